@@ -38,14 +38,21 @@ import (
 	"github.com/siglens/siglens/pkg/dashboards"
 	"github.com/siglens/siglens/pkg/hooks"
 	"github.com/siglens/siglens/pkg/instrumentation"
+	"github.com/siglens/siglens/pkg/integrations/graphite"
+	"github.com/siglens/siglens/pkg/integrations/prometheus/rules"
+	"github.com/siglens/siglens/pkg/integrations/prometheus/scrape"
+	"github.com/siglens/siglens/pkg/integrations/statsd"
 	"github.com/siglens/siglens/pkg/localnodeid"
+	"github.com/siglens/siglens/pkg/otlp"
 	"github.com/siglens/siglens/pkg/querytracker"
 	"github.com/siglens/siglens/pkg/retention"
 	"github.com/siglens/siglens/pkg/scroll"
 	"github.com/siglens/siglens/pkg/segment/memory/limit"
 	"github.com/siglens/siglens/pkg/segment/query"
+	"github.com/siglens/siglens/pkg/segment/tracing/depgraph"
 	tracinghandler "github.com/siglens/siglens/pkg/segment/tracing/handler"
 	"github.com/siglens/siglens/pkg/segment/writer"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/rollup"
 	entryHandler "github.com/siglens/siglens/pkg/server/ingest"
 	server_utils "github.com/siglens/siglens/pkg/server/utils"
 
@@ -330,6 +337,15 @@ func StartSiglensServer(nodeType commonconfig.DeploymentType, nodeID string) err
 
 	go tracinghandler.MonitorSpansHealth()
 	go tracinghandler.DependencyGraphThread()
+	go depgraph.RunFlushLoop()
+	if ingestNode && config.IsMetricsRollupEnabled() {
+		go rollup.RunCompactionLoop()
+	}
+	if ingestNode {
+		scrape.InitScrapeManager()
+		statsd.InitStatsdListener()
+		graphite.InitGraphiteListener()
+	}
 	go entryHandler.MonitorDiskUsage()
 
 	return nil
@@ -340,6 +356,16 @@ func ShutdownSiglensServer(gotSigusr1 bool) {
 		hook(gotSigusr1)
 	}
 
+	// stop recording rules, scrapes, statsd and graphite so that no samples are written after the flush
+	rules.StopRecordingRules()
+	scrape.StopScrapeManager()
+	statsd.StopStatsdListener()
+	graphite.StopGraphiteListener()
+
+	// decide buffered traces so that kept ones are written before the final flush
+	otlp.FlushTailSampler()
+	depgraph.FlushEdges(true)
+
 	// force write unsaved data to segfile and flush bloom, range, updates to meta
 	writer.ForcedFlushToSegfile()
 	metrics.ForceFlushMetricsBlock()
@@ -0,0 +1,485 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/segment/results/mresults"
+	"github.com/siglens/siglens/pkg/segment/structs"
+	sutils "github.com/siglens/siglens/pkg/segment/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long an instance is kept after it resolved and stopped matching.
+const ALERT_INSTANCE_RETENTION = 24 * time.Hour
+
+// How many rows of the result of the query of an alert the notification
+// templates are given.
+const NOTIFICATION_RESULT_ROWS = 10
+
+// matchedInstance is a group-by row or a series that matched the condition of
+// an alert.
+type matchedInstance struct {
+	labels   map[string]string
+	value    float64
+	baseline *float64 // for anomaly conditions
+	score    *float64
+}
+
+type instanceTransition struct {
+	instance  *alertutils.AlertInstance
+	fromState alertutils.AlertState
+}
+
+type alertEvaluation struct {
+	instances   []*alertutils.AlertInstance // all the instances after the evaluation
+	changed     []*alertutils.AlertInstance
+	deleted     []string // fingerprints
+	transitions []instanceTransition
+}
+
+/*
+Applies an evaluation of an alert to its instances. A matched instance becomes
+Pending, and Firing once it matched intervalCount evaluations in a row. Pending
+and Firing instances that did not match become Normal. Normal instances are
+deleted ALERT_INSTANCE_RETENTION after they last matched.
+*/
+func applyAlertEvaluation(alertId string, existing []*alertutils.AlertInstance, matched []matchedInstance,
+	intervalCount uint64, now time.Time) *alertEvaluation {
+
+	if intervalCount == 0 {
+		intervalCount = 1
+	}
+
+	eval := &alertEvaluation{}
+	byFingerprint := make(map[string]*alertutils.AlertInstance, len(existing))
+	for _, instance := range existing {
+		byFingerprint[instance.Fingerprint] = instance
+	}
+
+	seen := make(map[string]struct{}, len(matched))
+	for _, match := range matched {
+		fingerprint := alertutils.GetInstanceFingerprint(match.labels)
+		if _, ok := seen[fingerprint]; ok {
+			continue
+		}
+		seen[fingerprint] = struct{}{}
+
+		instance, ok := byFingerprint[fingerprint]
+		if !ok {
+			instance = &alertutils.AlertInstance{
+				AlertId:     alertId,
+				Fingerprint: fingerprint,
+				Labels:      match.labels,
+				State:       alertutils.Normal,
+			}
+			byFingerprint[fingerprint] = instance
+		}
+
+		fromState := instance.State
+		instance.Value = match.value
+		instance.Baseline = match.baseline
+		instance.Score = match.score
+		instance.LastEvaluatedAt = now
+		instance.ConsecutiveMatches++
+		if !alertutils.IsAlertStatePendingOrFiring(instance.State) {
+			instance.State = alertutils.Pending
+			instance.ActiveAt = now
+		}
+		if instance.State == alertutils.Pending && instance.ConsecutiveMatches >= intervalCount {
+			instance.State = alertutils.Firing
+			instance.FiredAt = now
+		}
+		eval.changed = append(eval.changed, instance)
+		if instance.State != fromState {
+			eval.transitions = append(eval.transitions, instanceTransition{instance: instance, fromState: fromState})
+		}
+	}
+
+	for _, instance := range existing {
+		if _, ok := seen[instance.Fingerprint]; ok {
+			continue
+		}
+		if alertutils.IsAlertStatePendingOrFiring(instance.State) {
+			fromState := instance.State
+			instance.State = alertutils.Normal
+			instance.ConsecutiveMatches = 0
+			instance.ResolvedAt = now
+			instance.LastEvaluatedAt = now
+			eval.changed = append(eval.changed, instance)
+			eval.transitions = append(eval.transitions, instanceTransition{instance: instance, fromState: fromState})
+			continue
+		}
+		lastActive := instance.ResolvedAt
+		if lastActive.IsZero() {
+			lastActive = instance.LastEvaluatedAt
+		}
+		if now.Sub(lastActive) >= ALERT_INSTANCE_RETENTION {
+			eval.deleted = append(eval.deleted, instance.Fingerprint)
+			delete(byFingerprint, instance.Fingerprint)
+		}
+	}
+
+	for _, instance := range byFingerprint {
+		eval.instances = append(eval.instances, instance)
+	}
+	sort.Slice(eval.instances, func(i, j int) bool {
+		return eval.instances[i].Fingerprint < eval.instances[j].Fingerprint
+	})
+	return eval
+}
+
+// The state of an alert is Firing when any instance fires, otherwise Pending
+// when any instance is pending, otherwise Normal.
+func getAggregateAlertState(instances []*alertutils.AlertInstance) alertutils.AlertState {
+	state := alertutils.Normal
+	for _, instance := range instances {
+		if instance.State == alertutils.Firing {
+			return alertutils.Firing
+		}
+		if instance.State == alertutils.Pending {
+			state = alertutils.Pending
+		}
+	}
+	return state
+}
+
+func getAlertStateEventDescription(state alertutils.AlertState) string {
+	switch state {
+	case alertutils.Firing:
+		return alertutils.AlertFiring
+	case alertutils.Pending:
+		return alertutils.AlertPending
+	default:
+		return alertutils.AlertNormal
+	}
+}
+
+/*
+Updates the instances of the alert with the result of an evaluation, records
+the state changes of the instances in the alert history and sends the
+notification. Firing notifications name the firing instances and the ones that
+resolved in this evaluation. The results are the first rows of the result of
+the query, for the notification templates.
+*/
+func handleAlertInstances(alertToEvaluate *alertutils.AlertDetails, matched []matchedInstance, alertDataMessage string,
+	results []map[string]interface{}) error {
+	existing, err := databaseObj.GetAlertInstances(alertToEvaluate.AlertId)
+	if err != nil {
+		log.Errorf("ALERTSERVICE: handleAlertInstances: Error getting alert instances. Alert=%+v & err=%+v.", alertToEvaluate.AlertName, err)
+		return err
+	}
+
+	now := time.Now().UTC()
+	intervalCount := uint64(1)
+	if alertToEvaluate.EvalInterval > 0 {
+		intervalCount = alertToEvaluate.EvalWindow / alertToEvaluate.EvalInterval
+	}
+	eval := applyAlertEvaluation(alertToEvaluate.AlertId, existing, matched, intervalCount, now)
+	for _, instance := range eval.changed {
+		instance.Annotations = alertutils.ExpandAnnotations(alertToEvaluate.Annotations, instance.Labels, instance.Value,
+			config.GetQueryServerBaseUrl())
+	}
+
+	err = databaseObj.UpdateAlertInstances(alertToEvaluate.AlertId, eval.changed, eval.deleted)
+	if err != nil {
+		log.Errorf("ALERTSERVICE: handleAlertInstances: Error updating alert instances. Alert=%+v & err=%+v.", alertToEvaluate.AlertName, err)
+		return err
+	}
+
+	var resolved []*alertutils.AlertInstance
+	for _, transition := range eval.transitions {
+		instance := transition.instance
+		if transition.fromState == alertutils.Firing && instance.State == alertutils.Normal {
+			resolved = append(resolved, instance)
+		}
+		alertEvent := alertutils.AlertHistoryDetails{
+			AlertId:          alertToEvaluate.AlertId,
+			AlertType:        alertToEvaluate.AlertType,
+			AlertState:       instance.State,
+			EventDescription: getAlertStateEventDescription(instance.State),
+			UserName:         alertutils.SystemGeneratedAlert,
+			EventTriggeredAt: now,
+			Fingerprint:      instance.Fingerprint,
+			Labels:           instance.Labels,
+		}
+		_, err = databaseObj.CreateAlertHistory(&alertEvent)
+		if err != nil {
+			log.Errorf("ALERTSERVICE: handleAlertInstances: could not create instance event in alert history. Alert=%+v & err=%+v.", alertToEvaluate.AlertName, err)
+		}
+	}
+
+	newAlertState := getAggregateAlertState(eval.instances)
+	var alertNotificationSent bool
+
+	routing, err := databaseObj.GetNotificationRouting(alertToEvaluate.OrgId)
+	if err != nil {
+		log.Errorf("ALERTSERVICE: handleAlertInstances: Error getting notification routing, notifying the contact point of the alert. Alert=%+v & err=%+v.", alertToEvaluate.AlertName, err)
+	}
+
+	// With a notification routing the dispatcher groups the instances and notifies the routed contact points.
+	// Otherwise a Firing notification is sent while any instance fires; the cooldown period on the Notification Handler
+	// decides if it is sent again. The Normal notification is only sent if the previous notification was Firing.
+	if routing != nil {
+		alertDispatcher.dispatch(alertToEvaluate, routing, eval.instances, alertDataMessage, results, now)
+	} else {
+		alertNotificationSent = notifyAlertInstances(alertToEvaluate, newAlertState, eval.instances, resolved, alertDataMessage, results)
+	}
+
+	err = updateAlertStateAndCreateAlertHistory(alertToEvaluate, newAlertState, getAlertStateEventDescription(newAlertState), alertNotificationSent)
+	if err != nil {
+		log.Errorf("ALERTSERVICE: handleAlertInstances: Error in updateAlertStateAndCreateAlertHistory. AlertState=%v, Alert=%+v & err=%+v", newAlertState, alertToEvaluate.AlertName, err)
+	}
+	return err
+}
+
+// Notifies the contact point of the alert directly, for orgs without a
+// notification routing.
+func notifyAlertInstances(alertToEvaluate *alertutils.AlertDetails, newAlertState alertutils.AlertState,
+	instances []*alertutils.AlertInstance, resolved []*alertutils.AlertInstance, alertDataMessage string,
+	results []map[string]interface{}) bool {
+
+	var alertNotificationSent bool
+	var err error
+	switch newAlertState {
+	case alertutils.Firing:
+		var notified []*alertutils.AlertInstance
+		for _, instance := range instances {
+			if instance.State == alertutils.Firing {
+				notified = append(notified, instance)
+			}
+		}
+		notified = append(notified, resolved...)
+		alertNotificationSent, err = NotifyAlertHandlerRequest(alertToEvaluate.AlertId, newAlertState, alertDataMessage, notified, results)
+		if err != nil {
+			log.Errorf("notifyAlertInstances: Could not send Alert Notification. found error = %v", err)
+		}
+	case alertutils.Normal:
+		alertNotificationSent, err = NotifyAlertHandlerRequest(alertToEvaluate.AlertId, alertutils.Normal, "The Alert State has been updated to Normal.", resolved, results)
+		if err != nil {
+			log.Errorf("notifyAlertInstances: Could not send Alert Notification. found error = %v", err)
+		}
+	}
+	return alertNotificationSent
+}
+
+// Returns the series that matched the condition as instances labeled with the
+// labels of the series. The value is the one of the latest matching point.
+func getMetricsMatchedInstances(alertsDataList []alertutils.MetricAlertData) []matchedInstance {
+	latest := make(map[string]alertutils.MetricAlertData)
+	for _, alertData := range alertsDataList {
+		current, ok := latest[alertData.SeriesId]
+		if !ok || alertData.Timestamp > current.Timestamp {
+			latest[alertData.SeriesId] = alertData
+		}
+	}
+
+	seriesIds := make([]string, 0, len(latest))
+	for seriesId := range latest {
+		seriesIds = append(seriesIds, seriesId)
+	}
+	sort.Strings(seriesIds)
+
+	matched := make([]matchedInstance, 0, len(seriesIds))
+	for _, seriesId := range seriesIds {
+		matched = append(matched, matchedInstance{labels: getMetricSeriesLabels(seriesId), value: latest[seriesId].Value})
+	}
+	return matched
+}
+
+// Returns the group-by rows of a logs query that matched the condition, as
+// instances labeled with their group-by values.
+func getLogsQueryMatchedInstances(searchResponse *structs.PipeSearchResponseOuter, queryCond *alertutils.AlertQueryCondition, alertValue float64) ([]matchedInstance, error) {
+	values, err := getLogsQueryValues(searchResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []matchedInstance
+	for _, value := range values {
+		if evaluateConditions(value.value, queryCond, alertValue) {
+			matched = append(matched, value)
+		}
+	}
+	return matched, nil
+}
+
+// Returns the value of every group-by row of a logs query, labeled with its
+// group-by values.
+func getLogsQueryValues(searchResponse *structs.PipeSearchResponseOuter) ([]matchedInstance, error) {
+	if searchResponse == nil {
+		err := fmt.Errorf("ALERTSERVICE: getLogsQueryValues: searchResponse is nil")
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	if len(searchResponse.MeasureAggregationCols) > 0 {
+		return getRecordsMeasureAggsValues(searchResponse)
+	} else if len(searchResponse.MeasureResults) > 0 {
+		return getMeasureResultsValues(searchResponse)
+	}
+
+	return nil, nil
+}
+
+func getMeasureResultsValues(searchResponse *structs.PipeSearchResponseOuter) ([]matchedInstance, error) {
+	firstBucket := searchResponse.MeasureResults[0]
+	if len(firstBucket.MeasureVal) > 1 {
+		err := fmt.Errorf("ALERTSERVICE: getMeasureResultsValues: The Query has more than 1 Measure Column")
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	var values []matchedInstance
+	for _, bucket := range searchResponse.MeasureResults {
+		for _, measureVal := range bucket.MeasureVal {
+			floatVal, err := sutils.ParseHumanizedValueToFloat(measureVal)
+			if err != nil {
+				log.Errorf("ALERTSERVICE: getMeasureResultsValues: Error converting value to float. Value=%v, err=%v", measureVal, err)
+				continue
+			}
+			labels := make(map[string]string, len(bucket.GroupByValues))
+			for i, groupByValue := range bucket.GroupByValues {
+				if i < len(searchResponse.GroupByCols) {
+					labels[searchResponse.GroupByCols[i]] = groupByValue
+				}
+			}
+			values = append(values, matchedInstance{labels: labels, value: floatVal})
+		}
+	}
+
+	return values, nil
+}
+
+func getRecordsMeasureAggsValues(searchResponse *structs.PipeSearchResponseOuter) ([]matchedInstance, error) {
+	if len(searchResponse.MeasureAggregationCols) > 1 {
+		err := fmt.Errorf("ALERTSERVICE: getRecordsMeasureAggsValues: The Query has more than 1 Measure Column")
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	if len(searchResponse.RenameColumns) > 0 {
+		for i, measureCol := range searchResponse.MeasureAggregationCols {
+			if newColName, ok := searchResponse.RenameColumns[measureCol]; ok {
+				searchResponse.MeasureAggregationCols[i] = newColName
+			}
+		}
+	}
+
+	var values []matchedInstance
+	for _, record := range searchResponse.Hits.Hits {
+		for _, col := range searchResponse.MeasureAggregationCols {
+			value, ok := record[col]
+			if !ok {
+				continue
+			}
+			floatVal, err := sutils.ParseHumanizedValueToFloat(value)
+			if err != nil {
+				log.Errorf("ALERTSERVICE: getRecordsMeasureAggsValues: Error converting value to float. Value=%v, err=%v", value, err)
+				continue
+			}
+			values = append(values, matchedInstance{labels: getRecordGroupLabels(searchResponse, record, col), value: floatVal})
+		}
+	}
+
+	return values, nil
+}
+
+// The group-by columns of the query label a record. Without them, every
+// column of the record except the measure column is a label.
+func getRecordGroupLabels(searchResponse *structs.PipeSearchResponseOuter, record map[string]interface{}, measureCol string) map[string]string {
+	labels := make(map[string]string)
+	if len(searchResponse.GroupByCols) > 0 {
+		for _, col := range searchResponse.GroupByCols {
+			if value, ok := record[col]; ok {
+				labels[col] = fmt.Sprint(value)
+			}
+		}
+		return labels
+	}
+
+	for col, value := range record {
+		if col != measureCol {
+			labels[col] = fmt.Sprint(value)
+		}
+	}
+	return labels
+}
+
+// Returns the first rows of the result of a logs query: the group-by rows of
+// a stats query, otherwise the records.
+func getLogsQueryResultRows(searchResponse *structs.PipeSearchResponseOuter, limit int) []map[string]interface{} {
+	if searchResponse == nil {
+		return nil
+	}
+
+	rows := make([]map[string]interface{}, 0)
+	if len(searchResponse.MeasureAggregationCols) == 0 && len(searchResponse.MeasureResults) > 0 {
+		for _, bucket := range searchResponse.MeasureResults {
+			if len(rows) >= limit {
+				break
+			}
+			row := make(map[string]interface{}, len(bucket.GroupByValues)+len(bucket.MeasureVal))
+			for i, groupByValue := range bucket.GroupByValues {
+				if i < len(searchResponse.GroupByCols) {
+					row[searchResponse.GroupByCols[i]] = groupByValue
+				}
+			}
+			for col, value := range bucket.MeasureVal {
+				row[col] = value
+			}
+			rows = append(rows, row)
+		}
+		return rows
+	}
+
+	for _, record := range searchResponse.Hits.Hits {
+		if len(rows) >= limit {
+			break
+		}
+		rows = append(rows, record)
+	}
+	return rows
+}
+
+// Returns the first series of the result of a metrics query, by series id, as
+// rows of their labels and their latest value.
+func getMetricsQueryResultRows(queryRes *mresults.MetricsResult, limit int) []map[string]interface{} {
+	if queryRes == nil {
+		return nil
+	}
+
+	rows := make([]map[string]interface{}, 0, limit)
+	for _, series := range getMetricsQueryValues(queryRes) {
+		if len(rows) >= limit {
+			break
+		}
+		row := make(map[string]interface{}, len(series.labels)+1)
+		for name, labelValue := range series.labels {
+			row[name] = labelValue
+		}
+		row["value"] = series.value
+		rows = append(rows, row)
+	}
+	return rows
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/siglens/siglens/pkg/segment/structs"
+	"github.com/stretchr/testify/assert"
+)
+
+func getInstanceByLabel(instances []*alertutils.AlertInstance, key, value string) *alertutils.AlertInstance {
+	for _, instance := range instances {
+		if instance.Labels[key] == value {
+			return instance
+		}
+	}
+	return nil
+}
+
+func Test_applyAlertEvaluation(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	web01 := matchedInstance{labels: map[string]string{"host": "web01"}, value: 97}
+	web02 := matchedInstance{labels: map[string]string{"host": "web02"}, value: 91}
+
+	// both hosts match; they are pending until they match 2 evaluations in a row
+	eval := applyAlertEvaluation("a1", nil, []matchedInstance{web01, web02}, 2, now)
+	assert.Equal(t, 2, len(eval.instances))
+	assert.Equal(t, 2, len(eval.changed))
+	assert.Equal(t, 2, len(eval.transitions))
+	assert.Equal(t, alertutils.Pending, getAggregateAlertState(eval.instances))
+	assert.Equal(t, now, getInstanceByLabel(eval.instances, "host", "web01").ActiveAt)
+
+	// only web01 still matches, so it fires and web02 resolves
+	now = now.Add(time.Minute)
+	eval = applyAlertEvaluation("a1", eval.instances, []matchedInstance{web01}, 2, now)
+	instance01 := getInstanceByLabel(eval.instances, "host", "web01")
+	instance02 := getInstanceByLabel(eval.instances, "host", "web02")
+	assert.Equal(t, alertutils.Firing, instance01.State)
+	assert.Equal(t, now, instance01.FiredAt)
+	assert.Equal(t, uint64(2), instance01.ConsecutiveMatches)
+	assert.Equal(t, alertutils.Normal, instance02.State)
+	assert.Equal(t, uint64(0), instance02.ConsecutiveMatches)
+	assert.Equal(t, now, instance02.ResolvedAt)
+	assert.Equal(t, 2, len(eval.transitions))
+	assert.Equal(t, alertutils.Firing, getAggregateAlertState(eval.instances))
+
+	// web01 keeps firing without a transition, web02 is unchanged
+	now = now.Add(time.Minute)
+	eval = applyAlertEvaluation("a1", eval.instances, []matchedInstance{web01}, 2, now)
+	assert.Equal(t, 0, len(eval.transitions))
+	assert.Equal(t, 1, len(eval.changed))
+	assert.Equal(t, alertutils.Firing, getInstanceByLabel(eval.instances, "host", "web01").State)
+
+	// resolved instances are deleted after the retention
+	now = now.Add(ALERT_INSTANCE_RETENTION)
+	eval = applyAlertEvaluation("a1", eval.instances, nil, 2, now)
+	assert.Equal(t, []string{alertutils.GetInstanceFingerprint(web02.labels)}, eval.deleted)
+	assert.Equal(t, 1, len(eval.instances))
+	assert.Equal(t, alertutils.Firing, eval.transitions[0].fromState)
+	assert.Equal(t, alertutils.Normal, getAggregateAlertState(eval.instances))
+
+	// with a single evaluation interval the instance fires right away
+	eval = applyAlertEvaluation("a2", nil, []matchedInstance{web01}, 1, now)
+	assert.Equal(t, alertutils.Firing, eval.instances[0].State)
+	assert.Equal(t, alertutils.Normal, eval.transitions[0].fromState)
+}
+
+func Test_getLogsQueryMatchedInstances(t *testing.T) {
+	condition := alertutils.IsAbove
+	searchResponse := &structs.PipeSearchResponseOuter{
+		GroupByCols: []string{"host", "region"},
+		MeasureResults: []*structs.BucketHolder{
+			{GroupByValues: []string{"web01", "us"}, MeasureVal: map[string]interface{}{"count(*)": 120}},
+			{GroupByValues: []string{"web02", "eu"}, MeasureVal: map[string]interface{}{"count(*)": 12}},
+		},
+	}
+	matched, err := getLogsQueryMatchedInstances(searchResponse, &condition, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, []matchedInstance{{labels: map[string]string{"host": "web01", "region": "us"}, value: 120}}, matched)
+
+	searchResponse = &structs.PipeSearchResponseOuter{
+		MeasureAggregationCols: []string{"avg(latency)"},
+		RenameColumns:          map[string]string{"avg(latency)": "avgLatency"},
+		Hits: structs.PipeSearchResponse{Hits: []map[string]interface{}{
+			{"service": "api", "avgLatency": 250.5},
+			{"service": "web", "avgLatency": 20},
+		}},
+	}
+	matched, err = getLogsQueryMatchedInstances(searchResponse, &condition, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, []matchedInstance{{labels: map[string]string{"service": "api"}, value: 250.5}}, matched)
+
+	isMatched, err := evaluateLogsQueryConditions(searchResponse, &condition, 1000)
+	assert.Nil(t, err)
+	assert.False(t, isMatched)
+
+	_, err = getLogsQueryMatchedInstances(nil, &condition, 100)
+	assert.NotNil(t, err)
+}
+
+func Test_getMetricsMatchedInstances(t *testing.T) {
+	matched := getMetricsMatchedInstances([]alertutils.MetricAlertData{
+		{SeriesId: "cpu{host:web01,", Timestamp: 10, Value: 95},
+		{SeriesId: "cpu{host:web01,", Timestamp: 20, Value: 97},
+		{SeriesId: "cpu{host:web02,", Timestamp: 10, Value: 91},
+	})
+	assert.Equal(t, []matchedInstance{
+		{labels: map[string]string{"host": "web01"}, value: 97},
+		{labels: map[string]string{"host": "web02"}, value: 91},
+	}, matched)
+}
+
+func Test_getInstancesMessage(t *testing.T) {
+	message := getInstancesMessage([]*alertutils.AlertInstance{
+		{Labels: map[string]string{"region": "us", "host": "web01"}, State: alertutils.Firing, Value: 97},
+		{Labels: map[string]string{"host": "web02"}, State: alertutils.Normal},
+	})
+	assert.Equal(t, "Firing instances:\n- host=web01, region=us (value: 97)\nResolved instances:\n- host=web02", message)
+
+	assert.Equal(t, "", getInstancesMessage([]*alertutils.AlertInstance{{State: alertutils.Firing}}))
+
+	assert.Equal(t, alertutils.GetInstanceFingerprint(map[string]string{"a": "1", "b": "2"}),
+		alertutils.GetInstanceFingerprint(map[string]string{"b": "2", "a": "1"}))
+	assert.NotEqual(t, alertutils.GetInstanceFingerprint(map[string]string{"a": "1"}),
+		alertutils.GetInstanceFingerprint(map[string]string{"a": "2"}))
+}
+
+func Test_removeSilencedInstances(t *testing.T) {
+	now := time.Now().UTC()
+	alert := &alertutils.AlertDetails{AlertConfig: alertutils.AlertConfig{AlertName: "High CPU"}}
+	web01 := &alertutils.AlertInstance{Labels: map[string]string{"host": "web01"}, State: alertutils.Firing}
+	web02 := &alertutils.AlertInstance{Labels: map[string]string{"host": "web02"}, State: alertutils.Firing}
+	instances := []*alertutils.AlertInstance{web01, web02}
+
+	silenceWeb01 := &alertutils.Silence{
+		Matchers: alertutils.SilenceMatchers{{Name: "host", Value: "web01"}},
+		StartsAt: now.Add(-time.Minute),
+		EndsAt:   now.Add(time.Hour),
+	}
+	remaining, silenced := removeSilencedInstances(alert, instances, []*alertutils.Silence{silenceWeb01}, nil, now)
+	assert.False(t, silenced)
+	assert.Equal(t, []*alertutils.AlertInstance{web02}, remaining)
+
+	silenceAlert := &alertutils.Silence{
+		Matchers: alertutils.SilenceMatchers{{Name: "alertname", Value: "High CPU"}},
+		StartsAt: now.Add(-time.Minute),
+		EndsAt:   now.Add(time.Hour),
+	}
+	remaining, silenced = removeSilencedInstances(alert, instances, []*alertutils.Silence{silenceAlert}, nil, now)
+	assert.True(t, silenced)
+	assert.Equal(t, 0, len(remaining))
+
+	// without instances the labels of the alert are matched
+	_, silenced = removeSilencedInstances(alert, nil, []*alertutils.Silence{silenceAlert}, nil, now)
+	assert.True(t, silenced)
+	_, silenced = removeSilencedInstances(alert, nil, []*alertutils.Silence{silenceWeb01}, nil, now)
+	assert.False(t, silenced)
+
+	remaining, silenced = removeSilencedInstances(alert, instances, nil, nil, now)
+	assert.False(t, silenced)
+	assert.Equal(t, instances, remaining)
+}
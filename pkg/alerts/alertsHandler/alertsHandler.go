@@ -59,9 +59,41 @@ type database interface {
 	GetCoolDownDetails(alert_id string) (uint64, time.Time, error)
 	GetAlertNotification(alert_id string) (*alertutils.Notification, error)
 	GetContactDetails(alert_id string) (string, string, string, error)
-	GetEmailAndChannelID(contact_id string) ([]string, []alertutils.SlackTokenConfig, []alertutils.WebHookConfig, error)
+	GetContact(contact_id string) (*alertutils.Contact, error)
 	UpdateAlertStateAndNotificationDetails(alertId string, alertState alertutils.AlertState, updateNotificationState bool) error
 	DeleteContactPoint(contact_id string) error
+	GetAlertInstances(alert_id string) ([]*alertutils.AlertInstance, error)
+	UpdateAlertInstances(alert_id string, instances []*alertutils.AlertInstance, deletedFingerprints []string) error
+	CreateSilence(silence *alertutils.Silence) error
+	GetSilence(silence_id string) (*alertutils.Silence, error)
+	GetAllSilences(org_id int64) ([]*alertutils.Silence, error)
+	UpdateSilence(silence *alertutils.Silence) error
+	DeleteSilence(silence_id string) error
+	CreateMaintenanceWindow(window *alertutils.MaintenanceWindow) error
+	GetAllMaintenanceWindows(org_id int64) ([]*alertutils.MaintenanceWindow, error)
+	UpdateMaintenanceWindow(window *alertutils.MaintenanceWindow) error
+	DeleteMaintenanceWindow(window_id string) error
+	GetNotificationRouting(org_id int64) (*alertutils.NotificationRouting, error)
+	UpdateNotificationRouting(routing *alertutils.NotificationRouting) error
+	DeleteNotificationRouting(org_id int64) error
+	AcquireLease(name string, holder string, ttl time.Duration, now time.Time) (bool, *alertutils.AlertLease, error)
+	GetLease(name string) (*alertutils.AlertLease, error)
+	ReleaseLease(name string, holder string) error
+	GetNotificationLogEntry(group_key string) (*alertutils.NotificationLogEntry, error)
+	UpdateNotificationLogEntry(entry *alertutils.NotificationLogEntry) error
+	DeleteNotificationLogEntry(group_key string) error
+	CreateNotificationDelivery(delivery *alertutils.NotificationDelivery) error
+	GetNotificationDelivery(delivery_id string) (*alertutils.NotificationDelivery, error)
+	GetDueNotificationDeliveries(now time.Time, limit int) ([]*alertutils.NotificationDelivery, error)
+	GetNotificationDeliveries(org_id int64, status alertutils.DeliveryStatus) ([]*alertutils.NotificationDelivery, error)
+	UpdateNotificationDelivery(delivery *alertutils.NotificationDelivery) error
+	DeleteNotificationDelivery(delivery_id string) error
+	AddNotificationDeliveryAttempt(attempt *alertutils.NotificationDeliveryAttempt) error
+	GetNotificationDeliveryAttempts(contact_id string, limit int) ([]*alertutils.NotificationDeliveryAttempt, error)
+	PruneNotificationDeliveryAttempts(keep int) error
+	AddOpenIncidents(incidents []*alertutils.OpenIncident) error
+	GetOpenIncidents(contact_id string, contact_type string, alert_ids []string) ([]*alertutils.OpenIncident, error)
+	DeleteOpenIncident(contact_id string, contact_type string, dedup_key string) error
 }
 
 var databaseObj database
@@ -91,6 +123,9 @@ func Disconnect() {
 	if databaseObj == nil {
 		return
 	}
+	if alertLeader != nil {
+		alertLeader.release()
+	}
 	databaseObj.CloseDb()
 }
 
@@ -128,6 +163,15 @@ func validateAlertTypeAndQuery(alertToBeCreated *alertutils.AlertDetails) (strin
 		return fmt.Sprintf("Alert Type: %v", alertToBeCreated.AlertType), fmt.Errorf("minion alerts are not supported")
 	}
 
+	err := alertutils.ValidateAnomalyConfig(alertToBeCreated.Condition, alertToBeCreated.Value, alertToBeCreated.Anomaly)
+	if err != nil {
+		return fmt.Sprintf("Condition: %v, Anomaly: %+v", alertToBeCreated.Condition, alertToBeCreated.Anomaly), err
+	}
+	err = validateLogsAnomalyBaseline(alertToBeCreated)
+	if err != nil {
+		return fmt.Sprintf("Condition: %v, Anomaly: %+v", alertToBeCreated.Condition, alertToBeCreated.Anomaly), err
+	}
+
 	return "", nil
 }
 
@@ -223,6 +267,7 @@ func processAlertSilence(ctx *fasthttp.RequestCtx, isSilence bool) {
 		}
 		alertDataObj.SilenceMinutes = request.SilenceMinutes
 		alertDataObj.SilenceEndTime = uint64(now.Add(time.Duration(request.SilenceMinutes) * time.Minute).Unix())
+		go acknowledgeAlertInstances(alertDataObj)
 	} else {
 		alertDataObj.SilenceMinutes = 0
 		alertDataObj.SilenceEndTime = 0
@@ -274,7 +319,7 @@ func ProcessTestContactPointRequest(ctx *fasthttp.RequestCtx) {
 			ChannelId: channelID,
 			SlToken:   slackToken,
 		}
-		err := sendSlack("Test Alert", "This is a test message to verify the Slack integration.", channel, alertutils.Normal, "")
+		err := sendSlack("Test Alert", "This is a test message to verify the Slack integration.", channel, alertutils.Normal, "", "")
 		if err != nil {
 			utils.SendError(ctx, err.Error(), "Error sending test message to slack. Request Body:"+string(ctx.PostBody()), err)
 			return
@@ -289,6 +334,46 @@ func ProcessTestContactPointRequest(ctx *fasthttp.RequestCtx) {
 			utils.SendError(ctx, fmt.Sprintf("Failed to verify webhook URL. Error=%v", err), "", err)
 			return
 		}
+	case "pagerduty":
+		routingKey, ok := testContactRequest.Settings["routing_key"].(string)
+		if !ok || routingKey == "" {
+			utils.SendError(ctx, "routing_key is required but is missing", "Request Body: "+string(ctx.PostBody()), nil)
+			return
+		}
+		err := sendTestIncident(func(state alertutils.AlertState, instances []*alertutils.AlertInstance) error {
+			return sendPagerDuty(routingKey, "Test Alert", testContactPointMessage, state, "", instances)
+		})
+		if err != nil {
+			utils.SendError(ctx, fmt.Sprintf("Failed to send test event to PagerDuty. Error=%v", err), "", err)
+			return
+		}
+	case "opsgenie":
+		config := alertutils.OpsgenieConfig{}
+		config.ApiKey, _ = testContactRequest.Settings["api_key"].(string)
+		config.ApiUrl, _ = testContactRequest.Settings["api_url"].(string)
+		config.Priority, _ = testContactRequest.Settings["priority"].(string)
+		if config.ApiKey == "" {
+			utils.SendError(ctx, "api_key is required but is missing", "Request Body: "+string(ctx.PostBody()), nil)
+			return
+		}
+		err := sendTestIncident(func(state alertutils.AlertState, instances []*alertutils.AlertInstance) error {
+			return sendOpsgenie(config, "Test Alert", testContactPointMessage, state, "", instances)
+		})
+		if err != nil {
+			utils.SendError(ctx, fmt.Sprintf("Failed to send test alert to Opsgenie. Error=%v", err), "", err)
+			return
+		}
+	case "teams":
+		webhookURL, ok := testContactRequest.Settings["webhook_url"].(string)
+		if !ok || webhookURL == "" {
+			utils.SendError(ctx, "webhook_url is required but is missing", "Request Body: "+string(ctx.PostBody()), nil)
+			return
+		}
+		err := sendTeams(webhookURL, "Test Alert", testContactPointMessage, alertutils.Normal, "", nil)
+		if err != nil {
+			utils.SendError(ctx, fmt.Sprintf("Failed to send test message to Teams. Error=%v", err), "", err)
+			return
+		}
 	default:
 		utils.SendError(ctx, "Invalid type", "Request Body:"+string(ctx.PostBody()), nil)
 		return
@@ -298,6 +383,23 @@ func ProcessTestContactPointRequest(ctx *fasthttp.RequestCtx) {
 	utils.WriteJsonResponse(ctx, map[string]interface{}{"message": "Successfully verified contact point"})
 }
 
+const testContactPointMessage = "This is a test message to verify the contact point integration."
+
+// Triggers a test incident and resolves it right away, so it does not stay
+// open in the incident management tool.
+func sendTestIncident(send func(state alertutils.AlertState, instances []*alertutils.AlertInstance) error) error {
+	instance := &alertutils.AlertInstance{
+		AlertId:     "siglens-test",
+		Fingerprint: uuid.New().String(),
+		State:       alertutils.Firing,
+	}
+	if err := send(alertutils.Firing, []*alertutils.AlertInstance{instance}); err != nil {
+		return err
+	}
+	instance.State = alertutils.Normal
+	return send(alertutils.Normal, []*alertutils.AlertInstance{instance})
+}
+
 func testWebhookURL(webhookURL string, headers map[string]string) error {
 	client := alertutils.GetCertErrorForgivingHttpClient()
 	req, err := http.NewRequest("GET", webhookURL, nil)
@@ -478,16 +580,18 @@ func ProcessAlertHistoryRequest(ctx *fasthttp.RequestCtx) {
 	limit := ctx.QueryArgs().GetUintOrZero("limit")
 	offset := ctx.QueryArgs().GetUintOrZero("offset")
 	sortOrder := string(ctx.QueryArgs().Peek("sort_order"))
+	fingerprint := string(ctx.QueryArgs().Peek("fingerprint"))
 
 	if sortOrder != string(alertutils.ASC) && sortOrder != string(alertutils.DESC) {
 		sortOrder = string(alertutils.DESC)
 	}
 
 	alertHistory, err := databaseObj.GetAlertHistoryByAlertID(&alertutils.AlertHistoryQueryParams{
-		AlertId:   alertId,
-		SortOrder: alertutils.DB_SORT_ORDER(sortOrder),
-		Limit:     uint64(limit),
-		Offset:    uint64(offset),
+		AlertId:     alertId,
+		SortOrder:   alertutils.DB_SORT_ORDER(sortOrder),
+		Limit:       uint64(limit),
+		Offset:      uint64(offset),
+		Fingerprint: fingerprint,
 	})
 	if err != nil {
 		utils.SendError(ctx, fmt.Sprintf("Failed to get alert history. Error=%v", err), fmt.Sprintf("alert ID: %v", alertId), err)
@@ -500,6 +604,28 @@ func ProcessAlertHistoryRequest(ctx *fasthttp.RequestCtx) {
 	utils.WriteJsonResponse(ctx, responseBody)
 }
 
+// Returns the instances of the alert, one per group-by row or series that
+// matched its condition recently, with their states and labels.
+func ProcessGetAlertInstancesRequest(ctx *fasthttp.RequestCtx) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	responseBody := make(map[string]interface{})
+	alertId := utils.ExtractParamAsString(ctx.UserValue("alertID"))
+	instances, err := databaseObj.GetAlertInstances(alertId)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to get alert instances. Error=%v", err), fmt.Sprintf("alert ID: %v", alertId), err)
+		return
+	}
+
+	responseBody["count"] = len(instances)
+	responseBody["instances"] = instances
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
 // request body should contain alert_id only
 func ProcessDeleteAlertRequest(ctx *fasthttp.RequestCtx) {
 	if databaseObj == nil {
@@ -530,6 +656,7 @@ func ProcessDeleteAlertRequest(ctx *fasthttp.RequestCtx) {
 		utils.SendError(ctx, fmt.Sprintf("Failed to delete alert. Error=%v", err), fmt.Sprintf("alert name: %v", alertToBeRemoved.AlertName), err)
 		return
 	}
+	alertDispatcher.removeAlert(alertToBeRemoved.AlertId)
 
 	responseBody["message"] = "Alert deleted successfully"
 	utils.WriteJsonResponse(ctx, responseBody)
@@ -555,6 +682,11 @@ func ProcessCreateContactRequest(ctx *fasthttp.RequestCtx, org_id int64) {
 		return
 	}
 	contactToBeCreated.OrgId = org_id
+	err = alertutils.ValidateNotificationTemplates(contactToBeCreated.Templates)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Invalid notification template. Error=%v", err), fmt.Sprintf("contact name: %v", contactToBeCreated.ContactName), err)
+		return
+	}
 	err = databaseObj.CreateContact(contactToBeCreated)
 	if err != nil {
 		utils.SendError(ctx, fmt.Sprintf("Failed to create contact. Error=%v", err), fmt.Sprintf("contact name: %v", contactToBeCreated.ContactName), err)
@@ -601,6 +733,11 @@ func ProcessUpdateContactRequest(ctx *fasthttp.RequestCtx) {
 		utils.SendError(ctx, fmt.Sprintf("Failed to unmarshal json. Error=%v", err), "", err)
 		return
 	}
+	err = alertutils.ValidateNotificationTemplates(contactToBeUpdated.Templates)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Invalid notification template. Error=%v", err), fmt.Sprintf("contact name: %v", contactToBeUpdated.ContactName), err)
+		return
+	}
 	err = databaseObj.UpdateContactPoint(contactToBeUpdated)
 	if err != nil {
 		utils.SendError(ctx, fmt.Sprintf("Failed to update contact. Error=%v", err), fmt.Sprintf("contact name: %v", contactToBeUpdated.ContactName), err)
@@ -642,33 +779,30 @@ func ProcessDeleteContactRequest(ctx *fasthttp.RequestCtx) {
 	ctx.SetStatusCode(fasthttp.StatusOK)
 }
 
+// Starts the notification dispatcher and the election of the node that
+// evaluates the alerts. The elected node schedules the alerts of all orgs.
 func InitAlertingService(getMyIds func() []int64) {
 	if databaseObj == nil {
 		log.Errorf("InitAlertingService, err = %+v", invalidDatabaseProvider)
 		return
 	}
-	myids := getMyIds()
-	for _, myid := range myids {
+	alertDispatcher.notificationLog = databaseObj
+	alertDispatcher.start()
+	externalAlerts.start()
+	notificationQueue.store = databaseObj
+	notificationQueue.start()
 
-		// get all alerts from database
-		allAlerts, err := databaseObj.GetAllAlerts(myid)
-		if err != nil {
-			log.Errorf("InitAlertingService: unable to GetAllAlerts: ,err: %+v", err)
-		}
-		for _, alertInfo := range allAlerts {
-			alertDataObj, err := databaseObj.GetAlert(alertInfo.AlertId)
-			if err != nil {
-				log.Errorf("InitAlertingService: unable to GetAlert with alertId %v: ,err: %+v", alertInfo.AlertId, err)
-			}
-			if alertDataObj != nil {
-				_, err = AddCronJob(alertDataObj)
-				if err != nil {
-					log.Errorf("InitAlertingService: could not add a new CronJob corresponding to alert=%+v, err=%+v", alertDataObj.AlertName, err)
-					return
-				}
-			}
-		}
+	alertLeader = newAlertLeaderElector(databaseObj, getAlertNodeId())
+	alertLeader.onElected = func() {
+		syncAlertCronJobs(getMyIds)
+		externalAlerts.resume(time.Now().UTC())
+	}
+	alertLeader.onRenewed = func() { syncAlertCronJobsIfDue(getMyIds, time.Now().UTC()) }
+	alertLeader.onDeposed = func() {
+		unscheduleAllAlerts()
+		alertDispatcher.removeExternalAlerts()
 	}
+	alertLeader.start()
 }
 
 func InitMinionSearchService(getMyIds func() []int64) {
@@ -32,14 +32,18 @@ import (
 
 // mockDatabase implements the database interface for contact point methods only
 type mockDatabase struct {
-	contacts map[int64][]alertutils.Contact // org_id -> contacts
-	nextID   int64
+	contacts  map[int64][]alertutils.Contact // org_id -> contacts
+	alerts    map[int64][]*alertutils.AlertDetails
+	instances map[string][]*alertutils.AlertInstance
+	nextID    int64
 }
 
 func newMockDatabase() *mockDatabase {
 	return &mockDatabase{
-		contacts: make(map[int64][]alertutils.Contact),
-		nextID:   1,
+		contacts:  make(map[int64][]alertutils.Contact),
+		alerts:    make(map[int64][]*alertutils.AlertDetails),
+		instances: make(map[string][]*alertutils.AlertInstance),
+		nextID:    1,
 	}
 }
 
@@ -92,7 +96,9 @@ func (m *mockDatabase) CreateAlertHistory(alertHistoryDetails *alertutils.AlertH
 func (m *mockDatabase) GetAlertHistoryByAlertID(alertHistoryParams *alertutils.AlertHistoryQueryParams) ([]*alertutils.AlertHistoryDetails, error) {
 	return nil, nil
 }
-func (m *mockDatabase) GetAllAlerts(orgId int64) ([]*alertutils.AlertDetails, error) { return nil, nil }
+func (m *mockDatabase) GetAllAlerts(orgId int64) ([]*alertutils.AlertDetails, error) {
+	return m.alerts[orgId], nil
+}
 func (m *mockDatabase) CreateMinionSearch(alertInfo *alertutils.MinionSearch) (alertutils.MinionSearch, error) {
 	return alertutils.MinionSearch{}, nil
 }
@@ -117,12 +123,115 @@ func (m *mockDatabase) GetAlertNotification(alert_id string) (*alertutils.Notifi
 func (m *mockDatabase) GetContactDetails(alert_id string) (string, string, string, error) {
 	return "", "", "", nil
 }
-func (m *mockDatabase) GetEmailAndChannelID(contact_id string) ([]string, []alertutils.SlackTokenConfig, []alertutils.WebHookConfig, error) {
-	return nil, nil, nil, nil
+func (m *mockDatabase) GetContact(contact_id string) (*alertutils.Contact, error) {
+	for _, contacts := range m.contacts {
+		for i := range contacts {
+			if contacts[i].ContactId == contact_id {
+				return &contacts[i], nil
+			}
+		}
+	}
+	return nil, errors.New("contact not found")
 }
 func (m *mockDatabase) UpdateAlertStateAndNotificationDetails(alertId string, alertState alertutils.AlertState, updateNotificationState bool) error {
 	return nil
 }
+func (m *mockDatabase) GetAlertInstances(alert_id string) ([]*alertutils.AlertInstance, error) {
+	return m.instances[alert_id], nil
+}
+func (m *mockDatabase) UpdateAlertInstances(alert_id string, instances []*alertutils.AlertInstance, deletedFingerprints []string) error {
+	return nil
+}
+func (m *mockDatabase) CreateSilence(silence *alertutils.Silence) error {
+	return nil
+}
+func (m *mockDatabase) GetSilence(silence_id string) (*alertutils.Silence, error) {
+	return nil, nil
+}
+func (m *mockDatabase) GetAllSilences(org_id int64) ([]*alertutils.Silence, error) {
+	return nil, nil
+}
+func (m *mockDatabase) UpdateSilence(silence *alertutils.Silence) error {
+	return nil
+}
+func (m *mockDatabase) DeleteSilence(silence_id string) error {
+	return nil
+}
+func (m *mockDatabase) CreateMaintenanceWindow(window *alertutils.MaintenanceWindow) error {
+	return nil
+}
+func (m *mockDatabase) GetAllMaintenanceWindows(org_id int64) ([]*alertutils.MaintenanceWindow, error) {
+	return nil, nil
+}
+func (m *mockDatabase) UpdateMaintenanceWindow(window *alertutils.MaintenanceWindow) error {
+	return nil
+}
+func (m *mockDatabase) DeleteMaintenanceWindow(window_id string) error {
+	return nil
+}
+func (m *mockDatabase) GetNotificationRouting(org_id int64) (*alertutils.NotificationRouting, error) {
+	return nil, nil
+}
+func (m *mockDatabase) UpdateNotificationRouting(routing *alertutils.NotificationRouting) error {
+	return nil
+}
+func (m *mockDatabase) DeleteNotificationRouting(org_id int64) error {
+	return nil
+}
+func (m *mockDatabase) AcquireLease(name string, holder string, ttl time.Duration, now time.Time) (bool, *alertutils.AlertLease, error) {
+	return true, &alertutils.AlertLease{Name: name, Holder: holder, Term: 1, ExpiresAtMs: now.Add(ttl).UnixMilli()}, nil
+}
+func (m *mockDatabase) GetLease(name string) (*alertutils.AlertLease, error) {
+	return nil, nil
+}
+func (m *mockDatabase) ReleaseLease(name string, holder string) error {
+	return nil
+}
+func (m *mockDatabase) GetNotificationLogEntry(group_key string) (*alertutils.NotificationLogEntry, error) {
+	return nil, nil
+}
+func (m *mockDatabase) UpdateNotificationLogEntry(entry *alertutils.NotificationLogEntry) error {
+	return nil
+}
+func (m *mockDatabase) DeleteNotificationLogEntry(group_key string) error {
+	return nil
+}
+func (m *mockDatabase) CreateNotificationDelivery(delivery *alertutils.NotificationDelivery) error {
+	return nil
+}
+func (m *mockDatabase) GetNotificationDelivery(delivery_id string) (*alertutils.NotificationDelivery, error) {
+	return nil, nil
+}
+func (m *mockDatabase) GetDueNotificationDeliveries(now time.Time, limit int) ([]*alertutils.NotificationDelivery, error) {
+	return nil, nil
+}
+func (m *mockDatabase) GetNotificationDeliveries(org_id int64, status alertutils.DeliveryStatus) ([]*alertutils.NotificationDelivery, error) {
+	return nil, nil
+}
+func (m *mockDatabase) UpdateNotificationDelivery(delivery *alertutils.NotificationDelivery) error {
+	return nil
+}
+func (m *mockDatabase) DeleteNotificationDelivery(delivery_id string) error {
+	return nil
+}
+func (m *mockDatabase) AddNotificationDeliveryAttempt(attempt *alertutils.NotificationDeliveryAttempt) error {
+	return nil
+}
+func (m *mockDatabase) GetNotificationDeliveryAttempts(contact_id string, limit int) ([]*alertutils.NotificationDeliveryAttempt, error) {
+	return nil, nil
+}
+func (m *mockDatabase) PruneNotificationDeliveryAttempts(keep int) error {
+	return nil
+}
+func (m *mockDatabase) AddOpenIncidents(incidents []*alertutils.OpenIncident) error {
+	return nil
+}
+func (m *mockDatabase) GetOpenIncidents(contact_id string, contact_type string, alert_ids []string) ([]*alertutils.OpenIncident, error) {
+	return nil, nil
+}
+func (m *mockDatabase) DeleteOpenIncident(contact_id string, contact_type string, dedup_key string) error {
+	return nil
+}
 
 func Test_ContactPointCRUD(t *testing.T) {
 	// Setup
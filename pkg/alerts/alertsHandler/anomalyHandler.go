@@ -0,0 +1,281 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/siglens/siglens/pkg/ast/pipesearch"
+	"github.com/siglens/siglens/pkg/common/dtypeutils"
+	"github.com/siglens/siglens/pkg/integrations/prometheus/promql"
+	rutils "github.com/siglens/siglens/pkg/readerUtils"
+	"github.com/siglens/siglens/pkg/segment/results/mresults"
+	"github.com/siglens/siglens/pkg/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// The most earlier windows that a logs query is run over for the rolling
+// baseline of IsAnomalous. Alerts whose baseline window covers more windows of
+// the query are rejected when they are saved.
+const MAX_LOGS_BASELINE_WINDOWS = 24
+
+/*
+Returns the values that match an anomaly condition, with what they were
+compared with. The baselines are the earlier values of each group-by row or
+series by fingerprint: the samples of the rolling baseline for IsAnomalous, or
+the value of the last season or of the change interval ago.
+*/
+func getAnomalyMatchedInstances(alert *alertutils.AlertDetails, values []matchedInstance, baselines map[string][]float64) []matchedInstance {
+	var matched []matchedInstance
+	for _, value := range values {
+		samples := baselines[alertutils.GetInstanceFingerprint(value.labels)]
+
+		var baseline, score float64
+		switch alert.Condition {
+		case alertutils.IsAnomalous:
+			center, spread, ok := alertutils.GetRollingBaseline(samples, alert.Anomaly.GetMethod())
+			if !ok {
+				continue
+			}
+			baseline = center
+			score = alertutils.GetDeviationScore(value.value, center, spread)
+		case alertutils.DeviatesFromSeason, alertutils.ChangesByPercent:
+			if len(samples) == 0 {
+				continue
+			}
+			baseline = samples[len(samples)-1]
+			score = alertutils.GetPercentChange(value.value, baseline)
+		default:
+			continue
+		}
+
+		if !alert.Anomaly.IsAnomalousScore(score, alert.Value) {
+			continue
+		}
+		value.baseline = &baseline
+		if !math.IsInf(score, 0) {
+			value.score = &score
+		}
+		matched = append(matched, value)
+	}
+	return matched
+}
+
+// Returns the offsets from the evaluation window of the earlier windows that
+// the baseline of the condition comes from, oldest first.
+func getBaselineOffsets(alert *alertutils.AlertDetails, window time.Duration) []time.Duration {
+	switch alert.Condition {
+	case alertutils.IsAnomalous:
+		if window <= 0 {
+			return nil
+		}
+		count := int(math.Ceil(float64(alert.Anomaly.GetBaselineWindow()) / float64(window)))
+		offsets := make([]time.Duration, 0, count)
+		for i := count; i >= 1; i-- {
+			offsets = append(offsets, time.Duration(i)*window)
+		}
+		return offsets
+	case alertutils.DeviatesFromSeason:
+		return []time.Duration{alert.Anomaly.GetSeasonOffset()}
+	case alertutils.ChangesByPercent:
+		return []time.Duration{alert.Anomaly.GetChangeInterval()}
+	}
+	return nil
+}
+
+/*
+Evaluates an anomaly condition of a logs alert. The query is run again over
+earlier windows of the same length as the evaluation window: the windows of
+the baseline window before it for IsAnomalous, where each window is a sample,
+or the window a season or the change interval ago.
+*/
+func getLogsAnomalyMatchedInstances(alert *alertutils.AlertDetails, values []matchedInstance, timeRange *dtypeutils.TimeRange) ([]matchedInstance, error) {
+	if timeRange == nil {
+		return nil, fmt.Errorf("getLogsAnomalyMatchedInstances: the time range of the query is unknown")
+	}
+
+	window := time.Duration(timeRange.EndEpochMs-timeRange.StartEpochMs) * time.Millisecond
+	offsets := getBaselineOffsets(alert, window)
+	if len(offsets) > MAX_LOGS_BASELINE_WINDOWS {
+		return nil, fmt.Errorf("getLogsAnomalyMatchedInstances: the baseline window covers %v windows of the query, at most %v are supported",
+			len(offsets), MAX_LOGS_BASELINE_WINDOWS)
+	}
+	baselines := make(map[string][]float64)
+	for _, offset := range offsets {
+		offsetMs := uint64(offset.Milliseconds())
+		if offsetMs > timeRange.StartEpochMs {
+			continue
+		}
+		queryParams := alert.QueryParams
+		queryParams.StartTime = strconv.FormatUint(timeRange.StartEpochMs-offsetMs, 10)
+		queryParams.EndTime = strconv.FormatUint(timeRange.EndEpochMs-offsetMs, 10)
+
+		searchResponse, _, err := pipesearch.ProcessAlertsPipeSearchRequest(queryParams, alert.OrgId, nil)
+		if err != nil {
+			log.Errorf("getLogsAnomalyMatchedInstances: Error processing the logs query %v earlier. Alert=%+v, err=%+v", offset, alert.AlertName, err)
+			return nil, err
+		}
+		earlier, err := getLogsQueryValues(searchResponse)
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range earlier {
+			fingerprint := alertutils.GetInstanceFingerprint(value.labels)
+			baselines[fingerprint] = append(baselines[fingerprint], value.value)
+		}
+	}
+
+	return getAnomalyMatchedInstances(alert, values, baselines), nil
+}
+
+// Returns an error if the baseline window of an IsAnomalous logs alert covers
+// more than MAX_LOGS_BASELINE_WINDOWS windows of its query, since the query is
+// run once for each of them.
+func validateLogsAnomalyBaseline(alert *alertutils.AlertDetails) error {
+	if alert.AlertType != alertutils.AlertTypeLogs || alert.Condition != alertutils.IsAnomalous {
+		return nil
+	}
+	readJSON := map[string]interface{}{
+		"startEpoch": alert.QueryParams.StartTime,
+		"endEpoch":   alert.QueryParams.EndTime,
+	}
+	_, startEpoch, endEpoch, _, _, _, _, _ := pipesearch.ParseSearchBody(readJSON, utils.GetCurrentTimeInMs())
+	if endEpoch <= startEpoch {
+		return fmt.Errorf("the time range of the query should not be empty")
+	}
+
+	window := time.Duration(endEpoch-startEpoch) * time.Millisecond
+	count := len(getBaselineOffsets(alert, window))
+	if count > MAX_LOGS_BASELINE_WINDOWS {
+		return fmt.Errorf("the baseline window of %v covers %v windows of the %v query time range, at most %v are supported",
+			alert.Anomaly.GetBaselineWindow(), count, window, MAX_LOGS_BASELINE_WINDOWS)
+	}
+	return nil
+}
+
+/*
+Evaluates an anomaly condition of a metrics alert. Every point of a series in
+the baseline window before the evaluation window is a sample for IsAnomalous;
+otherwise the query is run over the window a season or the change interval
+ago and its latest points are the baselines.
+*/
+func getMetricsAnomalyMatchedInstances(alert *alertutils.AlertDetails, queryRes *mresults.MetricsResult, start uint32, end uint32) ([]matchedInstance, error) {
+	values := getMetricsQueryValues(queryRes)
+
+	var baselineStart, baselineEnd uint32
+	switch alert.Condition {
+	case alertutils.IsAnomalous:
+		baselineEnd = start
+		baselineStart = start - min(start, uint32(alert.Anomaly.GetBaselineWindow().Seconds()))
+	default:
+		offsets := getBaselineOffsets(alert, 0)
+		if len(offsets) == 0 {
+			return nil, nil
+		}
+		offset := uint32(offsets[0].Seconds())
+		if offset > start {
+			return nil, nil
+		}
+		baselineStart, baselineEnd = start-offset, end-offset
+	}
+
+	_, _, queries, formulas, errorLog, _, err := promql.ParseMetricTimeSeriesRequest([]byte(alert.MetricsQueryParamsString))
+	if err != nil {
+		log.Errorf("getMetricsAnomalyMatchedInstances: Error parsing metrics query. Alert=%+v, ErrLog=%v, err=%+v", alert.AlertName, errorLog, err)
+		return nil, err
+	}
+	baselineRes, _, _, extraMsgToLog, err := promql.ProcessMetricsQueryRequest(queries, formulas, baselineStart, baselineEnd, alert.OrgId, rutils.GetNextQid())
+	if err != nil {
+		log.Errorf("getMetricsAnomalyMatchedInstances: Error processing the baseline metrics query. Alert=%+v, ExtraMsgToLog=%v, err=%+v", alert.AlertName, extraMsgToLog, err)
+		return nil, err
+	}
+
+	var baselines map[string][]float64
+	if alert.Condition == alertutils.IsAnomalous {
+		baselines = getMetricsQuerySamples(baselineRes)
+	} else {
+		baselines = make(map[string][]float64)
+		for _, value := range getMetricsQueryValues(baselineRes) {
+			baselines[alertutils.GetInstanceFingerprint(value.labels)] = []float64{value.value}
+		}
+	}
+	return getAnomalyMatchedInstances(alert, values, baselines), nil
+}
+
+// Returns the latest value of every series of a metrics query, labeled with
+// the labels of the series.
+func getMetricsQueryValues(queryRes *mresults.MetricsResult) []matchedInstance {
+	if queryRes == nil {
+		return nil
+	}
+
+	seriesIds := make([]string, 0, len(queryRes.Results))
+	for seriesId := range queryRes.Results {
+		seriesIds = append(seriesIds, seriesId)
+	}
+	sort.Strings(seriesIds)
+
+	values := make([]matchedInstance, 0, len(seriesIds))
+	for _, seriesId := range seriesIds {
+		var latest uint32
+		var value float64
+		found := false
+		for ts, val := range queryRes.Results[seriesId] {
+			if !found || ts > latest {
+				latest, value, found = ts, val, true
+			}
+		}
+		if found {
+			values = append(values, matchedInstance{labels: getMetricSeriesLabels(seriesId), value: value})
+		}
+	}
+	return values
+}
+
+// Returns the points of every series of a metrics query by the fingerprint of
+// its labels, oldest first.
+func getMetricsQuerySamples(queryRes *mresults.MetricsResult) map[string][]float64 {
+	samples := make(map[string][]float64)
+	if queryRes == nil {
+		return samples
+	}
+	for seriesId, points := range queryRes.Results {
+		timestamps := make([]uint32, 0, len(points))
+		for ts := range points {
+			timestamps = append(timestamps, ts)
+		}
+		sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+		fingerprint := alertutils.GetInstanceFingerprint(getMetricSeriesLabels(seriesId))
+		for _, ts := range timestamps {
+			samples[fingerprint] = append(samples[fingerprint], points[ts])
+		}
+	}
+	return samples
+}
+
+func getMetricSeriesLabels(seriesId string) map[string]string {
+	labels := mresults.GetPromQLSeriesFormat(seriesId)
+	delete(labels, "__name__")
+	return labels
+}
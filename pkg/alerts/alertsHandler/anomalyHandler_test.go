@@ -0,0 +1,119 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/siglens/siglens/pkg/segment/results/mresults"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_getAnomalyMatchedInstances(t *testing.T) {
+	web01 := map[string]string{"host": "web01"}
+	web02 := map[string]string{"host": "web02"}
+	web03 := map[string]string{"host": "web03"}
+	values := []matchedInstance{{labels: web01, value: 30}, {labels: web02, value: 11}, {labels: web03, value: 50}}
+	baselines := map[string][]float64{
+		alertutils.GetInstanceFingerprint(web01): {10, 12, 8, 10},
+		alertutils.GetInstanceFingerprint(web02): {10, 12, 8, 10},
+		alertutils.GetInstanceFingerprint(web03): {10}, // too few samples
+	}
+
+	alert := &alertutils.AlertDetails{AlertConfig: alertutils.AlertConfig{Condition: alertutils.IsAnomalous, Value: 3}}
+	matched := getAnomalyMatchedInstances(alert, values, baselines)
+	assert.Equal(t, 1, len(matched))
+	assert.Equal(t, web01, matched[0].labels)
+	assert.Equal(t, 10.0, *matched[0].baseline)
+	assert.InDelta(t, 14.14, *matched[0].score, 0.01)
+
+	alert.Condition = alertutils.ChangesByPercent
+	alert.Value = 50
+	alert.Anomaly = &alertutils.AnomalyConfig{Direction: alertutils.AnomalyUp}
+	matched = getAnomalyMatchedInstances(alert, values, baselines)
+	assert.Equal(t, 2, len(matched))
+	assert.Equal(t, 200.0, *matched[0].score) // 30 against the latest 10
+	assert.Equal(t, web03, matched[1].labels)
+
+	// a change from 0 has no finite score but still matches
+	matched = getAnomalyMatchedInstances(alert, []matchedInstance{{labels: web01, value: 5}},
+		map[string][]float64{alertutils.GetInstanceFingerprint(web01): {0}})
+	assert.Equal(t, 1, len(matched))
+	assert.Equal(t, 0.0, *matched[0].baseline)
+	assert.Nil(t, matched[0].score)
+}
+
+func Test_getBaselineOffsets(t *testing.T) {
+	alert := &alertutils.AlertDetails{AlertConfig: alertutils.AlertConfig{Condition: alertutils.IsAnomalous}}
+	offsets := getBaselineOffsets(alert, 20*time.Minute)
+	assert.Equal(t, []time.Duration{60 * time.Minute, 40 * time.Minute, 20 * time.Minute}, offsets)
+	assert.Equal(t, 60, len(getBaselineOffsets(alert, time.Minute)))
+	assert.Nil(t, getBaselineOffsets(alert, 0))
+
+	alert.Condition = alertutils.DeviatesFromSeason
+	alert.Anomaly = &alertutils.AnomalyConfig{Season: alertutils.WeekSeason}
+	assert.Equal(t, []time.Duration{7 * 24 * time.Hour}, getBaselineOffsets(alert, 5*time.Minute))
+
+	alert.Condition = alertutils.ChangesByPercent
+	assert.Equal(t, []time.Duration{time.Hour}, getBaselineOffsets(alert, 5*time.Minute))
+
+	alert.Condition = alertutils.IsAbove
+	assert.Nil(t, getBaselineOffsets(alert, 5*time.Minute))
+}
+
+func Test_getMetricsQuerySamples(t *testing.T) {
+	queryRes := &mresults.MetricsResult{Results: map[string]map[uint32]float64{
+		"cpu{host:web01": {30: 3, 10: 1, 20: 2},
+	}}
+	fingerprint := alertutils.GetInstanceFingerprint(map[string]string{"host": "web01"})
+	assert.Equal(t, []float64{1, 2, 3}, getMetricsQuerySamples(queryRes)[fingerprint])
+
+	values := getMetricsQueryValues(queryRes)
+	assert.Equal(t, 1, len(values))
+	assert.Equal(t, 3.0, values[0].value)
+}
+
+func Test_getInstancesMessageWithBaseline(t *testing.T) {
+	baseline, score := 40.5, 3.2
+	instances := []*alertutils.AlertInstance{
+		{Labels: map[string]string{"host": "web01"}, State: alertutils.Firing, Value: 97, Baseline: &baseline, Score: &score},
+	}
+	assert.Equal(t, "Firing instances:\n- host=web01 (value: 97, baseline: 40.5, score: 3.2)", getInstancesMessage(instances))
+}
+
+func Test_validateLogsAnomalyBaseline(t *testing.T) {
+	alert := &alertutils.AlertDetails{AlertConfig: alertutils.AlertConfig{
+		AlertType:   alertutils.AlertTypeLogs,
+		Condition:   alertutils.IsAnomalous,
+		QueryParams: alertutils.QueryParams{StartTime: "now-5m", EndTime: "now"},
+	}}
+	// the default baseline window of an hour covers 12 windows of 5 minutes
+	assert.Nil(t, validateLogsAnomalyBaseline(alert))
+
+	alert.Anomaly = &alertutils.AnomalyConfig{BaselineWindow: 24 * 60}
+	assert.NotNil(t, validateLogsAnomalyBaseline(alert))
+
+	alert.QueryParams.StartTime = "now-1h"
+	assert.Nil(t, validateLogsAnomalyBaseline(alert))
+
+	alert.Condition = alertutils.DeviatesFromSeason
+	alert.QueryParams.StartTime = "now-1m"
+	assert.Nil(t, validateLogsAnomalyBaseline(alert))
+}
@@ -0,0 +1,636 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/siglens/siglens/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// alertsBundleState is the alerting config of an org, by the names used in bundles.
+type alertsBundleState struct {
+	orgId    int64
+	contacts map[string]*alertutils.Contact
+	alerts   map[string]*alertutils.AlertDetails
+	silences map[string][]*alertutils.Silence // silences with the same matchers
+	windows  map[string]*alertutils.MaintenanceWindow
+}
+
+// plannedChange is a change of a bundle with the function that applies it.
+type plannedChange struct {
+	alertutils.BundleChange
+	apply func() error
+}
+
+/*
+Returns the alerting config of the org as a bundle of its contact points,
+alerts with their labels, silences that did not expire and maintenance
+windows. The secrets of the contact points are redacted. The bundle is JSON,
+or YAML with the format=yaml parameter.
+*/
+func ProcessExportAlertsRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	state, err := getAlertsBundleState(org_id, time.Now().UTC())
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to get the alerting config. Error=%v", err), "", err)
+		return
+	}
+	bundle, err := state.getBundle()
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to export the alerting config. Error=%v", err), "", err)
+		return
+	}
+
+	if string(ctx.QueryArgs().Peek("format")) == "yaml" {
+		yamlBundle, err := bundle.MarshalYaml()
+		if err != nil {
+			utils.SendError(ctx, fmt.Sprintf("Failed to export the alerting config. Error=%v", err), "", err)
+			return
+		}
+		ctx.SetContentType("application/yaml")
+		ctx.SetBody(yamlBundle)
+		ctx.SetStatusCode(fasthttp.StatusOK)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, bundle)
+}
+
+/*
+Applies a bundle in YAML or JSON: creates, updates and deletes the contact
+points, alerts, silences and maintenance windows of the org so that they match
+the sections of the bundle. Applying the same bundle again changes nothing.
+With dry_run=true the changes are returned without applying them. Nothing is
+applied when the bundle is invalid.
+*/
+func ProcessImportAlertsRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+	rawBundle := ctx.PostBody()
+	if len(rawBundle) == 0 {
+		utils.SendError(ctx, "Received empty request", "", nil)
+		return
+	}
+	dryRun := ctx.QueryArgs().GetBool("dry_run")
+
+	bundle, err := alertutils.ParseAlertsBundle(rawBundle)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to parse the bundle. Error=%v", err), "", err)
+		return
+	}
+	err = bundle.Validate()
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Invalid bundle. Error=%v", err), "", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	state, err := getAlertsBundleState(org_id, now)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to get the alerting config. Error=%v", err), "", err)
+		return
+	}
+	changes, err := state.plan(bundle, now)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Invalid bundle. Error=%v", err), "", err)
+		return
+	}
+
+	failed := 0
+	if !dryRun {
+		failed = applyBundleChanges(changes)
+	}
+
+	responseBody := make(map[string]interface{})
+	result := make([]alertutils.BundleChange, 0, len(changes))
+	for _, change := range changes {
+		result = append(result, change.BundleChange)
+	}
+	responseBody["dry_run"] = dryRun
+	responseBody["changes"] = result
+	switch {
+	case dryRun:
+		responseBody["message"] = fmt.Sprintf("%v changes to apply", len(changes))
+	case failed > 0:
+		responseBody["message"] = fmt.Sprintf("Failed to apply %v of %v changes", failed, len(changes))
+	default:
+		responseBody["message"] = fmt.Sprintf("Applied %v changes", len(changes))
+	}
+	if failed > 0 {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+	} else {
+		ctx.SetStatusCode(fasthttp.StatusOK)
+	}
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+// Applies the changes in order and records their errors. Returns the number of
+// changes that failed.
+func applyBundleChanges(changes []*plannedChange) int {
+	failed := 0
+	for _, change := range changes {
+		err := change.apply()
+		if err != nil {
+			log.Errorf("applyBundleChanges: unable to %v %v %v, err=%v", change.Action, change.Kind, change.Name, err)
+			change.Error = err.Error()
+			failed++
+		}
+	}
+	return failed
+}
+
+// Expired silences are left out; they are neither exported nor deleted.
+func getAlertsBundleState(orgId int64, now time.Time) (*alertsBundleState, error) {
+	state := &alertsBundleState{
+		orgId:    orgId,
+		contacts: make(map[string]*alertutils.Contact),
+		alerts:   make(map[string]*alertutils.AlertDetails),
+		silences: make(map[string][]*alertutils.Silence),
+		windows:  make(map[string]*alertutils.MaintenanceWindow),
+	}
+
+	contacts, err := databaseObj.GetAllContactPoints(orgId)
+	if err != nil {
+		return nil, err
+	}
+	for i := range contacts {
+		state.contacts[contacts[i].ContactName] = &contacts[i]
+	}
+
+	alerts, err := databaseObj.GetAllAlerts(orgId)
+	if err != nil {
+		return nil, err
+	}
+	for _, alert := range alerts {
+		state.alerts[alert.AlertName] = alert
+	}
+
+	silences, err := databaseObj.GetAllSilences(orgId)
+	if err != nil {
+		return nil, err
+	}
+	for _, silence := range silences {
+		if silence.GetStatus(now) == alertutils.SilenceExpired {
+			continue
+		}
+		name := alertutils.NewBundleSilence(silence).GetName()
+		state.silences[name] = append(state.silences[name], silence)
+	}
+
+	windows, err := databaseObj.GetAllMaintenanceWindows(orgId)
+	if err != nil {
+		return nil, err
+	}
+	for _, window := range windows {
+		state.windows[window.Name] = window
+	}
+	return state, nil
+}
+
+func (state *alertsBundleState) getContactName(contactId string) string {
+	for name, contact := range state.contacts {
+		if contact.ContactId == contactId {
+			return name
+		}
+	}
+	return ""
+}
+
+func (state *alertsBundleState) getBundleAlert(alert *alertutils.AlertDetails) (*alertutils.BundleAlert, error) {
+	bundleAlert, err := alertutils.NewBundleAlert(alert)
+	if err != nil {
+		return nil, err
+	}
+	// The contact name stored with the alert is not updated when the contact is renamed.
+	if name := state.getContactName(alert.ContactID); name != "" {
+		bundleAlert.ContactName = name
+	}
+	return bundleAlert, nil
+}
+
+// Returns the config as a bundle, sorted by name, with the secrets of the
+// contact points redacted.
+func (state *alertsBundleState) getBundle() (*alertutils.AlertsBundle, error) {
+	bundle := &alertutils.AlertsBundle{
+		Contacts:           make([]*alertutils.BundleContact, 0, len(state.contacts)),
+		Alerts:             make([]*alertutils.BundleAlert, 0, len(state.alerts)),
+		Silences:           make([]*alertutils.BundleSilence, 0, len(state.silences)),
+		MaintenanceWindows: make([]*alertutils.BundleMaintenanceWindow, 0, len(state.windows)),
+	}
+	for _, name := range getSortedKeys(state.contacts) {
+		contact := alertutils.NewBundleContact(state.contacts[name])
+		contact.RedactSecrets()
+		bundle.Contacts = append(bundle.Contacts, contact)
+	}
+	for _, name := range getSortedKeys(state.alerts) {
+		bundleAlert, err := state.getBundleAlert(state.alerts[name])
+		if err != nil {
+			return nil, err
+		}
+		bundle.Alerts = append(bundle.Alerts, bundleAlert)
+	}
+	for _, name := range getSortedKeys(state.silences) {
+		for _, silence := range state.silences[name] {
+			bundle.Silences = append(bundle.Silences, alertutils.NewBundleSilence(silence))
+		}
+	}
+	for _, name := range getSortedKeys(state.windows) {
+		bundle.MaintenanceWindows = append(bundle.MaintenanceWindows, alertutils.NewBundleMaintenanceWindow(state.windows[name]))
+	}
+	return bundle, nil
+}
+
+func getSortedKeys[T any](values map[string]T) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+Returns the changes that make the config match the bundle, in the order they
+are applied: contact points are created and updated before the alerts that
+notify them change, and deleted after. Returns an error when an alert of the
+bundle is invalid or would notify a contact point that does not exist.
+*/
+func (state *alertsBundleState) plan(bundle *alertutils.AlertsBundle, now time.Time) ([]*plannedChange, error) {
+	changes := make([]*plannedChange, 0)
+
+	contactChanges, contactDeletes, err := state.planContacts(bundle)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, contactChanges...)
+
+	alertChanges, err := state.planAlerts(bundle)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, alertChanges...)
+	changes = append(changes, contactDeletes...)
+
+	silenceChanges, err := state.planSilences(bundle, now)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, silenceChanges...)
+
+	windowChanges, err := state.planMaintenanceWindows(bundle)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, windowChanges...)
+	return changes, nil
+}
+
+func newPlannedChange(kind string, name string, action string, fields []string, apply func() error) *plannedChange {
+	return &plannedChange{
+		BundleChange: alertutils.BundleChange{Kind: kind, Name: name, Action: action, Fields: fields},
+		apply:        apply,
+	}
+}
+
+// Returns the creates and updates, and separately the deletes of the contacts.
+func (state *alertsBundleState) planContacts(bundle *alertutils.AlertsBundle) ([]*plannedChange, []*plannedChange, error) {
+	changes := make([]*plannedChange, 0)
+	deletes := make([]*plannedChange, 0)
+	if bundle.Contacts == nil {
+		return changes, deletes, nil
+	}
+
+	desiredNames := make(map[string]struct{}, len(bundle.Contacts))
+	for _, desired := range bundle.Contacts {
+		desired := desired
+		desiredNames[desired.Name] = struct{}{}
+		current, ok := state.contacts[desired.Name]
+		var currentBundleContact *alertutils.BundleContact
+		if ok {
+			currentBundleContact = alertutils.NewBundleContact(current)
+		}
+		err := desired.KeepSecrets(currentBundleContact)
+		if err != nil {
+			return nil, nil, fmt.Errorf("contact %v: %v", desired.Name, err)
+		}
+		if !ok {
+			changes = append(changes, newPlannedChange(alertutils.BundleKindContact, desired.Name, alertutils.BundleActionCreate, nil, func() error {
+				contact := desired.ToContact(state.orgId)
+				err := databaseObj.CreateContact(contact)
+				if err != nil {
+					return err
+				}
+				state.contacts[desired.Name] = contact
+				return nil
+			}))
+			continue
+		}
+
+		fields, err := alertutils.GetBundleChangedFields(currentBundleContact, desired)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		contactId := current.ContactId
+		changes = append(changes, newPlannedChange(alertutils.BundleKindContact, desired.Name, alertutils.BundleActionUpdate, fields, func() error {
+			contact := desired.ToContact(state.orgId)
+			contact.ContactId = contactId
+			return databaseObj.UpdateContactPoint(contact)
+		}))
+	}
+
+	for _, name := range getSortedKeys(state.contacts) {
+		if _, ok := desiredNames[name]; ok {
+			continue
+		}
+		contactId := state.contacts[name].ContactId
+		deletes = append(deletes, newPlannedChange(alertutils.BundleKindContact, name, alertutils.BundleActionDelete, nil, func() error {
+			return databaseObj.DeleteContactPoint(contactId)
+		}))
+	}
+	return changes, deletes, nil
+}
+
+// Returns true if the contact exists after the contacts of the bundle are applied.
+func (state *alertsBundleState) isContactKept(bundle *alertutils.AlertsBundle, name string) bool {
+	if bundle.Contacts == nil {
+		_, ok := state.contacts[name]
+		return ok
+	}
+	for _, contact := range bundle.Contacts {
+		if contact.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (state *alertsBundleState) planAlerts(bundle *alertutils.AlertsBundle) ([]*plannedChange, error) {
+	changes := make([]*plannedChange, 0)
+	if bundle.Alerts == nil {
+		// The existing alerts must keep their contact points.
+		for _, name := range getSortedKeys(state.alerts) {
+			contactName := state.getContactName(state.alerts[name].ContactID)
+			if contactName != "" && !state.isContactKept(bundle, contactName) {
+				return nil, fmt.Errorf("contact %v is used by alert %v", contactName, name)
+			}
+		}
+		return changes, nil
+	}
+
+	desiredNames := make(map[string]struct{}, len(bundle.Alerts))
+	for _, desired := range bundle.Alerts {
+		desired := desired
+		desiredNames[desired.AlertName] = struct{}{}
+		if !state.isContactKept(bundle, desired.ContactName) {
+			return nil, fmt.Errorf("alert %v: contact %v does not exist", desired.AlertName, desired.ContactName)
+		}
+		if desired.AlertType == alertutils.AlertTypeMetrics {
+			desired.QueryParams = nil
+		} else {
+			desired.MetricsQueryParams = nil
+		}
+		err := validateBundleAlert(desired, state.orgId)
+		if err != nil {
+			return nil, fmt.Errorf("alert %v: %v", desired.AlertName, err)
+		}
+
+		current, ok := state.alerts[desired.AlertName]
+		if !ok {
+			changes = append(changes, newPlannedChange(alertutils.BundleKindAlert, desired.AlertName, alertutils.BundleActionCreate, nil, func() error {
+				alert, err := desired.ToAlert(state.orgId, state.getContactId(desired.ContactName))
+				if err != nil {
+					return err
+				}
+				return createImportedAlert(alert)
+			}))
+			continue
+		}
+
+		currentBundleAlert, err := state.getBundleAlert(current)
+		if err != nil {
+			return nil, err
+		}
+		fields, err := alertutils.GetBundleChangedFields(currentBundleAlert, desired)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		changes = append(changes, newPlannedChange(alertutils.BundleKindAlert, desired.AlertName, alertutils.BundleActionUpdate, fields, func() error {
+			alert, err := desired.ToAlert(state.orgId, state.getContactId(desired.ContactName))
+			if err != nil {
+				return err
+			}
+			return updateImportedAlert(current, alert)
+		}))
+	}
+
+	for _, name := range getSortedKeys(state.alerts) {
+		if _, ok := desiredNames[name]; ok {
+			continue
+		}
+		alertId := state.alerts[name].AlertId
+		changes = append(changes, newPlannedChange(alertutils.BundleKindAlert, name, alertutils.BundleActionDelete, nil, func() error {
+			return removeImportedAlert(alertId)
+		}))
+	}
+	return changes, nil
+}
+
+func (state *alertsBundleState) getContactId(name string) string {
+	if contact, ok := state.contacts[name]; ok {
+		return contact.ContactId
+	}
+	return ""
+}
+
+func validateBundleAlert(bundleAlert *alertutils.BundleAlert, orgId int64) error {
+	alert, err := bundleAlert.ToAlert(orgId, "")
+	if err != nil {
+		return err
+	}
+	if alert.AlertType != alertutils.AlertTypeLogs && alert.AlertType != alertutils.AlertTypeMetrics {
+		return fmt.Errorf("alert_type must be %v (logs) or %v (metrics)", alertutils.AlertTypeLogs, alertutils.AlertTypeMetrics)
+	}
+	if alert.EvalWindow < alert.EvalInterval {
+		return fmt.Errorf("eval_for should be greater than or equal to eval_interval")
+	}
+	if alert.EvalInterval == 0 {
+		return fmt.Errorf("eval_interval must be greater than zero")
+	}
+	_, err = validateAlertTypeAndQuery(alert)
+	return err
+}
+
+// Updates the config of the alert like the update alert API, keeping its
+// state, instances and silence.
+func updateImportedAlert(current *alertutils.AlertDetails, desired *alertutils.AlertDetails) error {
+	alert := *current
+	alert.AlertConfig = desired.AlertConfig
+	alert.MetricsQueryParamsString = desired.MetricsQueryParamsString
+	alert.RuleGroup = desired.RuleGroup
+	err := databaseObj.UpdateAlert(&alert)
+	if err != nil {
+		return err
+	}
+
+	alertEvent := alertutils.AlertHistoryDetails{
+		AlertId:          alert.AlertId,
+		EventDescription: alertutils.ConfigChange,
+		UserName:         alertutils.UserModified,
+		EventTriggeredAt: time.Now().UTC(),
+	}
+	_, err = databaseObj.CreateAlertHistory(&alertEvent)
+	if err != nil {
+		log.Errorf("updateImportedAlert: could not create alert event in alert history. found error = %v", err)
+	}
+
+	err = RemoveCronJob(alert.AlertId)
+	if err != nil {
+		return err
+	}
+	_, err = AddCronJob(&alert)
+	return err
+}
+
+func (state *alertsBundleState) planSilences(bundle *alertutils.AlertsBundle, now time.Time) ([]*plannedChange, error) {
+	changes := make([]*plannedChange, 0)
+	if bundle.Silences == nil {
+		return changes, nil
+	}
+
+	desiredNames := make(map[string]struct{}, len(bundle.Silences))
+	for _, desired := range bundle.Silences {
+		desired := desired
+		name := desired.GetName()
+		desiredNames[name] = struct{}{}
+		desired.EndsAt = desired.EndsAt.UTC()
+
+		existing := state.silences[name]
+		if len(existing) == 0 {
+			if desired.StartsAt.IsZero() {
+				desired.StartsAt = now
+			}
+			desired.StartsAt = desired.StartsAt.UTC()
+			changes = append(changes, newPlannedChange(alertutils.BundleKindSilence, name, alertutils.BundleActionCreate, nil, func() error {
+				return databaseObj.CreateSilence(desired.ToSilence(state.orgId))
+			}))
+			continue
+		}
+
+		// Silences with the same matchers are replaced by the one of the bundle.
+		current := existing[0]
+		for _, duplicate := range existing[1:] {
+			silenceId := duplicate.SilenceId
+			changes = append(changes, newPlannedChange(alertutils.BundleKindSilence, name, alertutils.BundleActionDelete, nil, func() error {
+				return databaseObj.DeleteSilence(silenceId)
+			}))
+		}
+		if desired.StartsAt.IsZero() {
+			desired.StartsAt = current.StartsAt
+		}
+		desired.StartsAt = desired.StartsAt.UTC()
+		fields, err := alertutils.GetBundleChangedFields(alertutils.NewBundleSilence(current), desired)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		silenceId := current.SilenceId
+		changes = append(changes, newPlannedChange(alertutils.BundleKindSilence, name, alertutils.BundleActionUpdate, fields, func() error {
+			silence := desired.ToSilence(state.orgId)
+			silence.SilenceId = silenceId
+			return databaseObj.UpdateSilence(silence)
+		}))
+	}
+
+	for _, name := range getSortedKeys(state.silences) {
+		if _, ok := desiredNames[name]; ok {
+			continue
+		}
+		for _, silence := range state.silences[name] {
+			silenceId := silence.SilenceId
+			changes = append(changes, newPlannedChange(alertutils.BundleKindSilence, name, alertutils.BundleActionDelete, nil, func() error {
+				return databaseObj.DeleteSilence(silenceId)
+			}))
+		}
+	}
+	return changes, nil
+}
+
+func (state *alertsBundleState) planMaintenanceWindows(bundle *alertutils.AlertsBundle) ([]*plannedChange, error) {
+	changes := make([]*plannedChange, 0)
+	if bundle.MaintenanceWindows == nil {
+		return changes, nil
+	}
+
+	desiredNames := make(map[string]struct{}, len(bundle.MaintenanceWindows))
+	for _, desired := range bundle.MaintenanceWindows {
+		desired := desired
+		desiredNames[desired.Name] = struct{}{}
+		current, ok := state.windows[desired.Name]
+		if !ok {
+			changes = append(changes, newPlannedChange(alertutils.BundleKindMaintenanceWindow, desired.Name, alertutils.BundleActionCreate, nil, func() error {
+				return databaseObj.CreateMaintenanceWindow(desired.ToMaintenanceWindow(state.orgId))
+			}))
+			continue
+		}
+
+		fields, err := alertutils.GetBundleChangedFields(alertutils.NewBundleMaintenanceWindow(current), desired)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		windowId := current.WindowId
+		changes = append(changes, newPlannedChange(alertutils.BundleKindMaintenanceWindow, desired.Name, alertutils.BundleActionUpdate, fields, func() error {
+			window := desired.ToMaintenanceWindow(state.orgId)
+			window.WindowId = windowId
+			return databaseObj.UpdateMaintenanceWindow(window)
+		}))
+	}
+
+	for _, name := range getSortedKeys(state.windows) {
+		if _, ok := desiredNames[name]; ok {
+			continue
+		}
+		windowId := state.windows[name].WindowId
+		changes = append(changes, newPlannedChange(alertutils.BundleKindMaintenanceWindow, name, alertutils.BundleActionDelete, nil, func() error {
+			return databaseObj.DeleteMaintenanceWindow(windowId)
+		}))
+	}
+	return changes, nil
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/siglens/siglens/pkg/alerts/alertsqlite"
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const testAlertsBundle = `
+contacts:
+  - name: oncall
+    webhook:
+      - webhook: https://hooks.example.com/oncall
+    slack:
+      - channel_id: C123
+        slack_token: xoxb-1
+alerts:
+  - alert_name: Errors
+    alert_type: 1
+    contact_name: oncall
+    labels:
+      team: web
+    queryParams:
+      data_source: Logs
+      queryLanguage: Splunk QL
+      queryText: "error | stats count"
+      startTime: now-5m
+      endTime: now
+    condition: 0
+    value: 10
+    eval_for: 5
+    eval_interval: 1
+    message: Too many errors
+  - alert_name: High CPU
+    alert_type: 2
+    contact_name: oncall
+    metricsQueryParams:
+      start: now-5m
+      end: now
+      queries:
+        - name: a
+          query: cpu_usage
+          qlType: promql
+      formulas:
+        - formula: a
+    condition: 0
+    value: 90
+    eval_for: 5
+    eval_interval: 1
+silences:
+  - matchers:
+      - name: env
+        value: staging
+        type: "="
+    ends_at: 2099-01-01T00:00:00Z
+    comment: staging is noisy
+maintenance_windows:
+  - name: weekly
+    matchers:
+      - name: team
+        value: web
+        type: "="
+    schedule: 0 2 * * SAT
+    duration_minutes: 60
+`
+
+// Uses an sqlite database for the alerts, and a node that does not evaluate
+// them so no cron jobs are scheduled.
+func setupBundleTest(t *testing.T) *alertsqlite.Sqlite {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "siglens.db")), &gorm.Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, db.AutoMigrate(&alertutils.AlertDetails{}, &alertutils.AlertLabel{}, &alertutils.AlertHistoryDetails{},
+		&alertutils.Notification{}, &alertutils.Contact{}, &alertutils.SlackTokenConfig{}, &alertutils.WebHookConfig{},
+		&alertutils.AlertInstance{}, &alertutils.Silence{}, &alertutils.MaintenanceWindow{}))
+	p := &alertsqlite.Sqlite{}
+	p.SetDB(db)
+	databaseObj = p
+
+	follower := newAlertLeaderElector(newMockDatabase(), "follower")
+	alertLeader = follower
+	t.Cleanup(func() {
+		alertLeader = nil
+		databaseObj = nil
+	})
+	return p
+}
+
+func importTestBundle(t *testing.T, bundle string, dryRun bool) (int, []alertutils.BundleChange) {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetBody([]byte(bundle))
+	if dryRun {
+		ctx.QueryArgs().Set("dry_run", "true")
+	}
+	ProcessImportAlertsRequest(ctx, 0)
+
+	var response struct {
+		Changes []alertutils.BundleChange `json:"changes"`
+	}
+
+	assert.Nil(t, json.Unmarshal(ctx.Response.Body(), &response), string(ctx.Response.Body()))
+	return ctx.Response.StatusCode(), response.Changes
+}
+
+func exportTestBundle(t *testing.T, format string) []byte {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.QueryArgs().Set("format", format)
+	ProcessExportAlertsRequest(ctx, 0)
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	return ctx.Response.Body()
+}
+
+func getChangeActions(changes []alertutils.BundleChange) []string {
+	actions := make([]string, 0, len(changes))
+	for _, change := range changes {
+		actions = append(actions, change.Action+" "+change.Kind+" "+change.Name)
+	}
+	return actions
+}
+
+func Test_ImportAlertsBundle(t *testing.T) {
+	p := setupBundleTest(t)
+
+	status, changes := importTestBundle(t, testAlertsBundle, true)
+	assert.Equal(t, fasthttp.StatusOK, status)
+	assert.Equal(t, []string{
+		"create contact oncall",
+		"create alert Errors",
+		"create alert High CPU",
+		`create silence {env="staging"}`,
+		"create maintenance_window weekly",
+	}, getChangeActions(changes))
+	alerts, err := p.GetAllAlerts(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(alerts))
+
+	status, changes = importTestBundle(t, testAlertsBundle, false)
+	assert.Equal(t, fasthttp.StatusOK, status)
+	assert.Equal(t, 5, len(changes))
+	for _, change := range changes {
+		assert.Equal(t, "", change.Error)
+	}
+
+	alerts, err = p.GetAllAlerts(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(alerts))
+	contacts, err := p.GetAllContactPoints(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(contacts))
+	for _, alert := range alerts {
+		assert.Equal(t, contacts[0].ContactId, alert.ContactID)
+	}
+
+	// applying the bundle again changes nothing
+	_, changes = importTestBundle(t, testAlertsBundle, false)
+	assert.Equal(t, 0, len(changes))
+
+	// neither does applying the export
+	_, changes = importTestBundle(t, string(exportTestBundle(t, "yaml")), true)
+	assert.Equal(t, 0, len(changes))
+	_, changes = importTestBundle(t, string(exportTestBundle(t, "json")), true)
+	assert.Equal(t, 0, len(changes))
+
+	bundle, err := alertutils.ParseAlertsBundle(exportTestBundle(t, "yaml"))
+	assert.Nil(t, err)
+	assert.Equal(t, alertutils.BundleRedactedSecret, bundle.Contacts[0].Slack[0].SlToken)
+	contact, err := p.GetContact(contacts[0].ContactId)
+	assert.Nil(t, err)
+	assert.Equal(t, "xoxb-1", contact.Slack[0].SlToken)
+
+	bundle.Contacts[0].Slack = nil
+	bundle.Alerts[0].Value = 20
+	bundle.Alerts[0].Labels["severity"] = "critical"
+	bundle.Alerts = bundle.Alerts[:1]
+	bundle.Silences = []*alertutils.BundleSilence{}
+	bundle.MaintenanceWindows = nil
+	updated, err := json.Marshal(bundle)
+	assert.Nil(t, err)
+
+	_, changes = importTestBundle(t, string(updated), false)
+	assert.Equal(t, []string{
+		"update contact oncall",
+		"update alert Errors",
+		"delete alert High CPU",
+		`delete silence {env="staging"}`,
+	}, getChangeActions(changes))
+	assert.Equal(t, []string{"slack"}, changes[0].Fields)
+	assert.Equal(t, []string{"labels", "value"}, changes[1].Fields)
+
+	alerts, err = p.GetAllAlerts(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(alerts))
+	assert.Equal(t, float64(20), alerts[0].Value)
+	assert.Equal(t, 2, len(alerts[0].Labels))
+	contact, err = p.GetContact(contacts[0].ContactId)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(contact.Slack))
+	windows, err := p.GetAllMaintenanceWindows(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(windows))
+
+	_, changes = importTestBundle(t, string(updated), false)
+	assert.Equal(t, 0, len(changes))
+}
+
+func Test_ImportAlertsBundleRejectsInvalid(t *testing.T) {
+	p := setupBundleTest(t)
+	status, _ := importTestBundle(t, testAlertsBundle, false)
+	assert.Equal(t, fasthttp.StatusOK, status)
+
+	for _, bundle := range []string{
+		// the contact of the alerts would be deleted
+		`contacts: []`,
+		`alerts: [{alert_name: Other, alert_type: 1, contact_name: missing, queryParams: {queryText: "* | stats count", queryLanguage: Splunk QL}, eval_for: 1, eval_interval: 1}]`,
+		`alerts: [{alert_name: Other, alert_type: 1, contact_name: oncall, queryParams: {queryText: "*", queryLanguage: Splunk QL}, eval_for: 1, eval_interval: 1}]`,
+		`contacts: [{name: a}, {name: a}]`,
+		// a new contact point needs its secrets
+		`contacts: [{name: oncall, webhook: [{webhook: "https://hooks.example.com/oncall"}], slack: [{channel_id: C123, slack_token: xoxb-1}]}, {name: other, pager_duty: "<redacted>"}]`,
+		`silences: [{matchers: [{name: env, value: prod, type: "="}]}]`,
+		`unknown: []`,
+	} {
+		status, changes := importTestBundle(t, bundle, false)
+		assert.Equal(t, fasthttp.StatusBadRequest, status, bundle)
+		assert.Equal(t, 0, len(changes), bundle)
+	}
+
+	alerts, err := p.GetAllAlerts(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(alerts))
+	silences, err := p.GetAllSilences(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(silences))
+	assert.True(t, silences[0].EndsAt.After(time.Now()))
+}
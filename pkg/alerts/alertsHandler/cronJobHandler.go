@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-co-op/gocron"
@@ -33,12 +34,47 @@ import (
 	rutils "github.com/siglens/siglens/pkg/readerUtils"
 	"github.com/siglens/siglens/pkg/segment/results/mresults"
 	"github.com/siglens/siglens/pkg/segment/structs"
-	sutils "github.com/siglens/siglens/pkg/segment/utils"
 	log "github.com/sirupsen/logrus"
 )
 
 var s = gocron.NewScheduler(time.UTC)
 
+// Alert id -> fingerprint of the config the alert was scheduled with.
+var scheduledAlerts = make(map[string]string)
+var scheduledAlertsLock sync.Mutex
+
+// Returns what the cron job of the alert depends on, so a node can tell that an
+// alert was changed through another node.
+func getAlertScheduleFingerprint(alertDataObj *alertutils.AlertDetails) string {
+	fingerprint, err := json.Marshal(struct {
+		Config             alertutils.AlertConfig
+		MetricsQueryParams string
+		OrgId              int64
+	}{alertDataObj.AlertConfig, alertDataObj.MetricsQueryParamsString, alertDataObj.OrgId})
+	if err != nil {
+		log.Errorf("getAlertScheduleFingerprint: unable to marshal the config of alert=%v, err=%v", alertDataObj.AlertName, err)
+		return ""
+	}
+	return string(fingerprint)
+}
+
+func getScheduledAlertFingerprint(alertId string) (string, bool) {
+	scheduledAlertsLock.Lock()
+	defer scheduledAlertsLock.Unlock()
+	fingerprint, ok := scheduledAlerts[alertId]
+	return fingerprint, ok
+}
+
+func getScheduledAlertIds() []string {
+	scheduledAlertsLock.Lock()
+	defer scheduledAlertsLock.Unlock()
+	alertIds := make([]string, 0, len(scheduledAlerts))
+	for alertId := range scheduledAlerts {
+		alertIds = append(alertIds, alertId)
+	}
+	return alertIds
+}
+
 func VerifyAlertCronJobExists(alertDataObj *alertutils.AlertDetails) bool {
 	job_ids := s.GetAllTags()
 	for _, id := range job_ids {
@@ -49,7 +85,13 @@ func VerifyAlertCronJobExists(alertDataObj *alertutils.AlertDetails) bool {
 	return false
 }
 
+// Only the node that holds the alert evaluation lease schedules the alert; on
+// the other nodes AddCronJob returns a nil job, and the leader schedules the
+// alert when it syncs its cron jobs.
 func AddCronJob(alertDataObj *alertutils.AlertDetails) (*gocron.Job, error) {
+	if !isAlertEvaluationLeader() {
+		return nil, nil
+	}
 	evaluationIntervalInSec := int(alertDataObj.EvalInterval * 60)
 
 	var evaluateFunc interface{}
@@ -69,8 +111,9 @@ func AddCronJob(alertDataObj *alertutils.AlertDetails) (*gocron.Job, error) {
 		return &gocron.Job{}, err
 	}
 	s.StartAsync()
-	// TODO: for multinode set up, set create and set node_id to which this alert will be assigned
-	// TODO: node_id should be created using hash function
+	scheduledAlertsLock.Lock()
+	scheduledAlerts[alertDataObj.AlertId] = getAlertScheduleFingerprint(alertDataObj)
+	scheduledAlertsLock.Unlock()
 	return cron_job, nil
 }
 
@@ -89,6 +132,10 @@ func AddMinionSearchCronJob(alertDataObj *alertutils.MinionSearch) (*gocron.Job,
 }
 
 func RemoveCronJob(alertId string) error {
+	scheduledAlertsLock.Lock()
+	delete(scheduledAlerts, alertId)
+	scheduledAlertsLock.Unlock()
+
 	err := s.RemoveByTag(alertId)
 	if err != nil {
 		log.Errorf("ALERTSERVICE: RemoveCronJob error %v.", err)
@@ -123,47 +170,6 @@ func updateAlertStateAndCreateAlertHistory(alertDetails *alertutils.AlertDetails
 	return nil
 }
 
-// An Alert State can be updated to Firing, when the previous (IntervalCount - 1) Evaluations + Current Evaluation satisfies the conditions.
-// Meaning, the (IntervalCount - 1) evaluations and the current Evaluations State should be in either Pending or Firing.
-// The (IntervalCount - 1) evaluations will be Fetched from the AlertHistory Table.
-func shouldUpdateAlertStateToFiring(alertDetails *alertutils.AlertDetails, currentState alertutils.AlertState) bool {
-	if !alertutils.IsAlertStatePendingOrFiring(currentState) {
-		return false
-	}
-
-	intervalCount := alertDetails.EvalWindow / alertDetails.EvalInterval
-	if intervalCount == 0 {
-		log.Errorf("ALERTSERVICE: shouldUpdateAlertStateToFiring: EvalWindow=%v is less than EvalInterval=%v. Alert=%+v", alertDetails.EvalWindow, alertDetails.EvalInterval, alertDetails.AlertName)
-		return false
-	}
-
-	if intervalCount == 1 {
-		return true
-	}
-
-	alertHistoryList, err := databaseObj.GetAlertHistoryByAlertID(&alertutils.AlertHistoryQueryParams{
-		AlertId:   alertDetails.AlertId,
-		Limit:     intervalCount - 1,
-		SortOrder: alertutils.DESC,
-	})
-	if err != nil {
-		log.Errorf("ALERTSERVICE: shouldUpdateAlertStateToFiring: Error getting AlertHistory. Alert=%+v & err=%+v.", alertDetails.AlertName, err)
-		return false
-	}
-
-	if len(alertHistoryList) < int(intervalCount-1) {
-		return false
-	}
-
-	for _, alertHistory := range alertHistoryList {
-		if !alertutils.IsAlertStatePendingOrFiring(alertHistory.AlertState) {
-			return false
-		}
-	}
-
-	return true
-}
-
 func GetLatestAlertHistory(alertId string) (*alertutils.AlertHistoryDetails, error) {
 	alertHistoryList, err := databaseObj.GetAlertHistoryByAlertID(&alertutils.AlertHistoryQueryParams{
 		AlertId:   alertId,
@@ -182,50 +188,6 @@ func GetLatestAlertHistory(alertId string) (*alertutils.AlertHistoryDetails, err
 	return alertHistoryList[0], nil
 }
 
-func handleAlertCondition(alertToEvaluate *alertutils.AlertDetails, isAlertConditionMatched bool, alertDataMessage string) error {
-	var newAlertState alertutils.AlertState
-	var eventDesc string
-	var alertNotificationSent bool
-	var err error
-
-	if isAlertConditionMatched {
-		newAlertState = alertutils.Pending
-		eventDesc = alertutils.AlertPending
-
-		if shouldUpdateAlertStateToFiring(alertToEvaluate, newAlertState) {
-			newAlertState = alertutils.Firing
-			eventDesc = alertutils.AlertFiring
-		}
-
-		// If the Alert State is updated to Firing, then we should send the Alert Notification.
-		// If the previous state was Firing, then the cooldown period on the Notification Handler will decide if the notification should be sent.
-		if newAlertState == alertutils.Firing {
-			alertNotificationSent, err = NotifyAlertHandlerRequest(alertToEvaluate.AlertId, newAlertState, alertDataMessage)
-			if err != nil {
-				log.Errorf("handleAlertCondition: Could not send Alert Notification. found error = %v", err)
-			}
-		}
-	} else {
-		newAlertState = alertutils.Normal
-		eventDesc = alertutils.AlertNormal
-
-		// The Alert state is Normal, then we should send the Alert Notification.
-		// The cooldown period on the Notification Handler will decide if the notification should be sent. So that false positives are avoided.
-		// The Notification handler is expected to send the Normal State Notification, only if the previous Notification sent was Firing.
-		alertNotificationSent, err = NotifyAlertHandlerRequest(alertToEvaluate.AlertId, alertutils.Normal, "The Alert State has been updated to Normal.")
-		if err != nil {
-			log.Errorf("handleAlertCondition: Could not send Alert Notification. found error = %v", err)
-		}
-	}
-
-	err = updateAlertStateAndCreateAlertHistory(alertToEvaluate, newAlertState, eventDesc, alertNotificationSent)
-	if err != nil {
-		log.Errorf("ALERTSERVICE: handleAlertCondition: Error in updateAlertStateAndCreateAlertHistory. AlertState=%v, Alert=%+v & err=%+v", newAlertState, alertToEvaluate.AlertName, err)
-	}
-
-	return err
-}
-
 func getLogsQueryLinkForTheAlert(alertDetails *alertutils.AlertDetails, timeRange *dtypeutils.TimeRange) string {
 	if timeRange == nil {
 		log.Errorf("ALERTSERVICE: getLogsQueryLinkForTheAlert: TimeRange is nil. Alert=%+v", alertDetails.AlertName)
@@ -277,27 +239,43 @@ func getMetricsQueryLinkForTheAlert(alertDetails *alertutils.AlertDetails, parse
 }
 
 func evaluateLogAlert(alertToEvaluate *alertutils.AlertDetails, job gocron.Job) {
+	if !isAlertEvaluationLeader() {
+		return
+	}
 	searchResponse, timeRange, err := pipesearch.ProcessAlertsPipeSearchRequest(alertToEvaluate.QueryParams, alertToEvaluate.OrgId, nil) // TODO: CronJob should really record the user who created it. This user should then be set in the context and passed along.
 	if err != nil {
 		log.Errorf("ALERTSERVICE: evaluateLogAlert: Error processing logs query. Alert=%+v, err=%+v", alertToEvaluate.AlertName, err)
 		return
 	}
 
-	isAlertConditionMatched, err := evaluateLogsQueryConditions(searchResponse, &alertToEvaluate.Condition, alertToEvaluate.Value)
+	var matched []matchedInstance
+	if alertutils.IsAnomalyCondition(alertToEvaluate.Condition) {
+		var values []matchedInstance
+		values, err = getLogsQueryValues(searchResponse)
+		if err == nil {
+			matched, err = getLogsAnomalyMatchedInstances(alertToEvaluate, values, timeRange)
+		}
+	} else {
+		matched, err = getLogsQueryMatchedInstances(searchResponse, &alertToEvaluate.Condition, alertToEvaluate.Value)
+	}
 	if err != nil {
 		log.Errorf("ALERTSERVICE: evaluateLogAlert: Error evaluating logs query conditions. Alert=%+v, err=%+v", alertToEvaluate.AlertName, err)
 		return
 	}
 
 	alertDataMessage := getLogsQueryLinkForTheAlert(alertToEvaluate, timeRange)
+	results := getLogsQueryResultRows(searchResponse, NOTIFICATION_RESULT_ROWS)
 
-	err = handleAlertCondition(alertToEvaluate, isAlertConditionMatched, alertDataMessage)
+	err = handleAlertInstances(alertToEvaluate, matched, alertDataMessage, results)
 	if err != nil {
-		log.Errorf("ALERTSERVICE: evaluateLogAlert: Error in handleAlertCondition. Alert=%+v & err=%+v.", alertToEvaluate.AlertName, err)
+		log.Errorf("ALERTSERVICE: evaluateLogAlert: Error in handleAlertInstances. Alert=%+v & err=%+v.", alertToEvaluate.AlertName, err)
 	}
 }
 
 func evaluateMetricsAlert(alertToEvaluate *alertutils.AlertDetails, job gocron.Job) {
+	if !isAlertEvaluationLeader() {
+		return
+	}
 	if alertToEvaluate.AlertType != alertutils.AlertTypeMetrics {
 		log.Errorf("ALERTSERVICE: evaluateMetricsAlert: AlertType is not Metrics. Alert=%+v", alertToEvaluate.AlertName)
 		return
@@ -317,22 +295,31 @@ func evaluateMetricsAlert(alertToEvaluate *alertutils.AlertDetails, job gocron.J
 		return
 	}
 
-	alertsDataList := evaluateMetricsQueryConditions(queryRes, &alertToEvaluate.Condition, alertToEvaluate.Value)
-
-	isAlertConditionMatched := len(alertsDataList) > 0
+	var matched []matchedInstance
+	if alertutils.IsAnomalyCondition(alertToEvaluate.Condition) {
+		matched, err = getMetricsAnomalyMatchedInstances(alertToEvaluate, queryRes, start, end)
+		if err != nil {
+			log.Errorf("ALERTSERVICE: evaluateMetricsAlert: Error evaluating the anomaly condition. Alert=%+v, err=%+v", alertToEvaluate.AlertName, err)
+			return
+		}
+	} else {
+		alertsDataList := evaluateMetricsQueryConditions(queryRes, &alertToEvaluate.Condition, alertToEvaluate.Value)
+		matched = getMetricsMatchedInstances(alertsDataList)
+	}
 
 	alertDataMessage := ""
 
-	if isAlertConditionMatched {
+	if len(matched) > 0 {
 		parsedJsonMap["start"] = start
 		parsedJsonMap["end"] = end
 
 		alertDataMessage = getMetricsQueryLinkForTheAlert(alertToEvaluate, parsedJsonMap)
 	}
+	results := getMetricsQueryResultRows(queryRes, NOTIFICATION_RESULT_ROWS)
 
-	err = handleAlertCondition(alertToEvaluate, isAlertConditionMatched, alertDataMessage)
+	err = handleAlertInstances(alertToEvaluate, matched, alertDataMessage, results)
 	if err != nil {
-		log.Errorf("ALERTSERVICE: evaluateMetricsAlert: Error in handleAlertCondition. Alert=%+v & err=%+v.", alertToEvaluate.AlertName, err)
+		log.Errorf("ALERTSERVICE: evaluateMetricsAlert: Error in handleAlertInstances. Alert=%+v & err=%+v.", alertToEvaluate.AlertName, err)
 	}
 }
 
@@ -353,6 +340,10 @@ func evaluateConditions(serResVal float64, queryCond *alertutils.AlertQueryCondi
 		return serResVal != val
 	case alertutils.HasNoValue:
 		return serResVal == 0
+	case alertutils.IsAboveOrEqualTo:
+		return serResVal >= val
+	case alertutils.IsBelowOrEqualTo:
+		return serResVal <= val
 	default:
 		return false
 	}
@@ -378,91 +369,13 @@ func evaluateMetricsQueryConditions(queryRes *mresults.MetricsResult, queryCond
 	return alertsDataList
 }
 
+// Returns whether any group-by row of the logs query matches the condition.
 func evaluateLogsQueryConditions(searchResponse *structs.PipeSearchResponseOuter, queryCond *alertutils.AlertQueryCondition, alertValue float64) (bool, error) {
-	if searchResponse == nil {
-		err := fmt.Errorf("ALERTSERVICE: evaluateLogsQueryConditions: searchResponse is nil")
-		log.Error(err.Error())
-		return false, err
-	}
-
-	if len(searchResponse.MeasureAggregationCols) > 0 {
-		return evaluateRecordsMeasureAggsAlertCondition(searchResponse, queryCond, alertValue)
-	} else if searchResponse.MeasureResults != nil && len(searchResponse.MeasureResults) > 0 {
-		return evaluateMeasureResultsAlertCondition(searchResponse, queryCond, alertValue)
-	}
-
-	return false, nil
-}
-
-func evaluateMeasureResultsAlertCondition(searchResponse *structs.PipeSearchResponseOuter, queryCond *alertutils.AlertQueryCondition, alertValue float64) (bool, error) {
-	if searchResponse == nil {
-		err := fmt.Errorf("ALERTSERVICE: evaluateMeasureResultsAlertCondition: searchResponse is nil")
-		log.Error(err.Error())
-		return false, err
-	}
-
-	firstBucket := searchResponse.MeasureResults[0]
-	if len(firstBucket.MeasureVal) > 1 {
-		err := fmt.Errorf("ALERTSERVICE: evaluateMeasureResultsAlertCondition: The Query has more than 1 Measure Column")
-		log.Error(err.Error())
-		return false, err
-	}
-
-	for _, bucket := range searchResponse.MeasureResults {
-		for _, measureVal := range bucket.MeasureVal {
-			floatVal, err := sutils.ParseHumanizedValueToFloat(measureVal)
-			if err != nil {
-				log.Errorf("ALERTSERVICE: evaluateMeasureResultsAlertCondition: Error converting value to float. Value=%v, err=%v", measureVal, err)
-				continue
-			}
-			toBeAlerted := evaluateConditions(floatVal, queryCond, alertValue)
-			if toBeAlerted {
-				return true, nil
-			}
-		}
-	}
-
-	return false, nil
-}
-
-func evaluateRecordsMeasureAggsAlertCondition(searchResponse *structs.PipeSearchResponseOuter, queryCond *alertutils.AlertQueryCondition, alertValue float64) (bool, error) {
-	if searchResponse == nil {
-		err := fmt.Errorf("ALERTSERVICE: evaluateRecordsMeasureAggsCondition: searchResponse is nil")
-		log.Error(err.Error())
-		return false, err
-	}
-
-	if len(searchResponse.MeasureAggregationCols) > 1 {
-		err := fmt.Errorf("ALERTSERVICE: evaluateRecordsMeasureAggsCondition: The Query has more than 1 Measure Column")
-		log.Error(err.Error())
+	matched, err := getLogsQueryMatchedInstances(searchResponse, queryCond, alertValue)
+	if err != nil {
 		return false, err
 	}
-
-	if len(searchResponse.RenameColumns) > 0 {
-		for i, measureCol := range searchResponse.MeasureAggregationCols {
-			if newColName, ok := searchResponse.RenameColumns[measureCol]; ok {
-				searchResponse.MeasureAggregationCols[i] = newColName
-			}
-		}
-	}
-
-	for _, record := range searchResponse.Hits.Hits {
-		for _, col := range searchResponse.MeasureAggregationCols {
-			if value, ok := record[col]; ok {
-				floatVal, err := sutils.ParseHumanizedValueToFloat(value)
-				if err != nil {
-					log.Errorf("ALERTSERVICE: evaluateRecordsMeasureAggsCondition: Error converting value to float. Value=%v, err=%v", value, err)
-					continue
-				}
-				toBeAlerted := evaluateConditions(floatVal, queryCond, alertValue)
-				if toBeAlerted {
-					return true, nil
-				}
-			}
-		}
-	}
-
-	return false, nil
+	return len(matched) > 0, nil
 }
 
 func updateMinionSearchStateAndCreateAlertHistory(msToEvaluate *alertutils.MinionSearch, alertState alertutils.AlertState, eventDesc string) error {
@@ -507,7 +420,7 @@ func evaluateMinionSearch(msToEvaluate *alertutils.MinionSearch, job gocron.Job)
 			log.Errorf("ALERTSERVICE: evaluateMinionSearch: Error in updateMinionSearchStateAndCreateAlertHistory. AlertState=%v, Alert=%+v & err=%+v.", alertutils.Firing, msToEvaluate.AlertName, err)
 		}
 
-		_, err = NotifyAlertHandlerRequest(msToEvaluate.AlertId, alertutils.Firing, "")
+		_, err = NotifyAlertHandlerRequest(msToEvaluate.AlertId, alertutils.Firing, "", nil, nil)
 		if err != nil {
 			log.Errorf("MinionSearch: evaluate: Could not send Alert Notification. found error = %v", err)
 			return
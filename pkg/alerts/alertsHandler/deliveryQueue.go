@@ -0,0 +1,793 @@
+package alertsHandler
+
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/time/rate"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often the queue checks for deliveries to retry.
+const DELIVERY_QUEUE_INTERVAL = time.Second
+
+// The delay before the first retry of a delivery, which doubles on every
+// retry up to the max delay. With 8 attempts a delivery is retried for about
+// 1.5 hours before it becomes a dead letter.
+const DELIVERY_RETRY_BASE_DELAY = 30 * time.Second
+const DELIVERY_RETRY_MAX_DELAY = 30 * time.Minute
+const MAX_DELIVERY_ATTEMPTS = 8
+
+// Every send of a delivery gives up after the send timeout. A delivery that is
+// being attempted is claimed by setting its next attempt after the claim
+// timeout, so the queue does not attempt it again at the same time.
+const DELIVERY_SEND_TIMEOUT = 30 * time.Second
+const DELIVERY_CLAIM_TIMEOUT = 2 * DELIVERY_SEND_TIMEOUT
+
+const MAX_DUE_DELIVERIES = 100 // retried per check of the queue
+const MAX_CONCURRENT_DELIVERIES = 8
+
+// Number of attempts kept in the delivery log, and how often it is pruned.
+const DELIVERY_LOG_SIZE = 10000
+const DELIVERY_LOG_PRUNE_INTERVAL = time.Hour
+const DEFAULT_DELIVERY_LOG_LIMIT = 100
+
+// The endpoint of the Slack Web API.
+var slackAPIURL = slack.APIURL
+
+type deliveryRateLimit struct {
+	perSecond rate.Limit
+	burst     int
+}
+
+// Slack accepts about one message per second per channel and answers 429
+// beyond that. The other destinations get a more generous limit.
+var deliveryRateLimits = map[string]deliveryRateLimit{
+	alertutils.SlackContactType: {perSecond: 1, burst: 2},
+}
+var defaultDeliveryRateLimit = deliveryRateLimit{perSecond: 10, burst: 10}
+
+// Slack errors that are worth retrying. Other errors, e.g. channel_not_found
+// or invalid_auth, fail again on every attempt.
+var retryableSlackErrors = map[string]bool{
+	"internal_error":      true,
+	"fatal_error":         true,
+	"service_unavailable": true,
+	"request_timeout":     true,
+	"ratelimited":         true,
+}
+
+type deliveryResult struct {
+	statusCode int // HTTP status code, or SMTP reply code of a failed email
+	latency    time.Duration
+	err        error
+	retryAfter time.Duration // asked by the destination, e.g. in a 429 response
+	permanent  bool          // retrying fails again, e.g. after a 400 response or with an invalid Slack token
+}
+
+// deliveryStore persists the outbound notification queue, its dead letters
+// and the delivery log of the contact points.
+type deliveryStore interface {
+	CreateNotificationDelivery(delivery *alertutils.NotificationDelivery) error
+	GetNotificationDelivery(delivery_id string) (*alertutils.NotificationDelivery, error)
+	GetDueNotificationDeliveries(now time.Time, limit int) ([]*alertutils.NotificationDelivery, error)
+	GetNotificationDeliveries(org_id int64, status alertutils.DeliveryStatus) ([]*alertutils.NotificationDelivery, error)
+	UpdateNotificationDelivery(delivery *alertutils.NotificationDelivery) error
+	DeleteNotificationDelivery(delivery_id string) error
+	AddNotificationDeliveryAttempt(attempt *alertutils.NotificationDeliveryAttempt) error
+	GetNotificationDeliveryAttempts(contact_id string, limit int) ([]*alertutils.NotificationDeliveryAttempt, error)
+	PruneNotificationDeliveryAttempts(keep int) error
+	DeleteOpenIncident(contact_id string, contact_type string, dedup_key string) error
+}
+
+/*
+deliveryQueue sends the notifications to the destinations of the contact
+points. A delivery is attempted once right away by the node that created it;
+when that fails it stays in the queue and the node that evaluates the alerts
+retries it with exponential backoff. A delivery is claimed in the queue before
+each attempt, so the nodes do not attempt it at the same time. The deliveries to a destination are rate
+limited, and a destination that asks to retry later is not sent anything
+before then. Deliveries are sent at least once: a node that stops during an
+attempt leaves the delivery to be retried.
+*/
+type deliveryQueue struct {
+	mu           sync.Mutex
+	store        deliveryStore // nil if the deliveries are not persisted, they are then attempted once
+	send         func(contactType string, request *alertutils.DeliveryRequest) *deliveryResult
+	limiters     map[string]*rate.Limiter // destination -> limiter
+	blockedUntil map[string]time.Time     // destination -> end of its Retry-After
+	inFlight     map[string]bool          // ids of the deliveries being attempted
+	lastPruned   time.Time
+	once         sync.Once
+}
+
+var notificationQueue = newDeliveryQueue()
+
+func newDeliveryQueue() *deliveryQueue {
+	return &deliveryQueue{
+		send:         sendDeliveryRequest,
+		limiters:     make(map[string]*rate.Limiter),
+		blockedUntil: make(map[string]time.Time),
+		inFlight:     make(map[string]bool),
+	}
+}
+
+func (q *deliveryQueue) start() {
+	q.once.Do(func() {
+		go func() {
+			ticker := time.NewTicker(DELIVERY_QUEUE_INTERVAL)
+			defer ticker.Stop()
+			for range ticker.C {
+				q.retryDue(time.Now().UTC())
+			}
+		}()
+	})
+}
+
+func newNotificationDelivery(contact *alertutils.Contact, contactType string, subject string,
+	request *alertutils.DeliveryRequest) *alertutils.NotificationDelivery {
+
+	return &alertutils.NotificationDelivery{
+		OrgId:       contact.OrgId,
+		ContactId:   contact.ContactId,
+		ContactType: contactType,
+		Destination: getDeliveryDestination(request),
+		Subject:     subject,
+		Request:     *request,
+		Status:      alertutils.DeliveryPending,
+	}
+}
+
+// Returns the email address, the Slack channel or the URL of the request
+// without its query and credentials.
+func getDeliveryDestination(request *alertutils.DeliveryRequest) string {
+	if request.To != "" {
+		return request.To
+	}
+	if request.Channel != "" {
+		return request.Channel
+	}
+	requestUrl, err := url.Parse(request.Url)
+	if err != nil {
+		return ""
+	}
+	requestUrl.User = nil
+	requestUrl.RawQuery = ""
+	requestUrl.Fragment = ""
+	return requestUrl.String()
+}
+
+// Deliveries are rate limited per email address, Slack channel or host.
+func getDeliveryRateLimitKey(delivery *alertutils.NotificationDelivery) string {
+	if delivery.Request.Url != "" {
+		if requestUrl, err := url.Parse(delivery.Request.Url); err == nil {
+			return delivery.ContactType + "/" + requestUrl.Host
+		}
+	}
+	return delivery.ContactType + "/" + delivery.Destination
+}
+
+func getDeliveryRetryDelay(attempts int) time.Duration {
+	delay := DELIVERY_RETRY_BASE_DELAY
+	for i := 1; i < attempts && delay < DELIVERY_RETRY_MAX_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > DELIVERY_RETRY_MAX_DELAY {
+		delay = DELIVERY_RETRY_MAX_DELAY
+	}
+	return delay
+}
+
+// Takes a token of the rate limit of the destination of the delivery. Returns
+// how long to wait instead when the destination is rate limited.
+func (q *deliveryQueue) takeRateLimit(delivery *alertutils.NotificationDelivery, now time.Time) time.Duration {
+	key := getDeliveryRateLimitKey(delivery)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if blockedUntil, ok := q.blockedUntil[key]; ok {
+		if now.Before(blockedUntil) {
+			return blockedUntil.Sub(now)
+		}
+		delete(q.blockedUntil, key)
+	}
+	limiter, ok := q.limiters[key]
+	if !ok {
+		limit, ok := deliveryRateLimits[delivery.ContactType]
+		if !ok {
+			limit = defaultDeliveryRateLimit
+		}
+		limiter = rate.NewLimiter(limit.perSecond, limit.burst)
+		q.limiters[key] = limiter
+	}
+	reservation := limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+func (q *deliveryQueue) blockDestination(delivery *alertutils.NotificationDelivery, until time.Time) {
+	key := getDeliveryRateLimitKey(delivery)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if until.After(q.blockedUntil[key]) {
+		q.blockedUntil[key] = until
+	}
+}
+
+// Returns false if the delivery is already being attempted.
+func (q *deliveryQueue) markInFlight(deliveryId string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.inFlight[deliveryId] {
+		return false
+	}
+	q.inFlight[deliveryId] = true
+	return true
+}
+
+func (q *deliveryQueue) unmarkInFlight(deliveryId string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.inFlight, deliveryId)
+}
+
+/*
+Persists the deliveries and attempts each of them right away. A delivery whose
+destination is rate limited is left in the queue for later, or is a dead
+letter if it could not be queued. Returns true if any of them was delivered or
+will be retried.
+
+The deliveries are queued claimed, so the queue does not retry them while
+their first attempt is running.
+*/
+func (q *deliveryQueue) enqueue(deliveries []*alertutils.NotificationDelivery, now time.Time) bool {
+	accepted := false
+	for _, delivery := range deliveries {
+		delivery.Status = alertutils.DeliveryPending
+		delivery.NextAttemptAtMs = now.Add(DELIVERY_CLAIM_TIMEOUT).UnixMilli()
+		if q.store != nil {
+			err := q.store.CreateNotificationDelivery(delivery)
+			if err != nil {
+				log.Errorf("deliveryQueue.enqueue: could not queue the %v delivery to %v, it is sent without retries, err=%v",
+					delivery.ContactType, delivery.Destination, err)
+				delivery.DeliveryId = ""
+			}
+		}
+
+		if delay := q.takeRateLimit(delivery, now); delay > 0 {
+			if !q.isQueued(delivery) {
+				delivery.Status = alertutils.DeliveryDead
+				delivery.LastError = fmt.Sprintf("the destination is rate limited for %v", delay)
+				log.Errorf("deliveryQueue.enqueue: dropped the %v delivery to %v of contact: %v, err=%v",
+					delivery.ContactType, delivery.Destination, delivery.ContactId, delivery.LastError)
+				continue
+			}
+			// Otherwise the claim expires and the queue retries it then.
+			delivery.NextAttemptAtMs = now.Add(delay).UnixMilli()
+			if err := q.store.UpdateNotificationDelivery(delivery); err != nil {
+				log.Errorf("deliveryQueue.enqueue: could not postpone delivery: %v, err=%v", delivery.DeliveryId, err)
+			}
+			accepted = true
+			continue
+		}
+
+		q.attempt(delivery, time.Now().UTC())
+		if delivery.Status != alertutils.DeliveryDead {
+			accepted = true
+		}
+	}
+	return accepted
+}
+
+func (q *deliveryQueue) isQueued(delivery *alertutils.NotificationDelivery) bool {
+	return q.store != nil && delivery.DeliveryId != ""
+}
+
+// Retries the pending deliveries that are due. Only the node that evaluates
+// the alerts retries them.
+func (q *deliveryQueue) retryDue(now time.Time) {
+	if q.store == nil || !isAlertEvaluationLeader() {
+		return
+	}
+	q.pruneDeliveryLog(now)
+
+	deliveries, err := q.store.GetDueNotificationDeliveries(now, MAX_DUE_DELIVERIES)
+	if err != nil {
+		log.Errorf("deliveryQueue.retryDue: could not get the due deliveries, err=%v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, MAX_CONCURRENT_DELIVERIES)
+	for _, delivery := range deliveries {
+		if !q.markInFlight(delivery.DeliveryId) {
+			continue
+		}
+		if delay := q.takeRateLimit(delivery, now); delay > 0 {
+			// Postponed, so the deliveries to other destinations are not held up.
+			delivery.NextAttemptAtMs = now.Add(delay).UnixMilli()
+			if err := q.store.UpdateNotificationDelivery(delivery); err != nil {
+				log.Errorf("deliveryQueue.retryDue: could not postpone delivery: %v, err=%v", delivery.DeliveryId, err)
+			}
+			q.unmarkInFlight(delivery.DeliveryId)
+			continue
+		}
+		delivery.NextAttemptAtMs = now.Add(DELIVERY_CLAIM_TIMEOUT).UnixMilli()
+		if err := q.store.UpdateNotificationDelivery(delivery); err != nil {
+			log.Errorf("deliveryQueue.retryDue: could not claim delivery: %v, err=%v", delivery.DeliveryId, err)
+			q.unmarkInFlight(delivery.DeliveryId)
+			continue
+		}
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(delivery *alertutils.NotificationDelivery) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer q.unmarkInFlight(delivery.DeliveryId)
+			q.attempt(delivery, time.Now().UTC())
+		}(delivery)
+	}
+	wg.Wait()
+}
+
+func (q *deliveryQueue) pruneDeliveryLog(now time.Time) {
+	if now.Sub(q.lastPruned) < DELIVERY_LOG_PRUNE_INTERVAL {
+		return
+	}
+	q.lastPruned = now
+	if err := q.store.PruneNotificationDeliveryAttempts(DELIVERY_LOG_SIZE); err != nil {
+		log.Errorf("deliveryQueue.pruneDeliveryLog: could not prune the delivery log, err=%v", err)
+	}
+}
+
+/*
+Sends the delivery and records the attempt in the delivery log. A delivery
+that was delivered leaves the queue. One that failed is retried after a delay
+that doubles with every attempt, or after the delay the destination asked for
+if that is longer. It becomes a dead letter when retrying cannot help or after
+MAX_DELIVERY_ATTEMPTS attempts.
+*/
+func (q *deliveryQueue) attempt(delivery *alertutils.NotificationDelivery, now time.Time) {
+	result := q.send(delivery.ContactType, &delivery.Request)
+
+	delivery.Attempts++
+	delivery.LastAttemptAt = now
+	delivery.LastStatusCode = result.statusCode
+	delivery.LastLatencyMs = result.latency.Milliseconds()
+	delivery.LastError = ""
+	if result.retryAfter > 0 {
+		q.blockDestination(delivery, now.Add(result.retryAfter))
+	}
+
+	queued := q.isQueued(delivery)
+	switch {
+	case result.err == nil:
+		delivery.Status = alertutils.DeliveryDelivered
+	case result.permanent || !queued || delivery.Attempts >= MAX_DELIVERY_ATTEMPTS:
+		delivery.Status = alertutils.DeliveryDead
+	default:
+		delivery.Status = alertutils.DeliveryPending
+		delay := getDeliveryRetryDelay(delivery.Attempts)
+		if result.retryAfter > delay {
+			delay = result.retryAfter
+		}
+		delivery.NextAttemptAtMs = now.Add(delay).UnixMilli()
+	}
+	if result.err != nil {
+		delivery.LastError = result.err.Error()
+		log.Errorf("deliveryQueue.attempt: attempt %v of the %v delivery to %v of contact: %v failed, status: %v, err=%v",
+			delivery.Attempts, delivery.ContactType, delivery.Destination, delivery.ContactId, delivery.Status, result.err)
+	}
+	if delivery.Status == alertutils.DeliveryDelivered && delivery.Request.ResolvesIncident != "" && q.store != nil {
+		err := q.store.DeleteOpenIncident(delivery.ContactId, delivery.ContactType, delivery.Request.ResolvesIncident)
+		if err != nil {
+			log.Errorf("deliveryQueue.attempt: could not close incident: %v of contact: %v, err=%v",
+				delivery.Request.ResolvesIncident, delivery.ContactId, err)
+		}
+	}
+	if !queued {
+		return
+	}
+
+	err := q.store.AddNotificationDeliveryAttempt(&alertutils.NotificationDeliveryAttempt{
+		DeliveryId:  delivery.DeliveryId,
+		OrgId:       delivery.OrgId,
+		ContactId:   delivery.ContactId,
+		ContactType: delivery.ContactType,
+		Destination: delivery.Destination,
+		Subject:     delivery.Subject,
+		Attempt:     delivery.Attempts,
+		Status:      delivery.Status,
+		StatusCode:  result.statusCode,
+		LatencyMs:   delivery.LastLatencyMs,
+		Error:       delivery.LastError,
+		AttemptedAt: now,
+	})
+	if err != nil {
+		log.Errorf("deliveryQueue.attempt: could not log the attempt of delivery: %v, err=%v", delivery.DeliveryId, err)
+	}
+	if delivery.Status == alertutils.DeliveryDelivered {
+		err = q.store.DeleteNotificationDelivery(delivery.DeliveryId)
+	} else {
+		err = q.store.UpdateNotificationDelivery(delivery)
+	}
+	if err != nil {
+		log.Errorf("deliveryQueue.attempt: could not update delivery: %v, err=%v", delivery.DeliveryId, err)
+	}
+}
+
+// Moves a dead letter back to the queue with a new round of attempts, and
+// attempts it right away unless its destination is rate limited.
+func (q *deliveryQueue) resend(delivery *alertutils.NotificationDelivery, now time.Time) error {
+	if !q.markInFlight(delivery.DeliveryId) {
+		return fmt.Errorf("delivery %v is being attempted", delivery.DeliveryId)
+	}
+	defer q.unmarkInFlight(delivery.DeliveryId)
+
+	delivery.Status = alertutils.DeliveryPending
+	delivery.Attempts = 0
+	if delay := q.takeRateLimit(delivery, now); delay > 0 {
+		delivery.NextAttemptAtMs = now.Add(delay).UnixMilli()
+		return q.store.UpdateNotificationDelivery(delivery)
+	}
+	q.attempt(delivery, now)
+	return nil
+}
+
+func sendDeliveryRequest(contactType string, request *alertutils.DeliveryRequest) *deliveryResult {
+	start := time.Now()
+	var result *deliveryResult
+	switch contactType {
+	case alertutils.EmailContactType:
+		result = sendEmailRequest(request)
+	case alertutils.SlackContactType:
+		result = sendSlackRequest(request)
+	case alertutils.WebhookContactType:
+		client := alertutils.GetCertErrorForgivingHttpClient()
+		client.Timeout = DELIVERY_SEND_TIMEOUT
+		result = postRequest(client, request)
+	default:
+		result = postRequest(integrationHttpClient, request)
+	}
+	result.latency = time.Since(start)
+	return result
+}
+
+// Sends the requests once, e.g. to test a contact point.
+func sendDeliveryRequests(contactType string, requests []*alertutils.DeliveryRequest) error {
+	var errs []error
+	for _, request := range requests {
+		if result := sendDeliveryRequest(contactType, request); result.err != nil {
+			errs = append(errs, result.err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func sendEmailRequest(request *alertutils.DeliveryRequest) *deliveryResult {
+	host, port, senderEmail, senderPassword := config.GetEmailConfig()
+	auth := smtp.PlainAuth("", senderEmail, senderPassword, host)
+	err := sendMail(host, port, auth, senderEmail, request.To, []byte(request.Body))
+	if err == nil {
+		return &deliveryResult{}
+	}
+
+	result := &deliveryResult{err: err}
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		// 4xx replies are transient, 5xx replies are permanent
+		result.statusCode = smtpErr.Code
+		result.permanent = smtpErr.Code >= 500
+	}
+	return result
+}
+
+// Sends the email like smtp.SendMail, giving up after DELIVERY_SEND_TIMEOUT.
+func sendMail(host string, port int, auth smtp.Auth, from string, to string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), DELIVERY_SEND_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	err = conn.SetDeadline(time.Now().Add(DELIVERY_SEND_TIMEOUT))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if ok, _ := client.Extension("AUTH"); ok {
+		err = client.Auth(auth)
+		if err != nil {
+			return err
+		}
+	}
+	err = client.Mail(from)
+	if err != nil {
+		return err
+	}
+	err = client.Rcpt(to)
+	if err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func sendSlackRequest(request *alertutils.DeliveryRequest) *deliveryResult {
+	var attachment slack.Attachment
+	if err := json.Unmarshal([]byte(request.Body), &attachment); err != nil {
+		return &deliveryResult{err: err, permanent: true}
+	}
+	client := slack.New(request.Token, slack.OptionDebug(false), slack.OptionAPIURL(slackAPIURL),
+		slack.OptionHTTPClient(&http.Client{Timeout: DELIVERY_SEND_TIMEOUT}))
+	_, _, err := client.PostMessage(request.Channel, slack.MsgOptionAttachments(attachment))
+	if err == nil {
+		return &deliveryResult{statusCode: http.StatusOK}
+	}
+
+	result := &deliveryResult{err: err}
+	var rateLimitedErr *slack.RateLimitedError
+	var statusCodeErr slack.StatusCodeError
+	var slackErr slack.SlackErrorResponse
+	switch {
+	case errors.As(err, &rateLimitedErr):
+		result.statusCode = http.StatusTooManyRequests
+		result.retryAfter = rateLimitedErr.RetryAfter
+	case errors.As(err, &statusCodeErr):
+		result.statusCode = statusCodeErr.Code
+		result.permanent = isPermanentStatusCode(statusCodeErr.Code)
+	case errors.As(err, &slackErr):
+		// Slack answers 200 with the error
+		result.statusCode = http.StatusOK
+		result.permanent = !retryableSlackErrors[slackErr.Err]
+	}
+	return result
+}
+
+func postRequest(client *http.Client, request *alertutils.DeliveryRequest) *deliveryResult {
+	req, err := http.NewRequest(http.MethodPost, request.Url, strings.NewReader(request.Body))
+	if err != nil {
+		return &deliveryResult{err: err, permanent: true}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range request.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return &deliveryResult{err: err}
+	}
+	defer resp.Body.Close()
+	result := &deliveryResult{statusCode: resp.StatusCode}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return result
+	}
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	result.err = fmt.Errorf("request failed with status %v: %v", resp.Status, strings.TrimSpace(string(respBody)))
+	result.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	result.permanent = isPermanentStatusCode(resp.StatusCode)
+	return result
+}
+
+// Client errors fail again when retried, except timeouts and rate limiting.
+func isPermanentStatusCode(statusCode int) bool {
+	return statusCode >= 400 && statusCode < 500 &&
+		statusCode != http.StatusRequestTimeout && statusCode != http.StatusTooManyRequests
+}
+
+// Parses a Retry-After header, which is either seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+type deadLettersRequest struct {
+	DeliveryIds []string `json:"delivery_ids"`
+}
+
+// Returns the attempts of deliveries to the contact point, the newest first.
+// The limit query parameter defaults to DEFAULT_DELIVERY_LOG_LIMIT.
+func ProcessGetDeliveryLogRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	contactId := string(ctx.QueryArgs().Peek("contact_id"))
+	if contactId == "" {
+		utils.SendError(ctx, "contact_id is required but is missing", "", nil)
+		return
+	}
+	limit := DEFAULT_DELIVERY_LOG_LIMIT
+	if value := string(ctx.QueryArgs().Peek("limit")); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			utils.SendError(ctx, fmt.Sprintf("Invalid limit: %v", value), "", err)
+			return
+		}
+		limit = parsed
+	}
+	contact, err := databaseObj.GetContact(contactId)
+	if err != nil || contact.OrgId != org_id {
+		utils.SendError(ctx, fmt.Sprintf("Contact point not found: %v", contactId), "", err)
+		return
+	}
+
+	attempts, err := databaseObj.GetNotificationDeliveryAttempts(contactId, limit)
+	if err != nil {
+		utils.SendError(ctx, "Failed to get the delivery log", fmt.Sprintf("contact ID: %v", contactId), err)
+		return
+	}
+
+	responseBody := make(map[string]interface{})
+	responseBody["deliveryLog"] = attempts
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+func ProcessGetDeadLettersRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	deadLetters, err := databaseObj.GetNotificationDeliveries(org_id, alertutils.DeliveryDead)
+	if err != nil {
+		utils.SendError(ctx, "Failed to get the dead letters", "", err)
+		return
+	}
+
+	responseBody := make(map[string]interface{})
+	responseBody["deadLetters"] = deadLetters
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+// Resends the dead letters and returns them with the status after their
+// first attempt.
+func ProcessResendDeadLettersRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	deadLetters, ok := getDeadLetters(ctx, org_id)
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	for _, delivery := range deadLetters {
+		if err := notificationQueue.resend(delivery, now); err != nil {
+			utils.SendError(ctx, fmt.Sprintf("Failed to resend the dead letter. Error=%v", err), fmt.Sprintf("delivery ID: %v", delivery.DeliveryId), err)
+			return
+		}
+	}
+
+	responseBody := make(map[string]interface{})
+	responseBody["deliveries"] = deadLetters
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+func ProcessDeleteDeadLettersRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	deadLetters, ok := getDeadLetters(ctx, org_id)
+	if !ok {
+		return
+	}
+	for _, delivery := range deadLetters {
+		if err := databaseObj.DeleteNotificationDelivery(delivery.DeliveryId); err != nil {
+			utils.SendError(ctx, fmt.Sprintf("Failed to delete the dead letter. Error=%v", err), fmt.Sprintf("delivery ID: %v", delivery.DeliveryId), err)
+			return
+		}
+	}
+
+	responseBody := make(map[string]interface{})
+	responseBody["message"] = "Dead letters deleted successfully"
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+// Returns the dead letters of the org with the ids in the request body. Sends
+// an error if any of them is not a dead letter of the org.
+func getDeadLetters(ctx *fasthttp.RequestCtx, org_id int64) ([]*alertutils.NotificationDelivery, bool) {
+	var request deadLettersRequest
+	if err := json.Unmarshal(ctx.PostBody(), &request); err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to unmarshal json. Error=%v", err), "", err)
+		return nil, false
+	}
+	if len(request.DeliveryIds) == 0 {
+		utils.SendError(ctx, "delivery_ids is required but is missing", "", nil)
+		return nil, false
+	}
+
+	deadLetters := make([]*alertutils.NotificationDelivery, 0, len(request.DeliveryIds))
+	for _, deliveryId := range request.DeliveryIds {
+		delivery, err := databaseObj.GetNotificationDelivery(deliveryId)
+		if err != nil {
+			utils.SendError(ctx, "Failed to get the dead letter", fmt.Sprintf("delivery ID: %v", deliveryId), err)
+			return nil, false
+		}
+		if delivery == nil || delivery.OrgId != org_id || delivery.Status != alertutils.DeliveryDead {
+			utils.SendError(ctx, fmt.Sprintf("Dead letter not found: %v", deliveryId), "", nil)
+			return nil, false
+		}
+		deadLetters = append(deadLetters, delivery)
+	}
+	return deadLetters, true
+}
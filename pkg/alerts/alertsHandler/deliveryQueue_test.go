@@ -0,0 +1,363 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/siglens/siglens/pkg/alerts/alertsqlite"
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// A destination that answers with the status codes in order, then with 200.
+type flakyDestination struct {
+	mu          sync.Mutex
+	statusCodes []int
+	retryAfter  string
+	requests    int
+}
+
+func (d *flakyDestination) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requests++
+	if len(d.statusCodes) == 0 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	statusCode := d.statusCodes[0]
+	d.statusCodes = d.statusCodes[1:]
+	if d.retryAfter != "" {
+		w.Header().Set("Retry-After", d.retryAfter)
+	}
+	w.WriteHeader(statusCode)
+}
+
+func (d *flakyDestination) getRequests() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.requests
+}
+
+func setupDeliveryTest(t *testing.T, statusCodes ...int) (*alertsqlite.Sqlite, *alertutils.Contact, *flakyDestination) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "siglens.db")), &gorm.Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, db.AutoMigrate(&alertutils.Contact{}, &alertutils.SlackTokenConfig{}, &alertutils.WebHookConfig{},
+		&alertutils.NotificationDelivery{}, &alertutils.NotificationDeliveryAttempt{}, &alertutils.AlertInstance{}, &alertutils.OpenIncident{}))
+	p := &alertsqlite.Sqlite{}
+	p.SetDB(db)
+	databaseObj = p
+
+	queue := notificationQueue
+	notificationQueue = newDeliveryQueue()
+	notificationQueue.store = p
+	t.Cleanup(func() {
+		notificationQueue = queue
+		databaseObj = nil
+	})
+
+	destination := &flakyDestination{statusCodes: statusCodes}
+	server := httptest.NewServer(destination)
+	t.Cleanup(server.Close)
+
+	contact := &alertutils.Contact{
+		ContactName: "oncall",
+		Webhook:     []alertutils.WebHookConfig{{Webhook: server.URL + "/hook?token=secret"}},
+	}
+	assert.Nil(t, p.CreateContact(contact))
+	return p, contact, destination
+}
+
+func getDeliveryLog(t *testing.T, contactId string) []*alertutils.NotificationDeliveryAttempt {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.QueryArgs().Set("contact_id", contactId)
+	ProcessGetDeliveryLogRequest(ctx, 0)
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode(), string(ctx.Response.Body()))
+
+	var response struct {
+		DeliveryLog []*alertutils.NotificationDeliveryAttempt `json:"deliveryLog"`
+	}
+	assert.Nil(t, json.Unmarshal(ctx.Response.Body(), &response))
+	return response.DeliveryLog
+}
+
+func getTestDeadLetters(t *testing.T) []*alertutils.NotificationDelivery {
+	ctx := &fasthttp.RequestCtx{}
+	ProcessGetDeadLettersRequest(ctx, 0)
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode(), string(ctx.Response.Body()))
+
+	var response struct {
+		DeadLetters []*alertutils.NotificationDelivery `json:"deadLetters"`
+	}
+	assert.Nil(t, json.Unmarshal(ctx.Response.Body(), &response))
+	return response.DeadLetters
+}
+
+func Test_DeliveryQueueRetries(t *testing.T) {
+	p, contact, destination := setupDeliveryTest(t, http.StatusServiceUnavailable, http.StatusBadGateway)
+
+	sent, err := sendToContactPoint(contact.ContactId, "High CPU", "CPU is high", alertutils.Firing, "", 1, nil, nil)
+	assert.Nil(t, err)
+	assert.True(t, sent)
+
+	now := time.Now().UTC()
+	due, err := p.GetDueNotificationDeliveries(now, MAX_DUE_DELIVERIES)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(due))
+	due, err = p.GetDueNotificationDeliveries(now.Add(getDeliveryRetryDelay(1)), MAX_DUE_DELIVERIES)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(due))
+	assert.Equal(t, 1, due[0].Attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, due[0].LastStatusCode)
+	assert.Equal(t, 1, destination.getRequests())
+
+	// the second retry is only due after the doubled delay
+	notificationQueue.retryDue(now.Add(getDeliveryRetryDelay(1)))
+	assert.Equal(t, 2, destination.getRequests())
+	notificationQueue.retryDue(now.Add(getDeliveryRetryDelay(1) + time.Second))
+	assert.Equal(t, 2, destination.getRequests())
+	notificationQueue.retryDue(now.Add(getDeliveryRetryDelay(1) + getDeliveryRetryDelay(2) + time.Second))
+	assert.Equal(t, 3, destination.getRequests())
+
+	// the delivered notification leaves the queue, the delivery log keeps its attempts
+	due, err = p.GetDueNotificationDeliveries(now.Add(time.Hour), MAX_DUE_DELIVERIES)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(due))
+	deliveryLog := getDeliveryLog(t, contact.ContactId)
+	assert.Equal(t, 3, len(deliveryLog))
+	assert.Equal(t, alertutils.DeliveryDelivered, deliveryLog[0].Status)
+	assert.Equal(t, 3, deliveryLog[0].Attempt)
+	assert.Equal(t, http.StatusOK, deliveryLog[0].StatusCode)
+	assert.Equal(t, alertutils.DeliveryPending, deliveryLog[1].Status)
+	assert.Equal(t, http.StatusBadGateway, deliveryLog[1].StatusCode)
+	assert.NotEmpty(t, deliveryLog[2].Error)
+	assert.Equal(t, alertutils.WebhookContactType, deliveryLog[2].ContactType)
+	assert.NotContains(t, deliveryLog[2].Destination, "secret")
+
+	// a follower does not retry the deliveries
+	alertLeader = newAlertLeaderElector(newMockDatabase(), "follower")
+	defer func() { alertLeader = nil }()
+	destination.statusCodes = []int{http.StatusInternalServerError}
+	sent, err = sendToContactPoint(contact.ContactId, "High CPU", "CPU is high", alertutils.Firing, "", 1, nil, nil)
+	assert.Nil(t, err)
+	assert.True(t, sent)
+	notificationQueue.retryDue(now.Add(time.Hour))
+	assert.Equal(t, 4, destination.getRequests())
+}
+
+func Test_DeliveryQueueDeadLetters(t *testing.T) {
+	p, contact, destination := setupDeliveryTest(t, http.StatusBadRequest)
+
+	// a client error is not retried
+	sent, err := sendToContactPoint(contact.ContactId, "High CPU", "CPU is high", alertutils.Firing, "", 1, nil, nil)
+	assert.NotNil(t, err)
+	assert.False(t, sent)
+	deadLetters := getTestDeadLetters(t)
+	assert.Equal(t, 1, len(deadLetters))
+	assert.Equal(t, http.StatusBadRequest, deadLetters[0].LastStatusCode)
+	assert.Equal(t, contact.ContactId, deadLetters[0].ContactId)
+
+	// resending delivers it
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetBody([]byte(`{"delivery_ids": ["` + deadLetters[0].DeliveryId + `"]}`))
+	ProcessResendDeadLettersRequest(ctx, 0)
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode(), string(ctx.Response.Body()))
+	assert.Equal(t, 2, destination.getRequests())
+	assert.Equal(t, 0, len(getTestDeadLetters(t)))
+
+	// so is a delivery that failed every attempt
+	destination.statusCodes = make([]int, MAX_DELIVERY_ATTEMPTS)
+	for i := range destination.statusCodes {
+		destination.statusCodes[i] = http.StatusServiceUnavailable
+	}
+	_, err = sendToContactPoint(contact.ContactId, "High CPU", "CPU is high", alertutils.Firing, "", 1, nil, nil)
+	assert.Nil(t, err)
+	now := time.Now().UTC()
+	for i := 0; i < MAX_DELIVERY_ATTEMPTS; i++ {
+		notificationQueue.retryDue(now.Add(time.Duration(i+1) * DELIVERY_RETRY_MAX_DELAY))
+	}
+	assert.Equal(t, 2+MAX_DELIVERY_ATTEMPTS, destination.getRequests())
+	deadLetters = getTestDeadLetters(t)
+	assert.Equal(t, 1, len(deadLetters))
+	assert.Equal(t, MAX_DELIVERY_ATTEMPTS, deadLetters[0].Attempts)
+
+	// only dead letters of the org can be resent or deleted
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.SetBody([]byte(`{"delivery_ids": ["` + deadLetters[0].DeliveryId + `"]}`))
+	ProcessDeleteDeadLettersRequest(ctx, 1)
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.SetBody([]byte(`{"delivery_ids": ["` + deadLetters[0].DeliveryId + `"]}`))
+	ProcessDeleteDeadLettersRequest(ctx, 0)
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode(), string(ctx.Response.Body()))
+	assert.Equal(t, 0, len(getTestDeadLetters(t)))
+	delivery, err := p.GetNotificationDelivery(deadLetters[0].DeliveryId)
+	assert.Nil(t, err)
+	assert.Nil(t, delivery)
+}
+
+func Test_DeliveryQueueRetryAfter(t *testing.T) {
+	p, contact, destination := setupDeliveryTest(t, http.StatusTooManyRequests)
+	destination.retryAfter = "120"
+
+	sent, err := sendToContactPoint(contact.ContactId, "High CPU", "CPU is high", alertutils.Firing, "", 1, nil, nil)
+	assert.Nil(t, err)
+	assert.True(t, sent)
+
+	// the destination is not sent anything before it asked
+	_, err = sendToContactPoint(contact.ContactId, "High CPU", "CPU is high", alertutils.Firing, "", 1, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, destination.getRequests())
+
+	now := time.Now().UTC()
+	notificationQueue.retryDue(now.Add(time.Minute))
+	assert.Equal(t, 1, destination.getRequests())
+	notificationQueue.retryDue(now.Add(3 * time.Minute))
+	assert.Equal(t, 3, destination.getRequests())
+
+	attempts, err := p.GetNotificationDeliveryAttempts(contact.ContactId, DEFAULT_DELIVERY_LOG_LIMIT)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(attempts))
+	assert.Equal(t, http.StatusTooManyRequests, attempts[2].StatusCode)
+}
+
+func Test_DeliveryQueueClaims(t *testing.T) {
+	p, contact, _ := setupDeliveryTest(t)
+
+	// the delivery is not due for the queue while it is being sent
+	dueDuringSend := 0
+	notificationQueue.send = func(contactType string, request *alertutils.DeliveryRequest) *deliveryResult {
+		due, err := p.GetDueNotificationDeliveries(time.Now().UTC().Add(DELIVERY_SEND_TIMEOUT), MAX_DUE_DELIVERIES)
+		assert.Nil(t, err)
+		dueDuringSend += len(due)
+		return &deliveryResult{statusCode: http.StatusServiceUnavailable, err: errors.New("unavailable")}
+	}
+	delivery := newNotificationDelivery(contact, alertutils.WebhookContactType, "High CPU",
+		&alertutils.DeliveryRequest{Url: "https://hooks.example.com/oncall", Body: "{}"})
+	now := time.Now().UTC()
+	assert.True(t, notificationQueue.enqueue([]*alertutils.NotificationDelivery{delivery}, now))
+	notificationQueue.retryDue(now.Add(time.Hour))
+	assert.Equal(t, 0, dueDuringSend)
+
+	queued, err := p.GetNotificationDelivery(delivery.DeliveryId)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, queued.Attempts)
+	assert.Equal(t, alertutils.DeliveryPending, queued.Status)
+}
+
+func Test_DeliveryQueueRateLimitedEnqueue(t *testing.T) {
+	p, contact, _ := setupDeliveryTest(t)
+	sent := 0
+	send := func(contactType string, request *alertutils.DeliveryRequest) *deliveryResult {
+		sent++
+		return &deliveryResult{statusCode: http.StatusOK}
+	}
+	newSlackDeliveries := func() []*alertutils.NotificationDelivery {
+		deliveries := make([]*alertutils.NotificationDelivery, 0)
+		for i := 0; i < 3; i++ {
+			deliveries = append(deliveries, newNotificationDelivery(contact, alertutils.SlackContactType, "High CPU",
+				&alertutils.DeliveryRequest{Channel: "C1", Token: "xoxb-1", Body: "{}"}))
+		}
+		return deliveries
+	}
+
+	// the delivery beyond the burst of the channel is queued for later instead of waiting
+	notificationQueue.send = send
+	now := time.Now().UTC()
+	deliveries := newSlackDeliveries()
+	start := time.Now()
+	assert.True(t, notificationQueue.enqueue(deliveries, now))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, 2, sent)
+	queued, err := p.GetNotificationDelivery(deliveries[2].DeliveryId)
+	assert.Nil(t, err)
+	assert.Equal(t, alertutils.DeliveryPending, queued.Status)
+	assert.LessOrEqual(t, queued.NextAttemptAtMs, now.Add(2*time.Second).UnixMilli())
+
+	// without a queue it is dropped
+	queue := newDeliveryQueue()
+	queue.send = send
+	deliveries = newSlackDeliveries()
+	start = time.Now()
+	assert.True(t, queue.enqueue(deliveries, now))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, 4, sent)
+	assert.Equal(t, alertutils.DeliveryDead, deliveries[2].Status)
+	assert.NotEmpty(t, deliveries[2].LastError)
+}
+
+func Test_sendSlackRequest(t *testing.T) {
+	var slackError string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch slackError {
+		case "":
+			_, _ = w.Write([]byte(`{"ok": true, "channel": "C123", "ts": "1"}`))
+		case "ratelimited":
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			_, _ = w.Write([]byte(`{"ok": false, "error": "` + slackError + `"}`))
+		}
+	}))
+	defer server.Close()
+	defer func(apiURL string) { slackAPIURL = apiURL }(slackAPIURL)
+	slackAPIURL = server.URL + "/"
+
+	request, err := getSlackRequest("High CPU", "CPU is high", alertutils.SlackTokenConfig{ChannelId: "C123", SlToken: "token"},
+		alertutils.Firing, "", "")
+	assert.Nil(t, err)
+	result := sendDeliveryRequest(alertutils.SlackContactType, request)
+	assert.Nil(t, result.err)
+
+	slackError = "ratelimited"
+	result = sendDeliveryRequest(alertutils.SlackContactType, request)
+	assert.NotNil(t, result.err)
+	assert.Equal(t, http.StatusTooManyRequests, result.statusCode)
+	assert.Equal(t, 30*time.Second, result.retryAfter)
+	assert.False(t, result.permanent)
+
+	slackError = "channel_not_found"
+	result = sendDeliveryRequest(alertutils.SlackContactType, request)
+	assert.True(t, result.permanent)
+
+	slackError = "internal_error"
+	result = sendDeliveryRequest(alertutils.SlackContactType, request)
+	assert.False(t, result.permanent)
+}
+
+func Test_getDeliveryRetryDelay(t *testing.T) {
+	assert.Equal(t, DELIVERY_RETRY_BASE_DELAY, getDeliveryRetryDelay(1))
+	assert.Equal(t, 4*DELIVERY_RETRY_BASE_DELAY, getDeliveryRetryDelay(3))
+	assert.Equal(t, DELIVERY_RETRY_MAX_DELAY, getDeliveryRetryDelay(20))
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, 5*time.Second, parseRetryAfter("5", now))
+	assert.Equal(t, time.Minute, parseRetryAfter("Wed, 01 May 2024 12:01:00 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+}
@@ -0,0 +1,501 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often the dispatcher checks for aggregation groups to notify.
+const NOTIFICATION_DISPATCH_INTERVAL = time.Second
+
+// groupAlert is an alert instance in an aggregation group.
+type groupAlert struct {
+	alertId          string
+	alert            *alertutils.AlertDetails
+	message          string
+	alertDataMessage string
+	results          []map[string]interface{}  // the first rows of the result of the query
+	instance         *alertutils.AlertInstance // labeled with the name and the labels of the alert
+	silencedUntil    time.Time                 // silence of the alert by its id
+	notifiedFiring   bool
+}
+
+// aggregationGroup collects the alert instances that a route groups together,
+// so they are notified in one message.
+type aggregationGroup struct {
+	orgId        int64
+	route        *alertutils.MatchedRoute
+	contactId    string
+	labels       map[string]string
+	alerts       map[string]*groupAlert // alert id and fingerprint -> instance
+	nextFlush    time.Time
+	lastNotified time.Time
+	changed      bool // instances were added or changed state since the last notification
+	restored     *notificationLogEntry
+}
+
+// notificationLogEntry is the logged notification of a group that was notified
+// by another node. Instances notified as firing in it are not notified again.
+type notificationLogEntry alertutils.NotificationLogEntry
+
+func (entry *notificationLogEntry) hasNotifiedFiring(key string) bool {
+	if entry == nil {
+		return false
+	}
+	for _, firing := range entry.Firing {
+		if firing == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Like hasNotifiedFiring, but forgets the instance, so it is notified again
+// when it fires after it resolved.
+func (entry *notificationLogEntry) takeNotifiedFiring(key string) bool {
+	if entry == nil {
+		return false
+	}
+	for i, firing := range entry.Firing {
+		if firing == key {
+			entry.Firing = append(entry.Firing[:i], entry.Firing[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (d *notificationDispatcher) getNotificationLogEntry(groupKey string) *notificationLogEntry {
+	if d.notificationLog == nil {
+		return nil
+	}
+	entry, err := d.notificationLog.GetNotificationLogEntry(groupKey)
+	if err != nil {
+		log.Errorf("notificationDispatcher.getNotificationLogEntry: could not get the notification log of group: %v, err=%v", groupKey, err)
+		return nil
+	}
+	return (*notificationLogEntry)(entry)
+}
+
+// Logs the notification of the group, or removes the log of a deleted group.
+func (d *notificationDispatcher) updateNotificationLog(groupKey string, entry *alertutils.NotificationLogEntry) {
+	if d.notificationLog == nil {
+		return
+	}
+	var err error
+	if entry == nil {
+		err = d.notificationLog.DeleteNotificationLogEntry(groupKey)
+	} else {
+		err = d.notificationLog.UpdateNotificationLogEntry(entry)
+	}
+	if err != nil {
+		log.Errorf("notificationDispatcher.updateNotificationLog: could not update the notification log of group: %v, err=%v", groupKey, err)
+	}
+}
+
+// notificationLogStore persists the last notification of the aggregation
+// groups, so a node that takes over the evaluation of the alerts continues
+// their group_interval and repeat_interval instead of notifying them again.
+type notificationLogStore interface {
+	GetNotificationLogEntry(group_key string) (*alertutils.NotificationLogEntry, error)
+	UpdateNotificationLogEntry(entry *alertutils.NotificationLogEntry) error
+	DeleteNotificationLogEntry(group_key string) error
+}
+
+type groupNotification struct {
+	orgId            int64
+	contactId        string
+	subject          string
+	message          string
+	alertDataMessage string
+	state            alertutils.AlertState
+	instances        []*alertutils.AlertInstance
+	templateData     *alertutils.NotificationTemplateData
+}
+
+// notificationDispatcher routes the instances of the alerts of orgs that have
+// a notification routing to aggregation groups and periodically notifies the
+// groups with group_wait, group_interval and repeat_interval.
+type notificationDispatcher struct {
+	mu      sync.Mutex
+	groups  map[string]*aggregationGroup
+	routing map[int64]*alertutils.NotificationRouting
+	firing  map[int64]map[string][]map[string]string // org id -> alert id -> labels of the firing instances
+	send    func(notification *groupNotification) error
+	once    sync.Once
+
+	notificationLog notificationLogStore // nil if the notifications are not logged
+}
+
+var alertDispatcher = newNotificationDispatcher()
+
+func newNotificationDispatcher() *notificationDispatcher {
+	return &notificationDispatcher{
+		groups:  make(map[string]*aggregationGroup),
+		routing: make(map[int64]*alertutils.NotificationRouting),
+		firing:  make(map[int64]map[string][]map[string]string),
+		send:    sendGroupNotification,
+	}
+}
+
+func (d *notificationDispatcher) start() {
+	d.once.Do(func() {
+		go func() {
+			ticker := time.NewTicker(NOTIFICATION_DISPATCH_INTERVAL)
+			defer ticker.Stop()
+			for range ticker.C {
+				d.flush(time.Now().UTC())
+			}
+		}()
+	})
+}
+
+func getAlertInstanceKey(alertId string, fingerprint string) string {
+	return alertId + "/" + fingerprint
+}
+
+// Adds the firing instances of the alert to the groups of their routes and
+// marks the instances that resolved. Pending instances are not notified.
+func (d *notificationDispatcher) dispatch(alert *alertutils.AlertDetails, routing *alertutils.NotificationRouting,
+	instances []*alertutils.AlertInstance, alertDataMessage string, results []map[string]interface{}, now time.Time) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.routing[alert.OrgId] = routing
+	var firing []map[string]string
+	for _, instance := range instances {
+		if instance.State != alertutils.Firing && instance.State != alertutils.Normal {
+			continue
+		}
+
+		labels := alertutils.GetSilenceLabels(alert, instance.Labels)
+		if instance.State == alertutils.Firing {
+			firing = append(firing, labels)
+		}
+		labeledInstance := *instance
+		labeledInstance.Labels = labels
+
+		for _, route := range routing.Match(labels) {
+			contactId := route.ContactID
+			if contactId == "" {
+				contactId = alert.ContactID
+			}
+			groupLabels := route.GetGroupLabels(labels)
+			groupKey := fmt.Sprintf("%v/%v/%v/%v", alert.OrgId, route.Path, contactId, alertutils.GetInstanceFingerprint(groupLabels))
+
+			key := getAlertInstanceKey(alert.AlertId, instance.Fingerprint)
+			group, ok := d.groups[groupKey]
+			if !ok {
+				entry := d.getNotificationLogEntry(groupKey)
+				if instance.State != alertutils.Firing && !entry.hasNotifiedFiring(key) {
+					continue
+				}
+				group = &aggregationGroup{
+					orgId:     alert.OrgId,
+					route:     route,
+					contactId: contactId,
+					labels:    groupLabels,
+					alerts:    make(map[string]*groupAlert),
+					nextFlush: now.Add(route.GroupWait),
+					restored:  entry,
+				}
+				if entry != nil {
+					group.lastNotified = entry.LastNotified
+				}
+				d.groups[groupKey] = group
+			}
+
+			existing, ok := group.alerts[key]
+			restored := !ok && group.restored.takeNotifiedFiring(key)
+			if !ok && !restored && instance.State != alertutils.Firing {
+				continue
+			}
+			if restored {
+				// Notified as firing by the node that evaluated the alert before.
+				existing = &groupAlert{instance: &alertutils.AlertInstance{State: alertutils.Firing}, notifiedFiring: true}
+				ok = true
+			}
+			if !ok || existing.instance.State != instance.State {
+				group.changed = true
+			}
+			current := &groupAlert{
+				alertId:          alert.AlertId,
+				alert:            alert,
+				message:          alert.Message,
+				alertDataMessage: alertDataMessage,
+				results:          results,
+				instance:         &labeledInstance,
+				silencedUntil:    time.Unix(int64(alert.SilenceEndTime), 0),
+			}
+			if ok {
+				current.notifiedFiring = existing.notifiedFiring
+			}
+			group.alerts[key] = current
+		}
+	}
+
+	if _, ok := d.firing[alert.OrgId]; !ok {
+		d.firing[alert.OrgId] = make(map[string][]map[string]string)
+	}
+	d.firing[alert.OrgId][alert.AlertId] = firing
+}
+
+// Removes the instances of a deleted alert.
+func (d *notificationDispatcher) removeAlert(alertId string) {
+	d.removeAlerts(func(id string) bool { return id == alertId })
+}
+
+// Removes the instances of the external alerts, which only the node that
+// evaluates the alerts notifies.
+func (d *notificationDispatcher) removeExternalAlerts() {
+	d.removeAlerts(func(id string) bool { return strings.HasPrefix(id, EXTERNAL_ALERT_ID_PREFIX) })
+}
+
+func (d *notificationDispatcher) removeAlerts(matches func(alertId string) bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for groupKey, group := range d.groups {
+		for key, alert := range group.alerts {
+			if matches(alert.alertId) {
+				delete(group.alerts, key)
+			}
+		}
+		if len(group.alerts) == 0 {
+			delete(d.groups, groupKey)
+		}
+	}
+	for _, alerts := range d.firing {
+		for alertId := range alerts {
+			if matches(alertId) {
+				delete(alerts, alertId)
+			}
+		}
+	}
+}
+
+// Drops the groups of an org whose notification routing was changed or removed.
+func (d *notificationDispatcher) resetOrg(orgId int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for groupKey, group := range d.groups {
+		if group.orgId == orgId {
+			delete(d.groups, groupKey)
+		}
+	}
+	delete(d.routing, orgId)
+	delete(d.firing, orgId)
+}
+
+// Sends the notifications of the groups that are due. Only the node that
+// evaluates the alerts notifies, so the external alerts that every node
+// receives are notified once.
+func (d *notificationDispatcher) flush(now time.Time) {
+	if !isAlertEvaluationLeader() {
+		return
+	}
+	d.mu.Lock()
+	var notifications []*groupNotification
+	notificationLog := make(map[string]*alertutils.NotificationLogEntry) // group key -> entry, nil if deleted
+	silencesByOrg := make(map[int64][]*alertutils.Silence)
+	windowsByOrg := make(map[int64][]*alertutils.MaintenanceWindow)
+	for groupKey, group := range d.groups {
+		if now.Before(group.nextFlush) {
+			continue
+		}
+		if _, ok := silencesByOrg[group.orgId]; !ok {
+			silencesByOrg[group.orgId], windowsByOrg[group.orgId] = getSilencesAndMaintenanceWindows(group.orgId)
+		}
+
+		notification := d.flushGroup(group, silencesByOrg[group.orgId], windowsByOrg[group.orgId], now)
+		if notification != nil {
+			notifications = append(notifications, notification)
+			notificationLog[groupKey] = group.getNotificationLogEntry(groupKey)
+		}
+		if len(group.alerts) == 0 {
+			delete(d.groups, groupKey)
+			notificationLog[groupKey] = nil
+		}
+	}
+	d.mu.Unlock()
+
+	for _, notification := range notifications {
+		err := d.send(notification)
+		if err != nil {
+			log.Errorf("notificationDispatcher.flush: could not send the notification %v to contact: %v, err=%v", notification.subject, notification.contactId, err)
+		}
+	}
+	for groupKey, entry := range notificationLog {
+		d.updateNotificationLog(groupKey, entry)
+	}
+}
+
+func (group *aggregationGroup) getNotificationLogEntry(groupKey string) *alertutils.NotificationLogEntry {
+	entry := &alertutils.NotificationLogEntry{
+		GroupKey:     groupKey,
+		OrgId:        group.orgId,
+		LastNotified: group.lastNotified,
+	}
+	for key, alert := range group.alerts {
+		if alert.notifiedFiring {
+			entry.Firing = append(entry.Firing, key)
+		}
+	}
+	sort.Strings(entry.Firing)
+	return entry
+}
+
+func getSilencesAndMaintenanceWindows(orgId int64) ([]*alertutils.Silence, []*alertutils.MaintenanceWindow) {
+	if databaseObj == nil {
+		return nil, nil
+	}
+	silences, err := databaseObj.GetAllSilences(orgId)
+	if err != nil {
+		log.Errorf("getSilencesAndMaintenanceWindows: could not get the silences of org: %v, err=%v", orgId, err)
+	}
+	windows, err := databaseObj.GetAllMaintenanceWindows(orgId)
+	if err != nil {
+		log.Errorf("getSilencesAndMaintenanceWindows: could not get the maintenance windows of org: %v, err=%v", orgId, err)
+	}
+	return silences, windows
+}
+
+/*
+Returns the notification of the group, or nil if it should not be notified.
+The first notification is sent group_wait after the group was created. After
+that the group is notified every group_interval if its instances changed, and
+every repeat_interval while instances keep firing. Silenced and inhibited
+instances are left out; resolved instances are notified once if their firing
+was notified.
+*/
+func (d *notificationDispatcher) flushGroup(group *aggregationGroup, silences []*alertutils.Silence,
+	windows []*alertutils.MaintenanceWindow, now time.Time) *groupNotification {
+
+	group.nextFlush = now.Add(group.route.GroupInterval)
+
+	var inhibitRules []*alertutils.InhibitRule
+	if routing, ok := d.routing[group.orgId]; ok {
+		inhibitRules = routing.InhibitRules
+	}
+	var firingSources []map[string]string
+	for _, labels := range d.firing[group.orgId] {
+		firingSources = append(firingSources, labels...)
+	}
+
+	var firing, resolved []string
+	for key, alert := range group.alerts {
+		if alert.instance.State != alertutils.Firing {
+			if alert.notifiedFiring {
+				resolved = append(resolved, key)
+			} else {
+				delete(group.alerts, key)
+			}
+			continue
+		}
+		labels := alert.instance.Labels
+		if now.Before(alert.silencedUntil) || alertutils.IsSilenced(labels, silences, windows, now) ||
+			alertutils.IsInhibited(inhibitRules, labels, firingSources) {
+			continue
+		}
+		firing = append(firing, key)
+	}
+
+	var shouldSend bool
+	switch {
+	case len(firing) == 0 && len(resolved) == 0:
+		shouldSend = false
+	case group.changed:
+		shouldSend = true
+	case !group.lastNotified.IsZero() && now.Sub(group.lastNotified) >= group.route.RepeatInterval:
+		shouldSend = len(firing) > 0
+	}
+	if !shouldSend {
+		return nil
+	}
+
+	sort.Strings(firing)
+	sort.Strings(resolved)
+	notification := &groupNotification{
+		orgId:     group.orgId,
+		contactId: group.contactId,
+		state:     alertutils.Normal,
+	}
+	alertIds := make(map[string]struct{})
+	var notified *groupAlert
+	for _, key := range firing {
+		alert := group.alerts[key]
+		alert.notifiedFiring = true
+		alertIds[alert.alertId] = struct{}{}
+		notified = alert
+		notification.instances = append(notification.instances, alert.instance)
+		notification.message = alert.message
+		notification.alertDataMessage = alert.alertDataMessage
+	}
+	for _, key := range resolved {
+		alert := group.alerts[key]
+		alertIds[alert.alertId] = struct{}{}
+		notification.instances = append(notification.instances, alert.instance)
+		if notification.message == "" {
+			notification.message = alert.message
+		}
+		if notified == nil {
+			notified = alert
+		}
+		delete(group.alerts, key)
+	}
+
+	groupLabels := alertutils.FormatInstanceLabels(group.labels)
+	if len(firing) > 0 {
+		notification.state = alertutils.Firing
+		notification.subject = fmt.Sprintf("[FIRING:%v] %v", len(firing), groupLabels)
+	} else {
+		notification.subject = fmt.Sprintf("[RESOLVED] %v", groupLabels)
+	}
+	if len(alertIds) > 1 {
+		// The message and the data of one alert do not describe the others.
+		notification.message = fmt.Sprintf("%v firing and %v resolved alert instances", len(firing), len(resolved))
+		notification.alertDataMessage = ""
+		notification.templateData = &alertutils.NotificationTemplateData{}
+	} else {
+		notification.templateData = getAlertTemplateData(notified.alert, notified.results)
+	}
+	notification.templateData.GroupLabels = group.labels
+
+	group.changed = false
+	group.lastNotified = now
+	return notification
+}
+
+func sendGroupNotification(notification *groupNotification) error {
+	if notification.contactId == "" {
+		return fmt.Errorf("sendGroupNotification: no contact point for notification %v", notification.subject)
+	}
+	_, err := sendToContactPoint(notification.contactId, notification.subject, notification.message, notification.state,
+		notification.alertDataMessage, 0, notification.instances, notification.templateData)
+	return err
+}
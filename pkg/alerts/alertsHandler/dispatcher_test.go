@@ -0,0 +1,173 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDispatcher() (*notificationDispatcher, *[]*groupNotification) {
+	databaseObj = newMockDatabase()
+	d := newNotificationDispatcher()
+	sent := make([]*groupNotification, 0)
+	d.send = func(notification *groupNotification) error {
+		sent = append(sent, notification)
+		return nil
+	}
+	return d, &sent
+}
+
+func getHostInstances(state alertutils.AlertState, hosts ...string) []*alertutils.AlertInstance {
+	instances := make([]*alertutils.AlertInstance, 0, len(hosts))
+	for _, host := range hosts {
+		labels := map[string]string{"host": host}
+		instances = append(instances, &alertutils.AlertInstance{
+			Fingerprint: alertutils.GetInstanceFingerprint(labels),
+			Labels:      labels,
+			State:       state,
+		})
+	}
+	return instances
+}
+
+func Test_DispatcherGroupsInstances(t *testing.T) {
+	d, sent := newTestDispatcher()
+	routing := &alertutils.NotificationRouting{Route: alertutils.NotificationRoute{
+		GroupWait:      "30s",
+		GroupInterval:  "5m",
+		RepeatInterval: "1h",
+	}}
+	alert := &alertutils.AlertDetails{AlertId: "a1", AlertConfig: alertutils.AlertConfig{AlertName: "High CPU", ContactID: "c1", Message: "CPU is high"}}
+
+	hosts := make([]string, 200)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("web%03d", i)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	d.dispatch(alert, routing, getHostInstances(alertutils.Firing, hosts...), "", nil, now)
+
+	// nothing is sent before the group wait
+	d.flush(now.Add(29 * time.Second))
+	assert.Equal(t, 0, len(*sent))
+
+	// the storm of firing instances is one notification
+	d.flush(now.Add(30 * time.Second))
+	assert.Equal(t, 1, len(*sent))
+	notification := (*sent)[0]
+	assert.Equal(t, "c1", notification.contactId)
+	assert.Equal(t, alertutils.Firing, notification.state)
+	assert.Equal(t, "[FIRING:200] alertname=High CPU", notification.subject)
+	assert.Equal(t, "CPU is high", notification.message)
+	assert.Equal(t, 200, len(notification.instances))
+	assert.Equal(t, "High CPU", notification.instances[0].Labels[alertutils.AlertNameLabel])
+
+	// unchanged groups are not notified again before the repeat interval
+	d.dispatch(alert, routing, getHostInstances(alertutils.Firing, hosts...), "", nil, now.Add(time.Minute))
+	d.flush(now.Add(6 * time.Minute))
+	assert.Equal(t, 1, len(*sent))
+
+	// resolved instances are notified at the next group interval
+	instances := append(getHostInstances(alertutils.Normal, hosts[:150]...), getHostInstances(alertutils.Firing, hosts[150:]...)...)
+	d.dispatch(alert, routing, instances, "", nil, now.Add(7*time.Minute))
+	d.flush(now.Add(11 * time.Minute))
+	assert.Equal(t, 2, len(*sent))
+	assert.Equal(t, "[FIRING:50] alertname=High CPU", (*sent)[1].subject)
+	assert.Equal(t, 200, len((*sent)[1].instances))
+
+	// firing instances are repeated after the repeat interval, without the resolved ones
+	d.flush(now.Add(71 * time.Minute))
+	assert.Equal(t, 3, len(*sent))
+	assert.Equal(t, 50, len((*sent)[2].instances))
+
+	d.dispatch(alert, routing, getHostInstances(alertutils.Normal, hosts...), "", nil, now.Add(72*time.Minute))
+	d.flush(now.Add(76 * time.Minute))
+	assert.Equal(t, 4, len(*sent))
+	assert.Equal(t, alertutils.Normal, (*sent)[3].state)
+	assert.Equal(t, "[RESOLVED] alertname=High CPU", (*sent)[3].subject)
+	assert.Equal(t, 0, len(d.groups))
+}
+
+func Test_DispatcherRoutesAndInhibits(t *testing.T) {
+	d, sent := newTestDispatcher()
+	routing := &alertutils.NotificationRouting{
+		Route: alertutils.NotificationRoute{
+			GroupBy:   []string{"host"},
+			GroupWait: "0s",
+			Routes: []*alertutils.NotificationRoute{
+				{Matchers: alertutils.SilenceMatchers{{Name: "team", Value: "infra"}}, ContactID: "infra"},
+			},
+		},
+		InhibitRules: []*alertutils.InhibitRule{{
+			SourceMatchers: alertutils.SilenceMatchers{{Name: "alertname", Value: "node_down"}},
+			TargetMatchers: alertutils.SilenceMatchers{{Name: "alertname", Value: "service_down"}},
+			Equal:          []string{"host"},
+		}},
+	}
+	nodeDown := &alertutils.AlertDetails{AlertId: "a1", AlertConfig: alertutils.AlertConfig{
+		AlertName: "node_down", ContactID: "c1", Labels: []alertutils.AlertLabel{{LabelName: "team", LabelValue: "infra"}}}}
+	serviceDown := &alertutils.AlertDetails{AlertId: "a2", AlertConfig: alertutils.AlertConfig{AlertName: "service_down", ContactID: "c2"}}
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	d.dispatch(nodeDown, routing, getHostInstances(alertutils.Firing, "web01"), "", nil, now)
+	d.dispatch(serviceDown, routing, getHostInstances(alertutils.Firing, "web01", "web02"), "", nil, now)
+	d.flush(now)
+
+	subjects := make(map[string]string)
+	for _, notification := range *sent {
+		subjects[notification.contactId+" "+notification.subject] = notification.message
+	}
+	assert.Equal(t, map[string]string{
+		"infra [FIRING:1] host=web01": "",
+		"c2 [FIRING:1] host=web02":    "",
+	}, subjects)
+
+	// the deleted alert no longer inhibits service_down on web01
+	d.removeAlert("a1")
+	d.flush(now.Add(5 * time.Minute))
+	assert.Equal(t, 3, len(*sent))
+	assert.Equal(t, "c2", (*sent)[2].contactId)
+	assert.Equal(t, "[FIRING:1] host=web01", (*sent)[2].subject)
+}
+
+func Test_DispatcherEmailSubjectWithLineBreaks(t *testing.T) {
+	d, sent := newTestDispatcher()
+	routing := &alertutils.NotificationRouting{Route: alertutils.NotificationRoute{GroupBy: []string{"host"}, GroupWait: "0s"}}
+	alert := &alertutils.AlertDetails{AlertId: "a1", AlertConfig: alertutils.AlertConfig{AlertName: "High CPU", ContactID: "c1"}}
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	d.dispatch(alert, routing, getHostInstances(alertutils.Firing, "web01\r\nBcc: victim@example.com"), "", nil, now)
+	d.flush(now)
+	assert.Equal(t, 1, len(*sent))
+
+	request := getEmailRequest("oncall@example.com", (*sent)[0].subject, "CPU is high", "", "")
+	message, err := mail.ReadMessage(strings.NewReader(request.Body))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(message.Header))
+	assert.Empty(t, message.Header.Get("Bcc"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+	assert.NoError(t, err)
+	assert.Equal(t, "[FIRING:1] host=web01\r\nBcc: victim@example.com", subject)
+}
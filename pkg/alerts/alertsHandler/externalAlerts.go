@@ -0,0 +1,458 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/siglens/siglens/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// How long an external alert without an end time keeps firing after it was
+// last received, like the resolve_timeout of Alertmanager.
+const EXTERNAL_ALERT_RESOLVE_TIMEOUT = 5 * time.Minute
+
+// How often external alerts that reached their end time are resolved.
+const EXTERNAL_ALERT_SWEEP_INTERVAL = 10 * time.Second
+
+// Prefix of the ids of the alerts that external alerts are notified as, one
+// per alert name.
+const EXTERNAL_ALERT_ID_PREFIX = "external-"
+
+// postableAlert is an alert sent to the Alertmanager /api/v2/alerts API.
+type postableAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt,omitempty"`
+	EndsAt       time.Time         `json:"endsAt,omitempty"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+type gettableAlertStatus struct {
+	State       string   `json:"state"`
+	SilencedBy  []string `json:"silencedBy"`
+	InhibitedBy []string `json:"inhibitedBy"`
+}
+
+type gettableAlertReceiver struct {
+	Name string `json:"name"`
+}
+
+// gettableAlert is an alert returned by the Alertmanager /api/v2/alerts API.
+type gettableAlert struct {
+	Labels       map[string]string       `json:"labels"`
+	Annotations  map[string]string       `json:"annotations"`
+	StartsAt     time.Time               `json:"startsAt"`
+	EndsAt       time.Time               `json:"endsAt"`
+	UpdatedAt    time.Time               `json:"updatedAt"`
+	GeneratorURL string                  `json:"generatorURL,omitempty"`
+	Fingerprint  string                  `json:"fingerprint"`
+	Receivers    []gettableAlertReceiver `json:"receivers"`
+	Status       gettableAlertStatus     `json:"status"`
+}
+
+type externalAlert struct {
+	labels       map[string]string // without the alert name
+	annotations  map[string]string
+	startsAt     time.Time
+	endsAt       time.Time
+	updatedAt    time.Time
+	generatorURL string
+}
+
+/*
+externalAlertStore keeps the alerts that external Prometheus servers send to
+the Alertmanager API and notifies them through the notification routing of the
+org. Alerts are kept in memory; Prometheus resends firing alerts, so they are
+restored after a restart.
+
+Like the members of an Alertmanager cluster, every node keeps the alerts it
+receives, and only the node that evaluates the alerts notifies them. A node
+that is elected notifies the alerts it kept, which the notification log does
+not notify again.
+*/
+type externalAlertStore struct {
+	mu         sync.Mutex
+	alerts     map[int64]map[string]map[string]*externalAlert // org id -> alert name -> fingerprint -> alert
+	dispatcher *notificationDispatcher
+	getRouting func(orgId int64) (*alertutils.NotificationRouting, error)
+	once       sync.Once
+}
+
+var externalAlerts = newExternalAlertStore(alertDispatcher)
+
+func newExternalAlertStore(dispatcher *notificationDispatcher) *externalAlertStore {
+	return &externalAlertStore{
+		alerts:     make(map[int64]map[string]map[string]*externalAlert),
+		dispatcher: dispatcher,
+		getRouting: getNotificationRouting,
+	}
+}
+
+func getNotificationRouting(orgId int64) (*alertutils.NotificationRouting, error) {
+	if databaseObj == nil {
+		return nil, errors.New(invalidDatabaseProvider)
+	}
+	return databaseObj.GetNotificationRouting(orgId)
+}
+
+func (s *externalAlertStore) start() {
+	s.once.Do(func() {
+		go func() {
+			ticker := time.NewTicker(EXTERNAL_ALERT_SWEEP_INTERVAL)
+			defer ticker.Stop()
+			for range ticker.C {
+				s.sweep(time.Now().UTC())
+			}
+		}()
+	})
+}
+
+func validatePostableAlert(alert *postableAlert) error {
+	if len(alert.Labels) == 0 {
+		return errors.New("alert has no labels")
+	}
+	for name, value := range alert.Labels {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if value == "" {
+			return fmt.Errorf("label %q has an empty value", name)
+		}
+	}
+	if alert.Labels[alertutils.AlertNameLabel] == "" {
+		return fmt.Errorf("alert has no %v label", alertutils.AlertNameLabel)
+	}
+	if !alert.EndsAt.IsZero() && !alert.StartsAt.IsZero() && alert.EndsAt.Before(alert.StartsAt) {
+		return errors.New("alert ends before it starts")
+	}
+	return nil
+}
+
+// Adds or updates the alerts and notifies the alert names that changed.
+func (s *externalAlertStore) add(orgId int64, routing *alertutils.NotificationRouting, postable []postableAlert, now time.Time) {
+	s.mu.Lock()
+	if _, ok := s.alerts[orgId]; !ok {
+		s.alerts[orgId] = make(map[string]map[string]*externalAlert)
+	}
+	changedNames := make(map[string]struct{})
+	for _, alert := range postable {
+		name := alert.Labels[alertutils.AlertNameLabel]
+		labels := make(map[string]string, len(alert.Labels))
+		for labelName, value := range alert.Labels {
+			if labelName != alertutils.AlertNameLabel {
+				labels[labelName] = value
+			}
+		}
+		fingerprint := alertutils.GetInstanceFingerprint(labels)
+
+		startsAt, endsAt := alert.StartsAt, alert.EndsAt
+		if startsAt.IsZero() {
+			startsAt = now
+		}
+		if endsAt.IsZero() {
+			endsAt = now.Add(EXTERNAL_ALERT_RESOLVE_TIMEOUT)
+		}
+
+		if _, ok := s.alerts[orgId][name]; !ok {
+			s.alerts[orgId][name] = make(map[string]*externalAlert)
+		}
+		// An alert that is still firing keeps the time it started.
+		if existing, ok := s.alerts[orgId][name][fingerprint]; ok && now.Before(existing.endsAt) && existing.startsAt.Before(startsAt) {
+			startsAt = existing.startsAt
+		}
+		s.alerts[orgId][name][fingerprint] = &externalAlert{
+			labels:       labels,
+			annotations:  alert.Annotations,
+			startsAt:     startsAt,
+			endsAt:       endsAt,
+			updatedAt:    now,
+			generatorURL: alert.GeneratorURL,
+		}
+		changedNames[name] = struct{}{}
+	}
+	s.mu.Unlock()
+
+	if !isAlertEvaluationLeader() {
+		return
+	}
+	for name := range changedNames {
+		s.notify(orgId, routing, name, now)
+	}
+}
+
+func getExternalAlertDetails(orgId int64, name string) *alertutils.AlertDetails {
+	return &alertutils.AlertDetails{
+		AlertConfig: alertutils.AlertConfig{
+			AlertName: name,
+			Message:   fmt.Sprintf("%v was received from an external Prometheus server", name),
+		},
+		AlertId: EXTERNAL_ALERT_ID_PREFIX + name,
+		OrgId:   orgId,
+	}
+}
+
+func (alert *externalAlert) getInstance(alertId string, now time.Time) *alertutils.AlertInstance {
+	instance := &alertutils.AlertInstance{
+		AlertId:         alertId,
+		Fingerprint:     alertutils.GetInstanceFingerprint(alert.labels),
+		Labels:          alert.labels,
+		State:           alertutils.Firing,
+		ActiveAt:        alert.startsAt,
+		FiredAt:         alert.startsAt,
+		LastEvaluatedAt: alert.updatedAt,
+		Annotations:     alert.annotations,
+	}
+	if !now.Before(alert.endsAt) {
+		instance.State = alertutils.Normal
+		instance.ResolvedAt = alert.endsAt
+	}
+	return instance
+}
+
+// Hands the alerts with the name to the dispatcher, which groups and notifies
+// them like the instances of an alert.
+func (s *externalAlertStore) notify(orgId int64, routing *alertutils.NotificationRouting, name string, now time.Time) {
+	s.mu.Lock()
+	alertDetails := getExternalAlertDetails(orgId, name)
+	alerts := s.alerts[orgId][name]
+	fingerprints := make([]string, 0, len(alerts))
+	for fingerprint := range alerts {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.Strings(fingerprints)
+
+	var instances []*alertutils.AlertInstance
+	var generatorURL string
+	for _, fingerprint := range fingerprints {
+		alert := alerts[fingerprint]
+		instance := alert.getInstance(alertDetails.AlertId, now)
+		instances = append(instances, instance)
+		if instance.State == alertutils.Firing && generatorURL == "" {
+			generatorURL = alert.generatorURL
+		}
+	}
+	s.mu.Unlock()
+
+	s.dispatcher.dispatch(alertDetails, routing, instances, generatorURL, nil, now)
+}
+
+// Hands all alerts to the dispatcher, when the node is elected to notify them.
+func (s *externalAlertStore) resume(now time.Time) {
+	s.mu.Lock()
+	names := make(map[int64][]string)
+	for orgId, alerts := range s.alerts {
+		for name := range alerts {
+			names[orgId] = append(names[orgId], name)
+		}
+	}
+	s.mu.Unlock()
+
+	for orgId, orgNames := range names {
+		routing, err := s.getRouting(orgId)
+		if err != nil {
+			log.Errorf("externalAlertStore.resume: could not get the notification routing of org: %v, err=%v", orgId, err)
+			continue
+		}
+		if routing == nil {
+			continue
+		}
+		for _, name := range orgNames {
+			s.notify(orgId, routing, name, now)
+		}
+	}
+}
+
+// Resolves the alerts that reached their end time and forgets them. Only the
+// node that evaluates the alerts notifies the resolved alerts.
+func (s *externalAlertStore) sweep(now time.Time) {
+	type expiredName struct {
+		orgId int64
+		name  string
+	}
+	var expired []expiredName
+
+	s.mu.Lock()
+	for orgId, names := range s.alerts {
+		for name, alerts := range names {
+			for _, alert := range alerts {
+				if !now.Before(alert.endsAt) {
+					expired = append(expired, expiredName{orgId: orgId, name: name})
+					break
+				}
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if isAlertEvaluationLeader() {
+		routingByOrg := make(map[int64]*alertutils.NotificationRouting)
+		for _, e := range expired {
+			routing, ok := routingByOrg[e.orgId]
+			if !ok {
+				var err error
+				routing, err = s.getRouting(e.orgId)
+				if err != nil {
+					log.Errorf("externalAlertStore.sweep: could not get the notification routing of org: %v, err=%v", e.orgId, err)
+				}
+				routingByOrg[e.orgId] = routing
+			}
+			// Without a routing the alerts are forgotten without a notification.
+			if routing != nil {
+				s.notify(e.orgId, routing, e.name, now)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range expired {
+		alerts := s.alerts[e.orgId][e.name]
+		for fingerprint, alert := range alerts {
+			if !now.Before(alert.endsAt) {
+				delete(alerts, fingerprint)
+			}
+		}
+		if len(alerts) == 0 {
+			delete(s.alerts[e.orgId], e.name)
+		}
+	}
+}
+
+// Returns the alerts of the org that did not resolve, in the format of the
+// Alertmanager API.
+func (s *externalAlertStore) list(orgId int64, routing *alertutils.NotificationRouting, silences []*alertutils.Silence,
+	now time.Time) []*gettableAlert {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]*gettableAlert, 0)
+	for name, alerts := range s.alerts[orgId] {
+		for fingerprint, alert := range alerts {
+			if !now.Before(alert.endsAt) {
+				continue
+			}
+			labels := make(map[string]string, len(alert.labels)+1)
+			for labelName, value := range alert.labels {
+				labels[labelName] = value
+			}
+			labels[alertutils.AlertNameLabel] = name
+
+			annotations := alert.annotations
+			if annotations == nil {
+				annotations = map[string]string{}
+			}
+			gettable := &gettableAlert{
+				Labels:       labels,
+				Annotations:  annotations,
+				StartsAt:     alert.startsAt,
+				EndsAt:       alert.endsAt,
+				UpdatedAt:    alert.updatedAt,
+				GeneratorURL: alert.generatorURL,
+				Fingerprint:  fingerprint,
+				Receivers:    make([]gettableAlertReceiver, 0),
+				Status: gettableAlertStatus{
+					State:       "active",
+					SilencedBy:  make([]string, 0),
+					InhibitedBy: make([]string, 0),
+				},
+			}
+			for _, silence := range silences {
+				if silence.IsActive(now) && silence.Matchers.Matches(labels) {
+					gettable.Status.SilencedBy = append(gettable.Status.SilencedBy, silence.SilenceId)
+					gettable.Status.State = "suppressed"
+				}
+			}
+			if routing != nil {
+				for _, route := range routing.Match(labels) {
+					gettable.Receivers = append(gettable.Receivers, gettableAlertReceiver{Name: route.ContactID})
+				}
+			}
+			result = append(result, gettable)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Fingerprint < result[j].Fingerprint
+	})
+	return result
+}
+
+/*
+Accepts alerts from external Prometheus servers, like the /api/v2/alerts API of
+Alertmanager, so they are notified through the notification routing of the org
+together with the SigLens alerts.
+*/
+func ProcessPostExternalAlertsRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+	var postable []postableAlert
+	err := json.Unmarshal(ctx.PostBody(), &postable)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to unmarshal json. Error=%v", err), "", err)
+		return
+	}
+	for i := range postable {
+		err = validatePostableAlert(&postable[i])
+		if err != nil {
+			utils.SendError(ctx, fmt.Sprintf("Invalid alert. Error=%v", err), fmt.Sprintf("labels: %v", postable[i].Labels), err)
+			return
+		}
+	}
+
+	routing, err := databaseObj.GetNotificationRouting(org_id)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to get notification routing. Error=%v", err), "", err)
+		return
+	}
+	if routing == nil {
+		utils.SendError(ctx, "Notification routing is not configured, it is required to notify external alerts", "", nil)
+		return
+	}
+
+	externalAlerts.add(org_id, routing, postable, time.Now().UTC())
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+func ProcessGetExternalAlertsRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+	routing, err := databaseObj.GetNotificationRouting(org_id)
+	if err != nil {
+		log.Errorf("ProcessGetExternalAlertsRequest: could not get the notification routing of org: %v, err=%v", org_id, err)
+	}
+	silences, err := databaseObj.GetAllSilences(org_id)
+	if err != nil {
+		log.Errorf("ProcessGetExternalAlertsRequest: could not get the silences of org: %v, err=%v", org_id, err)
+	}
+	utils.WriteJsonResponse(ctx, externalAlerts.list(org_id, routing, silences, time.Now().UTC()))
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
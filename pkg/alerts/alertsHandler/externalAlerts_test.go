@@ -0,0 +1,149 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ExternalAlerts(t *testing.T) {
+	d, sent := newTestDispatcher()
+	routing := &alertutils.NotificationRouting{Route: alertutils.NotificationRoute{
+		ContactID:      "c1",
+		GroupWait:      "30s",
+		GroupInterval:  "5m",
+		RepeatInterval: "4h",
+	}}
+	store := newExternalAlertStore(d)
+	store.getRouting = func(orgId int64) (*alertutils.NotificationRouting, error) {
+		return routing, nil
+	}
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store.add(1, routing, []postableAlert{
+		{
+			Labels:       map[string]string{"alertname": "InstanceDown", "instance": "web01"},
+			Annotations:  map[string]string{"summary": "web01 is down"},
+			StartsAt:     now.Add(-time.Minute),
+			EndsAt:       now.Add(4 * time.Minute),
+			GeneratorURL: "http://prometheus:9090/graph",
+		},
+		{Labels: map[string]string{"alertname": "InstanceDown", "instance": "web02"}},
+	}, now)
+
+	d.flush(now.Add(30 * time.Second))
+	assert.Equal(t, 1, len(*sent))
+	notification := (*sent)[0]
+	assert.Equal(t, "c1", notification.contactId)
+	assert.Equal(t, "[FIRING:2] alertname=InstanceDown", notification.subject)
+	assert.Equal(t, "http://prometheus:9090/graph", notification.alertDataMessage)
+	for _, instance := range notification.instances {
+		if instance.Labels["instance"] == "web01" {
+			assert.Equal(t, "web01 is down", instance.Annotations["summary"])
+		} else {
+			assert.Nil(t, instance.Annotations)
+		}
+	}
+
+	silence := &alertutils.Silence{SilenceId: "s1", Matchers: alertutils.SilenceMatchers{{Name: "instance", Value: "web02"}},
+		StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour)}
+	listed := store.list(1, routing, []*alertutils.Silence{silence}, now.Add(time.Minute))
+	assert.Equal(t, 2, len(listed))
+	for _, alert := range listed {
+		assert.Equal(t, "InstanceDown", alert.Labels["alertname"])
+		assert.Equal(t, []gettableAlertReceiver{{Name: "c1"}}, alert.Receivers)
+		if alert.Labels["instance"] == "web02" {
+			assert.Equal(t, "suppressed", alert.Status.State)
+			assert.Equal(t, []string{"s1"}, alert.Status.SilencedBy)
+			assert.Equal(t, now.Add(EXTERNAL_ALERT_RESOLVE_TIMEOUT), alert.EndsAt)
+		} else {
+			assert.Equal(t, "active", alert.Status.State)
+			assert.Equal(t, now.Add(-time.Minute), alert.StartsAt)
+		}
+	}
+
+	// a resent alert keeps its start time and extends its end time
+	store.add(1, routing, []postableAlert{{Labels: map[string]string{"alertname": "InstanceDown", "instance": "web01"}, StartsAt: now.Add(time.Minute)}}, now.Add(2*time.Minute))
+
+	// web02 reaches the resolve timeout while web01 is still firing
+	store.sweep(now.Add(6 * time.Minute))
+	listed = store.list(1, routing, nil, now.Add(6*time.Minute))
+	assert.Equal(t, 1, len(listed))
+	assert.Equal(t, "web01", listed[0].Labels["instance"])
+	assert.Equal(t, now.Add(-time.Minute), listed[0].StartsAt)
+
+	d.flush(now.Add(6 * time.Minute))
+	assert.Equal(t, 2, len(*sent))
+	assert.Equal(t, "[FIRING:1] alertname=InstanceDown", (*sent)[1].subject)
+
+	store.sweep(now.Add(8 * time.Minute))
+	assert.Equal(t, 0, len(store.list(1, routing, nil, now.Add(8*time.Minute))))
+	d.flush(now.Add(11 * time.Minute))
+	assert.Equal(t, 3, len(*sent))
+	assert.Equal(t, "[RESOLVED] alertname=InstanceDown", (*sent)[2].subject)
+	assert.Equal(t, alertutils.Normal, (*sent)[2].state)
+}
+
+func Test_ExternalAlertsOnlyLeaderNotifies(t *testing.T) {
+	d, sent := newTestDispatcher()
+	routing := &alertutils.NotificationRouting{Route: alertutils.NotificationRoute{ContactID: "c1", GroupWait: "30s"}}
+	store := newExternalAlertStore(d)
+	store.getRouting = func(orgId int64) (*alertutils.NotificationRouting, error) {
+		return routing, nil
+	}
+	alertLeader = newAlertLeaderElector(newMockDatabase(), "follower")
+	defer func() { alertLeader = nil }()
+
+	// a follower keeps the alerts without notifying them
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store.add(1, routing, []postableAlert{{Labels: map[string]string{"alertname": "InstanceDown", "instance": "web01"}}}, now)
+	d.flush(now.Add(time.Minute))
+	assert.Equal(t, 0, len(*sent))
+	assert.Equal(t, 0, len(d.groups))
+	assert.Equal(t, 1, len(store.list(1, routing, nil, now)))
+
+	// the elected node notifies the alerts it kept
+	alertLeader = nil
+	store.resume(now.Add(time.Minute))
+	d.flush(now.Add(2 * time.Minute))
+	assert.Equal(t, 1, len(*sent))
+	assert.Equal(t, "[FIRING:1] alertname=InstanceDown", (*sent)[0].subject)
+
+	// a deposed node drops its groups and forgets the expired alerts silently
+	alertLeader = newAlertLeaderElector(newMockDatabase(), "follower")
+	d.removeExternalAlerts()
+	assert.Equal(t, 0, len(d.groups))
+	store.sweep(now.Add(10 * time.Minute))
+	assert.Equal(t, 0, len(store.list(1, routing, nil, now.Add(10*time.Minute))))
+	d.flush(now.Add(11 * time.Minute))
+	assert.Equal(t, 1, len(*sent))
+}
+
+func Test_ValidatePostableAlert(t *testing.T) {
+	now := time.Now()
+	assert.Nil(t, validatePostableAlert(&postableAlert{Labels: map[string]string{"alertname": "InstanceDown", "job": "node"}}))
+	assert.NotNil(t, validatePostableAlert(&postableAlert{}))
+	assert.NotNil(t, validatePostableAlert(&postableAlert{Labels: map[string]string{"job": "node"}}))
+	assert.NotNil(t, validatePostableAlert(&postableAlert{Labels: map[string]string{"alertname": "InstanceDown", "job-name": "node"}}))
+	assert.NotNil(t, validatePostableAlert(&postableAlert{Labels: map[string]string{"alertname": "InstanceDown", "job": ""}}))
+	assert.NotNil(t, validatePostableAlert(&postableAlert{Labels: map[string]string{"alertname": "InstanceDown"}, StartsAt: now, EndsAt: now.Add(-time.Minute)}))
+}
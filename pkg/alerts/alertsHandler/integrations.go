@@ -0,0 +1,503 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/siglens/siglens/pkg/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// The endpoint of the PagerDuty Events API v2.
+var pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+const DEFAULT_OPSGENIE_API_URL = "https://api.opsgenie.com"
+const DEFAULT_OPSGENIE_PRIORITY = "P3"
+
+const INTEGRATION_SOURCE = "SigLens"
+
+var integrationHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+type incidentAction string
+
+const (
+	incidentTrigger     incidentAction = "trigger"
+	incidentAcknowledge incidentAction = "acknowledge"
+	incidentResolve     incidentAction = "resolve"
+)
+
+// incidentEvent is the event of an alert instance for PagerDuty and Opsgenie,
+// which track the incident of each instance by its dedup key.
+type incidentEvent struct {
+	dedupKey    string
+	action      incidentAction
+	summary     string
+	labels      map[string]string
+	value       float64
+	baseline    *float64 // set for anomaly conditions
+	alertId     string   // empty for the event of a whole alert
+	fingerprint string
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction incidentAction    `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+	Client      string            `json:"client,omitempty"`
+	ClientURL   string            `json:"client_url,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+}
+
+type opsgenieAlert struct {
+	Message     string            `json:"message"`
+	Alias       string            `json:"alias"`
+	Description string            `json:"description,omitempty"`
+	Priority    string            `json:"priority"`
+	Tags        []string          `json:"tags,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+	Source      string            `json:"source"`
+}
+
+type opsgenieAction struct {
+	Source string `json:"source"`
+	Note   string `json:"note,omitempty"`
+}
+
+// The dedup key of an alert instance, which stays the same across the
+// evaluations of the alert.
+func getInstanceDedupKey(instance *alertutils.AlertInstance) string {
+	return instance.AlertId + "-" + instance.Fingerprint
+}
+
+// Returns one event per instance: a trigger for the firing instances and a
+// resolve for the others. Without instances the event is for the whole alert,
+// identified by the subject, which is only for notifications that are not of
+// an alert, like the test of a contact point.
+func getIncidentEvents(subject string, alertState alertutils.AlertState, instances []*alertutils.AlertInstance) []*incidentEvent {
+	if len(instances) == 0 {
+		action := incidentResolve
+		if alertState == alertutils.Firing {
+			action = incidentTrigger
+		}
+		dedupKey := alertutils.GetInstanceFingerprint(map[string]string{alertutils.AlertNameLabel: subject})
+		return []*incidentEvent{{dedupKey: dedupKey, action: action, summary: subject}}
+	}
+	return getInstanceIncidentEvents(subject, instances)
+}
+
+func getInstanceIncidentEvents(subject string, instances []*alertutils.AlertInstance) []*incidentEvent {
+	events := make([]*incidentEvent, 0, len(instances))
+	for _, instance := range instances {
+		event := &incidentEvent{
+			dedupKey:    getInstanceDedupKey(instance),
+			action:      incidentResolve,
+			summary:     subject,
+			labels:      instance.Labels,
+			value:       instance.Value,
+			baseline:    instance.Baseline,
+			alertId:     instance.AlertId,
+			fingerprint: instance.Fingerprint,
+		}
+		if instance.State == alertutils.Firing {
+			event.action = incidentTrigger
+		}
+		if len(instance.Labels) > 0 {
+			event.summary = fmt.Sprintf("%v (%v)", subject, alertutils.FormatInstanceLabels(instance.Labels))
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+/*
+Returns the incident events of a notification of alerts to the integrations of
+one type of the contact point, and records the incidents that it triggers as
+open until their resolve is delivered.
+
+The incidents are per instance, so a notification without instances has no
+events. Besides the instances of the notification, it resolves the open
+incidents of the alerts whose instance does not fire anymore, since the
+notification that resolved the instance may have been suppressed by the
+cooldown period or a silence, or may not have been delivered.
+*/
+func getContactIncidentEvents(contact *alertutils.Contact, contactType string, subject string, alertIds []string,
+	instances []*alertutils.AlertInstance) []*incidentEvent {
+
+	events := getInstanceIncidentEvents(subject, instances)
+	events = append(events, getOpenIncidentResolves(contact, contactType, alertIds, events)...)
+
+	opened := make([]*alertutils.OpenIncident, 0)
+	for _, event := range events {
+		if event.action != incidentTrigger || event.alertId == "" {
+			continue
+		}
+		opened = append(opened, &alertutils.OpenIncident{
+			ContactId:   contact.ContactId,
+			ContactType: contactType,
+			DedupKey:    event.dedupKey,
+			OrgId:       contact.OrgId,
+			AlertId:     event.alertId,
+			Fingerprint: event.fingerprint,
+		})
+	}
+	if err := databaseObj.AddOpenIncidents(opened); err != nil {
+		log.Errorf("getContactIncidentEvents: could not record the open %v incidents of contact: %v, err=%v", contactType, contact.ContactName, err)
+	}
+	return events
+}
+
+func getOpenIncidentResolves(contact *alertutils.Contact, contactType string, alertIds []string, events []*incidentEvent) []*incidentEvent {
+	if len(alertIds) == 0 {
+		return nil
+	}
+	openIncidents, err := databaseObj.GetOpenIncidents(contact.ContactId, contactType, alertIds)
+	if err != nil {
+		log.Errorf("getOpenIncidentResolves: could not get the open %v incidents of contact: %v, err=%v", contactType, contact.ContactName, err)
+		return nil
+	}
+
+	notified := make(map[string]struct{}, len(events))
+	for _, event := range events {
+		notified[event.dedupKey] = struct{}{}
+	}
+	firing := make(map[string]map[string]struct{}) // alert id -> fingerprints of its firing instances
+	resolves := make([]*incidentEvent, 0)
+	for _, incident := range openIncidents {
+		if _, ok := notified[incident.DedupKey]; ok {
+			continue
+		}
+		if _, ok := firing[incident.AlertId]; !ok {
+			firing[incident.AlertId], err = getFiringFingerprints(incident.AlertId)
+			if err != nil {
+				log.Errorf("getOpenIncidentResolves: could not get the instances of alert: %v, err=%v", incident.AlertId, err)
+				continue
+			}
+		}
+		if _, ok := firing[incident.AlertId][incident.Fingerprint]; ok {
+			continue
+		}
+		resolves = append(resolves, &incidentEvent{dedupKey: incident.DedupKey, action: incidentResolve,
+			alertId: incident.AlertId, fingerprint: incident.Fingerprint})
+	}
+	return resolves
+}
+
+func getFiringFingerprints(alertId string) (map[string]struct{}, error) {
+	instances, err := databaseObj.GetAlertInstances(alertId)
+	if err != nil {
+		return nil, err
+	}
+	fingerprints := make(map[string]struct{})
+	for _, instance := range instances {
+		if instance.State == alertutils.Firing {
+			fingerprints[instance.Fingerprint] = struct{}{}
+		}
+	}
+	return fingerprints, nil
+}
+
+func getAcknowledgeEvents(instances []*alertutils.AlertInstance) []*incidentEvent {
+	events := make([]*incidentEvent, 0, len(instances))
+	for _, instance := range instances {
+		if instance.State != alertutils.Firing {
+			continue
+		}
+		events = append(events, &incidentEvent{dedupKey: getInstanceDedupKey(instance), action: incidentAcknowledge})
+	}
+	return events
+}
+
+// The PagerDuty severity of an instance is its severity label when that is a
+// PagerDuty severity, otherwise critical.
+func getPagerDutySeverity(labels map[string]string) string {
+	switch severity := strings.ToLower(labels["severity"]); severity {
+	case "critical", "error", "warning", "info":
+		return severity
+	}
+	return "critical"
+}
+
+func sendPagerDuty(routingKey string, subject string, message string, alertState alertutils.AlertState, alertDataMessage string,
+	instances []*alertutils.AlertInstance) error {
+
+	return sendPagerDutyEvents(routingKey, message, alertDataMessage, getIncidentEvents(subject, alertState, instances))
+}
+
+func sendPagerDutyEvents(routingKey string, message string, alertDataMessage string, events []*incidentEvent) error {
+	requests, err := getPagerDutyRequests(routingKey, message, alertDataMessage, events)
+	if err != nil {
+		return err
+	}
+	return sendDeliveryRequests(alertutils.PagerDutyContactType, requests)
+}
+
+// Returns one request per event. Events that cannot be encoded are left out
+// and reported in the error.
+func getPagerDutyRequests(routingKey string, message string, alertDataMessage string, events []*incidentEvent) ([]*alertutils.DeliveryRequest, error) {
+	requests := make([]*alertutils.DeliveryRequest, 0, len(events))
+	var errs []error
+	for _, event := range events {
+		pdEvent := pagerDutyEvent{
+			RoutingKey:  routingKey,
+			EventAction: event.action,
+			DedupKey:    event.dedupKey,
+		}
+		if event.action == incidentTrigger {
+			details := map[string]interface{}{"message": message}
+			if len(event.labels) > 0 {
+				details["labels"] = event.labels
+				details["value"] = event.value
+			}
+			if event.baseline != nil {
+				details["baseline"] = *event.baseline
+			}
+			if alertDataMessage != "" {
+				details["alert_data"] = alertDataMessage
+			}
+			pdEvent.Payload = &pagerDutyPayload{
+				Summary:       alertutils.TruncateText(1024, event.summary),
+				Source:        INTEGRATION_SOURCE,
+				Severity:      getPagerDutySeverity(event.labels),
+				CustomDetails: details,
+			}
+			pdEvent.Client = INTEGRATION_SOURCE
+			if utils.IsValidURL(alertDataMessage) {
+				pdEvent.ClientURL = alertDataMessage
+			}
+		}
+
+		request, err := newJSONRequest(pagerDutyEventsURL, nil, pdEvent)
+		if err != nil {
+			log.Errorf("getPagerDutyRequests: could not encode %v event for dedup key %v, err=%v", event.action, event.dedupKey, err)
+			errs = append(errs, err)
+			continue
+		}
+		if event.action == incidentResolve {
+			request.ResolvesIncident = event.dedupKey
+		}
+		requests = append(requests, request)
+	}
+	return requests, errors.Join(errs...)
+}
+
+func sendOpsgenie(config alertutils.OpsgenieConfig, subject string, message string, alertState alertutils.AlertState, alertDataMessage string,
+	instances []*alertutils.AlertInstance) error {
+
+	return sendOpsgenieEvents(config, message, alertDataMessage, getIncidentEvents(subject, alertState, instances))
+}
+
+func sendOpsgenieEvents(config alertutils.OpsgenieConfig, message string, alertDataMessage string, events []*incidentEvent) error {
+	requests, err := getOpsgenieRequests(config, message, alertDataMessage, events)
+	if err != nil {
+		return err
+	}
+	return sendDeliveryRequests(alertutils.OpsgenieContactType, requests)
+}
+
+// Returns one request per event, like getPagerDutyRequests.
+func getOpsgenieRequests(config alertutils.OpsgenieConfig, message string, alertDataMessage string,
+	events []*incidentEvent) ([]*alertutils.DeliveryRequest, error) {
+
+	apiUrl := strings.TrimSuffix(config.ApiUrl, "/")
+	if apiUrl == "" {
+		apiUrl = DEFAULT_OPSGENIE_API_URL
+	}
+	priority := config.Priority
+	if priority == "" {
+		priority = DEFAULT_OPSGENIE_PRIORITY
+	}
+	headers := map[string]string{"Authorization": "GenieKey " + config.ApiKey}
+
+	requests := make([]*alertutils.DeliveryRequest, 0, len(events))
+	var errs []error
+	for _, event := range events {
+		var request *alertutils.DeliveryRequest
+		var err error
+		switch event.action {
+		case incidentTrigger:
+			description := message
+			if alertDataMessage != "" {
+				description = description + "\nAlert Data: " + alertDataMessage
+			}
+			alert := opsgenieAlert{
+				Message:     alertutils.TruncateText(130, event.summary),
+				Alias:       alertutils.TruncateText(512, event.dedupKey),
+				Description: alertutils.TruncateText(15000, description),
+				Priority:    priority,
+				Tags:        []string{"siglens"},
+				Details:     event.labels,
+				Source:      INTEGRATION_SOURCE,
+			}
+			request, err = newJSONRequest(apiUrl+"/v2/alerts", headers, alert)
+		case incidentAcknowledge:
+			actionUrl := fmt.Sprintf("%v/v2/alerts/%v/acknowledge?identifierType=alias", apiUrl, url.PathEscape(event.dedupKey))
+			request, err = newJSONRequest(actionUrl, headers, opsgenieAction{Source: INTEGRATION_SOURCE, Note: "Silenced in SigLens"})
+		case incidentResolve:
+			actionUrl := fmt.Sprintf("%v/v2/alerts/%v/close?identifierType=alias", apiUrl, url.PathEscape(event.dedupKey))
+			request, err = newJSONRequest(actionUrl, headers, opsgenieAction{Source: INTEGRATION_SOURCE, Note: "Resolved in SigLens"})
+			if err == nil {
+				request.ResolvesIncident = event.dedupKey
+			}
+		}
+		if err != nil {
+			log.Errorf("getOpsgenieRequests: could not encode %v event for alias %v, err=%v", event.action, event.dedupKey, err)
+			errs = append(errs, err)
+			continue
+		}
+		requests = append(requests, request)
+	}
+	return requests, errors.Join(errs...)
+}
+
+func sendTeams(webhookUrl string, subject string, message string, alertState alertutils.AlertState, alertDataMessage string,
+	instances []*alertutils.AlertInstance) error {
+
+	request, err := getTeamsRequest(webhookUrl, subject, message, alertState, alertDataMessage, instances)
+	if err != nil {
+		return err
+	}
+	return sendDeliveryRequest(alertutils.TeamsContactType, request).err
+}
+
+// Returns the request that sends an Adaptive Card to a Microsoft Teams
+// incoming webhook or workflow.
+func getTeamsRequest(webhookUrl string, subject string, message string, alertState alertutils.AlertState, alertDataMessage string,
+	instances []*alertutils.AlertInstance) (*alertutils.DeliveryRequest, error) {
+
+	color := "Good"
+	if alertState == alertutils.Firing {
+		color = "Attention"
+	}
+	body := []map[string]interface{}{
+		{"type": "TextBlock", "text": subject, "weight": "Bolder", "size": "Medium", "color": color, "wrap": true},
+		{"type": "TextBlock", "text": message, "wrap": true},
+	}
+
+	facts := make([]map[string]string, 0, len(instances))
+	for _, instance := range instances {
+		if len(instance.Labels) == 0 {
+			continue
+		}
+		value := "Resolved"
+		if instance.State == alertutils.Firing {
+			value = fmt.Sprintf("Firing (%v)", formatInstanceValue(instance))
+		}
+		facts = append(facts, map[string]string{"title": alertutils.FormatInstanceLabels(instance.Labels), "value": value})
+	}
+	if len(facts) > 0 {
+		body = append(body, map[string]interface{}{"type": "FactSet", "facts": facts})
+	}
+
+	var actions []map[string]interface{}
+	if utils.IsValidURL(alertDataMessage) {
+		actions = append(actions, map[string]interface{}{"type": "Action.OpenUrl", "title": "View Results", "url": alertDataMessage})
+	} else if alertDataMessage != "" {
+		body = append(body, map[string]interface{}{"type": "TextBlock", "text": "Alert Data: " + alertDataMessage, "wrap": true})
+	}
+
+	card := map[string]interface{}{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body":    body,
+	}
+	if len(actions) > 0 {
+		card["actions"] = actions
+	}
+	teamsMessage := map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{
+			{"contentType": "application/vnd.microsoft.card.adaptive", "content": card},
+		},
+	}
+	return newJSONRequest(webhookUrl, nil, teamsMessage)
+}
+
+// Acknowledges the incidents of the firing instances of the alert in
+// PagerDuty and Opsgenie, e.g. when the alert is silenced. The events are
+// deliveries of the notification queue, so they are retried when they fail.
+func acknowledgeAlertInstances(alert *alertutils.AlertDetails) {
+	if alert.ContactID == "" {
+		return
+	}
+	contact, err := databaseObj.GetContact(alert.ContactID)
+	if err != nil {
+		log.Errorf("acknowledgeAlertInstances: could not get the contact of alert: %v, err=%v", alert.AlertName, err)
+		return
+	}
+	if contact.PagerDuty == "" && len(contact.Opsgenie) == 0 {
+		return
+	}
+	instances, err := databaseObj.GetAlertInstances(alert.AlertId)
+	if err != nil {
+		log.Errorf("acknowledgeAlertInstances: could not get the instances of alert: %v, err=%v", alert.AlertName, err)
+		return
+	}
+	events := getAcknowledgeEvents(instances)
+	if len(events) == 0 {
+		return
+	}
+
+	subject := "Acknowledge " + alert.AlertName
+	deliveries := make([]*alertutils.NotificationDelivery, 0)
+	if contact.PagerDuty != "" {
+		requests, err := getPagerDutyRequests(contact.PagerDuty, "", "", events)
+		if err != nil {
+			log.Errorf("acknowledgeAlertInstances: could not acknowledge alert: %v in PagerDuty, err=%v", alert.AlertName, err)
+		}
+		for _, request := range requests {
+			deliveries = append(deliveries, newNotificationDelivery(contact, alertutils.PagerDutyContactType, subject, request))
+		}
+	}
+	for _, config := range contact.Opsgenie {
+		requests, err := getOpsgenieRequests(config, "", "", events)
+		if err != nil {
+			log.Errorf("acknowledgeAlertInstances: could not acknowledge alert: %v in Opsgenie, err=%v", alert.AlertName, err)
+		}
+		for _, request := range requests {
+			deliveries = append(deliveries, newNotificationDelivery(contact, alertutils.OpsgenieContactType, subject, request))
+		}
+	}
+	if !notificationQueue.enqueue(deliveries, time.Now().UTC()) {
+		log.Errorf("acknowledgeAlertInstances: could not acknowledge alert: %v", alert.AlertName)
+	}
+}
+
+// Returns a POST of the body encoded as JSON.
+func newJSONRequest(requestUrl string, headers map[string]string, body interface{}) (*alertutils.DeliveryRequest, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &alertutils.DeliveryRequest{Url: requestUrl, Headers: headers, Body: string(data)}, nil
+}
@@ -0,0 +1,284 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+type receivedRequest struct {
+	path   string
+	query  string
+	header http.Header
+	body   map[string]interface{}
+}
+
+// A local stand-in for the APIs of the integrations, which records the requests.
+func newIntegrationServer(t *testing.T) (*httptest.Server, func() []receivedRequest) {
+	var mu sync.Mutex
+	requests := make([]receivedRequest, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+		body := make(map[string]interface{})
+		assert.Nil(t, json.Unmarshal(data, &body))
+
+		mu.Lock()
+		requests = append(requests, receivedRequest{path: r.URL.Path, query: r.URL.RawQuery, header: r.Header, body: body})
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []receivedRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]receivedRequest(nil), requests...)
+	}
+}
+
+func getTestInstances() []*alertutils.AlertInstance {
+	return []*alertutils.AlertInstance{
+		{AlertId: "a1", Fingerprint: "f1", Labels: map[string]string{"host": "web01", "severity": "warning"}, State: alertutils.Firing, Value: 97},
+		{AlertId: "a1", Fingerprint: "f2", Labels: map[string]string{"host": "web02"}, State: alertutils.Normal},
+	}
+}
+
+func Test_sendPagerDuty(t *testing.T) {
+	server, getRequests := newIntegrationServer(t)
+	defer func(eventsURL string) { pagerDutyEventsURL = eventsURL }(pagerDutyEventsURL)
+	pagerDutyEventsURL = server.URL + "/v2/enqueue"
+
+	err := sendPagerDuty("routing-key", "High CPU", "CPU is high", alertutils.Firing, "http://localhost:5122/alert.html", getTestInstances())
+	assert.Nil(t, err)
+
+	requests := getRequests()
+	assert.Equal(t, 2, len(requests))
+	trigger := requests[0].body
+	assert.Equal(t, "/v2/enqueue", requests[0].path)
+	assert.Equal(t, "routing-key", trigger["routing_key"])
+	assert.Equal(t, "trigger", trigger["event_action"])
+	assert.Equal(t, "a1-f1", trigger["dedup_key"])
+	assert.Equal(t, "http://localhost:5122/alert.html", trigger["client_url"])
+	payload := trigger["payload"].(map[string]interface{})
+	assert.Equal(t, "High CPU (host=web01, severity=warning)", payload["summary"])
+	assert.Equal(t, "warning", payload["severity"])
+	assert.Equal(t, "SigLens", payload["source"])
+	assert.Equal(t, float64(97), payload["custom_details"].(map[string]interface{})["value"])
+
+	resolve := requests[1].body
+	assert.Equal(t, "resolve", resolve["event_action"])
+	assert.Equal(t, "a1-f2", resolve["dedup_key"])
+	assert.Nil(t, resolve["payload"])
+
+	// the alert is identified by its subject when there are no instances
+	assert.Nil(t, sendPagerDuty("routing-key", "Minion Search", "", alertutils.Firing, "", nil))
+	assert.Nil(t, sendPagerDuty("routing-key", "Minion Search", "", alertutils.Normal, "", nil))
+	requests = getRequests()
+	assert.Equal(t, 4, len(requests))
+	assert.Equal(t, "trigger", requests[2].body["event_action"])
+	assert.Equal(t, "critical", requests[2].body["payload"].(map[string]interface{})["severity"])
+	assert.Equal(t, "resolve", requests[3].body["event_action"])
+	assert.Equal(t, requests[2].body["dedup_key"], requests[3].body["dedup_key"])
+}
+
+func Test_sendOpsgenie(t *testing.T) {
+	server, getRequests := newIntegrationServer(t)
+	config := alertutils.OpsgenieConfig{ApiKey: "genie-key", ApiUrl: server.URL + "/", Priority: "P2"}
+
+	err := sendOpsgenie(config, "High CPU", "CPU is high", alertutils.Firing, "", getTestInstances())
+	assert.Nil(t, err)
+
+	requests := getRequests()
+	assert.Equal(t, 2, len(requests))
+	assert.Equal(t, "/v2/alerts", requests[0].path)
+	assert.Equal(t, "GenieKey genie-key", requests[0].header.Get("Authorization"))
+	assert.Equal(t, "a1-f1", requests[0].body["alias"])
+	assert.Equal(t, "P2", requests[0].body["priority"])
+	assert.Equal(t, "High CPU (host=web01, severity=warning)", requests[0].body["message"])
+	assert.Equal(t, "web01", requests[0].body["details"].(map[string]interface{})["host"])
+
+	assert.Equal(t, "/v2/alerts/a1-f2/close", requests[1].path)
+	assert.Equal(t, "identifierType=alias", requests[1].query)
+
+	// long messages are cut at a character boundary
+	err = sendOpsgenie(config, strings.Repeat("é", 200), "", alertutils.Firing, "", nil)
+	assert.Nil(t, err)
+	message := getRequests()[2].body["message"].(string)
+	assert.True(t, utf8.ValidString(message))
+	assert.Equal(t, 130, utf8.RuneCountInString(message))
+	assert.True(t, strings.HasSuffix(message, "..."))
+}
+
+func Test_sendTeams(t *testing.T) {
+	server, getRequests := newIntegrationServer(t)
+
+	err := sendTeams(server.URL, "High CPU", "CPU is high", alertutils.Firing, "http://localhost:5122/alert.html", getTestInstances())
+	assert.Nil(t, err)
+
+	requests := getRequests()
+	assert.Equal(t, 1, len(requests))
+	assert.Equal(t, "message", requests[0].body["type"])
+	attachment := requests[0].body["attachments"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "application/vnd.microsoft.card.adaptive", attachment["contentType"])
+	card := attachment["content"].(map[string]interface{})
+	assert.Equal(t, "AdaptiveCard", card["type"])
+	body := card["body"].([]interface{})
+	assert.Equal(t, "High CPU", body[0].(map[string]interface{})["text"])
+	assert.Equal(t, "Attention", body[0].(map[string]interface{})["color"])
+	facts := body[2].(map[string]interface{})["facts"].([]interface{})
+	assert.Equal(t, 2, len(facts))
+	assert.Equal(t, "Firing (value: 97)", facts[0].(map[string]interface{})["value"])
+	assert.Equal(t, "Resolved", facts[1].(map[string]interface{})["value"])
+	action := card["actions"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "http://localhost:5122/alert.html", action["url"])
+}
+
+func Test_sendToContactPointIntegrations(t *testing.T) {
+	server, getRequests := newIntegrationServer(t)
+	defer func(eventsURL string) { pagerDutyEventsURL = eventsURL }(pagerDutyEventsURL)
+	pagerDutyEventsURL = server.URL + "/pagerduty"
+
+	mockDB := newMockDatabase()
+	databaseObj = mockDB
+	contact := &alertutils.Contact{
+		ContactName: "oncall",
+		PagerDuty:   "routing-key",
+		Opsgenie:    []alertutils.OpsgenieConfig{{ApiKey: "genie-key", ApiUrl: server.URL + "/opsgenie"}},
+		Teams:       []alertutils.TeamsConfig{{WebhookUrl: server.URL + "/teams"}},
+	}
+	assert.Nil(t, mockDB.CreateContact(contact))
+
+	instances := getTestInstances()[:1]
+	sent, err := sendToContactPoint(contact.ContactId, "High CPU", "CPU is high", alertutils.Firing, "", 1, instances, nil)
+	assert.Nil(t, err)
+	assert.True(t, sent)
+
+	paths := make([]string, 0)
+	for _, request := range getRequests() {
+		paths = append(paths, request.path)
+	}
+	assert.Equal(t, []string{"/pagerduty", "/opsgenie/v2/alerts", "/teams"}, paths)
+
+	// silencing the alert acknowledges its firing instances
+	mockDB.instances["a1"] = getTestInstances()
+	acknowledgeAlertInstances(&alertutils.AlertDetails{AlertId: "a1", AlertConfig: alertutils.AlertConfig{ContactID: contact.ContactId}})
+	requests := getRequests()[3:]
+	assert.Equal(t, 2, len(requests))
+	assert.Equal(t, "acknowledge", requests[0].body["event_action"])
+	assert.Equal(t, "a1-f1", requests[0].body["dedup_key"])
+	assert.Equal(t, "/opsgenie/v2/alerts/a1-f1/acknowledge", requests[1].path)
+
+	// a contact point that no integration accepts is an error
+	server.Close()
+	sent, err = sendToContactPoint(contact.ContactId, "High CPU", "CPU is high", alertutils.Firing, "", 1, instances, nil)
+	assert.NotNil(t, err)
+	assert.False(t, sent)
+}
+
+func Test_sendToContactPointResolvesOpenIncidents(t *testing.T) {
+	p, webhookContact, destination := setupDeliveryTest(t)
+	defer func(eventsURL string) { pagerDutyEventsURL = eventsURL }(pagerDutyEventsURL)
+	pagerDutyEventsURL = strings.TrimSuffix(webhookContact.Webhook[0].Webhook, "/hook?token=secret") + "/pagerduty"
+	contact := &alertutils.Contact{ContactName: "pager", PagerDuty: "routing-key"}
+	assert.Nil(t, p.CreateContact(contact))
+	getOpenIncidents := func() []*alertutils.OpenIncident {
+		incidents, err := p.GetOpenIncidents(contact.ContactId, alertutils.PagerDutyContactType, []string{"a1"})
+		assert.Nil(t, err)
+		return incidents
+	}
+
+	instances := getTestInstances()[:1]
+	assert.Nil(t, p.UpdateAlertInstances("a1", instances, nil))
+	sent, err := sendToContactPoint(contact.ContactId, "High CPU", "CPU is high", alertutils.Firing, "", 1, instances,
+		&alertutils.NotificationTemplateData{AlertId: "a1"})
+	assert.Nil(t, err)
+	assert.True(t, sent)
+	assert.Equal(t, 1, destination.getRequests())
+	incidents := getOpenIncidents()
+	assert.Equal(t, 1, len(incidents))
+	assert.Equal(t, "a1-f1", incidents[0].DedupKey)
+
+	// the notification that resolved the instance was suppressed, so the next
+	// notification of the alert resolves the incident instead of the subject
+	instances[0].State = alertutils.Normal
+	assert.Nil(t, p.UpdateAlertInstances("a1", instances, nil))
+	destination.statusCodes = []int{http.StatusServiceUnavailable}
+	sent, err = sendToContactPoint(contact.ContactId, "High CPU", "The Alert State has been updated to Normal.", alertutils.Normal, "", 2, nil,
+		&alertutils.NotificationTemplateData{AlertId: "a1"})
+	assert.Nil(t, err)
+	assert.True(t, sent)
+	assert.Equal(t, 2, destination.getRequests())
+
+	// the incident is open until its resolve is delivered
+	assert.Equal(t, 1, len(getOpenIncidents()))
+	notificationQueue.retryDue(time.Now().UTC().Add(getDeliveryRetryDelay(1)))
+	assert.Equal(t, 3, destination.getRequests())
+	assert.Equal(t, 0, len(getOpenIncidents()))
+
+	// without open incidents a notification without instances has no events
+	_, err = sendToContactPoint(contact.ContactId, "High CPU", "The Alert State has been updated to Normal.", alertutils.Normal, "", 3, nil,
+		&alertutils.NotificationTemplateData{AlertId: "a1"})
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, destination.getRequests())
+}
+
+func Test_ProcessTestContactPointRequestIntegrations(t *testing.T) {
+	server, getRequests := newIntegrationServer(t)
+	defer func(eventsURL string) { pagerDutyEventsURL = eventsURL }(pagerDutyEventsURL)
+	pagerDutyEventsURL = server.URL + "/pagerduty"
+
+	testContactPoint := func(body string) int {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetBody([]byte(body))
+		ProcessTestContactPointRequest(ctx)
+		return ctx.Response.StatusCode()
+	}
+
+	assert.Equal(t, fasthttp.StatusOK, testContactPoint(`{"type": "pagerduty", "settings": {"routing_key": "routing-key"}}`))
+	requests := getRequests()
+	assert.Equal(t, 2, len(requests))
+	assert.Equal(t, "trigger", requests[0].body["event_action"])
+	assert.Equal(t, "resolve", requests[1].body["event_action"])
+	assert.Equal(t, requests[0].body["dedup_key"], requests[1].body["dedup_key"])
+
+	assert.Equal(t, fasthttp.StatusOK, testContactPoint(`{"type": "opsgenie", "settings": {"api_key": "genie-key", "api_url": "`+server.URL+`"}}`))
+	requests = getRequests()
+	assert.Equal(t, 4, len(requests))
+	assert.Equal(t, "/v2/alerts", requests[2].path)
+	assert.Equal(t, "P3", requests[2].body["priority"])
+
+	assert.Equal(t, fasthttp.StatusOK, testContactPoint(`{"type": "teams", "settings": {"webhook_url": "`+server.URL+`/teams"}}`))
+	assert.Equal(t, 5, len(getRequests()))
+
+	assert.Equal(t, fasthttp.StatusBadRequest, testContactPoint(`{"type": "pagerduty", "settings": {}}`))
+	assert.Equal(t, fasthttp.StatusBadRequest, testContactPoint(`{"type": "opsgenie", "settings": {}}`))
+	assert.Equal(t, fasthttp.StatusBadRequest, testContactPoint(`{"type": "teams", "settings": {}}`))
+}
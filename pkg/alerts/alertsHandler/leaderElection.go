@@ -0,0 +1,282 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// How long the alert evaluation lease is valid after it was renewed. Another
+// node takes over the evaluation at most this long after the leader stopped.
+const ALERT_LEASE_DURATION = 30 * time.Second
+
+// How often the nodes try to acquire or renew the alert evaluation lease.
+const ALERT_LEASE_RENEW_INTERVAL = 10 * time.Second
+
+// How often the leader picks up the alerts that changed through other nodes.
+const ALERT_CRON_SYNC_INTERVAL = time.Minute
+
+type leaseStore interface {
+	AcquireLease(name string, holder string, ttl time.Duration, now time.Time) (bool, *alertutils.AlertLease, error)
+	ReleaseLease(name string, holder string) error
+}
+
+/*
+alertLeaderElector elects one of the query nodes that share the alerts database
+to evaluate the alerts. The leader holds a lease in the database and renews it
+every ALERT_LEASE_RENEW_INTERVAL; when it stops renewing, another node acquires
+the lease once it expired. onElected and onDeposed are called when the node
+acquires and loses the lease, and onRenewed after every renewal.
+*/
+type alertLeaderElector struct {
+	mu        sync.Mutex
+	store     leaseStore
+	nodeId    string
+	leading   bool
+	term      uint64
+	expiresAt time.Time
+	onElected func()
+	onDeposed func()
+	onRenewed func()
+	stop      chan struct{}
+	once      sync.Once
+}
+
+// Set by InitAlertingService. Without an elector the node evaluates the alerts.
+var alertLeader *alertLeaderElector
+
+func newAlertLeaderElector(store leaseStore, nodeId string) *alertLeaderElector {
+	return &alertLeaderElector{
+		store:     store,
+		nodeId:    nodeId,
+		onElected: func() {},
+		onDeposed: func() {},
+		onRenewed: func() {},
+		stop:      make(chan struct{}),
+	}
+}
+
+// Returns the id of this node in the alert evaluation lease.
+func getAlertNodeId() string {
+	hostname := config.GetQueryHostname()
+	if hostname == "" {
+		var err error
+		hostname, err = os.Hostname()
+		if err != nil {
+			log.Errorf("getAlertNodeId: unable to get the hostname, err=%v", err)
+			hostname = "localhost"
+		}
+	}
+	return fmt.Sprintf("%v:%v/%v", hostname, config.GetQueryPort(), os.Getpid())
+}
+
+// Tries to acquire the lease right away, so a single node evaluates the alerts
+// from the start, and then keeps renewing it in the background.
+func (e *alertLeaderElector) start() {
+	e.once.Do(func() {
+		e.renew(time.Now().UTC())
+		go func() {
+			ticker := time.NewTicker(ALERT_LEASE_RENEW_INTERVAL)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-e.stop:
+					return
+				case <-ticker.C:
+					e.renew(time.Now().UTC())
+				}
+			}
+		}()
+	})
+}
+
+// Acquires or renews the lease and calls the callback for the change of leadership.
+func (e *alertLeaderElector) renew(now time.Time) {
+	acquired, lease, err := e.store.AcquireLease(alertutils.ALERT_EVALUATION_LEASE, e.nodeId, ALERT_LEASE_DURATION, now)
+
+	e.mu.Lock()
+	wasLeading := e.leading
+	if err != nil {
+		// No other node can take the lease over before it expires.
+		log.Errorf("alertLeaderElector.renew: unable to renew the alert evaluation lease, node: %v, err=%v", e.nodeId, err)
+		acquired = wasLeading && now.Before(e.expiresAt)
+	} else if acquired {
+		e.term = lease.Term
+		e.expiresAt = time.UnixMilli(lease.ExpiresAtMs)
+	}
+	e.leading = acquired
+	if !acquired {
+		e.expiresAt = time.Time{}
+	}
+	e.mu.Unlock()
+
+	switch {
+	case acquired && !wasLeading:
+		log.Infof("alertLeaderElector.renew: node %v is now evaluating the alerts, term: %v", e.nodeId, e.getTerm())
+		e.onElected()
+	case !acquired && wasLeading:
+		log.Warnf("alertLeaderElector.renew: node %v lost the alert evaluation lease", e.nodeId)
+		e.onDeposed()
+	case acquired:
+		e.onRenewed()
+	}
+}
+
+// Stops renewing the lease and releases it, so another node takes over the
+// evaluation without waiting for the lease to expire.
+func (e *alertLeaderElector) release() {
+	close(e.stop)
+
+	e.mu.Lock()
+	wasLeading := e.leading
+	e.leading = false
+	e.expiresAt = time.Time{}
+	e.mu.Unlock()
+
+	if !wasLeading {
+		return
+	}
+	e.onDeposed()
+	err := e.store.ReleaseLease(alertutils.ALERT_EVALUATION_LEASE, e.nodeId)
+	if err != nil {
+		log.Errorf("alertLeaderElector.release: unable to release the alert evaluation lease, node: %v, err=%v", e.nodeId, err)
+	}
+}
+
+// Returns true while the node holds a lease that did not expire.
+func (e *alertLeaderElector) isLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leading && time.Now().Before(e.expiresAt)
+}
+
+func (e *alertLeaderElector) getTerm() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.term
+}
+
+func isAlertEvaluationLeader() bool {
+	return alertLeader == nil || alertLeader.isLeader()
+}
+
+// The time of the last sync of the cron jobs, which the renewals of the lease
+// repeat every ALERT_CRON_SYNC_INTERVAL.
+var lastAlertCronJobSync time.Time
+
+func syncAlertCronJobsIfDue(getMyIds func() []int64, now time.Time) {
+	if now.Sub(lastAlertCronJobSync) < ALERT_CRON_SYNC_INTERVAL {
+		return
+	}
+	syncAlertCronJobs(getMyIds)
+}
+
+// Schedules the alerts that are not scheduled or changed since they were
+// scheduled, and removes the jobs of the deleted alerts. Alerts created,
+// updated or deleted through another node are picked up this way.
+func syncAlertCronJobs(getMyIds func() []int64) {
+	if databaseObj == nil {
+		return
+	}
+	lastAlertCronJobSync = time.Now().UTC()
+
+	existing := make(map[string]struct{})
+	for _, myid := range getMyIds() {
+		allAlerts, err := databaseObj.GetAllAlerts(myid)
+		if err != nil {
+			log.Errorf("syncAlertCronJobs: unable to GetAllAlerts, err: %+v", err)
+			// Without the alerts of the org we can not tell which were deleted.
+			return
+		}
+		for _, alertDataObj := range allAlerts {
+			existing[alertDataObj.AlertId] = struct{}{}
+			fingerprint, scheduled := getScheduledAlertFingerprint(alertDataObj.AlertId)
+			if scheduled && fingerprint == getAlertScheduleFingerprint(alertDataObj) {
+				continue
+			}
+			if scheduled {
+				err = RemoveCronJob(alertDataObj.AlertId)
+				if err != nil {
+					log.Errorf("syncAlertCronJobs: unable to remove the CronJob of alert=%v, err=%+v", alertDataObj.AlertName, err)
+					continue
+				}
+			}
+			_, err = AddCronJob(alertDataObj)
+			if err != nil {
+				log.Errorf("syncAlertCronJobs: could not add a new CronJob corresponding to alert=%+v, err=%+v", alertDataObj.AlertName, err)
+			}
+		}
+	}
+
+	for _, alertId := range getScheduledAlertIds() {
+		if _, ok := existing[alertId]; ok {
+			continue
+		}
+		err := RemoveCronJob(alertId)
+		if err != nil {
+			log.Errorf("syncAlertCronJobs: unable to remove the CronJob of deleted alert: %v, err=%+v", alertId, err)
+		}
+		alertDispatcher.removeAlert(alertId)
+	}
+}
+
+// Removes the jobs of all alerts and their instances from the dispatcher. The
+// state of the instances and the notification log stay in the database for the
+// node that takes over.
+func unscheduleAllAlerts() {
+	for _, alertId := range getScheduledAlertIds() {
+		err := RemoveCronJob(alertId)
+		if err != nil {
+			log.Errorf("unscheduleAllAlerts: unable to remove the CronJob of alert: %v, err=%+v", alertId, err)
+		}
+		alertDispatcher.removeAlert(alertId)
+	}
+}
+
+func ProcessGetAlertLeaderRequest(ctx *fasthttp.RequestCtx) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	lease, err := databaseObj.GetLease(alertutils.ALERT_EVALUATION_LEASE)
+	if err != nil {
+		utils.SendError(ctx, "Failed to get the alert evaluation lease", "", err)
+		return
+	}
+
+	responseBody := make(map[string]interface{})
+	if alertLeader != nil {
+		responseBody["node_id"] = alertLeader.nodeId
+		responseBody["is_leader"] = alertLeader.isLeader()
+	} else {
+		responseBody["is_leader"] = true
+	}
+	responseBody["lease"] = lease
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/siglens/siglens/pkg/alerts/alertsqlite"
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Opens one connection per node to the same sqlite file, like query nodes
+// that share the alerts database.
+func newTestNodeDatabases(t *testing.T, numNodes int) []*alertsqlite.Sqlite {
+	dbPath := filepath.Join(t.TempDir(), "siglens.db")
+	nodes := make([]*alertsqlite.Sqlite, numNodes)
+	for i := range nodes {
+		db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+		assert.Nil(t, err)
+		assert.Nil(t, db.Exec("PRAGMA busy_timeout=5000;").Error)
+		assert.Nil(t, db.AutoMigrate(&alertutils.AlertLease{}, &alertutils.NotificationLogEntry{}))
+		nodes[i] = &alertsqlite.Sqlite{}
+		nodes[i].SetDB(db)
+	}
+	return nodes
+}
+
+type testElectorEvents struct {
+	elected int
+	deposed int
+	renewed int
+}
+
+func newTestElector(store leaseStore, nodeId string) (*alertLeaderElector, *testElectorEvents) {
+	events := &testElectorEvents{}
+	elector := newAlertLeaderElector(store, nodeId)
+	elector.onElected = func() { events.elected++ }
+	elector.onDeposed = func() { events.deposed++ }
+	elector.onRenewed = func() { events.renewed++ }
+	return elector, events
+}
+
+func Test_AlertLeaderFailover(t *testing.T) {
+	nodes := newTestNodeDatabases(t, 2)
+	node1, events1 := newTestElector(nodes[0], "node1")
+	node2, events2 := newTestElector(nodes[1], "node2")
+	now := time.Now().UTC()
+
+	node1.renew(now)
+	node2.renew(now)
+	assert.True(t, node1.isLeader())
+	assert.False(t, node2.isLeader())
+	assert.Equal(t, 1, events1.elected)
+	assert.Equal(t, 0, events2.elected)
+
+	node1.renew(now.Add(ALERT_LEASE_RENEW_INTERVAL))
+	node2.renew(now.Add(ALERT_LEASE_RENEW_INTERVAL))
+	assert.True(t, node1.isLeader())
+	assert.Equal(t, 1, events1.renewed)
+	assert.False(t, node2.isLeader())
+
+	// node1 stops renewing; node2 takes over once the lease expired
+	expired := now.Add(ALERT_LEASE_RENEW_INTERVAL + ALERT_LEASE_DURATION)
+	node2.renew(expired.Add(-time.Second))
+	assert.False(t, node2.isLeader())
+	node2.renew(expired)
+	assert.True(t, node2.isLeader())
+	assert.Equal(t, 1, events2.elected)
+	assert.Equal(t, uint64(2), node2.getTerm())
+
+	node1.renew(expired.Add(time.Second))
+	assert.False(t, node1.isLeader())
+	assert.Equal(t, 1, events1.deposed)
+
+	// releasing the lease hands it over without waiting for it to expire
+	node2.release()
+	assert.False(t, node2.isLeader())
+	assert.Equal(t, 1, events2.deposed)
+	node1.renew(expired.Add(2 * time.Second))
+	assert.True(t, node1.isLeader())
+	assert.Equal(t, 2, events1.elected)
+	assert.Equal(t, uint64(3), node1.getTerm())
+}
+
+func Test_DispatcherNotificationLogHandoff(t *testing.T) {
+	nodes := newTestNodeDatabases(t, 2)
+	d1, sent1 := newTestDispatcher()
+	d1.notificationLog = nodes[0]
+	d2, sent2 := newTestDispatcher()
+	d2.notificationLog = nodes[1]
+
+	routing := &alertutils.NotificationRouting{Route: alertutils.NotificationRoute{
+		GroupWait:      "30s",
+		GroupInterval:  "5m",
+		RepeatInterval: "1h",
+	}}
+	alert := &alertutils.AlertDetails{AlertId: "a1", AlertConfig: alertutils.AlertConfig{AlertName: "High CPU", ContactID: "c1"}}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	d1.dispatch(alert, routing, getHostInstances(alertutils.Firing, "web01"), "", nil, now)
+	d1.flush(now.Add(30 * time.Second))
+	assert.Equal(t, 1, len(*sent1))
+
+	// the node that takes over does not notify the instances notified before
+	d2.dispatch(alert, routing, getHostInstances(alertutils.Firing, "web01", "web02"), "", nil, now.Add(time.Minute))
+	d2.flush(now.Add(2 * time.Minute))
+	assert.Equal(t, 1, len(*sent2))
+	assert.Equal(t, "[FIRING:2] alertname=High CPU", (*sent2)[0].subject)
+
+	d2.dispatch(alert, routing, getHostInstances(alertutils.Firing, "web01", "web02"), "", nil, now.Add(3*time.Minute))
+	d2.flush(now.Add(8 * time.Minute))
+	assert.Equal(t, 1, len(*sent2))
+
+	// a third node repeats the notification after the repeat interval of the last one
+	d3, sent3 := newTestDispatcher()
+	d3.notificationLog = nodes[0]
+	d3.dispatch(alert, routing, getHostInstances(alertutils.Firing, "web01", "web02"), "", nil, now.Add(10*time.Minute))
+	d3.flush(now.Add(11 * time.Minute))
+	assert.Equal(t, 0, len(*sent3))
+	d3.flush(now.Add(62 * time.Minute))
+	assert.Equal(t, 1, len(*sent3))
+	groupKey := getTestGroupKey(d3)
+	entry, err := nodes[1].GetNotificationLogEntry(groupKey)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(62*time.Minute), entry.LastNotified.UTC())
+	assert.Equal(t, 2, len(entry.Firing))
+
+	// resolved instances notified as firing by another node are notified once
+	d4, sent4 := newTestDispatcher()
+	d4.notificationLog = nodes[1]
+	d4.dispatch(alert, routing, getHostInstances(alertutils.Normal, "web01", "web02"), "", nil, now.Add(63*time.Minute))
+	d4.flush(now.Add(64 * time.Minute))
+	assert.Equal(t, 1, len(*sent4))
+	assert.Equal(t, "[RESOLVED] alertname=High CPU", (*sent4)[0].subject)
+	assert.Equal(t, 0, len(d4.groups))
+
+	entry, err = nodes[0].GetNotificationLogEntry(groupKey)
+	assert.Nil(t, err)
+	assert.Nil(t, entry)
+}
+
+func getTestGroupKey(d *notificationDispatcher) string {
+	for groupKey := range d.groups {
+		return groupKey
+	}
+	return ""
+}
+
+func Test_syncAlertCronJobsIfDue(t *testing.T) {
+	databaseObj = newMockDatabase()
+	defer func() {
+		databaseObj = nil
+		lastAlertCronJobSync = time.Time{}
+	}()
+	syncs := 0
+	getMyIds := func() []int64 {
+		syncs++
+		return []int64{0}
+	}
+
+	now := time.Now().UTC()
+	syncAlertCronJobsIfDue(getMyIds, now)
+	assert.Equal(t, 1, syncs)
+
+	// the renewals of the lease sync less often than they happen
+	syncAlertCronJobsIfDue(getMyIds, now.Add(ALERT_LEASE_RENEW_INTERVAL))
+	assert.Equal(t, 1, syncs)
+	syncAlertCronJobsIfDue(getMyIds, now.Add(ALERT_CRON_SYNC_INTERVAL+time.Second))
+	assert.Equal(t, 2, syncs)
+}
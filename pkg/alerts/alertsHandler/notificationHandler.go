@@ -18,25 +18,28 @@ package alertsHandler
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
-	"net/smtp"
+	"mime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/slack-go/slack"
 
 	"github.com/siglens/siglens/pkg/alerts/alertutils"
-	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/integrations/prometheus/promql"
 	"github.com/siglens/siglens/pkg/utils"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func NotifyAlertHandlerRequest(alertID string, alertState alertutils.AlertState, alertDataMessage string) (bool, error) {
+// Sends the notification of the alert to its contact point. The instances are
+// the firing and resolved instances that the notification names, and the
+// results are the first rows of the result of the query of the alert.
+func NotifyAlertHandlerRequest(alertID string, alertState alertutils.AlertState, alertDataMessage string, instances []*alertutils.AlertInstance,
+	results []map[string]interface{}) (bool, error) {
 	if alertID == "" {
 		log.Errorf("NotifyAlertHandlerRequest: Missing alert_id")
 		return false, errors.New("alert ID is empty")
@@ -48,7 +51,7 @@ func NotifyAlertHandlerRequest(alertID string, alertState alertutils.AlertState,
 		return false, err
 	}
 
-	shouldSend, err := shouldSendNotification(alertID, alertDetails, alertState)
+	shouldSend, instances, err := shouldSendNotification(alertID, alertDetails, alertState, instances)
 	if err != nil {
 		log.Errorf("NotifyAlertHandlerRequest:Error checking if notification should be sent for alert id- %s, err=%v", alertID, err)
 		return false, err
@@ -62,100 +65,342 @@ func NotifyAlertHandlerRequest(alertID string, alertState alertutils.AlertState,
 		log.Errorf("NotifyAlertHandlerRequest:Error retrieving contact and message for alert id- %s, err=%v", alertID, err)
 		return false, err
 	}
-	emailIDs, channelIDs, webhooks, err := processGetEmailAndChannelID(contact_id)
+	templateData := getAlertTemplateData(alertDetails, results)
+	return sendToContactPoint(contact_id, subject, message, alertState, alertDataMessage, alertDetails.NumEvaluationsCount, instances, templateData)
+}
+
+/*
+Sends the notification to the emails, Slack channels, webhooks, PagerDuty,
+Opsgenie and Microsoft Teams of the contact point. Each of them is a delivery
+of the notification queue, which attempts it right away and retries it when it
+fails. Returns true if any of them was delivered or will be retried.
+PagerDuty and Opsgenie get an event per instance, and resolve the open
+incidents of the alerts whose instance no longer fires.
+
+The templates of the contact point render the title and the body for their
+type of contact point from the template data, which is completed with the
+subject, message, state, link and instances of the notification. A body
+template replaces the message and the list of instances.
+*/
+func sendToContactPoint(contact_id string, subject string, message string, alertState alertutils.AlertState, alertDataMessage string,
+	numEvaluationsCount uint64, instances []*alertutils.AlertInstance, templateData *alertutils.NotificationTemplateData) (bool, error) {
+
+	contact, err := processGetContact(contact_id)
 	if err != nil {
-		log.Errorf("NotifyAlertHandlerRequest:Error retrieving emails or channelIds of slack for contact_id- %s and alert id- %s, err=%v", contact_id, alertID, err)
+		log.Errorf("sendToContactPoint: Error retrieving contact point for contact_id- %s, err=%v", contact_id, err)
 		return false, err
 	}
-	emailSent := false
-	slackSent := false
-	webhookSent := false
-	if len(emailIDs) > 0 {
-		for _, emailID := range emailIDs {
-			err = sendAlertEmail(emailID, subject, message, alertDataMessage)
-			if err != nil {
-				log.Errorf("NotifyAlertHandlerRequest: Error sending email to- %s for alert id- %s, err=%v", emailID, alertID, err)
-			} else {
-				emailSent = true
-			}
+	if templateData == nil {
+		templateData = &alertutils.NotificationTemplateData{}
+	}
+	templateData.Title = subject
+	templateData.Message = message
+	templateData.State = alertutils.GetStateName(alertState)
+	templateData.Link = alertDataMessage
+	templateData.NumEvaluations = numEvaluationsCount
+	templateData.SetInstances(instances)
+
+	instancesMessage := getInstancesMessage(instances)
+	alertIds := getNotificationAlertIds(templateData, instances)
+	render := func(contactType string) (string, string, string) {
+		return renderNotification(contact, contactType, templateData, instancesMessage)
+	}
+
+	deliveries := make([]*alertutils.NotificationDelivery, 0)
+	addDeliveries := func(contactType string, subject string, requests ...*alertutils.DeliveryRequest) {
+		for _, request := range requests {
+			deliveries = append(deliveries, newNotificationDelivery(contact, contactType, subject, request))
 		}
 	}
-	if len(channelIDs) > 0 {
-		for _, channelID := range channelIDs {
-			err = sendSlack(subject, message, channelID, alertState, alertDataMessage)
-			if err != nil {
-				log.Errorf("NotifyAlertHandlerRequest: Error sending Slack message to channelID- %v for alert id- %v, err=%v", channelID, alertID, err)
-			} else {
-				slackSent = true
-			}
+
+	for _, emailID := range contact.Email {
+		subject, message, instancesMessage := render(alertutils.EmailContactType)
+		addDeliveries(alertutils.EmailContactType, subject, getEmailRequest(emailID, subject, message, alertDataMessage, instancesMessage))
+	}
+	for _, channelID := range contact.Slack {
+		subject, message, instancesMessage := render(alertutils.SlackContactType)
+		request, err := getSlackRequest(subject, message, channelID, alertState, alertDataMessage, instancesMessage)
+		if err != nil {
+			log.Errorf("sendToContactPoint: Error creating Slack message to channelID- %v for contact_id- %v, err=%v", channelID.ChannelId, contact_id, err)
+			continue
 		}
+		addDeliveries(alertutils.SlackContactType, subject, request)
 	}
-	if len(webhooks) > 0 {
-		for _, webhook := range webhooks {
-			err = sendWebhooks(webhook.Webhook, subject, message, alertDataMessage, alertDetails.NumEvaluationsCount, alertState, webhook.Headers)
-			if err != nil {
-				log.Errorf("NotifyAlertHandlerRequest: Error sending Webhook message to webhook- %s for alert id- %s, err=%v", webhook.Webhook, alertID, err)
-			} else {
-				webhookSent = true
-			}
+	for _, webhook := range contact.Webhook {
+		subject, message, _ := render(alertutils.WebhookContactType)
+		request, err := getWebhookRequest(webhook.Webhook, subject, message, alertDataMessage, numEvaluationsCount, alertState, webhook.Headers, instances)
+		if err != nil {
+			log.Errorf("sendToContactPoint: Error creating Webhook message to webhook- %s for contact_id- %s, err=%v", webhook.Webhook, contact_id, err)
+			continue
+		}
+		addDeliveries(alertutils.WebhookContactType, subject, request)
+	}
+	if contact.PagerDuty != "" {
+		subject, message, _ := render(alertutils.PagerDutyContactType)
+		requests, err := getPagerDutyRequests(contact.PagerDuty, message, alertDataMessage,
+			getContactIncidentEvents(contact, alertutils.PagerDutyContactType, subject, alertIds, instances))
+		if err != nil {
+			log.Errorf("sendToContactPoint: Error creating PagerDuty events for contact_id- %s, err=%v", contact_id, err)
+		}
+		addDeliveries(alertutils.PagerDutyContactType, subject, requests...)
+	}
+	for _, opsgenie := range contact.Opsgenie {
+		subject, message, _ := render(alertutils.OpsgenieContactType)
+		requests, err := getOpsgenieRequests(opsgenie, message, alertDataMessage,
+			getContactIncidentEvents(contact, alertutils.OpsgenieContactType, subject, alertIds, instances))
+		if err != nil {
+			log.Errorf("sendToContactPoint: Error creating Opsgenie alerts for contact_id- %s, err=%v", contact_id, err)
 		}
+		addDeliveries(alertutils.OpsgenieContactType, subject, requests...)
+	}
+	for _, teams := range contact.Teams {
+		subject, message, _ := render(alertutils.TeamsContactType)
+		request, err := getTeamsRequest(teams.WebhookUrl, subject, message, alertState, alertDataMessage, instances)
+		if err != nil {
+			log.Errorf("sendToContactPoint: Error creating Teams message for contact_id- %s, err=%v", contact_id, err)
+			continue
+		}
+		addDeliveries(alertutils.TeamsContactType, subject, request)
 	}
 
-	if !emailSent && !slackSent && !webhookSent {
-		return false, errors.New("neither emails or slack message or webhook sent for this notification")
+	if !notificationQueue.enqueue(deliveries, time.Now().UTC()) {
+		return false, errors.New("the notification was not sent to any integration of the contact point")
 	}
 
 	return true, nil
 }
 
-// shouldSendNotification checks if the notification should be sent based on the cooldown period and silence minutes
+// Returns the ids of the alerts that a notification is about: the alert of its
+// template data and the alerts of its instances.
+func getNotificationAlertIds(templateData *alertutils.NotificationTemplateData, instances []*alertutils.AlertInstance) []string {
+	alertIds := make([]string, 0)
+	seen := make(map[string]struct{})
+	add := func(alertId string) {
+		if _, ok := seen[alertId]; ok || alertId == "" {
+			return
+		}
+		seen[alertId] = struct{}{}
+		alertIds = append(alertIds, alertId)
+	}
+	add(templateData.AlertId)
+	for _, instance := range instances {
+		add(instance.AlertId)
+	}
+	return alertIds
+}
+
+// Returns the title, the body and the list of instances of the notification
+// for a type of contact point. When its template fails, the defaults are sent.
+func renderNotification(contact *alertutils.Contact, contactType string, data *alertutils.NotificationTemplateData,
+	instancesMessage string) (string, string, string) {
+
+	tmpl, ok := contact.Templates[contactType]
+	if !ok {
+		return data.Title, data.Message, instancesMessage
+	}
+	title, body, err := tmpl.Render(data)
+	if err != nil {
+		log.Errorf("renderNotification: could not render the %v template of contact: %v, sending the default notification, err=%v",
+			contactType, contact.ContactName, err)
+		return data.Title, data.Message, instancesMessage
+	}
+	if strings.TrimSpace(tmpl.Body) != "" {
+		instancesMessage = ""
+	}
+	return title, body, instancesMessage
+}
+
+// Returns the template data of the alert. The notification completes it.
+func getAlertTemplateData(alert *alertutils.AlertDetails, results []map[string]interface{}) *alertutils.NotificationTemplateData {
+	data := &alertutils.NotificationTemplateData{
+		AlertId:   alert.AlertId,
+		AlertName: alert.AlertName,
+		Labels:    alertutils.GetSilenceLabels(alert, nil),
+		Condition: alertutils.GetConditionDescription(alert.Condition, alert.Value),
+		Threshold: alert.Value,
+		Results:   results,
+	}
+	switch alert.AlertType {
+	case alertutils.AlertTypeLogs:
+		data.QueryLanguage = alert.QueryParams.QueryLanguage
+		data.QueryText = alert.QueryParams.QueryText
+	case alertutils.AlertTypeMetrics:
+		data.QueryLanguage, data.QueryText = getMetricsQueryText(alert)
+	}
+	return data
+}
+
+// Returns the language and the text of the queries of a metrics alert, with
+// its formulas, e.g. "a: avg(cpu) by (host); a * 100".
+func getMetricsQueryText(alert *alertutils.AlertDetails) (string, string) {
+	_, _, queries, formulas, _, _, err := promql.ParseMetricTimeSeriesRequest([]byte(alert.MetricsQueryParamsString))
+	if err != nil {
+		log.Errorf("getMetricsQueryText: could not parse the metrics query of alert: %v, err=%v", alert.AlertName, err)
+		return "", ""
+	}
+
+	var queryLanguage string
+	parts := make([]string, 0, len(queries)+len(formulas))
+	for _, query := range queries {
+		if lang, ok := query["qlType"].(string); ok && queryLanguage == "" {
+			queryLanguage = lang
+		}
+		parts = append(parts, fmt.Sprintf("%v: %v", query["name"], query["query"]))
+	}
+	for _, formula := range formulas {
+		if text, ok := formula["formula"].(string); ok && text != "" {
+			parts = append(parts, text)
+		}
+	}
+	return queryLanguage, strings.Join(parts, "; ")
+}
+
+// shouldSendNotification checks if the notification should be sent based on the cooldown period, silence minutes,
+// silences and maintenance windows. It returns the instances that are not silenced.
 // If the last alert state is normal and the current alert state is also normal, then we should not send the notification
-func shouldSendNotification(alertID string, alertDetails *alertutils.AlertDetails, currentAlertState alertutils.AlertState) (bool, error) {
+func shouldSendNotification(alertID string, alertDetails *alertutils.AlertDetails, currentAlertState alertutils.AlertState,
+	instances []*alertutils.AlertInstance) (bool, []*alertutils.AlertInstance, error) {
+
 	alertNotification, err := processGetAlertNotification(alertID)
 	if err != nil {
 		log.Errorf("shouldSendNotification:Error getting alert notification details for alert id- %s, err=%v", alertID, err)
-		return false, err
+		return false, nil, err
 	}
 
 	if currentAlertState == alertutils.Normal {
 		if alertNotification.LastAlertState == alertutils.Inactive {
 			// If the last alert state is inactive and the current alert state is normal, then we should not send the notification
-			return false, nil
+			return false, nil, nil
 		}
 		if alertNotification.LastAlertState == currentAlertState {
 			// If the last alert state is normal and the current alert state is also normal, then we should not send the notification
-			return false, nil
+			return false, nil, nil
 		}
 	}
 
 	cooldownOver := isCooldownOver(alertNotification.CooldownPeriod, alertNotification.LastSentTime)
 	if !cooldownOver {
-		return false, nil
+		return false, nil, nil
 	}
 	silenceMinutesOver := isSilenceMinutesOver(alertDetails.SilenceMinutes, alertNotification.LastSentTime)
 	if !silenceMinutesOver {
-		return false, nil
+		return false, nil, nil
 	}
 
-	return true, nil
+	silences, err := databaseObj.GetAllSilences(alertDetails.OrgId)
+	if err != nil {
+		log.Errorf("shouldSendNotification:Error getting silences for alert id- %s, err=%v", alertID, err)
+		return false, nil, err
+	}
+	windows, err := databaseObj.GetAllMaintenanceWindows(alertDetails.OrgId)
+	if err != nil {
+		log.Errorf("shouldSendNotification:Error getting maintenance windows for alert id- %s, err=%v", alertID, err)
+		return false, nil, err
+	}
+	instances, silenced := removeSilencedInstances(alertDetails, instances, silences, windows, time.Now().UTC())
+	if silenced {
+		return false, nil, nil
+	}
+
+	return true, instances, nil
+}
+
+// Removes the instances that an active silence or maintenance window matches.
+// Returns true if everything the notification is about is silenced, which is
+// the alert itself when there are no instances.
+func removeSilencedInstances(alertDetails *alertutils.AlertDetails, instances []*alertutils.AlertInstance,
+	silences []*alertutils.Silence, windows []*alertutils.MaintenanceWindow, now time.Time) ([]*alertutils.AlertInstance, bool) {
+
+	if len(silences) == 0 && len(windows) == 0 {
+		return instances, false
+	}
+	if len(instances) == 0 {
+		labels := alertutils.GetSilenceLabels(alertDetails, nil)
+		return instances, alertutils.IsSilenced(labels, silences, windows, now)
+	}
+
+	unsilenced := make([]*alertutils.AlertInstance, 0, len(instances))
+	for _, instance := range instances {
+		labels := alertutils.GetSilenceLabels(alertDetails, instance.Labels)
+		if !alertutils.IsSilenced(labels, silences, windows, now) {
+			unsilenced = append(unsilenced, instance)
+		}
+	}
+	return unsilenced, len(unsilenced) == 0
+}
+
+/*
+Lists the firing and the resolved instances, one per line, e.g.
+
+	Firing instances:
+	- host=web01 (value: 97, baseline: 40.5, score: 3.2)
+	Resolved instances:
+	- host=web02
+
+The baseline and the score are only given for anomaly conditions. Returns an
+empty string when no instance has labels, i.e. the alert has a single instance.
+*/
+func getInstancesMessage(instances []*alertutils.AlertInstance) string {
+	var firing, resolved []string
+	for _, instance := range instances {
+		if len(instance.Labels) == 0 {
+			continue
+		}
+		labels := alertutils.FormatInstanceLabels(instance.Labels)
+		if instance.State == alertutils.Firing {
+			line := fmt.Sprintf("- %v (%v)", labels, formatInstanceValue(instance))
+			if summary := instance.Annotations[alertutils.SummaryAnnotation]; summary != "" {
+				line += ": " + summary
+			}
+			firing = append(firing, line)
+		} else {
+			resolved = append(resolved, "- "+labels)
+		}
+	}
+
+	var lines []string
+	if len(firing) > 0 {
+		lines = append(lines, "Firing instances:")
+		lines = append(lines, firing...)
+	}
+	if len(resolved) > 0 {
+		lines = append(lines, "Resolved instances:")
+		lines = append(lines, resolved...)
+	}
+	return strings.Join(lines, "\n")
 }
 
-func sendAlertEmail(emailID, subject, message string, alertDataMessage string) error {
-	host, port, senderEmail, senderPassword := config.GetEmailConfig()
-	auth := smtp.PlainAuth("", senderEmail, senderPassword, host)
+// Formats the value of an instance with its baseline and score, if any, e.g.
+// "value: 97, baseline: 40.5, score: 3.2".
+func formatInstanceValue(instance *alertutils.AlertInstance) string {
+	text := fmt.Sprintf("value: %v", instance.Value)
+	if instance.Baseline != nil {
+		text += fmt.Sprintf(", baseline: %v", strconv.FormatFloat(*instance.Baseline, 'g', 4, 64))
+	}
+	if instance.Score != nil {
+		text += fmt.Sprintf(", score: %v", strconv.FormatFloat(*instance.Score, 'g', 3, 64))
+	}
+	return text
+}
+
+func getEmailRequest(emailID, subject, message string, alertDataMessage string, instancesMessage string) *alertutils.DeliveryRequest {
+	// The subject can have label values, so it is encoded when it has line
+	// breaks or other characters that cannot be in a header as they are.
 	body := "To: " + emailID + "\r\n" +
-		"Subject: " + subject + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
 		"\r\n" +
 		message + "\r\n"
+	if instancesMessage != "" {
+		body = body + strings.ReplaceAll(instancesMessage, "\n", "\r\n") + "\r\n"
+	}
 	if alertDataMessage != "" {
 		body = body + "Alert Data: " + alertDataMessage + "\r\n"
 	}
-	err := smtp.SendMail(host+":"+strconv.Itoa(port), auth, senderEmail, []string{emailID}, []byte(body))
-	return err
+	return &alertutils.DeliveryRequest{To: emailID, Body: body}
 }
 
-func sendWebhooks(webhookUrl, subject, message string, alertDataMessage string, numEvaluationsCount uint64,
-	alertState alertutils.AlertState, headers map[string]string) error {
+func getWebhookRequest(webhookUrl, subject, message string, alertDataMessage string, numEvaluationsCount uint64,
+	alertState alertutils.AlertState, headers map[string]string, instances []*alertutils.AlertInstance) (*alertutils.DeliveryRequest, error) {
 
 	var status string
 	switch alertState {
@@ -164,47 +409,47 @@ func sendWebhooks(webhookUrl, subject, message string, alertDataMessage string,
 	case alertutils.Firing:
 		status = "firing"
 	case alertutils.Pending, alertutils.Inactive:
-		return fmt.Errorf("sendWebhooks: Invalid alert state %v", alertState)
+		return nil, fmt.Errorf("getWebhookRequest: Invalid alert state %v", alertState)
 	}
 
 	if alertDataMessage != "" {
 		message = message + "\nAlert Data: " + alertDataMessage
 	}
 
+	alerts := []alertutils.Alert{
+		{
+			Status: status,
+		},
+	}
+	if len(instances) > 0 {
+		alerts = make([]alertutils.Alert, 0, len(instances))
+		for _, instance := range instances {
+			instanceStatus := "normal"
+			if instance.State == alertutils.Firing {
+				instanceStatus = "firing"
+			}
+			alerts = append(alerts, alertutils.Alert{
+				Status:      instanceStatus,
+				Labels:      instance.Labels,
+				Value:       instance.Value,
+				Fingerprint: instance.Fingerprint,
+				Annotations: instance.Annotations,
+				Baseline:    instance.Baseline,
+				Score:       instance.Score,
+			})
+		}
+	}
+
 	webhookBody := alertutils.WebhookBody{
 		Receiver:            "My Super Webhook",
 		Status:              status,
 		Title:               subject,
 		Body:                message,
 		NumEvaluationsCount: numEvaluationsCount,
-		Alerts: []alertutils.Alert{
-			{
-				Status: status,
-			},
-		},
-	}
-
-	data, _ := json.Marshal(webhookBody)
-
-	r, err := http.NewRequest("POST", webhookUrl, bytes.NewBuffer(data))
-	if err != nil {
-		log.Errorf("sendWebhooks: Error creating request. WebhookURL=%v, Error=%v", webhookUrl, err)
-		return err
+		Alerts:              alerts,
 	}
 
-	r.Header.Add("Content-Type", "application/json")
-
-	for key, value := range headers {
-		r.Header.Add(key, value)
-	}
-	client := alertutils.GetCertErrorForgivingHttpClient()
-	resp, err := client.Do(r)
-	if err != nil {
-		log.Errorf("sendWebhooks: Error sending request. WebhookURL=%v, Error=%v", webhookUrl, err)
-		return err
-	}
-	resp.Body.Close()
-	return nil
+	return newJSONRequest(webhookUrl, headers, webhookBody)
 }
 
 func isSilenceMinutesOver(silenceMinutes uint64, lastSendTime time.Time) bool {
@@ -237,10 +482,17 @@ func getSlackMessageColor(alertState alertutils.AlertState) string {
 	return "#FF0000"
 }
 
-func sendSlack(alertName string, message string, channel alertutils.SlackTokenConfig, alertState alertutils.AlertState, alertDataMessage string) error {
-	channelID := channel.ChannelId
-	token := channel.SlToken
-	client := slack.New(token, slack.OptionDebug(false))
+func sendSlack(alertName string, message string, channel alertutils.SlackTokenConfig, alertState alertutils.AlertState, alertDataMessage string, instancesMessage string) error {
+	request, err := getSlackRequest(alertName, message, channel, alertState, alertDataMessage, instancesMessage)
+	if err != nil {
+		return err
+	}
+	return sendDeliveryRequest(alertutils.SlackContactType, request).err
+}
+
+func getSlackRequest(alertName string, message string, channel alertutils.SlackTokenConfig, alertState alertutils.AlertState,
+	alertDataMessage string, instancesMessage string) (*alertutils.DeliveryRequest, error) {
+
 	color := getSlackMessageColor(alertState)
 
 	attachment := slack.Attachment{
@@ -271,6 +523,13 @@ func sendSlack(alertName string, message string, channel alertutils.SlackTokenCo
 		}
 	}
 
+	if instancesMessage != "" {
+		attachment.Fields = append(attachment.Fields, slack.AttachmentField{
+			Title: "Instances",
+			Value: instancesMessage,
+		})
+	}
+
 	if utils.IsValidURL(message) {
 		// If the Message that a user has set while creating is a URL,
 		// then we will add a button to view the message
@@ -295,11 +554,11 @@ func sendSlack(alertName string, message string, channel alertutils.SlackTokenCo
 		}
 	}
 
-	_, _, err := client.PostMessage(
-		channelID,
-		slack.MsgOptionAttachments(attachment),
-	)
-	return err
+	data, err := json.Marshal(attachment)
+	if err != nil {
+		return nil, err
+	}
+	return &alertutils.DeliveryRequest{Channel: channel.ChannelId, Token: channel.SlToken, Body: string(data)}, nil
 }
 
 func processGetAlertNotification(alert_id string) (*alertutils.Notification, error) {
@@ -329,12 +588,12 @@ func processGetContactDetails(alert_id string) (string, string, string, error) {
 	return id, message, subject, nil
 }
 
-func processGetEmailAndChannelID(contact_id string) ([]string, []alertutils.SlackTokenConfig, []alertutils.WebHookConfig, error) {
-	emails, slacks, webhook, err := databaseObj.GetEmailAndChannelID(contact_id)
+func processGetContact(contact_id string) (*alertutils.Contact, error) {
+	contact, err := databaseObj.GetContact(contact_id)
 	if err != nil {
-		log.Errorf("ProcessGetEmailAndChannelID: Error in getting emails and channel_ids for contact_id- %s, err=%v", contact_id, err)
-		return nil, nil, nil, err
+		log.Errorf("ProcessGetContact: Error in getting contact point for contact_id- %s, err=%v", contact_id, err)
+		return nil, err
 	}
 
-	return emails, slacks, webhook, nil
+	return contact, nil
 }
@@ -0,0 +1,657 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/siglens/siglens/pkg/integrations/prometheus/promql"
+	"github.com/siglens/siglens/pkg/integrations/prometheus/rules"
+	"github.com/siglens/siglens/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule group of the metrics alerts that were not imported from a rule file.
+const DEFAULT_ALERTING_RULE_GROUP = "siglens"
+
+// File reported for the alerting rule groups by the Prometheus rules API.
+const ALERTING_RULES_FILE = "siglens-alerts"
+
+type skippedRule struct {
+	Group string `json:"group"`
+	Rule  string `json:"rule"`
+	Error string `json:"error"`
+}
+
+/*
+Imports the alerting rules of a Prometheus rule file as metrics alerts notifying
+the contact point given by the contact_id parameter. Every rule is converted
+before any alert changes, and the file is rejected with the unsupported rules
+when one of them cannot be converted. The alerts of a group that was imported
+before are updated in place by name, so they keep their instances and history,
+and the alerts of rules removed from the group are deleted. Recording rules are
+skipped and returned with the reason.
+*/
+func ProcessImportPrometheusRulesRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+	contactId := string(ctx.QueryArgs().Peek("contact_id"))
+	if contactId == "" {
+		utils.SendError(ctx, "contact_id is required", "", nil)
+		return
+	}
+	_, err := databaseObj.GetContact(contactId)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Contact point %v does not exist", contactId), "", err)
+		return
+	}
+	rawYaml := ctx.PostBody()
+	if len(rawYaml) == 0 {
+		utils.SendError(ctx, "Received empty request", "", nil)
+		return
+	}
+
+	var ruleGroups alertutils.PrometheusRuleGroups
+	err = yaml.Unmarshal(rawYaml, &ruleGroups)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to parse rule file. Error=%v", err), "", err)
+		return
+	}
+	err = validatePrometheusRuleGroups(&ruleGroups)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to import rules. Error=%v", err), "", err)
+		return
+	}
+
+	existing, err := databaseObj.GetAllAlerts(org_id)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to get alerts. Error=%v", err), "", err)
+		return
+	}
+
+	responseBody := make(map[string]interface{})
+	changes, skipped, unsupported := planPrometheusRuleGroups(&ruleGroups, org_id, contactId, existing)
+	if len(unsupported) > 0 {
+		responseBody["message"] = fmt.Sprintf("Failed to import rules, %v alerting rules are not supported", len(unsupported))
+		responseBody["unsupported"] = unsupported
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		utils.WriteJsonResponse(ctx, responseBody)
+		return
+	}
+
+	failed := applyBundleChanges(changes)
+	result := make([]alertutils.BundleChange, 0, len(changes))
+	for _, change := range changes {
+		result = append(result, change.BundleChange)
+	}
+	responseBody["changes"] = result
+	responseBody["skipped"] = skipped
+	if failed > 0 {
+		responseBody["message"] = fmt.Sprintf("Failed to apply %v of %v changes", failed, len(changes))
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+	} else {
+		responseBody["message"] = fmt.Sprintf("Imported %v alerting rules with %v changes", countAlertingRules(&ruleGroups), len(changes))
+		ctx.SetStatusCode(fasthttp.StatusOK)
+	}
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+func countAlertingRules(ruleGroups *alertutils.PrometheusRuleGroups) int {
+	count := 0
+	for _, group := range ruleGroups.Groups {
+		for _, rule := range group.Rules {
+			if rule.Alert != "" {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func validatePrometheusRuleGroups(ruleGroups *alertutils.PrometheusRuleGroups) error {
+	if len(ruleGroups.Groups) == 0 {
+		return errors.New("rule file does not have any groups")
+	}
+	names := make(map[string]struct{}, len(ruleGroups.Groups))
+	for _, group := range ruleGroups.Groups {
+		if group.Name == "" {
+			return errors.New("rule group name is required")
+		}
+		if group.Name == DEFAULT_ALERTING_RULE_GROUP {
+			return fmt.Errorf("rule group name %v is reserved", group.Name)
+		}
+		if _, ok := names[group.Name]; ok {
+			return fmt.Errorf("duplicate group name %v", group.Name)
+		}
+		names[group.Name] = struct{}{}
+
+		_, err := getRuleGroupInterval(&group)
+		if err != nil {
+			return fmt.Errorf("group %v: %v", group.Name, err)
+		}
+	}
+	return nil
+}
+
+func getRuleGroupInterval(group *alertutils.PrometheusRuleGroup) (time.Duration, error) {
+	if group.Interval == "" {
+		return rules.DEFAULT_EVALUATION_INTERVAL, nil
+	}
+	interval, err := model.ParseDuration(group.Interval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval %v, err=%v", group.Interval, err)
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("invalid interval %v", group.Interval)
+	}
+	return time.Duration(interval), nil
+}
+
+/*
+Converts the alerting rules of the groups and plans the creates, updates and
+deletes of their alerts. Returns the changes, the skipped recording rules and
+the alerting rules that could not be converted; no change should be applied
+when there are unsupported rules.
+*/
+func planPrometheusRuleGroups(ruleGroups *alertutils.PrometheusRuleGroups, orgId int64, contactId string,
+	existing []*alertutils.AlertDetails) ([]*plannedChange, []skippedRule, []skippedRule) {
+
+	importedGroups := make(map[string]struct{}, len(ruleGroups.Groups))
+	for _, group := range ruleGroups.Groups {
+		importedGroups[group.Name] = struct{}{}
+	}
+	// The alerts of the imported groups keep their names, the others are taken.
+	takenNames := make(map[string]struct{}, len(existing))
+	groupAlerts := make(map[string]map[string]*alertutils.AlertDetails)
+	for _, alert := range existing {
+		if _, ok := importedGroups[alert.RuleGroup]; !ok {
+			takenNames[alert.AlertName] = struct{}{}
+			continue
+		}
+		if groupAlerts[alert.RuleGroup] == nil {
+			groupAlerts[alert.RuleGroup] = make(map[string]*alertutils.AlertDetails)
+		}
+		groupAlerts[alert.RuleGroup][alert.AlertName] = alert
+	}
+
+	changes := make([]*plannedChange, 0)
+	skipped := make([]skippedRule, 0)
+	unsupported := make([]skippedRule, 0)
+	for i := range ruleGroups.Groups {
+		group := &ruleGroups.Groups[i]
+		current := groupAlerts[group.Name]
+		desiredNames := make(map[string]struct{}, len(group.Rules))
+		for j := range group.Rules {
+			rule := &group.Rules[j]
+			if rule.Alert == "" {
+				skipped = append(skipped, skippedRule{Group: group.Name, Rule: rule.Record,
+					Error: "recording rules are managed with the recording rules API"})
+				continue
+			}
+
+			desired, err := convertPrometheusRule(group, rule, orgId, contactId)
+			if err == nil {
+				_, err = validateAlertTypeAndQuery(desired)
+			}
+			if err != nil {
+				unsupported = append(unsupported, skippedRule{Group: group.Name, Rule: rule.Alert, Error: err.Error()})
+				continue
+			}
+			desired.AlertName = getUniqueAlertName(rule.Alert, group.Name, takenNames)
+			if desired.AlertName != rule.Alert {
+				desired.Labels = append(desired.Labels, alertutils.AlertLabel{LabelName: alertutils.AlertNameLabel, LabelValue: rule.Alert})
+			}
+			takenNames[desired.AlertName] = struct{}{}
+			desiredNames[desired.AlertName] = struct{}{}
+
+			alert, ok := current[desired.AlertName]
+			if !ok {
+				changes = append(changes, newPlannedChange(alertutils.BundleKindAlert, desired.AlertName, alertutils.BundleActionCreate, nil, func() error {
+					return createImportedAlert(desired)
+				}))
+				continue
+			}
+			fields, err := alertutils.GetBundleChangedFields(getImportedAlertFields(alert), getImportedAlertFields(desired))
+			if err != nil {
+				unsupported = append(unsupported, skippedRule{Group: group.Name, Rule: rule.Alert, Error: err.Error()})
+				continue
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			if desired.ContactID == alert.ContactID {
+				desired.ContactName = alert.ContactName
+			}
+			changes = append(changes, newPlannedChange(alertutils.BundleKindAlert, desired.AlertName, alertutils.BundleActionUpdate, fields, func() error {
+				return updateImportedAlert(alert, desired)
+			}))
+		}
+
+		for _, name := range getSortedKeys(current) {
+			if _, ok := desiredNames[name]; ok {
+				continue
+			}
+			alertId := current[name].AlertId
+			changes = append(changes, newPlannedChange(alertutils.BundleKindAlert, name, alertutils.BundleActionDelete, nil, func() error {
+				return removeImportedAlert(alertId)
+			}))
+		}
+	}
+	return changes, skipped, unsupported
+}
+
+// Returns the fields of an imported alert that come from its rule, to compare
+// the stored alert with the converted rule.
+func getImportedAlertFields(alert *alertutils.AlertDetails) map[string]interface{} {
+	labels := make(map[string]string, len(alert.Labels))
+	for _, label := range alert.Labels {
+		labels[label.LabelName] = label.LabelValue
+	}
+	annotations := make(map[string]string, len(alert.Annotations))
+	for name, value := range alert.Annotations {
+		annotations[name] = value
+	}
+	return map[string]interface{}{
+		"contact_id":         alert.ContactID,
+		"labels":             labels,
+		"annotations":        annotations,
+		"condition":          alert.Condition,
+		"value":              alert.Value,
+		"eval_for":           alert.EvalWindow,
+		"eval_interval":      alert.EvalInterval,
+		"message":            alert.Message,
+		"metricsQueryParams": alert.MetricsQueryParamsString,
+	}
+}
+
+// Alert names are unique, while Prometheus rules often share the name of the
+// alert, for example to fire with different severities.
+func getUniqueAlertName(name string, groupName string, takenNames map[string]struct{}) string {
+	if _, ok := takenNames[name]; !ok {
+		return name
+	}
+	base := fmt.Sprintf("%v (%v)", name, groupName)
+	uniqueName := base
+	for i := 2; ; i++ {
+		if _, ok := takenNames[uniqueName]; !ok {
+			return uniqueName
+		}
+		uniqueName = fmt.Sprintf("%v #%v", base, i)
+	}
+}
+
+func createImportedAlert(alert *alertutils.AlertDetails) error {
+	_, err := validateAlertTypeAndQuery(alert)
+	if err != nil {
+		return err
+	}
+	alertDataObj, err := databaseObj.CreateAlert(alert)
+	if err != nil {
+		return err
+	}
+	_, err = AddCronJob(&alertDataObj)
+	return err
+}
+
+func removeImportedAlert(alertId string) error {
+	err := RemoveCronJob(alertId)
+	if err != nil {
+		return err
+	}
+	err = databaseObj.DeleteAlert(alertId)
+	if err != nil {
+		return err
+	}
+	alertDispatcher.removeAlert(alertId)
+	return nil
+}
+
+/*
+Converts an alerting rule into a metrics alert. The alert evaluates every
+interval of the group and fires once the condition held for the duration of
+the for clause, which takes for/interval + 1 evaluations in a row.
+*/
+func convertPrometheusRule(group *alertutils.PrometheusRuleGroup, rule *alertutils.PrometheusRule,
+	orgId int64, contactId string) (*alertutils.AlertDetails, error) {
+
+	if !model.IsValidMetricName(model.LabelValue(rule.Alert)) {
+		return nil, fmt.Errorf("invalid alert name %q", rule.Alert)
+	}
+	for name := range rule.Labels {
+		if !model.LabelName(name).IsValid() || name == alertutils.AlertNameLabel {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	for name := range rule.Annotations {
+		if !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("invalid annotation name %q", name)
+		}
+	}
+
+	query, condition, value, err := parseAlertingExpr(rule.Expr)
+	if err != nil {
+		return nil, err
+	}
+
+	interval, err := getRuleGroupInterval(group)
+	if err != nil {
+		return nil, err
+	}
+	var forDuration time.Duration
+	if rule.For != "" {
+		duration, err := model.ParseDuration(rule.For)
+		if err != nil {
+			return nil, fmt.Errorf("invalid for %v, err=%v", rule.For, err)
+		}
+		forDuration = time.Duration(duration)
+	}
+
+	// Alerts are evaluated every whole number of minutes.
+	evalInterval := uint64(math.Max(1, math.Ceil(interval.Minutes())))
+	forIntervals := uint64(math.Ceil(forDuration.Minutes() / float64(evalInterval)))
+
+	metricsQueryParams, err := json.Marshal(map[string]interface{}{
+		"start": fmt.Sprintf("now-%vm", evalInterval),
+		"end":   "now",
+		"queries": []map[string]interface{}{
+			{"name": "a", "query": query, "qlType": "promql", "state": "raw"},
+		},
+		"formulas": []map[string]interface{}{
+			{"formula": "a"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	labelNames := make([]string, 0, len(rule.Labels))
+	for name := range rule.Labels {
+		labelNames = append(labelNames, name)
+	}
+	sort.Strings(labelNames)
+	labels := make([]alertutils.AlertLabel, 0, len(labelNames))
+	for _, name := range labelNames {
+		labels = append(labels, alertutils.AlertLabel{LabelName: name, LabelValue: rule.Labels[name]})
+	}
+
+	return &alertutils.AlertDetails{
+		AlertConfig: alertutils.AlertConfig{
+			AlertName:    rule.Alert,
+			AlertType:    alertutils.AlertTypeMetrics,
+			ContactID:    contactId,
+			Labels:       labels,
+			Condition:    condition,
+			Value:        value,
+			EvalInterval: evalInterval,
+			EvalWindow:   (forIntervals + 1) * evalInterval,
+			Message:      fmt.Sprintf("%v: %v", rule.Alert, strings.TrimSpace(rule.Expr)),
+			Annotations:  rule.Annotations,
+		},
+		MetricsQueryParamsString: string(metricsQueryParams),
+		OrgId:                    orgId,
+		RuleGroup:                group.Name,
+	}, nil
+}
+
+var comparisonConditions = map[parser.ItemType]alertutils.AlertQueryCondition{
+	parser.GTR:  alertutils.IsAbove,
+	parser.LSS:  alertutils.IsBelow,
+	parser.GTE:  alertutils.IsAboveOrEqualTo,
+	parser.LTE:  alertutils.IsBelowOrEqualTo,
+	parser.EQLC: alertutils.IsEqualTo,
+	parser.NEQ:  alertutils.IsNotEqualTo,
+}
+
+// Comparison operators with their operands swapped, for exprs like 0.9 < query.
+var swappedComparisons = map[parser.ItemType]parser.ItemType{
+	parser.GTR:  parser.LSS,
+	parser.LSS:  parser.GTR,
+	parser.GTE:  parser.LTE,
+	parser.LTE:  parser.GTE,
+	parser.EQLC: parser.EQLC,
+	parser.NEQ:  parser.NEQ,
+}
+
+func unwrapParens(expr parser.Expr) parser.Expr {
+	for {
+		paren, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.Expr
+	}
+}
+
+// Splits the expr of an alerting rule, like: rate(errors[5m]) > 0.1, into the
+// query and the condition of a metrics alert.
+func parseAlertingExpr(expr string) (string, alertutils.AlertQueryCondition, float64, error) {
+	parsed, err := promql.ParsePromQLExpr(expr)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("could not parse expr %q, err=%v", expr, err)
+	}
+
+	binary, ok := unwrapParens(parsed).(*parser.BinaryExpr)
+	if !ok || binary.ReturnBool {
+		return "", 0, 0, fmt.Errorf("expr %q must compare a query with a number", expr)
+	}
+	op := binary.Op
+	query, threshold := binary.LHS, binary.RHS
+	if _, ok := unwrapParens(query).(*parser.NumberLiteral); ok {
+		query, threshold = threshold, query
+		op = swappedComparisons[op]
+	}
+	condition, ok := comparisonConditions[op]
+	number, isNumber := unwrapParens(threshold).(*parser.NumberLiteral)
+	if !ok || !isNumber || query.Type() != parser.ValueTypeVector {
+		return "", 0, 0, fmt.Errorf("expr %q must compare a query with a number", expr)
+	}
+
+	positions := query.PositionRange()
+	return strings.TrimSpace(expr[positions.Start:positions.End]), condition, number.Val, nil
+}
+
+var conditionOperators = map[alertutils.AlertQueryCondition]string{
+	alertutils.IsAbove:          ">",
+	alertutils.IsBelow:          "<",
+	alertutils.IsAboveOrEqualTo: ">=",
+	alertutils.IsBelowOrEqualTo: "<=",
+	alertutils.IsEqualTo:        "==",
+	alertutils.IsNotEqualTo:     "!=",
+}
+
+// Returns the PromQL expr that a metrics alert evaluates, as the expr of an
+// alerting rule.
+func getPrometheusRuleExpr(alert *alertutils.AlertDetails) string {
+	var params struct {
+		Queries []struct {
+			Query string `json:"query"`
+		} `json:"queries"`
+		Formulas []struct {
+			Formula string `json:"formula"`
+		} `json:"formulas"`
+	}
+	err := json.Unmarshal([]byte(alert.MetricsQueryParamsString), &params)
+	if err != nil {
+		log.Errorf("getPrometheusRuleExpr: could not parse the metrics query of alert %v, err=%v", alert.AlertName, err)
+		return ""
+	}
+
+	var query string
+	if len(params.Queries) == 1 {
+		query = params.Queries[0].Query
+	} else if len(params.Formulas) > 0 {
+		query = params.Formulas[0].Formula
+	}
+
+	if alert.Condition == alertutils.HasNoValue {
+		return fmt.Sprintf("absent(%v)", query)
+	}
+	return fmt.Sprintf("%v %v %v", query, conditionOperators[alert.Condition], strconv.FormatFloat(alert.Value, 'f', -1, 64))
+}
+
+func getPrometheusAlertState(state alertutils.AlertState) string {
+	switch state {
+	case alertutils.Firing:
+		return "firing"
+	case alertutils.Pending:
+		return "pending"
+	default:
+		return "inactive"
+	}
+}
+
+/*
+Returns the metrics alerts of the org as alerting rule groups in the format of
+the Prometheus /api/v1/rules API. Imported alerts are in the group they were
+imported from and the other alerts are in the DEFAULT_ALERTING_RULE_GROUP.
+*/
+func GetAlertingRuleGroupStatuses(myid int64) []*rules.RuleGroupStatus {
+	statuses := make([]*rules.RuleGroupStatus, 0)
+	if databaseObj == nil {
+		return statuses
+	}
+	alerts, err := databaseObj.GetAllAlerts(myid)
+	if err != nil {
+		log.Errorf("GetAlertingRuleGroupStatuses: unable to get the alerts of orgid=%v, err=%v", myid, err)
+		return statuses
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].CreateTimestamp.Before(alerts[j].CreateTimestamp)
+	})
+
+	groups := make(map[string]*rules.RuleGroupStatus)
+	for _, alert := range alerts {
+		if alert.AlertType != alertutils.AlertTypeMetrics {
+			continue
+		}
+		groupName := alert.RuleGroup
+		if groupName == "" {
+			groupName = DEFAULT_ALERTING_RULE_GROUP
+		}
+		group, ok := groups[groupName]
+		if !ok {
+			group = &rules.RuleGroupStatus{
+				Name:     groupName,
+				File:     ALERTING_RULES_FILE,
+				Rules:    make([]*rules.RuleStatus, 0),
+				Interval: float64(alert.EvalInterval * 60),
+			}
+			groups[groupName] = group
+			statuses = append(statuses, group)
+		}
+
+		ruleStatus := getAlertingRuleStatus(alert)
+		group.Rules = append(group.Rules, ruleStatus)
+		if ruleStatus.LastEvaluation.After(group.LastEvaluation) {
+			group.LastEvaluation = ruleStatus.LastEvaluation
+		}
+	}
+	return statuses
+}
+
+func getAlertingRuleStatus(alert *alertutils.AlertDetails) *rules.RuleStatus {
+	labels := make(map[string]string, len(alert.Labels))
+	for _, label := range alert.Labels {
+		labels[label.LabelName] = label.LabelValue
+	}
+	name := alert.AlertName
+	if alertName, ok := labels[alertutils.AlertNameLabel]; ok {
+		name = alertName
+		delete(labels, alertutils.AlertNameLabel)
+	}
+
+	status := &rules.RuleStatus{
+		Name:        name,
+		Query:       getPrometheusRuleExpr(alert),
+		Labels:      labels,
+		Health:      rules.HEALTH_OK,
+		Type:        "alerting",
+		Annotations: alert.Annotations,
+		Alerts:      make([]*rules.ActiveAlert, 0),
+		State:       getPrometheusAlertState(alert.State),
+	}
+	if alert.EvalWindow > alert.EvalInterval {
+		status.Duration = float64((alert.EvalWindow - alert.EvalInterval) * 60)
+	}
+	if alert.State == alertutils.Inactive {
+		status.Health = rules.HEALTH_UNKNOWN
+	}
+
+	instances, err := databaseObj.GetAlertInstances(alert.AlertId)
+	if err != nil {
+		log.Errorf("getAlertingRuleStatus: unable to get the instances of alert %v, err=%v", alert.AlertName, err)
+		status.Health = rules.HEALTH_ERR
+		status.LastError = err.Error()
+		return status
+	}
+	for _, instance := range instances {
+		if instance.LastEvaluatedAt.After(status.LastEvaluation) {
+			status.LastEvaluation = instance.LastEvaluatedAt
+		}
+		if !alertutils.IsAlertStatePendingOrFiring(instance.State) {
+			continue
+		}
+		activeAt := instance.ActiveAt
+		annotations := map[string]string(instance.Annotations)
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		status.Alerts = append(status.Alerts, &rules.ActiveAlert{
+			Labels:      alertutils.GetSilenceLabels(alert, instance.Labels),
+			Annotations: annotations,
+			State:       getPrometheusAlertState(instance.State),
+			ActiveAt:    &activeAt,
+			Value:       strconv.FormatFloat(instance.Value, 'e', -1, 64),
+		})
+	}
+	return status
+}
+
+// Returns the pending and firing alerts of the metrics alerts in the format of
+// the Prometheus /api/v1/alerts API.
+func ProcessGetPrometheusAlertsRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	alerts := make([]*rules.ActiveAlert, 0)
+	for _, group := range GetAlertingRuleGroupStatuses(myid) {
+		for _, rule := range group.Rules {
+			alerts = append(alerts, rule.Alerts...)
+		}
+	}
+
+	response := map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"alerts": alerts,
+		},
+	}
+	utils.WriteJsonResponse(ctx, response)
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
@@ -0,0 +1,315 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_ParseAlertingExpr(t *testing.T) {
+	cases := []struct {
+		expr      string
+		query     string
+		condition alertutils.AlertQueryCondition
+		value     float64
+	}{
+		{`up{job="node"} == 0`, `up{job="node"}`, alertutils.IsEqualTo, 0},
+		{`rate(http_errors_total[5m]) / rate(http_requests_total[5m]) > 0.05`, `rate(http_errors_total[5m]) / rate(http_requests_total[5m])`, alertutils.IsAbove, 0.05},
+		{`(node_filesystem_avail_bytes / node_filesystem_size_bytes) <= 0.1`, `(node_filesystem_avail_bytes / node_filesystem_size_bytes)`, alertutils.IsBelowOrEqualTo, 0.1},
+		{`0.9 < sum by (instance) (cpu_usage)`, `sum by (instance) (cpu_usage)`, alertutils.IsAbove, 0.9},
+		{`(temperature >= -5)`, `temperature`, alertutils.IsAboveOrEqualTo, -5},
+		{`queue_size != 1e3`, `queue_size`, alertutils.IsNotEqualTo, 1000},
+	}
+	for _, c := range cases {
+		query, condition, value, err := parseAlertingExpr(c.expr)
+		assert.Nil(t, err, c.expr)
+		assert.Equal(t, c.query, query, c.expr)
+		assert.Equal(t, c.condition, condition, c.expr)
+		assert.Equal(t, c.value, value, c.expr)
+	}
+
+	for _, expr := range []string{
+		`absent(up{job="node"})`,
+		`up > bool 0`,
+		`errors > other_errors`,
+		`a > 1 and b < 2`,
+		`up ==`,
+	} {
+		_, _, _, err := parseAlertingExpr(expr)
+		assert.NotNil(t, err, expr)
+	}
+}
+
+func Test_ConvertPrometheusRule(t *testing.T) {
+	group := &alertutils.PrometheusRuleGroup{Name: "node", Interval: "30s"}
+	rule := &alertutils.PrometheusRule{
+		Alert:       "InstanceDown",
+		Expr:        `up{job="node"} == 0`,
+		For:         "5m",
+		Labels:      map[string]string{"team": "infra", "severity": "critical"},
+		Annotations: map[string]string{"summary": "Instance {{ $labels.instance }} is down"},
+	}
+
+	alert, err := convertPrometheusRule(group, rule, 3, "c1")
+	assert.Nil(t, err)
+	assert.Equal(t, "InstanceDown", alert.AlertName)
+	assert.Equal(t, alertutils.AlertTypeMetrics, alert.AlertType)
+	assert.Equal(t, "c1", alert.ContactID)
+	assert.Equal(t, int64(3), alert.OrgId)
+	assert.Equal(t, "node", alert.RuleGroup)
+	assert.Equal(t, alertutils.IsEqualTo, alert.Condition)
+	assert.Equal(t, float64(0), alert.Value)
+	assert.Equal(t, []alertutils.AlertLabel{{LabelName: "severity", LabelValue: "critical"}, {LabelName: "team", LabelValue: "infra"}}, alert.Labels)
+	assert.Equal(t, alertutils.JSONMap(rule.Annotations), alert.Annotations)
+
+	// the 30s interval is evaluated every minute and fires after 5 more evaluations
+	assert.Equal(t, uint64(1), alert.EvalInterval)
+	assert.Equal(t, uint64(6), alert.EvalWindow)
+
+	var params map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(alert.MetricsQueryParamsString), &params))
+	assert.Equal(t, "now-1m", params["start"])
+	assert.Equal(t, "now", params["end"])
+	query := params["queries"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, `up{job="node"}`, query["query"])
+	assert.Equal(t, "promql", query["qlType"])
+	_, err = validateAlertTypeAndQuery(alert)
+	assert.Nil(t, err)
+
+	assert.Equal(t, `up{job="node"} == 0`, getPrometheusRuleExpr(alert))
+
+	// without for, the alert fires on the first evaluation
+	rule.For = ""
+	group.Interval = "2m"
+	alert, err = convertPrometheusRule(group, rule, 3, "c1")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), alert.EvalInterval)
+	assert.Equal(t, uint64(2), alert.EvalWindow)
+
+	for _, invalid := range []*alertutils.PrometheusRule{
+		{Alert: "Instance Down", Expr: "up == 0"},
+		{Alert: "InstanceDown", Expr: "up == 0", Labels: map[string]string{"alertname": "other"}},
+		{Alert: "InstanceDown", Expr: "up == 0", For: "five minutes"},
+		{Alert: "InstanceDown", Expr: "absent(up)"},
+	} {
+		_, err = convertPrometheusRule(group, invalid, 3, "c1")
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func Test_ValidatePrometheusRuleGroups(t *testing.T) {
+	valid := &alertutils.PrometheusRuleGroups{Groups: []alertutils.PrometheusRuleGroup{{Name: "node", Interval: "1m"}, {Name: "api"}}}
+	assert.Nil(t, validatePrometheusRuleGroups(valid))
+
+	assert.NotNil(t, validatePrometheusRuleGroups(&alertutils.PrometheusRuleGroups{}))
+	assert.NotNil(t, validatePrometheusRuleGroups(&alertutils.PrometheusRuleGroups{Groups: []alertutils.PrometheusRuleGroup{{Name: "node"}, {Name: "node"}}}))
+	assert.NotNil(t, validatePrometheusRuleGroups(&alertutils.PrometheusRuleGroups{Groups: []alertutils.PrometheusRuleGroup{{Name: DEFAULT_ALERTING_RULE_GROUP}}}))
+	assert.NotNil(t, validatePrometheusRuleGroups(&alertutils.PrometheusRuleGroups{Groups: []alertutils.PrometheusRuleGroup{{Name: "node", Interval: "often"}}}))
+}
+
+func Test_GetUniqueAlertName(t *testing.T) {
+	taken := map[string]struct{}{}
+	assert.Equal(t, "HighLatency", getUniqueAlertName("HighLatency", "api", taken))
+
+	taken["HighLatency"] = struct{}{}
+	assert.Equal(t, "HighLatency (api)", getUniqueAlertName("HighLatency", "api", taken))
+
+	taken["HighLatency (api)"] = struct{}{}
+	assert.Equal(t, "HighLatency (api) #2", getUniqueAlertName("HighLatency", "api", taken))
+}
+
+func Test_GetAlertingRuleGroupStatuses(t *testing.T) {
+	mockDB := newMockDatabase()
+	databaseObj = mockDB
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	imported, err := convertPrometheusRule(&alertutils.PrometheusRuleGroup{Name: "node"}, &alertutils.PrometheusRule{
+		Alert:       "InstanceDown",
+		Expr:        "up == 0",
+		For:         "2m",
+		Labels:      map[string]string{"severity": "critical"},
+		Annotations: map[string]string{"summary": "Instance {{ $labels.instance }} is down"},
+	}, 1, "c1")
+	assert.Nil(t, err)
+	imported.AlertId = "a1"
+	imported.AlertName = "InstanceDown (node)"
+	imported.Labels = append(imported.Labels, alertutils.AlertLabel{LabelName: alertutils.AlertNameLabel, LabelValue: "InstanceDown"})
+	imported.State = alertutils.Firing
+	imported.CreateTimestamp = now
+
+	created := &alertutils.AlertDetails{
+		AlertId:                  "a2",
+		AlertConfig:              alertutils.AlertConfig{AlertName: "High CPU", AlertType: alertutils.AlertTypeMetrics, Condition: alertutils.IsAbove, Value: 90, EvalInterval: 5, EvalWindow: 5},
+		MetricsQueryParamsString: `{"queries":[{"name":"a","query":"cpu_usage","qlType":"promql"}],"formulas":[{"formula":"a"}]}`,
+		CreateTimestamp:          now.Add(time.Minute),
+	}
+	logs := &alertutils.AlertDetails{AlertId: "a3", AlertConfig: alertutils.AlertConfig{AlertName: "Errors", AlertType: alertutils.AlertTypeLogs}}
+	mockDB.alerts[1] = []*alertutils.AlertDetails{created, imported, logs}
+
+	mockDB.instances["a1"] = []*alertutils.AlertInstance{
+		{AlertId: "a1", Fingerprint: "f1", Labels: map[string]string{"instance": "web01"}, State: alertutils.Firing, Value: 0,
+			ActiveAt: now, LastEvaluatedAt: now.Add(3 * time.Minute), Annotations: map[string]string{"summary": "Instance web01 is down"}},
+		{AlertId: "a1", Fingerprint: "f2", Labels: map[string]string{"instance": "web02"}, State: alertutils.Normal, LastEvaluatedAt: now},
+	}
+
+	groups := GetAlertingRuleGroupStatuses(1)
+	assert.Equal(t, 2, len(groups))
+	assert.Equal(t, "node", groups[0].Name)
+	assert.Equal(t, float64(60), groups[0].Interval)
+	assert.Equal(t, now.Add(3*time.Minute), groups[0].LastEvaluation)
+
+	rule := groups[0].Rules[0]
+	assert.Equal(t, "InstanceDown", rule.Name)
+	assert.Equal(t, "up == 0", rule.Query)
+	assert.Equal(t, float64(120), rule.Duration)
+	assert.Equal(t, map[string]string{"severity": "critical"}, rule.Labels)
+	assert.Equal(t, "alerting", rule.Type)
+	assert.Equal(t, "firing", rule.State)
+	assert.Equal(t, 1, len(rule.Alerts))
+	assert.Equal(t, map[string]string{"alertname": "InstanceDown", "severity": "critical", "instance": "web01"}, rule.Alerts[0].Labels)
+	assert.Equal(t, "Instance web01 is down", rule.Alerts[0].Annotations["summary"])
+	assert.Equal(t, "firing", rule.Alerts[0].State)
+
+	assert.Equal(t, DEFAULT_ALERTING_RULE_GROUP, groups[1].Name)
+	assert.Equal(t, "High CPU", groups[1].Rules[0].Name)
+	assert.Equal(t, "cpu_usage > 90", groups[1].Rules[0].Query)
+	assert.Equal(t, float64(0), groups[1].Rules[0].Duration)
+	assert.Equal(t, "inactive", groups[1].Rules[0].State)
+
+	ctx := &fasthttp.RequestCtx{}
+	ProcessGetPrometheusAlertsRequest(ctx, 1)
+	var response struct {
+		Status string `json:"status"`
+		Data   struct {
+			Alerts []struct {
+				Labels map[string]string `json:"labels"`
+				State  string            `json:"state"`
+				Value  string            `json:"value"`
+			} `json:"alerts"`
+		} `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(ctx.Response.Body(), &response))
+	assert.Equal(t, "success", response.Status)
+	assert.Equal(t, 1, len(response.Data.Alerts))
+	assert.Equal(t, "web01", response.Data.Alerts[0].Labels["instance"])
+	assert.Equal(t, "0e+00", response.Data.Alerts[0].Value)
+}
+
+func importTestRules(t *testing.T, contactId string, ruleFile string) (int, map[string]json.RawMessage) {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.QueryArgs().Set("contact_id", contactId)
+	ctx.Request.SetBody([]byte(ruleFile))
+	ProcessImportPrometheusRulesRequest(ctx, 0)
+
+	var response map[string]json.RawMessage
+	assert.Nil(t, json.Unmarshal(ctx.Response.Body(), &response), string(ctx.Response.Body()))
+	return ctx.Response.StatusCode(), response
+}
+
+func Test_ImportPrometheusRules(t *testing.T) {
+	p := setupBundleTest(t)
+	contact := &alertutils.Contact{ContactName: "oncall", Webhook: []alertutils.WebHookConfig{{Webhook: "https://hooks.example.com/oncall"}}}
+	assert.Nil(t, p.CreateContact(contact))
+
+	ruleFile := `
+groups:
+  - name: node
+    rules:
+      - alert: InstanceDown
+        expr: up == 0
+        for: 5m
+      - alert: HighLoad
+        expr: node_load1 > 4
+      - record: job:up:sum
+        expr: sum by (job) (up)
+`
+	status, response := importTestRules(t, contact.ContactId, ruleFile)
+	assert.Equal(t, fasthttp.StatusOK, status)
+	var changes []alertutils.BundleChange
+	assert.Nil(t, json.Unmarshal(response["changes"], &changes))
+	assert.Equal(t, []string{"create alert InstanceDown", "create alert HighLoad"}, getChangeActions(changes))
+	var skipped []skippedRule
+	assert.Nil(t, json.Unmarshal(response["skipped"], &skipped))
+	assert.Equal(t, []skippedRule{{Group: "node", Rule: "job:up:sum", Error: "recording rules are managed with the recording rules API"}}, skipped)
+
+	alerts, err := p.GetAllAlerts(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(alerts))
+	alertIds := make(map[string]string)
+	for _, alert := range alerts {
+		alertIds[alert.AlertName] = alert.AlertId
+	}
+	instance := &alertutils.AlertInstance{AlertId: alertIds["InstanceDown"], Fingerprint: "f1", State: alertutils.Firing}
+	assert.Nil(t, p.UpdateAlertInstances(alertIds["InstanceDown"], []*alertutils.AlertInstance{instance}, nil))
+
+	// importing the same rules again changes nothing
+	status, response = importTestRules(t, contact.ContactId, ruleFile)
+	assert.Equal(t, fasthttp.StatusOK, status)
+	assert.Nil(t, json.Unmarshal(response["changes"], &changes))
+	assert.Equal(t, 0, len(changes))
+
+	// an unsupported rule rejects the whole file
+	status, response = importTestRules(t, contact.ContactId, `
+groups:
+  - name: node
+    rules:
+      - alert: InstanceDown
+        expr: up == 0
+        for: 10m
+      - alert: NodeMissing
+        expr: absent(up{job="node"})
+`)
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+	var unsupported []skippedRule
+	assert.Nil(t, json.Unmarshal(response["unsupported"], &unsupported))
+	assert.Equal(t, 1, len(unsupported))
+	assert.Equal(t, "NodeMissing", unsupported[0].Rule)
+	alerts, err = p.GetAllAlerts(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(alerts))
+
+	// the alerts are updated in place and the removed rules deleted
+	status, response = importTestRules(t, contact.ContactId, `
+groups:
+  - name: node
+    rules:
+      - alert: InstanceDown
+        expr: up == 0
+        for: 10m
+`)
+	assert.Equal(t, fasthttp.StatusOK, status)
+	assert.Nil(t, json.Unmarshal(response["changes"], &changes))
+	assert.Equal(t, []string{"update alert InstanceDown", "delete alert HighLoad"}, getChangeActions(changes))
+	assert.Equal(t, []string{"eval_for"}, changes[0].Fields)
+
+	alerts, err = p.GetAllAlerts(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(alerts))
+	assert.Equal(t, alertIds["InstanceDown"], alerts[0].AlertId)
+	assert.Equal(t, uint64(11), alerts[0].EvalWindow)
+	assert.Equal(t, "oncall", alerts[0].ContactName)
+	instances, err := p.GetAlertInstances(alertIds["InstanceDown"])
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(instances))
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/siglens/siglens/pkg/utils"
+	"github.com/valyala/fasthttp"
+)
+
+func ProcessGetNotificationRoutingRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	routing, err := databaseObj.GetNotificationRouting(org_id)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to get notification routing. Error=%v", err), "", err)
+		return
+	}
+
+	responseBody := make(map[string]interface{})
+	responseBody["routing"] = routing
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+// Replaces the routing tree and the inhibition rules of the org. The pending
+// notification groups of the org are dropped.
+func ProcessUpdateNotificationRoutingRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	rawJSON := ctx.PostBody()
+	if len(rawJSON) == 0 {
+		utils.SendError(ctx, "Received empty request", "", nil)
+		return
+	}
+	var routing alertutils.NotificationRouting
+	if err := json.Unmarshal(rawJSON, &routing); err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to unmarshal json. Error=%v", err), "", err)
+		return
+	}
+	if err := routing.Validate(); err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Invalid notification routing. Error=%v", err), "", err)
+		return
+	}
+
+	routing.OrgId = org_id
+	err := databaseObj.UpdateNotificationRouting(&routing)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to update notification routing. Error=%v", err), "", err)
+		return
+	}
+	alertDispatcher.resetOrg(org_id)
+
+	responseBody := make(map[string]interface{})
+	responseBody["message"] = "Successfully updated the notification routing"
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+// Removes the notification routing of the org, so alerts notify their own
+// contact point again.
+func ProcessDeleteNotificationRoutingRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	err := databaseObj.DeleteNotificationRouting(org_id)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to delete notification routing. Error=%v", err), "", err)
+		return
+	}
+	alertDispatcher.resetOrg(org_id)
+
+	responseBody := make(map[string]interface{})
+	responseBody["message"] = "Notification routing deleted successfully"
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
@@ -0,0 +1,251 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/siglens/siglens/pkg/utils"
+	"github.com/valyala/fasthttp"
+)
+
+func ProcessCreateSilenceRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	silence, ok := parseSilence(ctx)
+	if !ok {
+		return
+	}
+	silence.OrgId = org_id
+	err := databaseObj.CreateSilence(silence)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to create silence. Error=%v", err), "", err)
+		return
+	}
+
+	responseBody := make(map[string]interface{})
+	responseBody["message"] = "Successfully created a silence"
+	responseBody["silence_id"] = silence.SilenceId
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+func ProcessGetAllSilencesRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	silences, err := databaseObj.GetAllSilences(org_id)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to get silences. Error=%v", err), "", err)
+		return
+	}
+	now := time.Now().UTC()
+	for _, silence := range silences {
+		silence.Status = silence.GetStatus(now)
+	}
+
+	responseBody := make(map[string]interface{})
+	responseBody["silences"] = silences
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+func ProcessUpdateSilenceRequest(ctx *fasthttp.RequestCtx) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	silence, ok := parseSilence(ctx)
+	if !ok {
+		return
+	}
+	err := databaseObj.UpdateSilence(silence)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to update silence. Error=%v", err), fmt.Sprintf("silence ID: %v", silence.SilenceId), err)
+		return
+	}
+
+	responseBody := make(map[string]interface{})
+	responseBody["message"] = "Successfully updated the silence"
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+// request body should contain silence_id only
+func ProcessDeleteSilenceRequest(ctx *fasthttp.RequestCtx) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	var silence alertutils.Silence
+	if err := json.Unmarshal(ctx.PostBody(), &silence); err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to unmarshal json. Error=%v", err), "", err)
+		return
+	}
+	err := databaseObj.DeleteSilence(silence.SilenceId)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to delete silence. Error=%v", err), fmt.Sprintf("silence ID: %v", silence.SilenceId), err)
+		return
+	}
+
+	responseBody := make(map[string]interface{})
+	responseBody["message"] = "Silence deleted successfully"
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+// Parses and validates the silence in the request body. The silence starts
+// now when no start time is given.
+func parseSilence(ctx *fasthttp.RequestCtx) (*alertutils.Silence, bool) {
+	rawJSON := ctx.PostBody()
+	if len(rawJSON) == 0 {
+		utils.SendError(ctx, "Received empty request", "", nil)
+		return nil, false
+	}
+
+	var silence alertutils.Silence
+	if err := json.Unmarshal(rawJSON, &silence); err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to unmarshal json. Error=%v", err), "", err)
+		return nil, false
+	}
+	if silence.StartsAt.IsZero() {
+		silence.StartsAt = time.Now().UTC()
+	}
+	if err := silence.Validate(); err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Invalid silence. Error=%v", err), "", err)
+		return nil, false
+	}
+	return &silence, true
+}
+
+func ProcessCreateMaintenanceWindowRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	window, ok := parseMaintenanceWindow(ctx)
+	if !ok {
+		return
+	}
+	window.OrgId = org_id
+	err := databaseObj.CreateMaintenanceWindow(window)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to create maintenance window. Error=%v", err), fmt.Sprintf("name: %v", window.Name), err)
+		return
+	}
+
+	responseBody := make(map[string]interface{})
+	responseBody["message"] = "Successfully created a maintenance window"
+	responseBody["window_id"] = window.WindowId
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+func ProcessGetAllMaintenanceWindowsRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	windows, err := databaseObj.GetAllMaintenanceWindows(org_id)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to get maintenance windows. Error=%v", err), "", err)
+		return
+	}
+
+	responseBody := make(map[string]interface{})
+	responseBody["maintenance_windows"] = windows
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+func ProcessUpdateMaintenanceWindowRequest(ctx *fasthttp.RequestCtx) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	window, ok := parseMaintenanceWindow(ctx)
+	if !ok {
+		return
+	}
+	err := databaseObj.UpdateMaintenanceWindow(window)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to update maintenance window. Error=%v", err), fmt.Sprintf("window ID: %v", window.WindowId), err)
+		return
+	}
+
+	responseBody := make(map[string]interface{})
+	responseBody["message"] = "Successfully updated the maintenance window"
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+// request body should contain window_id only
+func ProcessDeleteMaintenanceWindowRequest(ctx *fasthttp.RequestCtx) {
+	if databaseObj == nil {
+		utils.SendError(ctx, invalidDatabaseProvider, "", nil)
+		return
+	}
+
+	var window alertutils.MaintenanceWindow
+	if err := json.Unmarshal(ctx.PostBody(), &window); err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to unmarshal json. Error=%v", err), "", err)
+		return
+	}
+	err := databaseObj.DeleteMaintenanceWindow(window.WindowId)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to delete maintenance window. Error=%v", err), fmt.Sprintf("window ID: %v", window.WindowId), err)
+		return
+	}
+
+	responseBody := make(map[string]interface{})
+	responseBody["message"] = "Maintenance window deleted successfully"
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+func parseMaintenanceWindow(ctx *fasthttp.RequestCtx) (*alertutils.MaintenanceWindow, bool) {
+	rawJSON := ctx.PostBody()
+	if len(rawJSON) == 0 {
+		utils.SendError(ctx, "Received empty request", "", nil)
+		return nil, false
+	}
+
+	var window alertutils.MaintenanceWindow
+	if err := json.Unmarshal(rawJSON, &window); err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to unmarshal json. Error=%v", err), "", err)
+		return nil, false
+	}
+	if err := window.Validate(); err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Invalid maintenance window. Error=%v", err), fmt.Sprintf("name: %v", window.Name), err)
+		return nil, false
+	}
+	return &window, true
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/siglens/siglens/pkg/ast/pipesearch"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/integrations/prometheus/promql"
+	rutils "github.com/siglens/siglens/pkg/readerUtils"
+	"github.com/siglens/siglens/pkg/utils"
+	"github.com/valyala/fasthttp"
+)
+
+type previewTemplateRequest struct {
+	Template alertutils.NotificationTemplate `json:"template"`
+	AlertId  string                          `json:"alert_id,omitempty"`
+}
+
+/*
+Renders a notification template without saving it. With an alert_id, the
+template is given the alert, its current instances and the current result of
+its query; otherwise it is given sample data.
+*/
+func ProcessPreviewNotificationTemplateRequest(ctx *fasthttp.RequestCtx, org_id int64) {
+	var request previewTemplateRequest
+	err := json.Unmarshal(ctx.PostBody(), &request)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to unmarshal json. Error=%v", err), "", err)
+		return
+	}
+
+	data := getSampleTemplateData()
+	if request.AlertId != "" {
+		data, err = getPreviewTemplateData(request.AlertId, org_id)
+		if err != nil {
+			utils.SendError(ctx, fmt.Sprintf("Failed to get the data of the alert. Error=%v", err), fmt.Sprintf("alert ID: %v", request.AlertId), err)
+			return
+		}
+	}
+
+	title, body, err := request.Template.Render(data)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Failed to render the template. Error=%v", err), "", err)
+		return
+	}
+
+	responseBody := make(map[string]interface{})
+	responseBody["title"] = title
+	responseBody["body"] = body
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, responseBody)
+}
+
+func getSampleTemplateData() *alertutils.NotificationTemplateData {
+	data := &alertutils.NotificationTemplateData{
+		AlertId:        "sample-alert",
+		AlertName:      "High CPU usage",
+		State:          "firing",
+		Title:          "High CPU usage",
+		Message:        "CPU usage is above 90",
+		Labels:         map[string]string{alertutils.AlertNameLabel: "High CPU usage", "severity": "critical"},
+		Condition:      alertutils.GetConditionDescription(alertutils.IsAbove, 90),
+		Threshold:      90,
+		QueryLanguage:  "Splunk QL",
+		QueryText:      "* | stats avg(cpu) AS cpu BY host",
+		Link:           config.GetQueryServerBaseUrl() + "/index.html",
+		NumEvaluations: 12,
+		Results: []map[string]interface{}{
+			{"host": "web01", "cpu": 97.5},
+			{"host": "web02", "cpu": 42.0},
+		},
+	}
+	data.SetInstances([]*alertutils.AlertInstance{
+		{Fingerprint: "sample-web01", Labels: map[string]string{"host": "web01"}, Value: 97.5, State: alertutils.Firing,
+			Annotations: map[string]string{alertutils.SummaryAnnotation: "CPU of web01 is 97.5%"}},
+		{Fingerprint: "sample-web02", Labels: map[string]string{"host": "web02"}, Value: 42, State: alertutils.Normal},
+	})
+	return data
+}
+
+// Returns the template data that a notification of the alert would get now.
+func getPreviewTemplateData(alertId string, orgId int64) (*alertutils.NotificationTemplateData, error) {
+	if databaseObj == nil {
+		return nil, fmt.Errorf("%v", invalidDatabaseProvider)
+	}
+	alert, err := databaseObj.GetAlert(alertId)
+	if err != nil {
+		return nil, err
+	}
+	if alert.OrgId != orgId {
+		return nil, fmt.Errorf("alert %v does not exist", alertId)
+	}
+	instances, err := databaseObj.GetAlertInstances(alertId)
+	if err != nil {
+		return nil, err
+	}
+	link, results, err := runAlertQuery(alert)
+	if err != nil {
+		return nil, err
+	}
+
+	data := getAlertTemplateData(alert, results)
+	data.Title = alert.AlertName
+	data.Message = alert.Message
+	if _, message, _, err := databaseObj.GetContactDetails(alertId); err == nil {
+		data.Message = message
+	}
+	data.State = alertutils.GetStateName(getAggregateAlertState(instances))
+	data.Link = link
+	data.NumEvaluations = alert.NumEvaluationsCount
+	data.SetInstances(instances)
+	return data, nil
+}
+
+// Runs the query of the alert. Returns the link to its results and their
+// first rows.
+func runAlertQuery(alert *alertutils.AlertDetails) (string, []map[string]interface{}, error) {
+	switch alert.AlertType {
+	case alertutils.AlertTypeLogs:
+		searchResponse, timeRange, err := pipesearch.ProcessAlertsPipeSearchRequest(alert.QueryParams, alert.OrgId, nil)
+		if err != nil {
+			return "", nil, err
+		}
+		return getLogsQueryLinkForTheAlert(alert, timeRange), getLogsQueryResultRows(searchResponse, NOTIFICATION_RESULT_ROWS), nil
+	case alertutils.AlertTypeMetrics:
+		start, end, queries, formulas, _, parsedJsonMap, err := promql.ParseMetricTimeSeriesRequest([]byte(alert.MetricsQueryParamsString))
+		if err != nil {
+			return "", nil, err
+		}
+		queryRes, _, _, _, err := promql.ProcessMetricsQueryRequest(queries, formulas, start, end, alert.OrgId, rutils.GetNextQid())
+		if err != nil {
+			return "", nil, err
+		}
+		parsedJsonMap["start"] = start
+		parsedJsonMap["end"] = end
+		return getMetricsQueryLinkForTheAlert(alert, parsedJsonMap), getMetricsQueryResultRows(queryRes, NOTIFICATION_RESULT_ROWS), nil
+	}
+	return "", nil, fmt.Errorf("alerts of type %v have no query to preview", alert.AlertType)
+}
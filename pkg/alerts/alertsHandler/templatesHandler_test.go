@@ -0,0 +1,123 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertsHandler
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/siglens/siglens/pkg/alerts/alertutils"
+	"github.com/siglens/siglens/pkg/segment/results/mresults"
+	"github.com/siglens/siglens/pkg/segment/structs"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_sendToContactPointTemplates(t *testing.T) {
+	server, getRequests := newIntegrationServer(t)
+
+	mockDB := newMockDatabase()
+	databaseObj = mockDB
+	contact := &alertutils.Contact{
+		ContactName: "oncall",
+		Teams:       []alertutils.TeamsConfig{{WebhookUrl: server.URL + "/teams"}},
+		Webhook:     []alertutils.WebHookConfig{{Webhook: server.URL + "/webhook"}},
+		Templates: map[string]alertutils.NotificationTemplate{
+			alertutils.TeamsContactType: {
+				Title: "{{ .AlertName }} {{ .Condition }}",
+				Body:  "{{ range .Results }}{{ .host }}: {{ .cpu }}\n{{ end }}",
+			},
+			alertutils.WebhookContactType: {Title: "{{ .Labels.missing.value }}"},
+		},
+	}
+	assert.Nil(t, mockDB.CreateContact(contact))
+
+	alert := &alertutils.AlertDetails{AlertId: "a1", AlertConfig: alertutils.AlertConfig{AlertName: "High CPU", Value: 90}}
+	results := []map[string]interface{}{{"host": "web01", "cpu": 97}}
+	sent, err := sendToContactPoint(contact.ContactId, "High CPU", "CPU is high", alertutils.Firing, "", 1, getTestInstances(),
+		getAlertTemplateData(alert, results))
+	assert.Nil(t, err)
+	assert.True(t, sent)
+
+	requests := getRequests()
+	assert.Equal(t, 2, len(requests))
+	for _, request := range requests {
+		switch request.path {
+		case "/teams":
+			card := request.body["attachments"].([]interface{})[0].(map[string]interface{})["content"].(map[string]interface{})
+			body := card["body"].([]interface{})
+			assert.Equal(t, "High CPU is above 90", body[0].(map[string]interface{})["text"])
+			assert.Equal(t, "web01: 97", body[1].(map[string]interface{})["text"])
+		case "/webhook":
+			// a template that fails to execute sends the defaults
+			assert.Equal(t, "High CPU", request.body["Title"])
+			assert.Equal(t, "CPU is high", request.body["Body"])
+		default:
+			t.Errorf("unexpected request to %v", request.path)
+		}
+	}
+}
+
+func Test_ProcessPreviewNotificationTemplateRequest(t *testing.T) {
+	preview := func(body string) (int, map[string]interface{}) {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetBody([]byte(body))
+		ProcessPreviewNotificationTemplateRequest(ctx, 0)
+		response := make(map[string]interface{})
+		assert.Nil(t, json.Unmarshal(ctx.Response.Body(), &response))
+		return ctx.Response.StatusCode(), response
+	}
+
+	status, response := preview(`{"template": {"title": "[{{ .State | upper }}] {{ .AlertName }}",
+		"body": "{{ range .Firing }}{{ formatLabels .Labels }} {{ .Annotations.summary }}{{ end }}"}}`)
+	assert.Equal(t, fasthttp.StatusOK, status)
+	assert.Equal(t, "[FIRING] High CPU usage", response["title"])
+	assert.Equal(t, "host=web01 CPU of web01 is 97.5%", response["body"])
+
+	status, _ = preview(`{"template": {"title": "{{ .AlertName"}}`)
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+	status, _ = preview(`{"template": {"body": "{{ .NoSuchField }}"}}`)
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+}
+
+func Test_getQueryResultRows(t *testing.T) {
+	searchResponse := &structs.PipeSearchResponseOuter{
+		GroupByCols: []string{"host"},
+		MeasureResults: []*structs.BucketHolder{
+			{GroupByValues: []string{"web01"}, MeasureVal: map[string]interface{}{"avg(cpu)": 97}},
+			{GroupByValues: []string{"web02"}, MeasureVal: map[string]interface{}{"avg(cpu)": 42}},
+		},
+	}
+	rows := getLogsQueryResultRows(searchResponse, 1)
+	assert.Equal(t, []map[string]interface{}{{"host": "web01", "avg(cpu)": 97}}, rows)
+
+	searchResponse = &structs.PipeSearchResponseOuter{
+		MeasureAggregationCols: []string{"count"},
+		Hits:                   structs.PipeSearchResponse{Hits: []map[string]interface{}{{"count": 3}, {"count": 5}}},
+	}
+	assert.Equal(t, 2, len(getLogsQueryResultRows(searchResponse, 10)))
+	assert.Nil(t, getLogsQueryResultRows(nil, 10))
+
+	queryRes := &mresults.MetricsResult{Results: map[string]map[uint32]float64{
+		"cpu{host:web01": {10: 1, 20: 2},
+	}}
+	rows = getMetricsQueryResultRows(queryRes, 10)
+	assert.Equal(t, 1, len(rows))
+	assert.Equal(t, 2.0, rows[0]["value"])
+	assert.Equal(t, "web01", rows[0]["host"])
+}
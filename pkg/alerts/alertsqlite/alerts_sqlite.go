@@ -80,6 +80,12 @@ func (p *Sqlite) Connect() error {
 
 	p.SetDB(dbConnection)
 
+	err = migrateAlertLabels(dbConnection)
+	if err != nil {
+		log.Errorf("Connect: unable to migrate alert labels, Error=%+v", err)
+		return err
+	}
+
 	err = dbConnection.AutoMigrate(&alertutils.AlertDetails{})
 	if err != nil {
 		return err
@@ -112,10 +118,128 @@ func (p *Sqlite) Connect() error {
 	if err != nil {
 		return err
 	}
+	err = dbConnection.AutoMigrate(&alertutils.AlertInstance{})
+	if err != nil {
+		return err
+	}
+	err = dbConnection.AutoMigrate(&alertutils.Silence{})
+	if err != nil {
+		return err
+	}
+	err = dbConnection.AutoMigrate(&alertutils.MaintenanceWindow{})
+	if err != nil {
+		return err
+	}
+	err = dbConnection.AutoMigrate(&alertutils.NotificationRouting{})
+	if err != nil {
+		return err
+	}
+	err = dbConnection.AutoMigrate(&alertutils.AlertLease{})
+	if err != nil {
+		return err
+	}
+	err = dbConnection.AutoMigrate(&alertutils.NotificationLogEntry{})
+	if err != nil {
+		return err
+	}
+	err = dbConnection.AutoMigrate(&alertutils.NotificationDelivery{})
+	if err != nil {
+		return err
+	}
+	err = dbConnection.AutoMigrate(&alertutils.NotificationDeliveryAttempt{})
+	if err != nil {
+		return err
+	}
+	err = dbConnection.AutoMigrate(&alertutils.OpenIncident{})
+	if err != nil {
+		return err
+	}
 	p.ctx = context.Background()
 	return nil
 }
 
+type labelAlertRow struct {
+	AlertDetailsAlertId string
+	MinionSearchAlertId string
+	LabelName           string
+	LabelValue          string
+}
+
+/*
+Labels used to be identified by their name only, so all the alerts with a label
+shared the value of the alert that created it first. Labels are now identified
+by their name and value. Rebuilds the label tables of databases created before,
+keeping the labels of every alert.
+*/
+func migrateAlertLabels(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&alertutils.AlertLabel{}) {
+		return nil
+	}
+	columnTypes, err := migrator.ColumnTypes(&alertutils.AlertLabel{})
+	if err != nil {
+		return fmt.Errorf("migrateAlertLabels: unable to get the columns of alert_labels, err=%v", err)
+	}
+	for _, columnType := range columnTypes {
+		if columnType.Name() != "label_value" {
+			continue
+		}
+		if isPrimaryKey, ok := columnType.PrimaryKey(); ok && isPrimaryKey {
+			return nil
+		}
+	}
+
+	rows := make([]labelAlertRow, 0)
+	if migrator.HasTable("label_alerts") {
+		alertColumn, minionColumn := "''", "''"
+		if migrator.HasColumn("label_alerts", "alert_details_alert_id") {
+			alertColumn = "IFNULL(la.alert_details_alert_id, '')"
+		}
+		if migrator.HasColumn("label_alerts", "minion_search_alert_id") {
+			minionColumn = "IFNULL(la.minion_search_alert_id, '')"
+		}
+		err = db.Raw("SELECT " + alertColumn + " AS alert_details_alert_id, " + minionColumn + " AS minion_search_alert_id, " +
+			"la.alert_label_label_name AS label_name, IFNULL(l.label_value, '') AS label_value " +
+			"FROM label_alerts la JOIN alert_labels l ON l.label_name = la.alert_label_label_name").Scan(&rows).Error
+		if err != nil {
+			return fmt.Errorf("migrateAlertLabels: unable to read the labels of the alerts, err=%v", err)
+		}
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Migrator().DropTable("label_alerts", &alertutils.AlertLabel{})
+		if err != nil {
+			return fmt.Errorf("migrateAlertLabels: unable to drop the label tables, err=%v", err)
+		}
+		// One model at a time, so the join table has the columns of both alerts and minion searches.
+		for _, model := range []interface{}{&alertutils.AlertDetails{}, &alertutils.AlertLabel{}, &alertutils.MinionSearch{}} {
+			err = tx.AutoMigrate(model)
+			if err != nil {
+				return fmt.Errorf("migrateAlertLabels: unable to create the label tables, err=%v", err)
+			}
+		}
+		for _, row := range rows {
+			label := alertutils.AlertLabel{LabelName: row.LabelName, LabelValue: row.LabelValue}
+			err = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&label).Error
+			if err != nil {
+				return fmt.Errorf("migrateAlertLabels: unable to create label %v, err=%v", row.LabelName, err)
+			}
+			if row.AlertDetailsAlertId != "" {
+				err = tx.Exec("INSERT INTO label_alerts (alert_details_alert_id, alert_label_label_name, alert_label_label_value) VALUES (?, ?, ?)",
+					row.AlertDetailsAlertId, row.LabelName, row.LabelValue).Error
+			} else if row.MinionSearchAlertId != "" {
+				err = tx.Exec("INSERT INTO label_alerts (minion_search_alert_id, alert_label_label_name, alert_label_label_value) VALUES (?, ?, ?)",
+					row.MinionSearchAlertId, row.LabelName, row.LabelValue).Error
+			}
+			if err != nil {
+				return fmt.Errorf("migrateAlertLabels: unable to add label %v, err=%v", row.LabelName, err)
+			}
+		}
+		log.Infof("migrateAlertLabels: migrated %v alert labels", len(rows))
+		return nil
+	})
+}
+
 func isValid(str string) bool {
 	return str != "" && str != "*"
 }
@@ -475,6 +599,13 @@ func (p Sqlite) DeleteAlert(alert_id string) error {
 		return err
 	}
 
+	err = p.db.Where("alert_id = ?", alert_id).Delete(&alertutils.AlertInstance{}).Error
+	if err != nil {
+		err := fmt.Errorf("DeleteAlert: unable to delete the instances of alert, Alert Name=%v, Error=%v", alert.AlertName, err)
+		log.Error(err.Error())
+		return err
+	}
+
 	return nil
 }
 
@@ -529,21 +660,19 @@ func (p Sqlite) UpdateContactPoint(contact *alertutils.Contact) error {
 		return err
 	}
 
-	if len(contact.Slack) != 0 {
-		err := p.db.Model(&alertutils.Contact{ContactId: contact.ContactId}).Association("Slack").Clear()
-		if err != nil {
-			err = fmt.Errorf("UpdateContactPoint: unable to update contact : %v, Error=%+v", contact.ContactName, err)
-			log.Error(err.Error())
-			return err
-		}
+	// The contact replaces the existing one, so Slack channels and webhooks it
+	// does not have anymore are removed.
+	err = p.db.Model(&alertutils.Contact{ContactId: contact.ContactId}).Association("Slack").Clear()
+	if err != nil {
+		err = fmt.Errorf("UpdateContactPoint: unable to update contact : %v, Error=%+v", contact.ContactName, err)
+		log.Error(err.Error())
+		return err
 	}
-	if len(contact.Webhook) != 0 {
-		err := p.db.Model(&alertutils.Contact{ContactId: contact.ContactId}).Association("Webhook").Clear()
-		if err != nil {
-			err = fmt.Errorf("UpdateContactPoint: unable to update contact: %v, Error=%+v", contact.ContactName, err)
-			log.Error(err.Error())
-			return err
-		}
+	err = p.db.Model(&alertutils.Contact{ContactId: contact.ContactId}).Association("Webhook").Clear()
+	if err != nil {
+		err = fmt.Errorf("UpdateContactPoint: unable to update contact: %v, Error=%+v", contact.ContactName, err)
+		log.Error(err.Error())
+		return err
 	}
 	result := p.db.Session(&gorm.Session{FullSaveAssociations: true}).Save(&contact)
 	if result.Error != nil && result.RowsAffected != 1 {
@@ -620,21 +749,8 @@ func resolveTemplate(template string, alertName string, condition alertutils.Ale
 
 	message := strings.ReplaceAll(template, "{{alert_rule_name}}", alertName)
 	message = strings.ReplaceAll(message, "{{query_string}}", queryText)
-	switch condition {
-	case alertutils.IsAbove:
-		val := "is above " + fmt.Sprintf("%1.0f", value)
-		message = strings.ReplaceAll(message, "{{condition}}", val)
-	case alertutils.IsBelow:
-		val := "is below " + fmt.Sprintf("%1.0f", value)
-		message = strings.ReplaceAll(message, "{{condition}}", val)
-	case alertutils.IsEqualTo:
-		val := "is equal to " + fmt.Sprintf("%1.0f", value)
-		message = strings.ReplaceAll(message, "{{condition}}", val)
-	case alertutils.IsNotEqualTo:
-		val := "is not equal to " + fmt.Sprintf("%1.0f", value)
-		message = strings.ReplaceAll(message, "{{condition}}", val)
-	case alertutils.HasNoValue:
-		message = strings.ReplaceAll(message, "{{condition}}", "has no value")
+	if description := alertutils.GetConditionDescription(condition, value); description != "" {
+		message = strings.ReplaceAll(message, "{{condition}}", description)
 	}
 	message = strings.ReplaceAll(message, "{{queryLanguage}}", queryLanguage)
 
@@ -784,19 +900,14 @@ func (p Sqlite) UpdateAlertStateAndNotificationDetails(alert_id string, alertSta
 	return nil
 }
 
-func (p Sqlite) GetEmailAndChannelID(contact_id string) ([]string, []alertutils.SlackTokenConfig, []alertutils.WebHookConfig, error) {
-
+func (p Sqlite) GetContact(contact_id string) (*alertutils.Contact, error) {
 	var contact = &alertutils.Contact{}
 	if err := p.db.Preload("Slack").Preload("Webhook").Where("contact_id = ?", contact_id).First(contact).Error; err != nil {
-		err = fmt.Errorf("GetEmailAndChannelID: unable to update contact, contact id: %v, Error=%+v", contact_id, err)
+		err = fmt.Errorf("GetContact: unable to get contact, contact id: %v, Error=%+v", contact_id, err)
 		log.Error(err.Error())
-		return nil, nil, nil, err
+		return nil, err
 	}
-	emailArray := contact.Email
-	slackArray := contact.Slack
-	webhookArray := contact.Webhook
-
-	return emailArray, slackArray, webhookArray, nil
+	return contact, nil
 }
 
 func (p Sqlite) GetAllMinionSearches(orgId int64) ([]alertutils.MinionSearch, error) {
@@ -937,7 +1048,11 @@ func (p Sqlite) GetAlertHistoryByAlertID(alertHistoryParams *alertutils.AlertHis
 
 	alertHistory := make([]*alertutils.AlertHistoryDetails, 0)
 
-	query := p.db.Where("alert_id = ?", alertHistoryParams.AlertId).Order(
+	query := p.db.Where("alert_id = ?", alertHistoryParams.AlertId)
+	if alertHistoryParams.Fingerprint != "" {
+		query = query.Where("fingerprint = ?", alertHistoryParams.Fingerprint)
+	}
+	query = query.Order(
 		clause.OrderByColumn{Column: clause.Column{Name: clause.PrimaryColumn.Name}, Desc: alertHistoryParams.SortOrder == alertutils.DESC}).Offset(int(alertHistoryParams.Offset)).Limit(int(alertHistoryParams.Limit))
 
 	err = query.Find(&alertHistory).Error
@@ -949,3 +1064,478 @@ func (p Sqlite) GetAlertHistoryByAlertID(alertHistoryParams *alertutils.AlertHis
 
 	return alertHistory, nil
 }
+
+func (p Sqlite) GetAlertInstances(alert_id string) ([]*alertutils.AlertInstance, error) {
+	if !isValid(alert_id) {
+		err := fmt.Errorf("GetAlertInstances: Data Validation Check Failed: AlertId=%v is not valid", alert_id)
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	instances := make([]*alertutils.AlertInstance, 0)
+	err := p.db.Where("alert_id = ?", alert_id).Order("fingerprint").Find(&instances).Error
+	if err != nil {
+		err = fmt.Errorf("GetAlertInstances: unable to fetch alert instances, AlertId=%v, Error=%+v", alert_id, err)
+		log.Error(err.Error())
+		return nil, err
+	}
+	return instances, nil
+}
+
+// Saves the changed instances of the alert and deletes the ones with the
+// given fingerprints, in one transaction.
+func (p Sqlite) UpdateAlertInstances(alert_id string, instances []*alertutils.AlertInstance, deletedFingerprints []string) error {
+	if !isValid(alert_id) {
+		err := fmt.Errorf("UpdateAlertInstances: Data Validation Check Failed: AlertId=%v is not valid", alert_id)
+		log.Error(err.Error())
+		return err
+	}
+
+	err := retry(func(attemptCount int) error {
+		return p.db.Transaction(func(tx *gorm.DB) error {
+			if len(instances) > 0 {
+				if err := tx.Save(instances).Error; err != nil {
+					return err
+				}
+			}
+			if len(deletedFingerprints) > 0 {
+				err := tx.Where("alert_id = ? AND fingerprint IN ?", alert_id, deletedFingerprints).Delete(&alertutils.AlertInstance{}).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		err = fmt.Errorf("UpdateAlertInstances: unable to update alert instances, AlertId=%v, Error=%+v", alert_id, err)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (p Sqlite) CreateSilence(silence *alertutils.Silence) error {
+	silence.SilenceId = CreateUniqId()
+	result := p.db.Create(silence)
+	if result.Error != nil && result.RowsAffected != 1 {
+		err := fmt.Errorf("CreateSilence: unable to create silence, Error=%v", result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (p Sqlite) GetSilence(silence_id string) (*alertutils.Silence, error) {
+	if !isValid(silence_id) {
+		err := fmt.Errorf("GetSilence: Data Validation Check Failed: SilenceId=%v is not valid", silence_id)
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	var silence alertutils.Silence
+	if err := p.db.Where("silence_id = ?", silence_id).First(&silence).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("GetSilence: silence: %v does not exist", silence_id)
+		}
+		err = fmt.Errorf("GetSilence: unable to fetch silence: %v, Error=%v", silence_id, err)
+		log.Error(err.Error())
+		return nil, err
+	}
+	return &silence, nil
+}
+
+func (p Sqlite) GetAllSilences(org_id int64) ([]*alertutils.Silence, error) {
+	silences := make([]*alertutils.Silence, 0)
+	err := p.db.Where("org_id = ?", org_id).Order("starts_at").Find(&silences).Error
+	if err != nil {
+		err = fmt.Errorf("GetAllSilences: unable to fetch silences, OrgId=%v, Error=%v", org_id, err)
+		log.Error(err.Error())
+		return nil, err
+	}
+	return silences, nil
+}
+
+func (p Sqlite) UpdateSilence(silence *alertutils.Silence) error {
+	existing, err := p.GetSilence(silence.SilenceId)
+	if err != nil {
+		return err
+	}
+	silence.OrgId = existing.OrgId
+	silence.CreatedAt = existing.CreatedAt
+	result := p.db.Save(silence)
+	if result.Error != nil && result.RowsAffected != 1 {
+		err := fmt.Errorf("UpdateSilence: unable to update silence: %v, Error=%v", silence.SilenceId, result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (p Sqlite) DeleteSilence(silence_id string) error {
+	if _, err := p.GetSilence(silence_id); err != nil {
+		return err
+	}
+	result := p.db.Where("silence_id = ?", silence_id).Delete(&alertutils.Silence{})
+	if result.Error != nil && result.RowsAffected != 1 {
+		err := fmt.Errorf("DeleteSilence: unable to delete silence: %v, Error=%v", silence_id, result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (p Sqlite) CreateMaintenanceWindow(window *alertutils.MaintenanceWindow) error {
+	window.WindowId = CreateUniqId()
+	result := p.db.Create(window)
+	if result.Error != nil && result.RowsAffected != 1 {
+		err := fmt.Errorf("CreateMaintenanceWindow: unable to create maintenance window: %v, Error=%v", window.Name, result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (p Sqlite) GetMaintenanceWindow(window_id string) (*alertutils.MaintenanceWindow, error) {
+	if !isValid(window_id) {
+		err := fmt.Errorf("GetMaintenanceWindow: Data Validation Check Failed: WindowId=%v is not valid", window_id)
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	var window alertutils.MaintenanceWindow
+	if err := p.db.Where("window_id = ?", window_id).First(&window).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("GetMaintenanceWindow: maintenance window: %v does not exist", window_id)
+		}
+		err = fmt.Errorf("GetMaintenanceWindow: unable to fetch maintenance window: %v, Error=%v", window_id, err)
+		log.Error(err.Error())
+		return nil, err
+	}
+	return &window, nil
+}
+
+func (p Sqlite) GetAllMaintenanceWindows(org_id int64) ([]*alertutils.MaintenanceWindow, error) {
+	windows := make([]*alertutils.MaintenanceWindow, 0)
+	err := p.db.Where("org_id = ?", org_id).Order("name").Find(&windows).Error
+	if err != nil {
+		err = fmt.Errorf("GetAllMaintenanceWindows: unable to fetch maintenance windows, OrgId=%v, Error=%v", org_id, err)
+		log.Error(err.Error())
+		return nil, err
+	}
+	return windows, nil
+}
+
+func (p Sqlite) UpdateMaintenanceWindow(window *alertutils.MaintenanceWindow) error {
+	existing, err := p.GetMaintenanceWindow(window.WindowId)
+	if err != nil {
+		return err
+	}
+	window.OrgId = existing.OrgId
+	window.CreatedAt = existing.CreatedAt
+	result := p.db.Save(window)
+	if result.Error != nil && result.RowsAffected != 1 {
+		err := fmt.Errorf("UpdateMaintenanceWindow: unable to update maintenance window: %v, Error=%v", window.Name, result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (p Sqlite) DeleteMaintenanceWindow(window_id string) error {
+	if _, err := p.GetMaintenanceWindow(window_id); err != nil {
+		return err
+	}
+	result := p.db.Where("window_id = ?", window_id).Delete(&alertutils.MaintenanceWindow{})
+	if result.Error != nil && result.RowsAffected != 1 {
+		err := fmt.Errorf("DeleteMaintenanceWindow: unable to delete maintenance window: %v, Error=%v", window_id, result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+// Returns nil when the org has no notification routing.
+func (p Sqlite) GetNotificationRouting(org_id int64) (*alertutils.NotificationRouting, error) {
+	var routing alertutils.NotificationRouting
+	if err := p.db.Where("org_id = ?", org_id).First(&routing).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		err = fmt.Errorf("GetNotificationRouting: unable to fetch notification routing, OrgId=%v, Error=%v", org_id, err)
+		log.Error(err.Error())
+		return nil, err
+	}
+	return &routing, nil
+}
+
+func (p Sqlite) UpdateNotificationRouting(routing *alertutils.NotificationRouting) error {
+	result := p.db.Save(routing)
+	if result.Error != nil {
+		err := fmt.Errorf("UpdateNotificationRouting: unable to update notification routing, OrgId=%v, Error=%v", routing.OrgId, result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (p Sqlite) DeleteNotificationRouting(org_id int64) error {
+	result := p.db.Where("org_id = ?", org_id).Delete(&alertutils.NotificationRouting{})
+	if result.Error != nil {
+		err := fmt.Errorf("DeleteNotificationRouting: unable to delete notification routing, OrgId=%v, Error=%v", org_id, result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+/*
+Acquires or renews the lease for the holder until now+ttl. The lease is only
+taken when it is free, expired or already held by the holder; both statements
+are atomic, so of the nodes sharing the database at most one holds the lease.
+Returns whether the holder holds the lease, and the current lease.
+*/
+func (p Sqlite) AcquireLease(name string, holder string, ttl time.Duration, now time.Time) (bool, *alertutils.AlertLease, error) {
+	nowMs := now.UnixMilli()
+	expiresAtMs := now.Add(ttl).UnixMilli()
+	result := p.db.Model(&alertutils.AlertLease{}).
+		Where("name = ? AND (holder = ? OR expires_at_ms <= ?)", name, holder, nowMs).
+		Updates(map[string]interface{}{
+			"term":          gorm.Expr("CASE WHEN holder = ? THEN term ELSE term + 1 END", holder),
+			"acquired_at":   gorm.Expr("CASE WHEN holder = ? THEN acquired_at ELSE ? END", holder, nowMs),
+			"holder":        holder,
+			"renewed_at":    nowMs,
+			"expires_at_ms": expiresAtMs,
+		})
+	if result.Error != nil {
+		err := fmt.Errorf("AcquireLease: unable to renew lease: %v, holder: %v, Error=%v", name, holder, result.Error)
+		log.Error(err.Error())
+		return false, nil, err
+	}
+	if result.RowsAffected == 0 {
+		lease := alertutils.AlertLease{
+			Name:        name,
+			Holder:      holder,
+			Term:        1,
+			AcquiredAt:  nowMs,
+			RenewedAt:   nowMs,
+			ExpiresAtMs: expiresAtMs,
+		}
+		result = p.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&lease)
+		if result.Error != nil {
+			err := fmt.Errorf("AcquireLease: unable to create lease: %v, holder: %v, Error=%v", name, holder, result.Error)
+			log.Error(err.Error())
+			return false, nil, err
+		}
+	}
+
+	lease, err := p.GetLease(name)
+	if err != nil {
+		return false, nil, err
+	}
+	return lease.IsHeldBy(holder, now), lease, nil
+}
+
+// Returns nil when the lease was never acquired.
+func (p Sqlite) GetLease(name string) (*alertutils.AlertLease, error) {
+	var lease alertutils.AlertLease
+	if err := p.db.Where("name = ?", name).First(&lease).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		err = fmt.Errorf("GetLease: unable to fetch lease: %v, Error=%v", name, err)
+		log.Error(err.Error())
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// Expires the lease if the holder holds it, so another node can take it over
+// without waiting for it to expire.
+func (p Sqlite) ReleaseLease(name string, holder string) error {
+	result := p.db.Model(&alertutils.AlertLease{}).
+		Where("name = ? AND holder = ?", name, holder).
+		Update("expires_at_ms", 0)
+	if result.Error != nil {
+		err := fmt.Errorf("ReleaseLease: unable to release lease: %v, holder: %v, Error=%v", name, holder, result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+// Returns nil when the group has no notification in the log.
+func (p Sqlite) GetNotificationLogEntry(group_key string) (*alertutils.NotificationLogEntry, error) {
+	var entry alertutils.NotificationLogEntry
+	if err := p.db.Where("group_key = ?", group_key).First(&entry).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		err = fmt.Errorf("GetNotificationLogEntry: unable to fetch notification log of group: %v, Error=%v", group_key, err)
+		log.Error(err.Error())
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (p Sqlite) UpdateNotificationLogEntry(entry *alertutils.NotificationLogEntry) error {
+	result := p.db.Save(entry)
+	if result.Error != nil {
+		err := fmt.Errorf("UpdateNotificationLogEntry: unable to update notification log of group: %v, Error=%v", entry.GroupKey, result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (p Sqlite) DeleteNotificationLogEntry(group_key string) error {
+	result := p.db.Where("group_key = ?", group_key).Delete(&alertutils.NotificationLogEntry{})
+	if result.Error != nil {
+		err := fmt.Errorf("DeleteNotificationLogEntry: unable to delete notification log of group: %v, Error=%v", group_key, result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (p Sqlite) CreateNotificationDelivery(delivery *alertutils.NotificationDelivery) error {
+	delivery.DeliveryId = CreateUniqId()
+	result := p.db.Create(delivery)
+	if result.Error != nil {
+		err := fmt.Errorf("CreateNotificationDelivery: unable to create delivery to contact: %v, Error=%v", delivery.ContactId, result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+// Returns nil when the delivery is not in the queue.
+func (p Sqlite) GetNotificationDelivery(delivery_id string) (*alertutils.NotificationDelivery, error) {
+	var delivery alertutils.NotificationDelivery
+	if err := p.db.Where("delivery_id = ?", delivery_id).First(&delivery).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		err = fmt.Errorf("GetNotificationDelivery: unable to fetch delivery: %v, Error=%v", delivery_id, err)
+		log.Error(err.Error())
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// Returns the pending deliveries whose next attempt is due, the oldest first.
+func (p Sqlite) GetDueNotificationDeliveries(now time.Time, limit int) ([]*alertutils.NotificationDelivery, error) {
+	deliveries := make([]*alertutils.NotificationDelivery, 0)
+	err := p.db.Where("status = ? AND next_attempt_at_ms <= ?", alertutils.DeliveryPending, now.UnixMilli()).
+		Order("next_attempt_at_ms").Limit(limit).Find(&deliveries).Error
+	if err != nil {
+		err = fmt.Errorf("GetDueNotificationDeliveries: unable to fetch due deliveries, Error=%v", err)
+		log.Error(err.Error())
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Returns the deliveries of the org with the status, the newest first.
+func (p Sqlite) GetNotificationDeliveries(org_id int64, status alertutils.DeliveryStatus) ([]*alertutils.NotificationDelivery, error) {
+	deliveries := make([]*alertutils.NotificationDelivery, 0)
+	err := p.db.Where("org_id = ? AND status = ?", org_id, status).Order("created_at DESC").Find(&deliveries).Error
+	if err != nil {
+		err = fmt.Errorf("GetNotificationDeliveries: unable to fetch %v deliveries, OrgId=%v, Error=%v", status, org_id, err)
+		log.Error(err.Error())
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (p Sqlite) UpdateNotificationDelivery(delivery *alertutils.NotificationDelivery) error {
+	result := p.db.Save(delivery)
+	if result.Error != nil {
+		err := fmt.Errorf("UpdateNotificationDelivery: unable to update delivery: %v, Error=%v", delivery.DeliveryId, result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (p Sqlite) DeleteNotificationDelivery(delivery_id string) error {
+	result := p.db.Where("delivery_id = ?", delivery_id).Delete(&alertutils.NotificationDelivery{})
+	if result.Error != nil {
+		err := fmt.Errorf("DeleteNotificationDelivery: unable to delete delivery: %v, Error=%v", delivery_id, result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (p Sqlite) AddNotificationDeliveryAttempt(attempt *alertutils.NotificationDeliveryAttempt) error {
+	result := p.db.Create(attempt)
+	if result.Error != nil {
+		err := fmt.Errorf("AddNotificationDeliveryAttempt: unable to log attempt of delivery: %v, Error=%v", attempt.DeliveryId, result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+// Returns the last attempts of deliveries to the contact point, the newest first.
+func (p Sqlite) GetNotificationDeliveryAttempts(contact_id string, limit int) ([]*alertutils.NotificationDeliveryAttempt, error) {
+	attempts := make([]*alertutils.NotificationDeliveryAttempt, 0)
+	err := p.db.Where("contact_id = ?", contact_id).Order("id DESC").Limit(limit).Find(&attempts).Error
+	if err != nil {
+		err = fmt.Errorf("GetNotificationDeliveryAttempts: unable to fetch delivery log of contact: %v, Error=%v", contact_id, err)
+		log.Error(err.Error())
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// Deletes all but the last attempts of the delivery log.
+func (p Sqlite) PruneNotificationDeliveryAttempts(keep int) error {
+	oldest := p.db.Model(&alertutils.NotificationDeliveryAttempt{}).Select("id").Order("id DESC").Limit(1).Offset(keep)
+	result := p.db.Where("id <= (?)", oldest).Delete(&alertutils.NotificationDeliveryAttempt{})
+	if result.Error != nil {
+		err := fmt.Errorf("PruneNotificationDeliveryAttempts: unable to prune the delivery log, Error=%v", result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (p Sqlite) AddOpenIncidents(incidents []*alertutils.OpenIncident) error {
+	if len(incidents) == 0 {
+		return nil
+	}
+	result := p.db.Save(incidents)
+	if result.Error != nil {
+		err := fmt.Errorf("AddOpenIncidents: unable to save open incidents of contact: %v, Error=%v", incidents[0].ContactId, result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+// Returns the open incidents of the alerts at the integrations of one type of the contact point.
+func (p Sqlite) GetOpenIncidents(contact_id string, contact_type string, alert_ids []string) ([]*alertutils.OpenIncident, error) {
+	incidents := make([]*alertutils.OpenIncident, 0)
+	if len(alert_ids) == 0 {
+		return incidents, nil
+	}
+	err := p.db.Where("contact_id = ? AND contact_type = ? AND alert_id IN ?", contact_id, contact_type, alert_ids).Find(&incidents).Error
+	if err != nil {
+		err = fmt.Errorf("GetOpenIncidents: unable to fetch open incidents of contact: %v, Error=%v", contact_id, err)
+		log.Error(err.Error())
+		return nil, err
+	}
+	return incidents, nil
+}
+
+func (p Sqlite) DeleteOpenIncident(contact_id string, contact_type string, dedup_key string) error {
+	result := p.db.Where("contact_id = ? AND contact_type = ? AND dedup_key = ?", contact_id, contact_type, dedup_key).Delete(&alertutils.OpenIncident{})
+	if result.Error != nil {
+		err := fmt.Errorf("DeleteOpenIncident: unable to delete open incident: %v of contact: %v, Error=%v", dedup_key, contact_id, result.Error)
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
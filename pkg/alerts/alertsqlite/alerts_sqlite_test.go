@@ -18,10 +18,14 @@
 package alertsqlite
 
 import (
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/siglens/siglens/pkg/alerts/alertutils"
 	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 )
 
 func Test_resolveTemplate(t *testing.T) {
@@ -42,3 +46,388 @@ func Test_resolveTemplate(t *testing.T) {
 	actual = resolveTemplate("static message", "alert5", alertutils.IsAbove, 42, "Splunk QL", "* | stats count")
 	assert.Equal(t, "static message", actual)
 }
+
+func Test_AlertInstances(t *testing.T) {
+	dbConnection, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "siglens.db")), &gorm.Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, dbConnection.AutoMigrate(&alertutils.AlertDetails{}, &alertutils.AlertHistoryDetails{}, &alertutils.AlertInstance{}))
+	p := &Sqlite{}
+	p.SetDB(dbConnection)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	web01 := &alertutils.AlertInstance{AlertId: "a1", Fingerprint: "f1", Labels: map[string]string{"host": "web01"}, State: alertutils.Pending, ActiveAt: now}
+	web02 := &alertutils.AlertInstance{AlertId: "a1", Fingerprint: "f2", Labels: map[string]string{"host": "web02"}, State: alertutils.Firing, Value: 97}
+	assert.Nil(t, p.UpdateAlertInstances("a1", []*alertutils.AlertInstance{web01, web02}, nil))
+
+	web01.State = alertutils.Firing
+	assert.Nil(t, p.UpdateAlertInstances("a1", []*alertutils.AlertInstance{web01}, []string{"f2"}))
+
+	instances, err := p.GetAlertInstances("a1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(instances))
+	assert.Equal(t, alertutils.Firing, instances[0].State)
+	assert.Equal(t, alertutils.JSONMap{"host": "web01"}, instances[0].Labels)
+	assert.True(t, now.Equal(instances[0].ActiveAt))
+
+	// history of an instance is filtered by its fingerprint
+	assert.Nil(t, dbConnection.Create(&alertutils.AlertDetails{AlertId: "a1", AlertConfig: alertutils.AlertConfig{AlertName: "alert1"}}).Error)
+	_, err = p.CreateAlertHistory(&alertutils.AlertHistoryDetails{AlertId: "a1", EventDescription: alertutils.AlertFiring, UserName: alertutils.SystemGeneratedAlert})
+	assert.Nil(t, err)
+	_, err = p.CreateAlertHistory(&alertutils.AlertHistoryDetails{AlertId: "a1", EventDescription: alertutils.AlertFiring, UserName: alertutils.SystemGeneratedAlert,
+		Fingerprint: "f1", Labels: map[string]string{"host": "web01"}})
+	assert.Nil(t, err)
+	history, err := p.GetAlertHistoryByAlertID(&alertutils.AlertHistoryQueryParams{AlertId: "a1", Fingerprint: "f1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(history))
+	assert.Equal(t, alertutils.JSONMap{"host": "web01"}, history[0].Labels)
+	history, err = p.GetAlertHistoryByAlertID(&alertutils.AlertHistoryQueryParams{AlertId: "a1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(history))
+}
+
+func Test_SilencesAndMaintenanceWindows(t *testing.T) {
+	dbConnection, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "siglens.db")), &gorm.Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, dbConnection.AutoMigrate(&alertutils.Silence{}, &alertutils.MaintenanceWindow{}))
+	p := &Sqlite{}
+	p.SetDB(dbConnection)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	silence := &alertutils.Silence{
+		Matchers:  alertutils.SilenceMatchers{{Name: "host", Value: "web.*", Type: alertutils.MatchRegexp}},
+		StartsAt:  now,
+		EndsAt:    now.Add(time.Hour),
+		CreatedBy: "admin",
+		Comment:   "deploying web servers",
+		OrgId:     1,
+	}
+	assert.Nil(t, p.CreateSilence(silence))
+	assert.NotEqual(t, "", silence.SilenceId)
+
+	silences, err := p.GetAllSilences(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(silences))
+	assert.Equal(t, "deploying web servers", silences[0].Comment)
+	assert.True(t, silences[0].Matchers.Matches(map[string]string{"host": "web01"}))
+	silences, err = p.GetAllSilences(2)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(silences))
+
+	silence.EndsAt = now.Add(2 * time.Hour)
+	silence.OrgId = 0
+	assert.Nil(t, p.UpdateSilence(silence))
+	updated, err := p.GetSilence(silence.SilenceId)
+	assert.Nil(t, err)
+	assert.True(t, now.Add(2*time.Hour).Equal(updated.EndsAt))
+	assert.Equal(t, int64(1), updated.OrgId)
+
+	assert.Nil(t, p.DeleteSilence(silence.SilenceId))
+	assert.NotNil(t, p.DeleteSilence(silence.SilenceId))
+
+	window := &alertutils.MaintenanceWindow{
+		Name:            "weekly patching",
+		Matchers:        alertutils.SilenceMatchers{{Name: "env", Value: "prod"}},
+		Schedule:        "0 2 * * SAT",
+		DurationMinutes: 120,
+		OrgId:           1,
+	}
+	assert.Nil(t, p.CreateMaintenanceWindow(window))
+	window.DurationMinutes = 60
+	assert.Nil(t, p.UpdateMaintenanceWindow(window))
+	windows, err := p.GetAllMaintenanceWindows(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(windows))
+	assert.Equal(t, uint64(60), windows[0].DurationMinutes)
+	assert.Equal(t, "0 2 * * SAT", windows[0].Schedule)
+
+	assert.Nil(t, p.DeleteMaintenanceWindow(window.WindowId))
+	windows, err = p.GetAllMaintenanceWindows(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(windows))
+}
+
+func Test_NotificationRouting(t *testing.T) {
+	dbConnection, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "siglens.db")), &gorm.Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, dbConnection.AutoMigrate(&alertutils.NotificationRouting{}))
+	p := &Sqlite{}
+	p.SetDB(dbConnection)
+
+	routing, err := p.GetNotificationRouting(1)
+	assert.Nil(t, err)
+	assert.Nil(t, routing)
+
+	routing = &alertutils.NotificationRouting{
+		OrgId: 1,
+		Route: alertutils.NotificationRoute{
+			ContactID: "c1",
+			GroupBy:   []string{"alertname"},
+			Routes: []*alertutils.NotificationRoute{
+				{Matchers: alertutils.SilenceMatchers{{Name: "team", Value: "db"}}, ContactID: "c2"},
+			},
+		},
+		InhibitRules: []*alertutils.InhibitRule{{
+			SourceMatchers: alertutils.SilenceMatchers{{Name: "alertname", Value: "node_down"}},
+			TargetMatchers: alertutils.SilenceMatchers{{Name: "alertname", Value: "service_down"}},
+			Equal:          []string{"host"},
+		}},
+	}
+	assert.Nil(t, p.UpdateNotificationRouting(routing))
+	routing.Route.ContactID = "c3"
+	assert.Nil(t, p.UpdateNotificationRouting(routing))
+
+	stored, err := p.GetNotificationRouting(1)
+	assert.Nil(t, err)
+	assert.Equal(t, "c3", stored.Route.ContactID)
+	assert.Equal(t, "c2", stored.Route.Routes[0].ContactID)
+	assert.Equal(t, []string{"host"}, stored.InhibitRules[0].Equal)
+	assert.Equal(t, "c2", stored.Match(map[string]string{"team": "db"})[0].ContactID)
+
+	assert.Nil(t, p.DeleteNotificationRouting(1))
+	stored, err = p.GetNotificationRouting(1)
+	assert.Nil(t, err)
+	assert.Nil(t, stored)
+}
+
+func Test_GetContact(t *testing.T) {
+	dbConnection, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "siglens.db")), &gorm.Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, dbConnection.AutoMigrate(&alertutils.Contact{}, &alertutils.SlackTokenConfig{}, &alertutils.WebHookConfig{}))
+	p := &Sqlite{}
+	p.SetDB(dbConnection)
+
+	contact := &alertutils.Contact{
+		ContactName: "oncall",
+		PagerDuty:   "routing-key",
+		Opsgenie:    []alertutils.OpsgenieConfig{{ApiKey: "genie-key", Priority: "P1"}},
+		Teams:       []alertutils.TeamsConfig{{WebhookUrl: "https://example.webhook.office.com/webhook"}},
+		Webhook:     []alertutils.WebHookConfig{{Webhook: "https://example.com/hook"}},
+	}
+	assert.Nil(t, p.CreateContact(contact))
+
+	stored, err := p.GetContact(contact.ContactId)
+	assert.Nil(t, err)
+	assert.Equal(t, "routing-key", stored.PagerDuty)
+	assert.Equal(t, contact.Opsgenie, stored.Opsgenie)
+	assert.Equal(t, contact.Teams, stored.Teams)
+	assert.Equal(t, "https://example.com/hook", stored.Webhook[0].Webhook)
+
+	_, err = p.GetContact("missing")
+	assert.NotNil(t, err)
+}
+
+func Test_AlertLabels(t *testing.T) {
+	dbConnection, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "siglens.db")), &gorm.Config{})
+	assert.Nil(t, err)
+
+	// tables of a database created when labels were identified by their name only
+	assert.Nil(t, dbConnection.AutoMigrate(&alertutils.Contact{}, &alertutils.Notification{}))
+	assert.Nil(t, dbConnection.Exec("CREATE TABLE `alert_labels` (`label_name` text NOT NULL,`label_value` text,PRIMARY KEY (`label_name`))").Error)
+	assert.Nil(t, dbConnection.Exec("CREATE TABLE `label_alerts` (`alert_details_alert_id` text,`alert_label_label_name` text NOT NULL,`minion_search_alert_id` text,"+
+		"PRIMARY KEY (`alert_details_alert_id`,`alert_label_label_name`))").Error)
+	assert.Nil(t, dbConnection.Exec("INSERT INTO alert_labels VALUES ('team', 'db')").Error)
+	assert.Nil(t, dbConnection.Exec("INSERT INTO label_alerts (alert_details_alert_id, alert_label_label_name) VALUES ('a1', 'team')").Error)
+
+	assert.Nil(t, migrateAlertLabels(dbConnection))
+	assert.Nil(t, migrateAlertLabels(dbConnection)) // already migrated
+	p := &Sqlite{}
+	p.SetDB(dbConnection)
+
+	assert.Nil(t, dbConnection.Create(&alertutils.AlertDetails{AlertId: "a1", AlertConfig: alertutils.AlertConfig{AlertName: "alert1"}}).Error)
+	assert.Nil(t, p.CreateContact(&alertutils.Contact{ContactName: "oncall"}))
+	contacts, err := p.GetAllContactPoints(0)
+	assert.Nil(t, err)
+
+	for _, severity := range []string{"critical", "warning"} {
+		_, err = p.CreateAlert(&alertutils.AlertDetails{AlertConfig: alertutils.AlertConfig{
+			AlertName: "HighLatency " + severity,
+			ContactID: contacts[0].ContactId,
+			Labels:    []alertutils.AlertLabel{{LabelName: "severity", LabelValue: severity}, {LabelName: "team", LabelValue: "db"}},
+		}})
+		assert.Nil(t, err)
+	}
+
+	alerts, err := p.GetAllAlerts(0)
+	assert.Nil(t, err)
+	labels := make(map[string][]alertutils.AlertLabel)
+	for _, alert := range alerts {
+		labels[alert.AlertName] = alert.Labels
+	}
+	assert.Equal(t, []alertutils.AlertLabel{{LabelName: "team", LabelValue: "db"}}, labels["alert1"])
+	assert.ElementsMatch(t, []alertutils.AlertLabel{{LabelName: "severity", LabelValue: "critical"}, {LabelName: "team", LabelValue: "db"}}, labels["HighLatency critical"])
+	assert.ElementsMatch(t, []alertutils.AlertLabel{{LabelName: "severity", LabelValue: "warning"}, {LabelName: "team", LabelValue: "db"}}, labels["HighLatency warning"])
+}
+
+func Test_AlertLease(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "siglens.db")
+	nodes := make([]*Sqlite, 2)
+	for i := range nodes {
+		dbConnection, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+		assert.Nil(t, err)
+		assert.Nil(t, dbConnection.AutoMigrate(&alertutils.AlertLease{}))
+		nodes[i] = &Sqlite{}
+		nodes[i].SetDB(dbConnection)
+	}
+	ttl := 30 * time.Second
+	now := time.Now().UTC()
+
+	lease, err := nodes[0].GetLease(alertutils.ALERT_EVALUATION_LEASE)
+	assert.Nil(t, err)
+	assert.Nil(t, lease)
+
+	acquired, lease, err := nodes[0].AcquireLease(alertutils.ALERT_EVALUATION_LEASE, "node1", ttl, now)
+	assert.Nil(t, err)
+	assert.True(t, acquired)
+	assert.Equal(t, uint64(1), lease.Term)
+
+	// the lease is held until it expires
+	acquired, lease, err = nodes[1].AcquireLease(alertutils.ALERT_EVALUATION_LEASE, "node2", ttl, now.Add(10*time.Second))
+	assert.Nil(t, err)
+	assert.False(t, acquired)
+	assert.Equal(t, "node1", lease.Holder)
+
+	// renewing keeps the term
+	acquired, lease, err = nodes[0].AcquireLease(alertutils.ALERT_EVALUATION_LEASE, "node1", ttl, now.Add(20*time.Second))
+	assert.Nil(t, err)
+	assert.True(t, acquired)
+	assert.Equal(t, uint64(1), lease.Term)
+	assert.Equal(t, now.Add(50*time.Second).UnixMilli(), lease.ExpiresAtMs)
+
+	// another node takes the expired lease over
+	acquired, lease, err = nodes[1].AcquireLease(alertutils.ALERT_EVALUATION_LEASE, "node2", ttl, now.Add(50*time.Second))
+	assert.Nil(t, err)
+	assert.True(t, acquired)
+	assert.Equal(t, uint64(2), lease.Term)
+	assert.Equal(t, now.Add(50*time.Second).UnixMilli(), lease.AcquiredAt)
+
+	acquired, _, err = nodes[0].AcquireLease(alertutils.ALERT_EVALUATION_LEASE, "node1", ttl, now.Add(60*time.Second))
+	assert.Nil(t, err)
+	assert.False(t, acquired)
+
+	// only the holder can release the lease
+	assert.Nil(t, nodes[0].ReleaseLease(alertutils.ALERT_EVALUATION_LEASE, "node1"))
+	acquired, _, err = nodes[0].AcquireLease(alertutils.ALERT_EVALUATION_LEASE, "node1", ttl, now.Add(61*time.Second))
+	assert.Nil(t, err)
+	assert.False(t, acquired)
+
+	assert.Nil(t, nodes[1].ReleaseLease(alertutils.ALERT_EVALUATION_LEASE, "node2"))
+	acquired, lease, err = nodes[0].AcquireLease(alertutils.ALERT_EVALUATION_LEASE, "node1", ttl, now.Add(62*time.Second))
+	assert.Nil(t, err)
+	assert.True(t, acquired)
+	assert.Equal(t, uint64(3), lease.Term)
+}
+
+func Test_NotificationLog(t *testing.T) {
+	dbConnection, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "siglens.db")), &gorm.Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, dbConnection.AutoMigrate(&alertutils.NotificationLogEntry{}))
+	p := &Sqlite{}
+	p.SetDB(dbConnection)
+
+	entry, err := p.GetNotificationLogEntry("1/0/c1/f1")
+	assert.Nil(t, err)
+	assert.Nil(t, entry)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	assert.Nil(t, p.UpdateNotificationLogEntry(&alertutils.NotificationLogEntry{GroupKey: "1/0/c1/f1", OrgId: 1, LastNotified: now, Firing: []string{"a1/f2"}}))
+	entry, err = p.GetNotificationLogEntry("1/0/c1/f1")
+	assert.Nil(t, err)
+	assert.True(t, now.Equal(entry.LastNotified))
+	assert.Equal(t, []string{"a1/f2"}, entry.Firing)
+
+	assert.Nil(t, p.DeleteNotificationLogEntry("1/0/c1/f1"))
+	entry, err = p.GetNotificationLogEntry("1/0/c1/f1")
+	assert.Nil(t, err)
+	assert.Nil(t, entry)
+}
+
+func Test_NotificationDeliveries(t *testing.T) {
+	dbConnection, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "siglens.db")), &gorm.Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, dbConnection.AutoMigrate(&alertutils.NotificationDelivery{}, &alertutils.NotificationDeliveryAttempt{}))
+	p := &Sqlite{}
+	p.SetDB(dbConnection)
+
+	now := time.Now().UTC()
+	request := alertutils.DeliveryRequest{Url: "https://hooks.example.com/oncall", Headers: map[string]string{"X-Token": "t"}, Body: "{}"}
+	due := &alertutils.NotificationDelivery{OrgId: 1, ContactId: "c1", ContactType: alertutils.WebhookContactType,
+		Request: request, Status: alertutils.DeliveryPending, NextAttemptAtMs: now.UnixMilli()}
+	later := &alertutils.NotificationDelivery{OrgId: 1, ContactId: "c1", ContactType: alertutils.WebhookContactType,
+		Request: request, Status: alertutils.DeliveryPending, NextAttemptAtMs: now.Add(time.Minute).UnixMilli()}
+	assert.Nil(t, p.CreateNotificationDelivery(due))
+	assert.Nil(t, p.CreateNotificationDelivery(later))
+	assert.NotEqual(t, due.DeliveryId, later.DeliveryId)
+
+	deliveries, err := p.GetDueNotificationDeliveries(now, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(deliveries))
+	assert.Equal(t, due.DeliveryId, deliveries[0].DeliveryId)
+	assert.Equal(t, request, deliveries[0].Request)
+
+	// dead letters are not due
+	later.Status = alertutils.DeliveryDead
+	assert.Nil(t, p.UpdateNotificationDelivery(later))
+	deliveries, err = p.GetDueNotificationDeliveries(now.Add(time.Hour), 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(deliveries))
+	deliveries, err = p.GetNotificationDeliveries(1, alertutils.DeliveryDead)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(deliveries))
+	assert.Equal(t, later.DeliveryId, deliveries[0].DeliveryId)
+	deliveries, err = p.GetNotificationDeliveries(2, alertutils.DeliveryDead)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(deliveries))
+
+	assert.Nil(t, p.DeleteNotificationDelivery(due.DeliveryId))
+	delivery, err := p.GetNotificationDelivery(due.DeliveryId)
+	assert.Nil(t, err)
+	assert.Nil(t, delivery)
+
+	for i := 1; i <= 5; i++ {
+		assert.Nil(t, p.AddNotificationDeliveryAttempt(&alertutils.NotificationDeliveryAttempt{DeliveryId: due.DeliveryId,
+			ContactId: "c1", Attempt: i, StatusCode: 503, AttemptedAt: now}))
+	}
+	attempts, err := p.GetNotificationDeliveryAttempts("c1", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(attempts))
+	assert.Equal(t, 5, attempts[0].Attempt)
+
+	assert.Nil(t, p.PruneNotificationDeliveryAttempts(3))
+	attempts, err = p.GetNotificationDeliveryAttempts("c1", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(attempts))
+	assert.Equal(t, 3, attempts[2].Attempt)
+}
+
+func Test_OpenIncidents(t *testing.T) {
+	dbConnection, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "siglens.db")), &gorm.Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, dbConnection.AutoMigrate(&alertutils.OpenIncident{}))
+	p := &Sqlite{}
+	p.SetDB(dbConnection)
+
+	incidents := []*alertutils.OpenIncident{
+		{ContactId: "c1", ContactType: alertutils.PagerDutyContactType, DedupKey: "a1-f1", AlertId: "a1", Fingerprint: "f1"},
+		{ContactId: "c1", ContactType: alertutils.OpsgenieContactType, DedupKey: "a1-f1", AlertId: "a1", Fingerprint: "f1"},
+		{ContactId: "c1", ContactType: alertutils.PagerDutyContactType, DedupKey: "a2-f1", AlertId: "a2", Fingerprint: "f1"},
+	}
+	assert.Nil(t, p.AddOpenIncidents(incidents))
+	// triggering an open incident again keeps one entry
+	assert.Nil(t, p.AddOpenIncidents(incidents[:1]))
+
+	open, err := p.GetOpenIncidents("c1", alertutils.PagerDutyContactType, []string{"a1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(open))
+	assert.Equal(t, "f1", open[0].Fingerprint)
+	open, err = p.GetOpenIncidents("c1", alertutils.PagerDutyContactType, []string{"a1", "a2"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(open))
+
+	assert.Nil(t, p.DeleteOpenIncident("c1", alertutils.PagerDutyContactType, "a1-f1"))
+	open, err = p.GetOpenIncidents("c1", alertutils.PagerDutyContactType, []string{"a1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(open))
+	open, err = p.GetOpenIncidents("c1", alertutils.OpsgenieContactType, []string{"a1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(open))
+}
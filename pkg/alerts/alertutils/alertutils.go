@@ -23,8 +23,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/cespare/xxhash"
 	"github.com/go-co-op/gocron"
 	"github.com/siglens/siglens/pkg/utils"
 	log "github.com/sirupsen/logrus"
@@ -50,6 +53,8 @@ type AlertConfig struct {
 	EvalWindow   uint64              `json:"eval_for"`      // in minutes; TODO: Rename json field to eval_window
 	EvalInterval uint64              `json:"eval_interval"` // in minutes
 	Message      string              `json:"message"`
+	Annotations  JSONMap             `json:"annotations,omitempty" gorm:"type:text"`             // templates expanded for each instance
+	Anomaly      *AnomalyConfig      `json:"anomaly,omitempty" gorm:"type:text;serializer:json"` // settings of the anomaly conditions
 }
 
 type AlertDetails struct {
@@ -65,6 +70,7 @@ type AlertDetails struct {
 	NotificationID           string     `json:"notification_id" gorm:"foreignKey:NotificationId;"`
 	OrgId                    int64      `json:"org_id"`
 	NumEvaluationsCount      uint64     `json:"num_evaluations_count"`
+	RuleGroup                string     `json:"rule_group,omitempty"` // Prometheus rule group the alert was imported from
 }
 
 func (AlertDetails) TableName() string {
@@ -72,8 +78,8 @@ func (AlertDetails) TableName() string {
 }
 
 type AlertLabel struct {
-	LabelName  string `json:"label_name" gorm:"primaryKey;size:256;not null;"` // unique
-	LabelValue string `json:"label_value"`
+	LabelName  string `json:"label_name" gorm:"primaryKey;size:256;not null;"`
+	LabelValue string `json:"label_value" gorm:"primaryKey;size:256"`
 }
 
 // TableName overrides the default tablename generated by GORM
@@ -89,6 +95,8 @@ type AlertHistoryDetails struct {
 	EventDescription string     `json:"event_description"`
 	UserName         string     `json:"user_name"`
 	EventTriggeredAt time.Time  `json:"event_triggered_at"`
+	Fingerprint      string     `json:"fingerprint,omitempty"`             // set for the events of an alert instance
+	Labels           JSONMap    `json:"labels,omitempty" gorm:"type:text"` // labels of the alert instance
 }
 
 func (AlertHistoryDetails) TableName() string {
@@ -103,10 +111,35 @@ const (
 )
 
 type AlertHistoryQueryParams struct {
-	AlertId   string        `json:"alert_id"` // mandatory
-	SortOrder DB_SORT_ORDER `json:"sort_order"`
-	Limit     uint64        `json:"limit"`
-	Offset    uint64        `json:"offset"`
+	AlertId     string        `json:"alert_id"` // mandatory
+	SortOrder   DB_SORT_ORDER `json:"sort_order"`
+	Limit       uint64        `json:"limit"`
+	Offset      uint64        `json:"offset"`
+	Fingerprint string        `json:"fingerprint"` // only the events of this alert instance, when set
+}
+
+// AlertInstance is a group-by row of a logs alert or a series of a metrics
+// alert. Each instance has its own state, so one unhealthy group fires and
+// resolves independently of the others. Instances are identified by the
+// fingerprint of their labels.
+type AlertInstance struct {
+	AlertId            string     `json:"alert_id" gorm:"primaryKey"`
+	Fingerprint        string     `json:"fingerprint" gorm:"primaryKey"`
+	Labels             JSONMap    `json:"labels" gorm:"type:text"`
+	State              AlertState `json:"state"`
+	Value              float64    `json:"value"`               // value of the last evaluation that matched the condition
+	ConsecutiveMatches uint64     `json:"consecutive_matches"` // evaluations in a row that matched the condition
+	ActiveAt           time.Time  `json:"active_at"`           // when the instance became pending
+	FiredAt            time.Time  `json:"fired_at"`
+	ResolvedAt         time.Time  `json:"resolved_at"`
+	LastEvaluatedAt    time.Time  `json:"last_evaluated_at"`
+	Annotations        JSONMap    `json:"annotations,omitempty" gorm:"type:text"` // annotations of the alert expanded for the instance
+	Baseline           *float64   `json:"baseline,omitempty"`                     // what the value was compared with, for anomaly conditions
+	Score              *float64   `json:"score,omitempty"`                        // deviations or percent from the baseline, for anomaly conditions
+}
+
+func (AlertInstance) TableName() string {
+	return "alert_instances"
 }
 
 type QueryParams struct {
@@ -119,7 +152,13 @@ type QueryParams struct {
 	QueryMode     string `json:"queryMode"`
 }
 type Alert struct {
-	Status string
+	Status      string
+	Labels      map[string]string `json:"Labels,omitempty"` // labels of the alert instance
+	Value       float64           `json:"Value,omitempty"`
+	Fingerprint string            `json:"Fingerprint,omitempty"`
+	Annotations map[string]string `json:"Annotations,omitempty"`
+	Baseline    *float64          `json:"Baseline,omitempty"` // set for anomaly conditions
+	Score       *float64          `json:"Score,omitempty"`
 }
 
 type WebhookBody struct {
@@ -132,13 +171,27 @@ type WebhookBody struct {
 }
 
 type Contact struct {
-	ContactId   string             `json:"contact_id" gorm:"primaryKey"`
-	ContactName string             `json:"contact_name" gorm:"not null;unique"`
-	Email       []string           `json:"email" gorm:"type:text[]"`
-	Slack       []SlackTokenConfig `json:"slack" gorm:"many2many:slack_contact;auto_preload"`
-	PagerDuty   string             `json:"pager_duty"`
-	Webhook     []WebHookConfig    `json:"webhook" gorm:"many2many:webhook_contact;auto_preload"`
-	OrgId       int64              `json:"org_id"`
+	ContactId   string                          `json:"contact_id" gorm:"primaryKey"`
+	ContactName string                          `json:"contact_name" gorm:"not null;unique"`
+	Email       []string                        `json:"email" gorm:"type:text[]"`
+	Slack       []SlackTokenConfig              `json:"slack" gorm:"many2many:slack_contact;auto_preload"`
+	PagerDuty   string                          `json:"pager_duty"` // routing key of a PagerDuty Events API v2 integration
+	Webhook     []WebHookConfig                 `json:"webhook" gorm:"many2many:webhook_contact;auto_preload"`
+	Opsgenie    []OpsgenieConfig                `json:"opsgenie" gorm:"type:text;serializer:json"`
+	Teams       []TeamsConfig                   `json:"teams" gorm:"type:text;serializer:json"`
+	Templates   map[string]NotificationTemplate `json:"templates,omitempty" gorm:"type:text;serializer:json"` // contact point type -> template
+	OrgId       int64                           `json:"org_id"`
+}
+
+type OpsgenieConfig struct {
+	ApiKey   string `json:"api_key"`
+	ApiUrl   string `json:"api_url,omitempty"`  // defaults to https://api.opsgenie.com, use https://api.eu.opsgenie.com for EU accounts
+	Priority string `json:"priority,omitempty"` // P1 to P5, defaults to P3
+}
+
+// TeamsConfig is a Microsoft Teams incoming webhook or workflow URL.
+type TeamsConfig struct {
+	WebhookUrl string `json:"webhook_url"`
 }
 
 type SlackTokenConfig struct {
@@ -158,6 +211,13 @@ func (j JSONMap) Value() (driver.Value, error) {
 }
 
 func (j *JSONMap) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*j = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), j)
+	}
 	bytes, ok := value.([]byte)
 	if !ok {
 		return fmt.Errorf("JSONMap Scan: failed to assert database value as []byte")
@@ -194,8 +254,41 @@ const (
 	IsEqualTo
 	IsNotEqualTo
 	HasNoValue
+	IsAboveOrEqualTo
+	IsBelowOrEqualTo
+	IsAnomalous        // deviates from the rolling baseline by Value deviations
+	DeviatesFromSeason // deviates from the same window a day or a week ago by Value percent
+	ChangesByPercent   // changed by Value percent over the change interval
 )
 
+// Describes the condition of an alert, e.g. "is above 42".
+func GetConditionDescription(condition AlertQueryCondition, value float64) string {
+	threshold := fmt.Sprintf("%1.0f", value)
+	switch condition {
+	case IsAbove:
+		return "is above " + threshold
+	case IsBelow:
+		return "is below " + threshold
+	case IsEqualTo:
+		return "is equal to " + threshold
+	case IsNotEqualTo:
+		return "is not equal to " + threshold
+	case HasNoValue:
+		return "has no value"
+	case IsAboveOrEqualTo:
+		return "is above or equal to " + threshold
+	case IsBelowOrEqualTo:
+		return "is below or equal to " + threshold
+	case IsAnomalous:
+		return fmt.Sprintf("deviates from the baseline by %v deviations", value)
+	case DeviatesFromSeason:
+		return fmt.Sprintf("deviates from the last season by %v%%", value)
+	case ChangesByPercent:
+		return fmt.Sprintf("changes by %v%%", value)
+	}
+	return ""
+}
+
 type AlertState uint8 // state of the alerts
 const (
 	Inactive AlertState = iota
@@ -278,6 +371,39 @@ func IsAlertStatePendingOrFiring(alertState AlertState) bool {
 	return alertState == Pending || alertState == Firing
 }
 
+// Returns the fingerprint that identifies the alert instance with the labels.
+func GetInstanceFingerprint(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, key := range keys {
+		sb.WriteString(key)
+		sb.WriteByte(0xff)
+		sb.WriteString(labels[key])
+		sb.WriteByte(0xff)
+	}
+	return fmt.Sprintf("%016x", xxhash.Sum64String(sb.String()))
+}
+
+// Returns the labels as key=value pairs sorted by key, e.g. host=web01, region=us.
+func FormatInstanceLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+labels[key])
+	}
+	return strings.Join(pairs, ", ")
+}
+
 func (alert *AlertDetails) EncodeQueryParamToBase64() {
 	if alert.AlertType == AlertTypeLogs {
 		alert.QueryParams.QueryText = utils.EncodeToBase64(alert.QueryParams.QueryText)
@@ -0,0 +1,214 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertutils
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+type AnomalyMethod string
+
+const (
+	ZScoreMethod AnomalyMethod = "zscore" // deviations are standard deviations from the mean
+	MADMethod    AnomalyMethod = "mad"    // deviations are scaled median absolute deviations from the median
+)
+
+type AnomalySeason string
+
+const (
+	DaySeason  AnomalySeason = "day"
+	WeekSeason AnomalySeason = "week"
+)
+
+type AnomalyDirection string
+
+const (
+	AnomalyBoth AnomalyDirection = "both"
+	AnomalyUp   AnomalyDirection = "up"
+	AnomalyDown AnomalyDirection = "down"
+)
+
+const DEFAULT_BASELINE_WINDOW_MINUTES = 60
+const DEFAULT_CHANGE_INTERVAL_MINUTES = 60
+
+// The rolling baseline needs this many samples before a value can be anomalous.
+const MIN_BASELINE_SAMPLES = 3
+
+// Scales the median absolute deviation to the standard deviation of normally
+// distributed values, so MAD thresholds are comparable to z-scores.
+const MAD_SCALE = 1.4826
+
+// AnomalyConfig holds the settings of the anomaly conditions. The threshold
+// is the Value of the alert: the number of deviations for IsAnomalous and a
+// percent for DeviatesFromSeason and ChangesByPercent.
+type AnomalyConfig struct {
+	Method         AnomalyMethod    `json:"method,omitempty"`          // IsAnomalous: zscore (default) or mad
+	BaselineWindow uint64           `json:"baseline_window,omitempty"` // IsAnomalous: minutes of history before the evaluation window, defaults to 60
+	Season         AnomalySeason    `json:"season,omitempty"`          // DeviatesFromSeason: day (default) or week
+	ChangeInterval uint64           `json:"change_interval,omitempty"` // ChangesByPercent: minutes, defaults to 60
+	Direction      AnomalyDirection `json:"direction,omitempty"`       // up, down or both (default)
+}
+
+func IsAnomalyCondition(condition AlertQueryCondition) bool {
+	return condition == IsAnomalous || condition == DeviatesFromSeason || condition == ChangesByPercent
+}
+
+// Returns an error if the settings of an anomaly condition are invalid.
+func ValidateAnomalyConfig(condition AlertQueryCondition, threshold float64, config *AnomalyConfig) error {
+	if !IsAnomalyCondition(condition) {
+		return nil
+	}
+	if threshold <= 0 {
+		return fmt.Errorf("the value of an anomaly condition should be greater than 0")
+	}
+	if config == nil {
+		return nil
+	}
+	switch config.Method {
+	case "", ZScoreMethod, MADMethod:
+	default:
+		return fmt.Errorf("invalid anomaly method %q, it should be %v or %v", config.Method, ZScoreMethod, MADMethod)
+	}
+	switch config.Season {
+	case "", DaySeason, WeekSeason:
+	default:
+		return fmt.Errorf("invalid anomaly season %q, it should be %v or %v", config.Season, DaySeason, WeekSeason)
+	}
+	switch config.Direction {
+	case "", AnomalyBoth, AnomalyUp, AnomalyDown:
+	default:
+		return fmt.Errorf("invalid anomaly direction %q, it should be %v, %v or %v", config.Direction, AnomalyUp, AnomalyDown, AnomalyBoth)
+	}
+	return nil
+}
+
+func (config *AnomalyConfig) GetMethod() AnomalyMethod {
+	if config == nil || config.Method == "" {
+		return ZScoreMethod
+	}
+	return config.Method
+}
+
+func (config *AnomalyConfig) GetBaselineWindow() time.Duration {
+	if config == nil || config.BaselineWindow == 0 {
+		return DEFAULT_BASELINE_WINDOW_MINUTES * time.Minute
+	}
+	return time.Duration(config.BaselineWindow) * time.Minute
+}
+
+// Returns how far back the season is.
+func (config *AnomalyConfig) GetSeasonOffset() time.Duration {
+	if config != nil && config.Season == WeekSeason {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+func (config *AnomalyConfig) GetChangeInterval() time.Duration {
+	if config == nil || config.ChangeInterval == 0 {
+		return DEFAULT_CHANGE_INTERVAL_MINUTES * time.Minute
+	}
+	return time.Duration(config.ChangeInterval) * time.Minute
+}
+
+// Returns whether the score is beyond the threshold in the direction of the
+// condition.
+func (config *AnomalyConfig) IsAnomalousScore(score float64, threshold float64) bool {
+	if math.IsNaN(score) {
+		return false
+	}
+	direction := AnomalyBoth
+	if config != nil && config.Direction != "" {
+		direction = config.Direction
+	}
+	switch direction {
+	case AnomalyUp:
+		return score >= threshold
+	case AnomalyDown:
+		return score <= -threshold
+	}
+	return math.Abs(score) >= threshold
+}
+
+/*
+Returns the center and the spread of the samples: the mean and the standard
+deviation for z-scores, the median and the scaled median absolute deviation
+for MAD. Returns false with fewer than MIN_BASELINE_SAMPLES samples.
+*/
+func GetRollingBaseline(samples []float64, method AnomalyMethod) (float64, float64, bool) {
+	if len(samples) < MIN_BASELINE_SAMPLES {
+		return 0, 0, false
+	}
+
+	if method == MADMethod {
+		center := getMedian(samples)
+		deviations := make([]float64, len(samples))
+		for i, sample := range samples {
+			deviations[i] = math.Abs(sample - center)
+		}
+		return center, MAD_SCALE * getMedian(deviations), true
+	}
+
+	var sum float64
+	for _, sample := range samples {
+		sum += sample
+	}
+	mean := sum / float64(len(samples))
+	var squares float64
+	for _, sample := range samples {
+		squares += (sample - mean) * (sample - mean)
+	}
+	return mean, math.Sqrt(squares / float64(len(samples))), true
+}
+
+func getMedian(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// Returns how many spreads the value is from the center. A value that differs
+// from a baseline without spread is infinitely far from it.
+func GetDeviationScore(value float64, center float64, spread float64) float64 {
+	if spread == 0 {
+		if value == center {
+			return 0
+		}
+		return math.Copysign(math.Inf(1), value-center)
+	}
+	return (value - center) / spread
+}
+
+// Returns the change from the previous value in percent. Any change from 0 is
+// an infinite percent.
+func GetPercentChange(value float64, previous float64) float64 {
+	if previous == 0 {
+		if value == 0 {
+			return 0
+		}
+		return math.Copysign(math.Inf(1), value)
+	}
+	return (value - previous) / math.Abs(previous) * 100
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertutils
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_GetRollingBaseline(t *testing.T) {
+	_, _, ok := GetRollingBaseline([]float64{1, 2}, ZScoreMethod)
+	assert.False(t, ok)
+
+	center, spread, ok := GetRollingBaseline([]float64{2, 4, 4, 4, 5, 5, 7, 9}, ZScoreMethod)
+	assert.True(t, ok)
+	assert.Equal(t, 5.0, center)
+	assert.Equal(t, 2.0, spread)
+	assert.Equal(t, 2.5, GetDeviationScore(10, center, spread))
+
+	// an outlier moves the median and the MAD much less than the mean and the standard deviation
+	center, spread, ok = GetRollingBaseline([]float64{10, 11, 9, 10, 100}, MADMethod)
+	assert.True(t, ok)
+	assert.Equal(t, 10.0, center)
+	assert.InDelta(t, MAD_SCALE, spread, 1e-9)
+
+	assert.Equal(t, 0.0, GetDeviationScore(5, 5, 0))
+	assert.True(t, math.IsInf(GetDeviationScore(6, 5, 0), 1))
+	assert.True(t, math.IsInf(GetDeviationScore(4, 5, 0), -1))
+}
+
+func Test_GetPercentChange(t *testing.T) {
+	assert.Equal(t, 50.0, GetPercentChange(150, 100))
+	assert.Equal(t, -25.0, GetPercentChange(75, 100))
+	assert.Equal(t, 200.0, GetPercentChange(10, -10))
+	assert.Equal(t, 0.0, GetPercentChange(0, 0))
+	assert.True(t, math.IsInf(GetPercentChange(3, 0), 1))
+}
+
+func Test_AnomalyConfig(t *testing.T) {
+	var config *AnomalyConfig
+	assert.Equal(t, ZScoreMethod, config.GetMethod())
+	assert.Equal(t, time.Hour, config.GetBaselineWindow())
+	assert.Equal(t, 24*time.Hour, config.GetSeasonOffset())
+	assert.Equal(t, time.Hour, config.GetChangeInterval())
+	assert.True(t, config.IsAnomalousScore(-3, 3))
+	assert.False(t, config.IsAnomalousScore(2.9, 3))
+	assert.False(t, config.IsAnomalousScore(math.NaN(), 3))
+
+	config = &AnomalyConfig{Method: MADMethod, BaselineWindow: 30, Season: WeekSeason, ChangeInterval: 15, Direction: AnomalyUp}
+	assert.Equal(t, MADMethod, config.GetMethod())
+	assert.Equal(t, 30*time.Minute, config.GetBaselineWindow())
+	assert.Equal(t, 7*24*time.Hour, config.GetSeasonOffset())
+	assert.Equal(t, 15*time.Minute, config.GetChangeInterval())
+	assert.True(t, config.IsAnomalousScore(math.Inf(1), 3))
+	assert.False(t, config.IsAnomalousScore(-5, 3))
+	config.Direction = AnomalyDown
+	assert.True(t, config.IsAnomalousScore(-5, 3))
+	assert.False(t, config.IsAnomalousScore(5, 3))
+}
+
+func Test_ValidateAnomalyConfig(t *testing.T) {
+	assert.Nil(t, ValidateAnomalyConfig(IsAbove, 0, nil))
+	assert.Nil(t, ValidateAnomalyConfig(IsAnomalous, 3, nil))
+	assert.Nil(t, ValidateAnomalyConfig(ChangesByPercent, 20, &AnomalyConfig{Direction: AnomalyDown}))
+	assert.NotNil(t, ValidateAnomalyConfig(IsAnomalous, 0, nil))
+	assert.NotNil(t, ValidateAnomalyConfig(IsAnomalous, 3, &AnomalyConfig{Method: "stddev"}))
+	assert.NotNil(t, ValidateAnomalyConfig(DeviatesFromSeason, 10, &AnomalyConfig{Season: "month"}))
+	assert.NotNil(t, ValidateAnomalyConfig(ChangesByPercent, 10, &AnomalyConfig{Direction: "sideways"}))
+
+	assert.Equal(t, "deviates from the baseline by 3 deviations", GetConditionDescription(IsAnomalous, 3))
+	assert.Equal(t, "changes by 20%", GetConditionDescription(ChangesByPercent, 20))
+}
@@ -0,0 +1,599 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	BundleKindContact           = "contact"
+	BundleKindAlert             = "alert"
+	BundleKindSilence           = "silence"
+	BundleKindMaintenanceWindow = "maintenance_window"
+)
+
+const (
+	BundleActionCreate = "create"
+	BundleActionUpdate = "update"
+	BundleActionDelete = "delete"
+)
+
+// Exported in place of the secrets of the contact points. Applying a bundle
+// keeps the stored secret when the field is redacted or empty.
+const BundleRedactedSecret = "<redacted>"
+
+/*
+AlertsBundle is the alerting config of an org as code. Contact points, alerts
+and maintenance windows are identified by their names and silences by their
+matchers, so a bundle exported from one environment can be applied to another.
+Applying a bundle makes each of its sections match the org; a section that is
+missing from the bundle is left as it is, while an empty one deletes
+everything of its kind.
+*/
+type AlertsBundle struct {
+	Contacts           []*BundleContact           `json:"contacts"`
+	Alerts             []*BundleAlert             `json:"alerts"`
+	Silences           []*BundleSilence           `json:"silences"`
+	MaintenanceWindows []*BundleMaintenanceWindow `json:"maintenance_windows"`
+}
+
+type BundleSlackConfig struct {
+	ChannelId string `json:"channel_id"`
+	SlToken   string `json:"slack_token"`
+}
+
+type BundleWebhookConfig struct {
+	Webhook string            `json:"webhook"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type BundleContact struct {
+	Name      string                          `json:"name"`
+	Email     []string                        `json:"email,omitempty"`
+	Slack     []BundleSlackConfig             `json:"slack,omitempty"`
+	PagerDuty string                          `json:"pager_duty,omitempty"`
+	Webhook   []BundleWebhookConfig           `json:"webhook,omitempty"`
+	Opsgenie  []OpsgenieConfig                `json:"opsgenie,omitempty"`
+	Teams     []TeamsConfig                   `json:"teams,omitempty"`
+	Templates map[string]NotificationTemplate `json:"templates,omitempty"`
+}
+
+// BundleAlert is an alert with the fields of the create alert API, except that
+// it refers to its contact point by name and has its labels as a map.
+type BundleAlert struct {
+	AlertName          string                 `json:"alert_name"`
+	AlertType          AlertType              `json:"alert_type"`
+	ContactName        string                 `json:"contact_name"`
+	Labels             map[string]string      `json:"labels,omitempty"`
+	QueryParams        *QueryParams           `json:"queryParams,omitempty"`        // logs alerts
+	MetricsQueryParams map[string]interface{} `json:"metricsQueryParams,omitempty"` // metrics alerts
+	Condition          AlertQueryCondition    `json:"condition"`
+	Value              float64                `json:"value"`
+	EvalWindow         uint64                 `json:"eval_for"`
+	EvalInterval       uint64                 `json:"eval_interval"`
+	Message            string                 `json:"message,omitempty"`
+	Annotations        map[string]string      `json:"annotations,omitempty"`
+	Anomaly            *AnomalyConfig         `json:"anomaly,omitempty"`
+	RuleGroup          string                 `json:"rule_group,omitempty"`
+}
+
+type BundleSilence struct {
+	Matchers  SilenceMatchers `json:"matchers"`
+	StartsAt  time.Time       `json:"starts_at"` // keeps the start of the existing silence when not set
+	EndsAt    time.Time       `json:"ends_at"`
+	CreatedBy string          `json:"created_by,omitempty"`
+	Comment   string          `json:"comment,omitempty"`
+}
+
+type BundleMaintenanceWindow struct {
+	Name            string          `json:"name"`
+	Matchers        SilenceMatchers `json:"matchers"`
+	Schedule        string          `json:"schedule"`
+	DurationMinutes uint64          `json:"duration_minutes"`
+	Timezone        string          `json:"timezone,omitempty"`
+	CreatedBy       string          `json:"created_by,omitempty"`
+	Comment         string          `json:"comment,omitempty"`
+}
+
+// BundleChange is a change that applying a bundle makes, or made, to the org.
+type BundleChange struct {
+	Kind   string   `json:"kind"`
+	Name   string   `json:"name"`
+	Action string   `json:"action"`
+	Fields []string `json:"fields,omitempty"` // the fields that an update changes
+	Error  string   `json:"error,omitempty"`  // set when the change could not be applied
+}
+
+// Parses a bundle in YAML or JSON. The fields are the json names in both.
+func ParseAlertsBundle(data []byte) (*AlertsBundle, error) {
+	var raw interface{}
+	err := yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, fmt.Errorf("bundle is empty")
+	}
+	jsonData, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var bundle AlertsBundle
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&bundle)
+	if err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// Returns the bundle as YAML with the json names of the fields.
+func (bundle *AlertsBundle) MarshalYaml() ([]byte, error) {
+	jsonData, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is YAML; decoding it into a node keeps the order of the fields.
+	var node yaml.Node
+	err = yaml.Unmarshal(jsonData, &node)
+	if err != nil {
+		return nil, err
+	}
+	setBlockStyle(&node)
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&node)
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func setBlockStyle(node *yaml.Node) {
+	node.Style &^= yaml.FlowStyle
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!str" {
+		node.Style &^= yaml.DoubleQuotedStyle
+	}
+	for _, child := range node.Content {
+		setBlockStyle(child)
+	}
+}
+
+// Checks that the names are set and unique, and that the silences and
+// maintenance windows are valid. Alerts are validated when they are applied.
+func (bundle *AlertsBundle) Validate() error {
+	contactNames := make(map[string]struct{}, len(bundle.Contacts))
+	for _, contact := range bundle.Contacts {
+		if contact == nil || contact.Name == "" {
+			return fmt.Errorf("contact name is required")
+		}
+		if _, ok := contactNames[contact.Name]; ok {
+			return fmt.Errorf("duplicate contact %v", contact.Name)
+		}
+		contactNames[contact.Name] = struct{}{}
+		err := ValidateNotificationTemplates(contact.Templates)
+		if err != nil {
+			return fmt.Errorf("contact %v: %v", contact.Name, err)
+		}
+	}
+
+	alertNames := make(map[string]struct{}, len(bundle.Alerts))
+	for _, alert := range bundle.Alerts {
+		if alert == nil || alert.AlertName == "" {
+			return fmt.Errorf("alert name is required")
+		}
+		if _, ok := alertNames[alert.AlertName]; ok {
+			return fmt.Errorf("duplicate alert %v", alert.AlertName)
+		}
+		alertNames[alert.AlertName] = struct{}{}
+		if alert.ContactName == "" {
+			return fmt.Errorf("alert %v: contact_name is required", alert.AlertName)
+		}
+	}
+
+	silenceKeys := make(map[string]struct{}, len(bundle.Silences))
+	for _, silence := range bundle.Silences {
+		if silence == nil {
+			return fmt.Errorf("silence is empty")
+		}
+		key := silence.GetName()
+		if _, ok := silenceKeys[key]; ok {
+			return fmt.Errorf("duplicate silence %v", key)
+		}
+		silenceKeys[key] = struct{}{}
+		startsAt := silence.StartsAt
+		if startsAt.IsZero() {
+			startsAt = time.Now().UTC()
+		}
+		toValidate := Silence{Matchers: silence.Matchers, StartsAt: startsAt, EndsAt: silence.EndsAt}
+		err := toValidate.Validate()
+		if err != nil {
+			return fmt.Errorf("silence %v: %v", key, err)
+		}
+	}
+
+	windowNames := make(map[string]struct{}, len(bundle.MaintenanceWindows))
+	for _, window := range bundle.MaintenanceWindows {
+		if window == nil || window.Name == "" {
+			return fmt.Errorf("maintenance window name is required")
+		}
+		if _, ok := windowNames[window.Name]; ok {
+			return fmt.Errorf("duplicate maintenance window %v", window.Name)
+		}
+		windowNames[window.Name] = struct{}{}
+		err := window.ToMaintenanceWindow(0).Validate()
+		if err != nil {
+			return fmt.Errorf("maintenance window %v: %v", window.Name, err)
+		}
+	}
+	return nil
+}
+
+func NewBundleContact(contact *Contact) *BundleContact {
+	bundleContact := &BundleContact{
+		Name:      contact.ContactName,
+		Email:     contact.Email,
+		PagerDuty: contact.PagerDuty,
+		Opsgenie:  contact.Opsgenie,
+		Teams:     contact.Teams,
+		Templates: contact.Templates,
+	}
+	for _, slack := range contact.Slack {
+		bundleContact.Slack = append(bundleContact.Slack, BundleSlackConfig{ChannelId: slack.ChannelId, SlToken: slack.SlToken})
+	}
+	for _, webhook := range contact.Webhook {
+		bundleContact.Webhook = append(bundleContact.Webhook, BundleWebhookConfig{Webhook: webhook.Webhook, Headers: webhook.Headers})
+	}
+	return bundleContact
+}
+
+func (c *BundleContact) ToContact(orgId int64) *Contact {
+	contact := &Contact{
+		ContactName: c.Name,
+		Email:       c.Email,
+		PagerDuty:   c.PagerDuty,
+		Opsgenie:    c.Opsgenie,
+		Teams:       c.Teams,
+		Templates:   c.Templates,
+		OrgId:       orgId,
+	}
+	for _, slack := range c.Slack {
+		contact.Slack = append(contact.Slack, SlackTokenConfig{ChannelId: slack.ChannelId, SlToken: slack.SlToken})
+	}
+	for _, webhook := range c.Webhook {
+		contact.Webhook = append(contact.Webhook, WebHookConfig{Webhook: webhook.Webhook, Headers: webhook.Headers})
+	}
+	return contact
+}
+
+// Replaces the Slack tokens, the PagerDuty routing key, the webhook header
+// values, the Opsgenie API keys and the Teams webhook URLs with
+// BundleRedactedSecret.
+func (c *BundleContact) RedactSecrets() {
+	for i := range c.Slack {
+		c.Slack[i].SlToken = redactSecret(c.Slack[i].SlToken)
+	}
+	c.PagerDuty = redactSecret(c.PagerDuty)
+	for i := range c.Webhook {
+		if c.Webhook[i].Headers == nil {
+			continue
+		}
+		headers := make(map[string]string, len(c.Webhook[i].Headers))
+		for name, value := range c.Webhook[i].Headers {
+			headers[name] = redactSecret(value)
+		}
+		c.Webhook[i].Headers = headers
+	}
+	opsgenie := make([]OpsgenieConfig, len(c.Opsgenie))
+	for i, config := range c.Opsgenie {
+		config.ApiKey = redactSecret(config.ApiKey)
+		opsgenie[i] = config
+	}
+	if c.Opsgenie != nil {
+		c.Opsgenie = opsgenie
+	}
+	teams := make([]TeamsConfig, len(c.Teams))
+	for i, config := range c.Teams {
+		config.WebhookUrl = redactSecret(config.WebhookUrl)
+		teams[i] = config
+	}
+	if c.Teams != nil {
+		c.Teams = teams
+	}
+}
+
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return BundleRedactedSecret
+}
+
+func isSecretUnset(secret string) bool {
+	return secret == "" || secret == BundleRedactedSecret
+}
+
+/*
+Sets the secrets that are redacted or empty to the ones of the stored contact
+point: the Slack token of the same channel, the PagerDuty routing key, the
+header value of the same webhook URL and header name, and the Opsgenie API key
+and Teams webhook URL at the same position. Returns an error if a secret is
+redacted and there is nothing stored to keep.
+*/
+func (c *BundleContact) KeepSecrets(current *BundleContact) error {
+	currentSlackTokens := make(map[string]string)
+	if current != nil {
+		for _, slack := range current.Slack {
+			currentSlackTokens[slack.ChannelId] = slack.SlToken
+		}
+	}
+	for i := range c.Slack {
+		if isSecretUnset(c.Slack[i].SlToken) && currentSlackTokens[c.Slack[i].ChannelId] != "" {
+			c.Slack[i].SlToken = currentSlackTokens[c.Slack[i].ChannelId]
+		}
+		if c.Slack[i].SlToken == BundleRedactedSecret {
+			return fmt.Errorf("the slack token of channel %v is redacted", c.Slack[i].ChannelId)
+		}
+	}
+
+	if isSecretUnset(c.PagerDuty) && current != nil && current.PagerDuty != "" {
+		c.PagerDuty = current.PagerDuty
+	}
+	if c.PagerDuty == BundleRedactedSecret {
+		return fmt.Errorf("the pager_duty routing key is redacted")
+	}
+
+	currentHeaders := make(map[string]map[string]string)
+	if current != nil {
+		for _, webhook := range current.Webhook {
+			currentHeaders[webhook.Webhook] = webhook.Headers
+		}
+	}
+	for i := range c.Webhook {
+		if c.Webhook[i].Headers == nil {
+			continue
+		}
+		headers := make(map[string]string, len(c.Webhook[i].Headers))
+		for name, value := range c.Webhook[i].Headers {
+			if isSecretUnset(value) && currentHeaders[c.Webhook[i].Webhook][name] != "" {
+				value = currentHeaders[c.Webhook[i].Webhook][name]
+			}
+			if value == BundleRedactedSecret {
+				return fmt.Errorf("the header %v of webhook %v is redacted", name, c.Webhook[i].Webhook)
+			}
+			headers[name] = value
+		}
+		c.Webhook[i].Headers = headers
+	}
+
+	opsgenie := make([]OpsgenieConfig, len(c.Opsgenie))
+	for i, config := range c.Opsgenie {
+		if isSecretUnset(config.ApiKey) && current != nil && i < len(current.Opsgenie) {
+			config.ApiKey = current.Opsgenie[i].ApiKey
+		}
+		if config.ApiKey == BundleRedactedSecret {
+			return fmt.Errorf("the opsgenie api_key at position %v is redacted", i)
+		}
+		opsgenie[i] = config
+	}
+	if c.Opsgenie != nil {
+		c.Opsgenie = opsgenie
+	}
+
+	teams := make([]TeamsConfig, len(c.Teams))
+	for i, config := range c.Teams {
+		if isSecretUnset(config.WebhookUrl) && current != nil && i < len(current.Teams) {
+			config.WebhookUrl = current.Teams[i].WebhookUrl
+		}
+		if config.WebhookUrl == BundleRedactedSecret {
+			return fmt.Errorf("the teams webhook_url at position %v is redacted", i)
+		}
+		teams[i] = config
+	}
+	if c.Teams != nil {
+		c.Teams = teams
+	}
+	return nil
+}
+
+func NewBundleAlert(alert *AlertDetails) (*BundleAlert, error) {
+	bundleAlert := &BundleAlert{
+		AlertName:    alert.AlertName,
+		AlertType:    alert.AlertType,
+		ContactName:  alert.ContactName,
+		Condition:    alert.Condition,
+		Value:        alert.Value,
+		EvalWindow:   alert.EvalWindow,
+		EvalInterval: alert.EvalInterval,
+		Message:      alert.Message,
+		Anomaly:      alert.Anomaly,
+		RuleGroup:    alert.RuleGroup,
+	}
+	if len(alert.Labels) > 0 {
+		bundleAlert.Labels = make(map[string]string, len(alert.Labels))
+		for _, label := range alert.Labels {
+			bundleAlert.Labels[label.LabelName] = label.LabelValue
+		}
+	}
+	if len(alert.Annotations) > 0 {
+		bundleAlert.Annotations = alert.Annotations
+	}
+	if alert.AlertType == AlertTypeMetrics {
+		err := json.Unmarshal([]byte(alert.MetricsQueryParamsString), &bundleAlert.MetricsQueryParams)
+		if err != nil {
+			return nil, fmt.Errorf("alert %v: invalid metrics query params, err=%v", alert.AlertName, err)
+		}
+	} else {
+		queryParams := alert.QueryParams
+		bundleAlert.QueryParams = &queryParams
+	}
+	return bundleAlert, nil
+}
+
+// Returns the alert of the bundle, to be created or to update an existing alert.
+func (a *BundleAlert) ToAlert(orgId int64, contactId string) (*AlertDetails, error) {
+	alert := &AlertDetails{
+		AlertConfig: AlertConfig{
+			AlertName:    a.AlertName,
+			AlertType:    a.AlertType,
+			ContactID:    contactId,
+			ContactName:  a.ContactName,
+			Condition:    a.Condition,
+			Value:        a.Value,
+			EvalWindow:   a.EvalWindow,
+			EvalInterval: a.EvalInterval,
+			Message:      a.Message,
+			Annotations:  a.Annotations,
+			Anomaly:      a.Anomaly,
+		},
+		OrgId:     orgId,
+		RuleGroup: a.RuleGroup,
+	}
+	names := make([]string, 0, len(a.Labels))
+	for name := range a.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		alert.Labels = append(alert.Labels, AlertLabel{LabelName: name, LabelValue: a.Labels[name]})
+	}
+	if a.QueryParams != nil {
+		alert.QueryParams = *a.QueryParams
+	}
+	if a.MetricsQueryParams != nil {
+		metricsQueryParams, err := json.Marshal(a.MetricsQueryParams)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metricsQueryParams, err=%v", err)
+		}
+		alert.MetricsQueryParamsString = string(metricsQueryParams)
+	}
+	return alert, nil
+}
+
+func NewBundleSilence(silence *Silence) *BundleSilence {
+	return &BundleSilence{
+		Matchers:  silence.Matchers,
+		StartsAt:  silence.StartsAt.UTC(),
+		EndsAt:    silence.EndsAt.UTC(),
+		CreatedBy: silence.CreatedBy,
+		Comment:   silence.Comment,
+	}
+}
+
+// Silences have no name; they are identified by their matchers.
+func (s *BundleSilence) GetName() string {
+	matchers := make([]string, 0, len(s.Matchers))
+	for _, matcher := range s.Matchers {
+		if matcher != nil {
+			matchers = append(matchers, fmt.Sprintf("%v%v%q", matcher.Name, matcher.Type, matcher.Value))
+		}
+	}
+	sort.Strings(matchers)
+	return "{" + strings.Join(matchers, ", ") + "}"
+}
+
+func (s *BundleSilence) ToSilence(orgId int64) *Silence {
+	return &Silence{
+		Matchers:  s.Matchers,
+		StartsAt:  s.StartsAt,
+		EndsAt:    s.EndsAt,
+		CreatedBy: s.CreatedBy,
+		Comment:   s.Comment,
+		OrgId:     orgId,
+	}
+}
+
+func NewBundleMaintenanceWindow(window *MaintenanceWindow) *BundleMaintenanceWindow {
+	return &BundleMaintenanceWindow{
+		Name:            window.Name,
+		Matchers:        window.Matchers,
+		Schedule:        window.Schedule,
+		DurationMinutes: window.DurationMinutes,
+		Timezone:        window.Timezone,
+		CreatedBy:       window.CreatedBy,
+		Comment:         window.Comment,
+	}
+}
+
+func (w *BundleMaintenanceWindow) ToMaintenanceWindow(orgId int64) *MaintenanceWindow {
+	return &MaintenanceWindow{
+		Name:            w.Name,
+		Matchers:        w.Matchers,
+		Schedule:        w.Schedule,
+		DurationMinutes: w.DurationMinutes,
+		Timezone:        w.Timezone,
+		CreatedBy:       w.CreatedBy,
+		Comment:         w.Comment,
+		OrgId:           orgId,
+	}
+}
+
+// Returns the sorted json names of the fields whose values differ.
+func GetBundleChangedFields(current interface{}, desired interface{}) ([]string, error) {
+	currentFields, err := getBundleFields(current)
+	if err != nil {
+		return nil, err
+	}
+	desiredFields, err := getBundleFields(desired)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make([]string, 0)
+	for name, value := range desiredFields {
+		if !reflect.DeepEqual(value, currentFields[name]) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range currentFields {
+		if _, ok := desiredFields[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+func getBundleFields(value interface{}) (map[string]interface{}, error) {
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{})
+	err = json.Unmarshal(jsonData, &fields)
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
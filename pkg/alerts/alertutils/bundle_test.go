@@ -0,0 +1,185 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertutils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseAlertsBundle(t *testing.T) {
+	yamlBundle := `
+contacts:
+  - name: oncall
+    teams:
+      - webhook_url: https://teams.example.com/hook
+alerts:
+  - alert_name: Errors
+    alert_type: 1
+    contact_name: oncall
+    labels: {team: web}
+    queryParams: {queryText: "error | stats count", queryLanguage: Splunk QL}
+    value: 10
+    eval_for: 5
+    eval_interval: 1
+silences: []
+`
+	bundle, err := ParseAlertsBundle([]byte(yamlBundle))
+	assert.Nil(t, err)
+	assert.Equal(t, "oncall", bundle.Contacts[0].Name)
+	assert.Equal(t, "https://teams.example.com/hook", bundle.Contacts[0].Teams[0].WebhookUrl)
+	assert.Equal(t, AlertTypeLogs, bundle.Alerts[0].AlertType)
+	assert.Equal(t, map[string]string{"team": "web"}, bundle.Alerts[0].Labels)
+	assert.Equal(t, "error | stats count", bundle.Alerts[0].QueryParams.QueryText)
+	// an empty section is synced, a missing one is not
+	assert.NotNil(t, bundle.Silences)
+	assert.Nil(t, bundle.MaintenanceWindows)
+
+	jsonBundle, err := ParseAlertsBundle([]byte(`{"contacts": [{"name": "oncall"}]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "oncall", jsonBundle.Contacts[0].Name)
+
+	exported, err := bundle.MarshalYaml()
+	assert.Nil(t, err)
+	parsed, err := ParseAlertsBundle(exported)
+	assert.Nil(t, err)
+	assert.Equal(t, bundle, parsed)
+
+	for _, invalid := range []string{``, `contacts: [{nme: oncall}]`, `alerts: {}`} {
+		_, err = ParseAlertsBundle([]byte(invalid))
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func Test_ValidateAlertsBundle(t *testing.T) {
+	matchers := SilenceMatchers{{Name: "env", Value: "staging", Type: MatchEqual}}
+	valid := &AlertsBundle{
+		Contacts:           []*BundleContact{{Name: "oncall"}},
+		Alerts:             []*BundleAlert{{AlertName: "Errors", ContactName: "oncall"}},
+		Silences:           []*BundleSilence{{Matchers: matchers, EndsAt: time.Now().Add(time.Hour)}},
+		MaintenanceWindows: []*BundleMaintenanceWindow{{Name: "weekly", Matchers: matchers, Schedule: "0 2 * * SAT", DurationMinutes: 60}},
+	}
+	assert.Nil(t, valid.Validate())
+
+	for _, invalid := range []*AlertsBundle{
+		{Contacts: []*BundleContact{{Name: ""}}},
+		{Contacts: []*BundleContact{{Name: "oncall"}, {Name: "oncall"}}},
+		{Contacts: []*BundleContact{{Name: "oncall", Templates: map[string]NotificationTemplate{SlackContactType: {Title: "{{ .AlertName"}}}}},
+		{Alerts: []*BundleAlert{{AlertName: "Errors"}}},
+		{Alerts: []*BundleAlert{{AlertName: "Errors", ContactName: "oncall"}, {AlertName: "Errors", ContactName: "oncall"}}},
+		{Silences: []*BundleSilence{{Matchers: matchers}}},
+		{Silences: []*BundleSilence{{Matchers: matchers, EndsAt: time.Now().Add(time.Hour)}, {Matchers: matchers, EndsAt: time.Now().Add(time.Hour)}}},
+		{MaintenanceWindows: []*BundleMaintenanceWindow{{Name: "weekly", Matchers: matchers, Schedule: "every day", DurationMinutes: 60}}},
+	} {
+		assert.NotNil(t, invalid.Validate())
+	}
+}
+
+func Test_BundleAlertConversion(t *testing.T) {
+	alert := &AlertDetails{
+		AlertConfig: AlertConfig{
+			AlertName:    "High CPU",
+			AlertType:    AlertTypeMetrics,
+			ContactName:  "oncall",
+			Labels:       []AlertLabel{{LabelName: "team", LabelValue: "infra"}, {LabelName: "severity", LabelValue: "critical"}},
+			Value:        90,
+			EvalWindow:   5,
+			EvalInterval: 1,
+		},
+		MetricsQueryParamsString: `{"queries":[{"name":"a","query":"cpu_usage","qlType":"promql"}],"formulas":[{"formula":"a"}]}`,
+	}
+	bundleAlert, err := NewBundleAlert(alert)
+	assert.Nil(t, err)
+	assert.Nil(t, bundleAlert.QueryParams)
+	assert.Equal(t, map[string]string{"team": "infra", "severity": "critical"}, bundleAlert.Labels)
+
+	converted, err := bundleAlert.ToAlert(2, "c1")
+	assert.Nil(t, err)
+	assert.Equal(t, "c1", converted.ContactID)
+	assert.Equal(t, int64(2), converted.OrgId)
+	assert.Equal(t, []AlertLabel{{LabelName: "severity", LabelValue: "critical"}, {LabelName: "team", LabelValue: "infra"}}, converted.Labels)
+	assert.JSONEq(t, alert.MetricsQueryParamsString, converted.MetricsQueryParamsString)
+}
+
+func Test_GetBundleChangedFields(t *testing.T) {
+	current := &BundleMaintenanceWindow{Name: "weekly", Schedule: "0 2 * * SAT", DurationMinutes: 60, Comment: "patching"}
+	desired := &BundleMaintenanceWindow{Name: "weekly", Schedule: "0 3 * * SAT", DurationMinutes: 60}
+
+	fields, err := GetBundleChangedFields(current, desired)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"comment", "schedule"}, fields)
+
+	fields, err = GetBundleChangedFields(current, current)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(fields))
+}
+
+func Test_BundleSilenceName(t *testing.T) {
+	silence := &BundleSilence{Matchers: SilenceMatchers{
+		{Name: "service", Value: "api|web", Type: MatchRegexp},
+		{Name: "env", Value: "staging", Type: MatchEqual},
+	}}
+	assert.Equal(t, `{env="staging", service=~"api|web"}`, silence.GetName())
+}
+
+func Test_BundleContactSecrets(t *testing.T) {
+	contact := &Contact{
+		ContactName: "oncall",
+		Slack:       []SlackTokenConfig{{ChannelId: "C1", SlToken: "xoxb-1"}, {ChannelId: "C2", SlToken: "xoxb-2"}},
+		PagerDuty:   "routing-key",
+		Opsgenie:    []OpsgenieConfig{{ApiKey: "key-1", Priority: "P1"}},
+		Webhook:     []WebHookConfig{{Webhook: "https://hooks.example.com/a", Headers: JSONMap{"Authorization": "Bearer abc", "X-Empty": ""}}},
+		Teams:       []TeamsConfig{{WebhookUrl: "https://teams.example.com/1"}},
+	}
+	current := NewBundleContact(contact)
+	redacted := NewBundleContact(contact)
+	redacted.RedactSecrets()
+	assert.Equal(t, []BundleSlackConfig{{ChannelId: "C1", SlToken: BundleRedactedSecret}, {ChannelId: "C2", SlToken: BundleRedactedSecret}}, redacted.Slack)
+	assert.Equal(t, BundleRedactedSecret, redacted.PagerDuty)
+	assert.Equal(t, []OpsgenieConfig{{ApiKey: BundleRedactedSecret, Priority: "P1"}}, redacted.Opsgenie)
+	assert.Equal(t, []BundleWebhookConfig{{Webhook: "https://hooks.example.com/a", Headers: map[string]string{"Authorization": BundleRedactedSecret, "X-Empty": ""}}}, redacted.Webhook)
+	assert.Equal(t, []TeamsConfig{{WebhookUrl: BundleRedactedSecret}}, redacted.Teams)
+	assert.Equal(t, "key-1", contact.Opsgenie[0].ApiKey)
+	assert.Equal(t, "Bearer abc", contact.Webhook[0].Headers["Authorization"])
+	assert.Equal(t, "https://teams.example.com/1", contact.Teams[0].WebhookUrl)
+
+	// the stored secrets are kept for redacted and empty fields
+	redacted.Slack = []BundleSlackConfig{{ChannelId: "C2", SlToken: ""}, {ChannelId: "C3", SlToken: "xoxb-3"}}
+	redacted.PagerDuty = ""
+	assert.Nil(t, redacted.KeepSecrets(current))
+	assert.Equal(t, []BundleSlackConfig{{ChannelId: "C2", SlToken: "xoxb-2"}, {ChannelId: "C3", SlToken: "xoxb-3"}}, redacted.Slack)
+	assert.Equal(t, "routing-key", redacted.PagerDuty)
+	assert.Equal(t, []OpsgenieConfig{{ApiKey: "key-1", Priority: "P1"}}, redacted.Opsgenie)
+	assert.Equal(t, []BundleWebhookConfig{{Webhook: "https://hooks.example.com/a", Headers: map[string]string{"Authorization": "Bearer abc", "X-Empty": ""}}}, redacted.Webhook)
+	assert.Equal(t, []TeamsConfig{{WebhookUrl: "https://teams.example.com/1"}}, redacted.Teams)
+
+	// a redacted secret needs a stored one
+	for _, invalid := range []*BundleContact{
+		{Name: "new", Slack: []BundleSlackConfig{{ChannelId: "C9", SlToken: BundleRedactedSecret}}},
+		{Name: "new", Opsgenie: []OpsgenieConfig{{}, {ApiKey: BundleRedactedSecret}}},
+		{Name: "new", Webhook: []BundleWebhookConfig{{Webhook: "https://hooks.example.com/b", Headers: map[string]string{"Authorization": BundleRedactedSecret}}}},
+		{Name: "new", Webhook: []BundleWebhookConfig{{Webhook: "https://hooks.example.com/a", Headers: map[string]string{"X-Empty": BundleRedactedSecret}}}},
+		{Name: "new", Teams: []TeamsConfig{{}, {WebhookUrl: BundleRedactedSecret}}},
+	} {
+		assert.NotNil(t, invalid.KeepSecrets(current), invalid)
+	}
+	assert.NotNil(t, (&BundleContact{PagerDuty: BundleRedactedSecret}).KeepSecrets(nil))
+	assert.Nil(t, (&BundleContact{Slack: []BundleSlackConfig{{ChannelId: "C1"}}}).KeepSecrets(nil))
+}
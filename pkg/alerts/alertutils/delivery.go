@@ -0,0 +1,112 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertutils
+
+import "time"
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending" // waiting for its first attempt or a retry
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryDead      DeliveryStatus = "dead" // in the dead-letter list until it is resent or deleted
+)
+
+// DeliveryRequest is what a delivery sends on every attempt: a JSON POST to
+// the URL for webhooks, PagerDuty, Opsgenie and Teams, an attachment to a
+// Slack channel or an email.
+type DeliveryRequest struct {
+	Url     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Channel string            `json:"channel,omitempty"` // Slack channel
+	Token   string            `json:"token,omitempty"`   // Slack token
+	To      string            `json:"to,omitempty"`      // email address
+	Body    string            `json:"body"`              // JSON body, Slack attachment or email message
+
+	ResolvesIncident string `json:"resolves_incident,omitempty"` // dedup key of the PagerDuty or Opsgenie incident that the request resolves
+}
+
+/*
+NotificationDelivery is a notification to one destination of a contact point
+in the outbound queue. It is retried with exponential backoff until it is
+delivered, which removes it from the queue, or until it fails permanently and
+becomes a dead letter. The next attempt is in unix milliseconds so that due
+deliveries can be selected in SQL.
+*/
+type NotificationDelivery struct {
+	DeliveryId      string          `json:"delivery_id" gorm:"primaryKey"`
+	OrgId           int64           `json:"org_id" gorm:"index"`
+	ContactId       string          `json:"contact_id" gorm:"index"`
+	ContactType     string          `json:"contact_type"`
+	Destination     string          `json:"destination"` // email address, Slack channel or URL without its query
+	Subject         string          `json:"subject"`
+	Request         DeliveryRequest `json:"-" gorm:"type:text;serializer:json"`
+	Status          DeliveryStatus  `json:"status" gorm:"index"`
+	Attempts        int             `json:"attempts"`
+	NextAttemptAtMs int64           `json:"next_attempt_at" gorm:"index"`
+	CreatedAt       time.Time       `json:"created_at"`
+	LastAttemptAt   time.Time       `json:"last_attempt_at"`
+	LastStatusCode  int             `json:"last_status_code,omitempty"`
+	LastLatencyMs   int64           `json:"last_latency_ms"`
+	LastError       string          `json:"last_error,omitempty"`
+}
+
+func (NotificationDelivery) TableName() string {
+	return "notification_deliveries"
+}
+
+// NotificationDeliveryAttempt is an entry of the delivery log of a contact
+// point. The status is the status of the delivery after the attempt.
+type NotificationDeliveryAttempt struct {
+	ID          uint           `json:"-" gorm:"primaryKey;autoIncrement:true"`
+	DeliveryId  string         `json:"delivery_id" gorm:"index"`
+	OrgId       int64          `json:"org_id" gorm:"index"`
+	ContactId   string         `json:"contact_id" gorm:"index"`
+	ContactType string         `json:"contact_type"`
+	Destination string         `json:"destination"`
+	Subject     string         `json:"subject"`
+	Attempt     int            `json:"attempt"`
+	Status      DeliveryStatus `json:"status"`
+	StatusCode  int            `json:"status_code,omitempty"` // HTTP status code, or SMTP reply code of a failed email
+	LatencyMs   int64          `json:"latency_ms"`
+	Error       string         `json:"error,omitempty"`
+	AttemptedAt time.Time      `json:"attempted_at"`
+}
+
+func (NotificationDeliveryAttempt) TableName() string {
+	return "notification_delivery_attempts"
+}
+
+/*
+OpenIncident is a PagerDuty or Opsgenie incident of an alert instance that was
+triggered at a contact point and whose resolve was not delivered yet. The
+notification that resolves an instance can be suppressed, e.g. by the cooldown
+period, so the next notification of the alert resolves it instead.
+*/
+type OpenIncident struct {
+	ContactId   string `json:"contact_id" gorm:"primaryKey"`
+	ContactType string `json:"contact_type" gorm:"primaryKey"`
+	DedupKey    string `json:"dedup_key" gorm:"primaryKey"`
+	OrgId       int64  `json:"org_id"`
+	AlertId     string `json:"alert_id" gorm:"index"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func (OpenIncident) TableName() string {
+	return "open_incidents"
+}
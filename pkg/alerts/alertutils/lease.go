@@ -0,0 +1,57 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertutils
+
+import "time"
+
+// Name of the lease that elects the node that evaluates the alerts.
+const ALERT_EVALUATION_LEASE = "alert_evaluation"
+
+// AlertLease is held by the query node that evaluates the alerts. The holder
+// renews it before it expires; once it expired any node can take it over.
+// Times are unix milliseconds so that expiry can be compared in SQL.
+type AlertLease struct {
+	Name        string `json:"name" gorm:"primaryKey"`
+	Holder      string `json:"holder"`
+	Term        uint64 `json:"term"` // incremented whenever the lease changes holder
+	AcquiredAt  int64  `json:"acquired_at"`
+	RenewedAt   int64  `json:"renewed_at"`
+	ExpiresAtMs int64  `json:"expires_at"`
+}
+
+func (AlertLease) TableName() string {
+	return "alert_leases"
+}
+
+func (lease *AlertLease) IsHeldBy(holder string, now time.Time) bool {
+	return lease != nil && lease.Holder == holder && now.UnixMilli() < lease.ExpiresAtMs
+}
+
+// NotificationLogEntry is the last notification of an aggregation group, so a
+// node that takes over the evaluation does not notify the group again before
+// its group_interval or repeat_interval.
+type NotificationLogEntry struct {
+	GroupKey     string    `json:"group_key" gorm:"primaryKey"`
+	OrgId        int64     `json:"org_id" gorm:"index"`
+	LastNotified time.Time `json:"last_notified"`
+	Firing       []string  `json:"firing" gorm:"type:text;serializer:json"` // keys of the instances notified as firing
+}
+
+func (NotificationLogEntry) TableName() string {
+	return "notification_log"
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertutils
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+const SummaryAnnotation = "summary"
+
+// PrometheusRuleGroups is the Prometheus rule file format. Only the alerting
+// rules of the groups are imported as alerts.
+type PrometheusRuleGroups struct {
+	Groups []PrometheusRuleGroup `json:"groups" yaml:"groups"`
+}
+
+type PrometheusRuleGroup struct {
+	Name     string           `json:"name" yaml:"name"`
+	Interval string           `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Rules    []PrometheusRule `json:"rules" yaml:"rules"`
+}
+
+type PrometheusRule struct {
+	Alert       string            `json:"alert,omitempty" yaml:"alert,omitempty"`
+	Record      string            `json:"record,omitempty" yaml:"record,omitempty"`
+	Expr        string            `json:"expr" yaml:"expr"`
+	For         string            `json:"for,omitempty" yaml:"for,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+}
+
+// Templates of the annotations are given the same variables as in Prometheus.
+var annotationTemplateDefs = strings.Join([]string{
+	"{{$labels := .Labels}}",
+	"{{$externalLabels := .ExternalLabels}}",
+	"{{$externalURL := .ExternalURL}}",
+	"{{$value := .Value}}",
+}, "")
+
+type annotationTemplateData struct {
+	Labels         map[string]string
+	ExternalLabels map[string]string
+	ExternalURL    string
+	Value          float64
+}
+
+// The functions of the Prometheus annotation templates, except the ones that
+// run queries.
+var annotationTemplateFuncs = template.FuncMap{
+	"humanize":           humanizeNumber,
+	"humanize1024":       humanize1024,
+	"humanizeDuration":   humanizeDuration,
+	"humanizePercentage": humanizePercentage,
+	"humanizeTimestamp":  humanizeTimestamp,
+	"title":              cases.Title(language.Und, cases.NoLower).String,
+	"toUpper":            strings.ToUpper,
+	"toLower":            strings.ToLower,
+	"match":              regexp.MatchString,
+	"reReplaceAll": func(pattern string, repl string, text string) (string, error) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return "", err
+		}
+		return re.ReplaceAllString(text, repl), nil
+	},
+	"stripPort": func(hostPort string) string {
+		if idx := strings.LastIndexByte(hostPort, ':'); idx >= 0 && !strings.Contains(hostPort[idx:], "]") {
+			return hostPort[:idx]
+		}
+		return hostPort
+	},
+}
+
+// Formats a number with a binary prefix, e.g. 1536 as 1.5Ki.
+func humanize1024(value interface{}) (string, error) {
+	v, err := toFloat(value)
+	if err != nil {
+		return "", err
+	}
+	if math.Abs(v) <= 1 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Sprintf("%.4g", v), nil
+	}
+	prefix := ""
+	for _, p := range []string{"Ki", "Mi", "Gi", "Ti", "Pi", "Ei", "Zi", "Yi"} {
+		if math.Abs(v) < 1024 {
+			break
+		}
+		prefix = p
+		v /= 1024
+	}
+	return fmt.Sprintf("%.4g%s", v, prefix), nil
+}
+
+// Formats a ratio as a percentage, e.g. 0.125 as 12.5%.
+func humanizePercentage(value interface{}) (string, error) {
+	v, err := toFloat(value)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%.4g%%", v*100), nil
+}
+
+// Formats a unix timestamp in seconds as a UTC time.
+func humanizeTimestamp(value interface{}) (string, error) {
+	v, err := toFloat(value)
+	if err != nil {
+		return "", err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Sprintf("%.4g", v), nil
+	}
+	sec, frac := math.Modf(v)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC().String(), nil
+}
+
+/*
+Expands the Go templates of the annotations for an alert instance with the
+given labels and value, like Prometheus does for alerting rules. An annotation
+whose template fails is set to the error, so the notification still shows it.
+*/
+func ExpandAnnotations(annotations map[string]string, labels map[string]string, value float64, externalURL string) JSONMap {
+	if len(annotations) == 0 {
+		return nil
+	}
+
+	data := &annotationTemplateData{Labels: labels, ExternalLabels: map[string]string{}, ExternalURL: externalURL, Value: value}
+	if data.Labels == nil {
+		data.Labels = map[string]string{}
+	}
+	expanded := make(JSONMap, len(annotations))
+	for name, text := range annotations {
+		result, err := expandAnnotation(name, text, data)
+		if err != nil {
+			result = fmt.Sprintf("<error expanding template: %v>", err)
+		}
+		expanded[name] = result
+	}
+	return expanded
+}
+
+func expandAnnotation(name string, text string, data *annotationTemplateData) (string, error) {
+	tmpl, err := template.New("__alert_" + name).Funcs(annotationTemplateFuncs).Option("missingkey=zero").Parse(annotationTemplateDefs + text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertutils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ExpandAnnotations(t *testing.T) {
+	annotations := map[string]string{
+		"summary":     "Instance {{ $labels.instance }} is down",
+		"description": "Error rate is {{ $value | humanizePercentage }} on {{ $labels.job }}",
+		"static":      "runbook",
+		"broken":      "{{ $labels.instance",
+	}
+	labels := map[string]string{"instance": "web01:9100", "job": "node"}
+
+	expanded := ExpandAnnotations(annotations, labels, 0.125, "http://localhost:5122")
+	assert.Equal(t, "Instance web01:9100 is down", expanded["summary"])
+	assert.Equal(t, "Error rate is 12.5% on node", expanded["description"])
+	assert.Equal(t, "runbook", expanded["static"])
+	assert.True(t, strings.HasPrefix(expanded["broken"], "<error expanding template:"))
+
+	expanded = ExpandAnnotations(map[string]string{"summary": "{{ $value | humanize }} requests"}, nil, 1234567, "")
+	assert.Equal(t, "1.235M requests", expanded["summary"])
+
+	expanded = ExpandAnnotations(map[string]string{
+		"size":    "{{ 1536 | humanize1024 }}",
+		"at":      "{{ 1714564800 | humanizeTimestamp }}",
+		"missing": "{{ $labels.nothing }}",
+		"host":    "{{ $labels.instance | stripPort | toUpper }}",
+	}, labels, 0, "")
+	assert.Equal(t, "1.5Ki", expanded["size"])
+	assert.Equal(t, "2024-05-01 12:00:00 +0000 UTC", expanded["at"])
+	assert.Equal(t, "", expanded["missing"])
+	assert.Equal(t, "WEB01", expanded["host"])
+
+	assert.Nil(t, ExpandAnnotations(nil, labels, 1, ""))
+}
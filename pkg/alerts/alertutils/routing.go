@@ -0,0 +1,226 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertutils
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Grouping by this label groups by all the labels, i.e. every alert instance
+// is notified on its own.
+const GroupByAll = "..."
+
+const (
+	DEFAULT_GROUP_WAIT      = 30 * time.Second
+	DEFAULT_GROUP_INTERVAL  = 5 * time.Minute
+	DEFAULT_REPEAT_INTERVAL = 4 * time.Hour
+)
+
+// NotificationRoute is a node of the routing tree of an org. An alert
+// instance is routed to the deepest routes whose matchers match its labels;
+// the first matching child wins unless it has Continue set. Unset fields are
+// inherited from the parent route. When no route sets a contact point, the
+// contact point of the alert is used.
+type NotificationRoute struct {
+	Matchers       SilenceMatchers      `json:"matchers,omitempty"`
+	ContactID      string               `json:"contact_id,omitempty"`
+	GroupBy        []string             `json:"group_by,omitempty"`
+	GroupWait      string               `json:"group_wait,omitempty"`      // e.g. "30s"
+	GroupInterval  string               `json:"group_interval,omitempty"`  // e.g. "5m"
+	RepeatInterval string               `json:"repeat_interval,omitempty"` // e.g. "4h"
+	Continue       bool                 `json:"continue,omitempty"`
+	Routes         []*NotificationRoute `json:"routes,omitempty"`
+}
+
+// InhibitRule suppresses the notifications of the alert instances that match
+// TargetMatchers while an instance that matches SourceMatchers fires with the
+// same values for the Equal labels.
+type InhibitRule struct {
+	SourceMatchers SilenceMatchers `json:"source_matchers"`
+	TargetMatchers SilenceMatchers `json:"target_matchers"`
+	Equal          []string        `json:"equal,omitempty"`
+}
+
+// NotificationRouting is the routing tree and the inhibition rules of an org.
+// Alerts of orgs without one notify their contact point directly.
+type NotificationRouting struct {
+	OrgId        int64             `json:"org_id" gorm:"primaryKey;autoIncrement:false"`
+	Route        NotificationRoute `json:"route" gorm:"type:text;serializer:json"`
+	InhibitRules []*InhibitRule    `json:"inhibit_rules" gorm:"type:text;serializer:json"`
+	UpdatedAt    time.Time         `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+func (NotificationRouting) TableName() string {
+	return "notification_routing"
+}
+
+// MatchedRoute is a route that matched an alert instance, with the settings
+// inherited from its parents.
+type MatchedRoute struct {
+	Path           string // index of the route at each level of the tree, e.g. "0.2"
+	ContactID      string
+	GroupBy        []string
+	GroupWait      time.Duration
+	GroupInterval  time.Duration
+	RepeatInterval time.Duration
+}
+
+func (r *NotificationRouting) Validate() error {
+	if err := r.Route.validate("route"); err != nil {
+		return err
+	}
+	for i, rule := range r.InhibitRules {
+		if rule == nil {
+			return fmt.Errorf("inhibit rule %v is empty", i)
+		}
+		if err := rule.SourceMatchers.Validate(); err != nil {
+			return fmt.Errorf("inhibit rule %v: source matchers: %v", i, err)
+		}
+		if err := rule.TargetMatchers.Validate(); err != nil {
+			return fmt.Errorf("inhibit rule %v: target matchers: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (r *NotificationRoute) validate(name string) error {
+	for _, matcher := range r.Matchers {
+		if matcher == nil {
+			return fmt.Errorf("%v: matcher is empty", name)
+		}
+		if err := matcher.Validate(); err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	for _, interval := range []string{r.GroupWait, r.GroupInterval, r.RepeatInterval} {
+		if interval == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(interval); err != nil {
+			return fmt.Errorf("%v: invalid interval %v, err=%v", name, interval, err)
+		}
+	}
+	for i, child := range r.Routes {
+		if child == nil {
+			return fmt.Errorf("%v.%v: route is empty", name, i)
+		}
+		if err := child.validate(fmt.Sprintf("%v.%v", name, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match returns the routes that the labels are routed to. The root route
+// matches all labels.
+func (r *NotificationRouting) Match(labels map[string]string) []*MatchedRoute {
+	root := &MatchedRoute{
+		GroupBy:        []string{AlertNameLabel},
+		GroupWait:      DEFAULT_GROUP_WAIT,
+		GroupInterval:  DEFAULT_GROUP_INTERVAL,
+		RepeatInterval: DEFAULT_REPEAT_INTERVAL,
+	}
+	return r.Route.match(labels, root.inherit(&r.Route, "0"))
+}
+
+func (r *NotificationRoute) match(labels map[string]string, settings *MatchedRoute) []*MatchedRoute {
+	var matched []*MatchedRoute
+	for i, child := range r.Routes {
+		if len(child.Matchers) > 0 && !child.Matchers.Matches(labels) {
+			continue
+		}
+		matched = append(matched, child.match(labels, settings.inherit(child, settings.Path+"."+strconv.Itoa(i)))...)
+		if !child.Continue {
+			break
+		}
+	}
+	if len(matched) == 0 {
+		matched = append(matched, settings)
+	}
+	return matched
+}
+
+func (m *MatchedRoute) inherit(route *NotificationRoute, path string) *MatchedRoute {
+	child := *m
+	child.Path = path
+	if route.ContactID != "" {
+		child.ContactID = route.ContactID
+	}
+	if len(route.GroupBy) > 0 {
+		child.GroupBy = route.GroupBy
+	}
+	if d, err := time.ParseDuration(route.GroupWait); err == nil {
+		child.GroupWait = d
+	}
+	if d, err := time.ParseDuration(route.GroupInterval); err == nil {
+		child.GroupInterval = d
+	}
+	if d, err := time.ParseDuration(route.RepeatInterval); err == nil {
+		child.RepeatInterval = d
+	}
+	return &child
+}
+
+// GetGroupLabels returns the labels that the route groups the alert instance
+// by.
+func (m *MatchedRoute) GetGroupLabels(labels map[string]string) map[string]string {
+	groupLabels := make(map[string]string, len(m.GroupBy))
+	for _, name := range m.GroupBy {
+		if name == GroupByAll {
+			for k, v := range labels {
+				groupLabels[k] = v
+			}
+			return groupLabels
+		}
+		if value, ok := labels[name]; ok {
+			groupLabels[name] = value
+		}
+	}
+	return groupLabels
+}
+
+// IsInhibited returns true if a rule inhibits the target labels by one of the
+// firing source labels. An instance does not inhibit itself.
+func IsInhibited(rules []*InhibitRule, target map[string]string, firing []map[string]string) bool {
+	targetFingerprint := GetInstanceFingerprint(target)
+	for _, rule := range rules {
+		if !rule.TargetMatchers.Matches(target) {
+			continue
+		}
+		for _, source := range firing {
+			if !rule.SourceMatchers.Matches(source) || GetInstanceFingerprint(source) == targetFingerprint {
+				continue
+			}
+			if labelsEqual(rule.Equal, source, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func labelsEqual(names []string, a, b map[string]string) bool {
+	for _, name := range names {
+		if a[name] != b[name] {
+			return false
+		}
+	}
+	return true
+}
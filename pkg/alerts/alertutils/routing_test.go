@@ -0,0 +1,115 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertutils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NotificationRoutingMatch(t *testing.T) {
+	routing := &NotificationRouting{
+		Route: NotificationRoute{
+			ContactID: "default",
+			GroupBy:   []string{"alertname", "cluster"},
+			Routes: []*NotificationRoute{
+				{
+					Matchers:  SilenceMatchers{{Name: "team", Value: "db"}},
+					ContactID: "db-oncall",
+					GroupWait: "10s",
+					Continue:  true,
+					Routes: []*NotificationRoute{
+						{Matchers: SilenceMatchers{{Name: "severity", Value: "critical"}}, ContactID: "db-pager", RepeatInterval: "1h"},
+					},
+				},
+				{Matchers: SilenceMatchers{{Name: "team", Value: "db|infra", Type: MatchRegexp}}, ContactID: "infra", GroupBy: []string{GroupByAll}},
+				{Matchers: SilenceMatchers{{Name: "team", Value: "web"}}, ContactID: "web"},
+			},
+		},
+	}
+	assert.Nil(t, routing.Validate())
+
+	// unmatched labels go to the root route with the defaults
+	routes := routing.Match(map[string]string{"team": "mobile"})
+	assert.Equal(t, 1, len(routes))
+	assert.Equal(t, "0", routes[0].Path)
+	assert.Equal(t, "default", routes[0].ContactID)
+	assert.Equal(t, DEFAULT_GROUP_WAIT, routes[0].GroupWait)
+	assert.Equal(t, DEFAULT_REPEAT_INTERVAL, routes[0].RepeatInterval)
+
+	// the nested route inherits the group wait, and continue lets the next sibling match
+	routes = routing.Match(map[string]string{"team": "db", "severity": "critical"})
+	assert.Equal(t, 2, len(routes))
+	assert.Equal(t, "0.0.0", routes[0].Path)
+	assert.Equal(t, "db-pager", routes[0].ContactID)
+	assert.Equal(t, 10*time.Second, routes[0].GroupWait)
+	assert.Equal(t, time.Hour, routes[0].RepeatInterval)
+	assert.Equal(t, []string{"alertname", "cluster"}, routes[0].GroupBy)
+	assert.Equal(t, "0.1", routes[1].Path)
+	assert.Equal(t, "infra", routes[1].ContactID)
+
+	// the first matching route without continue stops the matching
+	routes = routing.Match(map[string]string{"team": "infra"})
+	assert.Equal(t, 1, len(routes))
+	assert.Equal(t, "infra", routes[0].ContactID)
+
+	// a route without a contact point uses the one of the alert
+	routing.Route.ContactID = ""
+	routes = routing.Match(map[string]string{})
+	assert.Equal(t, "", routes[0].ContactID)
+
+	routing.Route.Routes[2].GroupInterval = "five minutes"
+	assert.NotNil(t, routing.Validate())
+}
+
+func Test_GetGroupLabels(t *testing.T) {
+	labels := map[string]string{"alertname": "High CPU", "host": "web01", "cluster": "eu"}
+
+	route := &MatchedRoute{GroupBy: []string{"alertname", "cluster", "missing"}}
+	assert.Equal(t, map[string]string{"alertname": "High CPU", "cluster": "eu"}, route.GetGroupLabels(labels))
+
+	route.GroupBy = []string{GroupByAll}
+	assert.Equal(t, labels, route.GetGroupLabels(labels))
+}
+
+func Test_IsInhibited(t *testing.T) {
+	rules := []*InhibitRule{{
+		SourceMatchers: SilenceMatchers{{Name: "alertname", Value: "node_down"}},
+		TargetMatchers: SilenceMatchers{{Name: "alertname", Value: "service_down"}},
+		Equal:          []string{"host"},
+	}}
+	nodeDown := map[string]string{"alertname": "node_down", "host": "web01"}
+	serviceDownWeb01 := map[string]string{"alertname": "service_down", "host": "web01", "service": "nginx"}
+	serviceDownWeb02 := map[string]string{"alertname": "service_down", "host": "web02", "service": "nginx"}
+
+	firing := []map[string]string{nodeDown, serviceDownWeb01, serviceDownWeb02}
+	assert.True(t, IsInhibited(rules, serviceDownWeb01, firing))
+	assert.False(t, IsInhibited(rules, serviceDownWeb02, firing))
+	assert.False(t, IsInhibited(rules, nodeDown, firing))
+	assert.False(t, IsInhibited(rules, serviceDownWeb01, []map[string]string{serviceDownWeb01}))
+
+	// an instance that matches the source and the target does not inhibit itself
+	selfRules := []*InhibitRule{{
+		SourceMatchers: SilenceMatchers{{Name: "host", Value: "web01"}},
+		TargetMatchers: SilenceMatchers{{Name: "host", Value: "web01"}},
+	}}
+	assert.False(t, IsInhibited(selfRules, nodeDown, []map[string]string{nodeDown}))
+	assert.True(t, IsInhibited(selfRules, nodeDown, []map[string]string{serviceDownWeb01}))
+}
@@ -0,0 +1,292 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertutils
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// The label under which the name of an alert is matched by silences.
+const AlertNameLabel = "alertname"
+
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+type SilenceStatus string
+
+const (
+	SilencePending SilenceStatus = "pending"
+	SilenceActive  SilenceStatus = "active"
+	SilenceExpired SilenceStatus = "expired"
+)
+
+// SilenceMatcher matches the label Name of an alert instance against Value.
+// Regular expressions are anchored, as in Prometheus. A label that is not set
+// has the empty value.
+type SilenceMatcher struct {
+	Name  string    `json:"name"`
+	Value string    `json:"value"`
+	Type  MatchType `json:"type"`
+
+	re *regexp.Regexp
+}
+
+type SilenceMatchers []*SilenceMatcher
+
+func (m SilenceMatchers) Value() (driver.Value, error) {
+	return json.Marshal(m)
+}
+
+func (m *SilenceMatchers) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*m = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), m)
+	case []byte:
+		return json.Unmarshal(v, m)
+	}
+	return fmt.Errorf("SilenceMatchers Scan: failed to assert database value as []byte")
+}
+
+// Silence suppresses the notifications of the alert instances whose labels
+// match all of its matchers, between StartsAt and EndsAt.
+type Silence struct {
+	SilenceId string          `json:"silence_id" gorm:"primaryKey"`
+	Matchers  SilenceMatchers `json:"matchers" gorm:"type:text"`
+	StartsAt  time.Time       `json:"starts_at"`
+	EndsAt    time.Time       `json:"ends_at"`
+	CreatedBy string          `json:"created_by"`
+	Comment   string          `json:"comment"`
+	CreatedAt time.Time       `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time       `json:"updated_at" gorm:"autoUpdateTime"`
+	OrgId     int64           `json:"org_id"`
+	Status    SilenceStatus   `json:"status" gorm:"-"` // computed when the silence is read
+}
+
+func (Silence) TableName() string {
+	return "silences"
+}
+
+// MaintenanceWindow silences the alert instances that match its matchers for
+// DurationMinutes from every start of the cron Schedule, e.g. "0 2 * * SAT"
+// for every Saturday at 02:00. The schedule is evaluated in Timezone, which
+// defaults to UTC.
+type MaintenanceWindow struct {
+	WindowId        string          `json:"window_id" gorm:"primaryKey"`
+	Name            string          `json:"name" gorm:"not null"`
+	Matchers        SilenceMatchers `json:"matchers" gorm:"type:text"`
+	Schedule        string          `json:"schedule"`
+	DurationMinutes uint64          `json:"duration_minutes"`
+	Timezone        string          `json:"timezone"`
+	CreatedBy       string          `json:"created_by"`
+	Comment         string          `json:"comment"`
+	CreatedAt       time.Time       `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt       time.Time       `json:"updated_at" gorm:"autoUpdateTime"`
+	OrgId           int64           `json:"org_id"`
+}
+
+func (MaintenanceWindow) TableName() string {
+	return "maintenance_windows"
+}
+
+func (m *SilenceMatcher) Validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("matcher has no label name")
+	}
+	switch m.Type {
+	case "":
+		m.Type = MatchEqual
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid regex %v for label %v, err=%v", m.Value, m.Name, err)
+		}
+		m.re = re
+	default:
+		return fmt.Errorf("invalid match type %v for label %v", m.Type, m.Name)
+	}
+	return nil
+}
+
+func (m *SilenceMatcher) Matches(labels map[string]string) bool {
+	value := labels[m.Name]
+	switch m.Type {
+	case MatchEqual, "":
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp, MatchNotRegexp:
+		if m.re == nil {
+			if err := m.Validate(); err != nil {
+				return false
+			}
+		}
+		return m.re.MatchString(value) == (m.Type == MatchRegexp)
+	}
+	return false
+}
+
+func (m SilenceMatchers) Validate() error {
+	if len(m) == 0 {
+		return fmt.Errorf("at least one matcher is required")
+	}
+	for _, matcher := range m {
+		if matcher == nil {
+			return fmt.Errorf("matcher is empty")
+		}
+		if err := matcher.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches returns true if all the matchers match the labels. No matchers
+// match nothing, so that an empty silence does not silence every alert.
+func (m SilenceMatchers) Matches(labels map[string]string) bool {
+	if len(m) == 0 {
+		return false
+	}
+	for _, matcher := range m {
+		if matcher == nil || !matcher.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Silence) Validate() error {
+	if err := s.Matchers.Validate(); err != nil {
+		return err
+	}
+	if s.EndsAt.IsZero() {
+		return fmt.Errorf("end time is required")
+	}
+	if !s.EndsAt.After(s.StartsAt) {
+		return fmt.Errorf("end time must be after the start time")
+	}
+	return nil
+}
+
+func (s *Silence) GetStatus(now time.Time) SilenceStatus {
+	if now.Before(s.StartsAt) {
+		return SilencePending
+	}
+	if now.Before(s.EndsAt) {
+		return SilenceActive
+	}
+	return SilenceExpired
+}
+
+func (s *Silence) IsActive(now time.Time) bool {
+	return s.GetStatus(now) == SilenceActive
+}
+
+func (w *MaintenanceWindow) Validate() error {
+	if w.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if err := w.Matchers.Validate(); err != nil {
+		return err
+	}
+	if w.DurationMinutes == 0 {
+		return fmt.Errorf("duration_minutes must be greater than zero")
+	}
+	_, err := w.getSchedule()
+	return err
+}
+
+func (w *MaintenanceWindow) getSchedule() (cron.Schedule, error) {
+	spec := w.Schedule
+	if w.Timezone != "" {
+		if _, err := time.LoadLocation(w.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid timezone %v, err=%v", w.Timezone, err)
+		}
+		spec = "CRON_TZ=" + w.Timezone + " " + spec
+	}
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %v, err=%v", w.Schedule, err)
+	}
+	return schedule, nil
+}
+
+// IsActive returns true if now is within DurationMinutes of a start of the
+// schedule.
+func (w *MaintenanceWindow) IsActive(now time.Time) bool {
+	schedule, err := w.getSchedule()
+	if err != nil || w.DurationMinutes == 0 {
+		return false
+	}
+	// Next returns the first start strictly after the given time, so this is
+	// the first start that is not more than the duration ago.
+	windowStart := now.Add(-time.Duration(w.DurationMinutes) * time.Minute)
+	return !schedule.Next(windowStart).After(now)
+}
+
+// GetSilenceLabels returns the labels that silences match for an instance of
+// the alert: the labels of the alert, the labels of the instance and the name
+// of the alert. An alertname label of the alert overrides its name, which keeps
+// the name of imported Prometheus rules that were renamed to be unique.
+func GetSilenceLabels(alert *AlertDetails, instanceLabels map[string]string) map[string]string {
+	labels := make(map[string]string, len(alert.Labels)+len(instanceLabels)+1)
+	for _, label := range alert.Labels {
+		labels[label.LabelName] = label.LabelValue
+	}
+	for name, value := range instanceLabels {
+		labels[name] = value
+	}
+	labels[AlertNameLabel] = alert.AlertName
+	for _, label := range alert.Labels {
+		if label.LabelName == AlertNameLabel {
+			labels[AlertNameLabel] = label.LabelValue
+		}
+	}
+	return labels
+}
+
+// IsSilenced returns true if an active silence or maintenance window matches
+// the labels.
+func IsSilenced(labels map[string]string, silences []*Silence, windows []*MaintenanceWindow, now time.Time) bool {
+	for _, silence := range silences {
+		if silence.IsActive(now) && silence.Matchers.Matches(labels) {
+			return true
+		}
+	}
+	for _, window := range windows {
+		if window.Matchers.Matches(labels) && window.IsActive(now) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertutils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SilenceMatchers(t *testing.T) {
+	labels := map[string]string{"alertname": "High CPU", "host": "web01", "env": "prod"}
+
+	matchers := SilenceMatchers{
+		{Name: "host", Value: "web0[1-3]", Type: MatchRegexp},
+		{Name: "env", Value: "staging", Type: MatchNotEqual},
+		{Name: "alertname", Value: "High CPU"},
+	}
+	assert.Nil(t, matchers.Validate())
+	assert.Equal(t, MatchEqual, matchers[2].Type)
+	assert.True(t, matchers.Matches(labels))
+
+	// regexes are anchored
+	assert.False(t, SilenceMatchers{{Name: "host", Value: "web", Type: MatchRegexp}}.Matches(labels))
+	assert.True(t, SilenceMatchers{{Name: "host", Value: "db.*", Type: MatchNotRegexp}}.Matches(labels))
+	assert.False(t, SilenceMatchers{{Name: "host", Value: "web.*", Type: MatchNotRegexp}}.Matches(labels))
+
+	// a missing label has the empty value
+	assert.True(t, SilenceMatchers{{Name: "team", Value: "", Type: MatchEqual}}.Matches(labels))
+	assert.True(t, SilenceMatchers{{Name: "team", Value: "infra", Type: MatchNotEqual}}.Matches(labels))
+
+	// no matchers match nothing
+	assert.False(t, SilenceMatchers{}.Matches(labels))
+
+	assert.NotNil(t, SilenceMatchers{}.Validate())
+	assert.NotNil(t, SilenceMatchers{{Name: "", Value: "x"}}.Validate())
+	assert.NotNil(t, SilenceMatchers{{Name: "host", Value: "(", Type: MatchRegexp}}.Validate())
+	assert.NotNil(t, SilenceMatchers{{Name: "host", Value: "x", Type: "=="}}.Validate())
+}
+
+func Test_SilenceStatus(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	silence := &Silence{
+		Matchers: SilenceMatchers{{Name: "host", Value: "web01"}},
+		StartsAt: now.Add(time.Hour),
+		EndsAt:   now.Add(2 * time.Hour),
+	}
+	assert.Nil(t, silence.Validate())
+	assert.Equal(t, SilencePending, silence.GetStatus(now))
+	assert.Equal(t, SilenceActive, silence.GetStatus(now.Add(time.Hour)))
+	assert.Equal(t, SilenceExpired, silence.GetStatus(now.Add(2*time.Hour)))
+
+	silence.EndsAt = silence.StartsAt
+	assert.NotNil(t, silence.Validate())
+}
+
+func Test_MaintenanceWindowIsActive(t *testing.T) {
+	// every Saturday from 02:00 to 04:00
+	window := &MaintenanceWindow{
+		Name:            "weekly patching",
+		Matchers:        SilenceMatchers{{Name: "env", Value: "prod"}},
+		Schedule:        "0 2 * * SAT",
+		DurationMinutes: 120,
+	}
+	assert.Nil(t, window.Validate())
+
+	saturday := time.Date(2024, 5, 4, 0, 0, 0, 0, time.UTC)
+	assert.False(t, window.IsActive(saturday.Add(time.Hour+59*time.Minute)))
+	assert.True(t, window.IsActive(saturday.Add(2*time.Hour)))
+	assert.True(t, window.IsActive(saturday.Add(3*time.Hour+59*time.Minute)))
+	assert.False(t, window.IsActive(saturday.Add(4*time.Hour)))
+	assert.False(t, window.IsActive(saturday.Add(26*time.Hour)))
+
+	// the schedule is evaluated in the timezone of the window
+	window.Timezone = "Asia/Kolkata"
+	assert.Nil(t, window.Validate())
+	// 02:00 IST is 20:30 UTC on Friday
+	assert.True(t, window.IsActive(saturday.Add(-2*time.Hour-30*time.Minute)))
+	assert.False(t, window.IsActive(saturday.Add(2*time.Hour)))
+
+	window.Timezone = "Nowhere/Invalid"
+	assert.NotNil(t, window.Validate())
+	window.Timezone = ""
+	window.Schedule = "not a schedule"
+	assert.NotNil(t, window.Validate())
+	assert.False(t, window.IsActive(saturday.Add(2*time.Hour)))
+}
+
+func Test_IsSilenced(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	alert := &AlertDetails{AlertConfig: AlertConfig{
+		AlertName: "High CPU",
+		Labels:    []AlertLabel{{LabelName: "team", LabelValue: "infra"}},
+	}}
+	labels := GetSilenceLabels(alert, map[string]string{"host": "web01"})
+	assert.Equal(t, map[string]string{"alertname": "High CPU", "team": "infra", "host": "web01"}, labels)
+
+	// an alertname label of the alert overrides its name
+	renamed := &AlertDetails{AlertConfig: AlertConfig{
+		AlertName: "HighCPU (node)",
+		Labels:    []AlertLabel{{LabelName: "alertname", LabelValue: "HighCPU"}},
+	}}
+	assert.Equal(t, map[string]string{"alertname": "HighCPU", "host": "web01"}, GetSilenceLabels(renamed, map[string]string{"host": "web01"}))
+
+	active := &Silence{Matchers: SilenceMatchers{{Name: "team", Value: "infra"}}, StartsAt: now.Add(-time.Minute), EndsAt: now.Add(time.Minute)}
+	expired := &Silence{Matchers: SilenceMatchers{{Name: "host", Value: "web01"}}, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(-time.Minute)}
+	assert.True(t, IsSilenced(labels, []*Silence{active}, nil, now))
+	assert.False(t, IsSilenced(labels, []*Silence{expired}, nil, now))
+
+	window := &MaintenanceWindow{Matchers: SilenceMatchers{{Name: "alertname", Value: "High.*", Type: MatchRegexp}}, Schedule: "0 12 * * *", DurationMinutes: 30}
+	assert.True(t, IsSilenced(labels, []*Silence{expired}, []*MaintenanceWindow{window}, now))
+	assert.False(t, IsSilenced(labels, nil, []*MaintenanceWindow{window}, now.Add(time.Hour)))
+}
@@ -0,0 +1,310 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	sutils "github.com/siglens/siglens/pkg/segment/utils"
+)
+
+// The contact point types that a notification template can be set for.
+const (
+	EmailContactType     = "email"
+	SlackContactType     = "slack"
+	WebhookContactType   = "webhook"
+	PagerDutyContactType = "pager_duty"
+	OpsgenieContactType  = "opsgenie"
+	TeamsContactType     = "teams"
+)
+
+var contactTypes = []string{EmailContactType, SlackContactType, WebhookContactType, PagerDutyContactType,
+	OpsgenieContactType, TeamsContactType}
+
+// NotificationTemplate is a Go text/template for the title and the body of the
+// notifications sent to one type of contact point. An empty title or body
+// keeps the default one.
+type NotificationTemplate struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+// NotificationTemplateData is what a notification template is executed with.
+type NotificationTemplateData struct {
+	AlertId        string
+	AlertName      string
+	State          string // firing or normal
+	Title          string // the default title
+	Message        string // the message of the alert, with its placeholders resolved
+	Labels         map[string]string
+	GroupLabels    map[string]string // labels of the aggregation group of a routed notification
+	Condition      string            // e.g. "is above 42"
+	Threshold      float64
+	QueryLanguage  string
+	QueryText      string
+	Link           string // the link to the results of the query
+	NumEvaluations uint64
+	Instances      []*TemplateInstance
+	Firing         []*TemplateInstance
+	Resolved       []*TemplateInstance
+	Results        []map[string]interface{} // the first rows of the result of the query
+}
+
+type TemplateInstance struct {
+	Labels      map[string]string
+	Annotations map[string]string
+	Value       float64
+	Baseline    *float64 // set for anomaly conditions
+	Score       *float64
+	State       string
+	Fingerprint string
+}
+
+var notificationTemplateFuncs = template.FuncMap{
+	"humanize":         humanizeNumber,
+	"humanizeBytes":    humanizeBytes,
+	"humanizeDuration": humanizeDuration,
+	"truncate":         TruncateText,
+	"join":             strings.Join,
+	"upper":            strings.ToUpper,
+	"lower":            strings.ToLower,
+	"trim":             strings.TrimSpace,
+	"formatLabels":     FormatInstanceLabels,
+	"default":          defaultValue,
+	"toJson":           toJson,
+	"columns":          getResultColumns,
+}
+
+func GetStateName(state AlertState) string {
+	switch state {
+	case Firing:
+		return "firing"
+	case Pending:
+		return "pending"
+	case Normal:
+		return "normal"
+	}
+	return "inactive"
+}
+
+func NewTemplateInstance(instance *AlertInstance) *TemplateInstance {
+	return &TemplateInstance{
+		Labels:      instance.Labels,
+		Annotations: instance.Annotations,
+		Value:       instance.Value,
+		Baseline:    instance.Baseline,
+		Score:       instance.Score,
+		State:       GetStateName(instance.State),
+		Fingerprint: instance.Fingerprint,
+	}
+}
+
+// Sets the instances of the data and splits them into the firing and the
+// resolved ones.
+func (data *NotificationTemplateData) SetInstances(instances []*AlertInstance) {
+	data.Instances, data.Firing, data.Resolved = nil, nil, nil
+	for _, instance := range instances {
+		templateInstance := NewTemplateInstance(instance)
+		data.Instances = append(data.Instances, templateInstance)
+		if instance.State == Firing {
+			data.Firing = append(data.Firing, templateInstance)
+		} else {
+			data.Resolved = append(data.Resolved, templateInstance)
+		}
+	}
+}
+
+func parseNotificationTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=zero").Funcs(notificationTemplateFuncs).Parse(text)
+}
+
+// Returns an error if a template is for an unknown contact point type or does
+// not parse.
+func ValidateNotificationTemplates(templates map[string]NotificationTemplate) error {
+	for contactType, tmpl := range templates {
+		known := false
+		for _, name := range contactTypes {
+			known = known || name == contactType
+		}
+		if !known {
+			return fmt.Errorf("unknown contact point type %q for a template, it should be one of %v",
+				contactType, strings.Join(contactTypes, ", "))
+		}
+		_, err := parseNotificationTemplate("title", tmpl.Title)
+		if err != nil {
+			return fmt.Errorf("invalid title template for %v: %v", contactType, err)
+		}
+		_, err = parseNotificationTemplate("body", tmpl.Body)
+		if err != nil {
+			return fmt.Errorf("invalid body template for %v: %v", contactType, err)
+		}
+	}
+	return nil
+}
+
+// Executes the template with the data. The default title and message of the
+// data are returned for an empty title or body template.
+func (tmpl NotificationTemplate) Render(data *NotificationTemplateData) (string, string, error) {
+	title, err := executeNotificationTemplate("title", tmpl.Title, data.Title, data)
+	if err != nil {
+		return "", "", fmt.Errorf("error executing title template: %v", err)
+	}
+	body, err := executeNotificationTemplate("body", tmpl.Body, data.Message, data)
+	if err != nil {
+		return "", "", fmt.Errorf("error executing body template: %v", err)
+	}
+	return strings.TrimSpace(title), strings.TrimSpace(body), nil
+}
+
+func executeNotificationTemplate(name string, text string, defaultText string, data *NotificationTemplateData) (string, error) {
+	if strings.TrimSpace(text) == "" {
+		return defaultText, nil
+	}
+	tmpl, err := parseNotificationTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case time.Duration:
+		return v.Seconds(), nil
+	}
+	return sutils.ParseHumanizedValueToFloat(value)
+}
+
+// Formats a number with an SI prefix, e.g. 1234567 as 1.235M.
+func humanizeNumber(value interface{}) (string, error) {
+	v, err := toFloat(value)
+	if err != nil {
+		return "", err
+	}
+	if v == 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Sprintf("%.4g", v), nil
+	}
+	amount, prefix := humanize.ComputeSI(v)
+	return fmt.Sprintf("%.4g%s", amount, prefix), nil
+}
+
+// Formats a number of bytes, e.g. 1536 as 1.5 KiB.
+func humanizeBytes(value interface{}) (string, error) {
+	v, err := toFloat(value)
+	if err != nil {
+		return "", err
+	}
+	if v < 0 {
+		return "-" + humanize.IBytes(uint64(-v)), nil
+	}
+	return humanize.IBytes(uint64(v)), nil
+}
+
+// Formats a number of seconds or a time.Duration, e.g. 5430 as 1h 30m 30s.
+func humanizeDuration(value interface{}) (string, error) {
+	v, err := toFloat(value)
+	if err != nil {
+		return "", err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Sprintf("%.4g", v), nil
+	}
+	sign := ""
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	if v < 1 {
+		return fmt.Sprintf("%s%.4gms", sign, v*1000), nil
+	}
+
+	seconds := int64(v)
+	units := []struct {
+		suffix string
+		size   int64
+	}{{"d", 86400}, {"h", 3600}, {"m", 60}, {"s", 1}}
+	parts := make([]string, 0, len(units))
+	for _, unit := range units {
+		if count := seconds / unit.size; count > 0 {
+			parts = append(parts, fmt.Sprintf("%d%s", count, unit.suffix))
+			seconds -= count * unit.size
+		}
+	}
+	return sign + strings.Join(parts, " "), nil
+}
+
+// Cuts the text to at most maxLen characters, ending with "..." if it was cut.
+// The length comes first so that it can be piped, e.g. {{ .Message | truncate 100 }}.
+func TruncateText(maxLen int, text string) string {
+	runes := []rune(text)
+	if maxLen < 0 || len(runes) <= maxLen {
+		return text
+	}
+	if maxLen <= 3 {
+		return string(runes[:maxLen])
+	}
+	return string(runes[:maxLen-3]) + "..."
+}
+
+// Returns the value, or the default if the value is empty, e.g.
+// {{ .Labels.severity | default "critical" }}.
+func defaultValue(def interface{}, value interface{}) interface{} {
+	if value == nil || fmt.Sprint(value) == "" {
+		return def
+	}
+	return value
+}
+
+func toJson(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Returns the names of the columns of the result rows, sorted.
+func getResultColumns(rows []map[string]interface{}) []string {
+	seen := make(map[string]struct{})
+	columns := make([]string, 0)
+	for _, row := range rows {
+		for column := range row {
+			if _, ok := seen[column]; !ok {
+				seen[column] = struct{}{}
+				columns = append(columns, column)
+			}
+		}
+	}
+	sort.Strings(columns)
+	return columns
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package alertutils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestTemplateData() *NotificationTemplateData {
+	data := &NotificationTemplateData{
+		AlertName: "High CPU",
+		State:     "firing",
+		Title:     "High CPU",
+		Message:   "CPU is high",
+		Labels:    map[string]string{AlertNameLabel: "High CPU", "team": "web"},
+		Condition: GetConditionDescription(IsAbove, 90),
+		Link:      "http://localhost:5122/index.html",
+		Results: []map[string]interface{}{
+			{"host": "web01", "cpu": 97.5},
+			{"host": "web02", "cpu": 42.0},
+		},
+	}
+	data.SetInstances([]*AlertInstance{
+		{Fingerprint: "f1", Labels: map[string]string{"host": "web01"}, Value: 97.5, State: Firing},
+		{Fingerprint: "f2", Labels: map[string]string{"host": "web02"}, Value: 42, State: Normal},
+	})
+	return data
+}
+
+func Test_RenderNotificationTemplate(t *testing.T) {
+	data := getTestTemplateData()
+	assert.Equal(t, 2, len(data.Instances))
+	assert.Equal(t, 1, len(data.Firing))
+	assert.Equal(t, "normal", data.Resolved[0].State)
+
+	tmpl := NotificationTemplate{
+		Title: `[{{ .State | upper }}] {{ .AlertName }} ({{ len .Firing }})`,
+		Body: `{{ .AlertName }} {{ .Condition }} for team {{ .Labels.team }}.
+{{ range .Firing }}- {{ formatLabels .Labels }}: {{ .Value }}
+{{ end }}{{ range .Results }}{{ .host }}={{ .cpu }} {{ end }}
+{{ .Link }}`,
+	}
+	title, body, err := tmpl.Render(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "[FIRING] High CPU (1)", title)
+	assert.Equal(t, "High CPU is above 90 for team web.\n- host=web01: 97.5\nweb01=97.5 web02=42 \nhttp://localhost:5122/index.html", body)
+
+	// an empty template keeps the defaults
+	title, body, err = NotificationTemplate{}.Render(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "High CPU", title)
+	assert.Equal(t, "CPU is high", body)
+
+	// missing labels render empty
+	title, _, err = NotificationTemplate{Title: `{{ .Labels.severity | default "critical" }}`}.Render(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "critical", title)
+
+	_, _, err = NotificationTemplate{Body: `{{ humanizeBytes .AlertName }}`}.Render(data)
+	assert.NotNil(t, err)
+}
+
+func Test_ValidateNotificationTemplates(t *testing.T) {
+	assert.Nil(t, ValidateNotificationTemplates(nil))
+	assert.Nil(t, ValidateNotificationTemplates(map[string]NotificationTemplate{
+		SlackContactType: {Title: "{{ .AlertName }}"},
+		TeamsContactType: {Body: "{{ range .Firing }}{{ .Value }}{{ end }}"},
+	}))
+	assert.NotNil(t, ValidateNotificationTemplates(map[string]NotificationTemplate{"sms": {Title: "x"}}))
+	assert.NotNil(t, ValidateNotificationTemplates(map[string]NotificationTemplate{EmailContactType: {Title: "{{ .AlertName"}}))
+	assert.NotNil(t, ValidateNotificationTemplates(map[string]NotificationTemplate{EmailContactType: {Body: "{{ unknownFunc 1 }}"}}))
+}
+
+func Test_NotificationTemplateFuncs(t *testing.T) {
+	humanized, err := humanizeNumber(1234567)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.235M", humanized)
+	humanized, err = humanizeNumber("0.005")
+	assert.Nil(t, err)
+	assert.Equal(t, "5m", humanized)
+
+	humanized, err = humanizeBytes(1536)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.5 KiB", humanized)
+
+	humanized, err = humanizeDuration(5430)
+	assert.Nil(t, err)
+	assert.Equal(t, "1h 30m 30s", humanized)
+	humanized, err = humanizeDuration(90 * time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "1m 30s", humanized)
+	humanized, err = humanizeDuration(0.25)
+	assert.Nil(t, err)
+	assert.Equal(t, "250ms", humanized)
+	_, err = humanizeDuration("soon")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, "hello", TruncateText(10, "hello"))
+	assert.Equal(t, "hello w...", TruncateText(10, "hello world!"))
+	assert.Equal(t, []string{"cpu", "host"}, getResultColumns(getTestTemplateData().Results))
+}
@@ -65,6 +65,97 @@ type TracingConfig struct {
 	SamplingPercentage float64 `yaml:"samplingPercentage"` // sampling percentage for tracing (0-100)
 }
 
+// TailSamplingPolicy decides whether a buffered trace is kept. Type is one of
+// "status_code", "latency", "attribute" or "probabilistic".
+type TailSamplingPolicy struct {
+	Name               string   `yaml:"name"`
+	Type               string   `yaml:"type"`
+	LatencyThresholdMs uint64   `yaml:"latencyThresholdMs"` // used by "latency"
+	AttributeKey       string   `yaml:"attributeKey"`       // used by "attribute"
+	AttributeValues    []string `yaml:"attributeValues"`    // used by "attribute"; empty matches any value
+	Service            string   `yaml:"service"`            // used by "probabilistic"; empty matches all services
+	SamplingPercentage float64  `yaml:"samplingPercentage"` // used by "probabilistic" (0-100)
+}
+
+type TailSamplingConfig struct {
+	Enabled           bool                 `yaml:"enabled"`
+	DecisionWaitSecs  uint64               `yaml:"decisionWaitSecs"`  // how long to buffer spans of a trace before deciding
+	MaxBufferedTraces uint64               `yaml:"maxBufferedTraces"` // oldest traces are decided early once this is exceeded
+	Policies          []TailSamplingPolicy `yaml:"policies"`          // a trace is kept if any policy matches
+}
+
+// MetricsRollupConfig controls the 5m and 1h rollup tiers that are compacted
+// from rotated metrics blocks. A retention of 0 falls back to retentionHours.
+type MetricsRollupConfig struct {
+	Enabled               bool `yaml:"enabled"`
+	RawRetentionHours     int  `yaml:"rawRetentionHours"`     // raw datapoints are deleted after this, once rolled up
+	FiveMinRetentionHours int  `yaml:"fiveMinRetentionHours"` // retention of the 5m tier
+	OneHourRetentionHours int  `yaml:"oneHourRetentionHours"` // retention of the 1h tier
+}
+
+// MetricsLimitsConfig limits the number of active series. A series is active
+// when it had a datapoint within the active series window. Samples of new
+// series over a limit are rejected, or with the "drop_label" action, a tag key
+// over its limit is removed from the series instead. A limit of 0 is unlimited.
+type MetricsLimitsConfig struct {
+	Enabled                bool   `yaml:"enabled"`
+	MaxSeriesPerOrg        uint64 `yaml:"maxSeriesPerOrg"`
+	MaxSeriesPerMetric     uint64 `yaml:"maxSeriesPerMetric"`
+	MaxValuesPerTagKey     uint64 `yaml:"maxValuesPerTagKey"`     // distinct values of a tag key within a metric
+	Action                 string `yaml:"action"`                 // "reject" or "drop_label"
+	ActiveSeriesWindowMins uint64 `yaml:"activeSeriesWindowMins"` // series without datapoints for this long stop counting
+}
+
+// MetricRelabelRule is a Prometheus metric_relabel_configs entry. Empty
+// fields take the Prometheus defaults, e.g. the "replace" action.
+type MetricRelabelRule struct {
+	SourceLabels []string `json:"source_labels,omitempty" yaml:"source_labels,flow,omitempty"`
+	Separator    string   `json:"separator,omitempty" yaml:"separator,omitempty"`
+	Regex        string   `json:"regex,omitempty" yaml:"regex,omitempty"`
+	Modulus      uint64   `json:"modulus,omitempty" yaml:"modulus,omitempty"`
+	TargetLabel  string   `json:"target_label,omitempty" yaml:"target_label,omitempty"`
+	Replacement  *string  `json:"replacement,omitempty" yaml:"replacement,omitempty"` // nil means "$1"
+	Action       string   `json:"action,omitempty" yaml:"action,omitempty"`
+}
+
+// MetricRelabelConfig holds the relabel rules that are applied to every
+// metrics sample of an org before it is written.
+type MetricRelabelConfig struct {
+	OrgId int64               `yaml:"orgId"`
+	Rules []MetricRelabelRule `yaml:"rules"`
+}
+
+// ScrapeConfig enables pulling Prometheus /metrics targets. The jobs are read
+// from ConfigFile, which uses the scrape_configs format of prometheus.yml.
+type ScrapeConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	ConfigFile string `yaml:"configFile"` // file with the global and scrape_configs sections
+}
+
+// StatsdConfig enables the StatsD and DogStatsD listener. Metrics are
+// aggregated in memory and written once every flush interval.
+type StatsdConfig struct {
+	Enabled           bool      `yaml:"enabled"`
+	UDPAddress        string    `yaml:"udpAddress"`        // e.g. ":8125"; empty disables UDP
+	TCPAddress        string    `yaml:"tcpAddress"`        // e.g. ":8125"; empty disables TCP
+	FlushIntervalSecs uint64    `yaml:"flushIntervalSecs"` // how often aggregated metrics are written
+	Percentiles       []float64 `yaml:"percentiles"`       // percentiles written for timers, histograms and distributions
+	GaugeTTLSecs      uint64    `yaml:"gaugeTTLSecs"`      // gauges not updated for this long stop being written
+	OrgId             int64     `yaml:"orgId"`             // org that the metrics are written to
+}
+
+// GraphiteConfig enables the Carbon compatible listener. Each template is
+// "[filter] template [tag1=value1,tag2=value2]" and maps dotted paths to a
+// metric name and labels; the first template whose filter matches is used.
+type GraphiteConfig struct {
+	Enabled       bool     `yaml:"enabled"`
+	TCPAddress    string   `yaml:"tcpAddress"`    // plaintext protocol, e.g. ":2003"; empty disables it
+	UDPAddress    string   `yaml:"udpAddress"`    // plaintext protocol, e.g. ":2003"; empty disables it
+	PickleAddress string   `yaml:"pickleAddress"` // pickle protocol, e.g. ":2004"; empty disables it
+	Templates     []string `yaml:"templates"`     // path to metric name and labels mapping
+	OrgId         int64    `yaml:"orgId"`         // org that the metrics are written to
+}
+
 type AlertConfig struct {
 	Enabled  bool   `yaml:"enabled"`
 	Provider string `yaml:"provider"`
@@ -145,11 +236,18 @@ type Configuration struct {
 	TLS                         TLSConfig `yaml:"tls"`            // TLS related config
 	CompressStatic              string    `yaml:"compressStatic"` // compress static files
 	CompressStaticConverted     bool
-	Tracing                     TracingConfig  `yaml:"tracing"` // Tracing related config
-	EmailConfig                 EmailConfig    `yaml:"emailConfig"`
-	DatabaseConfig              DatabaseConfig `yaml:"minionSearch"`
-	MemoryConfig                MemoryConfig   `yaml:"memoryLimits"`
-	MaxAllowedColumns           uint64         `yaml:"maxAllowedColumns"`
+	Tracing                     TracingConfig         `yaml:"tracing"`              // Tracing related config
+	TailSampling                TailSamplingConfig    `yaml:"tailSampling"`         // tail-based sampling of ingested OTLP traces
+	MetricsRollup               MetricsRollupConfig   `yaml:"metricsRollup"`        // downsampled rollup tiers of metrics
+	Scrape                      ScrapeConfig          `yaml:"scrape"`               // pull based collection of Prometheus targets
+	Statsd                      StatsdConfig          `yaml:"statsd"`               // StatsD and DogStatsD listener
+	Graphite                    GraphiteConfig        `yaml:"graphite"`             // Carbon plaintext and pickle listener
+	MetricsLimits               MetricsLimitsConfig   `yaml:"metricsLimits"`        // cardinality limits on new metrics series
+	MetricRelabelConfigs        []MetricRelabelConfig `yaml:"metricRelabelConfigs"` // relabel rules applied at ingest, per org
+	EmailConfig                 EmailConfig           `yaml:"emailConfig"`
+	DatabaseConfig              DatabaseConfig        `yaml:"minionSearch"`
+	MemoryConfig                MemoryConfig          `yaml:"memoryLimits"`
+	MaxAllowedColumns           uint64                `yaml:"maxAllowedColumns"`
 	UseNewPipelineConverted     bool
 	UseNewQueryPipeline         string `yaml:"isNewQueryPipelineEnabled"`
 	QueryTimeoutSecs            int    `yaml:"queryTimeoutSecs"`
@@ -122,6 +122,31 @@ const (
 
 const DEFAULT_DISK_THRESHOLD_PERCENT uint64 = 95
 
+const (
+	DEFAULT_TAIL_SAMPLING_DECISION_WAIT_SECS  = 10
+	DEFAULT_TAIL_SAMPLING_MAX_BUFFERED_TRACES = 50_000
+)
+
+const (
+	DEFAULT_STATSD_UDP_ADDRESS         = ":8125"
+	DEFAULT_STATSD_FLUSH_INTERVAL_SECS = 10
+	DEFAULT_STATSD_GAUGE_TTL_SECS      = 300
+)
+
+var DEFAULT_STATSD_PERCENTILES = []float64{50, 90, 95, 99}
+
+const (
+	DEFAULT_GRAPHITE_TCP_ADDRESS    = ":2003"
+	DEFAULT_GRAPHITE_PICKLE_ADDRESS = ":2004"
+)
+
+const (
+	METRICS_LIMITS_ACTION_REJECT     = "reject"
+	METRICS_LIMITS_ACTION_DROP_LABEL = "drop_label"
+
+	DEFAULT_ACTIVE_SERIES_WINDOW_MINS = 60
+)
+
 func init() {
 	parallelism = int64(runtime.GOMAXPROCS(0))
 	if parallelism <= 1 {
@@ -529,6 +554,116 @@ func GetTraceSamplingPercentage() float64 {
 	return runningConfig.Tracing.SamplingPercentage
 }
 
+func IsTailSamplingEnabled() bool {
+	return runningConfig.TailSampling.Enabled
+}
+
+func IsMetricsRollupEnabled() bool {
+	return runningConfig.MetricsRollup.Enabled
+}
+
+// Returns the rollup config with every unset retention replaced by
+// retentionHours.
+func GetMetricsRollupConfig() common.MetricsRollupConfig {
+	rollupConfig := runningConfig.MetricsRollup
+	if rollupConfig.RawRetentionHours <= 0 {
+		rollupConfig.RawRetentionHours = runningConfig.RetentionHours
+	}
+	if rollupConfig.FiveMinRetentionHours <= 0 {
+		rollupConfig.FiveMinRetentionHours = runningConfig.RetentionHours
+	}
+	if rollupConfig.OneHourRetentionHours <= 0 {
+		rollupConfig.OneHourRetentionHours = runningConfig.RetentionHours
+	}
+	return rollupConfig
+}
+
+func IsScrapeEnabled() bool {
+	return runningConfig.Scrape.Enabled
+}
+
+func GetScrapeConfigFile() string {
+	return runningConfig.Scrape.ConfigFile
+}
+
+func IsMetricsLimitsEnabled() bool {
+	return runningConfig.MetricsLimits.Enabled
+}
+
+// Returns the metrics limits config with the defaults filled in. An unknown
+// action falls back to rejecting samples.
+func GetMetricsLimitsConfig() common.MetricsLimitsConfig {
+	limitsConfig := runningConfig.MetricsLimits
+	if limitsConfig.Action != METRICS_LIMITS_ACTION_DROP_LABEL {
+		limitsConfig.Action = METRICS_LIMITS_ACTION_REJECT
+	}
+	if limitsConfig.ActiveSeriesWindowMins == 0 {
+		limitsConfig.ActiveSeriesWindowMins = DEFAULT_ACTIVE_SERIES_WINDOW_MINS
+	}
+	return limitsConfig
+}
+
+// Returns the relabel rules of the org from the config file.
+func GetMetricRelabelRules(orgid int64) []common.MetricRelabelRule {
+	var rules []common.MetricRelabelRule
+	for _, relabelConfig := range runningConfig.MetricRelabelConfigs {
+		if relabelConfig.OrgId == orgid {
+			rules = append(rules, relabelConfig.Rules...)
+		}
+	}
+	return rules
+}
+
+func IsStatsdEnabled() bool {
+	return runningConfig.Statsd.Enabled
+}
+
+// Returns the statsd config with the defaults filled in. UDP listens on
+// DEFAULT_STATSD_UDP_ADDRESS when neither address is set.
+func GetStatsdConfig() common.StatsdConfig {
+	statsdConfig := runningConfig.Statsd
+	if statsdConfig.UDPAddress == "" && statsdConfig.TCPAddress == "" {
+		statsdConfig.UDPAddress = DEFAULT_STATSD_UDP_ADDRESS
+	}
+	if statsdConfig.FlushIntervalSecs == 0 {
+		statsdConfig.FlushIntervalSecs = DEFAULT_STATSD_FLUSH_INTERVAL_SECS
+	}
+	if len(statsdConfig.Percentiles) == 0 {
+		statsdConfig.Percentiles = DEFAULT_STATSD_PERCENTILES
+	}
+	if statsdConfig.GaugeTTLSecs == 0 {
+		statsdConfig.GaugeTTLSecs = DEFAULT_STATSD_GAUGE_TTL_SECS
+	}
+	return statsdConfig
+}
+
+func IsGraphiteEnabled() bool {
+	return runningConfig.Graphite.Enabled
+}
+
+// Returns the graphite config with the defaults filled in. The plaintext
+// listener uses DEFAULT_GRAPHITE_TCP_ADDRESS and the pickle listener uses
+// DEFAULT_GRAPHITE_PICKLE_ADDRESS when no address is set.
+func GetGraphiteConfig() common.GraphiteConfig {
+	graphiteConfig := runningConfig.Graphite
+	if graphiteConfig.TCPAddress == "" && graphiteConfig.UDPAddress == "" && graphiteConfig.PickleAddress == "" {
+		graphiteConfig.TCPAddress = DEFAULT_GRAPHITE_TCP_ADDRESS
+		graphiteConfig.PickleAddress = DEFAULT_GRAPHITE_PICKLE_ADDRESS
+	}
+	return graphiteConfig
+}
+
+func GetTailSamplingConfig() common.TailSamplingConfig {
+	tsConfig := runningConfig.TailSampling
+	if tsConfig.DecisionWaitSecs == 0 {
+		tsConfig.DecisionWaitSecs = DEFAULT_TAIL_SAMPLING_DECISION_WAIT_SECS
+	}
+	if tsConfig.MaxBufferedTraces == 0 {
+		tsConfig.MaxBufferedTraces = DEFAULT_TAIL_SAMPLING_MAX_BUFFERED_TRACES
+	}
+	return tsConfig
+}
+
 // returns SmtpHost, SmtpPort, SenderEmail and GmailAppPassword
 func GetEmailConfig() (string, int, string, string) {
 	return runningConfig.EmailConfig.SmtpHost, runningConfig.EmailConfig.SmtpPort, runningConfig.EmailConfig.SenderEmail, runningConfig.EmailConfig.GmailAppPassword
@@ -29,7 +29,7 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-var excludedInternalIndices = [...]string{"traces", "red-traces", "service-dependency", "metrics"}
+var excludedInternalIndices = [...]string{"traces", "red-traces", "service-dependency", "service-dependency-edges", "metrics"}
 
 func IndicesBody(indexName string) esutils.ResolveIndexEntry {
 	return esutils.ResolveIndexEntry{Name: indexName, Attributes: []string{"open"}}
@@ -38,4 +38,5 @@ const (
 	INGEST_FUNC_OTLP_METRICS
 	INGEST_FUNC_FAKE_DATA
 	INGEST_FUNC_LOKI
+	INGEST_FUNC_INFLUX_METRICS
 )
@@ -48,7 +48,7 @@ const (
 	NameSeparator = "--\x09--"
 )
 
-var excludedInternalIndices = [...]string{"traces", "red-traces", "service-dependency"}
+var excludedInternalIndices = [...]string{"traces", "red-traces", "service-dependency", "service-dependency-edges"}
 
 // GetTraceStatsForAllSegments retrieves all trace-related statistics.
 func GetTraceStatsForAllSegments(myid int64) (utils.AllIndexesStats, int64, float64, float64, map[string]struct{}) {
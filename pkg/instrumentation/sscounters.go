@@ -60,3 +60,108 @@ var S3_DELETED, _ = meter.Int64Counter(
 	"ss.s3deleted.received",
 	metric.WithUnit("1"),
 	metric.WithDescription("s3 deletes received"))
+
+var TAIL_SAMPLING_KEPT_TRACES, _ = meter.Int64Counter(
+	"ss.tailsampling.kept.traces",
+	metric.WithUnit("1"),
+	metric.WithDescription("traces kept by tail sampling"))
+
+var TAIL_SAMPLING_DROPPED_TRACES, _ = meter.Int64Counter(
+	"ss.tailsampling.dropped.traces",
+	metric.WithUnit("1"),
+	metric.WithDescription("traces dropped by tail sampling"))
+
+var TAIL_SAMPLING_KEPT_SPANS, _ = meter.Int64Counter(
+	"ss.tailsampling.kept.spans",
+	metric.WithUnit("1"),
+	metric.WithDescription("spans kept by tail sampling"))
+
+var TAIL_SAMPLING_DROPPED_SPANS, _ = meter.Int64Counter(
+	"ss.tailsampling.dropped.spans",
+	metric.WithUnit("1"),
+	metric.WithDescription("spans dropped by tail sampling"))
+
+var RECORDING_RULE_EVALUATIONS, _ = meter.Int64Counter(
+	"ss.recordingrules.evaluations",
+	metric.WithUnit("1"),
+	metric.WithDescription("recording rule evaluations"))
+
+var RECORDING_RULE_EVALUATION_FAILURES, _ = meter.Int64Counter(
+	"ss.recordingrules.evaluation.failures",
+	metric.WithUnit("1"),
+	metric.WithDescription("recording rule evaluations that failed"))
+
+var RECORDING_RULE_SAMPLES, _ = meter.Int64Counter(
+	"ss.recordingrules.samples",
+	metric.WithUnit("1"),
+	metric.WithDescription("samples written by recording rules"))
+
+var RECORDING_RULE_STALE_SERIES, _ = meter.Int64Counter(
+	"ss.recordingrules.stale.series",
+	metric.WithUnit("1"),
+	metric.WithDescription("recording rule output series that went stale"))
+
+var RECORDING_RULE_MISSED_ITERATIONS, _ = meter.Int64Counter(
+	"ss.recordingrules.missed.iterations",
+	metric.WithUnit("1"),
+	metric.WithDescription("rule group evaluations skipped because the previous one was still running"))
+
+var METRICS_ROLLUP_BLOCKS_COMPACTED, _ = meter.Int64Counter(
+	"ss.metrics.rollup.blocks.compacted",
+	metric.WithUnit("1"),
+	metric.WithDescription("rotated metrics blocks rolled up into the downsampling tiers"))
+
+var METRICS_ROLLUP_BLOCKS_QUERIED, _ = meter.Int64Counter(
+	"ss.metrics.rollup.blocks.queried",
+	metric.WithUnit("1"),
+	metric.WithDescription("rotated metrics blocks read from a rollup tier instead of raw datapoints"))
+
+var SCRAPE_REQUESTS, _ = meter.Int64Counter(
+	"ss.scrape.requests",
+	metric.WithUnit("1"),
+	metric.WithDescription("scrapes of Prometheus targets"))
+
+var SCRAPE_FAILURES, _ = meter.Int64Counter(
+	"ss.scrape.failures",
+	metric.WithUnit("1"),
+	metric.WithDescription("scrapes of Prometheus targets that failed"))
+
+var SCRAPE_SAMPLES, _ = meter.Int64Counter(
+	"ss.scrape.samples",
+	metric.WithUnit("1"),
+	metric.WithDescription("samples written from scraped Prometheus targets"))
+
+var STATSD_INVALID_LINES, _ = meter.Int64Counter(
+	"ss.statsd.invalid.lines",
+	metric.WithUnit("1"),
+	metric.WithDescription("StatsD lines that could not be parsed"))
+
+var STATSD_FLUSHED_METRICS, _ = meter.Int64Counter(
+	"ss.statsd.flushed.metrics",
+	metric.WithUnit("1"),
+	metric.WithDescription("aggregated StatsD datapoints written on flushes"))
+
+var GRAPHITE_INVALID_LINES, _ = meter.Int64Counter(
+	"ss.graphite.invalid.lines",
+	metric.WithUnit("1"),
+	metric.WithDescription("Graphite plaintext lines and pickle payloads that could not be parsed"))
+
+var GRAPHITE_WRITTEN_DATAPOINTS, _ = meter.Int64Counter(
+	"ss.graphite.written.datapoints",
+	metric.WithUnit("1"),
+	metric.WithDescription("Graphite datapoints written as metrics"))
+
+var METRICS_LIMITS_REJECTED_SAMPLES, _ = meter.Int64Counter(
+	"ss.metrics.limits.rejected.samples",
+	metric.WithUnit("1"),
+	metric.WithDescription("metrics samples rejected because their series is over a cardinality limit"))
+
+var METRICS_LIMITS_DROPPED_LABEL_SAMPLES, _ = meter.Int64Counter(
+	"ss.metrics.limits.dropped.label.samples",
+	metric.WithUnit("1"),
+	metric.WithDescription("metrics samples written without the tag keys that are over their cardinality limit"))
+
+var METRICS_RELABEL_DROPPED_SAMPLES, _ = meter.Int64Counter(
+	"ss.metrics.relabel.dropped.samples",
+	metric.WithUnit("1"),
+	metric.WithDescription("metrics samples dropped by the relabel rules of their org"))
@@ -83,6 +83,7 @@ const (
 	TotalCMISize
 	TotalCSGSize
 	PastMinuteActiveSeriesCount
+	TailSamplingBufferedTraces
 )
 
 var allSimpleGauges = map[Gauge]*simpleInt64Gauge{
@@ -191,6 +192,11 @@ var allSimpleGauges = map[Gauge]*simpleInt64Gauge{
 		unit:        "bytes",
 		description: "Total size of CSG files",
 	},
+	TailSamplingBufferedTraces: {
+		name:        "ss.tailsampling.buffered.traces",
+		unit:        "count",
+		description: "Number of traces buffered by tail sampling until they are decided",
+	},
 }
 
 var (
@@ -215,6 +221,7 @@ var (
 	SetTotalColumnCount            = makeGaugeSetter(TotalColumnCount)
 	SetTotalCMISize                = makeGaugeSetter(TotalCMISize)
 	SetTotalCSGSize                = makeGaugeSetter(TotalCSGSize)
+	SetTailSamplingBufferedTraces  = makeGaugeSetter(TailSamplingBufferedTraces)
 )
 
 func init() {
@@ -0,0 +1,438 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siglens/siglens/pkg/integrations/prometheus/promql"
+	rutils "github.com/siglens/siglens/pkg/readerUtils"
+	"github.com/siglens/siglens/pkg/segment/results/mresults"
+	"github.com/siglens/siglens/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// Number of points a series is downsampled to when maxDataPoints is not set.
+const DEFAULT_MAX_DATA_POINTS = 1000
+
+// Most series that a render request can return.
+const MAX_RENDER_SERIES = 10_000
+
+const DEFAULT_RENDER_FROM = "-24h"
+
+// RenderSeries is a series of the /render API in the json format. Datapoints
+// are [value, timestamp] pairs.
+type RenderSeries struct {
+	Target     string            `json:"target"`
+	Tags       map[string]string `json:"tags"`
+	Datapoints [][2]float64      `json:"datapoints"`
+}
+
+type tagExpression struct {
+	tag     string
+	negated bool
+	value   string
+	regex   *regexp.Regexp
+}
+
+/*
+Returns the nodes that match a Graphite glob in the format of the Graphite
+/metrics/find API. The format parameter is treejson, the default, or
+completer.
+*/
+func ProcessFindRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	query := string(ctx.FormValue("query"))
+	if query == "" {
+		utils.SetBadMsg(ctx, "query parameter is required")
+		return
+	}
+	format := string(ctx.FormValue("format"))
+	if format != "" && format != "treejson" && format != "completer" {
+		utils.SetBadMsg(ctx, fmt.Sprintf("unsupported format %q", format))
+		return
+	}
+
+	nodes, err := FindNodes(myid, query)
+	if err != nil {
+		utils.SetBadMsg(ctx, err.Error())
+		return
+	}
+
+	if format == "completer" {
+		metrics := make([]map[string]interface{}, 0, len(nodes))
+		for _, node := range nodes {
+			path := node.Id
+			if node.Leaf == 0 {
+				path += "."
+			}
+			metrics = append(metrics, map[string]interface{}{"path": path, "name": node.Text, "is_leaf": strconv.Itoa(node.Leaf)})
+		}
+		utils.WriteJsonResponse(ctx, map[string]interface{}{"metrics": metrics})
+	} else {
+		utils.WriteJsonResponse(ctx, nodes)
+	}
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+/*
+Returns the series of the targets in the format of the Graphite /render API
+with format=json. A target is a path glob, seriesByTag('tag=value', ...) or
+constantLine(value). from and until accept unix timestamps, "now" and relative
+times such as -1h; they default to the last 24 hours. The series are
+downsampled so that each one has at most maxDataPoints points.
+*/
+func ProcessRenderRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	format := string(ctx.FormValue("format"))
+	if format != "" && format != "json" {
+		utils.SetBadMsg(ctx, fmt.Sprintf("unsupported format %q, only json is supported", format))
+		return
+	}
+
+	var targets []string
+	for _, target := range ctx.QueryArgs().PeekMulti("target") {
+		targets = append(targets, string(target))
+	}
+	for _, target := range ctx.PostArgs().PeekMulti("target") {
+		targets = append(targets, string(target))
+	}
+	if len(targets) == 0 {
+		utils.SetBadMsg(ctx, "target parameter is required")
+		return
+	}
+
+	now := time.Now()
+	from, err := parseRenderTime(string(ctx.FormValue("from")), DEFAULT_RENDER_FROM, now)
+	if err != nil {
+		utils.SetBadMsg(ctx, err.Error())
+		return
+	}
+	until, err := parseRenderTime(string(ctx.FormValue("until")), "now", now)
+	if err != nil {
+		utils.SetBadMsg(ctx, err.Error())
+		return
+	}
+	if until <= from {
+		utils.SetBadMsg(ctx, "until must be after from")
+		return
+	}
+
+	maxDataPoints := DEFAULT_MAX_DATA_POINTS
+	if value := string(ctx.FormValue("maxDataPoints")); value != "" {
+		maxDataPoints, err = strconv.Atoi(value)
+		if err != nil || maxDataPoints <= 0 {
+			utils.SetBadMsg(ctx, fmt.Sprintf("invalid maxDataPoints %q", value))
+			return
+		}
+	}
+	step := getRenderStep(from, until, maxDataPoints)
+
+	result := make([]RenderSeries, 0)
+	for _, target := range targets {
+		series, err := renderTarget(target, from, until, step, myid)
+		if err != nil {
+			utils.SetBadMsg(ctx, err.Error())
+			return
+		}
+		result = append(result, series...)
+	}
+	utils.WriteJsonResponse(ctx, result)
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// Returns the step in seconds that gives at most maxDataPoints points.
+func getRenderStep(from, until uint32, maxDataPoints int) uint32 {
+	step := uint32(math.Ceil(float64(until-from) / float64(maxDataPoints)))
+	if step == 0 {
+		step = 1
+	}
+	return step
+}
+
+func renderTarget(target string, from, until, step uint32, myid int64) ([]RenderSeries, error) {
+	target = strings.TrimSpace(target)
+
+	var entries []*IndexEntry
+	switch {
+	case strings.HasPrefix(target, "constantLine(") && strings.HasSuffix(target, ")"):
+		arg := strings.TrimSuffix(strings.TrimPrefix(target, "constantLine("), ")")
+		value, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+		if err != nil {
+			return nil, fmt.Errorf("renderTarget: invalid constantLine value %q", arg)
+		}
+		return []RenderSeries{{
+			Target:     strconv.FormatFloat(value, 'f', -1, 64),
+			Tags:       map[string]string{"name": strconv.FormatFloat(value, 'f', -1, 64)},
+			Datapoints: [][2]float64{{value, float64(from)}, {value, float64(until)}},
+		}}, nil
+	case strings.HasPrefix(target, "seriesByTag(") && strings.HasSuffix(target, ")"):
+		args, err := parseFunctionArgs(strings.TrimSuffix(strings.TrimPrefix(target, "seriesByTag("), ")"))
+		if err != nil {
+			return nil, err
+		}
+		entries, err = matchSeriesByTag(myid, args)
+		if err != nil {
+			return nil, err
+		}
+	case strings.Contains(target, "("):
+		return nil, fmt.Errorf("renderTarget: unsupported function in target %q", target)
+	default:
+		var err error
+		entries, err = matchPathGlob(myid, target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(entries) > MAX_RENDER_SERIES {
+		return nil, fmt.Errorf("renderTarget: target %q matches %v series, more than the limit of %v", target, len(entries), MAX_RENDER_SERIES)
+	}
+	return renderEntries(entries, from, until, step, myid)
+}
+
+// Queries the metric series of the entries, one query per metric name, and
+// returns them in the order of the entries.
+func renderEntries(entries []*IndexEntry, from, until, step uint32, myid int64) ([]RenderSeries, error) {
+	byMetric := make(map[string]map[string]*IndexEntry)
+	for _, entry := range entries {
+		if byMetric[entry.MetricName] == nil {
+			byMetric[entry.MetricName] = make(map[string]*IndexEntry)
+		}
+		byMetric[entry.MetricName][labelsKey(entry.Labels)] = entry
+	}
+
+	datapoints := make(map[*IndexEntry][][2]float64, len(entries))
+	for mName, metricEntries := range byMetric {
+		qid := rutils.GetNextQid()
+		query := fmt.Sprintf("{__name__=%q}", mName)
+		res, _, _, err := promql.ExecuteRangeQuery(query, from, until, time.Duration(step)*time.Second, myid, qid)
+		if err != nil {
+			log.Errorf("qid=%v, renderEntries: failed to query metric=%v, err=%v", qid, mName, err)
+			return nil, fmt.Errorf("renderEntries: failed to query metric %v, err=%v", mName, err)
+		}
+		if res == nil {
+			continue
+		}
+		for seriesId, points := range res.Results {
+			labels := mresults.GetPromQLSeriesFormat(seriesId)
+			delete(labels, "__name__")
+			entry, ok := metricEntries[labelsKey(labels)]
+			if !ok {
+				continue
+			}
+			datapoints[entry] = append(datapoints[entry], sortedDatapoints(points)...)
+		}
+	}
+
+	series := make([]RenderSeries, 0, len(entries))
+	for _, entry := range entries {
+		tags := map[string]string{"name": entry.Path}
+		for _, tag := range entry.Tags {
+			tags[tag.Key] = tag.Value
+		}
+		points := datapoints[entry]
+		if points == nil {
+			points = [][2]float64{}
+		}
+		series = append(series, RenderSeries{
+			Target:     SeriesName(entry.Path, entry.Tags),
+			Tags:       tags,
+			Datapoints: points,
+		})
+	}
+	return series, nil
+}
+
+func sortedDatapoints(points map[uint32]float64) [][2]float64 {
+	timestamps := make([]uint32, 0, len(points))
+	for ts := range points {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	datapoints := make([][2]float64, 0, len(timestamps))
+	for _, ts := range timestamps {
+		datapoints = append(datapoints, [2]float64{points[ts], float64(ts)})
+	}
+	return datapoints
+}
+
+func labelsKey(labels map[string]string) string {
+	var sb strings.Builder
+	for _, tag := range labelsToTags(labels) {
+		sb.WriteString(tag.Key)
+		sb.WriteByte('=')
+		sb.WriteString(tag.Value)
+		sb.WriteByte(',')
+	}
+	return sb.String()
+}
+
+/*
+Returns the entries that match all the seriesByTag expressions. An expression
+is tag=value, tag!=value, tag=~regex or tag!=~regex, where the regex is
+anchored at the start of the value. The "name" tag is the path of the series,
+and a missing tag has an empty value.
+*/
+func matchSeriesByTag(orgid int64, args []string) ([]*IndexEntry, error) {
+	if len(args) == 0 {
+		return nil, errors.New("matchSeriesByTag: seriesByTag needs at least one expression")
+	}
+	expressions := make([]tagExpression, 0, len(args))
+	for _, arg := range args {
+		expr, err := parseTagExpression(arg)
+		if err != nil {
+			return nil, err
+		}
+		expressions = append(expressions, expr)
+	}
+
+	var matched []*IndexEntry
+	for _, entry := range getIndexEntries(orgid) {
+		if matchesTagExpressions(entry, expressions) {
+			matched = append(matched, entry)
+		}
+	}
+	return matched, nil
+}
+
+func parseTagExpression(expr string) (tagExpression, error) {
+	for _, op := range []string{"!=~", "=~", "!=", "="} {
+		idx := strings.Index(expr, op)
+		if idx <= 0 {
+			continue
+		}
+		te := tagExpression{tag: expr[:idx], negated: strings.HasPrefix(op, "!"), value: expr[idx+len(op):]}
+		if strings.HasSuffix(op, "~") {
+			re, err := regexp.Compile("^(?:" + te.value + ")")
+			if err != nil {
+				return tagExpression{}, fmt.Errorf("parseTagExpression: invalid regex in %q, err=%v", expr, err)
+			}
+			te.regex = re
+		}
+		return te, nil
+	}
+	return tagExpression{}, fmt.Errorf("parseTagExpression: invalid expression %q", expr)
+}
+
+func matchesTagExpressions(entry *IndexEntry, expressions []tagExpression) bool {
+	for _, expr := range expressions {
+		value := ""
+		if expr.tag == "name" {
+			value = entry.Path
+		} else {
+			for _, tag := range entry.Tags {
+				if tag.Key == expr.tag {
+					value = tag.Value
+					break
+				}
+			}
+		}
+
+		var matches bool
+		if expr.regex != nil {
+			matches = expr.regex.MatchString(value)
+		} else {
+			matches = value == expr.value
+		}
+		if matches == expr.negated {
+			return false
+		}
+	}
+	return true
+}
+
+// Splits the arguments of a function call, each a single or double quoted
+// string.
+func parseFunctionArgs(args string) ([]string, error) {
+	var result []string
+	rest := strings.TrimSpace(args)
+	for rest != "" {
+		quote := rest[0]
+		if quote != '\'' && quote != '"' {
+			return nil, fmt.Errorf("parseFunctionArgs: expected a quoted string in %q", args)
+		}
+		end := strings.IndexByte(rest[1:], quote)
+		if end < 0 {
+			return nil, fmt.Errorf("parseFunctionArgs: unterminated string in %q", args)
+		}
+		result = append(result, rest[1:end+1])
+		rest = strings.TrimSpace(rest[end+2:])
+		if rest == "" {
+			break
+		}
+		if rest[0] != ',' {
+			return nil, fmt.Errorf("parseFunctionArgs: expected a comma in %q", args)
+		}
+		rest = strings.TrimSpace(rest[1:])
+	}
+	return result, nil
+}
+
+var relativeTimeUnits = map[string]time.Duration{
+	"s": time.Second, "sec": time.Second, "secs": time.Second, "second": time.Second, "seconds": time.Second,
+	"min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour, "week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+	"mon": 30 * 24 * time.Hour, "month": 30 * 24 * time.Hour, "months": 30 * 24 * time.Hour,
+	"y": 365 * 24 * time.Hour, "year": 365 * 24 * time.Hour, "years": 365 * 24 * time.Hour,
+}
+
+var relativeTimeRegex = regexp.MustCompile(`^([+-])(\d+)([a-z]+)$`)
+
+// Parses a from or until value of the render API: a unix timestamp, "now", or
+// a time relative to now such as -1h or -30min. Empty values use defValue.
+func parseRenderTime(value string, defValue string, now time.Time) (uint32, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		value = defValue
+	}
+	if value == "now" {
+		return uint32(now.Unix()), nil
+	}
+	if ts, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return uint32(ts), nil
+	}
+
+	match := relativeTimeRegex.FindStringSubmatch(strings.TrimPrefix(value, "now"))
+	if match == nil {
+		return 0, fmt.Errorf("parseRenderTime: invalid time %q", value)
+	}
+	unit, ok := relativeTimeUnits[match[3]]
+	if !ok {
+		return 0, fmt.Errorf("parseRenderTime: invalid unit in time %q", value)
+	}
+	count, err := strconv.ParseInt(match[2], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parseRenderTime: invalid time %q", value)
+	}
+	offset := time.Duration(count) * unit
+	if match[1] == "-" {
+		offset = -offset
+	}
+	return uint32(now.Add(offset).Unix()), nil
+}
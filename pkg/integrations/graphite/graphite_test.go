@@ -0,0 +1,350 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package graphite
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/config/common"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// Saves the index in a temp dir instead of the ingest dir.
+func initIndexTest(t *testing.T) {
+	resetIndex()
+	baseDir := t.TempDir()
+	indexLoadOnce.Do(func() { loadIndexFromDir(baseDir) })
+	t.Cleanup(resetIndex)
+}
+
+func Test_ParseLine(t *testing.T) {
+	point, err := ParseLine("servers.web01.cpu.load 1.5 1700000000")
+	assert.Nil(t, err)
+	assert.Equal(t, &Point{Path: "servers.web01.cpu.load", Value: 1.5, Timestamp: 1700000000}, point)
+
+	point, err = ParseLine("disk.used;host=web01;dc=us 42 -1")
+	assert.Nil(t, err)
+	assert.Equal(t, &Point{Path: "disk.used", Tags: []Tag{{Key: "dc", Value: "us"}, {Key: "host", Value: "web01"}}, Value: 42}, point)
+
+	point, err = ParseLine("  jobs.queued 3\r")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), point.Timestamp)
+
+	point, err = ParseLine("")
+	assert.Nil(t, err)
+	assert.Nil(t, point)
+
+	for _, invalid := range []string{"only.path", "a.b x 1", "a.b 1 x", "a..b 1", ".a 1", "a;tag 1", "a;=v 1", "a.b NaN", "a b c d"} {
+		_, err = ParseLine(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func Test_SeriesName(t *testing.T) {
+	path, tags, err := ParseSeriesName("disk.used;host=web01;dc=us")
+	assert.Nil(t, err)
+	assert.Equal(t, "disk.used;dc=us;host=web01", SeriesName(path, tags))
+	assert.Equal(t, "disk.used", SeriesName("disk.used", nil))
+}
+
+func Test_DecodePickle(t *testing.T) {
+	// pickle.dumps([('servers.web01.cpu', (1700000000, 1.5)),
+	//   ('servers.web01.mem;dc=us', (1700000010, 42)), ('big', (1700000020, 2**70))], protocol=p)
+	payloads := map[int]string{
+		0: "286c70300a2856736572766572732e77656230312e6370750a70310a2849313730303030303030300a46312e350a7470320a7470330a612856736572766572732e77656230312e6d656d3b64633d75730a70340a2849313730303030303031300a4934320a7470350a7470360a6128566269670a70370a2849313730303030303032300a4c313138303539313632303731373431313330333432344c0a7470380a7470390a612e",
+		2: "80025d7100285811000000736572766572732e77656230312e63707571014a00f15365473ff80000000000008671028671035817000000736572766572732e77656230312e6d656d3b64633d757371044a0af153654b2a867105867106580300000062696771074a14f153658a09000000000000000040867108867109652e",
+		4: "8004956a000000000000005d94288c11736572766572732e77656230312e637075944a00f15365473ff8000000000000869486948c17736572766572732e77656230312e6d656d3b64633d7573944a0af153654b2a869486948c03626967944a14f153658a0900000000000000004086948694652e",
+	}
+	for protocol, payload := range payloads {
+		data, err := hex.DecodeString(payload)
+		assert.Nil(t, err)
+		points, err := DecodePickle(data)
+		assert.Nil(t, err, protocol)
+		assert.Equal(t, []*Point{
+			{Path: "servers.web01.cpu", Value: 1.5, Timestamp: 1700000000},
+			{Path: "servers.web01.mem", Tags: []Tag{{Key: "dc", Value: "us"}}, Value: 42, Timestamp: 1700000010},
+			{Path: "big", Value: 1180591620717411303424, Timestamp: 1700000020},
+		}, points, protocol)
+	}
+
+	_, err := DecodePickle([]byte("cos\nsystem\n(S'ls'\ntR."))
+	assert.NotNil(t, err)
+	_, err = DecodePickle([]byte{0x80, 0x02, ']'})
+	assert.NotNil(t, err)
+	_, err = DecodePickle([]byte("I1\n."))
+	assert.NotNil(t, err)
+}
+
+func Test_Mapper(t *testing.T) {
+	mapper, err := NewMapper([]string{
+		"servers.* .host.measurement*",
+		"stats.*.* .env.measurement.measurement region=us,team=core",
+		"app.*.requests measurement...status",
+	})
+	assert.Nil(t, err)
+
+	name, labels := mapper.Map("servers.web01.cpu.load", nil)
+	assert.Equal(t, "cpu_load", name)
+	assert.Equal(t, map[string]string{"host": "web01"}, labels)
+
+	name, labels = mapper.Map("stats.prod.api.latency.p99", []Tag{{Key: "region", Value: "eu"}})
+	assert.Equal(t, "api_latency", name)
+	assert.Equal(t, map[string]string{"env": "prod", "region": "eu", "team": "core"}, labels)
+
+	name, labels = mapper.Map("app.checkout.requests.200", nil)
+	assert.Equal(t, "app", name)
+	assert.Equal(t, map[string]string{"status": "200"}, labels)
+
+	name, labels = mapper.Map("1min.load-avg.host-1", nil)
+	assert.Equal(t, "_1min_load_avg_host_1", name)
+	assert.Equal(t, map[string]string{}, labels)
+
+	for _, invalid := range []string{"servers.* host.cpu", "a b c d", "measurement tag", "cpu* measurement x*"} {
+		_, err = ParseTemplate(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func Test_FindNodes(t *testing.T) {
+	initIndexTest(t)
+	for _, path := range []string{"servers.web01.cpu", "servers.web01.cpu.idle", "servers.web02.mem", "servers.db01.cpu", "jobs"} {
+		addToIndex(1, path, &IndexEntry{Path: path})
+	}
+	addToIndex(1, "servers.tagged;dc=us", &IndexEntry{Path: "servers.tagged", Tags: []Tag{{Key: "dc", Value: "us"}}})
+	addToIndex(2, "servers.other", &IndexEntry{Path: "servers.other"})
+
+	nodes, err := FindNodes(1, "*")
+	assert.Nil(t, err)
+	assert.Equal(t, []FindNode{
+		{Text: "jobs", Id: "jobs", Leaf: 1, Context: map[string]interface{}{}},
+		{Text: "servers", Id: "servers", Expandable: 1, AllowChildren: 1, Context: map[string]interface{}{}},
+	}, nodes)
+
+	nodes, err = FindNodes(1, "servers.web*.cpu")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(nodes))
+	assert.Equal(t, 1, nodes[0].Expandable)
+	assert.Equal(t, 1, nodes[1].Leaf)
+	assert.Equal(t, "servers.web01.cpu", nodes[1].Id)
+
+	nodes, err = FindNodes(1, "servers.{db01,web02}.*")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(nodes))
+	assert.Equal(t, "servers.db01.cpu", nodes[0].Id)
+	assert.Equal(t, "servers.web02.mem", nodes[1].Id)
+
+	entries, err := matchPathGlob(1, "servers.web0[12].*")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	_, err = FindNodes(1, "servers.{web")
+	assert.NotNil(t, err)
+
+	// the index is saved and loaded again
+	FlushIndex()
+	baseDir := indexBaseDir
+	resetIndex()
+	indexLoadOnce.Do(func() { loadIndexFromDir(baseDir) })
+	entries = getIndexEntries(1)
+	assert.Equal(t, 6, len(entries))
+	assert.Equal(t, "jobs", entries[0].Path)
+}
+
+func Test_IndexUpdateAndExpiry(t *testing.T) {
+	initIndexTest(t)
+	retentionHours := config.GetRetentionHours()
+	config.SetRetention(24)
+	t.Cleanup(func() { config.SetRetention(retentionHours) })
+
+	addToIndex(1, "servers.web01.cpu", &IndexEntry{Path: "servers.web01.cpu", MetricName: "cpu"})
+	addToIndex(1, "servers.db01.cpu", &IndexEntry{Path: "servers.db01.cpu", MetricName: "cpu"})
+	FlushIndex()
+
+	// a changed metric series replaces the entry, and is appended to the file
+	addToIndex(1, "servers.web01.cpu", &IndexEntry{Path: "servers.web01.cpu", MetricName: "cpu_renamed"})
+	assert.Len(t, index[1].pending, 1)
+	addToIndex(1, "servers.web01.cpu", &IndexEntry{Path: "servers.web01.cpu", MetricName: "cpu_renamed"})
+	assert.Len(t, index[1].pending, 1)
+	FlushIndex()
+
+	baseDir := indexBaseDir
+	resetIndex()
+	indexLoadOnce.Do(func() { loadIndexFromDir(baseDir) })
+	entries := getIndexEntries(1)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "cpu_renamed", entries[1].MetricName)
+
+	// entries not seen within the retention are removed on compaction
+	index[1].series["servers.db01.cpu"].LastSeen -= 25 * 3600
+	index[1].lastCompact = 0
+	FlushIndex()
+	entries = getIndexEntries(1)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "servers.web01.cpu", entries[0].Path)
+
+	resetIndex()
+	indexLoadOnce.Do(func() { loadIndexFromDir(baseDir) })
+	assert.Equal(t, 1, len(getIndexEntries(1)))
+}
+
+func Test_SeriesByTag(t *testing.T) {
+	initIndexTest(t)
+	addToIndex(1, "disk.used;dc=us;host=web01", &IndexEntry{Path: "disk.used", Tags: []Tag{{Key: "dc", Value: "us"}, {Key: "host", Value: "web01"}}})
+	addToIndex(1, "disk.used;dc=eu;host=db01", &IndexEntry{Path: "disk.used", Tags: []Tag{{Key: "dc", Value: "eu"}, {Key: "host", Value: "db01"}}})
+	addToIndex(1, "disk.free;dc=us", &IndexEntry{Path: "disk.free", Tags: []Tag{{Key: "dc", Value: "us"}}})
+
+	args, err := parseFunctionArgs(`'name=disk.used', "host=~web"`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"name=disk.used", "host=~web"}, args)
+	entries, err := matchSeriesByTag(1, args)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "web01", entries[0].Tags[1].Value)
+
+	entries, err = matchSeriesByTag(1, []string{"dc=us", "host!=web01"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "disk.free", entries[0].Path)
+
+	entries, err = matchSeriesByTag(1, []string{"name=~disk", "dc!=~e"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	_, err = matchSeriesByTag(1, []string{"dc"})
+	assert.NotNil(t, err)
+	_, err = parseFunctionArgs("'dc=us' 'x'")
+	assert.NotNil(t, err)
+}
+
+func Test_RenderHelpers(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for value, expected := range map[string]uint32{
+		"":           1700000000 - 24*3600,
+		"now":        1700000000,
+		"1690000000": 1690000000,
+		"-5min":      1700000000 - 300,
+		"now-1h":     1700000000 - 3600,
+		"+2d":        1700000000 + 2*86400,
+	} {
+		ts, err := parseRenderTime(value, DEFAULT_RENDER_FROM, now)
+		assert.Nil(t, err, value)
+		assert.Equal(t, expected, ts, value)
+	}
+	_, err := parseRenderTime("-5parsecs", DEFAULT_RENDER_FROM, now)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, uint32(36), getRenderStep(0, 3600, 100))
+	assert.Equal(t, uint32(1), getRenderStep(0, 10, 1000))
+
+	series, err := renderTarget("constantLine(100)", 10, 20, 1, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][2]float64{{100, 10}, {100, 20}}, series[0].Datapoints)
+
+	_, err = renderTarget("sumSeries(a.*)", 10, 20, 1, 1)
+	assert.NotNil(t, err)
+}
+
+type capturedDatapoint struct {
+	mName  string
+	labels map[string]string
+	value  float64
+	ts     uint32
+}
+
+type capturedDatapoints struct {
+	lock       sync.Mutex
+	datapoints []capturedDatapoint
+}
+
+// Writes the datapoints as if a relabel rule drops the "big" metric and adds a
+// written_ prefix to the other ones.
+func (c *capturedDatapoints) write(mName string, labels map[string]string, value float64, ts uint32, nBytes uint64, myid int64) (*metrics.WrittenSeries, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.datapoints = append(c.datapoints, capturedDatapoint{mName: mName, labels: labels, value: value, ts: ts})
+	if mName == "big" {
+		return nil, nil
+	}
+	return &metrics.WrittenSeries{MetricName: "written_" + mName, Labels: labels}, nil
+}
+
+func (c *capturedDatapoints) count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.datapoints)
+}
+
+func Test_Listener(t *testing.T) {
+	initIndexTest(t)
+	captured := &capturedDatapoints{}
+	listener, err := startListener(common.GraphiteConfig{
+		TCPAddress:    "127.0.0.1:0",
+		UDPAddress:    "127.0.0.1:0",
+		PickleAddress: "127.0.0.1:0",
+		Templates:     []string{"servers.* .host.measurement*"},
+		OrgId:         3,
+	}, captured.write)
+	assert.Nil(t, err)
+
+	udpConn, err := net.Dial("udp", listener.udpConn.LocalAddr().String())
+	assert.Nil(t, err)
+	_, err = udpConn.Write([]byte("servers.web01.cpu 1 1700000000\nbad line\n"))
+	assert.Nil(t, err)
+	_ = udpConn.Close()
+
+	tcpConn, err := net.Dial("tcp", listener.tcpLn.Addr().String())
+	assert.Nil(t, err)
+	_, err = tcpConn.Write([]byte("servers.web02.cpu 2 1700000000\njobs;dc=us 3 1700000000\n"))
+	assert.Nil(t, err)
+	_ = tcpConn.Close()
+
+	payload, err := hex.DecodeString("8004956a000000000000005d94288c11736572766572732e77656230312e637075944a00f15365473ff8000000000000869486948c17736572766572732e77656230312e6d656d3b64633d7573944a0af153654b2a869486948c03626967944a14f153658a0900000000000000004086948694652e")
+	assert.Nil(t, err)
+	pickleConn, err := net.Dial("tcp", listener.pickleLn.Addr().String())
+	assert.Nil(t, err)
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	_, err = pickleConn.Write(append(header, payload...))
+	assert.Nil(t, err)
+	_ = pickleConn.Close()
+
+	assert.Eventually(t, func() bool { return captured.count() == 6 }, 5*time.Second, 10*time.Millisecond)
+	listener.stopAndFlush()
+
+	byName := make(map[string][]capturedDatapoint)
+	for _, datapoint := range captured.datapoints {
+		byName[datapoint.mName] = append(byName[datapoint.mName], datapoint)
+	}
+	assert.Equal(t, 3, len(byName["cpu"]))
+	assert.Equal(t, map[string]string{"dc": "us"}, byName["jobs"][0].labels)
+	assert.Equal(t, map[string]string{"host": "web01", "dc": "us"}, byName["mem"][0].labels)
+	assert.Equal(t, uint32(1700000020), byName["big"][0].ts)
+
+	// the index has the series as written, and not the dropped one
+	entries := getIndexEntries(3)
+	assert.Equal(t, 4, len(entries))
+	assert.Equal(t, "jobs", entries[0].Path)
+	assert.Equal(t, "written_cpu", entries[1].MetricName)
+}
@@ -0,0 +1,476 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siglens/siglens/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// IndexEntry is a Graphite series and the metric series it is written as,
+// after the relabel rules and series limits of the org. LastSeen is when a
+// datapoint of the series was last written, to within INDEX_LAST_SEEN_RESOLUTION.
+type IndexEntry struct {
+	Path       string            `json:"path"`
+	Tags       []Tag             `json:"tags,omitempty"`
+	MetricName string            `json:"metricName"`
+	Labels     map[string]string `json:"labels"`
+	LastSeen   uint32            `json:"lastSeen"`
+}
+
+// FindNode is a node of the /metrics/find API in the treejson format.
+type FindNode struct {
+	Text          string                 `json:"text"`
+	Id            string                 `json:"id"`
+	Leaf          int                    `json:"leaf"`
+	Expandable    int                    `json:"expandable"`
+	AllowChildren int                    `json:"allowChildren"`
+	Context       map[string]interface{} `json:"context"`
+}
+
+// How stale LastSeen of an entry can get before it is updated, which is also
+// how often an active series is appended to the index file again.
+const INDEX_LAST_SEEN_RESOLUTION = 3600
+
+// How often entries older than the retention are removed, and the index file
+// is rewritten with only the remaining entries.
+const INDEX_COMPACT_INTERVAL = 3600
+
+const MAX_INDEX_LINE_SIZE = 1024 * 1024
+
+/*
+The index of an org is saved as a file of JSON lines, one per entry. New and
+updated entries are appended to it, and a later line of a series replaces the
+earlier ones. The file is rewritten when it is compacted.
+*/
+type orgIndex struct {
+	series      map[string]*IndexEntry // by Graphite series name
+	pending     []*IndexEntry          // not yet appended to the file
+	lastCompact uint32
+}
+
+var indexLock sync.RWMutex
+var index = make(map[int64]*orgIndex)
+var indexBaseDir string
+var indexLoadOnce sync.Once
+
+// Loads the saved index of all orgs. The index is loaded on first use, since
+// both the listener and the query APIs need it.
+func loadIndex() {
+	indexLoadOnce.Do(func() {
+		loadIndexFromDir(config.GetCurrentNodeIngestDir() + "graphite")
+	})
+}
+
+func loadIndexFromDir(baseDir string) {
+	err := os.MkdirAll(baseDir, 0764)
+	if err != nil {
+		log.Errorf("loadIndexFromDir: failed to create dir=%v, err=%v", baseDir, err)
+		return
+	}
+	files, err := os.ReadDir(baseDir)
+	if err != nil {
+		log.Errorf("loadIndexFromDir: failed to read dir=%v, err=%v", baseDir, err)
+		return
+	}
+
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	indexBaseDir = baseDir
+	for _, file := range files {
+		orgid, ok := getIndexFileOrgId(file.Name())
+		if !ok {
+			continue
+		}
+		fileName := filepath.Join(baseDir, file.Name())
+		orgIdx, err := readIndexFile(fileName)
+		if err != nil {
+			log.Errorf("loadIndexFromDir: failed to read file=%v, err=%v", fileName, err)
+			continue
+		}
+		index[orgid] = orgIdx
+	}
+}
+
+func readIndexFile(fileName string) (*orgIndex, error) {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	orgIdx := &orgIndex{series: make(map[string]*IndexEntry)}
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 4096), MAX_INDEX_LINE_SIZE)
+	for scanner.Scan() {
+		entry := &IndexEntry{}
+		err := json.Unmarshal(scanner.Bytes(), entry)
+		if err != nil {
+			// a partly written last line
+			log.Warnf("readIndexFile: skipping invalid line of file=%v, err=%v", fileName, err)
+			continue
+		}
+		orgIdx.series[SeriesName(entry.Path, entry.Tags)] = entry
+	}
+	return orgIdx, scanner.Err()
+}
+
+func getIndexFileName(orgid int64) string {
+	if orgid != 0 {
+		return filepath.Join(indexBaseDir, "index-"+strconv.FormatInt(orgid, 10)+".jsonl")
+	}
+	return filepath.Join(indexBaseDir, "index.jsonl")
+}
+
+func getIndexFileOrgId(fileName string) (int64, bool) {
+	if fileName == "index.jsonl" {
+		return 0, true
+	}
+	if !strings.HasPrefix(fileName, "index-") || !strings.HasSuffix(fileName, ".jsonl") {
+		return 0, false
+	}
+	orgid, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(fileName, "index-"), ".jsonl"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return orgid, true
+}
+
+/*
+Appends the entries that were added or updated since the last flush to the
+index files. Every INDEX_COMPACT_INTERVAL, the entries that were not seen
+within the retention are removed, since their datapoints are deleted, and the
+file of the org is rewritten.
+*/
+func FlushIndex() {
+	now := uint32(time.Now().Unix())
+	retentionSecs := uint32(config.GetRetentionHours()) * 3600
+
+	type indexWrite struct {
+		data   []byte
+		append bool
+	}
+	toWrite := make(map[int64]indexWrite)
+	indexLock.Lock()
+	if indexBaseDir == "" {
+		indexLock.Unlock()
+		return
+	}
+	for orgid, orgIdx := range index {
+		var entries []*IndexEntry
+		isAppend := true
+		if now-orgIdx.lastCompact >= INDEX_COMPACT_INTERVAL {
+			orgIdx.removeExpired(now, retentionSecs)
+			orgIdx.lastCompact = now
+			entries = make([]*IndexEntry, 0, len(orgIdx.series))
+			for _, entry := range orgIdx.series {
+				entries = append(entries, entry)
+			}
+			isAppend = false
+		} else {
+			entries = orgIdx.pending
+		}
+		orgIdx.pending = nil
+		if isAppend && len(entries) == 0 {
+			continue
+		}
+
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		for _, entry := range entries {
+			err := encoder.Encode(entry)
+			if err != nil {
+				log.Errorf("FlushIndex: failed to marshal entry %v of orgid=%v, err=%v", entry.Path, orgid, err)
+			}
+		}
+		toWrite[orgid] = indexWrite{data: buf.Bytes(), append: isAppend}
+	}
+	indexLock.Unlock()
+
+	for orgid, write := range toWrite {
+		fileName := getIndexFileName(orgid)
+		var err error
+		if write.append {
+			err = appendToFile(fileName, write.data)
+		} else {
+			err = os.WriteFile(fileName, write.data, 0644)
+		}
+		if err != nil {
+			log.Errorf("FlushIndex: failed to write file=%v, err=%v", fileName, err)
+		}
+	}
+}
+
+func appendToFile(fileName string, data []byte) error {
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(data)
+	closeErr := fd.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// The caller must hold indexLock.
+func (orgIdx *orgIndex) removeExpired(now uint32, retentionSecs uint32) {
+	if retentionSecs == 0 || now < retentionSecs {
+		return
+	}
+	for name, entry := range orgIdx.series {
+		if entry.LastSeen < now-retentionSecs {
+			delete(orgIdx.series, name)
+		}
+	}
+}
+
+/*
+Records the metric series that a Graphite series is written as. Known series
+are only updated when their metric series changed, e.g. with new relabel rules,
+or their LastSeen is older than INDEX_LAST_SEEN_RESOLUTION, so this is cheap to
+call for every datapoint.
+*/
+func addToIndex(orgid int64, seriesName string, entry *IndexEntry) {
+	loadIndex()
+	now := uint32(time.Now().Unix())
+
+	indexLock.RLock()
+	orgIdx, ok := index[orgid]
+	var existing *IndexEntry
+	if ok {
+		existing = orgIdx.series[seriesName]
+	}
+	indexLock.RUnlock()
+	if isIndexEntryCurrent(existing, entry, now) {
+		return
+	}
+
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	orgIdx, ok = index[orgid]
+	if !ok {
+		orgIdx = &orgIndex{series: make(map[string]*IndexEntry), lastCompact: now}
+		index[orgid] = orgIdx
+	}
+	if isIndexEntryCurrent(orgIdx.series[seriesName], entry, now) {
+		return
+	}
+	// entries are shared with the readers of the index, so they are replaced instead of updated
+	newEntry := *entry
+	newEntry.LastSeen = now
+	orgIdx.series[seriesName] = &newEntry
+	orgIdx.pending = append(orgIdx.pending, &newEntry)
+}
+
+func isIndexEntryCurrent(existing *IndexEntry, entry *IndexEntry, now uint32) bool {
+	return existing != nil && existing.MetricName == entry.MetricName && maps.Equal(existing.Labels, entry.Labels) &&
+		now-existing.LastSeen < INDEX_LAST_SEEN_RESOLUTION
+}
+
+// Returns the entries of the org sorted by series name. Entries are never
+// modified once added, so they are shared with the index.
+func getIndexEntries(orgid int64) []*IndexEntry {
+	loadIndex()
+
+	indexLock.RLock()
+	defer indexLock.RUnlock()
+	orgIdx, ok := index[orgid]
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, len(orgIdx.series))
+	for name := range orgIdx.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]*IndexEntry, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, orgIdx.series[name])
+	}
+	return entries
+}
+
+/*
+Returns the nodes at the depth of a Graphite glob query, e.g. "servers.*.cpu".
+A node that is both a series and has children is returned twice, once as a
+leaf and once as a branch, like Graphite does. Tagged series are not returned,
+since Graphite only finds them through the tag APIs.
+*/
+func FindNodes(orgid int64, query string) ([]FindNode, error) {
+	nodes := splitPattern(query)
+	re, err := compileGlob(query)
+	if err != nil {
+		return nil, err
+	}
+
+	type nodeKind struct {
+		leaf   bool
+		branch bool
+	}
+	found := make(map[string]*nodeKind)
+	var ids []string
+	for _, entry := range getIndexEntries(orgid) {
+		if len(entry.Tags) > 0 {
+			continue
+		}
+		pathNodes := strings.Split(entry.Path, ".")
+		if len(pathNodes) < len(nodes) {
+			continue
+		}
+		id := strings.Join(pathNodes[:len(nodes)], ".")
+		if !re.MatchString(id) {
+			continue
+		}
+		kind, ok := found[id]
+		if !ok {
+			kind = &nodeKind{}
+			found[id] = kind
+			ids = append(ids, id)
+		}
+		if len(pathNodes) == len(nodes) {
+			kind.leaf = true
+		} else {
+			kind.branch = true
+		}
+	}
+	sort.Strings(ids)
+
+	result := make([]FindNode, 0, len(ids))
+	for _, id := range ids {
+		text := id[strings.LastIndexByte(id, '.')+1:]
+		if found[id].branch {
+			result = append(result, FindNode{Text: text, Id: id, Expandable: 1, AllowChildren: 1, Context: map[string]interface{}{}})
+		}
+		if found[id].leaf {
+			result = append(result, FindNode{Text: text, Id: id, Leaf: 1, Context: map[string]interface{}{}})
+		}
+	}
+	return result, nil
+}
+
+// Returns the entries whose untagged Graphite path matches a glob.
+func matchPathGlob(orgid int64, pattern string) ([]*IndexEntry, error) {
+	re, err := compileGlob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var matched []*IndexEntry
+	for _, entry := range getIndexEntries(orgid) {
+		if len(entry.Tags) == 0 && re.MatchString(entry.Path) {
+			matched = append(matched, entry)
+		}
+	}
+	return matched, nil
+}
+
+// Splits a glob into its nodes. Dots inside {a,b} alternatives do not split.
+func splitPattern(pattern string) []string {
+	var nodes []string
+	depth := 0
+	start := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case '.':
+			if depth == 0 {
+				nodes = append(nodes, pattern[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(nodes, pattern[start:])
+}
+
+/*
+Compiles a Graphite glob into an anchored regexp. "*" matches any characters
+within a node, "?" matches one character, "[...]" matches a character class
+and "{a,b}" matches any of the alternatives.
+*/
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	depth := 0
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*':
+			sb.WriteString(`[^.]*`)
+		case c == '?':
+			sb.WriteString(`[^.]`)
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("compileGlob: unterminated character class in %q", pattern)
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end
+		case c == '{':
+			depth++
+			sb.WriteString("(?:")
+		case c == '}' && depth > 0:
+			depth--
+			sb.WriteString(")")
+		case c == ',' && depth > 0:
+			sb.WriteString("|")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("compileGlob: unterminated alternatives in %q", pattern)
+	}
+	sb.WriteString("$")
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, fmt.Errorf("compileGlob: invalid pattern %q, err=%v", pattern, err)
+	}
+	return re, nil
+}
+
+func resetIndex() {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	index = make(map[int64]*orgIndex)
+	indexBaseDir = ""
+	indexLoadOnce = sync.Once{}
+}
@@ -0,0 +1,344 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package graphite
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/config/common"
+	"github.com/siglens/siglens/pkg/instrumentation"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics"
+	"github.com/siglens/siglens/pkg/usageStats"
+	log "github.com/sirupsen/logrus"
+)
+
+const MAX_UDP_PACKET_SIZE = 65535
+
+// How often the ingestion stats are updated and the index is saved.
+const GRAPHITE_FLUSH_INTERVAL = 10 * time.Second
+
+// Listener receives Graphite datapoints over the Carbon plaintext protocol on
+// TCP and UDP, and over the pickle protocol on TCP. Datapoints are written as
+// soon as they are received.
+type Listener struct {
+	cfg      common.GraphiteConfig
+	mapper   *Mapper
+	udpConn  net.PacketConn
+	tcpLn    net.Listener
+	pickleLn net.Listener
+	stop     chan struct{}
+	wg       sync.WaitGroup
+
+	bytesReceived uint64
+	pointsWritten uint64
+
+	connsLock   sync.Mutex
+	conns       map[net.Conn]struct{}
+	connsClosed bool
+
+	// Writes the datapoint and returns the series it was written as, or nil when it was dropped
+	writeDatapoint func(mName string, labels map[string]string, value float64, ts uint32, nBytes uint64, myid int64) (*metrics.WrittenSeries, error)
+}
+
+var globalListener *Listener
+
+// Starts the Graphite listener, when it is enabled.
+func InitGraphiteListener() {
+	if !config.IsGraphiteEnabled() {
+		return
+	}
+
+	listener, err := startListener(config.GetGraphiteConfig(), writeDatapoint)
+	if err != nil {
+		log.Errorf("InitGraphiteListener: failed to start the listener, err=%v", err)
+		return
+	}
+	globalListener = listener
+	log.Infof("InitGraphiteListener: listening on tcp=%v udp=%v pickle=%v",
+		listener.cfg.TCPAddress, listener.cfg.UDPAddress, listener.cfg.PickleAddress)
+}
+
+// Stops the listener and saves the index.
+func StopGraphiteListener() {
+	if globalListener == nil {
+		return
+	}
+	globalListener.stopAndFlush()
+	globalListener = nil
+}
+
+func startListener(cfg common.GraphiteConfig,
+	writeDatapoint func(string, map[string]string, float64, uint32, uint64, int64) (*metrics.WrittenSeries, error)) (*Listener, error) {
+
+	mapper, err := NewMapper(cfg.Templates)
+	if err != nil {
+		return nil, err
+	}
+	loadIndex()
+
+	listener := &Listener{
+		cfg:            cfg,
+		mapper:         mapper,
+		stop:           make(chan struct{}),
+		conns:          make(map[net.Conn]struct{}),
+		writeDatapoint: writeDatapoint,
+	}
+
+	if cfg.UDPAddress != "" {
+		listener.udpConn, err = net.ListenPacket("udp", cfg.UDPAddress)
+		if err != nil {
+			return nil, err
+		}
+		listener.wg.Add(1)
+		go listener.serveUDP()
+	}
+	if cfg.TCPAddress != "" {
+		listener.tcpLn, err = net.Listen("tcp", cfg.TCPAddress)
+		if err != nil {
+			listener.closeListeners()
+			return nil, err
+		}
+		listener.wg.Add(1)
+		go listener.serveTCP(listener.tcpLn, listener.servePlaintextConn)
+	}
+	if cfg.PickleAddress != "" {
+		listener.pickleLn, err = net.Listen("tcp", cfg.PickleAddress)
+		if err != nil {
+			listener.closeListeners()
+			return nil, err
+		}
+		listener.wg.Add(1)
+		go listener.serveTCP(listener.pickleLn, listener.servePickleConn)
+	}
+
+	listener.wg.Add(1)
+	go listener.runFlushLoop()
+	return listener, nil
+}
+
+func (l *Listener) closeListeners() {
+	if l.udpConn != nil {
+		_ = l.udpConn.Close()
+	}
+	if l.tcpLn != nil {
+		_ = l.tcpLn.Close()
+	}
+	if l.pickleLn != nil {
+		_ = l.pickleLn.Close()
+	}
+	l.connsLock.Lock()
+	l.connsClosed = true
+	for conn := range l.conns {
+		_ = conn.Close()
+	}
+	l.connsLock.Unlock()
+
+	l.wg.Wait()
+}
+
+func (l *Listener) stopAndFlush() {
+	close(l.stop)
+	l.closeListeners()
+	l.flush()
+}
+
+func (l *Listener) serveUDP() {
+	defer l.wg.Done()
+
+	buf := make([]byte, MAX_UDP_PACKET_SIZE)
+	for {
+		n, _, err := l.udpConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Errorf("Listener.serveUDP: failed to read packet, err=%v", err)
+			continue
+		}
+		atomic.AddUint64(&l.bytesReceived, uint64(n))
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			l.handleLine(line)
+		}
+	}
+}
+
+func (l *Listener) serveTCP(ln net.Listener, serveConn func(net.Conn)) {
+	defer l.wg.Done()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Errorf("Listener.serveTCP: failed to accept connection, err=%v", err)
+			continue
+		}
+
+		l.connsLock.Lock()
+		if l.connsClosed {
+			l.connsLock.Unlock()
+			_ = conn.Close()
+			return
+		}
+		l.conns[conn] = struct{}{}
+		l.connsLock.Unlock()
+
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			defer func() {
+				l.connsLock.Lock()
+				delete(l.conns, conn)
+				l.connsLock.Unlock()
+				_ = conn.Close()
+			}()
+			serveConn(conn)
+		}()
+	}
+}
+
+func (l *Listener) servePlaintextConn(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), MAX_UDP_PACKET_SIZE)
+	for scanner.Scan() {
+		atomic.AddUint64(&l.bytesReceived, uint64(len(scanner.Bytes())+1))
+		l.handleLine(scanner.Text())
+	}
+}
+
+// Reads pickle payloads, each prefixed by its length as a 4 byte big endian
+// integer. The connection is closed when a payload is too large.
+func (l *Listener) servePickleConn(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 4)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			return
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > MAX_PICKLE_PAYLOAD_SIZE {
+			instrumentation.IncrementInt64Counter(instrumentation.GRAPHITE_INVALID_LINES, 1)
+			log.Errorf("Listener.servePickleConn: payload of %v bytes from %v is too large", size, conn.RemoteAddr())
+			return
+		}
+		payload := make([]byte, size)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			return
+		}
+		atomic.AddUint64(&l.bytesReceived, uint64(size)+4)
+
+		points, err := DecodePickle(payload)
+		if err != nil {
+			instrumentation.IncrementInt64Counter(instrumentation.GRAPHITE_INVALID_LINES, 1)
+			log.Debugf("Listener.servePickleConn: invalid payload from %v, err=%v", conn.RemoteAddr(), err)
+			continue
+		}
+		nBytes := uint64(size) + 4
+		if len(points) > 0 {
+			nBytes /= uint64(len(points))
+		}
+		for _, point := range points {
+			l.handlePoint(point, nBytes)
+		}
+	}
+}
+
+func (l *Listener) handleLine(line string) {
+	point, err := ParseLine(line)
+	if err != nil {
+		instrumentation.IncrementInt64Counter(instrumentation.GRAPHITE_INVALID_LINES, 1)
+		log.Debugf("Listener.handleLine: invalid line %q, err=%v", line, err)
+		return
+	}
+	if point != nil {
+		l.handlePoint(point, uint64(len(line)+1))
+	}
+}
+
+// Maps the point to its metric series, writes it and records the series in
+// the index for the find and render APIs.
+func (l *Listener) handlePoint(point *Point, nBytes uint64) {
+	ts := point.Timestamp
+	if ts == 0 {
+		ts = uint32(time.Now().Unix())
+	}
+
+	mName, labels := l.mapper.Map(point.Path, point.Tags)
+	written, err := l.writeDatapoint(mName, labels, point.Value, ts, nBytes, l.cfg.OrgId)
+	if err != nil {
+		log.Errorf("Listener.handlePoint: failed to write path=%v as metric=%v, orgid=%v, err=%v", point.Path, mName, l.cfg.OrgId, err)
+		return
+	}
+	atomic.AddUint64(&l.pointsWritten, 1)
+	if written == nil {
+		return
+	}
+
+	addToIndex(l.cfg.OrgId, SeriesName(point.Path, point.Tags), &IndexEntry{
+		Path:       point.Path,
+		Tags:       point.Tags,
+		MetricName: written.MetricName,
+		Labels:     written.Labels,
+	})
+}
+
+func (l *Listener) runFlushLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(GRAPHITE_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.flush()
+		}
+	}
+}
+
+func (l *Listener) flush() {
+	bytesReceived := atomic.SwapUint64(&l.bytesReceived, 0)
+	pointsWritten := atomic.SwapUint64(&l.pointsWritten, 0)
+	if pointsWritten > 0 {
+		usageStats.UpdateMetricsStats(bytesReceived, pointsWritten, l.cfg.OrgId)
+		instrumentation.IncrementInt64Counter(instrumentation.GRAPHITE_WRITTEN_DATAPOINTS, int64(pointsWritten))
+	}
+	FlushIndex()
+}
+
+func writeDatapoint(mName string, labels map[string]string, value float64, ts uint32, nBytes uint64, myid int64) (*metrics.WrittenSeries, error) {
+	tagHolder := metrics.GetTagsHolder()
+	for key, val := range labels {
+		tagHolder.Insert(key, []byte(val), jsonparser.String)
+	}
+	return metrics.EncodeDatapointGetSeries([]byte(mName), tagHolder, value, ts, nBytes, myid)
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Point is a single Graphite datapoint. Path is the dotted name without the
+// tags of a tagged series.
+type Point struct {
+	Path      string
+	Tags      []Tag // sorted by key
+	Value     float64
+	Timestamp uint32 // seconds; 0 means the time the point was received
+}
+
+/*
+Parses a line of the Carbon plaintext protocol:
+
+	path[;tag=value...] value [timestamp]
+
+A missing or negative timestamp means the time the point was received.
+Returns nil for empty lines.
+*/
+func ParseLine(line string) (*Point, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil, nil
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, fmt.Errorf("ParseLine: expected 2 or 3 fields, got %v", len(fields))
+	}
+
+	path, tags, err := ParseSeriesName(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	value, err := parseValue(fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var timestamp uint32
+	if len(fields) == 3 {
+		timestamp, err = parseTimestamp(fields[2])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Point{Path: path, Tags: tags, Value: value, Timestamp: timestamp}, nil
+}
+
+// Splits a Graphite series name of the form path[;tag=value...] into the path
+// and the tags sorted by key.
+func ParseSeriesName(name string) (string, []Tag, error) {
+	parts := strings.Split(name, ";")
+	path := parts[0]
+	if path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+		return "", nil, fmt.Errorf("ParseSeriesName: invalid path %q", path)
+	}
+
+	var tags []Tag
+	for _, part := range parts[1:] {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || key == "" || value == "" {
+			return "", nil, fmt.Errorf("ParseSeriesName: invalid tag %q", part)
+		}
+		tags = append(tags, Tag{Key: key, Value: value})
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].Key < tags[j].Key
+	})
+	return path, tags, nil
+}
+
+// Returns the Graphite name of a series: the path followed by the tags sorted
+// by key, as path;tag1=value1;tag2=value2.
+func SeriesName(path string, tags []Tag) string {
+	if len(tags) == 0 {
+		return path
+	}
+	var sb strings.Builder
+	sb.WriteString(path)
+	for _, tag := range tags {
+		sb.WriteByte(';')
+		sb.WriteString(tag.Key)
+		sb.WriteByte('=')
+		sb.WriteString(tag.Value)
+	}
+	return sb.String()
+}
+
+func parseValue(value string) (float64, error) {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parseValue: invalid value %q", value)
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, errors.New("parseValue: value is not a finite number")
+	}
+	return f, nil
+}
+
+func parseTimestamp(timestamp string) (uint32, error) {
+	ts, err := strconv.ParseFloat(timestamp, 64)
+	if err != nil || math.IsNaN(ts) || ts >= math.MaxUint32 {
+		return 0, fmt.Errorf("parseTimestamp: invalid timestamp %q", timestamp)
+	}
+	if ts < 0 {
+		return 0, nil
+	}
+	return uint32(ts), nil
+}
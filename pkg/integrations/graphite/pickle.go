@@ -0,0 +1,589 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Largest pickle payload that is accepted, same as Carbon.
+const MAX_PICKLE_PAYLOAD_SIZE = 1 << 20
+
+// Pickle opcodes that carbon clients use to encode a list of datapoints.
+const (
+	opMark           = '('
+	opStop           = '.'
+	opPop            = '0'
+	opInt            = 'I'
+	opBinInt         = 'J'
+	opBinInt1        = 'K'
+	opBinInt2        = 'M'
+	opLong           = 'L'
+	opLong1          = 0x8a
+	opLong4          = 0x8b
+	opNone           = 'N'
+	opNewTrue        = 0x88
+	opNewFalse       = 0x89
+	opFloat          = 'F'
+	opBinFloat       = 'G'
+	opString         = 'S'
+	opBinString      = 'T'
+	opShortBinString = 'U'
+	opUnicode        = 'V'
+	opBinUnicode     = 'X'
+	opShortBinUni    = 0x8c
+	opBinUnicode8    = 0x8d
+	opBinBytes       = 'B'
+	opShortBinBytes  = 'C'
+	opEmptyList      = ']'
+	opList           = 'l'
+	opAppend         = 'a'
+	opAppends        = 'e'
+	opEmptyTuple     = ')'
+	opTuple          = 't'
+	opTuple1         = 0x85
+	opTuple2         = 0x86
+	opTuple3         = 0x87
+	opPut            = 'p'
+	opBinPut         = 'q'
+	opLongBinPut     = 'r'
+	opMemoize        = 0x94
+	opGet            = 'g'
+	opBinGet         = 'h'
+	opLongBinGet     = 'j'
+	opProto          = 0x80
+	opFrame          = 0x95
+)
+
+// Lists are pointers, so that appends through a memo reference are seen by
+// every reference to the list.
+type pickleList struct {
+	items []interface{}
+}
+
+type pickleMark struct{}
+
+type unpickler struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	memo  map[int]interface{}
+}
+
+/*
+Decodes a payload of the Carbon pickle protocol, a pickled list of
+(path, (timestamp, value)) tuples. Only the opcodes that are needed to encode
+lists, tuples, numbers and strings are supported, so no Python objects are
+ever constructed.
+*/
+func DecodePickle(data []byte) ([]*Point, error) {
+	u := &unpickler{data: data, memo: make(map[int]interface{})}
+	obj, err := u.load()
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := obj.(*pickleList)
+	if !ok {
+		return nil, fmt.Errorf("DecodePickle: expected a list, got %T", obj)
+	}
+	points := make([]*Point, 0, len(list.items))
+	for _, item := range list.items {
+		point, err := pickleItemToPoint(item)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+func pickleItemToPoint(item interface{}) (*Point, error) {
+	metric, ok := asTuple(item, 2)
+	if !ok {
+		return nil, errors.New("pickleItemToPoint: expected a (path, (timestamp, value)) tuple")
+	}
+	name, ok := metric[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("pickleItemToPoint: expected a string path, got %T", metric[0])
+	}
+	datapoint, ok := asTuple(metric[1], 2)
+	if !ok {
+		return nil, fmt.Errorf("pickleItemToPoint: expected a (timestamp, value) tuple for %q", name)
+	}
+
+	path, tags, err := ParseSeriesName(name)
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := pickleNumber(datapoint[0])
+	if err != nil {
+		return nil, err
+	}
+	value, err := pickleNumber(datapoint[1])
+	if err != nil {
+		return nil, err
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("pickleItemToPoint: value of %q is not a finite number", name)
+	}
+	if math.IsNaN(timestamp) || timestamp >= math.MaxUint32 {
+		return nil, fmt.Errorf("pickleItemToPoint: invalid timestamp of %q", name)
+	}
+
+	point := &Point{Path: path, Tags: tags, Value: value}
+	if timestamp > 0 {
+		point.Timestamp = uint32(timestamp)
+	}
+	return point, nil
+}
+
+// Tuples are decoded as slices; lists are also accepted since some clients
+// send the datapoints as lists.
+func asTuple(obj interface{}, size int) ([]interface{}, bool) {
+	switch v := obj.(type) {
+	case []interface{}:
+		return v, len(v) == size
+	case *pickleList:
+		return v.items, len(v.items) == size
+	}
+	return nil, false
+}
+
+func pickleNumber(obj interface{}) (float64, error) {
+	switch v := obj.(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(v).Float64()
+		return f, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("pickleNumber: invalid number %q", v)
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("pickleNumber: expected a number, got %T", obj)
+}
+
+func (u *unpickler) load() (interface{}, error) {
+	for {
+		op, err := u.readByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case opProto:
+			_, err = u.read(1)
+		case opFrame:
+			_, err = u.read(8)
+		case opStop:
+			return u.pop()
+		case opMark:
+			u.push(pickleMark{})
+		case opPop:
+			_, err = u.pop()
+		case opNone:
+			u.push(nil)
+		case opNewTrue:
+			u.push(true)
+		case opNewFalse:
+			u.push(false)
+		case opInt:
+			err = u.loadInt()
+		case opBinInt:
+			err = u.loadFixedInt(4)
+		case opBinInt1:
+			err = u.loadFixedInt(1)
+		case opBinInt2:
+			err = u.loadFixedInt(2)
+		case opLong:
+			err = u.loadLong()
+		case opLong1:
+			err = u.loadLongN(1)
+		case opLong4:
+			err = u.loadLongN(4)
+		case opFloat:
+			err = u.loadFloat()
+		case opBinFloat:
+			err = u.loadBinFloat()
+		case opString:
+			err = u.loadString()
+		case opUnicode:
+			err = u.loadUnicode()
+		case opBinString, opBinUnicode, opBinBytes:
+			err = u.loadSizedString(4)
+		case opShortBinString, opShortBinUni, opShortBinBytes:
+			err = u.loadSizedString(1)
+		case opBinUnicode8:
+			err = u.loadSizedString(8)
+		case opEmptyList:
+			u.push(&pickleList{})
+		case opList:
+			var items []interface{}
+			items, err = u.popMark()
+			u.push(&pickleList{items: items})
+		case opAppend:
+			err = u.appendItems(false)
+		case opAppends:
+			err = u.appendItems(true)
+		case opEmptyTuple:
+			u.push([]interface{}{})
+		case opTuple:
+			var items []interface{}
+			items, err = u.popMark()
+			u.push(items)
+		case opTuple1, opTuple2, opTuple3:
+			err = u.loadTupleN(int(op-opTuple1) + 1)
+		case opPut:
+			err = u.memoizeLine()
+		case opBinPut:
+			err = u.memoizeIndex(1)
+		case opLongBinPut:
+			err = u.memoizeIndex(4)
+		case opMemoize:
+			err = u.memoize(len(u.memo))
+		case opGet:
+			err = u.loadMemoLine()
+		case opBinGet:
+			err = u.loadMemoIndex(1)
+		case opLongBinGet:
+			err = u.loadMemoIndex(4)
+		default:
+			return nil, fmt.Errorf("unpickler.load: unsupported opcode 0x%02x at offset %v", op, u.pos-1)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (u *unpickler) readByte() (byte, error) {
+	if u.pos >= len(u.data) {
+		return 0, errors.New("unpickler.readByte: unexpected end of data")
+	}
+	b := u.data[u.pos]
+	u.pos++
+	return b, nil
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || n > len(u.data)-u.pos {
+		return nil, errors.New("unpickler.read: unexpected end of data")
+	}
+	b := u.data[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+func (u *unpickler) readLine() (string, error) {
+	idx := bytes.IndexByte(u.data[u.pos:], '\n')
+	if idx < 0 {
+		return "", errors.New("unpickler.readLine: unexpected end of data")
+	}
+	line := string(u.data[u.pos : u.pos+idx])
+	u.pos += idx + 1
+	return line, nil
+}
+
+func (u *unpickler) readUint(n int) (uint64, error) {
+	b, err := u.read(n)
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	for i := n - 1; i >= 0; i-- {
+		value = value<<8 | uint64(b[i])
+	}
+	return value, nil
+}
+
+func (u *unpickler) push(obj interface{}) {
+	u.stack = append(u.stack, obj)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errors.New("unpickler.pop: stack is empty")
+	}
+	obj := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return obj, nil
+}
+
+// Pops the objects pushed since the last mark, and the mark itself.
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(pickleMark); ok {
+			items := append([]interface{}{}, u.stack[i+1:]...)
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, errors.New("unpickler.popMark: mark not found")
+}
+
+func (u *unpickler) loadInt() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	switch line {
+	case "00":
+		u.push(false)
+		return nil
+	case "01":
+		u.push(true)
+		return nil
+	}
+	value, err := strconv.ParseInt(line, 10, 64)
+	if err != nil {
+		return fmt.Errorf("unpickler.loadInt: invalid int %q", line)
+	}
+	u.push(value)
+	return nil
+}
+
+func (u *unpickler) loadFixedInt(n int) error {
+	value, err := u.readUint(n)
+	if err != nil {
+		return err
+	}
+	if n == 4 {
+		u.push(int64(int32(uint32(value))))
+	} else {
+		u.push(int64(value))
+	}
+	return nil
+}
+
+func (u *unpickler) loadLong() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	value, ok := new(big.Int).SetString(strings.TrimSuffix(line, "L"), 10)
+	if !ok {
+		return fmt.Errorf("unpickler.loadLong: invalid long %q", line)
+	}
+	u.pushBigInt(value)
+	return nil
+}
+
+// Loads a little endian two's complement integer of a size given in n bytes.
+func (u *unpickler) loadLongN(n int) error {
+	size, err := u.readUint(n)
+	if err != nil {
+		return err
+	}
+	if size > uint64(len(u.data)) {
+		return errors.New("unpickler.loadLongN: unexpected end of data")
+	}
+	b, err := u.read(int(size))
+	if err != nil {
+		return err
+	}
+
+	bigEndian := make([]byte, len(b))
+	for i := range b {
+		bigEndian[len(b)-1-i] = b[i]
+	}
+	value := new(big.Int).SetBytes(bigEndian)
+	if len(b) > 0 && b[len(b)-1]&0x80 != 0 {
+		value.Sub(value, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b))))
+	}
+	u.pushBigInt(value)
+	return nil
+}
+
+func (u *unpickler) pushBigInt(value *big.Int) {
+	if value.IsInt64() {
+		u.push(value.Int64())
+	} else {
+		u.push(value)
+	}
+}
+
+func (u *unpickler) loadFloat() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	value, err := strconv.ParseFloat(line, 64)
+	if err != nil {
+		return fmt.Errorf("unpickler.loadFloat: invalid float %q", line)
+	}
+	u.push(value)
+	return nil
+}
+
+func (u *unpickler) loadBinFloat() error {
+	b, err := u.read(8)
+	if err != nil {
+		return err
+	}
+	u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+	return nil
+}
+
+// Loads a quoted Python 2 string repr, e.g. 'a.b' or "a'b".
+func (u *unpickler) loadString() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	if len(line) < 2 || (line[0] != '\'' && line[0] != '"') || line[len(line)-1] != line[0] {
+		return fmt.Errorf("unpickler.loadString: invalid string %q", line)
+	}
+	value, err := strconv.Unquote(`"` + strings.ReplaceAll(line[1:len(line)-1], `"`, `\"`) + `"`)
+	if err != nil {
+		value = line[1 : len(line)-1]
+	}
+	u.push(value)
+	return nil
+}
+
+func (u *unpickler) loadUnicode() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	u.push(line)
+	return nil
+}
+
+func (u *unpickler) loadSizedString(n int) error {
+	size, err := u.readUint(n)
+	if err != nil {
+		return err
+	}
+	if size > uint64(len(u.data)) {
+		return errors.New("unpickler.loadSizedString: unexpected end of data")
+	}
+	b, err := u.read(int(size))
+	if err != nil {
+		return err
+	}
+	u.push(string(b))
+	return nil
+}
+
+func (u *unpickler) appendItems(multiple bool) error {
+	var items []interface{}
+	if multiple {
+		var err error
+		items, err = u.popMark()
+		if err != nil {
+			return err
+		}
+	} else {
+		item, err := u.pop()
+		if err != nil {
+			return err
+		}
+		items = []interface{}{item}
+	}
+
+	if len(u.stack) == 0 {
+		return errors.New("unpickler.appendItems: stack is empty")
+	}
+	list, ok := u.stack[len(u.stack)-1].(*pickleList)
+	if !ok {
+		return fmt.Errorf("unpickler.appendItems: expected a list, got %T", u.stack[len(u.stack)-1])
+	}
+	list.items = append(list.items, items...)
+	return nil
+}
+
+func (u *unpickler) loadTupleN(n int) error {
+	if len(u.stack) < n {
+		return errors.New("unpickler.loadTupleN: stack is too short")
+	}
+	items := append([]interface{}{}, u.stack[len(u.stack)-n:]...)
+	u.stack = u.stack[:len(u.stack)-n]
+	u.push(items)
+	return nil
+}
+
+func (u *unpickler) memoize(idx int) error {
+	if len(u.stack) == 0 {
+		return errors.New("unpickler.memoize: stack is empty")
+	}
+	u.memo[idx] = u.stack[len(u.stack)-1]
+	return nil
+}
+
+func (u *unpickler) memoizeLine() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	idx, err := strconv.Atoi(line)
+	if err != nil {
+		return fmt.Errorf("unpickler.memoizeLine: invalid memo index %q", line)
+	}
+	return u.memoize(idx)
+}
+
+func (u *unpickler) memoizeIndex(n int) error {
+	idx, err := u.readUint(n)
+	if err != nil {
+		return err
+	}
+	return u.memoize(int(idx))
+}
+
+func (u *unpickler) loadMemo(idx int) error {
+	obj, ok := u.memo[idx]
+	if !ok {
+		return fmt.Errorf("unpickler.loadMemo: memo index %v not found", idx)
+	}
+	u.push(obj)
+	return nil
+}
+
+func (u *unpickler) loadMemoLine() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	idx, err := strconv.Atoi(line)
+	if err != nil {
+		return fmt.Errorf("unpickler.loadMemoLine: invalid memo index %q", line)
+	}
+	return u.loadMemo(idx)
+}
+
+func (u *unpickler) loadMemoIndex(n int) error {
+	idx, err := u.readUint(n)
+	if err != nil {
+		return err
+	}
+	return u.loadMemo(int(idx))
+}
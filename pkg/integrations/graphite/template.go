@@ -0,0 +1,226 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package graphite
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	measurementElement     = "measurement"
+	measurementRestElement = "measurement*"
+)
+
+// Template maps the nodes of a dotted path to a metric name and labels.
+type Template struct {
+	filter   []string // glob per node; empty matches every path
+	elements []string // "measurement", "measurement*", a label name, or "" to skip the node
+	tags     []Tag    // labels added to every matching path
+}
+
+// Mapper applies the first template whose filter matches a path.
+type Mapper struct {
+	templates []*Template
+}
+
+/*
+Parses a template of the form "[filter] template [tag1=value1,tag2=value2]".
+
+The filter is a dotted glob, e.g. "servers.*", that is matched against the
+first nodes of a path. Each dot separated template element names what the node
+at the same position is: "measurement" is a part of the metric name,
+"measurement*" is the rest of the path as a part of the metric name, any other
+name is a label, and an empty element skips the node. For example the template
+".host.measurement*" maps servers.web01.cpu.load to the metric cpu_load with
+the label host="web01".
+*/
+func ParseTemplate(template string) (*Template, error) {
+	fields := strings.Fields(template)
+	var filter, elements, tags string
+	switch len(fields) {
+	case 1:
+		elements = fields[0]
+	case 2:
+		if strings.Contains(fields[1], "=") {
+			elements, tags = fields[0], fields[1]
+		} else {
+			filter, elements = fields[0], fields[1]
+		}
+	case 3:
+		filter, elements, tags = fields[0], fields[1], fields[2]
+	default:
+		return nil, fmt.Errorf("ParseTemplate: invalid template %q", template)
+	}
+
+	t := &Template{elements: strings.Split(elements, ".")}
+	hasMeasurement := false
+	for _, element := range t.elements {
+		if element == measurementElement || element == measurementRestElement {
+			hasMeasurement = true
+		} else if strings.Contains(element, "*") {
+			return nil, fmt.Errorf("ParseTemplate: invalid element %q in template %q", element, template)
+		}
+	}
+	if !hasMeasurement {
+		return nil, fmt.Errorf("ParseTemplate: template %q has no measurement", template)
+	}
+
+	if filter != "" {
+		t.filter = strings.Split(filter, ".")
+		for _, node := range t.filter {
+			if _, err := path.Match(node, ""); err != nil {
+				return nil, fmt.Errorf("ParseTemplate: invalid filter %q in template %q", filter, template)
+			}
+		}
+	}
+
+	if tags != "" {
+		for _, tag := range strings.Split(tags, ",") {
+			key, value, ok := strings.Cut(tag, "=")
+			if !ok || key == "" || value == "" {
+				return nil, fmt.Errorf("ParseTemplate: invalid tag %q in template %q", tag, template)
+			}
+			t.tags = append(t.tags, Tag{Key: sanitizeLabelName(key), Value: value})
+		}
+	}
+	return t, nil
+}
+
+func NewMapper(templates []string) (*Mapper, error) {
+	mapper := &Mapper{}
+	for _, template := range templates {
+		t, err := ParseTemplate(template)
+		if err != nil {
+			return nil, err
+		}
+		mapper.templates = append(mapper.templates, t)
+	}
+	return mapper, nil
+}
+
+func (t *Template) matches(nodes []string) bool {
+	if len(t.filter) > len(nodes) {
+		return false
+	}
+	for i, pattern := range t.filter {
+		if ok, _ := path.Match(pattern, nodes[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *Template) apply(nodes []string) (string, map[string]string) {
+	labels := make(map[string]string)
+	for _, tag := range t.tags {
+		labels[tag.Key] = tag.Value
+	}
+
+	var nameParts []string
+	for i, element := range t.elements {
+		if i >= len(nodes) {
+			break
+		}
+		switch element {
+		case "":
+		case measurementElement:
+			nameParts = append(nameParts, nodes[i])
+		case measurementRestElement:
+			nameParts = append(nameParts, nodes[i:]...)
+		default:
+			labels[sanitizeLabelName(element)] = nodes[i]
+		}
+		if element == measurementRestElement {
+			break
+		}
+	}
+	return strings.Join(nameParts, "_"), labels
+}
+
+/*
+Returns the metric name and labels of a Graphite series. Paths that match no
+template, or whose template yields no name, use the path with "." replaced by
+"_" as the metric name. The tags of a tagged series take precedence over the
+labels that the template extracts.
+*/
+func (m *Mapper) Map(graphitePath string, tags []Tag) (string, map[string]string) {
+	nodes := strings.Split(graphitePath, ".")
+
+	var name string
+	var labels map[string]string
+	for _, t := range m.templates {
+		if t.matches(nodes) {
+			name, labels = t.apply(nodes)
+			break
+		}
+	}
+	if name == "" {
+		name = strings.Join(nodes, "_")
+	}
+	if labels == nil {
+		labels = make(map[string]string, len(tags))
+	}
+	for _, tag := range tags {
+		if tag.Key == "name" {
+			continue
+		}
+		labels[sanitizeLabelName(tag.Key)] = tag.Value
+	}
+	return sanitizeMetricName(name), labels
+}
+
+// Replaces the characters that are not valid in a Prometheus metric name.
+func sanitizeMetricName(name string) string {
+	return sanitizeName(name, true)
+}
+
+// Replaces the characters that are not valid in a Prometheus label name.
+func sanitizeLabelName(name string) string {
+	return sanitizeName(name, false)
+}
+
+// Names can not start with a digit, so such names are prefixed with "_".
+func sanitizeName(name string, allowColon bool) string {
+	b := []byte(name)
+	for i, c := range b {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9') || (allowColon && c == ':')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 0 && b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+// Returns the labels as tags sorted by key.
+func labelsToTags(labels map[string]string) []Tag {
+	tags := make([]Tag, 0, len(labels))
+	for key, value := range labels {
+		tags = append(tags, Tag{Key: key, Value: value})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Key < tags[j].Key
+	})
+	return tags
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package writer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Field is a field of a point. Values of integer, unsigned and boolean fields
+// are converted to floats, and string fields only keep their raw value.
+type Field struct {
+	Key         string
+	Value       float64
+	IsString    bool
+	StringValue string
+}
+
+// Point is a single line of the InfluxDB line protocol.
+type Point struct {
+	Measurement  string
+	Tags         []Tag
+	Fields       []Field
+	Timestamp    int64
+	HasTimestamp bool
+}
+
+/*
+Parses a line of the InfluxDB line protocol:
+
+	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+
+Commas, equal signs and spaces in names, tag keys, tag values and field keys
+can be escaped with a backslash, and so can double quotes and backslashes in
+string field values. Returns nil for empty lines and comments.
+*/
+func ParseLine(line []byte) (*Point, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' {
+		return nil, nil
+	}
+
+	point := &Point{}
+	measurement, pos := scanEscaped(line, 0, ", ", ", ")
+	if len(measurement) == 0 {
+		return nil, errors.New("missing measurement")
+	}
+	point.Measurement = measurement
+
+	for pos < len(line) && line[pos] == ',' {
+		key, next := scanEscaped(line, pos+1, "=, ", "=, ")
+		if next >= len(line) || line[next] != '=' || len(key) == 0 {
+			return nil, fmt.Errorf("invalid tag in measurement %v", measurement)
+		}
+		value, next := scanEscaped(line, next+1, ", ", "=, ")
+		if len(value) == 0 {
+			return nil, fmt.Errorf("invalid value for tag %v", key)
+		}
+		point.Tags = append(point.Tags, Tag{Key: key, Value: value})
+		pos = next
+	}
+
+	pos = skipSpaces(line, pos)
+	if pos >= len(line) {
+		return nil, errors.New("missing fields")
+	}
+	for {
+		key, next := scanEscaped(line, pos, "=, ", "=, ")
+		if next >= len(line) || line[next] != '=' || len(key) == 0 {
+			return nil, errors.New("missing field key")
+		}
+		field, next, err := parseFieldValue(line, next+1)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for field %v: %v", key, err)
+		}
+		field.Key = key
+		point.Fields = append(point.Fields, *field)
+
+		pos = next
+		if pos >= len(line) || line[pos] != ',' {
+			break
+		}
+		pos++
+	}
+
+	if pos < len(line) && line[pos] != ' ' {
+		return nil, fmt.Errorf("unexpected character %q after the fields", line[pos])
+	}
+	pos = skipSpaces(line, pos)
+	if pos < len(line) {
+		ts, err := strconv.ParseInt(string(line[pos:]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", line[pos:])
+		}
+		point.Timestamp = ts
+		point.HasTimestamp = true
+	}
+	return point, nil
+}
+
+// Reads from pos until an unescaped delimiter, and returns the value with the
+// escaped characters unescaped and the position of the delimiter.
+func scanEscaped(line []byte, pos int, delimiters string, escapable string) (string, int) {
+	var value []byte
+	for pos < len(line) {
+		c := line[pos]
+		if c == '\\' && pos+1 < len(line) && (bytes.IndexByte([]byte(escapable), line[pos+1]) >= 0 || line[pos+1] == '\\') {
+			value = append(value, line[pos+1])
+			pos += 2
+			continue
+		}
+		if bytes.IndexByte([]byte(delimiters), c) >= 0 {
+			break
+		}
+		value = append(value, c)
+		pos++
+	}
+	return string(value), pos
+}
+
+func skipSpaces(line []byte, pos int) int {
+	for pos < len(line) && line[pos] == ' ' {
+		pos++
+	}
+	return pos
+}
+
+func parseFieldValue(line []byte, pos int) (*Field, int, error) {
+	if pos >= len(line) {
+		return nil, pos, errors.New("missing value")
+	}
+
+	if line[pos] == '"' {
+		var value []byte
+		pos++
+		for pos < len(line) {
+			c := line[pos]
+			if c == '\\' && pos+1 < len(line) && (line[pos+1] == '"' || line[pos+1] == '\\') {
+				value = append(value, line[pos+1])
+				pos += 2
+				continue
+			}
+			if c == '"' {
+				return &Field{IsString: true, StringValue: string(value)}, pos + 1, nil
+			}
+			value = append(value, c)
+			pos++
+		}
+		return nil, pos, errors.New("unterminated string")
+	}
+
+	end := pos
+	for end < len(line) && line[end] != ',' && line[end] != ' ' {
+		end++
+	}
+	raw := string(line[pos:end])
+	if raw == "" {
+		return nil, end, errors.New("missing value")
+	}
+
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return &Field{Value: 1}, end, nil
+	case "f", "F", "false", "False", "FALSE":
+		return &Field{Value: 0}, end, nil
+	}
+
+	switch raw[len(raw)-1] {
+	case 'i':
+		value, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return nil, end, fmt.Errorf("invalid integer %q", raw)
+		}
+		return &Field{Value: float64(value)}, end, nil
+	case 'u':
+		value, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return nil, end, fmt.Errorf("invalid unsigned integer %q", raw)
+		}
+		return &Field{Value: float64(value)}, end, nil
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, end, fmt.Errorf("invalid float %q", raw)
+	}
+	return &Field{Value: value}, end, nil
+}
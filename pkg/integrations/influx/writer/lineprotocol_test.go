@@ -0,0 +1,84 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package writer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseLine(t *testing.T) {
+	point, err := ParseLine([]byte(`cpu,host=server\ 01,region=us\,west,path=a=b usage_idle=98.5,count=3i,total=7u,up=t,msg="say \"hi\", bye" 1700000000000000000`))
+	assert.Nil(t, err)
+	assert.Equal(t, &Point{
+		Measurement: "cpu",
+		Tags: []Tag{
+			{Key: "host", Value: "server 01"},
+			{Key: "region", Value: "us,west"},
+			{Key: "path", Value: "a=b"},
+		},
+		Fields: []Field{
+			{Key: "usage_idle", Value: 98.5},
+			{Key: "count", Value: 3},
+			{Key: "total", Value: 7},
+			{Key: "up", Value: 1},
+			{Key: "msg", IsString: true, StringValue: `say "hi", bye`},
+		},
+		Timestamp:    1700000000000000000,
+		HasTimestamp: true,
+	}, point)
+
+	point, err = ParseLine([]byte("disk\\ io  reads=FALSE  "))
+	assert.Nil(t, err)
+	assert.Equal(t, &Point{Measurement: "disk io", Fields: []Field{{Key: "reads", Value: 0}}}, point)
+
+	for _, empty := range []string{"", "   ", "# a comment"} {
+		point, err = ParseLine([]byte(empty))
+		assert.Nil(t, err)
+		assert.Nil(t, point)
+	}
+
+	for _, invalid := range []string{
+		"cpu",
+		"cpu ",
+		",host=a value=1",
+		"cpu,host value=1",
+		"cpu,host= value=1",
+		"cpu value=",
+		"cpu value=1,",
+		"cpu value=abc",
+		"cpu value=NaN",
+		"cpu value=1.5i",
+		`cpu value="unterminated`,
+		`cpu value="a"b`,
+		"cpu value=1 notatimestamp",
+	} {
+		_, err = ParseLine([]byte(invalid))
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func Test_GetTimestampSecs(t *testing.T) {
+	assert.Equal(t, uint32(1700000000), getTimestampSecs(1700000000123456789, precisionToNanos["ns"]))
+	assert.Equal(t, uint32(1700000000), getTimestampSecs(1700000000123456, precisionToNanos["us"]))
+	assert.Equal(t, uint32(1700000000), getTimestampSecs(1700000000123, precisionToNanos["ms"]))
+	assert.Equal(t, uint32(1700000000), getTimestampSecs(1700000000, precisionToNanos["s"]))
+	assert.Equal(t, uint32(1700000040), getTimestampSecs(28333334, precisionToNanos["m"]))
+	assert.Equal(t, uint32(1699999200), getTimestampSecs(472222, precisionToNanos["h"]))
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package writer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/siglens/siglens/pkg/grpc"
+	"github.com/siglens/siglens/pkg/hooks"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics"
+	"github.com/siglens/siglens/pkg/usageStats"
+	"github.com/siglens/siglens/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// Only the first errors of a request are reported back to the client.
+const MAX_REPORTED_ERRORS = 10
+
+// Nanoseconds per unit of the precision parameter of the v1 and v2 APIs
+var precisionToNanos = map[string]int64{
+	"":   1,
+	"n":  1,
+	"ns": 1,
+	"u":  int64(time.Microsecond),
+	"us": int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+	"m":  int64(time.Minute),
+	"h":  int64(time.Hour),
+}
+
+// The error body of the v2 write API
+type influxV2ErrorResp struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// The error body of the v1 write API
+type influxV1ErrorResp struct {
+	Error string `json:"error"`
+}
+
+// Handles the v1 /write API. The db and rp parameters are ignored, since the
+// metrics of an org are not split into databases.
+func PutMetricsV1(ctx *fasthttp.RequestCtx, myid int64) {
+	putMetrics(ctx, myid, func(code int, msg string) {
+		writeInfluxResponse(ctx, code, &influxV1ErrorResp{Error: msg})
+	})
+}
+
+// Handles the v2 /api/v2/write API. The org and bucket parameters are
+// ignored, since the metrics of an org are not split into buckets.
+func PutMetricsV2(ctx *fasthttp.RequestCtx, myid int64) {
+	putMetrics(ctx, myid, func(code int, msg string) {
+		errCode := "invalid"
+		if code == fasthttp.StatusInternalServerError {
+			errCode = "internal error"
+		}
+		writeInfluxResponse(ctx, code, &influxV2ErrorResp{Code: errCode, Message: msg})
+	})
+}
+
+func putMetrics(ctx *fasthttp.RequestCtx, myid int64, writeError func(code int, msg string)) {
+	if hook := hooks.GlobalHooks.OverrideIngestRequestHook; hook != nil {
+		alreadyHandled := hook(ctx, myid, grpc.INGEST_FUNC_INFLUX_METRICS, false)
+		if alreadyHandled {
+			return
+		}
+	}
+
+	precision := string(ctx.QueryArgs().Peek("precision"))
+	if _, ok := precisionToNanos[precision]; !ok {
+		log.Errorf("putMetrics: unsupported precision %v", precision)
+		writeError(fasthttp.StatusBadRequest, fmt.Sprintf("unsupported precision %q", precision))
+		return
+	}
+
+	body := ctx.PostBody()
+	encoding := string(ctx.Request.Header.ContentEncoding())
+	switch encoding {
+	case "", "identity":
+	case "gzip":
+		var err error
+		body, err = ctx.Request.BodyGunzip()
+		if err != nil {
+			log.Errorf("putMetrics: error unzipping body, err=%v", err)
+			writeError(fasthttp.StatusBadRequest, "unable to decompress the gzip body")
+			return
+		}
+	default:
+		log.Errorf("putMetrics: unsupported content encoding %v", encoding)
+		writeError(fasthttp.StatusUnsupportedMediaType, fmt.Sprintf("unsupported content encoding %q", encoding))
+		return
+	}
+
+	_, failedCount, err := HandlePutMetrics(body, precision, myid)
+	if err != nil {
+		writeError(fasthttp.StatusBadRequest, err.Error())
+		return
+	}
+	if failedCount > 0 {
+		writeError(fasthttp.StatusInternalServerError, fmt.Sprintf("failed to write %v points", failedCount))
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+/*
+Writes every numeric field of the points in the body as a metric called
+<measurement>_<field>, with the tags of the point as its labels. Boolean fields
+are written as 0 or 1, and string fields are skipped.
+
+Lines that can not be parsed do not stop the other lines from being written.
+Returns the number of written and failed datapoints, and an error listing the
+lines that could not be parsed.
+*/
+func HandlePutMetrics(body []byte, precision string, myid int64) (uint64, uint64, error) {
+	var successCount uint64 = 0
+	var failedCount uint64 = 0
+	nanosPerUnit := precisionToNanos[precision]
+	now := uint32(time.Now().Unix())
+
+	lineErrors := make([]string, 0)
+	numBadLines := 0
+	lines := bytes.Split(body, []byte("\n"))
+	for lineNum, line := range lines {
+		point, err := ParseLine(line)
+		if err != nil {
+			numBadLines++
+			if len(lineErrors) < MAX_REPORTED_ERRORS {
+				lineErrors = append(lineErrors, fmt.Sprintf("line %v: %v", lineNum+1, err))
+			}
+			continue
+		}
+		if point == nil {
+			continue
+		}
+
+		ts := now
+		if point.HasTimestamp {
+			ts = getTimestampSecs(point.Timestamp, nanosPerUnit)
+		}
+
+		tagHolder := metrics.GetTagsHolder()
+		for _, tag := range point.Tags {
+			tagHolder.Insert(tag.Key, []byte(tag.Value), jsonparser.String)
+		}
+		for _, field := range point.Fields {
+			if field.IsString {
+				continue
+			}
+			mName := []byte(point.Measurement + "_" + field.Key)
+			err = metrics.EncodeDatapoint(mName, tagHolder, field.Value, ts, uint64(len(line)), myid)
+			if err != nil {
+				log.Errorf("HandlePutMetrics: failed to encode data for metric=%s, orgid=%v, err=%v", mName, myid, err)
+				failedCount++
+				continue
+			}
+			successCount++
+		}
+	}
+	usageStats.UpdateMetricsStats(uint64(len(body)), successCount, myid)
+
+	if numBadLines > 0 {
+		if numBadLines > len(lineErrors) {
+			lineErrors = append(lineErrors, fmt.Sprintf("and %v more lines", numBadLines-len(lineErrors)))
+		}
+		return successCount, failedCount, fmt.Errorf("partial write: unable to parse %v lines: %v", numBadLines, strings.Join(lineErrors, "; "))
+	}
+	return successCount, failedCount, nil
+}
+
+func getTimestampSecs(timestamp int64, nanosPerUnit int64) uint32 {
+	if nanosPerUnit >= int64(time.Second) {
+		return uint32(timestamp * (nanosPerUnit / int64(time.Second)))
+	}
+	return uint32(timestamp / (int64(time.Second) / nanosPerUnit))
+}
+
+func writeInfluxResponse(ctx *fasthttp.RequestCtx, code int, resp interface{}) {
+	ctx.SetStatusCode(code)
+	ctx.SetContentType(utils.ContentJson)
+	jval, err := json.Marshal(resp)
+	if err != nil {
+		log.Errorf("writeInfluxResponse: failed to marshal resp %+v, err=%v", resp, err)
+		return
+	}
+	_, err = ctx.Write(jval)
+	if err != nil {
+		log.Errorf("writeInfluxResponse: failed to write response, err=%v", err)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package writer
+
+import (
+	"os"
+	"testing"
+
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/segment/writer"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func initTestWriter(t *testing.T) {
+	config.InitializeTestingConfig(t.TempDir())
+	writer.InitWriterNode()
+	t.Cleanup(func() {
+		err := os.RemoveAll(config.GetDataPath())
+		assert.NoError(t, err)
+	})
+}
+
+func Test_HandlePutMetrics(t *testing.T) {
+	initTestWriter(t)
+
+	body := []byte("cpu,host=a usage_user=1.5,usage_system=2,state=\"ok\" 1700000000\n\nmem,host=a used=10i\n")
+	success, fail, err := HandlePutMetrics(body, "s", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), success)
+	assert.Equal(t, uint64(0), fail)
+
+	// the valid lines are still written when other lines can not be parsed
+	body = []byte("cpu,host=a usage_user=1.5 1700000000\ncpu,host=b\nmem used=\n")
+	success, fail, err = HandlePutMetrics(body, "s", 0)
+	assert.Equal(t, uint64(1), success)
+	assert.Equal(t, uint64(0), fail)
+	assert.ErrorContains(t, err, "partial write: unable to parse 2 lines: line 2: missing fields; line 3")
+}
+
+func Test_PutMetricsV2(t *testing.T) {
+	initTestWriter(t)
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/influx/api/v2/write?org=o&bucket=b&precision=ms")
+	ctx.Request.Header.SetContentEncoding("gzip")
+	ctx.Request.SetBody(fasthttp.AppendGzipBytes(nil, []byte("cpu,host=a usage_user=1.5 1700000000000\n")))
+	PutMetricsV2(ctx, 0)
+	assert.Equal(t, fasthttp.StatusNoContent, ctx.Response.StatusCode())
+
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/influx/api/v2/write")
+	ctx.Request.SetBody([]byte("cpu usage_user=abc\n"))
+	PutMetricsV2(ctx, 0)
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+	assert.Contains(t, string(ctx.Response.Body()), `"code":"invalid"`)
+
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/influx/write?db=telegraf&precision=d")
+	ctx.Request.SetBody([]byte("cpu usage_user=1\n"))
+	PutMetricsV1(ctx, 0)
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+	assert.Contains(t, string(ctx.Response.Body()), `{"error":"unsupported precision \"d\""}`)
+}
@@ -30,6 +30,7 @@ import (
 	"github.com/siglens/siglens/pkg/segment"
 	"github.com/siglens/siglens/pkg/segment/structs"
 	sutils "github.com/siglens/siglens/pkg/segment/utils"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/rollup"
 	. "github.com/siglens/siglens/pkg/utils"
 	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
@@ -92,6 +93,7 @@ func asyncMetricsQueryRequest(wg *sync.WaitGroup, alias string, req *structs.Met
 	defer wg.Done()
 	qid := rutils.GetNextQid()
 	segment.LogMetricsQuery("metrics query parser", req, qid)
+	rollup.SetQueryResolution(&req.MetricsQuery)
 	res := segment.ExecuteMetricsQuery(&req.MetricsQuery, &req.TimeRange, qid)
 	mQResponse, err := res.GetOTSDBResults(&req.MetricsQuery)
 	if err != nil {
@@ -29,6 +29,7 @@ import (
 	"github.com/siglens/siglens/pkg/segment"
 	"github.com/siglens/siglens/pkg/segment/structs"
 	sutils "github.com/siglens/siglens/pkg/segment/utils"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/rollup"
 	"github.com/siglens/siglens/pkg/utils"
 	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
@@ -51,6 +52,7 @@ func MetricsQueryParser(ctx *fasthttp.RequestCtx, myid int64) {
 	qid := rutils.GetNextQid()
 	segment.LogMetricsQuery("metrics query parser", mQRequest, qid)
 	mQRequest.MetricsQuery.OrgId = myid
+	rollup.SetQueryResolution(&mQRequest.MetricsQuery)
 	res := segment.ExecuteMetricsQuery(&mQRequest.MetricsQuery, &mQRequest.TimeRange, qid)
 	mQResponse, err := res.GetOTSDBResults(&mQRequest.MetricsQuery)
 	if err != nil {
@@ -21,14 +21,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"strings"
 
 	"github.com/buger/jsonparser"
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/siglens/siglens/pkg/grpc"
 	"github.com/siglens/siglens/pkg/hooks"
 	"github.com/siglens/siglens/pkg/segment/writer/metrics"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/histogram"
 	"github.com/siglens/siglens/pkg/usageStats"
 	"github.com/siglens/siglens/pkg/utils"
 	log "github.com/sirupsen/logrus"
@@ -110,7 +113,27 @@ func HandlePutMetrics(compressed []byte, myid int64) (uint64, uint64, error) {
 		return successCount, failedCount, err
 	}
 
-	for _, ts := range req.Timeseries {
+	WriteMetadata(req.Metadata, myid)
+	successCount, failedCount = WriteTimeSeries(req.Timeseries, uint64(len(compressed)), myid)
+	bytesReceived := uint64(len(compressed))
+	usageStats.UpdateMetricsStats(bytesReceived, successCount, myid)
+	return successCount, failedCount, nil
+}
+
+/*
+Writes the samples and native histograms of the time series into the metrics
+segments of the org. nBytes is the size of the request that the series came in,
+and is only used for the ingestion stats of the metrics segments.
+
+Returns the number of samples that were written and that failed. Exemplars are
+stored along with the series, but do not count as samples. This is shared by
+the remote write handler and the scrape manager.
+*/
+func WriteTimeSeries(timeseries []prompb.TimeSeries, nBytes uint64, myid int64) (uint64, uint64) {
+	var successCount uint64 = 0
+	var failedCount uint64 = 0
+
+	for _, ts := range timeseries {
 		tagHolder := metrics.GetTagsHolder()
 		var mName []byte
 		for _, l := range ts.Labels {
@@ -129,19 +152,104 @@ func HandlePutMetrics(compressed []byte, myid int64) (uint64, uint64, error) {
 			}
 
 			ts1 := parseTimestamp(s.Timestamp)
-			err = metrics.EncodeDatapoint(mName, tagHolder, s.Value, ts1, uint64(len(compressed)), myid)
+			err := metrics.EncodeDatapoint(mName, tagHolder, s.Value, ts1, nBytes, myid)
 			if err != nil {
-				log.Errorf("HandlePutMetrics: failed to encode data for metric=%s, orgid=%v, err=%v", mName, myid, err)
+				log.Errorf("WriteTimeSeries: failed to encode data for metric=%s, orgid=%v, err=%v", mName, myid, err)
 				failedCount++
 				continue
 			}
 			successCount++
 
 		}
+
+		for i := range ts.Histograms {
+			h := convertNativeHistogram(&ts.Histograms[i])
+			ts1 := parseTimestamp(ts.Histograms[i].Timestamp)
+			err := metrics.EncodeHistogramDatapoint(mName, tagHolder, h, ts1, nBytes, myid)
+			if err != nil {
+				log.Errorf("WriteTimeSeries: failed to encode histogram for metric=%s, orgid=%v, err=%v", mName, myid, err)
+				failedCount++
+				continue
+			}
+			successCount++
+		}
+
+		for i := range ts.Exemplars {
+			err := metrics.AddExemplar(mName, tagHolder, convertExemplar(&ts.Exemplars[i]), myid)
+			if err != nil {
+				log.Debugf("WriteTimeSeries: failed to add exemplar for metric=%s, orgid=%v, err=%v", mName, myid, err)
+			}
+		}
 	}
-	bytesReceived := uint64(len(compressed))
-	usageStats.UpdateMetricsStats(bytesReceived, successCount, myid)
-	return successCount, failedCount, nil
+	return successCount, failedCount
+}
+
+func convertExemplar(pe *prompb.Exemplar) metrics.Exemplar {
+	lb := labels.NewScratchBuilder(len(pe.Labels))
+	for _, l := range pe.Labels {
+		lb.Add(l.Name, l.Value)
+	}
+	lb.Sort()
+	return metrics.Exemplar{
+		Labels:    lb.Labels(),
+		Value:     pe.Value,
+		Timestamp: pe.Timestamp,
+	}
+}
+
+// Records the TYPE, HELP and UNIT of the metric families in a write request.
+func WriteMetadata(metadata []prompb.MetricMetadata, myid int64) {
+	for _, md := range metadata {
+		metrics.UpdateMetricMetadata(myid, md.MetricFamilyName, metrics.MetricMetadata{
+			Type: strings.ToLower(md.Type.String()),
+			Help: md.Help,
+			Unit: md.Unit,
+		})
+	}
+}
+
+// Converts a Prometheus native histogram, whose integer bucket counts are
+// delta encoded, to a histogram with absolute counts.
+func convertNativeHistogram(ph *prompb.Histogram) *histogram.Histogram {
+	h := &histogram.Histogram{
+		Schema:        ph.Schema,
+		ZeroThreshold: ph.ZeroThreshold,
+		Sum:           ph.Sum,
+		PositiveSpans: convertBucketSpans(ph.PositiveSpans),
+		NegativeSpans: convertBucketSpans(ph.NegativeSpans),
+	}
+
+	if ph.IsFloatHistogram() {
+		h.Count = ph.GetCountFloat()
+		h.ZeroCount = ph.GetZeroCountFloat()
+		h.PositiveBuckets = append([]float64(nil), ph.PositiveCounts...)
+		h.NegativeBuckets = append([]float64(nil), ph.NegativeCounts...)
+		return h
+	}
+
+	h.Count = float64(ph.GetCountInt())
+	h.ZeroCount = float64(ph.GetZeroCountInt())
+	h.PositiveBuckets = convertBucketDeltas(ph.PositiveDeltas)
+	h.NegativeBuckets = convertBucketDeltas(ph.NegativeDeltas)
+	return h
+}
+
+func convertBucketSpans(spans []prompb.BucketSpan) []histogram.Span {
+	converted := make([]histogram.Span, len(spans))
+	for i, span := range spans {
+		converted[i] = histogram.Span{Offset: span.Offset, Length: span.Length}
+	}
+	return converted
+}
+
+func convertBucketDeltas(deltas []int64) []float64 {
+	counts := make([]float64, len(deltas))
+	count := int64(0)
+	for i, delta := range deltas {
+		count += delta
+		counts[i] = float64(count)
+	}
+	return counts
 }
 
 func parseTimestamp(timestamp int64) uint32 {
@@ -27,9 +27,12 @@ import (
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/siglens/siglens/pkg/config"
 	"github.com/siglens/siglens/pkg/segment/writer"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/histogram"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -100,9 +103,80 @@ func Test_HandlePutMetrics_BadValues(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func Test_HandlePutMetrics_MetadataAndExemplars(t *testing.T) {
+	config.InitializeTestingConfig(t.TempDir())
+	writer.InitWriterNode()
+	t.Cleanup(func() {
+		metrics.ResetMetricsSegStore_TestOnly()
+		err := os.RemoveAll(config.GetDataPath())
+		assert.NoError(t, err)
+	})
+
+	now := time.Now().UnixMilli()
+	writeRequest := prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{{
+			Labels:    []prompb.Label{{Name: model.MetricNameLabel, Value: "http_requests_total"}, {Name: "code", Value: "200"}},
+			Samples:   []prompb.Sample{{Value: 7, Timestamp: now}},
+			Exemplars: []prompb.Exemplar{{Labels: []prompb.Label{{Name: "trace_id", Value: "abc"}}, Value: 1, Timestamp: now}},
+		}},
+		Metadata: []prompb.MetricMetadata{{
+			Type:             prompb.MetricMetadata_COUNTER,
+			MetricFamilyName: "http_requests_total",
+			Help:             "Number of HTTP requests.",
+		}},
+	}
+	protoBytes, err := proto.Marshal(&writeRequest)
+	assert.NoError(t, err)
+
+	numSuccess, numFail, err := HandlePutMetrics(snappy.Encode(nil, protoBytes), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), numSuccess)
+	assert.Equal(t, uint64(0), numFail)
+
+	assert.Equal(t, map[string][]metrics.MetricMetadata{
+		"http_requests_total": {{Type: "counter", Help: "Number of HTTP requests."}},
+	}, metrics.GetMetricMetadata(0, "", -1, -1))
+
+	matchers := [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "code", "200")}}
+	result := metrics.QueryExemplars(0, now, now, matchers)
+	assert.Len(t, result, 1)
+	assert.Equal(t, []metrics.Exemplar{{Labels: labels.FromStrings("trace_id", "abc"), Value: 1, Timestamp: now}}, result[0].Exemplars)
+}
+
 func Test_isBadValue(t *testing.T) {
 	assert.True(t, isBadValue(math.NaN()))
 	assert.True(t, isBadValue(math.Inf(1)))
 	assert.True(t, isBadValue(math.Inf(-1)))
 	assert.False(t, isBadValue(42))
 }
+
+func Test_convertNativeHistogram(t *testing.T) {
+	spans := []prompb.BucketSpan{{Offset: -1, Length: 2}, {Offset: 2, Length: 1}}
+
+	h := convertNativeHistogram(&prompb.Histogram{
+		Count:          &prompb.Histogram_CountInt{CountInt: 12},
+		Sum:            30,
+		Schema:         1,
+		ZeroThreshold:  0.001,
+		ZeroCount:      &prompb.Histogram_ZeroCountInt{ZeroCountInt: 2},
+		PositiveSpans:  spans,
+		PositiveDeltas: []int64{3, 2, -4},
+	})
+	assert.Nil(t, h.Validate())
+	assert.Equal(t, int32(1), h.Schema)
+	assert.Equal(t, float64(12), h.Count)
+	assert.Equal(t, float64(2), h.ZeroCount)
+	assert.Equal(t, []float64{3, 5, 1}, h.PositiveBuckets)
+	assert.Equal(t, []histogram.Span{{Offset: -1, Length: 2}, {Offset: 2, Length: 1}}, h.PositiveSpans)
+
+	h = convertNativeHistogram(&prompb.Histogram{
+		Count:          &prompb.Histogram_CountFloat{CountFloat: 4.5},
+		ZeroCount:      &prompb.Histogram_ZeroCountFloat{ZeroCountFloat: 0.5},
+		NegativeSpans:  spans,
+		NegativeCounts: []float64{1, 2, 1},
+	})
+	assert.Nil(t, h.Validate())
+	assert.Equal(t, float64(4.5), h.Count)
+	assert.Equal(t, float64(0.5), h.ZeroCount)
+	assert.Equal(t, []float64{1, 2, 1}, h.NegativeBuckets)
+}
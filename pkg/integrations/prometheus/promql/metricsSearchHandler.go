@@ -35,6 +35,8 @@ import (
 
 	"github.com/prometheus/prometheus/promql/parser"
 	dtu "github.com/siglens/siglens/pkg/common/dtypeutils"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/config/common"
 	putils "github.com/siglens/siglens/pkg/integrations/prometheus/utils"
 	rutils "github.com/siglens/siglens/pkg/readerUtils"
 	"github.com/siglens/siglens/pkg/segment"
@@ -47,6 +49,7 @@ import (
 	"github.com/siglens/siglens/pkg/segment/structs"
 	sutils "github.com/siglens/siglens/pkg/segment/utils"
 	"github.com/siglens/siglens/pkg/segment/writer/metrics"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/rollup"
 	"github.com/siglens/siglens/pkg/usageStats"
 	"github.com/siglens/siglens/pkg/utils"
 	. "github.com/siglens/siglens/pkg/utils"
@@ -182,19 +185,41 @@ func ProcessPromqlMetricsSearchRequest(ctx *fasthttp.RequestCtx, myid int64) {
 		}
 	}
 
-	startTime := endTime - DEFAULT_LOOKBACK_FOR_INSTANT_QUERIES
-	log.Infof("qid=%v, ProcessPromqlMetricsSearchRequest: InstantQuery; searchString=[%v] startEpochs=[%v] endEpochs=[%v]", qid, searchText, startTime, endTime)
-	metricQueryRequest, pqlQuerytype, queryArithmetic, err := ConvertPromQLToMetricsQuery(searchText, startTime, endTime, myid)
+	log.Infof("qid=%v, ProcessPromqlMetricsSearchRequest: InstantQuery; searchString=[%v] endEpochs=[%v]", qid, searchText, endTime)
+	res, pqlQuerytype, err := ExecuteInstantQuery(searchText, endTime, myid, qid)
 	if err != nil {
 		utils.SendError(ctx, "Error parsing promql query", fmt.Sprintf("qid=%v, Metrics Query: %+v", qid, searchText), err)
 		return
 	}
-	if len(metricQueryRequest) == 0 && len(queryArithmetic) == 0 {
+	if res == nil {
 		ctx.SetContentType(ContentJson)
 		WriteJsonResponse(ctx, map[string]interface{}{})
 		return
 	}
 
+	mQResponse, err := res.GetResultsPromQlInstantQuery(pqlQuerytype, endTime)
+	if err != nil {
+		utils.SendError(ctx, "Failed to get results", fmt.Sprintf("Query: %s", searchText), err)
+		return
+	}
+	WriteJsonResponse(ctx, &mQResponse)
+	ctx.SetContentType(ContentJson)
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// Evaluates the PromQL query as an instant query at endTime, looking back
+// DEFAULT_LOOKBACK_FOR_INSTANT_QUERIES for samples. Returns a nil result if
+// the query has nothing to execute.
+func ExecuteInstantQuery(searchText string, endTime uint32, myid int64, qid uint64) (*mresults.MetricsResult, parser.ValueType, error) {
+	startTime := endTime - DEFAULT_LOOKBACK_FOR_INSTANT_QUERIES
+	metricQueryRequest, pqlQuerytype, queryArithmetic, err := ConvertPromQLToMetricsQuery(searchText, startTime, endTime, myid)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(metricQueryRequest) == 0 && len(queryArithmetic) == 0 {
+		return nil, pqlQuerytype, nil
+	}
+
 	metricQueriesList := make([]*structs.MetricsQuery, 0)
 	var timeRange *dtu.MetricsTimeRange
 	hashList := make([]uint64, 0)
@@ -208,14 +233,36 @@ func ProcessPromqlMetricsSearchRequest(ctx *fasthttp.RequestCtx, myid int64) {
 	segment.LogMetricsQueryOps("PromQL metrics query parser: Ops: ", queryArithmetic, qid)
 	res := segment.ExecuteMultipleMetricsQuery(hashList, metricQueriesList, queryArithmetic, timeRange, qid, false)
 
-	mQResponse, err := res.GetResultsPromQlInstantQuery(pqlQuerytype, endTime)
+	return res, pqlQuerytype, nil
+}
+
+// Evaluates the PromQL query as a range query from startTime to endTime, with
+// the series downsampled to step. Returns the executed metrics queries along
+// with the result.
+func ExecuteRangeQuery(searchText string, startTime, endTime uint32, step time.Duration, myid int64,
+	qid uint64) (*mresults.MetricsResult, []*structs.MetricsQuery, parser.ValueType, error) {
+
+	metricQueryRequest, pqlQuerytype, queryArithmetic, err := ConvertPromQLToMetricsQuery(searchText, startTime, endTime, myid)
 	if err != nil {
-		utils.SendError(ctx, "Failed to get results", fmt.Sprintf("Query: %s", searchText), err)
-		return
+		return nil, nil, "", err
 	}
-	WriteJsonResponse(ctx, &mQResponse)
-	ctx.SetContentType(ContentJson)
-	ctx.SetStatusCode(fasthttp.StatusOK)
+
+	metricQueriesList := make([]*structs.MetricsQuery, 0)
+	var timeRange *dtu.MetricsTimeRange
+	hashList := make([]uint64, 0)
+	for i := range metricQueryRequest {
+		metricQueryRequest[i].MetricsQuery.Downsampler.Interval = int(step.Seconds())
+		metricQueryRequest[i].MetricsQuery.Downsampler.Unit = "s"
+		rollup.SetQueryResolution(&metricQueryRequest[i].MetricsQuery)
+		hashList = append(hashList, metricQueryRequest[i].MetricsQuery.QueryHash)
+		metricQueriesList = append(metricQueriesList, &metricQueryRequest[i].MetricsQuery)
+		segment.LogMetricsQuery("PromQL metrics query parser", &metricQueryRequest[i], qid)
+		timeRange = &metricQueryRequest[i].TimeRange
+	}
+	segment.LogMetricsQueryOps("PromQL metrics query parser: Ops: ", queryArithmetic, qid)
+	res := segment.ExecuteMultipleMetricsQuery(hashList, metricQueriesList, queryArithmetic, timeRange, qid, false)
+
+	return res, metricQueriesList, pqlQuerytype, nil
 }
 
 func ProcessPromqlMetricsRangeSearchRequest(ctx *fasthttp.RequestCtx, myid int64) {
@@ -261,32 +308,18 @@ func ProcessPromqlMetricsRangeSearchRequest(ctx *fasthttp.RequestCtx, myid int64
 
 	log.Infof("qid=%v, ProcessPromqlMetricsRangeSearchRequest:  searchString=[%v] startEpochs=[%v] endEpochs=[%v] step=[%v]", qid, searchText, startTime, endTime, step)
 
-	metricQueryRequest, pqlQuerytype, queryArithmetic, err := ConvertPromQLToMetricsQuery(searchText, startTime, endTime, myid)
+	res, metricQueriesList, pqlQuerytype, err := ExecuteRangeQuery(searchText, startTime, endTime, step, myid, qid)
 	if err != nil {
 		utils.SendError(ctx, "Error parsing promql query", fmt.Sprintf("qid=%v, Metrics Query: %+v", qid, searchText), err)
 		return
 	}
 
-	metricQueriesList := make([]*structs.MetricsQuery, 0)
-	var timeRange *dtu.MetricsTimeRange
-	hashList := make([]uint64, 0)
-	for i := range metricQueryRequest {
-		metricQueryRequest[i].MetricsQuery.Downsampler.Interval = int(step.Seconds())
-		metricQueryRequest[i].MetricsQuery.Downsampler.Unit = "s"
-		hashList = append(hashList, metricQueryRequest[i].MetricsQuery.QueryHash)
-		metricQueriesList = append(metricQueriesList, &metricQueryRequest[i].MetricsQuery)
-		segment.LogMetricsQuery("PromQL metrics query parser", &metricQueryRequest[i], qid)
-		timeRange = &metricQueryRequest[i].TimeRange
-	}
-	segment.LogMetricsQueryOps("PromQL metrics query parser: Ops: ", queryArithmetic, qid)
-	res := segment.ExecuteMultipleMetricsQuery(hashList, metricQueriesList, queryArithmetic, timeRange, qid, false)
-
 	var mQResponse *structs.MetricsPromQLRangeQueryResponse
 
 	if res.IsScalar {
 		mQResponse, err = res.GetResultsPromQlForScalarType(pqlQuerytype, startTime, endTime, uint32(step.Seconds()))
 	} else {
-		mQResponse, err = res.GetResultsPromQl(&metricQueryRequest[0].MetricsQuery, pqlQuerytype)
+		mQResponse, err = res.GetResultsPromQl(metricQueriesList[0], pqlQuerytype)
 	}
 	if err != nil {
 		utils.SendError(ctx, "Failed to get results", fmt.Sprintf("Query: %s", searchText), err)
@@ -523,6 +556,113 @@ func ProcessGetSeriesByLabelRequest(ctx *fasthttp.RequestCtx, myid int64) {
 	ctx.SetStatusCode(fasthttp.StatusOK)
 }
 
+// Returns the TYPE, HELP and UNIT of the metric families in the format of the
+// Prometheus /api/v1/metadata API.
+func ProcessGetMetricMetadataRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	limit, err := getOptionalIntParam(ctx, "limit")
+	if err != nil {
+		utils.SendError(ctx, err.Error(), "", err)
+		return
+	}
+	limitPerMetric, err := getOptionalIntParam(ctx, "limit_per_metric")
+	if err != nil {
+		utils.SendError(ctx, err.Error(), "", err)
+		return
+	}
+	metricName := string(ctx.FormValue("metric"))
+
+	response := map[string]interface{}{
+		"status": "success",
+		"data":   metrics.GetMetricMetadata(myid, metricName, limit, limitPerMetric),
+	}
+	WriteJsonResponse(ctx, &response)
+	ctx.SetContentType(ContentJson)
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// Returns -1 when the parameter is not set.
+func getOptionalIntParam(ctx *fasthttp.RequestCtx, name string) (int, error) {
+	param := string(ctx.FormValue(name))
+	if param == "" {
+		return -1, nil
+	}
+	value, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %v %q", name, param)
+	}
+	return value, nil
+}
+
+// Returns the exemplars of the series selected by the query in the format of
+// the Prometheus /api/v1/query_exemplars API. Without start and end, all
+// stored exemplars up to now are searched.
+func ProcessQueryExemplarsRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	type exemplarOutput struct {
+		Labels    map[string]string `json:"labels"`
+		Value     string            `json:"value"`
+		Timestamp float64           `json:"timestamp"`
+	}
+
+	type seriesOutput struct {
+		SeriesLabels map[string]string `json:"seriesLabels"`
+		Exemplars    []exemplarOutput  `json:"exemplars"`
+	}
+
+	queryParam := string(ctx.FormValue("query"))
+	expr, err := ParsePromQLExpr(queryParam)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Invalid query: %v", err), fmt.Sprintf("query: %v", queryParam), err)
+		return
+	}
+
+	startMs := int64(0)
+	endMs := time.Now().UnixMilli()
+	startParam := string(ctx.FormValue("start"))
+	if startParam != "" {
+		startTime, err := utils.ParseTimeForPromQL(startParam)
+		if err != nil {
+			utils.SendError(ctx, "Invalid start time", fmt.Sprintf("start: %v", startParam), err)
+			return
+		}
+		startMs = int64(startTime) * 1000
+	}
+	endParam := string(ctx.FormValue("end"))
+	if endParam != "" {
+		endTime, err := utils.ParseTimeForPromQL(endParam)
+		if err != nil {
+			utils.SendError(ctx, "Invalid end time", fmt.Sprintf("end: %v", endParam), err)
+			return
+		}
+		// the end time is truncated to seconds, so include the whole second
+		endMs = int64(endTime)*1000 + 999
+	}
+
+	exemplarSeries := metrics.QueryExemplars(myid, startMs, endMs, parser.ExtractSelectors(expr))
+	output := make([]seriesOutput, 0, len(exemplarSeries))
+	for _, series := range exemplarSeries {
+		exemplars := make([]exemplarOutput, 0, len(series.Exemplars))
+		for _, exemplar := range series.Exemplars {
+			exemplars = append(exemplars, exemplarOutput{
+				Labels:    exemplar.Labels.Map(),
+				Value:     strconv.FormatFloat(exemplar.Value, 'f', -1, 64),
+				Timestamp: float64(exemplar.Timestamp) / 1000,
+			})
+		}
+		output = append(output, seriesOutput{
+			SeriesLabels: series.SeriesLabels.Map(),
+			Exemplars:    exemplars,
+		})
+	}
+
+	response := map[string]interface{}{
+		"status": "success",
+		"data":   output,
+	}
+	WriteJsonResponse(ctx, &response)
+	ctx.SetContentType(ContentJson)
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
 func ProcessUiMetricsSearchRequest(ctx *fasthttp.RequestCtx, myid int64) {
 	rawJSON := ctx.PostBody()
 	if rawJSON == nil {
@@ -588,6 +728,7 @@ func ProcessUiMetricsSearchRequest(ctx *fasthttp.RequestCtx, myid int64) {
 	var timeRange *dtu.MetricsTimeRange
 	hashList := make([]uint64, 0)
 	for i := range metricQueryRequest {
+		rollup.SetQueryResolution(&metricQueryRequest[i].MetricsQuery)
 		hashList = append(hashList, metricQueryRequest[i].MetricsQuery.QueryHash)
 		metricQueriesList = append(metricQueriesList, &metricQueryRequest[i].MetricsQuery)
 		segment.LogMetricsQuery("PromQL metrics query parser", &metricQueryRequest[i], qid)
@@ -748,6 +889,7 @@ func ProcessMetricsQueryRequest(queries []map[string]interface{}, formulas []map
 	var timeRange *dtu.MetricsTimeRange
 	hashList := make([]uint64, 0)
 	for i := range metricQueryRequest {
+		rollup.SetQueryResolution(&metricQueryRequest[i].MetricsQuery)
 		hashList = append(hashList, metricQueryRequest[i].MetricsQuery.QueryHash)
 		metricQueriesList = append(metricQueriesList, &metricQueryRequest[i].MetricsQuery)
 		segment.LogMetricsQuery("PromQL metrics query parser", &metricQueryRequest[i], qid)
@@ -981,6 +1123,143 @@ func ProcessGetMetricSeriesCardinalityRequest(ctx *fasthttp.RequestCtx, myid int
 	WriteJsonResponse(ctx, &output)
 }
 
+// Returns the series limits of the org, its number of active series and the
+// metrics that were throttled within the active series window.
+func ProcessGetThrottledMetricsRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	type outputStruct struct {
+		Enabled                bool                      `json:"enabled"`
+		Action                 string                    `json:"action"`
+		MaxSeriesPerOrg        uint64                    `json:"maxSeriesPerOrg"`
+		MaxSeriesPerMetric     uint64                    `json:"maxSeriesPerMetric"`
+		MaxValuesPerTagKey     uint64                    `json:"maxValuesPerTagKey"`
+		ActiveSeriesWindowMins uint64                    `json:"activeSeriesWindowMins"`
+		ActiveSeries           uint64                    `json:"activeSeries"`
+		ThrottledMetrics       []metrics.ThrottledMetric `json:"throttledMetrics"`
+	}
+
+	limitsConfig := config.GetMetricsLimitsConfig()
+	output := &outputStruct{
+		Enabled:                config.IsMetricsLimitsEnabled(),
+		Action:                 limitsConfig.Action,
+		MaxSeriesPerOrg:        limitsConfig.MaxSeriesPerOrg,
+		MaxSeriesPerMetric:     limitsConfig.MaxSeriesPerMetric,
+		MaxValuesPerTagKey:     limitsConfig.MaxValuesPerTagKey,
+		ActiveSeriesWindowMins: limitsConfig.ActiveSeriesWindowMins,
+		ActiveSeries:           metrics.GetActiveSeriesCount(myid),
+		ThrottledMetrics:       metrics.GetThrottledMetrics(myid),
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, output)
+}
+
+// Returns the relabel rules of the org. The rules from the config are applied
+// before the ones that are set with the API.
+func ProcessGetMetricRelabelRulesRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	type outputStruct struct {
+		ConfigRules []common.MetricRelabelRule `json:"configRules"`
+		Rules       []common.MetricRelabelRule `json:"rules"`
+	}
+
+	configRules, rules := metrics.GetMetricRelabelRules(myid)
+	output := &outputStruct{
+		ConfigRules: configRules,
+		Rules:       rules,
+	}
+	if output.ConfigRules == nil {
+		output.ConfigRules = []common.MetricRelabelRule{}
+	}
+	if output.Rules == nil {
+		output.Rules = []common.MetricRelabelRule{}
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, output)
+}
+
+// Replaces the relabel rules of the org that were set with the API.
+func ProcessPutMetricRelabelRulesRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	type inputStruct struct {
+		Rules []common.MetricRelabelRule `json:"rules"`
+	}
+
+	input := inputStruct{}
+	err := json.Unmarshal(ctx.PostBody(), &input)
+	if err != nil {
+		utils.SendError(ctx, "Failed to parse request body", fmt.Sprintf("request body: %s", ctx.PostBody()), err)
+		return
+	}
+
+	err = metrics.SetMetricRelabelRules(myid, input.Rules)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Invalid relabel rules: %v", err), "", err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, map[string]interface{}{
+		"message": fmt.Sprintf("Saved %v relabel rules", len(input.Rules)),
+	})
+}
+
+func ProcessDeleteMetricRelabelRulesRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	err := metrics.SetMetricRelabelRules(myid, nil)
+	if err != nil {
+		utils.SendInternalError(ctx, "Failed to delete relabel rules", "", err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, map[string]interface{}{
+		"message": "Relabel rules deleted successfully",
+	})
+}
+
+// Shows what relabel rules do to a series, given its labels including
+// __name__. Without rules in the request, the current rules of the org are
+// used.
+func ProcessTestMetricRelabelRulesRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	type inputStruct struct {
+		Labels map[string]string          `json:"labels"`
+		Rules  []common.MetricRelabelRule `json:"rules"`
+	}
+
+	type outputStruct struct {
+		Keep   bool              `json:"keep"`
+		Labels map[string]string `json:"labels"`
+	}
+
+	input := inputStruct{}
+	err := json.Unmarshal(ctx.PostBody(), &input)
+	if err != nil {
+		utils.SendError(ctx, "Failed to parse request body", fmt.Sprintf("request body: %s", ctx.PostBody()), err)
+		return
+	}
+
+	rules := input.Rules
+	if rules == nil {
+		configRules, apiRules := metrics.GetMetricRelabelRules(myid)
+		rules = append(configRules, apiRules...)
+	}
+	relabelConfigs, err := metrics.CompileMetricRelabelRules(rules)
+	if err != nil {
+		utils.SendError(ctx, fmt.Sprintf("Invalid relabel rules: %v", err), "", err)
+		return
+	}
+
+	lbls, keep := metrics.ApplyMetricRelabelConfigs(input.Labels, relabelConfigs)
+	output := &outputStruct{
+		Keep:   keep,
+		Labels: lbls,
+	}
+	if output.Labels == nil {
+		output.Labels = map[string]string{}
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	utils.WriteJsonResponse(ctx, output)
+}
+
 func ProcessGetTagKeysWithMostSeriesRequest(ctx *fasthttp.RequestCtx, myid int64) {
 	type inputStruct struct {
 		StartEpoch utils.Epoch `json:"startEpoch"`
@@ -1220,7 +1499,7 @@ func ProcessGetTagKeysWithMostValuesRequest(ctx *fasthttp.RequestCtx, myid int64
 
 func ConvertPqlToMetricsQuery(searchText string, startTime, endTime uint32, myid int64) ([]structs.MetricsQueryRequest, parser.ValueType, []structs.QueryArithmetic, error) {
 	// call prometheus promql parser
-	expr, err := parser.ParseExpr(searchText)
+	expr, err := ParsePromQLExpr(searchText)
 	if err != nil {
 		return []structs.MetricsQueryRequest{}, "", []structs.QueryArithmetic{}, err
 	}
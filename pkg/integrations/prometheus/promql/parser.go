@@ -7,8 +7,11 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cespare/xxhash"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/siglens/siglens/pkg/common/dtypeutils"
@@ -21,6 +24,35 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+var registerLimitKOnce sync.Once
+
+// limitk is not part of the PromQL parser version we use, so it is registered
+// as a function before the first query is parsed. Unlike in newer Prometheus
+// versions it does not support grouping.
+func registerLimitK() {
+	registerLimitKOnce.Do(func() {
+		if _, ok := parser.Functions["limitk"]; !ok {
+			parser.Functions["limitk"] = &parser.Function{
+				Name:       "limitk",
+				ArgTypes:   []parser.ValueType{parser.ValueTypeScalar, parser.ValueTypeVector},
+				ReturnType: parser.ValueTypeVector,
+			}
+		}
+	})
+}
+
+var limitKGroupingRegex = regexp.MustCompile(`\blimitk\s*(\(.*\)\s*)?(by|without)\s*\(`)
+
+// Parses a PromQL expr with the functions that SigLens adds to the parser.
+func ParsePromQLExpr(query string) (parser.Expr, error) {
+	registerLimitK()
+	expr, err := parser.ParseExpr(query)
+	if err != nil && limitKGroupingRegex.MatchString(query) {
+		return nil, fmt.Errorf("grouping is not supported for limitk, remove its by or without clause")
+	}
+	return expr, err
+}
+
 func extractSelectors(expr parser.Expr) [][]*labels.Matcher {
 	var selectors [][]*labels.Matcher
 	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
@@ -90,7 +122,7 @@ func ConvertPromQLToMetricsQuery(query string, startTime, endTime uint32, myid i
 
 func parsePromQLQuery(query string, startTime, endTime uint32, myid int64) ([]*structs.MetricsQueryRequest, parser.ValueType, []*structs.QueryArithmetic, error) {
 	parser.EnableExperimentalFunctions = true
-	expr, err := parser.ParseExpr(query)
+	expr, err := ParsePromQLExpr(query)
 	if err != nil {
 		log.Errorf("parsePromQLQuery: Error parsing promql query: %v", err)
 		return []*structs.MetricsQueryRequest{}, "", []*structs.QueryArithmetic{}, err
@@ -130,6 +162,8 @@ func parsePromQLQuery(query string, startTime, endTime uint32, myid int64) ([]*s
 		}
 	}
 
+	extractTimeModifiers(expr, &mQuery)
+
 	timeRange := &dtu.MetricsTimeRange{
 		StartEpochSec: startTime,
 		EndEpochSec:   endTime,
@@ -215,6 +249,37 @@ func parsePromQLQuery(query string, startTime, endTime uint32, myid int64) ([]*s
 	return mQueryReqs, pqlQuerytype, queryArithmetic, nil
 }
 
+// Sets the offset and @ modifiers of the query from the selectors and
+// subqueries of the expression. Offsets of nested subqueries add up, and the
+// innermost @ modifier wins, like in Prometheus.
+func extractTimeModifiers(expr parser.Expr, mQuery *structs.MetricsQuery) {
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		var offset time.Duration
+		var timestamp *int64
+		var startOrEnd parser.ItemType
+
+		switch node := node.(type) {
+		case *parser.VectorSelector:
+			offset, timestamp, startOrEnd = node.OriginalOffset, node.Timestamp, node.StartOrEnd
+		case *parser.SubqueryExpr:
+			offset, timestamp, startOrEnd = node.OriginalOffset, node.Timestamp, node.StartOrEnd
+		default:
+			return nil
+		}
+
+		mQuery.Offset += int64(offset.Seconds())
+		if timestamp != nil {
+			mQuery.AtModifier = structs.AtTimestamp
+			mQuery.AtEpochSec = uint32(max(*timestamp/1000, 0))
+		} else if startOrEnd == parser.START {
+			mQuery.AtModifier = structs.AtStart
+		} else if startOrEnd == parser.END {
+			mQuery.AtModifier = structs.AtEnd
+		}
+		return nil
+	})
+}
+
 func parsePromQLExprNode(node parser.Node, mQueryReqs []*structs.MetricsQueryRequest, queryArithmetic []*structs.QueryArithmetic,
 	intervalSeconds uint32) ([]*structs.MetricsQueryRequest, []*structs.QueryArithmetic, bool, error) {
 	var err error = nil
@@ -233,9 +298,19 @@ func parsePromQLExprNode(node parser.Node, mQueryReqs []*structs.MetricsQueryReq
 			updateMetricQueryWithAggs(mQuery, mQueryAgg)
 		}
 	case *parser.Call:
-		mQueryAgg, err = handleCallExpr(node, mQueryReqs[0])
-		if err == nil {
-			updateMetricQueryWithAggs(mQuery, mQueryAgg)
+		switch node.Func.Name {
+		case "vector":
+			err = handleVectorCall(node, mQuery, intervalSeconds)
+		case "limitk":
+			mQueryAgg, err = handleLimitKCall(node, mQuery)
+			if err == nil {
+				updateMetricQueryWithAggs(mQuery, mQueryAgg)
+			}
+		default:
+			mQueryAgg, err = handleCallExpr(node, mQueryReqs[0])
+			if err == nil {
+				updateMetricQueryWithAggs(mQuery, mQueryAgg)
+			}
 		}
 	case *parser.VectorSelector:
 		mQueryReqs, err = handleVectorSelector(mQueryReqs, intervalSeconds)
@@ -332,6 +407,17 @@ func handleAggregateExpr(expr *parser.AggregateExpr, mQuery *structs.MetricsQuer
 		mQuery.GetAllLabels = true
 	case "group":
 		mQuery.FirstAggregator.AggregatorFunction = sutils.Group
+	case "count_values":
+		stringLiteral, ok := expr.Param.(*parser.StringLiteral)
+		if !ok {
+			return nil, fmt.Errorf("handleAggregateExpr: count_values contains invalid param: %v", expr.Param)
+		}
+		if !model.LabelName(stringLiteral.Val).IsValid() {
+			return nil, fmt.Errorf("handleAggregateExpr: count_values has invalid label name: %v", stringLiteral.Val)
+		}
+		mQuery.FirstAggregator.AggregatorFunction = sutils.CountValues
+		mQuery.FirstAggregator.ValueLabel = stringLiteral.Val
+		mQuery.GetAllLabels = true
 	case "":
 		log.Infof("handleAggregateExpr: using avg aggregator by default for AggregateExpr (got empty string)")
 		mQuery.FirstAggregator = structs.Aggregation{AggregatorFunction: sutils.Avg}
@@ -533,6 +619,21 @@ func handlePromQLRangeFunctionNode(functionName string, timeWindow, step float64
 		mQuery.Function = structs.Function{RangeFunction: sutils.Changes, TimeWindow: timeWindow, Step: step}
 	case "resets":
 		mQuery.Function = structs.Function{RangeFunction: sutils.Resets, TimeWindow: timeWindow, Step: step}
+	case "holt_winters":
+		if len(expr.Args) != 3 {
+			return fmt.Errorf("parser.Inspect: Incorrect parameters: %v for the holt_winters function", expr.Args.String())
+		}
+		mQuery.Function = structs.Function{RangeFunction: sutils.Holt_Winters, TimeWindow: timeWindow, ValueList: []string{expr.Args[1].String(), expr.Args[2].String()}, Step: step}
+	case "absent_over_time":
+		mQuery.Function = structs.Function{
+			FunctionType: structs.VectorFunction,
+			TimeWindow:   timeWindow,
+			Step:         step,
+			VectorFunction: &structs.VectorFunctionExpr{
+				Function: sutils.Absent_Over_Time,
+				Labels:   getAbsentLabels(expr.Args[0]),
+			},
+		}
 	default:
 		return fmt.Errorf("handlePromQLRangeFunctionNode: unsupported function type %v", functionName)
 	}
@@ -697,6 +798,20 @@ func handleCallExprVectorSelectorNode(expr *parser.Call, mQuery *structs.Metrics
 				GobRegexp:        gobRegexp,
 			},
 		}
+	case "absent":
+		mQuery.Function = structs.Function{
+			FunctionType: structs.VectorFunction,
+			VectorFunction: &structs.VectorFunctionExpr{
+				Function: sutils.Absent,
+				Labels:   getAbsentLabels(expr.Args[0]),
+			},
+		}
+	case "sort":
+		mQuery.Function = structs.Function{FunctionType: structs.VectorFunction, VectorFunction: &structs.VectorFunctionExpr{Function: sutils.Sort}}
+	case "sort_desc":
+		mQuery.Function = structs.Function{FunctionType: structs.VectorFunction, VectorFunction: &structs.VectorFunctionExpr{Function: sutils.Sort_Desc}}
+	case "scalar":
+		mQuery.Function = structs.Function{FunctionType: structs.VectorFunction, VectorFunction: &structs.VectorFunctionExpr{Function: sutils.Scalar}}
 	case "label_join":
 		// TODO: Implement label_join function
 		return fmt.Errorf("handleCallExprVectorSelectorNode: label_join function is not supported")
@@ -717,6 +832,32 @@ func handleCallExprVectorSelectorNode(expr *parser.Call, mQuery *structs.Metrics
 				Quantile: quantileLiteral.Val,
 			},
 		}
+	case "histogram_count":
+		mQuery.Function = structs.Function{FunctionType: structs.HistogramFunction, HistogramFunction: &structs.HistogramAgg{Function: sutils.HistogramCount}}
+	case "histogram_sum":
+		mQuery.Function = structs.Function{FunctionType: structs.HistogramFunction, HistogramFunction: &structs.HistogramAgg{Function: sutils.HistogramSum}}
+	case "histogram_fraction":
+		if len(expr.Args) != 3 {
+			return fmt.Errorf("handleCallExprVectorSelectorNode: incorrect parameters: %v for the histogram_fraction function", expr.Args.String())
+		}
+
+		lowerLiteral, ok := expr.Args[0].(*parser.NumberLiteral)
+		if !ok {
+			return fmt.Errorf("handleCallExprVectorSelectorNode: incorrect parameters:%v. Expected the lower bound to be a number", expr.Args.String())
+		}
+		upperLiteral, ok := expr.Args[1].(*parser.NumberLiteral)
+		if !ok {
+			return fmt.Errorf("handleCallExprVectorSelectorNode: incorrect parameters:%v. Expected the upper bound to be a number", expr.Args.String())
+		}
+
+		mQuery.Function = structs.Function{
+			FunctionType: structs.HistogramFunction,
+			HistogramFunction: &structs.HistogramAgg{
+				Function: sutils.HistogramFraction,
+				Lower:    lowerLiteral.Val,
+				Upper:    upperLiteral.Val,
+			},
+		}
 	default:
 		return fmt.Errorf("handleCallExprVectorSelectorNode: unsupported function type %v", function)
 	}
@@ -724,6 +865,92 @@ func handleCallExprVectorSelectorNode(expr *parser.Call, mQuery *structs.Metrics
 	return nil
 }
 
+// Returns the labels of the series that absent and absent_over_time return
+// when nothing matches the selector. Like Prometheus, these are the equality
+// matchers of the selector, except for labels that are matched more than once.
+func getAbsentLabels(arg parser.Expr) map[string]string {
+	var matchers []*labels.Matcher
+	switch arg := arg.(type) {
+	case *parser.VectorSelector:
+		matchers = arg.LabelMatchers
+	case *parser.MatrixSelector:
+		vectorSelector, ok := arg.VectorSelector.(*parser.VectorSelector)
+		if !ok {
+			return map[string]string{}
+		}
+		matchers = vectorSelector.LabelMatchers
+	default:
+		return map[string]string{}
+	}
+
+	absentLabels := make(map[string]string)
+	seen := make(map[string]struct{})
+	for _, matcher := range matchers {
+		if matcher.Name == labels.MetricName {
+			continue
+		}
+		if _, ok := seen[matcher.Name]; ok || matcher.Type != labels.MatchEqual {
+			delete(absentLabels, matcher.Name)
+		} else {
+			absentLabels[matcher.Name] = matcher.Value
+		}
+		seen[matcher.Name] = struct{}{}
+	}
+	return absentLabels
+}
+
+// vector(s) does not select any series; the query returns s as a series
+// without labels.
+func handleVectorCall(call *parser.Call, mQuery *structs.MetricsQuery, intervalSeconds uint32) error {
+	if len(call.Args) != 1 {
+		return fmt.Errorf("handleVectorCall: incorrect parameters: %v for the vector function", call.Args.String())
+	}
+	numberLiteral, ok := unwrapParenExpr(call.Args[0]).(*parser.NumberLiteral)
+	if !ok {
+		return fmt.Errorf("handleVectorCall: only a number is supported as the parameter of vector, got: %v", call.Args.String())
+	}
+
+	mQuery.ConstantVector = utils.Some(numberLiteral.Val)
+	mQuery.Downsampler = structs.Downsampler{Interval: int(intervalSeconds), Unit: "s", Aggregator: structs.Aggregation{AggregatorFunction: sutils.Avg}}
+
+	return nil
+}
+
+// limitk(k, v) keeps at most k series of v. It is registered as a function,
+// so it is converted to an aggregation here.
+func handleLimitKCall(call *parser.Call, mQuery *structs.MetricsQuery) (*structs.MetricQueryAgg, error) {
+	if len(call.Args) != 2 {
+		return nil, fmt.Errorf("handleLimitKCall: incorrect parameters: %v for the limitk function", call.Args.String())
+	}
+	numberLiteral, ok := unwrapParenExpr(call.Args[0]).(*parser.NumberLiteral)
+	if !ok {
+		return nil, fmt.Errorf("handleLimitKCall: limitk contains invalid param: %v", call.Args[0])
+	}
+
+	mQuery.FirstAggregator.AggregatorFunction = sutils.LimitK
+	mQuery.FirstAggregator.FuncConstant = numberLiteral.Val
+	mQuery.GetAllLabels = true
+	mQuery.AggWithoutGroupBy = true
+	mQuery.SelectAllSeries = true
+
+	mQueryAgg := &structs.MetricQueryAgg{
+		AggBlockType:    structs.AggregatorBlock,
+		AggregatorBlock: mQuery.FirstAggregator.ShallowClone(),
+	}
+
+	return mQueryAgg, nil
+}
+
+func unwrapParenExpr(expr parser.Expr) parser.Expr {
+	for {
+		parenExpr, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = parenExpr.Expr
+	}
+}
+
 func handleVectorSelector(mQueryReqs []*structs.MetricsQueryRequest, intervalSeconds uint32) ([]*structs.MetricsQueryRequest, error) {
 	mQuery := &mQueryReqs[0].MetricsQuery
 	mQuery.HashedMName = xxhash.Sum64String(mQuery.MetricName)
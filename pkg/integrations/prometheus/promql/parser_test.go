@@ -1200,6 +1200,32 @@ func Test_parsePromQLQuery_HistogramQunatile(t *testing.T) {
 	assert.Equal(t, float64(0.9), mQueryReqs[0].MetricsQuery.SubsequentAggs.Next.Next.FunctionBlock.HistogramFunction.Quantile)
 }
 
+func Test_parsePromQLQuery_NativeHistogramFunctions(t *testing.T) {
+	endTime := uint32(time.Now().Unix())
+	startTime := endTime - 86400 // 1 day
+
+	mQueryReqs, _, _, err := ConvertPromQLToMetricsQuery(`histogram_count(rate(http_request_duration_seconds[5m]))`, startTime, endTime, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(mQueryReqs))
+	assert.True(t, mQueryReqs[0].MetricsQuery.HasHistogramFunction())
+	assert.Equal(t, sutils.HistogramCount, mQueryReqs[0].MetricsQuery.SubsequentAggs.Next.Next.FunctionBlock.HistogramFunction.Function)
+
+	mQueryReqs, _, _, err = ConvertPromQLToMetricsQuery(`histogram_sum(http_request_duration_seconds)`, startTime, endTime, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, sutils.HistogramSum, mQueryReqs[0].MetricsQuery.SubsequentAggs.Next.FunctionBlock.HistogramFunction.Function)
+
+	mQueryReqs, _, _, err = ConvertPromQLToMetricsQuery(`histogram_fraction(0, 0.25, sum(rate(http_request_duration_seconds[5m])))`, startTime, endTime, 0)
+	assert.Nil(t, err)
+	histogramAgg := mQueryReqs[0].MetricsQuery.SubsequentAggs.Next.Next.Next.FunctionBlock.HistogramFunction
+	assert.Equal(t, sutils.HistogramFraction, histogramAgg.Function)
+	assert.Equal(t, float64(0), histogramAgg.Lower)
+	assert.Equal(t, float64(0.25), histogramAgg.Upper)
+
+	mQueryReqs, _, _, err = ConvertPromQLToMetricsQuery(`sum(http_request_duration_seconds)`, startTime, endTime, 0)
+	assert.Nil(t, err)
+	assert.False(t, mQueryReqs[0].MetricsQuery.HasHistogramFunction())
+}
+
 func Test_parsePromQLQuery_Without(t *testing.T) {
 	endTime := uint32(time.Now().Unix())
 	startTime := endTime - 86400 // 1 day
@@ -1480,3 +1506,92 @@ func parsePromQLForTest(t *testing.T, query string) structs.MetricsQuery {
 	require.Len(t, allRequests, 1)
 	return (*allRequests[0]).MetricsQuery
 }
+
+func Test_parsePromQLQuery_TimeModifiers(t *testing.T) {
+	mQuery := parsePromQLForTest(t, `rate(http_requests_total[5m] offset 1h)`)
+	assert.Equal(t, int64(3600), mQuery.Offset)
+	assert.Equal(t, structs.AtModifierType(0), mQuery.AtModifier)
+
+	mQuery = parsePromQLForTest(t, `http_requests_total @ 1700000000`)
+	assert.Equal(t, int64(0), mQuery.Offset)
+	assert.Equal(t, structs.AtTimestamp, mQuery.AtModifier)
+	assert.Equal(t, uint32(1700000000), mQuery.AtEpochSec)
+
+	mQuery = parsePromQLForTest(t, `http_requests_total offset -5m @ end()`)
+	assert.Equal(t, int64(-300), mQuery.Offset)
+	assert.Equal(t, structs.AtEnd, mQuery.AtModifier)
+}
+
+func Test_parsePromQLQuery_VectorFunctions(t *testing.T) {
+	mQuery := parsePromQLForTest(t, `absent(nonexistent{job="myjob",instance=~".*"})`)
+	function := findFunctionBlockForTest(t, mQuery)
+	require.NotNil(t, function.VectorFunction)
+	assert.Equal(t, sutils.Absent, function.VectorFunction.Function)
+	assert.Equal(t, map[string]string{"job": "myjob"}, function.VectorFunction.Labels)
+
+	mQuery = parsePromQLForTest(t, `absent_over_time(nonexistent{job="myjob"}[10m])`)
+	function = findFunctionBlockForTest(t, mQuery)
+	require.NotNil(t, function.VectorFunction)
+	assert.Equal(t, sutils.Absent_Over_Time, function.VectorFunction.Function)
+	assert.Equal(t, float64(600), function.TimeWindow)
+
+	mQuery = parsePromQLForTest(t, `sort_desc(http_requests_total)`)
+	function = findFunctionBlockForTest(t, mQuery)
+	require.NotNil(t, function.VectorFunction)
+	assert.Equal(t, sutils.Sort_Desc, function.VectorFunction.Function)
+
+	mQuery = parsePromQLForTest(t, `holt_winters(http_requests_total[10m], 0.3, 0.6)`)
+	function = findFunctionBlockForTest(t, mQuery)
+	assert.Equal(t, sutils.Holt_Winters, function.RangeFunction)
+	assert.Equal(t, []string{"0.3", "0.6"}, function.ValueList)
+
+	mQuery = parsePromQLForTest(t, `vector(3)`)
+	value, ok := mQuery.ConstantVector.Get()
+	assert.True(t, ok)
+	assert.Equal(t, float64(3), value)
+}
+
+func Test_parsePromQLQuery_CountValuesAndLimitK(t *testing.T) {
+	mQuery := parsePromQLForTest(t, `count_values("version", build_version)`)
+	aggregation := findAggregatorBlockForTest(t, mQuery)
+	assert.Equal(t, sutils.CountValues, aggregation.AggregatorFunction)
+	assert.Equal(t, "version", aggregation.ValueLabel)
+	assert.True(t, mQuery.GetAllLabels)
+
+	_, _, _, err := parsePromQLQuery(`count_values("invalid-label", build_version)`, 0, 0, 0)
+	assert.NotNil(t, err)
+
+	mQuery = parsePromQLForTest(t, `limitk(5, http_requests_total)`)
+	aggregation = findAggregatorBlockForTest(t, mQuery)
+	assert.Equal(t, sutils.LimitK, aggregation.AggregatorFunction)
+	assert.Equal(t, float64(5), aggregation.FuncConstant)
+
+	for _, query := range []string{`limitk(5, http_requests_total) by (job)`, `limitk without (instance) (5, http_requests_total)`} {
+		_, _, _, err = parsePromQLQuery(query, 0, 0, 0)
+		assert.ErrorContains(t, err, "grouping is not supported for limitk", query)
+	}
+}
+
+func findFunctionBlockForTest(t *testing.T, mQuery structs.MetricsQuery) *structs.Function {
+	t.Helper()
+
+	for agg := mQuery.SubsequentAggs; agg != nil; agg = agg.Next {
+		if agg.AggBlockType == structs.FunctionBlock {
+			return agg.FunctionBlock
+		}
+	}
+	require.FailNow(t, "no function block found")
+	return nil
+}
+
+func findAggregatorBlockForTest(t *testing.T, mQuery structs.MetricsQuery) *structs.Aggregation {
+	t.Helper()
+
+	for agg := mQuery.SubsequentAggs; agg != nil; agg = agg.Next {
+		if agg.AggBlockType == structs.AggregatorBlock {
+			return agg.AggregatorBlock
+		}
+	}
+	require.FailNow(t, "no aggregator block found")
+	return nil
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package promql
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	rutils "github.com/siglens/siglens/pkg/readerUtils"
+	"github.com/siglens/siglens/pkg/segment"
+	"github.com/siglens/siglens/pkg/segment/results/mresults"
+	"github.com/siglens/siglens/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+const REMOTE_READ_SAMPLES_CONTENT_TYPE = "application/x-protobuf"
+const REMOTE_READ_STREAMED_CONTENT_TYPE = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+
+// Same limit Prometheus uses when cutting XOR chunks for remote read.
+const MAX_SAMPLES_PER_CHUNK = 120
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Implements the Prometheus remote-read protocol. The response is either a
+// snappy compressed ReadResponse with raw samples, or a stream of
+// ChunkedReadResponse frames with XOR encoded chunks, depending on the
+// response types the client accepts.
+func ProcessRemoteReadRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	readRequest, err := decodeReadRequest(ctx.PostBody())
+	if err != nil {
+		utils.SendError(ctx, "Failed to decode remote read request", "", err)
+		return
+	}
+
+	results := make([][]*prompb.TimeSeries, len(readRequest.Queries))
+	for i, query := range readRequest.Queries {
+		results[i], err = readSeries(query, myid)
+		if err != nil {
+			utils.SendError(ctx, "Failed to execute remote read query", fmt.Sprintf("query: %+v", query), err)
+			return
+		}
+	}
+
+	if getRemoteReadResponseType(readRequest) == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+		ctx.Response.Header.Set("Content-Type", REMOTE_READ_STREAMED_CONTENT_TYPE)
+		ctx.SetStatusCode(fasthttp.StatusOK)
+		for queryIndex, series := range results {
+			err = writeChunkedSeries(ctx, int64(queryIndex), series)
+			if err != nil {
+				log.Errorf("ProcessRemoteReadRequest: failed to write chunked response, err=%v", err)
+				return
+			}
+		}
+		return
+	}
+
+	readResponse := &prompb.ReadResponse{Results: make([]*prompb.QueryResult, len(results))}
+	for i, series := range results {
+		readResponse.Results[i] = &prompb.QueryResult{Timeseries: series}
+	}
+	data, err := proto.Marshal(readResponse)
+	if err != nil {
+		utils.SendInternalError(ctx, "Failed to encode remote read response", "", err)
+		return
+	}
+
+	ctx.Response.Header.Set("Content-Type", REMOTE_READ_SAMPLES_CONTENT_TYPE)
+	ctx.Response.Header.Set("Content-Encoding", "snappy")
+	ctx.SetBody(snappy.Encode(nil, data))
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+func decodeReadRequest(compressed []byte) (*prompb.ReadRequest, error) {
+	reqBuf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("decodeReadRequest: could not decompress request body, err=%v", err)
+	}
+	var req prompb.ReadRequest
+	if err := proto.Unmarshal(reqBuf, &req); err != nil {
+		return nil, fmt.Errorf("decodeReadRequest: could not unmarshal request body, err=%v", err)
+	}
+	return &req, nil
+}
+
+// The client lists the response types it accepts in order of preference; we
+// support both, so the first one wins. An empty list means SAMPLES.
+func getRemoteReadResponseType(req *prompb.ReadRequest) prompb.ReadRequest_ResponseType {
+	for _, responseType := range req.AcceptedResponseTypes {
+		switch responseType {
+		case prompb.ReadRequest_SAMPLES, prompb.ReadRequest_STREAMED_XOR_CHUNKS:
+			return responseType
+		}
+	}
+	return prompb.ReadRequest_SAMPLES
+}
+
+// Converts the remote-read matchers into a PromQL vector selector, so the
+// query goes through the same series lookup as the PromQL APIs.
+func buildSelectorFromMatchers(matchers []*prompb.LabelMatcher) (string, error) {
+	if len(matchers) == 0 {
+		return "", fmt.Errorf("buildSelectorFromMatchers: no matchers in query")
+	}
+
+	parts := make([]string, 0, len(matchers))
+	for _, matcher := range matchers {
+		var op string
+		switch matcher.Type {
+		case prompb.LabelMatcher_EQ:
+			op = "="
+		case prompb.LabelMatcher_NEQ:
+			op = "!="
+		case prompb.LabelMatcher_RE:
+			op = "=~"
+		case prompb.LabelMatcher_NRE:
+			op = "!~"
+		default:
+			return "", fmt.Errorf("buildSelectorFromMatchers: unsupported matcher type %v", matcher.Type)
+		}
+		parts = append(parts, matcher.Name+op+strconv.Quote(matcher.Value))
+	}
+
+	return "{" + strings.Join(parts, ",") + "}", nil
+}
+
+// Returns the raw samples of every series matching the query, with the labels
+// and samples of each series sorted as Prometheus expects.
+func readSeries(query *prompb.Query, myid int64) ([]*prompb.TimeSeries, error) {
+	qid := rutils.GetNextQid()
+	selector, err := buildSelectorFromMatchers(query.Matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	startTime := uint32(query.StartTimestampMs / 1000)
+	endTime := uint32((query.EndTimestampMs + 999) / 1000)
+	log.Infof("qid=%v, readSeries: selector=[%v] startEpochs=[%v] endEpochs=[%v]", qid, selector, startTime, endTime)
+
+	metricQueryRequest, _, _, err := ConvertPromQLToMetricsQuery(selector, startTime, endTime, myid)
+	if err != nil {
+		return nil, err
+	}
+	if len(metricQueryRequest) != 1 {
+		return nil, fmt.Errorf("readSeries: expected one metrics query for selector %v, got %v", selector, len(metricQueryRequest))
+	}
+
+	// Remote read returns the raw samples, without downsampling.
+	mQuery := &metricQueryRequest[0].MetricsQuery
+	mQuery.RawSamples = true
+	segment.LogMetricsQuery("PromQL remote read", &metricQueryRequest[0], qid)
+	res := segment.ExecuteMetricsQuery(mQuery, &metricQueryRequest[0].TimeRange, qid)
+	if len(res.ErrList) > 0 {
+		return nil, fmt.Errorf("readSeries: %v", res.ErrList[0])
+	}
+
+	return convertResultsToTimeSeries(res.Results, query.StartTimestampMs, query.EndTimestampMs), nil
+}
+
+func convertResultsToTimeSeries(results map[string]map[uint32]float64, startMs, endMs int64) []*prompb.TimeSeries {
+	allSeries := make([]*prompb.TimeSeries, 0, len(results))
+	for seriesId, points := range results {
+		samples := make([]prompb.Sample, 0, len(points))
+		for ts, value := range points {
+			tsMs := int64(ts) * 1000
+			if tsMs < startMs || tsMs > endMs {
+				continue
+			}
+			samples = append(samples, prompb.Sample{Timestamp: tsMs, Value: value})
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		sort.Slice(samples, func(i, j int) bool {
+			return samples[i].Timestamp < samples[j].Timestamp
+		})
+
+		allSeries = append(allSeries, &prompb.TimeSeries{
+			Labels:  getSortedLabels(mresults.GetPromQLSeriesFormat(seriesId)),
+			Samples: samples,
+		})
+	}
+
+	sort.Slice(allSeries, func(i, j int) bool {
+		return compareLabels(allSeries[i].Labels, allSeries[j].Labels) < 0
+	})
+
+	return allSeries
+}
+
+func getSortedLabels(labelsMap map[string]string) []prompb.Label {
+	labels := make([]prompb.Label, 0, len(labelsMap))
+	for name, value := range labelsMap {
+		labels = append(labels, prompb.Label{Name: name, Value: value})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+func compareLabels(a, b []prompb.Label) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Name != b[i].Name {
+			return strings.Compare(a[i].Name, b[i].Name)
+		}
+		if a[i].Value != b[i].Value {
+			return strings.Compare(a[i].Value, b[i].Value)
+		}
+	}
+	return len(a) - len(b)
+}
+
+// Gorilla encodes the samples into XOR chunks of at most MAX_SAMPLES_PER_CHUNK
+// samples each.
+func encodeXORChunks(samples []prompb.Sample) ([]prompb.Chunk, error) {
+	chunks := make([]prompb.Chunk, 0, (len(samples)+MAX_SAMPLES_PER_CHUNK-1)/MAX_SAMPLES_PER_CHUNK)
+	for start := 0; start < len(samples); start += MAX_SAMPLES_PER_CHUNK {
+		end := start + MAX_SAMPLES_PER_CHUNK
+		if end > len(samples) {
+			end = len(samples)
+		}
+
+		chunk := chunkenc.NewXORChunk()
+		appender, err := chunk.Appender()
+		if err != nil {
+			return nil, fmt.Errorf("encodeXORChunks: could not get chunk appender, err=%v", err)
+		}
+		for _, sample := range samples[start:end] {
+			appender.Append(sample.Timestamp, sample.Value)
+		}
+
+		chunks = append(chunks, prompb.Chunk{
+			MinTimeMs: samples[start].Timestamp,
+			MaxTimeMs: samples[end-1].Timestamp,
+			Type:      prompb.Chunk_XOR,
+			Data:      chunk.Bytes(),
+		})
+	}
+	return chunks, nil
+}
+
+// Writes one ChunkedReadResponse frame per series.
+func writeChunkedSeries(w io.Writer, queryIndex int64, allSeries []*prompb.TimeSeries) error {
+	for _, series := range allSeries {
+		chunks, err := encodeXORChunks(series.Samples)
+		if err != nil {
+			return err
+		}
+
+		resp := &prompb.ChunkedReadResponse{
+			ChunkedSeries: []*prompb.ChunkedSeries{{Labels: series.Labels, Chunks: chunks}},
+			QueryIndex:    queryIndex,
+		}
+		data, err := proto.Marshal(resp)
+		if err != nil {
+			return fmt.Errorf("writeChunkedSeries: could not marshal chunked response, err=%v", err)
+		}
+		err = writeChunkedFrame(w, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Each frame is the uvarint size of the message, the big endian CRC32
+// (Castagnoli) of the message, and then the message itself.
+func writeChunkedFrame(w io.Writer, data []byte) error {
+	var header [binary.MaxVarintLen64 + 4]byte
+	n := binary.PutUvarint(header[:], uint64(len(data)))
+	binary.BigEndian.PutUint32(header[n:], crc32.Checksum(data, castagnoliTable))
+
+	if _, err := w.Write(header[:n+4]); err != nil {
+		return fmt.Errorf("writeChunkedFrame: could not write frame header, err=%v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("writeChunkedFrame: could not write frame data, err=%v", err)
+	}
+	return nil
+}
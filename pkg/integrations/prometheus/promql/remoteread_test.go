@@ -0,0 +1,123 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package promql
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_buildSelectorFromMatchers(t *testing.T) {
+	matchers := []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "http_requests_total"},
+		{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "api"},
+		{Type: prompb.LabelMatcher_RE, Name: "instance", Value: "host-.*"},
+		{Type: prompb.LabelMatcher_NRE, Name: "path", Value: `"/health"`},
+	}
+
+	selector, err := buildSelectorFromMatchers(matchers)
+	assert.Nil(t, err)
+	assert.Equal(t, `{__name__="http_requests_total",job!="api",instance=~"host-.*",path!~"\"/health\""}`, selector)
+
+	expr, err := parser.ParseExpr(selector)
+	assert.Nil(t, err)
+	vs, ok := expr.(*parser.VectorSelector)
+	assert.True(t, ok)
+	assert.Len(t, vs.LabelMatchers, 4)
+	assert.Equal(t, `"/health"`, vs.LabelMatchers[3].Value)
+
+	_, err = buildSelectorFromMatchers(nil)
+	assert.NotNil(t, err)
+}
+
+func Test_convertResultsToTimeSeries(t *testing.T) {
+	results := map[string]map[uint32]float64{
+		"cpu{host:b,":           {20: 2, 10: 1, 30: 3},
+		"cpu{host:a,region:us,": {10: 5, 99: 9},
+	}
+
+	allSeries := convertResultsToTimeSeries(results, 10_000, 30_000)
+	assert.Len(t, allSeries, 2)
+
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "cpu"}, {Name: "host", Value: "a"}, {Name: "region", Value: "us"}}, allSeries[0].Labels)
+	assert.Equal(t, []prompb.Sample{{Timestamp: 10_000, Value: 5}}, allSeries[0].Samples)
+
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "cpu"}, {Name: "host", Value: "b"}}, allSeries[1].Labels)
+	assert.Equal(t, []prompb.Sample{{Timestamp: 10_000, Value: 1}, {Timestamp: 20_000, Value: 2}, {Timestamp: 30_000, Value: 3}}, allSeries[1].Samples)
+}
+
+func Test_writeChunkedSeries(t *testing.T) {
+	samples := make([]prompb.Sample, 0)
+	for i := 0; i < 250; i++ {
+		samples = append(samples, prompb.Sample{Timestamp: int64(i) * 1000, Value: float64(i) / 2})
+	}
+	series := []*prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: samples},
+	}
+
+	var buf bytes.Buffer
+	err := writeChunkedSeries(&buf, 3, series)
+	assert.Nil(t, err)
+
+	reader := bufio.NewReader(&buf)
+	size, err := binary.ReadUvarint(reader)
+	assert.Nil(t, err)
+	var checksum [4]byte
+	_, err = io.ReadFull(reader, checksum[:])
+	assert.Nil(t, err)
+	data := make([]byte, size)
+	_, err = io.ReadFull(reader, data)
+	assert.Nil(t, err)
+	assert.Equal(t, crc32.Checksum(data, castagnoliTable), binary.BigEndian.Uint32(checksum[:]))
+	_, err = reader.ReadByte()
+	assert.Equal(t, io.EOF, err)
+
+	var resp prompb.ChunkedReadResponse
+	assert.Nil(t, proto.Unmarshal(data, &resp))
+	assert.Equal(t, int64(3), resp.QueryIndex)
+	assert.Len(t, resp.ChunkedSeries, 1)
+	assert.Equal(t, series[0].Labels, resp.ChunkedSeries[0].Labels)
+
+	chunks := resp.ChunkedSeries[0].Chunks
+	assert.Len(t, chunks, 3)
+	decoded := make([]prompb.Sample, 0)
+	for _, chunk := range chunks {
+		assert.Equal(t, prompb.Chunk_XOR, chunk.Type)
+		xorChunk, err := chunkenc.FromData(chunkenc.EncXOR, chunk.Data)
+		assert.Nil(t, err)
+		it := xorChunk.Iterator(nil)
+		for it.Next() == chunkenc.ValFloat {
+			ts, value := it.At()
+			decoded = append(decoded, prompb.Sample{Timestamp: ts, Value: value})
+		}
+		assert.Nil(t, it.Err())
+	}
+	assert.Equal(t, samples, decoded)
+	assert.Equal(t, int64(120_000), chunks[1].MinTimeMs)
+	assert.Equal(t, int64(249_000), chunks[2].MaxTimeMs)
+}
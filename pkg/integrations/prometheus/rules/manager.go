@@ -0,0 +1,561 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rules
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/siglens/siglens/pkg/instrumentation"
+	"github.com/siglens/siglens/pkg/integrations/prometheus/promql"
+	rutils "github.com/siglens/siglens/pkg/readerUtils"
+	"github.com/siglens/siglens/pkg/segment/results/mresults"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics"
+	"github.com/siglens/siglens/pkg/usageStats"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	HEALTH_UNKNOWN = "unknown"
+	HEALTH_OK      = "ok"
+	HEALTH_ERR     = "err"
+)
+
+type RuleStatus struct {
+	Name           string            `json:"name"`
+	Query          string            `json:"query"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Health         string            `json:"health"`
+	LastError      string            `json:"lastError,omitempty"`
+	EvaluationTime float64           `json:"evaluationTime"`
+	LastEvaluation time.Time         `json:"lastEvaluation"`
+	LastSamples    int               `json:"lastSamples"`
+	StaleSeries    uint64            `json:"staleSeries"`
+	Type           string            `json:"type"`
+
+	// Only set for alerting rules.
+	Duration    float64           `json:"duration,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Alerts      []*ActiveAlert    `json:"alerts,omitempty"`
+	State       string            `json:"state,omitempty"`
+}
+
+// ActiveAlert is a pending or firing alert of an alerting rule in the format of
+// the Prometheus /api/v1/alerts API.
+type ActiveAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	State       string            `json:"state"`
+	ActiveAt    *time.Time        `json:"activeAt,omitempty"`
+	Value       string            `json:"value"`
+}
+
+type RuleGroupStatus struct {
+	Name             string        `json:"name"`
+	File             string        `json:"file"`
+	Rules            []*RuleStatus `json:"rules"`
+	Interval         float64       `json:"interval"`
+	EvaluationTime   float64       `json:"evaluationTime"`
+	LastEvaluation   time.Time     `json:"lastEvaluation"`
+	MissedIterations uint64        `json:"missedIterations"`
+}
+
+type recordedSample struct {
+	labels map[string]string
+	value  float64
+}
+
+// groupRunner evaluates the rules of one group, in order, every interval.
+type groupRunner struct {
+	myid  int64
+	group RuleGroup
+	stop  chan struct{}
+	done  chan struct{}
+
+	lock             sync.Mutex
+	ruleStatuses     []*RuleStatus
+	evaluationTime   time.Duration
+	lastEvaluation   time.Time
+	missedIterations uint64
+
+	// Output series of each rule written by the last evaluation, keyed by
+	// their labels key, used to detect series that went stale.
+	activeSeries []map[string]map[string]string
+}
+
+var runnersLock sync.Mutex
+var orgRunners = make(map[int64][]*groupRunner)
+
+// Loads the persisted rule groups of every org and starts evaluating them.
+func InitRecordingRules(getMyIds func() []int64) {
+	err := initRulesDir()
+	if err != nil {
+		log.Errorf("InitRecordingRules: %v", err)
+		return
+	}
+
+	runnersLock.Lock()
+	defer runnersLock.Unlock()
+	for _, myid := range getMyIds() {
+		groups, err := readRuleGroups(myid)
+		if err != nil {
+			log.Errorf("InitRecordingRules: unable to read rule groups for orgid=%v, err=%v", myid, err)
+			continue
+		}
+		for _, group := range groups {
+			orgRunners[myid] = append(orgRunners[myid], startGroupRunner(myid, group))
+		}
+		log.Infof("InitRecordingRules: started %v rule groups for orgid=%v", len(groups), myid)
+	}
+}
+
+// Stops the evaluation of all rule groups and waits for any in flight
+// evaluation to finish.
+func StopRecordingRules() {
+	runnersLock.Lock()
+	defer runnersLock.Unlock()
+	for myid, runners := range orgRunners {
+		for _, runner := range runners {
+			runner.stopAndWait()
+		}
+		delete(orgRunners, myid)
+	}
+}
+
+func getRuleGroups(myid int64) []RuleGroup {
+	runnersLock.Lock()
+	defer runnersLock.Unlock()
+	groups := make([]RuleGroup, 0, len(orgRunners[myid]))
+	for _, runner := range orgRunners[myid] {
+		groups = append(groups, runner.group)
+	}
+	return groups
+}
+
+func getRuleGroupStatuses(myid int64) []*RuleGroupStatus {
+	runnersLock.Lock()
+	defer runnersLock.Unlock()
+	statuses := make([]*RuleGroupStatus, 0, len(orgRunners[myid]))
+	for _, runner := range orgRunners[myid] {
+		statuses = append(statuses, runner.getStatus())
+	}
+	return statuses
+}
+
+// Adds the groups, replacing any existing group with the same name when
+// replace is set, and persists the result.
+func putRuleGroups(myid int64, groups []RuleGroup, replace bool) error {
+	runnersLock.Lock()
+	defer runnersLock.Unlock()
+
+	runners := orgRunners[myid]
+	newGroups := make([]RuleGroup, 0, len(runners)+len(groups))
+	for _, runner := range runners {
+		newGroups = append(newGroups, runner.group)
+	}
+	replacedIdx := make(map[int]struct{})
+	for _, group := range groups {
+		idx := findGroup(newGroups, group.Name)
+		if idx < 0 {
+			newGroups = append(newGroups, group)
+			continue
+		}
+		if !replace {
+			return fmt.Errorf("rule group %v already exists", group.Name)
+		}
+		newGroups[idx] = group
+		replacedIdx[idx] = struct{}{}
+	}
+
+	err := writeRuleGroups(myid, newGroups)
+	if err != nil {
+		return err
+	}
+
+	for idx := range replacedIdx {
+		runners[idx].stopAndWait()
+		runners[idx] = startGroupRunner(myid, newGroups[idx])
+	}
+	for idx := len(runners); idx < len(newGroups); idx++ {
+		runners = append(runners, startGroupRunner(myid, newGroups[idx]))
+	}
+	orgRunners[myid] = runners
+	return nil
+}
+
+// Replaces the group called name with the given group, which may have a
+// different name.
+func updateRuleGroup(myid int64, name string, group RuleGroup) (bool, error) {
+	runnersLock.Lock()
+	defer runnersLock.Unlock()
+
+	runners := orgRunners[myid]
+	newGroups := make([]RuleGroup, 0, len(runners))
+	for _, runner := range runners {
+		newGroups = append(newGroups, runner.group)
+	}
+	idx := findGroup(newGroups, name)
+	if idx < 0 {
+		return false, nil
+	}
+	if otherIdx := findGroup(newGroups, group.Name); otherIdx >= 0 && otherIdx != idx {
+		return true, fmt.Errorf("rule group %v already exists", group.Name)
+	}
+	newGroups[idx] = group
+
+	err := writeRuleGroups(myid, newGroups)
+	if err != nil {
+		return true, err
+	}
+
+	runners[idx].stopAndWait()
+	runners[idx] = startGroupRunner(myid, group)
+	return true, nil
+}
+
+func deleteRuleGroup(myid int64, name string) (bool, error) {
+	runnersLock.Lock()
+	defer runnersLock.Unlock()
+
+	runners := orgRunners[myid]
+	newGroups := make([]RuleGroup, 0, len(runners))
+	for _, runner := range runners {
+		newGroups = append(newGroups, runner.group)
+	}
+	idx := findGroup(newGroups, name)
+	if idx < 0 {
+		return false, nil
+	}
+	newGroups = append(newGroups[:idx], newGroups[idx+1:]...)
+
+	err := writeRuleGroups(myid, newGroups)
+	if err != nil {
+		return true, err
+	}
+
+	runners[idx].stopAndWait()
+	orgRunners[myid] = append(runners[:idx], runners[idx+1:]...)
+	return true, nil
+}
+
+func findGroup(groups []RuleGroup, name string) int {
+	for idx := range groups {
+		if groups[idx].Name == name {
+			return idx
+		}
+	}
+	return -1
+}
+
+func newGroupRunner(myid int64, group RuleGroup) *groupRunner {
+	runner := &groupRunner{
+		myid:         myid,
+		group:        group,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+		ruleStatuses: make([]*RuleStatus, len(group.Rules)),
+		activeSeries: make([]map[string]map[string]string, len(group.Rules)),
+	}
+	for i, rule := range group.Rules {
+		runner.ruleStatuses[i] = &RuleStatus{
+			Name:   rule.Record,
+			Query:  rule.Expr,
+			Labels: rule.Labels,
+			Health: HEALTH_UNKNOWN,
+			Type:   "recording",
+		}
+		runner.activeSeries[i] = make(map[string]map[string]string)
+	}
+	return runner
+}
+
+func startGroupRunner(myid int64, group RuleGroup) *groupRunner {
+	runner := newGroupRunner(myid, group)
+	go runner.run()
+	return runner
+}
+
+func (gr *groupRunner) stopAndWait() {
+	close(gr.stop)
+	<-gr.done
+}
+
+// Evaluates the group on multiples of its interval, so that restarts do not
+// shift the timestamps of the recorded samples. Evaluations that could not
+// start on time because the previous one was still running are skipped.
+func (gr *groupRunner) run() {
+	defer close(gr.done)
+
+	interval := gr.group.GetInterval()
+	next := time.Now().Truncate(interval).Add(interval)
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-gr.stop:
+			return
+		case <-timer.C:
+			gr.evaluate(next)
+
+			next = next.Add(interval)
+			if now := time.Now(); now.After(next) {
+				missed := int64(now.Sub(next)/interval) + 1
+				next = next.Add(time.Duration(missed) * interval)
+				gr.lock.Lock()
+				gr.missedIterations += uint64(missed)
+				gr.lock.Unlock()
+				instrumentation.IncrementInt64CounterWithLabel(instrumentation.RECORDING_RULE_MISSED_ITERATIONS, missed, "group", gr.group.Name)
+				log.Warnf("groupRunner.run: group=%v, orgid=%v missed %v iterations", gr.group.Name, gr.myid, missed)
+			}
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+func (gr *groupRunner) evaluate(evalTime time.Time) {
+	groupStart := time.Now()
+	evalTs := uint32(evalTime.Unix())
+
+	for i := range gr.group.Rules {
+		rule := &gr.group.Rules[i]
+		ruleKey := gr.group.Name + "/" + rule.Record
+		ruleStart := time.Now()
+
+		written := 0
+		samples, err := evaluateRule(rule, evalTs, gr.myid)
+		if err == nil {
+			written, err = writeSamples(rule.Record, samples, evalTs, gr.myid)
+		}
+
+		instrumentation.IncrementInt64CounterWithLabel(instrumentation.RECORDING_RULE_EVALUATIONS, 1, "rule", ruleKey)
+		if err != nil {
+			instrumentation.IncrementInt64CounterWithLabel(instrumentation.RECORDING_RULE_EVALUATION_FAILURES, 1, "rule", ruleKey)
+			log.Errorf("groupRunner.evaluate: failed to evaluate rule=%v, orgid=%v, err=%v", ruleKey, gr.myid, err)
+		}
+		instrumentation.IncrementInt64CounterWithLabel(instrumentation.RECORDING_RULE_SAMPLES, int64(written), "rule", ruleKey)
+
+		var stale int
+		if err == nil {
+			staleSamples := updateActiveSeries(gr.activeSeries[i], samples)
+			stale = len(staleSamples)
+			if stale > 0 {
+				instrumentation.IncrementInt64CounterWithLabel(instrumentation.RECORDING_RULE_STALE_SERIES, int64(stale), "rule", ruleKey)
+				_, staleErr := writeSamples(rule.Record, staleSamples, evalTs, gr.myid)
+				if staleErr != nil {
+					log.Errorf("groupRunner.evaluate: failed to write staleness markers for rule=%v, orgid=%v, err=%v", ruleKey, gr.myid, staleErr)
+				}
+			}
+		}
+
+		gr.lock.Lock()
+		status := gr.ruleStatuses[i]
+		status.LastEvaluation = evalTime
+		status.EvaluationTime = time.Since(ruleStart).Seconds()
+		status.LastSamples = written
+		status.StaleSeries += uint64(stale)
+		if err != nil {
+			status.Health = HEALTH_ERR
+			status.LastError = err.Error()
+		} else {
+			status.Health = HEALTH_OK
+			status.LastError = ""
+		}
+		gr.lock.Unlock()
+	}
+
+	gr.lock.Lock()
+	gr.lastEvaluation = evalTime
+	gr.evaluationTime = time.Since(groupStart)
+	gr.lock.Unlock()
+}
+
+func (gr *groupRunner) getStatus() *RuleGroupStatus {
+	gr.lock.Lock()
+	defer gr.lock.Unlock()
+
+	status := &RuleGroupStatus{
+		Name:             gr.group.Name,
+		File:             getRulesFileName(gr.myid),
+		Rules:            make([]*RuleStatus, len(gr.ruleStatuses)),
+		Interval:         gr.group.GetInterval().Seconds(),
+		EvaluationTime:   gr.evaluationTime.Seconds(),
+		LastEvaluation:   gr.lastEvaluation,
+		MissedIterations: gr.missedIterations,
+	}
+	for i, ruleStatus := range gr.ruleStatuses {
+		ruleStatusCopy := *ruleStatus
+		status.Rules[i] = &ruleStatusCopy
+	}
+	return status
+}
+
+func evaluateRule(rule *RecordingRule, evalTs uint32, myid int64) ([]recordedSample, error) {
+	qid := rutils.GetNextQid()
+	res, pqlQuerytype, err := promql.ExecuteInstantQuery(rule.Expr, evalTs, myid, qid)
+	if err != nil {
+		return nil, err
+	}
+	return buildRecordedSamples(rule, res, pqlQuerytype)
+}
+
+// Converts the instant query result into the samples to record: the latest
+// value of each series, with the metric name dropped and the rule labels
+// applied on top of the series labels.
+func buildRecordedSamples(rule *RecordingRule, res *mresults.MetricsResult, pqlQuerytype parser.ValueType) ([]recordedSample, error) {
+	if res == nil {
+		return []recordedSample{}, nil
+	}
+	if len(res.ErrList) > 0 {
+		return nil, res.ErrList[0]
+	}
+
+	switch pqlQuerytype {
+	case parser.ValueTypeScalar:
+		labels := make(map[string]string, len(rule.Labels))
+		for name, value := range rule.Labels {
+			labels[name] = value
+		}
+		return []recordedSample{{labels: labels, value: res.ScalarValue}}, nil
+	case parser.ValueTypeVector:
+	default:
+		return nil, fmt.Errorf("buildRecordedSamples: expr must return a vector or a scalar, got %v", pqlQuerytype)
+	}
+
+	samples := make([]recordedSample, 0, len(res.Results))
+	labelSets := make(map[string]struct{}, len(res.Results))
+	for seriesId, points := range res.Results {
+		if len(points) == 0 {
+			continue
+		}
+		latestTime := uint32(0)
+		latestValue := float64(0)
+		for ts, value := range points {
+			if ts >= latestTime {
+				latestTime = ts
+				latestValue = value
+			}
+		}
+
+		labels := mresults.GetPromQLSeriesFormat(seriesId)
+		delete(labels, model.MetricNameLabel)
+		for name, value := range rule.Labels {
+			labels[name] = value
+		}
+
+		labelsKey := getLabelsKey(labels)
+		if _, ok := labelSets[labelsKey]; ok {
+			return nil, fmt.Errorf("buildRecordedSamples: vector contains metrics with the same labelset %v after applying rule labels", labelsKey)
+		}
+		labelSets[labelsKey] = struct{}{}
+		samples = append(samples, recordedSample{labels: labels, value: latestValue})
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		return getLabelsKey(samples[i].labels) < getLabelsKey(samples[j].labels)
+	})
+	return samples, nil
+}
+
+// Writes the samples through the same path as Prometheus remote write.
+// NaN and Inf values are skipped since the metrics storage rejects them,
+// except for staleness markers.
+func writeSamples(record string, samples []recordedSample, evalTs uint32, myid int64) (int, error) {
+	mName := []byte(record)
+	written := 0
+	var nBytes uint64
+	for _, sample := range samples {
+		if (math.IsNaN(sample.value) && !value.IsStaleNaN(sample.value)) || math.IsInf(sample.value, 0) {
+			continue
+		}
+
+		sampleBytes := uint64(len(mName) + 8)
+		tagHolder := metrics.GetTagsHolder()
+		for _, name := range getSortedLabelNames(sample.labels) {
+			value := sample.labels[name]
+			tagHolder.Insert(name, []byte(value), jsonparser.String)
+			sampleBytes += uint64(len(name) + len(value))
+		}
+
+		err := metrics.EncodeDatapoint(mName, tagHolder, sample.value, evalTs, sampleBytes, myid)
+		if err != nil {
+			usageStats.UpdateMetricsStats(nBytes, uint64(written), myid)
+			return written, fmt.Errorf("writeSamples: failed to encode datapoint for metric=%v, err=%v", record, err)
+		}
+		nBytes += sampleBytes
+		written++
+	}
+
+	usageStats.UpdateMetricsStats(nBytes, uint64(written), myid)
+	return written, nil
+}
+
+// Replaces the active series with the series of the samples and returns a
+// staleness marker for each previously active series that the rule no longer
+// produces. Instant queries stop returning a series once its marker is
+// written, instead of only after the lookback window.
+func updateActiveSeries(activeSeries map[string]map[string]string, samples []recordedSample) []recordedSample {
+	current := make(map[string]map[string]string, len(samples))
+	for _, sample := range samples {
+		current[getLabelsKey(sample.labels)] = sample.labels
+	}
+
+	stale := make([]recordedSample, 0)
+	for labelsKey, labels := range activeSeries {
+		if _, ok := current[labelsKey]; !ok {
+			stale = append(stale, recordedSample{labels: labels, value: math.Float64frombits(value.StaleNaN)})
+			delete(activeSeries, labelsKey)
+		}
+	}
+	for labelsKey, labels := range current {
+		activeSeries[labelsKey] = labels
+	}
+	return stale
+}
+
+func getSortedLabelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getLabelsKey(labels map[string]string) string {
+	var sb strings.Builder
+	sb.WriteString("{")
+	for i, name := range getSortedLabelNames(labels) {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(name)
+		sb.WriteString("=")
+		sb.WriteString(fmt.Sprintf("%q", labels[name]))
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/integrations/prometheus/promql"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const DEFAULT_EVALUATION_INTERVAL = time.Minute
+const MIN_EVALUATION_INTERVAL = 5 * time.Second
+
+// RuleGroups is the Prometheus rule file format.
+type RuleGroups struct {
+	Groups []RuleGroup `json:"groups" yaml:"groups"`
+}
+
+type RuleGroup struct {
+	Name     string          `json:"name" yaml:"name"`
+	Interval string          `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Rules    []RecordingRule `json:"rules" yaml:"rules"`
+}
+
+type RecordingRule struct {
+	Record string            `json:"record" yaml:"record"`
+	Expr   string            `json:"expr" yaml:"expr"`
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+
+	// Only used to reject alerting rules, which are imported as alerts.
+	Alert string `json:"alert,omitempty" yaml:"alert,omitempty"`
+}
+
+var rulesBaseDir string
+
+// Returns the evaluation interval of the group, falling back to
+// DEFAULT_EVALUATION_INTERVAL when none is set.
+func (g *RuleGroup) GetInterval() time.Duration {
+	if g.Interval == "" {
+		return DEFAULT_EVALUATION_INTERVAL
+	}
+	interval, err := model.ParseDuration(g.Interval)
+	if err != nil {
+		return DEFAULT_EVALUATION_INTERVAL
+	}
+	return time.Duration(interval)
+}
+
+func (g *RuleGroup) Validate() error {
+	if g.Name == "" {
+		return errors.New("rule group name is required")
+	}
+	if g.Interval != "" {
+		interval, err := model.ParseDuration(g.Interval)
+		if err != nil {
+			return fmt.Errorf("group %v: invalid interval %v, err=%v", g.Name, g.Interval, err)
+		}
+		if time.Duration(interval) < MIN_EVALUATION_INTERVAL {
+			return fmt.Errorf("group %v: interval %v is less than the minimum of %v", g.Name, g.Interval, MIN_EVALUATION_INTERVAL)
+		}
+	}
+	if len(g.Rules) == 0 {
+		return fmt.Errorf("group %v: no rules", g.Name)
+	}
+
+	for i := range g.Rules {
+		err := g.Rules[i].Validate()
+		if err != nil {
+			return fmt.Errorf("group %v, rule %v: %v", g.Name, i, err)
+		}
+	}
+	return nil
+}
+
+func (r *RecordingRule) Validate() error {
+	if r.Alert != "" {
+		return fmt.Errorf("alerting rule %v is not supported, import alerting rules with /api/alerts/importPrometheusRules", r.Alert)
+	}
+	if !model.IsValidMetricName(model.LabelValue(r.Record)) {
+		return fmt.Errorf("invalid recording rule name %q", r.Record)
+	}
+	if r.Expr == "" {
+		return errors.New("expr is required")
+	}
+	_, err := promql.ParsePromQLExpr(r.Expr)
+	if err != nil {
+		return fmt.Errorf("could not parse expr %q, err=%v", r.Expr, err)
+	}
+	for name := range r.Labels {
+		if !model.LabelName(name).IsValid() || name == model.MetricNameLabel {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	return nil
+}
+
+// Parses and validates a Prometheus rule file.
+func ParseRuleGroups(data []byte) (*RuleGroups, error) {
+	ruleGroups := &RuleGroups{}
+	err := yaml.Unmarshal(data, ruleGroups)
+	if err != nil {
+		return nil, fmt.Errorf("ParseRuleGroups: could not parse yaml, err=%v", err)
+	}
+
+	names := make(map[string]struct{}, len(ruleGroups.Groups))
+	for i := range ruleGroups.Groups {
+		group := &ruleGroups.Groups[i]
+		if _, ok := names[group.Name]; ok {
+			return nil, fmt.Errorf("ParseRuleGroups: duplicate group name %v", group.Name)
+		}
+		names[group.Name] = struct{}{}
+
+		err = group.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("ParseRuleGroups: %v", err)
+		}
+	}
+	return ruleGroups, nil
+}
+
+func initRulesDir() error {
+	rulesBaseDir = config.GetDataPath() + "querynodes/" + config.GetHostID() + "/recordingrules"
+	err := os.MkdirAll(rulesBaseDir, 0764)
+	if err != nil {
+		return fmt.Errorf("initRulesDir: failed to create dir=%v, err=%v", rulesBaseDir, err)
+	}
+	return nil
+}
+
+func getRulesFileName(myid int64) string {
+	if myid != 0 {
+		return rulesBaseDir + "/rules-" + strconv.FormatInt(myid, 10) + ".yaml"
+	}
+	return rulesBaseDir + "/rules.yaml"
+}
+
+func readRuleGroups(myid int64) ([]RuleGroup, error) {
+	fileName := getRulesFileName(myid)
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []RuleGroup{}, nil
+		}
+		return nil, fmt.Errorf("readRuleGroups: failed to read file=%v, err=%v", fileName, err)
+	}
+
+	ruleGroups, err := ParseRuleGroups(data)
+	if err != nil {
+		return nil, fmt.Errorf("readRuleGroups: file=%v, err=%v", fileName, err)
+	}
+	return ruleGroups.Groups, nil
+}
+
+func writeRuleGroups(myid int64, groups []RuleGroup) error {
+	fileName := getRulesFileName(myid)
+	data, err := yaml.Marshal(&RuleGroups{Groups: groups})
+	if err != nil {
+		return fmt.Errorf("writeRuleGroups: failed to marshal rule groups, err=%v", err)
+	}
+
+	err = os.WriteFile(fileName, data, 0644)
+	if err != nil {
+		log.Errorf("writeRuleGroups: failed to write file=%v, err=%v", fileName, err)
+		return err
+	}
+	return nil
+}
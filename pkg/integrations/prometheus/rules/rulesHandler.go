@@ -0,0 +1,185 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/siglens/siglens/pkg/utils"
+	"github.com/valyala/fasthttp"
+)
+
+// Returns the alerting rule groups of an org. Set by the alerting service, so
+// the alerts are listed next to the recording rules.
+var alertingRuleGroupsProvider func(myid int64) []*RuleGroupStatus
+
+func SetAlertingRuleGroupsProvider(provider func(myid int64) []*RuleGroupStatus) {
+	alertingRuleGroupsProvider = provider
+}
+
+// Returns the rule groups and their evaluation state in the format of the
+// Prometheus /api/v1/rules API. The type parameter limits the groups to
+// alerting (alert) or recording (record) rules.
+func ProcessGetRulesStatusRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	ruleType := string(ctx.QueryArgs().Peek("type"))
+	if ruleType != "" && ruleType != "alert" && ruleType != "record" {
+		utils.SetBadMsg(ctx, fmt.Sprintf("invalid rule type %q", ruleType))
+		return
+	}
+
+	groups := make([]*RuleGroupStatus, 0)
+	if ruleType != "alert" {
+		groups = append(groups, getRuleGroupStatuses(myid)...)
+	}
+	if ruleType != "record" && alertingRuleGroupsProvider != nil {
+		groups = append(groups, alertingRuleGroupsProvider(myid)...)
+	}
+
+	response := map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"groups": groups,
+		},
+	}
+	utils.WriteJsonResponse(ctx, response)
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+func ProcessGetRuleGroupsRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	utils.WriteJsonResponse(ctx, &RuleGroups{Groups: getRuleGroups(myid)})
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+func ProcessGetRuleGroupRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	name := utils.ExtractParamAsString(ctx.UserValue("groupName"))
+	groups := getRuleGroups(myid)
+	idx := findGroup(groups, name)
+	if idx < 0 {
+		writeGroupNotFound(ctx, name)
+		return
+	}
+	utils.WriteJsonResponse(ctx, &groups[idx])
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// Adds the groups of a Prometheus rule file, replacing existing groups with
+// the same name.
+func ProcessUploadRuleGroupsRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	ruleGroups, err := ParseRuleGroups(ctx.PostBody())
+	if err != nil {
+		utils.SendError(ctx, err.Error(), "", err)
+		return
+	}
+	if len(ruleGroups.Groups) == 0 {
+		utils.SetBadMsg(ctx, "rule file does not have any groups")
+		return
+	}
+
+	err = putRuleGroups(myid, ruleGroups.Groups, true)
+	if err != nil {
+		utils.SendInternalError(ctx, "Failed to save rule groups", "", err)
+		return
+	}
+
+	utils.WriteJsonResponse(ctx, map[string]interface{}{
+		"message": fmt.Sprintf("Uploaded %v rule groups", len(ruleGroups.Groups)),
+	})
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+func ProcessCreateRuleGroupRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	group, ok := readRuleGroupFromBody(ctx)
+	if !ok {
+		return
+	}
+
+	err := putRuleGroups(myid, []RuleGroup{*group}, false)
+	if err != nil {
+		utils.SendError(ctx, err.Error(), "", err)
+		return
+	}
+
+	utils.WriteJsonResponse(ctx, map[string]interface{}{
+		"message": "Rule group created successfully",
+	})
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+func ProcessUpdateRuleGroupRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	name := utils.ExtractParamAsString(ctx.UserValue("groupName"))
+	group, ok := readRuleGroupFromBody(ctx)
+	if !ok {
+		return
+	}
+
+	found, err := updateRuleGroup(myid, name, *group)
+	if !found {
+		writeGroupNotFound(ctx, name)
+		return
+	}
+	if err != nil {
+		utils.SendError(ctx, err.Error(), "", err)
+		return
+	}
+
+	utils.WriteJsonResponse(ctx, map[string]interface{}{
+		"message": "Rule group updated successfully",
+	})
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+func ProcessDeleteRuleGroupRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	name := utils.ExtractParamAsString(ctx.UserValue("groupName"))
+	found, err := deleteRuleGroup(myid, name)
+	if !found {
+		writeGroupNotFound(ctx, name)
+		return
+	}
+	if err != nil {
+		utils.SendInternalError(ctx, "Failed to delete rule group", "", err)
+		return
+	}
+
+	utils.WriteJsonResponse(ctx, map[string]interface{}{
+		"message": "Rule group deleted successfully",
+	})
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+func readRuleGroupFromBody(ctx *fasthttp.RequestCtx) (*RuleGroup, bool) {
+	group := &RuleGroup{}
+	err := json.Unmarshal(ctx.PostBody(), group)
+	if err != nil {
+		utils.SendError(ctx, "Invalid rule group json", "", err)
+		return nil, false
+	}
+	err = group.Validate()
+	if err != nil {
+		utils.SendError(ctx, err.Error(), "", err)
+		return nil, false
+	}
+	return group, true
+}
+
+func writeGroupNotFound(ctx *fasthttp.RequestCtx, name string) {
+	ctx.SetStatusCode(fasthttp.StatusNotFound)
+	utils.WriteJsonResponse(ctx, map[string]interface{}{
+		"message": fmt.Sprintf("Rule group %v not found", name),
+	})
+}
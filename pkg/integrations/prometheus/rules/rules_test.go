@@ -0,0 +1,194 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rules
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/siglens/siglens/pkg/segment/results/mresults"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func Test_ParseRuleGroups(t *testing.T) {
+	ruleFile := `
+groups:
+  - name: http
+    interval: 30s
+    rules:
+      - record: job:http_requests:rate5m
+        expr: sum by (job) (rate(http_requests_total[5m]))
+        labels:
+          team: web
+  - name: cpu
+    rules:
+      - record: instance:cpu:avg
+        expr: avg by (instance) (cpu_usage)
+`
+	ruleGroups, err := ParseRuleGroups([]byte(ruleFile))
+	assert.Nil(t, err)
+	assert.Len(t, ruleGroups.Groups, 2)
+	assert.Equal(t, 30*time.Second, ruleGroups.Groups[0].GetInterval())
+	assert.Equal(t, DEFAULT_EVALUATION_INTERVAL, ruleGroups.Groups[1].GetInterval())
+	assert.Equal(t, map[string]string{"team": "web"}, ruleGroups.Groups[0].Rules[0].Labels)
+
+	invalidFiles := []string{
+		"groups:\n  - name: a\n    rules:\n      - record: x\n        expr: up\n  - name: a\n    rules:\n      - record: y\n        expr: up\n",
+		"groups:\n  - name: a\n    rules:\n      - record: 'not a metric'\n        expr: up\n",
+		"groups:\n  - name: a\n    rules:\n      - record: x\n        expr: 'sum(('\n",
+		"groups:\n  - name: a\n    interval: 1s\n    rules:\n      - record: x\n        expr: up\n",
+		"groups:\n  - name: a\n    rules:\n      - alert: HighLatency\n        expr: up == 0\n",
+		"groups:\n  - name: a\n    rules: []\n",
+	}
+	for _, invalidFile := range invalidFiles {
+		_, err = ParseRuleGroups([]byte(invalidFile))
+		assert.NotNil(t, err, invalidFile)
+	}
+}
+
+func Test_buildRecordedSamples(t *testing.T) {
+	rule := &RecordingRule{Record: "job:requests:sum", Expr: "sum by (job) (requests)", Labels: map[string]string{"env": "prod"}}
+	res := &mresults.MetricsResult{
+		Results: map[string]map[uint32]float64{
+			"requests{job:api,":   {100: 1, 160: 4},
+			"requests{job:batch,": {130: 7},
+			"requests{job:empty,": {},
+		},
+	}
+
+	samples, err := buildRecordedSamples(rule, res, parser.ValueTypeVector)
+	assert.Nil(t, err)
+	assert.Equal(t, []recordedSample{
+		{labels: map[string]string{"job": "api", "env": "prod"}, value: 4},
+		{labels: map[string]string{"job": "batch", "env": "prod"}, value: 7},
+	}, samples)
+
+	res.ScalarValue = 42
+	samples, err = buildRecordedSamples(rule, res, parser.ValueTypeScalar)
+	assert.Nil(t, err)
+	assert.Equal(t, []recordedSample{{labels: map[string]string{"env": "prod"}, value: 42}}, samples)
+
+	_, err = buildRecordedSamples(rule, res, parser.ValueTypeMatrix)
+	assert.NotNil(t, err)
+
+	// Both series collapse to the same labelset once job is overwritten.
+	rule.Labels = map[string]string{"job": "all"}
+	_, err = buildRecordedSamples(rule, res, parser.ValueTypeVector)
+	assert.NotNil(t, err)
+}
+
+func Test_updateActiveSeries(t *testing.T) {
+	activeSeries := make(map[string]map[string]string)
+	a := recordedSample{labels: map[string]string{"job": "a"}, value: 1}
+	b := recordedSample{labels: map[string]string{"job": "b"}, value: 2}
+	c := recordedSample{labels: map[string]string{"job": "c"}, value: 3}
+
+	assert.Len(t, updateActiveSeries(activeSeries, []recordedSample{a, b}), 0)
+
+	stale := updateActiveSeries(activeSeries, []recordedSample{b, c})
+	assert.Len(t, stale, 1)
+	assert.Equal(t, a.labels, stale[0].labels)
+	assert.True(t, value.IsStaleNaN(stale[0].value))
+
+	assert.Len(t, updateActiveSeries(activeSeries, []recordedSample{}), 2)
+	assert.Len(t, activeSeries, 0)
+}
+
+func Test_RuleGroupsPersistence(t *testing.T) {
+	rulesBaseDir = t.TempDir()
+	defer StopRecordingRules()
+
+	group := RuleGroup{Name: "g1", Rules: []RecordingRule{{Record: "r1", Expr: "up"}}}
+	assert.Nil(t, putRuleGroups(1, []RuleGroup{group}, false))
+	assert.NotNil(t, putRuleGroups(1, []RuleGroup{group}, false))
+
+	group2 := RuleGroup{Name: "g2", Interval: "10s", Rules: []RecordingRule{{Record: "r2", Expr: "sum(up)"}}}
+	assert.Nil(t, putRuleGroups(1, []RuleGroup{group2}, true))
+
+	found, err := updateRuleGroup(1, "g1", RuleGroup{Name: "g1", Rules: []RecordingRule{{Record: "r3", Expr: "up"}}})
+	assert.True(t, found)
+	assert.Nil(t, err)
+	found, err = updateRuleGroup(1, "g1", group2)
+	assert.True(t, found)
+	assert.NotNil(t, err)
+
+	saved, err := readRuleGroups(1)
+	assert.Nil(t, err)
+	assert.Equal(t, getRuleGroups(1), saved)
+	assert.Equal(t, "r3", saved[0].Rules[0].Record)
+	assert.Equal(t, "g2", saved[1].Name)
+
+	statuses := getRuleGroupStatuses(1)
+	assert.Len(t, statuses, 2)
+	assert.Equal(t, HEALTH_UNKNOWN, statuses[0].Rules[0].Health)
+	assert.Equal(t, float64(10), statuses[1].Interval)
+
+	found, err = deleteRuleGroup(1, "g1")
+	assert.True(t, found)
+	assert.Nil(t, err)
+	found, _ = deleteRuleGroup(1, "g1")
+	assert.False(t, found)
+
+	saved, err = readRuleGroups(1)
+	assert.Nil(t, err)
+	assert.Len(t, saved, 1)
+	assert.Len(t, getRuleGroups(2), 0)
+}
+
+func Test_GetRulesStatusWithAlertingRules(t *testing.T) {
+	rulesBaseDir = t.TempDir()
+	defer StopRecordingRules()
+	defer SetAlertingRuleGroupsProvider(nil)
+
+	group := RuleGroup{Name: "recording", Rules: []RecordingRule{{Record: "r1", Expr: "up"}}}
+	assert.Nil(t, putRuleGroups(1, []RuleGroup{group}, false))
+	SetAlertingRuleGroupsProvider(func(myid int64) []*RuleGroupStatus {
+		return []*RuleGroupStatus{{Name: "alerting", Rules: []*RuleStatus{{Name: "InstanceDown", Type: "alerting", State: "inactive"}}}}
+	})
+
+	getGroupNames := func(ruleType string) []string {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.QueryArgs().Set("type", ruleType)
+		ProcessGetRulesStatusRequest(ctx, 1)
+		assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+
+		var response struct {
+			Data struct {
+				Groups []RuleGroupStatus `json:"groups"`
+			} `json:"data"`
+		}
+		assert.Nil(t, json.Unmarshal(ctx.Response.Body(), &response))
+		names := make([]string, 0)
+		for _, group := range response.Data.Groups {
+			names = append(names, group.Name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"recording", "alerting"}, getGroupNames(""))
+	assert.Equal(t, []string{"alerting"}, getGroupNames("alert"))
+	assert.Equal(t, []string{"recording"}, getGroupNames("record"))
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.QueryArgs().Set("type", "other")
+	ProcessGetRulesStatusRequest(ctx, 1)
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+}
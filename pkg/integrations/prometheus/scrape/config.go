@@ -0,0 +1,219 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package scrape
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"gopkg.in/yaml.v3"
+)
+
+const DEFAULT_SCRAPE_INTERVAL = model.Duration(time.Minute)
+const DEFAULT_SCRAPE_TIMEOUT = model.Duration(10 * time.Second)
+const DEFAULT_FILE_SD_REFRESH_INTERVAL = model.Duration(5 * time.Minute)
+const DEFAULT_METRICS_PATH = "/metrics"
+const MIN_SCRAPE_INTERVAL = model.Duration(time.Second)
+
+// Config is the subset of the Prometheus configuration file that is used for
+// scraping.
+type Config struct {
+	Global        GlobalConfig `yaml:"global"`
+	ScrapeConfigs []*JobConfig `yaml:"scrape_configs"`
+}
+
+type GlobalConfig struct {
+	ScrapeInterval model.Duration `yaml:"scrape_interval"`
+	ScrapeTimeout  model.Duration `yaml:"scrape_timeout"`
+}
+
+type JobConfig struct {
+	JobName         string         `yaml:"job_name"`
+	ScrapeInterval  model.Duration `yaml:"scrape_interval"`
+	ScrapeTimeout   model.Duration `yaml:"scrape_timeout"`
+	MetricsPath     string         `yaml:"metrics_path"`
+	Scheme          string         `yaml:"scheme"`
+	Params          url.Values     `yaml:"params"`
+	HonorLabels     bool           `yaml:"honor_labels"`
+	HonorTimestamps *bool          `yaml:"honor_timestamps"`
+	SampleLimit     uint64         `yaml:"sample_limit"` // a scrape with more samples fails; 0 is no limit
+
+	// The org that the samples are written to. This is specific to SigLens.
+	OrgId int64 `yaml:"org_id"`
+
+	StaticConfigs        []TargetGroup     `yaml:"static_configs"`
+	FileSDConfigs        []FileSDConfig    `yaml:"file_sd_configs"`
+	RelabelConfigs       []*relabel.Config `yaml:"relabel_configs"`
+	MetricRelabelConfigs []*relabel.Config `yaml:"metric_relabel_configs"`
+}
+
+// TargetGroup is a set of targets with common labels, as written in
+// static_configs and in the files of file_sd_configs.
+type TargetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// FileSDConfig discovers target groups from JSON or YAML files. The last path
+// element of every file may be a glob pattern.
+type FileSDConfig struct {
+	Files           []string       `yaml:"files"`
+	RefreshInterval model.Duration `yaml:"refresh_interval"`
+}
+
+// Reads, validates and fills in the defaults of a scrape config file.
+func LoadConfigFile(fileName string) (*Config, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("LoadConfigFile: could not read %v, err=%v", fileName, err)
+	}
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("LoadConfigFile: file %v: %v", fileName, err)
+	}
+	return cfg, nil
+}
+
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+	err := yaml.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("ParseConfig: could not parse yaml, err=%v", err)
+	}
+
+	if cfg.Global.ScrapeInterval == 0 {
+		cfg.Global.ScrapeInterval = DEFAULT_SCRAPE_INTERVAL
+	}
+	if cfg.Global.ScrapeTimeout == 0 {
+		cfg.Global.ScrapeTimeout = min(DEFAULT_SCRAPE_TIMEOUT, cfg.Global.ScrapeInterval)
+	}
+	if cfg.Global.ScrapeTimeout > cfg.Global.ScrapeInterval {
+		return nil, errors.New("ParseConfig: global scrape_timeout is greater than scrape_interval")
+	}
+
+	jobNames := make(map[string]struct{}, len(cfg.ScrapeConfigs))
+	for _, job := range cfg.ScrapeConfigs {
+		if job == nil {
+			return nil, errors.New("ParseConfig: empty scrape config")
+		}
+		if _, ok := jobNames[job.JobName]; ok {
+			return nil, fmt.Errorf("ParseConfig: duplicate job_name %v", job.JobName)
+		}
+		jobNames[job.JobName] = struct{}{}
+
+		job.setDefaults(&cfg.Global)
+		err = job.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("ParseConfig: %v", err)
+		}
+	}
+	return cfg, nil
+}
+
+func (j *JobConfig) setDefaults(global *GlobalConfig) {
+	if j.ScrapeInterval == 0 {
+		j.ScrapeInterval = global.ScrapeInterval
+	}
+	if j.ScrapeTimeout == 0 {
+		j.ScrapeTimeout = min(global.ScrapeTimeout, j.ScrapeInterval)
+	}
+	if j.MetricsPath == "" {
+		j.MetricsPath = DEFAULT_METRICS_PATH
+	}
+	if j.Scheme == "" {
+		j.Scheme = "http"
+	}
+	if j.HonorTimestamps == nil {
+		honorTimestamps := true
+		j.HonorTimestamps = &honorTimestamps
+	}
+	for i := range j.FileSDConfigs {
+		if j.FileSDConfigs[i].RefreshInterval == 0 {
+			j.FileSDConfigs[i].RefreshInterval = DEFAULT_FILE_SD_REFRESH_INTERVAL
+		}
+	}
+}
+
+func (j *JobConfig) Validate() error {
+	if j.JobName == "" {
+		return errors.New("job_name is required")
+	}
+	if j.ScrapeInterval < MIN_SCRAPE_INTERVAL {
+		return fmt.Errorf("job %v: scrape_interval %v is less than the minimum of %v", j.JobName, j.ScrapeInterval, MIN_SCRAPE_INTERVAL)
+	}
+	if j.ScrapeTimeout <= 0 || j.ScrapeTimeout > j.ScrapeInterval {
+		return fmt.Errorf("job %v: scrape_timeout %v must be positive and not greater than scrape_interval %v", j.JobName, j.ScrapeTimeout, j.ScrapeInterval)
+	}
+	if j.Scheme != "http" && j.Scheme != "https" {
+		return fmt.Errorf("job %v: unsupported scheme %v", j.JobName, j.Scheme)
+	}
+
+	for _, group := range j.StaticConfigs {
+		err := group.Validate()
+		if err != nil {
+			return fmt.Errorf("job %v: %v", j.JobName, err)
+		}
+	}
+	for _, sdConfig := range j.FileSDConfigs {
+		for _, file := range sdConfig.Files {
+			ext := filepath.Ext(file)
+			if ext != ".json" && ext != ".yml" && ext != ".yaml" {
+				return fmt.Errorf("job %v: file_sd file %v must be a .json, .yml or .yaml file", j.JobName, file)
+			}
+			_, err := filepath.Match(filepath.Base(file), "")
+			if err != nil {
+				return fmt.Errorf("job %v: invalid file_sd pattern %v, err=%v", j.JobName, file, err)
+			}
+		}
+		if sdConfig.RefreshInterval < MIN_SCRAPE_INTERVAL {
+			return fmt.Errorf("job %v: file_sd refresh_interval %v is less than the minimum of %v", j.JobName, sdConfig.RefreshInterval, MIN_SCRAPE_INTERVAL)
+		}
+	}
+	for _, relabelConfigs := range [][]*relabel.Config{j.RelabelConfigs, j.MetricRelabelConfigs} {
+		for _, relabelConfig := range relabelConfigs {
+			if relabelConfig == nil {
+				return fmt.Errorf("job %v: empty relabel config", j.JobName)
+			}
+			err := relabelConfig.Validate()
+			if err != nil {
+				return fmt.Errorf("job %v: invalid relabel config, err=%v", j.JobName, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (tg *TargetGroup) Validate() error {
+	for _, target := range tg.Targets {
+		if target == "" {
+			return errors.New("empty target")
+		}
+	}
+	for name := range tg.Labels {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	return nil
+}
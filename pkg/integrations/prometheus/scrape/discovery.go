@@ -0,0 +1,114 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package scrape
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Reads the target groups of every file that matches the file_sd configs. A
+// file that can not be read or parsed keeps the groups it had on the previous
+// refresh, so that a half written file does not drop its targets.
+func readFileSDGroups(sdConfigs []FileSDConfig, previous map[string][]TargetGroup) map[string][]TargetGroup {
+	fileGroups := make(map[string][]TargetGroup)
+	for _, sdConfig := range sdConfigs {
+		for _, pattern := range sdConfig.Files {
+			fileNames, err := filepath.Glob(pattern)
+			if err != nil {
+				log.Errorf("readFileSDGroups: invalid pattern %v, err=%v", pattern, err)
+				continue
+			}
+			for _, fileName := range fileNames {
+				if _, ok := fileGroups[fileName]; ok {
+					continue
+				}
+				groups, err := readTargetGroupsFile(fileName)
+				if err != nil {
+					log.Errorf("readFileSDGroups: %v", err)
+					if prevGroups, ok := previous[fileName]; ok {
+						fileGroups[fileName] = prevGroups
+					}
+					continue
+				}
+				fileGroups[fileName] = groups
+			}
+		}
+	}
+	return fileGroups
+}
+
+func readTargetGroupsFile(fileName string) ([]TargetGroup, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("readTargetGroupsFile: could not read %v, err=%v", fileName, err)
+	}
+
+	var groups []TargetGroup
+	if filepath.Ext(fileName) == ".json" {
+		err = json.Unmarshal(data, &groups)
+	} else {
+		err = yaml.Unmarshal(data, &groups)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("readTargetGroupsFile: could not parse %v, err=%v", fileName, err)
+	}
+
+	for i := range groups {
+		err = groups[i].Validate()
+		if err != nil {
+			return nil, fmt.Errorf("readTargetGroupsFile: file %v, group %v: %v", fileName, i, err)
+		}
+	}
+	return groups, nil
+}
+
+// Returns the static groups followed by the groups of every file, ordered by
+// file name.
+func getAllTargetGroups(staticGroups []TargetGroup, fileGroups map[string][]TargetGroup) []TargetGroup {
+	fileNames := make([]string, 0, len(fileGroups))
+	for fileName := range fileGroups {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	allGroups := append([]TargetGroup(nil), staticGroups...)
+	for _, fileName := range fileNames {
+		allGroups = append(allGroups, fileGroups[fileName]...)
+	}
+	return allGroups
+}
+
+// Returns the shortest refresh interval of the file_sd configs.
+func getFileSDRefreshInterval(sdConfigs []FileSDConfig) time.Duration {
+	refreshInterval := time.Duration(0)
+	for _, sdConfig := range sdConfigs {
+		interval := time.Duration(sdConfig.RefreshInterval)
+		if refreshInterval == 0 || interval < refreshInterval {
+			refreshInterval = interval
+		}
+	}
+	return refreshInterval
+}
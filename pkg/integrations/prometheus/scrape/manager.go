@@ -0,0 +1,360 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package scrape
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/instrumentation"
+	writer "github.com/siglens/siglens/pkg/integrations/prometheus/ingest"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics"
+	"github.com/siglens/siglens/pkg/usageStats"
+	log "github.com/sirupsen/logrus"
+)
+
+// scrapePool discovers and scrapes the targets of one job.
+type scrapePool struct {
+	job    *JobConfig
+	client *http.Client
+	stop   chan struct{}
+	done   chan struct{}
+
+	// file_sd target groups of the last refresh, by file name
+	fileGroups map[string][]TargetGroup
+
+	lock           sync.Mutex
+	loops          map[string]*scrapeLoop
+	droppedTargets []labels.Labels
+
+	// Writes the series of a scrape and returns the number of written samples
+	writeSeries func(series []prompb.TimeSeries, nBytes uint64, myid int64) uint64
+}
+
+// scrapeLoop scrapes one target every interval.
+type scrapeLoop struct {
+	pool   *scrapePool
+	target *Target
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var poolsLock sync.Mutex
+var scrapePools []*scrapePool
+
+// Starts scraping the jobs of the scrape config file, when scraping is enabled.
+func InitScrapeManager() {
+	if !config.IsScrapeEnabled() {
+		return
+	}
+
+	cfg, err := LoadConfigFile(config.GetScrapeConfigFile())
+	if err != nil {
+		log.Errorf("InitScrapeManager: %v", err)
+		return
+	}
+
+	poolsLock.Lock()
+	defer poolsLock.Unlock()
+	for _, job := range cfg.ScrapeConfigs {
+		scrapePools = append(scrapePools, startScrapePool(job, writeTimeSeries))
+	}
+	log.Infof("InitScrapeManager: started %v scrape jobs", len(cfg.ScrapeConfigs))
+}
+
+// Stops all scrape jobs and waits for any in flight scrape to finish.
+func StopScrapeManager() {
+	poolsLock.Lock()
+	defer poolsLock.Unlock()
+	for _, pool := range scrapePools {
+		pool.stopAndWait()
+	}
+	scrapePools = nil
+}
+
+func writeTimeSeries(series []prompb.TimeSeries, nBytes uint64, myid int64) uint64 {
+	successCount, _ := writer.WriteTimeSeries(series, nBytes, myid)
+	usageStats.UpdateMetricsStats(nBytes, successCount, myid)
+	return successCount
+}
+
+func getTargetStatuses(myid int64) ([]*TargetStatus, []*DroppedTargetStatus) {
+	poolsLock.Lock()
+	defer poolsLock.Unlock()
+
+	active := make([]*TargetStatus, 0)
+	dropped := make([]*DroppedTargetStatus, 0)
+	for _, pool := range scrapePools {
+		if pool.job.OrgId != myid {
+			continue
+		}
+		poolActive, poolDropped := pool.getTargetStatuses()
+		active = append(active, poolActive...)
+		dropped = append(dropped, poolDropped...)
+	}
+	return active, dropped
+}
+
+func newScrapePool(job *JobConfig, writeSeries func([]prompb.TimeSeries, uint64, int64) uint64) *scrapePool {
+	return &scrapePool{
+		job:         job,
+		client:      &http.Client{},
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		fileGroups:  make(map[string][]TargetGroup),
+		loops:       make(map[string]*scrapeLoop),
+		writeSeries: writeSeries,
+	}
+}
+
+func startScrapePool(job *JobConfig, writeSeries func([]prompb.TimeSeries, uint64, int64) uint64) *scrapePool {
+	pool := newScrapePool(job, writeSeries)
+	go pool.run()
+	return pool
+}
+
+func (sp *scrapePool) stopAndWait() {
+	close(sp.stop)
+	<-sp.done
+}
+
+// Syncs the targets right away, and then on every file_sd refresh.
+func (sp *scrapePool) run() {
+	defer close(sp.done)
+	defer sp.stopLoops()
+
+	sp.refresh()
+	refreshInterval := getFileSDRefreshInterval(sp.job.FileSDConfigs)
+	if refreshInterval == 0 {
+		<-sp.stop
+		return
+	}
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sp.stop:
+			return
+		case <-ticker.C:
+			sp.refresh()
+		}
+	}
+}
+
+func (sp *scrapePool) refresh() {
+	sp.fileGroups = readFileSDGroups(sp.job.FileSDConfigs, sp.fileGroups)
+	sp.sync(getAllTargetGroups(sp.job.StaticConfigs, sp.fileGroups))
+}
+
+// Starts a loop for every new target and stops the loops of the targets that
+// are gone. Targets that did not change keep their loop and state.
+func (sp *scrapePool) sync(groups []TargetGroup) {
+	targets, dropped, errs := buildTargets(sp.job, groups)
+	for _, err := range errs {
+		log.Errorf("scrapePool.sync: %v", err)
+	}
+
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
+	sp.droppedTargets = dropped
+	activeKeys := make(map[string]struct{}, len(targets))
+	for _, target := range targets {
+		key := target.key()
+		if _, ok := activeKeys[key]; ok {
+			continue
+		}
+		activeKeys[key] = struct{}{}
+		if _, ok := sp.loops[key]; !ok {
+			sp.loops[key] = sp.startLoop(target)
+		}
+	}
+
+	for key, loop := range sp.loops {
+		if _, ok := activeKeys[key]; !ok {
+			loop.stopAndWait()
+			delete(sp.loops, key)
+		}
+	}
+}
+
+func (sp *scrapePool) stopLoops() {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	for key, loop := range sp.loops {
+		loop.stopAndWait()
+		delete(sp.loops, key)
+	}
+}
+
+func (sp *scrapePool) getTargetStatuses() ([]*TargetStatus, []*DroppedTargetStatus) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
+	active := make([]*TargetStatus, 0, len(sp.loops))
+	for _, loop := range sp.loops {
+		active = append(active, loop.target.getStatus(sp.job.JobName))
+	}
+	dropped := make([]*DroppedTargetStatus, 0, len(sp.droppedTargets))
+	for _, lset := range sp.droppedTargets {
+		dropped = append(dropped, &DroppedTargetStatus{DiscoveredLabels: lset.Map(), ScrapePool: sp.job.JobName})
+	}
+	return active, dropped
+}
+
+func (sp *scrapePool) startLoop(target *Target) *scrapeLoop {
+	ctx, cancel := context.WithCancel(context.Background())
+	loop := &scrapeLoop{
+		pool:   sp,
+		target: target,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go loop.run(ctx)
+	return loop
+}
+
+func (sl *scrapeLoop) stopAndWait() {
+	sl.cancel()
+	<-sl.done
+}
+
+// Scrapes at a fixed offset within the interval, derived from the target, so
+// that the scrapes of many targets are spread out and restarts do not shift
+// them.
+func (sl *scrapeLoop) run(ctx context.Context) {
+	defer close(sl.done)
+
+	interval := sl.target.interval
+	hasher := fnv.New64a()
+	_, _ = hasher.Write([]byte(sl.target.key()))
+	offset := time.Duration(hasher.Sum64() % uint64(interval))
+
+	next := time.Now().Truncate(interval).Add(offset)
+	if next.Before(time.Now()) {
+		next = next.Add(interval)
+	}
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			sl.scrapeAndWrite(ctx, time.Now())
+
+			next = next.Add(interval)
+			now := time.Now()
+			for now.After(next) {
+				next = next.Add(interval)
+			}
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// Scrapes the target once and writes its samples along with the report
+// series.
+func (sl *scrapeLoop) scrapeAndWrite(ctx context.Context, scrapeTime time.Time) {
+	job := sl.pool.job
+	result, err := scrapeTarget(ctx, sl.pool.client, job, sl.target, scrapeTime)
+	duration := time.Since(scrapeTime)
+	if ctx.Err() != nil {
+		// stopped while scraping, so the target is no longer scraped
+		return
+	}
+
+	instrumentation.IncrementInt64CounterWithLabel(instrumentation.SCRAPE_REQUESTS, 1, "job", job.JobName)
+	if err != nil {
+		instrumentation.IncrementInt64CounterWithLabel(instrumentation.SCRAPE_FAILURES, 1, "job", job.JobName)
+		log.Debugf("scrapeAndWrite: failed to scrape %v of job %v, err=%v", sl.target.url, job.JobName, err)
+	}
+
+	written := uint64(0)
+	if len(result.series) > 0 {
+		written = sl.pool.writeSeries(result.series, uint64(result.bodySize), job.OrgId)
+	}
+	sl.pool.writeSeries(getReportSeries(sl.target.labels, scrapeTime, duration, result, err), 0, job.OrgId)
+	instrumentation.IncrementInt64CounterWithLabel(instrumentation.SCRAPE_SAMPLES, int64(written), "job", job.JobName)
+
+	if err == nil {
+		sl.target.setMetadata(result.metadata)
+		for name, metadata := range result.metadata {
+			metrics.UpdateMetricMetadata(job.OrgId, name, metadata)
+		}
+	}
+	sl.target.report(scrapeTime, duration, result.samplesScraped, err)
+}
+
+// TargetMetadata is the metadata of a metric family exposed by a target, in
+// the format of the Prometheus /api/v1/targets/metadata API.
+type TargetMetadata struct {
+	Target map[string]string `json:"target"`
+	Metric string            `json:"metric"`
+	Type   string            `json:"type"`
+	Help   string            `json:"help"`
+	Unit   string            `json:"unit"`
+}
+
+// Returns the metadata of the active targets of the org whose labels match
+// the matchers, or of all targets when there are no matchers.
+func getTargetsMetadata(myid int64, matchers []*labels.Matcher, metricName string) []*TargetMetadata {
+	poolsLock.Lock()
+	defer poolsLock.Unlock()
+
+	result := make([]*TargetMetadata, 0)
+	for _, pool := range scrapePools {
+		if pool.job.OrgId != myid {
+			continue
+		}
+		pool.lock.Lock()
+		for _, loop := range pool.loops {
+			if !matchesTarget(loop.target.labels, matchers) {
+				continue
+			}
+			for name, metadata := range loop.target.getMetadata(metricName) {
+				result = append(result, &TargetMetadata{
+					Target: loop.target.labels.Map(),
+					Metric: name,
+					Type:   metadata.Type,
+					Help:   metadata.Help,
+					Unit:   metadata.Unit,
+				})
+			}
+		}
+		pool.lock.Unlock()
+	}
+	return result
+}
+
+func matchesTarget(targetLabels labels.Labels, matchers []*labels.Matcher) bool {
+	for _, matcher := range matchers {
+		if !matcher.Matches(targetLabels.Get(matcher.Name)) {
+			return false
+		}
+	}
+	return true
+}
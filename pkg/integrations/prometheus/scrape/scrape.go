@@ -0,0 +1,240 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package scrape
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics"
+)
+
+const ACCEPT_HEADER = "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+const MAX_SCRAPE_BODY_SIZE = 256 * 1024 * 1024
+
+var errSampleLimit = errors.New("sample limit exceeded")
+
+// The result of one scrape of a target
+type scrapeResult struct {
+	series         []prompb.TimeSeries
+	metadata       map[string]metrics.MetricMetadata // by metric family name
+	bodySize       int
+	samplesScraped int
+}
+
+// Fetches the target and returns the body and its content type.
+func fetchTarget(ctx context.Context, client *http.Client, target *Target) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, target.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", ACCEPT_HEADER)
+	req.Header.Set("User-Agent", "SigLens")
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(target.timeout.Seconds(), 'f', -1, 64))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, "", fmt.Errorf("server returned HTTP status %v", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MAX_SCRAPE_BODY_SIZE+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(body) > MAX_SCRAPE_BODY_SIZE {
+		return nil, "", fmt.Errorf("body is larger than %v bytes", MAX_SCRAPE_BODY_SIZE)
+	}
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+/*
+Scrapes the target and converts the samples to time series with the target
+labels attached, after metric_relabel_configs.
+
+Samples without a timestamp, and all samples when honor_timestamps is off, get
+the time of the scrape. When the sample limit is exceeded, the whole scrape
+fails like it does in Prometheus.
+*/
+func scrapeTarget(ctx context.Context, client *http.Client, job *JobConfig, target *Target, scrapeTime time.Time) (*scrapeResult, error) {
+	body, contentType, err := fetchTarget(ctx, client, target)
+	if err != nil {
+		return &scrapeResult{}, err
+	}
+
+	result, err := parseSamples(body, contentType, job, target.labels, scrapeTime)
+	result.bodySize = len(body)
+	return result, err
+}
+
+func parseSamples(body []byte, contentType string, job *JobConfig, targetLabels labels.Labels, scrapeTime time.Time) (*scrapeResult, error) {
+	result := &scrapeResult{series: make([]prompb.TimeSeries, 0), metadata: make(map[string]metrics.MetricMetadata)}
+
+	// an unknown content type falls back to the Prometheus text format
+	parser, _ := textparse.New(body, contentType, false)
+	defaultTs := scrapeTime.UnixMilli()
+	lb := labels.NewBuilder(labels.EmptyLabels())
+
+	for {
+		entry, err := parser.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("could not parse the response, err=%v", err)
+		}
+		switch entry {
+		case textparse.EntryType:
+			name, metricType := parser.Type()
+			metadata := result.metadata[string(name)]
+			metadata.Type = string(metricType)
+			result.metadata[string(name)] = metadata
+			continue
+		case textparse.EntryHelp:
+			name, help := parser.Help()
+			metadata := result.metadata[string(name)]
+			metadata.Help = string(help)
+			result.metadata[string(name)] = metadata
+			continue
+		case textparse.EntryUnit:
+			name, unit := parser.Unit()
+			metadata := result.metadata[string(name)]
+			metadata.Unit = string(unit)
+			result.metadata[string(name)] = metadata
+			continue
+		case textparse.EntrySeries:
+		default:
+			continue
+		}
+
+		_, sampleTs, value := parser.Series()
+		result.samplesScraped++
+		if job.SampleLimit > 0 && uint64(result.samplesScraped) > job.SampleLimit {
+			result.series = result.series[:0]
+			return result, errSampleLimit
+		}
+
+		var scraped labels.Labels
+		parser.Metric(&scraped)
+		lb.Reset(scraped)
+		addTargetLabels(lb, targetLabels, job.HonorLabels)
+		if !relabel.ProcessBuilder(lb, job.MetricRelabelConfigs...) {
+			continue
+		}
+
+		ts := defaultTs
+		if sampleTs != nil && *job.HonorTimestamps {
+			ts = *sampleTs
+		}
+		series := prompb.TimeSeries{
+			Labels:  toPrompbLabels(lb.Labels()),
+			Samples: []prompb.Sample{{Value: value, Timestamp: ts}},
+		}
+		var e exemplar.Exemplar
+		for parser.Exemplar(&e) {
+			if !e.HasTs {
+				e.Ts = ts
+			}
+			series.Exemplars = append(series.Exemplars, prompb.Exemplar{
+				Labels:    toPrompbLabels(e.Labels),
+				Value:     e.Value,
+				Timestamp: e.Ts,
+			})
+			e = exemplar.Exemplar{}
+		}
+		result.series = append(result.series, series)
+	}
+	return result, nil
+}
+
+// Adds the target labels to the scraped labels. On a conflict, the scraped
+// label is kept when honor_labels is set, and is otherwise renamed to
+// exported_<name>.
+func addTargetLabels(lb *labels.Builder, targetLabels labels.Labels, honorLabels bool) {
+	targetLabels.Range(func(l labels.Label) {
+		scrapedValue := lb.Get(l.Name)
+		if scrapedValue != "" {
+			if honorLabels {
+				return
+			}
+			exportedName := model.ExportedLabelPrefix + l.Name
+			for lb.Get(exportedName) != "" {
+				exportedName = model.ExportedLabelPrefix + exportedName
+			}
+			lb.Set(exportedName, scrapedValue)
+		}
+		lb.Set(l.Name, l.Value)
+	})
+}
+
+// Returns the up, scrape_duration_seconds, scrape_samples_scraped and
+// scrape_samples_post_metric_relabeling series of a scrape.
+func getReportSeries(targetLabels labels.Labels, scrapeTime time.Time, duration time.Duration, result *scrapeResult, scrapeErr error) []prompb.TimeSeries {
+	up := float64(1)
+	if scrapeErr != nil {
+		up = 0
+	}
+
+	values := []struct {
+		name  string
+		value float64
+	}{
+		{"up", up},
+		{"scrape_duration_seconds", duration.Seconds()},
+		{"scrape_samples_scraped", float64(result.samplesScraped)},
+		{"scrape_samples_post_metric_relabeling", float64(len(result.series))},
+	}
+
+	series := make([]prompb.TimeSeries, 0, len(values))
+	for _, v := range values {
+		lb := labels.NewBuilder(targetLabels)
+		lb.Set(model.MetricNameLabel, v.name)
+		series = append(series, prompb.TimeSeries{
+			Labels:  toPrompbLabels(lb.Labels()),
+			Samples: []prompb.Sample{{Value: v.value, Timestamp: scrapeTime.UnixMilli()}},
+		})
+	}
+	return series
+}
+
+func toPrompbLabels(lset labels.Labels) []prompb.Label {
+	converted := make([]prompb.Label, 0, lset.Len())
+	lset.Range(func(l labels.Label) {
+		converted = append(converted, prompb.Label{Name: l.Name, Value: l.Value})
+	})
+	return converted
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package scrape
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/siglens/siglens/pkg/utils"
+	"github.com/valyala/fasthttp"
+)
+
+// Returns the scrape targets and their health in the format of the
+// Prometheus /api/v1/targets API. The state parameter filters the targets to
+// active, dropped or any, which is the default.
+func ProcessGetTargetsRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	state := string(ctx.QueryArgs().Peek("state"))
+	if state == "" {
+		state = "any"
+	}
+	if state != "any" && state != "active" && state != "dropped" {
+		utils.SetBadMsg(ctx, "state must be one of active, dropped or any")
+		return
+	}
+
+	active, dropped := getTargetStatuses(myid)
+	sort.Slice(active, func(i, j int) bool {
+		if active[i].ScrapePool != active[j].ScrapePool {
+			return active[i].ScrapePool < active[j].ScrapePool
+		}
+		return active[i].ScrapeUrl < active[j].ScrapeUrl
+	})
+
+	if state == "dropped" {
+		active = active[:0]
+	}
+	if state == "active" {
+		dropped = dropped[:0]
+	}
+	utils.WriteJsonResponse(ctx, map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"activeTargets":  active,
+			"droppedTargets": dropped,
+		},
+	})
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// Returns the metadata of the metrics exposed by the scrape targets in the
+// format of the Prometheus /api/v1/targets/metadata API. match_target is a
+// label selector for the targets, metric limits it to one metric family and
+// limit caps the number of entries.
+func ProcessGetTargetsMetadataRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	var matchers []*labels.Matcher
+	matchTarget := string(ctx.QueryArgs().Peek("match_target"))
+	if matchTarget != "" {
+		var err error
+		matchers, err = parser.ParseMetricSelector(matchTarget)
+		if err != nil {
+			utils.SetBadMsg(ctx, fmt.Sprintf("invalid match_target %q, err=%v", matchTarget, err))
+			return
+		}
+	}
+
+	limit := -1
+	limitParam := string(ctx.QueryArgs().Peek("limit"))
+	if limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil {
+			utils.SetBadMsg(ctx, fmt.Sprintf("invalid limit %q", limitParam))
+			return
+		}
+	}
+
+	metadata := getTargetsMetadata(myid, matchers, string(ctx.QueryArgs().Peek("metric")))
+	sort.Slice(metadata, func(i, j int) bool {
+		if metadata[i].Metric != metadata[j].Metric {
+			return metadata[i].Metric < metadata[j].Metric
+		}
+		return labels.FromMap(metadata[i].Target).String() < labels.FromMap(metadata[j].Target).String()
+	})
+	if limit >= 0 && len(metadata) > limit {
+		metadata = metadata[:limit]
+	}
+
+	utils.WriteJsonResponse(ctx, map[string]interface{}{
+		"status": "success",
+		"data":   metadata,
+	})
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
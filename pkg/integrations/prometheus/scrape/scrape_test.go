@@ -0,0 +1,323 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package scrape
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+const testScrapeConfig = `
+global:
+  scrape_interval: 30s
+scrape_configs:
+  - job_name: node
+    scrape_timeout: 5s
+    params:
+      module: [http_2xx]
+    static_configs:
+      - targets: ['host-a:9100', 'host-b:9100']
+        labels:
+          env: prod
+    relabel_configs:
+      - source_labels: [__address__]
+        regex: 'host-b:.*'
+        action: drop
+      - source_labels: [__address__]
+        regex: '(.*):9100'
+        target_label: host
+    metric_relabel_configs:
+      - source_labels: [__name__]
+        regex: 'go_.*'
+        action: drop
+`
+
+type capturedWrites struct {
+	lock   sync.Mutex
+	series []prompb.TimeSeries
+}
+
+func (cw *capturedWrites) write(series []prompb.TimeSeries, nBytes uint64, myid int64) uint64 {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	cw.series = append(cw.series, series...)
+	return uint64(len(series))
+}
+
+// Returns the value of every written series by its labels.
+func (cw *capturedWrites) getValues() map[string]float64 {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	values := make(map[string]float64)
+	for _, ts := range cw.series {
+		lset := make([]string, 0, len(ts.Labels))
+		for _, l := range ts.Labels {
+			lset = append(lset, l.Name+"="+l.Value)
+		}
+		values[strings.Join(lset, ",")] = ts.Samples[0].Value
+	}
+	return values
+}
+
+func Test_ParseConfig(t *testing.T) {
+	cfg, err := ParseConfig([]byte(testScrapeConfig))
+	assert.Nil(t, err)
+	assert.Len(t, cfg.ScrapeConfigs, 1)
+
+	job := cfg.ScrapeConfigs[0]
+	assert.Equal(t, model.Duration(30*time.Second), job.ScrapeInterval)
+	assert.Equal(t, model.Duration(5*time.Second), job.ScrapeTimeout)
+	assert.Equal(t, DEFAULT_METRICS_PATH, job.MetricsPath)
+	assert.Equal(t, "http", job.Scheme)
+	assert.True(t, *job.HonorTimestamps)
+	assert.Len(t, job.RelabelConfigs, 2)
+	assert.Equal(t, "$1", job.RelabelConfigs[1].Replacement)
+
+	for _, invalid := range []string{
+		"scrape_configs:\n  - job_name: ''",
+		"scrape_configs:\n  - job_name: a\n  - job_name: a",
+		"scrape_configs:\n  - job_name: a\n    scrape_interval: 10s\n    scrape_timeout: 20s",
+		"scrape_configs:\n  - job_name: a\n    scheme: ftp",
+		"scrape_configs:\n  - job_name: a\n    file_sd_configs:\n      - files: [targets.txt]",
+		"scrape_configs:\n  - job_name: a\n    relabel_configs:\n      - action: replace",
+	} {
+		_, err := ParseConfig([]byte(invalid))
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func Test_BuildTargets(t *testing.T) {
+	cfg, err := ParseConfig([]byte(testScrapeConfig))
+	assert.Nil(t, err)
+	job := cfg.ScrapeConfigs[0]
+
+	targets, dropped, errs := buildTargets(job, job.StaticConfigs)
+	assert.Empty(t, errs)
+	assert.Len(t, dropped, 1)
+	assert.Equal(t, "host-b:9100", dropped[0].Get(model.AddressLabel))
+	assert.Len(t, targets, 1)
+
+	target := targets[0]
+	assert.Equal(t, "http://host-a:9100/metrics?module=http_2xx", target.url)
+	assert.Equal(t, 30*time.Second, target.interval)
+	assert.Equal(t, 5*time.Second, target.timeout)
+	assert.Equal(t, map[string]string{
+		"env":      "prod",
+		"host":     "host-a",
+		"instance": "host-a:9100",
+		"job":      "node",
+	}, target.labels.Map())
+	assert.Equal(t, "http_2xx", target.discoveredLabels.Get("__param_module"))
+}
+
+func Test_ParseSamples(t *testing.T) {
+	cfg, err := ParseConfig([]byte(testScrapeConfig))
+	assert.Nil(t, err)
+	job := cfg.ScrapeConfigs[0]
+	targetLabels := labels.FromStrings("instance", "host-a:9100", "job", "node")
+	scrapeTime := time.UnixMilli(1_700_000_000_000)
+
+	body := `# TYPE http_requests counter
+http_requests_total{code="200",job="app"} 10 1699999999
+http_requests_created{code="200",job="app"} 1699990000
+go_goroutines 12
+# EOF
+`
+	result, err := parseSamples([]byte(body), "application/openmetrics-text; version=1.0.0", job, targetLabels, scrapeTime)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, result.samplesScraped)
+	assert.Len(t, result.series, 2)
+	assert.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "http_requests_total"},
+		{Name: "code", Value: "200"},
+		{Name: "exported_job", Value: "app"},
+		{Name: "instance", Value: "host-a:9100"},
+		{Name: "job", Value: "node"},
+	}, result.series[0].Labels)
+	assert.Equal(t, prompb.Sample{Value: 10, Timestamp: 1699999999000}, result.series[0].Samples[0])
+
+	// the text format, with the scraped job label kept
+	job.HonorLabels = true
+	result, err = parseSamples([]byte("up_time{job=\"app\"} 3\n"), "text/plain; version=0.0.4", job, targetLabels, scrapeTime)
+	assert.Nil(t, err)
+	assert.Len(t, result.series, 1)
+	assert.Contains(t, result.series[0].Labels, prompb.Label{Name: "job", Value: "app"})
+	assert.Equal(t, scrapeTime.UnixMilli(), result.series[0].Samples[0].Timestamp)
+
+	job.SampleLimit = 1
+	result, err = parseSamples([]byte("a 1\nb 2\n"), "", job, targetLabels, scrapeTime)
+	assert.Equal(t, errSampleLimit, err)
+	assert.Empty(t, result.series)
+
+	_, err = parseSamples([]byte("a{ 1\n"), "", job, targetLabels, scrapeTime)
+	assert.NotNil(t, err)
+}
+
+func Test_ParseSamples_MetadataAndExemplars(t *testing.T) {
+	cfg, err := ParseConfig([]byte(testScrapeConfig))
+	assert.Nil(t, err)
+	job := cfg.ScrapeConfigs[0]
+	targetLabels := labels.FromStrings("instance", "host-a:9100", "job", "node")
+	scrapeTime := time.UnixMilli(1_700_000_000_000)
+
+	body := `# TYPE request_latency_seconds histogram
+# HELP request_latency_seconds Latency of the requests.
+# UNIT request_latency_seconds seconds
+request_latency_seconds_bucket{le="0.5"} 3 # {trace_id="abc123"} 0.25 1699999998.5
+request_latency_seconds_bucket{le="+Inf"} 4 # {trace_id="def456"} 0.75
+request_latency_seconds_sum 1.5
+request_latency_seconds_count 4
+# EOF
+`
+	result, err := parseSamples([]byte(body), "application/openmetrics-text; version=1.0.0", job, targetLabels, scrapeTime)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]metrics.MetricMetadata{
+		"request_latency_seconds": {Type: "histogram", Help: "Latency of the requests.", Unit: "seconds"},
+	}, result.metadata)
+
+	assert.Len(t, result.series, 4)
+	assert.Equal(t, []prompb.Exemplar{{
+		Labels:    []prompb.Label{{Name: "trace_id", Value: "abc123"}},
+		Value:     0.25,
+		Timestamp: 1699999998500,
+	}}, result.series[0].Exemplars)
+	// exemplars without a timestamp get the one of the sample
+	assert.Equal(t, scrapeTime.UnixMilli(), result.series[1].Exemplars[0].Timestamp)
+	assert.Empty(t, result.series[2].Exemplars)
+}
+
+func Test_ScrapeAndWrite(t *testing.T) {
+	fail := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		assert.Contains(t, r.Header.Get("Accept"), "application/openmetrics-text")
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("# HELP temperature Temperature\n# TYPE temperature gauge\ntemperature{room=\"a\"} 21.5\n"))
+	}))
+	defer server.Close()
+
+	address := strings.TrimPrefix(server.URL, "http://")
+	cfg, err := ParseConfig([]byte("scrape_configs:\n  - job_name: sensors\n    static_configs:\n      - targets: ['" + address + "']"))
+	assert.Nil(t, err)
+
+	captured := &capturedWrites{}
+	pool := newScrapePool(cfg.ScrapeConfigs[0], captured.write)
+	pool.sync(pool.job.StaticConfigs)
+	defer pool.stopLoops()
+	assert.Len(t, pool.loops, 1)
+
+	var loop *scrapeLoop
+	for _, l := range pool.loops {
+		loop = l
+	}
+	loop.scrapeAndWrite(context.Background(), time.Now())
+
+	targetLabels := "instance=" + address + ",job=sensors"
+	values := captured.getValues()
+	assert.Equal(t, 21.5, values["__name__=temperature,"+targetLabels+",room=a"])
+	assert.Equal(t, float64(1), values["__name__=up,"+targetLabels])
+	assert.Equal(t, float64(1), values["__name__=scrape_samples_scraped,"+targetLabels])
+	assert.Contains(t, values, "__name__=scrape_duration_seconds,"+targetLabels)
+
+	active, dropped := pool.getTargetStatuses()
+	assert.Empty(t, dropped)
+	assert.Len(t, active, 1)
+	assert.Equal(t, HEALTH_UP, active[0].Health)
+	assert.Equal(t, 1, active[0].LastSamples)
+	assert.Equal(t, map[string]metrics.MetricMetadata{"temperature": {Type: "gauge", Help: "Temperature"}}, loop.target.getMetadata(""))
+	assert.Empty(t, loop.target.getMetadata("humidity"))
+
+	fail = true
+	captured.series = nil
+	loop.scrapeAndWrite(context.Background(), time.Now())
+	values = captured.getValues()
+	assert.Len(t, values, 4)
+	assert.Equal(t, float64(0), values["__name__=up,"+targetLabels])
+
+	active, _ = pool.getTargetStatuses()
+	assert.Equal(t, HEALTH_DOWN, active[0].Health)
+	assert.Contains(t, active[0].LastError, "500")
+	// the metadata of the last successful scrape is kept
+	assert.Len(t, loop.target.getMetadata(""), 1)
+
+	matchers, err := parser.ParseMetricSelector(`{job="sensors"}`)
+	assert.Nil(t, err)
+	assert.True(t, matchesTarget(loop.target.labels, matchers))
+	matchers, err = parser.ParseMetricSelector(`{job="node"}`)
+	assert.Nil(t, err)
+	assert.False(t, matchesTarget(loop.target.labels, matchers))
+}
+
+func Test_FileSDRefresh(t *testing.T) {
+	dir := t.TempDir()
+	jsonFile := filepath.Join(dir, "a.json")
+	err := os.WriteFile(jsonFile, []byte(`[{"targets": ["host-a:80"], "labels": {"team": "x"}}]`), 0644)
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(dir, "b.yml"), []byte("- targets: ['host-b:80', 'host-c:80']\n"), 0644)
+	assert.Nil(t, err)
+
+	cfg, err := ParseConfig([]byte("scrape_configs:\n  - job_name: files\n    scrape_interval: 1h\n    file_sd_configs:\n      - files: ['" + dir + "/*.json', '" + dir + "/*.yml']"))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(DEFAULT_FILE_SD_REFRESH_INTERVAL), getFileSDRefreshInterval(cfg.ScrapeConfigs[0].FileSDConfigs))
+
+	pool := newScrapePool(cfg.ScrapeConfigs[0], (&capturedWrites{}).write)
+	defer pool.stopLoops()
+
+	getInstances := func() map[string]string {
+		active, _ := pool.getTargetStatuses()
+		instances := make(map[string]string)
+		for _, status := range active {
+			instances[status.Labels["instance"]] = status.Labels["team"]
+		}
+		return instances
+	}
+
+	pool.refresh()
+	assert.Equal(t, map[string]string{"host-a:80": "x", "host-b:80": "", "host-c:80": ""}, getInstances())
+
+	// a target that is removed stops being scraped, and a file that can not
+	// be parsed keeps its previous targets
+	err = os.WriteFile(filepath.Join(dir, "b.yml"), []byte("- targets: ['host-b:80']\n"), 0644)
+	assert.Nil(t, err)
+	err = os.WriteFile(jsonFile, []byte(`[{"targets": `), 0644)
+	assert.Nil(t, err)
+	pool.refresh()
+	assert.Equal(t, map[string]string{"host-a:80": "x", "host-b:80": ""}, getInstances())
+
+	err = os.Remove(jsonFile)
+	assert.Nil(t, err)
+	pool.refresh()
+	assert.Equal(t, map[string]string{"host-b:80": ""}, getInstances())
+}
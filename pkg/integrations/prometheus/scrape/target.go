@@ -0,0 +1,250 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package scrape
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics"
+)
+
+const (
+	HEALTH_UNKNOWN = "unknown"
+	HEALTH_UP      = "up"
+	HEALTH_DOWN    = "down"
+)
+
+const PARAM_LABEL_PREFIX = "__param_"
+const SCRAPE_INTERVAL_LABEL = "__scrape_interval__"
+const SCRAPE_TIMEOUT_LABEL = "__scrape_timeout__"
+
+// Target is an endpoint that is scraped, along with the state of its last
+// scrape.
+type Target struct {
+	labels           labels.Labels
+	discoveredLabels labels.Labels
+	url              string
+	interval         time.Duration
+	timeout          time.Duration
+
+	lock               sync.Mutex
+	health             string
+	lastError          string
+	lastScrape         time.Time
+	lastScrapeDuration time.Duration
+	lastSamples        int
+	metadata           map[string]metrics.MetricMetadata // of the last successful scrape
+}
+
+type TargetStatus struct {
+	DiscoveredLabels   map[string]string `json:"discoveredLabels"`
+	Labels             map[string]string `json:"labels"`
+	ScrapePool         string            `json:"scrapePool"`
+	ScrapeUrl          string            `json:"scrapeUrl"`
+	LastError          string            `json:"lastError"`
+	LastScrape         time.Time         `json:"lastScrape"`
+	LastScrapeDuration float64           `json:"lastScrapeDuration"`
+	LastSamples        int               `json:"lastSamples"`
+	Health             string            `json:"health"`
+	ScrapeInterval     string            `json:"scrapeInterval"`
+	ScrapeTimeout      string            `json:"scrapeTimeout"`
+}
+
+type DroppedTargetStatus struct {
+	DiscoveredLabels map[string]string `json:"discoveredLabels"`
+	ScrapePool       string            `json:"scrapePool"`
+}
+
+// Returns a key that identifies the target across refreshes of the targets.
+func (t *Target) key() string {
+	return t.url + t.labels.String()
+}
+
+func (t *Target) report(start time.Time, duration time.Duration, numSamples int, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.lastScrape = start
+	t.lastScrapeDuration = duration
+	t.lastSamples = numSamples
+	if err != nil {
+		t.health = HEALTH_DOWN
+		t.lastError = err.Error()
+	} else {
+		t.health = HEALTH_UP
+		t.lastError = ""
+	}
+}
+
+func (t *Target) setMetadata(metadata map[string]metrics.MetricMetadata) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.metadata = metadata
+}
+
+// Returns the metadata of the metric families that the target exposed in its
+// last successful scrape, or only of metricName when it is set.
+func (t *Target) getMetadata(metricName string) map[string]metrics.MetricMetadata {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	metadata := make(map[string]metrics.MetricMetadata)
+	for name, md := range t.metadata {
+		if metricName == "" || name == metricName {
+			metadata[name] = md
+		}
+	}
+	return metadata
+}
+
+func (t *Target) getStatus(jobName string) *TargetStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return &TargetStatus{
+		DiscoveredLabels:   t.discoveredLabels.Map(),
+		Labels:             t.labels.Map(),
+		ScrapePool:         jobName,
+		ScrapeUrl:          t.url,
+		LastError:          t.lastError,
+		LastScrape:         t.lastScrape,
+		LastScrapeDuration: t.lastScrapeDuration.Seconds(),
+		LastSamples:        t.lastSamples,
+		Health:             t.health,
+		ScrapeInterval:     model.Duration(t.interval).String(),
+		ScrapeTimeout:      model.Duration(t.timeout).String(),
+	}
+}
+
+/*
+Builds the targets of the groups the same way Prometheus does. The labels of a
+target start with its group labels, __address__ and the job defaults in
+__scheme__, __metrics_path__, __scrape_interval__, __scrape_timeout__ and
+__param_<name>, and then go through relabel_configs. A target is dropped when
+relabeling drops it or removes its address.
+
+After relabeling, the internal labels that start with __ are removed, and the
+instance label defaults to the address.
+
+Returns the active targets and the discovered labels of the dropped targets.
+*/
+func buildTargets(job *JobConfig, groups []TargetGroup) ([]*Target, []labels.Labels, []error) {
+	targets := make([]*Target, 0)
+	dropped := make([]labels.Labels, 0)
+	errs := make([]error, 0)
+
+	for _, group := range groups {
+		for _, address := range group.Targets {
+			lb := labels.NewBuilder(labels.FromMap(group.Labels))
+			lb.Set(model.AddressLabel, address)
+			setDefaultLabel(lb, model.JobLabel, job.JobName)
+			setDefaultLabel(lb, model.SchemeLabel, job.Scheme)
+			setDefaultLabel(lb, model.MetricsPathLabel, job.MetricsPath)
+			setDefaultLabel(lb, SCRAPE_INTERVAL_LABEL, job.ScrapeInterval.String())
+			setDefaultLabel(lb, SCRAPE_TIMEOUT_LABEL, job.ScrapeTimeout.String())
+			for name, values := range job.Params {
+				if len(values) > 0 {
+					setDefaultLabel(lb, PARAM_LABEL_PREFIX+name, values[0])
+				}
+			}
+			discoveredLabels := lb.Labels()
+
+			if !relabel.ProcessBuilder(lb, job.RelabelConfigs...) || lb.Get(model.AddressLabel) == "" {
+				dropped = append(dropped, discoveredLabels)
+				continue
+			}
+
+			target, err := newTarget(job, lb, discoveredLabels)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("job %v, target %v: %v", job.JobName, address, err))
+				continue
+			}
+			targets = append(targets, target)
+		}
+	}
+	return targets, dropped, errs
+}
+
+func setDefaultLabel(lb *labels.Builder, name string, value string) {
+	if lb.Get(name) == "" {
+		lb.Set(name, value)
+	}
+}
+
+func newTarget(job *JobConfig, lb *labels.Builder, discoveredLabels labels.Labels) (*Target, error) {
+	address := lb.Get(model.AddressLabel)
+	if strings.Contains(address, "/") {
+		return nil, fmt.Errorf("invalid address %q", address)
+	}
+
+	interval, err := model.ParseDuration(lb.Get(SCRAPE_INTERVAL_LABEL))
+	if err != nil {
+		return nil, fmt.Errorf("invalid scrape interval, err=%v", err)
+	}
+	timeout, err := model.ParseDuration(lb.Get(SCRAPE_TIMEOUT_LABEL))
+	if err != nil {
+		return nil, fmt.Errorf("invalid scrape timeout, err=%v", err)
+	}
+	if interval < MIN_SCRAPE_INTERVAL {
+		return nil, fmt.Errorf("scrape interval %v is less than the minimum of %v", interval, MIN_SCRAPE_INTERVAL)
+	}
+	if timeout <= 0 || timeout > interval {
+		return nil, errors.New("scrape timeout must be positive and not greater than the scrape interval")
+	}
+
+	params := url.Values{}
+	for name, values := range job.Params {
+		params[name] = values
+	}
+	lb.Range(func(l labels.Label) {
+		if strings.HasPrefix(l.Name, PARAM_LABEL_PREFIX) {
+			params.Set(strings.TrimPrefix(l.Name, PARAM_LABEL_PREFIX), l.Value)
+		}
+	})
+
+	scrapeUrl := &url.URL{
+		Scheme:   lb.Get(model.SchemeLabel),
+		Host:     address,
+		Path:     lb.Get(model.MetricsPathLabel),
+		RawQuery: params.Encode(),
+	}
+
+	lb.Range(func(l labels.Label) {
+		if strings.HasPrefix(l.Name, model.ReservedLabelPrefix) {
+			lb.Del(l.Name)
+		}
+	})
+	setDefaultLabel(lb, model.InstanceLabel, address)
+
+	return &Target{
+		labels:           lb.Labels(),
+		discoveredLabels: discoveredLabels,
+		url:              scrapeUrl.String(),
+		interval:         time.Duration(interval),
+		timeout:          time.Duration(timeout),
+		health:           HEALTH_UNKNOWN,
+	}, nil
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package statsd
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AggregatedMetric is a datapoint written on a flush.
+type AggregatedMetric struct {
+	Name  string
+	Tags  []Tag
+	Value float64
+}
+
+type seriesState struct {
+	name string
+	tags []Tag
+
+	value     float64             // counter sum or gauge value
+	values    []float64           // timer, histogram and distribution values
+	count     float64             // number of timer values, scaled by the sample rate
+	sum       float64             // sum of timer values, scaled by the sample rate
+	setValues map[string]struct{} // unique set values
+
+	lastUpdated time.Time // of a gauge, to evict it once idle
+}
+
+/*
+Aggregator aggregates samples between flushes, per metric type, name and tags.
+
+Counters are summed and scaled by their sample rate. Gauges keep their last
+value, and are written on every flush until they are idle for longer than the
+gauge TTL, after which they are dropped. Timers,
+histograms and distributions are written as _count, _sum, _min, _max, _avg and
+a _p<percentile> series for every configured percentile. Sets are written as
+the number of unique values.
+*/
+type Aggregator struct {
+	percentiles []float64
+	gaugeTTL    time.Duration
+
+	lock     sync.Mutex
+	counters map[string]*seriesState
+	gauges   map[string]*seriesState
+	timers   map[string]*seriesState
+	sets     map[string]*seriesState
+}
+
+func NewAggregator(percentiles []float64, gaugeTTL time.Duration) *Aggregator {
+	return &Aggregator{
+		percentiles: percentiles,
+		gaugeTTL:    gaugeTTL,
+		counters:    make(map[string]*seriesState),
+		gauges:      make(map[string]*seriesState),
+		timers:      make(map[string]*seriesState),
+		sets:        make(map[string]*seriesState),
+	}
+}
+
+func (a *Aggregator) Add(sample *Sample) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	switch sample.Type {
+	case COUNTER:
+		state := getSeriesState(a.counters, sample)
+		for _, value := range sample.Values {
+			state.value += value / sample.SampleRate
+		}
+	case GAUGE:
+		state := getSeriesState(a.gauges, sample)
+		state.lastUpdated = time.Now()
+		for _, value := range sample.Values {
+			if sample.GaugeDelta {
+				state.value += value
+			} else {
+				state.value = value
+			}
+		}
+	case TIMER, HISTOGRAM, DISTRIBUTION:
+		state := getSeriesState(a.timers, sample)
+		for _, value := range sample.Values {
+			state.values = append(state.values, value)
+			state.count += 1 / sample.SampleRate
+			state.sum += value / sample.SampleRate
+		}
+	case SET:
+		state := getSeriesState(a.sets, sample)
+		if state.setValues == nil {
+			state.setValues = make(map[string]struct{})
+		}
+		state.setValues[sample.SetValue] = struct{}{}
+	}
+}
+
+func getSeriesState(states map[string]*seriesState, sample *Sample) *seriesState {
+	key := getSeriesKey(sample.Name, sample.Tags)
+	state, ok := states[key]
+	if !ok {
+		state = &seriesState{name: sample.Name, tags: sample.Tags}
+		states[key] = state
+	}
+	return state
+}
+
+func getSeriesKey(name string, tags []Tag) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+	for _, tag := range tags {
+		sb.WriteByte(0)
+		sb.WriteString(tag.Key)
+		sb.WriteByte(0)
+		sb.WriteString(tag.Value)
+	}
+	return sb.String()
+}
+
+// Returns the aggregated metrics since the last flush, and resets everything
+// except the gauges. Gauges not updated within the gauge TTL are dropped.
+func (a *Aggregator) Flush() []AggregatedMetric {
+	now := time.Now()
+	a.lock.Lock()
+	counters, timers, sets := a.counters, a.timers, a.sets
+	a.counters = make(map[string]*seriesState)
+	a.timers = make(map[string]*seriesState)
+	a.sets = make(map[string]*seriesState)
+
+	aggregated := make([]AggregatedMetric, 0, len(counters)+len(a.gauges)+len(sets)+len(timers)*(5+len(a.percentiles)))
+	for key, state := range a.gauges {
+		if now.Sub(state.lastUpdated) > a.gaugeTTL {
+			delete(a.gauges, key)
+			continue
+		}
+		aggregated = append(aggregated, AggregatedMetric{Name: state.name, Tags: state.tags, Value: state.value})
+	}
+	a.lock.Unlock()
+
+	for _, state := range counters {
+		aggregated = append(aggregated, AggregatedMetric{Name: state.name, Tags: state.tags, Value: state.value})
+	}
+	for _, state := range sets {
+		aggregated = append(aggregated, AggregatedMetric{Name: state.name, Tags: state.tags, Value: float64(len(state.setValues))})
+	}
+	for _, state := range timers {
+		aggregated = append(aggregated, a.getTimerMetrics(state)...)
+	}
+	return aggregated
+}
+
+func (a *Aggregator) getTimerMetrics(state *seriesState) []AggregatedMetric {
+	sort.Float64s(state.values)
+	numValues := len(state.values)
+
+	getMetric := func(suffix string, value float64) AggregatedMetric {
+		return AggregatedMetric{Name: state.name + suffix, Tags: state.tags, Value: value}
+	}
+	timerMetrics := []AggregatedMetric{
+		getMetric("_count", state.count),
+		getMetric("_sum", state.sum),
+		getMetric("_min", state.values[0]),
+		getMetric("_max", state.values[numValues-1]),
+		getMetric("_avg", state.sum/state.count),
+	}
+	for _, percentile := range a.percentiles {
+		// nearest rank, so that every percentile is an observed value
+		rank := int(math.Ceil(percentile / 100 * float64(numValues)))
+		rank = min(max(rank, 1), numValues)
+		suffix := "_p" + strings.ReplaceAll(strconv.FormatFloat(percentile, 'f', -1, 64), ".", "_")
+		timerMetrics = append(timerMetrics, getMetric(suffix, state.values[rank-1]))
+	}
+	return timerMetrics
+}
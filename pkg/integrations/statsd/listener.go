@@ -0,0 +1,261 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package statsd
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/config/common"
+	"github.com/siglens/siglens/pkg/instrumentation"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics"
+	"github.com/siglens/siglens/pkg/usageStats"
+	log "github.com/sirupsen/logrus"
+)
+
+const MAX_UDP_PACKET_SIZE = 65535
+
+// Listener receives StatsD lines over UDP and TCP, and writes the aggregated
+// metrics every flush interval.
+type Listener struct {
+	cfg        common.StatsdConfig
+	aggregator *Aggregator
+	udpConn    net.PacketConn
+	tcpLn      net.Listener
+	stop       chan struct{}
+	wg         sync.WaitGroup
+
+	bytesReceived uint64
+
+	tcpConnsLock sync.Mutex
+	tcpConns     map[net.Conn]struct{}
+	tcpClosed    bool
+
+	// Writes the aggregated metrics and returns the number of written ones
+	writeMetrics func(aggregated []AggregatedMetric, bytesReceived uint64, ts uint32, myid int64) uint64
+}
+
+var globalListener *Listener
+
+// Starts the StatsD listener, when it is enabled.
+func InitStatsdListener() {
+	if !config.IsStatsdEnabled() {
+		return
+	}
+
+	listener, err := startListener(config.GetStatsdConfig(), writeAggregatedMetrics)
+	if err != nil {
+		log.Errorf("InitStatsdListener: failed to start the listener, err=%v", err)
+		return
+	}
+	globalListener = listener
+	log.Infof("InitStatsdListener: listening on udp=%v tcp=%v", listener.cfg.UDPAddress, listener.cfg.TCPAddress)
+}
+
+// Stops the listener and writes the metrics aggregated since the last flush.
+func StopStatsdListener() {
+	if globalListener == nil {
+		return
+	}
+	globalListener.stopAndFlush()
+	globalListener = nil
+}
+
+func startListener(cfg common.StatsdConfig, writeMetrics func([]AggregatedMetric, uint64, uint32, int64) uint64) (*Listener, error) {
+	listener := &Listener{
+		cfg:          cfg,
+		aggregator:   NewAggregator(cfg.Percentiles, time.Duration(cfg.GaugeTTLSecs)*time.Second),
+		stop:         make(chan struct{}),
+		tcpConns:     make(map[net.Conn]struct{}),
+		writeMetrics: writeMetrics,
+	}
+
+	var err error
+	if cfg.UDPAddress != "" {
+		listener.udpConn, err = net.ListenPacket("udp", cfg.UDPAddress)
+		if err != nil {
+			return nil, err
+		}
+		listener.wg.Add(1)
+		go listener.serveUDP()
+	}
+	if cfg.TCPAddress != "" {
+		listener.tcpLn, err = net.Listen("tcp", cfg.TCPAddress)
+		if err != nil {
+			if listener.udpConn != nil {
+				_ = listener.udpConn.Close()
+				listener.wg.Wait()
+			}
+			return nil, err
+		}
+		listener.wg.Add(1)
+		go listener.serveTCP()
+	}
+
+	listener.wg.Add(1)
+	go listener.runFlushLoop()
+	return listener, nil
+}
+
+func (l *Listener) stopAndFlush() {
+	close(l.stop)
+	if l.udpConn != nil {
+		_ = l.udpConn.Close()
+	}
+	if l.tcpLn != nil {
+		_ = l.tcpLn.Close()
+	}
+	l.tcpConnsLock.Lock()
+	l.tcpClosed = true
+	for conn := range l.tcpConns {
+		_ = conn.Close()
+	}
+	l.tcpConnsLock.Unlock()
+
+	l.wg.Wait()
+	l.flush()
+}
+
+func (l *Listener) serveUDP() {
+	defer l.wg.Done()
+
+	buf := make([]byte, MAX_UDP_PACKET_SIZE)
+	for {
+		n, _, err := l.udpConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Errorf("Listener.serveUDP: failed to read packet, err=%v", err)
+			continue
+		}
+		atomic.AddUint64(&l.bytesReceived, uint64(n))
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			l.handleLine(line)
+		}
+	}
+}
+
+func (l *Listener) serveTCP() {
+	defer l.wg.Done()
+
+	for {
+		conn, err := l.tcpLn.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Errorf("Listener.serveTCP: failed to accept connection, err=%v", err)
+			continue
+		}
+
+		l.tcpConnsLock.Lock()
+		if l.tcpClosed {
+			l.tcpConnsLock.Unlock()
+			_ = conn.Close()
+			return
+		}
+		l.tcpConns[conn] = struct{}{}
+		l.tcpConnsLock.Unlock()
+
+		l.wg.Add(1)
+		go l.serveTCPConn(conn)
+	}
+}
+
+func (l *Listener) serveTCPConn(conn net.Conn) {
+	defer l.wg.Done()
+	defer func() {
+		l.tcpConnsLock.Lock()
+		delete(l.tcpConns, conn)
+		l.tcpConnsLock.Unlock()
+		_ = conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), MAX_UDP_PACKET_SIZE)
+	for scanner.Scan() {
+		atomic.AddUint64(&l.bytesReceived, uint64(len(scanner.Bytes())+1))
+		l.handleLine(scanner.Text())
+	}
+}
+
+func (l *Listener) handleLine(line string) {
+	sample, err := ParseLine(line)
+	if err != nil {
+		instrumentation.IncrementInt64Counter(instrumentation.STATSD_INVALID_LINES, 1)
+		log.Debugf("Listener.handleLine: invalid line %q, err=%v", line, err)
+		return
+	}
+	if sample != nil {
+		l.aggregator.Add(sample)
+	}
+}
+
+func (l *Listener) runFlushLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(l.cfg.FlushIntervalSecs) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.flush()
+		}
+	}
+}
+
+func (l *Listener) flush() {
+	aggregated := l.aggregator.Flush()
+	bytesReceived := atomic.SwapUint64(&l.bytesReceived, 0)
+	if len(aggregated) == 0 {
+		return
+	}
+	written := l.writeMetrics(aggregated, bytesReceived, uint32(time.Now().Unix()), l.cfg.OrgId)
+	instrumentation.IncrementInt64Counter(instrumentation.STATSD_FLUSHED_METRICS, int64(written))
+}
+
+// Writes the metrics with their tags as labels. The bytes received since the
+// last flush are spread over the datapoints for the ingestion stats.
+func writeAggregatedMetrics(aggregated []AggregatedMetric, bytesReceived uint64, ts uint32, myid int64) uint64 {
+	var successCount uint64 = 0
+	nBytes := bytesReceived / uint64(len(aggregated))
+	for _, metric := range aggregated {
+		tagHolder := metrics.GetTagsHolder()
+		for _, tag := range metric.Tags {
+			tagHolder.Insert(tag.Key, []byte(tag.Value), jsonparser.String)
+		}
+		err := metrics.EncodeDatapoint([]byte(metric.Name), tagHolder, metric.Value, ts, nBytes, myid)
+		if err != nil {
+			log.Errorf("writeAggregatedMetrics: failed to encode data for metric=%v, orgid=%v, err=%v", metric.Name, myid, err)
+			continue
+		}
+		successCount++
+	}
+	usageStats.UpdateMetricsStats(bytesReceived, successCount, myid)
+	return successCount
+}
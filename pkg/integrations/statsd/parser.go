@@ -0,0 +1,151 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type MetricType uint8
+
+const (
+	COUNTER MetricType = iota + 1
+	GAUGE
+	TIMER
+	HISTOGRAM
+	DISTRIBUTION
+	SET
+)
+
+var typeNames = map[string]MetricType{
+	"c":  COUNTER,
+	"g":  GAUGE,
+	"ms": TIMER,
+	"h":  HISTOGRAM,
+	"d":  DISTRIBUTION,
+	"s":  SET,
+}
+
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Sample is a single StatsD line. Sets only have SetValue, and every other
+// type has one or more Values.
+type Sample struct {
+	Name       string
+	Type       MetricType
+	Values     []float64
+	SetValue   string
+	GaugeDelta bool // the gauge value has a sign, so it is added to the current value
+	SampleRate float64
+	Tags       []Tag // sorted by key
+}
+
+/*
+Parses a StatsD or DogStatsD line:
+
+	name:value[:value...]|type[|@sample_rate][|#tag:value,tag...][|c:container][|T timestamp]
+
+Multiple values are a DogStatsD extension. Container ids and timestamps are
+ignored, since samples are aggregated per flush interval. Returns nil for empty
+lines and for DogStatsD events and service checks.
+*/
+func ParseLine(line string) (*Sample, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+		return nil, nil
+	}
+
+	sections := strings.Split(line, "|")
+	if len(sections) < 2 {
+		return nil, errors.New("missing metric type")
+	}
+	name, rawValue, found := strings.Cut(sections[0], ":")
+	if !found || name == "" || rawValue == "" {
+		return nil, fmt.Errorf("invalid metric %q", sections[0])
+	}
+	metricType, ok := typeNames[sections[1]]
+	if !ok {
+		return nil, fmt.Errorf("unknown metric type %q", sections[1])
+	}
+
+	sample := &Sample{Name: name, Type: metricType, SampleRate: 1}
+	for _, section := range sections[2:] {
+		if section == "" {
+			continue
+		}
+		switch section[0] {
+		case '@':
+			rate, err := strconv.ParseFloat(section[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid sample rate %q", section[1:])
+			}
+			sample.SampleRate = rate
+		case '#':
+			sample.Tags = parseTags(section[1:])
+		}
+	}
+
+	if metricType == SET {
+		sample.SetValue = rawValue
+		return sample, nil
+	}
+
+	for _, raw := range strings.Split(rawValue, ":") {
+		if raw == "" {
+			return nil, errors.New("empty value")
+		}
+		if metricType == GAUGE && (raw[0] == '+' || raw[0] == '-') {
+			sample.GaugeDelta = true
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("invalid value %q", raw)
+		}
+		sample.Values = append(sample.Values, value)
+	}
+	return sample, nil
+}
+
+// Parses comma separated tags, where a tag without a value gets an empty one.
+// When a key is repeated, the last value is kept.
+func parseTags(raw string) []Tag {
+	tagMap := make(map[string]string)
+	for _, tag := range strings.Split(raw, ",") {
+		key, value, _ := strings.Cut(tag, ":")
+		if key != "" {
+			tagMap[key] = value
+		}
+	}
+
+	tags := make([]Tag, 0, len(tagMap))
+	for key, value := range tagMap {
+		tags = append(tags, Tag{Key: key, Value: value})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Key < tags[j].Key
+	})
+	return tags
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package statsd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/siglens/siglens/pkg/config/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseLine(t *testing.T) {
+	sample, err := ParseLine("api.requests:2|c|@0.5|#env:prod,region:us,canary")
+	assert.Nil(t, err)
+	assert.Equal(t, &Sample{
+		Name:       "api.requests",
+		Type:       COUNTER,
+		Values:     []float64{2},
+		SampleRate: 0.5,
+		Tags:       []Tag{{Key: "canary"}, {Key: "env", Value: "prod"}, {Key: "region", Value: "us"}},
+	}, sample)
+
+	sample, err = ParseLine("latency:1.5:2.5:3|d|#env:prod|c:abc123|T1700000000")
+	assert.Nil(t, err)
+	assert.Equal(t, DISTRIBUTION, sample.Type)
+	assert.Equal(t, []float64{1.5, 2.5, 3}, sample.Values)
+	assert.Equal(t, []Tag{{Key: "env", Value: "prod"}}, sample.Tags)
+
+	sample, err = ParseLine("queue.size:-3|g")
+	assert.Nil(t, err)
+	assert.True(t, sample.GaugeDelta)
+	assert.Equal(t, []float64{-3}, sample.Values)
+
+	sample, err = ParseLine("users:user-1:a|s")
+	assert.Nil(t, err)
+	assert.Equal(t, "user-1:a", sample.SetValue)
+	assert.Nil(t, sample.Values)
+
+	for _, skipped := range []string{"", "  ", "_e{5,4}:title|text", "_sc|redis|0"} {
+		sample, err = ParseLine(skipped)
+		assert.Nil(t, err)
+		assert.Nil(t, sample)
+	}
+
+	for _, invalid := range []string{"a", "a:1", "a|c", ":1|c", "a:|c", "a:1|x", "a:x|c", "a:1::2|ms", "a:1|c|@0", "a:1|c|@2"} {
+		_, err = ParseLine(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+// Returns the value of every metric by its name and tags.
+func getMetricValues(aggregated []AggregatedMetric) map[string]float64 {
+	values := make(map[string]float64, len(aggregated))
+	for _, metric := range aggregated {
+		tags := make([]string, 0, len(metric.Tags))
+		for _, tag := range metric.Tags {
+			tags = append(tags, tag.Key+"="+tag.Value)
+		}
+		values[metric.Name+"{"+strings.Join(tags, ",")+"}"] = metric.Value
+	}
+	return values
+}
+
+func addLines(t *testing.T, aggregator *Aggregator, lines ...string) {
+	for _, line := range lines {
+		sample, err := ParseLine(line)
+		assert.Nil(t, err)
+		aggregator.Add(sample)
+	}
+}
+
+func Test_AggregatorFlush(t *testing.T) {
+	aggregator := NewAggregator([]float64{50, 99.9}, time.Minute)
+	addLines(t, aggregator,
+		"hits:1|c|#page:home",
+		"hits:2|c|@0.5|#page:home",
+		"hits:1|c|#page:about",
+		"temp:20|g",
+		"temp:+5|g",
+		"users:a|s",
+		"users:b|s",
+		"users:a|s",
+	)
+	for i := 1; i <= 10; i++ {
+		addLines(t, aggregator, fmt.Sprintf("db.query:%v|ms", i*10))
+	}
+	addLines(t, aggregator, "db.query:1000|ms|@0.1")
+
+	assert.Equal(t, map[string]float64{
+		"hits{page=home}":  5,
+		"hits{page=about}": 1,
+		"temp{}":           25,
+		"users{}":          2,
+		"db.query_count{}": 20,
+		"db.query_sum{}":   10550,
+		"db.query_min{}":   10,
+		"db.query_max{}":   1000,
+		"db.query_avg{}":   527.5,
+		"db.query_p50{}":   60,
+		"db.query_p99_9{}": 1000,
+	}, getMetricValues(aggregator.Flush()))
+
+	// only the gauges are written again
+	assert.Equal(t, map[string]float64{"temp{}": 25}, getMetricValues(aggregator.Flush()))
+
+	// until they are idle for longer than the TTL
+	aggregator.gauges[getSeriesKey("temp", nil)].lastUpdated = time.Now().Add(-2 * time.Minute)
+	assert.Empty(t, aggregator.Flush())
+	assert.Empty(t, aggregator.gauges)
+}
+
+type capturedMetrics struct {
+	lock       sync.Mutex
+	aggregated []AggregatedMetric
+	nBytes     uint64
+}
+
+func (cm *capturedMetrics) write(aggregated []AggregatedMetric, bytesReceived uint64, ts uint32, myid int64) uint64 {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	cm.aggregated = append(cm.aggregated, aggregated...)
+	cm.nBytes += bytesReceived
+	return uint64(len(aggregated))
+}
+
+func Test_Listener(t *testing.T) {
+	captured := &capturedMetrics{}
+	listener, err := startListener(common.StatsdConfig{
+		UDPAddress:        "127.0.0.1:0",
+		TCPAddress:        "127.0.0.1:0",
+		FlushIntervalSecs: 3600,
+		GaugeTTLSecs:      3600,
+	}, captured.write)
+	assert.Nil(t, err)
+
+	udpConn, err := net.Dial("udp", listener.udpConn.LocalAddr().String())
+	assert.Nil(t, err)
+	_, err = udpConn.Write([]byte("jobs:1|c\njobs:2|c\nbad line"))
+	assert.Nil(t, err)
+	assert.Nil(t, udpConn.Close())
+
+	tcpConn, err := net.Dial("tcp", listener.tcpLn.Addr().String())
+	assert.Nil(t, err)
+	_, err = tcpConn.Write([]byte("jobs:4|c\nworkers:3|g\n"))
+	assert.Nil(t, err)
+
+	// wait until every line is aggregated
+	assert.Eventually(t, func() bool {
+		listener.aggregator.lock.Lock()
+		defer listener.aggregator.lock.Unlock()
+		jobs, ok := listener.aggregator.counters[getSeriesKey("jobs", nil)]
+		return ok && jobs.value == 7 && len(listener.aggregator.gauges) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// stopping flushes the remaining metrics, and closes the open connection
+	listener.stopAndFlush()
+	aggregated := captured.aggregated
+	sort.Slice(aggregated, func(i, j int) bool {
+		return aggregated[i].Name < aggregated[j].Name
+	})
+	assert.Equal(t, []AggregatedMetric{{Name: "jobs", Value: 7}, {Name: "workers", Value: 3}}, aggregated)
+	assert.Equal(t, uint64(len("jobs:1|c\njobs:2|c\nbad line")+len("jobs:4|c\nworkers:3|g\n")), captured.nBytes)
+	assert.Nil(t, tcpConn.Close())
+}
@@ -18,14 +18,19 @@
 package otlp
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"regexp"
 	"strconv"
 
+	"github.com/buger/jsonparser"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/siglens/siglens/pkg/grpc"
 	"github.com/siglens/siglens/pkg/hooks"
 	. "github.com/siglens/siglens/pkg/segment/utils"
 	"github.com/siglens/siglens/pkg/segment/writer"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/histogram"
 	"github.com/siglens/siglens/pkg/usageStats"
 	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
@@ -40,6 +45,8 @@ type processedMetric struct {
 	Attributes   map[string]string
 	TimeUnixNano uint64
 	Value        uint64
+	Histogram    *histogram.Histogram // set for exponential histograms instead of Value
+	Exemplars    []*metricspb.Exemplar
 }
 
 func ProcessMetricsIngest(ctx *fasthttp.RequestCtx, myid int64) {
@@ -79,9 +86,19 @@ func ingestMetrics(request *collmetricspb.ExportMetricsServiceRequest, myid int6
 		for _, scopeMetrics := range resourceMetrics.ScopeMetrics {
 
 			for _, metrics := range scopeMetrics.Metrics {
+				updateMetricMetadata(metrics, myid)
 				extractedMetrics := processMetric(metrics)
 				for _, metric := range extractedMetrics {
 					dpCount++
+					addExemplars(metric, myid)
+					if metric.Histogram != nil {
+						err := encodeHistogramMetric(metric, myid)
+						if err != nil {
+							numFailedDps++
+							log.Errorf("OLTPMetrics: failed to encode histogram for metric=%v, err=%v", metric.Name, err)
+						}
+						continue
+					}
 					data, err := ConvertToOTLPMetricsFormat(metric, int64(metric.TimeUnixNano), float64(metric.Value))
 					if err != nil {
 						numFailedDps++
@@ -157,6 +174,7 @@ func processMetric(metric *metricspb.Metric) []processedMetric {
 				Attributes:   extractAttributes(dataPoint.Attributes),
 				TimeUnixNano: dataPoint.TimeUnixNano,
 				Value:        uint64(dataPoint.GetAsDouble()),
+				Exemplars:    dataPoint.Exemplars,
 			})
 		}
 		return extracted
@@ -169,6 +187,7 @@ func processMetric(metric *metricspb.Metric) []processedMetric {
 				Attributes:   extractAttributes(dataPoint.Attributes),
 				TimeUnixNano: dataPoint.TimeUnixNano,
 				Value:        uint64(dataPoint.GetAsDouble()),
+				Exemplars:    dataPoint.Exemplars,
 			})
 		}
 		return extracted
@@ -182,6 +201,7 @@ func processMetric(metric *metricspb.Metric) []processedMetric {
 				Attributes:   extractAttributes(dataPoint.Attributes),
 				TimeUnixNano: dataPoint.TimeUnixNano,
 				Value:        dataPoint.Count,
+				Exemplars:    dataPoint.Exemplars,
 			})
 		}
 		return extracted
@@ -194,7 +214,8 @@ func processMetric(metric *metricspb.Metric) []processedMetric {
 				Name:         metric.Name,
 				Attributes:   extractAttributes(dataPoint.Attributes),
 				TimeUnixNano: dataPoint.TimeUnixNano,
-				Value:        uint64(dataPoint.Scale),
+				Histogram:    convertExponentialHistogram(dataPoint),
+				Exemplars:    dataPoint.Exemplars,
 			})
 		}
 		return extracted
@@ -216,6 +237,111 @@ func processMetric(metric *metricspb.Metric) []processedMetric {
 	return extracted
 }
 
+// Records the description and unit of the metric as its HELP and UNIT, along
+// with the Prometheus type of its data.
+func updateMetricMetadata(metric *metricspb.Metric, myid int64) {
+	var metricType string
+	switch data := metric.Data.(type) {
+	case *metricspb.Metric_Gauge:
+		metricType = "gauge"
+	case *metricspb.Metric_Sum:
+		metricType = "gauge"
+		if data.Sum.GetIsMonotonic() {
+			metricType = "counter"
+		}
+	case *metricspb.Metric_Histogram, *metricspb.Metric_ExponentialHistogram:
+		metricType = "histogram"
+	case *metricspb.Metric_Summary:
+		metricType = "summary"
+	default:
+		metricType = "unknown"
+	}
+
+	mName := regexp.MustCompile(`[^a-zA-Z0-9_]`).ReplaceAllString(metric.Name, "_")
+	metrics.UpdateMetricMetadata(myid, mName, metrics.MetricMetadata{
+		Type: metricType,
+		Help: metric.Description,
+		Unit: metric.Unit,
+	})
+}
+
+// Stores the exemplars of a datapoint. The trace and span ids become the
+// trace_id and span_id labels of the exemplar.
+func addExemplars(metric processedMetric, myid int64) {
+	if len(metric.Exemplars) == 0 {
+		return
+	}
+
+	tagsHolder := metrics.GetTagsHolder()
+	for key, val := range metric.Attributes {
+		tagsHolder.Insert(key, []byte(val), jsonparser.String)
+	}
+	mName := regexp.MustCompile(`[^a-zA-Z0-9_]`).ReplaceAllString(metric.Name, "_")
+
+	for _, exemplar := range metric.Exemplars {
+		exemplarLabels := extractAttributes(exemplar.FilteredAttributes)
+		if len(exemplar.TraceId) > 0 {
+			exemplarLabels["trace_id"] = hex.EncodeToString(exemplar.TraceId)
+		}
+		if len(exemplar.SpanId) > 0 {
+			exemplarLabels["span_id"] = hex.EncodeToString(exemplar.SpanId)
+		}
+
+		value := exemplar.GetAsDouble()
+		if _, ok := exemplar.Value.(*metricspb.Exemplar_AsInt); ok {
+			value = float64(exemplar.GetAsInt())
+		}
+
+		err := metrics.AddExemplar([]byte(mName), tagsHolder, metrics.Exemplar{
+			Labels:    labels.FromMap(exemplarLabels),
+			Value:     value,
+			Timestamp: int64(exemplar.TimeUnixNano / 1_000_000),
+		}, myid)
+		if err != nil {
+			log.Debugf("addExemplars: failed to add exemplar for metric=%v, err=%v", mName, err)
+		}
+	}
+}
+
+/*
+Converts an OTLP exponential histogram to a native histogram.
+
+The scale of OTLP is the schema of Prometheus, but OTLP bucket k covers
+(base^k, base^(k+1)] while Prometheus bucket k covers (base^(k-1), base^k], so
+every index is shifted by one.
+*/
+func convertExponentialHistogram(dataPoint *metricspb.ExponentialHistogramDataPoint) *histogram.Histogram {
+	h := &histogram.Histogram{
+		ZeroThreshold: dataPoint.GetZeroThreshold(),
+		ZeroCount:     float64(dataPoint.GetZeroCount()),
+		Count:         float64(dataPoint.GetCount()),
+		Sum:           dataPoint.GetSum(),
+	}
+	h.SetBuckets(dataPoint.GetScale(), getExponentialBuckets(dataPoint.GetPositive()), getExponentialBuckets(dataPoint.GetNegative()))
+	return h
+}
+
+func getExponentialBuckets(buckets *metricspb.ExponentialHistogramDataPoint_Buckets) map[int32]float64 {
+	bucketMap := make(map[int32]float64)
+	if buckets == nil {
+		return bucketMap
+	}
+	for i, count := range buckets.GetBucketCounts() {
+		bucketMap[buckets.GetOffset()+int32(i)+1] = float64(count)
+	}
+	return bucketMap
+}
+
+func encodeHistogramMetric(metric processedMetric, myid int64) error {
+	tagsHolder := metrics.GetTagsHolder()
+	for key, val := range metric.Attributes {
+		tagsHolder.Insert(key, []byte(val), jsonparser.String)
+	}
+	mName := regexp.MustCompile(`[^a-zA-Z0-9_]`).ReplaceAllString(metric.Name, "_")
+	ts := uint32(metric.TimeUnixNano / 1_000_000_000)
+	return metrics.EncodeHistogramDatapoint([]byte(mName), tagsHolder, metric.Histogram, ts, uint64(len(mName)), myid)
+}
+
 func ConvertToOTLPMetricsFormat(data processedMetric, timestamp int64, value float64) ([]byte, error) {
 	type Metric struct {
 		Name      string            `json:"metric"`
@@ -3,6 +3,9 @@ package otlp
 import (
 	"testing"
 
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/histogram"
 	"github.com/siglens/siglens/pkg/utils"
 	"github.com/siglens/siglens/pkg/virtualtable"
 	"github.com/stretchr/testify/assert"
@@ -150,3 +153,87 @@ func TestProcessMetricsIngestWithSpecialSymbol(t *testing.T) {
 	assert.GreaterOrEqual(t, numFailedRecords, 0, "numFailedRecords should be = 0")
 
 }
+
+func Test_convertExponentialHistogram(t *testing.T) {
+	sum := 30.0
+	dataPoint := &metricspb.ExponentialHistogramDataPoint{
+		Count:         12,
+		Sum:           &sum,
+		Scale:         0,
+		ZeroCount:     2,
+		ZeroThreshold: 0.001,
+		// OTLP buckets (1, 2] and (2, 4] are Prometheus buckets 1 and 2
+		Positive: &metricspb.ExponentialHistogramDataPoint_Buckets{Offset: 0, BucketCounts: []uint64{4, 6}},
+		Negative: &metricspb.ExponentialHistogramDataPoint_Buckets{Offset: -1, BucketCounts: []uint64{0}},
+	}
+
+	h := convertExponentialHistogram(dataPoint)
+	assert.Nil(t, h.Validate())
+	assert.Equal(t, float64(12), h.Count)
+	assert.Equal(t, float64(30), h.Sum)
+	assert.Equal(t, float64(2), h.ZeroCount)
+	assert.Equal(t, []histogram.Span{{Offset: 1, Length: 2}}, h.PositiveSpans)
+	assert.Equal(t, []float64{4, 6}, h.PositiveBuckets)
+	assert.Empty(t, h.NegativeBuckets)
+	assert.Equal(t, float64(2), h.Quantile(0.5))
+
+	metrics := processMetric(&metricspb.Metric{
+		Name: "latency",
+		Data: &metricspb.Metric_ExponentialHistogram{
+			ExponentialHistogram: &metricspb.ExponentialHistogram{DataPoints: []*metricspb.ExponentialHistogramDataPoint{dataPoint}},
+		},
+	})
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, h, metrics[0].Histogram)
+}
+
+func Test_MetricMetadataAndExemplars(t *testing.T) {
+	metrics.ResetMetricsSegStore_TestOnly()
+	t.Cleanup(metrics.ResetMetricsSegStore_TestOnly)
+
+	metric := &metricspb.Metric{
+		Name:        "http.server.duration",
+		Description: "Duration of the requests.",
+		Unit:        "ms",
+		Data: &metricspb.Metric_Sum{
+			Sum: &metricspb.Sum{
+				IsMonotonic: true,
+				DataPoints: []*metricspb.NumberDataPoint{
+					{
+						TimeUnixNano: 1740390270409000000,
+						Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: 12},
+						Attributes: []*commonpb.KeyValue{
+							{Key: "route", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "/api"}}},
+						},
+						Exemplars: []*metricspb.Exemplar{
+							{
+								TimeUnixNano: 1740390270000000000,
+								Value:        &metricspb.Exemplar_AsInt{AsInt: 42},
+								TraceId:      []byte{0x01, 0x02, 0x03, 0x04},
+								SpanId:       []byte{0x0a, 0x0b},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	updateMetricMetadata(metric, 0)
+	assert.Equal(t, map[string][]metrics.MetricMetadata{
+		"http_server_duration": {{Type: "counter", Help: "Duration of the requests.", Unit: "ms"}},
+	}, metrics.GetMetricMetadata(0, "", -1, -1))
+
+	for _, processed := range processMetric(metric) {
+		addExemplars(processed, 0)
+	}
+	matchers := [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "__name__", "http_server_duration")}}
+	result := metrics.QueryExemplars(0, 0, 1740390271000, matchers)
+	assert.Len(t, result, 1)
+	assert.Equal(t, labels.FromStrings("__name__", "http_server_duration", "route", "/api"), result[0].SeriesLabels)
+	assert.Equal(t, []metrics.Exemplar{{
+		Labels:    labels.FromStrings("span_id", "0a0b", "trace_id", "01020304"),
+		Value:     42,
+		Timestamp: 1740390270000,
+	}}, result[0].Exemplars)
+}
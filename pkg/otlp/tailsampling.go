@@ -0,0 +1,376 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package otlp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/config/common"
+	"github.com/siglens/siglens/pkg/instrumentation"
+	"github.com/siglens/siglens/pkg/segment/tracing/depgraph"
+	log "github.com/sirupsen/logrus"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+const (
+	POLICY_STATUS_CODE   = "status_code"
+	POLICY_LATENCY       = "latency"
+	POLICY_ATTRIBUTE     = "attribute"
+	POLICY_PROBABILISTIC = "probabilistic"
+)
+
+// How many decision windows a keep/drop decision is remembered for, so that
+// spans arriving after the decision follow it instead of starting a new trace.
+const decisionCacheWindows = 6
+
+type sampledSpan struct {
+	service    string
+	isError    bool
+	startNs    uint64
+	endNs      uint64
+	attributes map[string]string
+	jsonData   []byte
+	depInfo    *depgraph.SpanInfo
+}
+
+type traceKey struct {
+	myid    int64
+	traceId string
+}
+
+type traceBuffer struct {
+	arrivedAt time.Time
+	spans     []*sampledSpan
+}
+
+type cachedDecision struct {
+	keep      bool
+	decidedAt time.Time
+}
+
+// TailSampler buffers spans per trace for a decision window and then keeps or
+// drops each trace as a whole according to the configured policies.
+type TailSampler struct {
+	mu           sync.Mutex
+	decisionWait time.Duration
+	maxTraces    int
+	policies     []common.TailSamplingPolicy
+	traces       map[traceKey]*traceBuffer
+	arrivalOrder []traceKey
+	decisions    map[traceKey]cachedDecision
+
+	// Called with the spans of every kept trace.
+	ingestFn func(myid int64, spans []*sampledSpan)
+}
+
+var globalTailSampler *TailSampler
+var tailSamplerInitOnce sync.Once
+
+func NewTailSampler(tsConfig common.TailSamplingConfig, ingestFn func(int64, []*sampledSpan)) *TailSampler {
+	return &TailSampler{
+		decisionWait: time.Duration(tsConfig.DecisionWaitSecs) * time.Second,
+		maxTraces:    int(tsConfig.MaxBufferedTraces),
+		policies:     tsConfig.Policies,
+		traces:       make(map[traceKey]*traceBuffer),
+		arrivalOrder: make([]traceKey, 0),
+		decisions:    make(map[traceKey]cachedDecision),
+		ingestFn:     ingestFn,
+	}
+}
+
+// Returns the process wide tail sampler, or nil if tail sampling is disabled.
+func getTailSampler() *TailSampler {
+	if !config.IsTailSamplingEnabled() {
+		return nil
+	}
+
+	tailSamplerInitOnce.Do(func() {
+		tsConfig := config.GetTailSamplingConfig()
+		globalTailSampler = NewTailSampler(tsConfig, func(myid int64, spans []*sampledSpan) {
+			spanJsons := make([][]byte, len(spans))
+			depInfos := make([]*depgraph.SpanInfo, len(spans))
+			for i, span := range spans {
+				spanJsons[i] = span.jsonData
+				depInfos[i] = span.depInfo
+			}
+
+			numFailed := ingestSpanJsons(myid, spanJsons)
+			if numFailed > 0 {
+				log.Errorf("TailSampler: failed to ingest %v of %v sampled spans for myid=%v", numFailed, len(spanJsons), myid)
+			}
+			depgraph.RecordSpans(myid, depInfos)
+		})
+		go globalTailSampler.runDecisionLoop()
+		log.Infof("getTailSampler: tail sampling enabled with decisionWait=%vs and %v policies",
+			tsConfig.DecisionWaitSecs, len(tsConfig.Policies))
+	})
+
+	return globalTailSampler
+}
+
+// Decides every buffered trace immediately. Used on shutdown.
+func FlushTailSampler() {
+	if globalTailSampler == nil {
+		return
+	}
+	globalTailSampler.decideAll()
+}
+
+func newSampledSpan(span *tracepb.Span, service string, jsonData []byte, depInfo *depgraph.SpanInfo) *sampledSpan {
+	attributes := make(map[string]string, len(span.Attributes))
+	for _, keyvalue := range span.Attributes {
+		key, value, err := extractKeyValue(keyvalue)
+		if err != nil {
+			continue
+		}
+		attributes[key] = fmt.Sprintf("%v", value)
+	}
+
+	return &sampledSpan{
+		service:    service,
+		isError:    span.Status != nil && span.Status.Code == tracepb.Status_STATUS_CODE_ERROR,
+		startNs:    span.StartTimeUnixNano,
+		endNs:      span.EndTimeUnixNano,
+		attributes: attributes,
+		jsonData:   jsonData,
+		depInfo:    depInfo,
+	}
+}
+
+// Buffers the span until its trace is decided. Returns true if the trace was
+// already kept, in which case the span is not buffered and the caller should
+// ingest it along with the rest of its request.
+func (ts *TailSampler) AddSpan(myid int64, traceId string, span *sampledSpan) bool {
+	key := traceKey{myid: myid, traceId: traceId}
+
+	ts.mu.Lock()
+	if decision, ok := ts.decisions[key]; ok {
+		ts.mu.Unlock()
+		if decision.keep {
+			instrumentation.IncrementInt64Counter(instrumentation.TAIL_SAMPLING_KEPT_SPANS, 1)
+		} else {
+			instrumentation.IncrementInt64Counter(instrumentation.TAIL_SAMPLING_DROPPED_SPANS, 1)
+		}
+		return decision.keep
+	}
+
+	buffer, ok := ts.traces[key]
+	if !ok {
+		buffer = &traceBuffer{arrivedAt: time.Now(), spans: make([]*sampledSpan, 0, 1)}
+		ts.traces[key] = buffer
+		ts.arrivalOrder = append(ts.arrivalOrder, key)
+	}
+	buffer.spans = append(buffer.spans, span)
+
+	var overflow map[traceKey]*traceBuffer
+	if ts.maxTraces > 0 && len(ts.traces) > ts.maxTraces {
+		overflow = ts.popOldestLocked(len(ts.traces)-ts.maxTraces, time.Time{})
+	}
+	instrumentation.SetTailSamplingBufferedTraces(int64(len(ts.traces)))
+	ts.mu.Unlock()
+
+	ts.decide(overflow)
+	return false
+}
+
+// Removes and returns up to count traces from the front of the arrival
+// queue. If cutoff is non-zero, only traces that arrived before it are popped.
+// The caller must hold ts.mu.
+func (ts *TailSampler) popOldestLocked(count int, cutoff time.Time) map[traceKey]*traceBuffer {
+	popped := make(map[traceKey]*traceBuffer)
+	numRemoved := 0
+	for _, key := range ts.arrivalOrder {
+		if len(popped) >= count {
+			break
+		}
+		buffer, ok := ts.traces[key]
+		if ok && !cutoff.IsZero() && !buffer.arrivedAt.Before(cutoff) {
+			break
+		}
+		numRemoved++
+		if !ok {
+			continue
+		}
+		popped[key] = buffer
+		delete(ts.traces, key)
+	}
+	ts.arrivalOrder = ts.arrivalOrder[numRemoved:]
+	instrumentation.SetTailSamplingBufferedTraces(int64(len(ts.traces)))
+
+	return popped
+}
+
+func (ts *TailSampler) runDecisionLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		ts.decideExpired(time.Now())
+	}
+}
+
+func (ts *TailSampler) decideExpired(now time.Time) {
+	ts.mu.Lock()
+	expired := ts.popOldestLocked(len(ts.traces), now.Add(-ts.decisionWait))
+	for key, decision := range ts.decisions {
+		if now.Sub(decision.decidedAt) > decisionCacheWindows*ts.decisionWait {
+			delete(ts.decisions, key)
+		}
+	}
+	ts.mu.Unlock()
+
+	ts.decide(expired)
+}
+
+func (ts *TailSampler) decideAll() {
+	ts.mu.Lock()
+	all := ts.popOldestLocked(len(ts.traces), time.Time{})
+	ts.mu.Unlock()
+
+	ts.decide(all)
+}
+
+func (ts *TailSampler) decide(traces map[traceKey]*traceBuffer) {
+	if len(traces) == 0 {
+		return
+	}
+
+	now := time.Now()
+	keptByOrg := make(map[int64][]*sampledSpan)
+	decisions := make(map[traceKey]cachedDecision, len(traces))
+	for key, buffer := range traces {
+		keep := ts.shouldKeep(key.traceId, buffer.spans)
+		decisions[key] = cachedDecision{keep: keep, decidedAt: now}
+		if !keep {
+			instrumentation.IncrementInt64Counter(instrumentation.TAIL_SAMPLING_DROPPED_TRACES, 1)
+			instrumentation.IncrementInt64Counter(instrumentation.TAIL_SAMPLING_DROPPED_SPANS, int64(len(buffer.spans)))
+			continue
+		}
+
+		instrumentation.IncrementInt64Counter(instrumentation.TAIL_SAMPLING_KEPT_TRACES, 1)
+		instrumentation.IncrementInt64Counter(instrumentation.TAIL_SAMPLING_KEPT_SPANS, int64(len(buffer.spans)))
+		keptByOrg[key.myid] = append(keptByOrg[key.myid], buffer.spans...)
+	}
+
+	ts.mu.Lock()
+	for key, decision := range decisions {
+		ts.decisions[key] = decision
+	}
+	ts.mu.Unlock()
+
+	for myid, spans := range keptByOrg {
+		ts.ingestFn(myid, spans)
+	}
+}
+
+func (ts *TailSampler) shouldKeep(traceId string, spans []*sampledSpan) bool {
+	for _, policy := range ts.policies {
+		if policyMatches(&policy, traceId, spans) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func policyMatches(policy *common.TailSamplingPolicy, traceId string, spans []*sampledSpan) bool {
+	switch policy.Type {
+	case POLICY_STATUS_CODE:
+		for _, span := range spans {
+			if span.isError {
+				return true
+			}
+		}
+		return false
+	case POLICY_LATENCY:
+		return getTraceDurationNs(spans) >= policy.LatencyThresholdMs*uint64(time.Millisecond)
+	case POLICY_ATTRIBUTE:
+		for _, span := range spans {
+			value, ok := span.attributes[policy.AttributeKey]
+			if !ok {
+				continue
+			}
+			if len(policy.AttributeValues) == 0 {
+				return true
+			}
+			for _, wanted := range policy.AttributeValues {
+				if value == wanted {
+					return true
+				}
+			}
+		}
+		return false
+	case POLICY_PROBABILISTIC:
+		if policy.Service != "" && !traceHasService(spans, policy.Service) {
+			return false
+		}
+		return isTraceIdSampled(traceId, policy.SamplingPercentage)
+	default:
+		log.Errorf("policyMatches: unknown tail sampling policy type %v in policy %v", policy.Type, policy.Name)
+		return false
+	}
+}
+
+// The trace duration is measured from the earliest span start to the latest
+// span end among the spans buffered for it.
+func getTraceDurationNs(spans []*sampledSpan) uint64 {
+	if len(spans) == 0 {
+		return 0
+	}
+
+	minStart, maxEnd := spans[0].startNs, spans[0].endNs
+	for _, span := range spans[1:] {
+		if span.startNs < minStart {
+			minStart = span.startNs
+		}
+		if span.endNs > maxEnd {
+			maxEnd = span.endNs
+		}
+	}
+	if maxEnd < minStart {
+		return 0
+	}
+
+	return maxEnd - minStart
+}
+
+func traceHasService(spans []*sampledSpan, service string) bool {
+	for _, span := range spans {
+		if span.service == service {
+			return true
+		}
+	}
+	return false
+}
+
+// Hashing the trace id makes the decision deterministic, so every node that
+// sees part of a trace makes the same choice.
+func isTraceIdSampled(traceId string, percentage float64) bool {
+	if percentage <= 0 {
+		return false
+	}
+	if percentage >= 100 {
+		return true
+	}
+
+	bucket := xxhash.Sum64String(traceId) % 10_000
+	return float64(bucket) < percentage*100
+}
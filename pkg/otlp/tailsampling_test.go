@@ -0,0 +1,141 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package otlp
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/siglens/siglens/pkg/config/common"
+	"github.com/stretchr/testify/assert"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+type capturedIngest struct {
+	mu    sync.Mutex
+	spans map[int64][][]byte
+}
+
+func (c *capturedIngest) ingest(myid int64, spans []*sampledSpan) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, span := range spans {
+		c.spans[myid] = append(c.spans[myid], span.jsonData)
+	}
+}
+
+func newTestSampler(policies []common.TailSamplingPolicy, maxTraces uint64) (*TailSampler, *capturedIngest) {
+	captured := &capturedIngest{spans: make(map[int64][][]byte)}
+	tsConfig := common.TailSamplingConfig{
+		Enabled:           true,
+		DecisionWaitSecs:  10,
+		MaxBufferedTraces: maxTraces,
+		Policies:          policies,
+	}
+	return NewTailSampler(tsConfig, captured.ingest), captured
+}
+
+func makeTestSpan(isError bool, durationMs uint64, attrs map[string]string) *tracepb.Span {
+	span := &tracepb.Span{
+		StartTimeUnixNano: 1_000_000_000,
+		EndTimeUnixNano:   1_000_000_000 + durationMs*uint64(time.Millisecond),
+	}
+	if isError {
+		span.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR}
+	}
+	for key, value := range attrs {
+		span.Attributes = append(span.Attributes, &commonpb.KeyValue{
+			Key:   key,
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+		})
+	}
+	return span
+}
+
+func Test_TailSampling_Policies(t *testing.T) {
+	sampler, captured := newTestSampler([]common.TailSamplingPolicy{
+		{Name: "errors", Type: POLICY_STATUS_CODE},
+		{Name: "slow", Type: POLICY_LATENCY, LatencyThresholdMs: 500},
+		{Name: "vip", Type: POLICY_ATTRIBUTE, AttributeKey: "tier", AttributeValues: []string{"gold"}},
+	}, 0)
+
+	sampler.AddSpan(0, "error-trace", newSampledSpan(makeTestSpan(false, 10, nil), "svc", []byte("e1"), nil))
+	sampler.AddSpan(0, "error-trace", newSampledSpan(makeTestSpan(true, 10, nil), "svc", []byte("e2"), nil))
+	sampler.AddSpan(0, "slow-trace", newSampledSpan(makeTestSpan(false, 900, nil), "svc", []byte("s1"), nil))
+	sampler.AddSpan(0, "vip-trace", newSampledSpan(makeTestSpan(false, 10, map[string]string{"tier": "gold"}), "svc", []byte("v1"), nil))
+	sampler.AddSpan(0, "silver-trace", newSampledSpan(makeTestSpan(false, 10, map[string]string{"tier": "silver"}), "svc", []byte("x1"), nil))
+	sampler.AddSpan(0, "boring-trace", newSampledSpan(makeTestSpan(false, 10, nil), "svc", []byte("b1"), nil))
+
+	// Nothing is decided before the window expires.
+	sampler.decideExpired(time.Now())
+	assert.Empty(t, captured.spans)
+	assert.Len(t, sampler.traces, 5)
+
+	sampler.decideExpired(time.Now().Add(11 * time.Second))
+	assert.ElementsMatch(t, [][]byte{[]byte("e1"), []byte("e2"), []byte("s1"), []byte("v1")}, captured.spans[0])
+	assert.Empty(t, sampler.traces)
+
+	// Late spans follow the earlier decision and are left to the caller to
+	// ingest with the rest of their request.
+	assert.True(t, sampler.AddSpan(0, "error-trace", newSampledSpan(makeTestSpan(false, 10, nil), "svc", []byte("e3"), nil)))
+	assert.False(t, sampler.AddSpan(0, "boring-trace", newSampledSpan(makeTestSpan(false, 10, nil), "svc", []byte("b2"), nil)))
+	assert.Len(t, captured.spans[0], 4)
+	assert.Empty(t, sampler.traces)
+}
+
+func Test_TailSampling_Probabilistic(t *testing.T) {
+	sampler, captured := newTestSampler([]common.TailSamplingPolicy{
+		{Name: "checkout", Type: POLICY_PROBABILISTIC, Service: "checkout", SamplingPercentage: 25},
+	}, 0)
+
+	numTraces := 4000
+	for i := 0; i < numTraces; i++ {
+		traceId := fmt.Sprintf("trace-%d", i)
+		sampler.AddSpan(1, traceId, newSampledSpan(makeTestSpan(false, 1, nil), "checkout", []byte(traceId), nil))
+		sampler.AddSpan(1, "other-"+traceId, newSampledSpan(makeTestSpan(false, 1, nil), "cart", []byte(traceId), nil))
+	}
+	sampler.decideAll()
+
+	// Only checkout traces are eligible and roughly a quarter of them are kept.
+	numKept := len(captured.spans[1])
+	assert.Greater(t, numKept, numTraces/5)
+	assert.Less(t, numKept, numTraces*3/10)
+
+	// The decision for a trace id is deterministic.
+	assert.Equal(t, isTraceIdSampled("abc", 25), isTraceIdSampled("abc", 25))
+	assert.True(t, isTraceIdSampled("abc", 100))
+	assert.False(t, isTraceIdSampled("abc", 0))
+}
+
+func Test_TailSampling_MaxBufferedTraces(t *testing.T) {
+	sampler, captured := newTestSampler([]common.TailSamplingPolicy{
+		{Name: "errors", Type: POLICY_STATUS_CODE},
+	}, 2)
+
+	sampler.AddSpan(0, "t1", newSampledSpan(makeTestSpan(true, 1, nil), "svc", []byte("t1"), nil))
+	sampler.AddSpan(0, "t2", newSampledSpan(makeTestSpan(true, 1, nil), "svc", []byte("t2"), nil))
+	assert.Empty(t, captured.spans)
+
+	// The oldest trace is decided early to stay within the limit.
+	sampler.AddSpan(0, "t3", newSampledSpan(makeTestSpan(true, 1, nil), "svc", []byte("t3"), nil))
+	assert.Equal(t, [][]byte{[]byte("t1")}, captured.spans[0])
+	assert.Len(t, sampler.traces, 2)
+}
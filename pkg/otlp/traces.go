@@ -26,6 +26,7 @@ import (
 	"github.com/siglens/siglens/pkg/es/writer"
 	"github.com/siglens/siglens/pkg/grpc"
 	"github.com/siglens/siglens/pkg/hooks"
+	"github.com/siglens/siglens/pkg/segment/tracing/depgraph"
 	segwriter "github.com/siglens/siglens/pkg/segment/writer"
 	"github.com/siglens/siglens/pkg/usageStats"
 	"github.com/siglens/siglens/pkg/utils"
@@ -59,22 +60,12 @@ func ProcessTraceIngest(ctx *fasthttp.RequestCtx, myid int64) {
 		return
 	}
 
-	// Setup ingestion parameters.
-	now := utils.GetCurrentTimeInMs()
-	indexName := "traces"
-	shouldFlush := false
-	localIndexMap := make(map[string]string)
-	tsKey := config.GetTimeStampKey()
-
-	idxToStreamIdCache := make(map[string]string)
-	cnameCacheByteHashToStr := make(map[uint64]string)
-	var jsParsingStackbuf [utils.UnescapeStackBufSize]byte
-
 	// Go through the request data and ingest each of the spans.
 	numSpans := 0       // The total number of spans sent in this request.
 	numFailedSpans := 0 // The number of spans that we could not ingest.
-	pleArray := make([]*segwriter.ParsedLogEvent, 0)
-	defer segwriter.ReleasePLEs(pleArray)
+	spanJsons := make([][]byte, 0)
+	depInfos := make([]*depgraph.SpanInfo, 0)
+	tailSampler := getTailSampler()
 
 	for _, resourceSpans := range request.ResourceSpans {
 		// Find the service name.
@@ -98,21 +89,24 @@ func ProcessTraceIngest(ctx *fasthttp.RequestCtx, myid int64) {
 					continue
 				}
 
-				ple, err := segwriter.GetNewPLE(jsonData, now, indexName, &tsKey, jsParsingStackbuf[:])
-				if err != nil {
-					log.Errorf("ProcessTraceIngest: failed to get new PLE, jsonData: %v, err: %v", jsonData, err)
-					numFailedSpans++
-					continue
+				depInfo := newDepGraphSpanInfo(span, service)
+				if tailSampler != nil {
+					// Unless its trace was already kept, the sampler buffers the
+					// span and ingests it later if the trace is kept.
+					keep := tailSampler.AddSpan(myid, depInfo.TraceId, newSampledSpan(span, service, jsonData, depInfo))
+					if !keep {
+						continue
+					}
 				}
-				pleArray = append(pleArray, ple)
+				spanJsons = append(spanJsons, jsonData)
+				depInfos = append(depInfos, depInfo)
 			}
 		}
 	}
 
-	err = writer.ProcessIndexRequestPle(now, indexName, shouldFlush, localIndexMap, myid, 0, idxToStreamIdCache, cnameCacheByteHashToStr, jsParsingStackbuf[:], pleArray)
-	if err != nil {
-		log.Errorf("ProcessTraceIngest: Failed to ingest traces, err: %v", err)
-		numFailedSpans += len(pleArray)
+	if len(spanJsons) > 0 {
+		numFailedSpans += ingestSpanJsons(myid, spanJsons)
+		depgraph.RecordSpans(myid, depInfos)
 	}
 
 	log.Debugf("ProcessTraceIngest: %v spans in the request and failed to ingest %v of them", numSpans, numFailedSpans)
@@ -121,6 +115,58 @@ func ProcessTraceIngest(ctx *fasthttp.RequestCtx, myid int64) {
 	HandleTraceIngestionResponse(ctx, numSpans, numFailedSpans)
 }
 
+// Ingests the given span JSONs into the traces index and returns the number of
+// spans that failed to ingest.
+func ingestSpanJsons(myid int64, spanJsons [][]byte) int {
+	now := utils.GetCurrentTimeInMs()
+	indexName := "traces"
+	shouldFlush := false
+	localIndexMap := make(map[string]string)
+	tsKey := config.GetTimeStampKey()
+
+	idxToStreamIdCache := make(map[string]string)
+	cnameCacheByteHashToStr := make(map[uint64]string)
+	var jsParsingStackbuf [utils.UnescapeStackBufSize]byte
+
+	numFailedSpans := 0
+	pleArray := make([]*segwriter.ParsedLogEvent, 0, len(spanJsons))
+	defer segwriter.ReleasePLEs(pleArray)
+
+	for _, jsonData := range spanJsons {
+		ple, err := segwriter.GetNewPLE(jsonData, now, indexName, &tsKey, jsParsingStackbuf[:])
+		if err != nil {
+			log.Errorf("ingestSpanJsons: failed to get new PLE, jsonData: %v, err: %v", jsonData, err)
+			numFailedSpans++
+			continue
+		}
+		pleArray = append(pleArray, ple)
+	}
+
+	err := writer.ProcessIndexRequestPle(now, indexName, shouldFlush, localIndexMap, myid, 0, idxToStreamIdCache, cnameCacheByteHashToStr, jsParsingStackbuf[:], pleArray)
+	if err != nil {
+		log.Errorf("ingestSpanJsons: Failed to ingest traces, err: %v", err)
+		numFailedSpans += len(pleArray)
+	}
+
+	return numFailedSpans
+}
+
+func newDepGraphSpanInfo(span *tracepb.Span, service string) *depgraph.SpanInfo {
+	spanInfo := &depgraph.SpanInfo{
+		TraceId:      hex.EncodeToString(span.TraceId),
+		SpanId:       hex.EncodeToString(span.SpanId),
+		ParentSpanId: hex.EncodeToString(span.ParentSpanId),
+		Service:      service,
+		StartTimeNs:  span.StartTimeUnixNano,
+		IsError:      span.Status != nil && span.Status.Code == tracepb.Status_STATUS_CODE_ERROR,
+	}
+	if span.EndTimeUnixNano > span.StartTimeUnixNano {
+		spanInfo.DurationNs = span.EndTimeUnixNano - span.StartTimeUnixNano
+	}
+
+	return spanInfo
+}
+
 func unmarshalTraceRequest(data []byte) (*coltracepb.ExportTraceServiceRequest, error) {
 	var trace coltracepb.ExportTraceServiceRequest
 	err := proto.Unmarshal(data, &trace)
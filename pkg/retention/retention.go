@@ -34,7 +34,9 @@ import (
 	segmetadata "github.com/siglens/siglens/pkg/segment/metadata"
 	"github.com/siglens/siglens/pkg/segment/structs"
 	"github.com/siglens/siglens/pkg/segment/writer"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/histogram"
 	mmeta "github.com/siglens/siglens/pkg/segment/writer/metrics/meta"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/rollup"
 	"github.com/siglens/siglens/pkg/utils"
 	vtable "github.com/siglens/siglens/pkg/virtualtable"
 	log "github.com/sirupsen/logrus"
@@ -71,6 +73,9 @@ func internalRetentionCleaner() {
 			doVolumeBasedDeletion(config.GetCurrentNodeIngestDir(), 60000, deletionWarningCounter)
 			doInodeBasedDeletion(config.GetCurrentNodeIngestDir(), deletionWarningCounter)
 		}
+		if config.IsMetricsRollupEnabled() {
+			DoMetricsRollupRetention(config.GetCurrentNodeIngestDir())
+		}
 		if deletionWarningCounter <= MAXIMUM_WARNINGS_COUNT {
 			deletionWarningCounter++
 		}
@@ -80,6 +85,7 @@ func internalRetentionCleaner() {
 func DoRetentionBasedDeletion(ingestNodeDir string, retentionHours int, orgid int64) {
 	currTime := time.Now()
 	deleteBefore := GetRetentionTimeMs(retentionHours, currTime)
+	metricsDeleteBefore := GetRetentionTimeMs(getMetricsRetentionHours(retentionHours), currTime)
 
 	allSegMetas := writer.ReadLocalSegmeta(false)
 
@@ -134,7 +140,7 @@ func DoRetentionBasedDeletion(ingestNodeDir string, retentionHours int, orgid in
 	for _, metaEntry := range allEntries {
 		switch entry := metaEntry.(type) {
 		case *structs.MetricsMeta:
-			if uint64(entry.LatestEpochSec)*1000 <= deleteBefore {
+			if uint64(entry.LatestEpochSec)*1000 <= metricsDeleteBefore {
 				metricSegmentsToDelete[entry.MSegmentDir] = entry
 			}
 			if oldest > uint64(entry.LatestEpochSec)*1000 {
@@ -159,6 +165,79 @@ func DoRetentionBasedDeletion(ingestNodeDir string, retentionHours int, orgid in
 	DeleteEmptyIndices(ingestNodeDir, orgid)
 }
 
+// Metrics segments are kept for as long as any of their rollup tiers is
+// retained; DoMetricsRollupRetention deletes the expired tiers before that.
+func getMetricsRetentionHours(retentionHours int) int {
+	if !config.IsMetricsRollupEnabled() {
+		return retentionHours
+	}
+
+	rollupConfig := config.GetMetricsRollupConfig()
+	metricsRetentionHours := max(retentionHours, rollupConfig.RawRetentionHours)
+	for _, tier := range rollup.Tiers {
+		metricsRetentionHours = max(metricsRetentionHours, rollup.GetTierRetentionHours(tier, rollupConfig))
+	}
+	return metricsRetentionHours
+}
+
+/*
+Deletes the raw datapoints and rollup tiers of metrics blocks that are past
+their own retention. Raw datapoints are only deleted once the block has been
+rolled up, so that no data is lost before the compactor gets to it.
+*/
+func DoMetricsRollupRetention(ingestNodeDir string) {
+	currentMetricsMeta := path.Join(ingestNodeDir, mmeta.MetricsMetaSuffix)
+	allMetricMetas, err := mmeta.ReadMetricsMeta(currentMetricsMeta)
+	if err != nil {
+		log.Errorf("DoMetricsRollupRetention: Failed to get all metric meta entries, FilePath=%v, err: %v", currentMetricsMeta, err)
+		return
+	}
+
+	currTime := time.Now()
+	rollupConfig := config.GetMetricsRollupConfig()
+	rawDeleteBefore := GetRetentionTimeMs(rollupConfig.RawRetentionHours, currTime)
+
+	numRawDeleted := 0
+	numTiersDeleted := 0
+	for _, entry := range allMetricMetas {
+		latestEpochMs := uint64(entry.LatestEpochSec) * 1000
+		for blkNum := uint16(0); blkNum < entry.NumBlocks; blkNum++ {
+			if latestEpochMs <= rawDeleteBefore && rollup.IsBlockRolledUp(entry.MSegmentDir, blkNum) {
+				if deleteMetricsBlockFile(rollup.GetTsoFileName(entry.MSegmentDir, blkNum)) {
+					numRawDeleted++
+				}
+				deleteMetricsBlockFile(rollup.GetTsgFileName(entry.MSegmentDir, blkNum))
+				deleteMetricsBlockFile(histogram.GetHistogramFileName(entry.MSegmentDir, blkNum))
+			}
+
+			for _, tier := range rollup.Tiers {
+				if latestEpochMs > GetRetentionTimeMs(rollup.GetTierRetentionHours(tier, rollupConfig), currTime) {
+					continue
+				}
+				if deleteMetricsBlockFile(rollup.GetRollupFileName(entry.MSegmentDir, blkNum, tier)) {
+					numTiersDeleted++
+				}
+			}
+		}
+	}
+
+	if numRawDeleted > 0 || numTiersDeleted > 0 {
+		log.Infof("DoMetricsRollupRetention: deleted raw datapoints of %v blocks and %v expired rollup tier files", numRawDeleted, numTiersDeleted)
+	}
+}
+
+// Returns whether the file existed and was deleted.
+func deleteMetricsBlockFile(fileName string) bool {
+	err := os.Remove(fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("deleteMetricsBlockFile: failed to delete %v, err: %v", fileName, err)
+		}
+		return false
+	}
+	return true
+}
+
 func DeleteEmptyIndices(ingestNodeDir string, myid int64) {
 	allIndices, err := vtable.GetVirtualTableNames(myid)
 	if err != nil {
@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"regexp"
 	"sort"
 	"sync"
@@ -96,9 +97,73 @@ func GetAllTagsTreesWithinTimeRange(timeRange *dtu.MetricsTimeRange, querySummar
 }
 
 func ApplyMetricsQuery(mQuery *structs.MetricsQuery, timeRange *dtu.MetricsTimeRange, qid uint64, querySummary *summary.QuerySummary) *mresults.MetricsResult {
+	if mQuery.Offset == 0 && mQuery.AtModifier == 0 {
+		return applyMetricsQuery(mQuery, timeRange, qid, querySummary)
+	}
+
+	// The offset and @ modifiers change the time the series are read at. Run
+	// the query over that time range, and then move the results back onto the
+	// requested time range.
+	evalTimeRange := getTimeRangeWithModifiers(mQuery, timeRange)
+	mRes := applyMetricsQuery(mQuery, evalTimeRange, qid, querySummary)
+	if len(mRes.ErrList) > 0 {
+		return mRes
+	}
+
+	if mQuery.AtModifier > 0 {
+		mRes.FillStepsWithLatestValue(timeRange)
+	} else {
+		mRes.ShiftTimestamps(mQuery.Offset)
+	}
+
+	return mRes
+}
+
+// Returns the time range the query has to be evaluated over. With the @
+// modifier the range ends at the @ time; the offset is then subtracted from
+// both ends.
+func getTimeRangeWithModifiers(mQuery *structs.MetricsQuery, timeRange *dtu.MetricsTimeRange) *dtu.MetricsTimeRange {
+	start := int64(timeRange.StartEpochSec)
+	end := int64(timeRange.EndEpochSec)
+
+	if mQuery.AtModifier > 0 {
+		var atTime int64
+		switch mQuery.AtModifier {
+		case structs.AtTimestamp:
+			atTime = int64(mQuery.AtEpochSec)
+		case structs.AtStart:
+			// An instant query is evaluated at a single time, so start() and
+			// end() are the same.
+			if mQuery.IsInstantQuery {
+				atTime = end
+			} else {
+				atTime = start
+			}
+		case structs.AtEnd:
+			atTime = end
+		}
+		start = atTime - (end - start)
+		end = atTime
+	}
+
+	start -= mQuery.Offset
+	end -= mQuery.Offset
+
+	return &dtu.MetricsTimeRange{
+		StartEpochSec: uint32(min(max(start, 0), math.MaxUint32)),
+		EndEpochSec:   uint32(min(max(end, 0), math.MaxUint32)),
+	}
+}
+
+func applyMetricsQuery(mQuery *structs.MetricsQuery, timeRange *dtu.MetricsTimeRange, qid uint64, querySummary *summary.QuerySummary) *mresults.MetricsResult {
 	// init metrics results structs
 	mRes := mresults.InitMetricResults(mQuery, qid)
 
+	if value, ok := mQuery.ConstantVector.Get(); ok {
+		applyConstantVectorQuery(mQuery, value, mRes, timeRange, qid)
+		return mRes
+	}
+
 	finalTimeRange := &dtu.MetricsTimeRange{
 		StartEpochSec: timeRange.StartEpochSec,
 		EndEpochSec:   timeRange.EndEpochSec,
@@ -174,6 +239,11 @@ func ApplyMetricsQuery(mQuery *structs.MetricsQuery, timeRange *dtu.MetricsTimeR
 		return mRes
 	}
 
+	if mQuery.RawSamples {
+		mRes.SetRawResults()
+		return mRes
+	}
+
 	if mQuery.IsQueryCancelled() {
 		mRes.AddError(fmt.Errorf("query cancelled"))
 		return mRes
@@ -205,11 +275,41 @@ func ApplyMetricsQuery(mQuery *structs.MetricsQuery, timeRange *dtu.MetricsTimeR
 		return mRes
 	}
 
+	if mRes.HasNativeHistograms() {
+		err = mRes.ApplyNativeHistogramChain(mQuery, timeRange)
+		if err != nil {
+			mRes.AddError(err)
+			return mRes
+		}
+	}
+
 	ProcessMQueryAggsChain(mQuery, timeRange, mRes, qid)
 
 	return mRes
 }
 
+// vector(s) does not read any series; the result is the constant, which then
+// goes through the aggregations and functions of the query.
+func applyConstantVectorQuery(mQuery *structs.MetricsQuery, value float64, mRes *mresults.MetricsResult, timeRange *dtu.MetricsTimeRange, qid uint64) {
+	mRes.SetConstantVector(value, mQuery.Downsampler, timeRange)
+
+	if mQuery.SubsequentAggs != nil {
+		mQuery.FirstAggregator = *mQuery.SubsequentAggs.AggregatorBlock // The first Aggregation in the MQueryAggs is always a AggregatorBlock
+		mQuery.SubsequentAggs = mQuery.SubsequentAggs.Next
+
+		parallelism := int(config.GetParallelism()) * 2
+		errors := mRes.ApplyAggregationToResults(parallelism, mQuery.FirstAggregator)
+		if errors != nil {
+			for _, err := range errors {
+				mRes.AddError(err)
+			}
+			return
+		}
+	}
+
+	ProcessMQueryAggsChain(mQuery, timeRange, mRes, qid)
+}
+
 func ProcessMQueryAggsChain(mQuery *structs.MetricsQuery, timeRange *dtu.MetricsTimeRange, mRes *mresults.MetricsResult, qid uint64) {
 	parallelism := int(config.GetParallelism()) * 2
 
@@ -175,7 +175,8 @@ func IsLogsQuery(firstAgg *structs.QueryAggregators) bool {
 		if qType != structs.RRCCmd {
 			return false
 		}
-		if firstAgg.IndexName == "traces" || firstAgg.IndexName == "service-dependency" || firstAgg.IndexName == "red-traces" {
+		if firstAgg.IndexName == "traces" || firstAgg.IndexName == "service-dependency" || firstAgg.IndexName == "red-traces" ||
+			firstAgg.IndexName == "service-dependency-edges" {
 			return false
 		}
 	}
@@ -348,6 +348,29 @@ func (tsbr *TimeSeriesBlockReader) GetTimeSeriesIterator(tsid uint64) (*compress
 	return it, true, nil
 }
 
+/*
+Returns all tsids of the block, in ascending order
+*/
+func (tsbr *TimeSeriesBlockReader) GetAllTSIDs() []uint64 {
+	var tsoBuf []byte
+	switch tsbr.tsoVersion {
+	case sutils.VERSION_TSOFILE_V1[0]:
+		tsoBuf = tsbr.rawTSO[3:]
+	case sutils.VERSION_TSOFILE_V2[0]:
+		tsoBuf = tsbr.rawTSO[9:]
+	default:
+		log.Error(ErrBadTsoVersion)
+		return nil
+	}
+
+	tsids := make([]uint64, 0, tsbr.numTSIDs)
+	for i := uint64(0); i < tsbr.numTSIDs; i++ {
+		// every tsid info takes 8 bytes for tsid and 4 bytes for tsid offset
+		tsids = append(tsids, utils.BytesToUint64LittleEndian(tsoBuf[i*12:i*12+8]))
+	}
+	return tsids
+}
+
 // returns bool if found. If true, returns the tsidx and offset in the TSG file
 func getOffsetFromTsoFile(tsoVersion byte, low uint32, high uint32, nTsids uint32, tsid uint64,
 	tsoBuf []byte) (bool, uint32, uint32) {
@@ -29,6 +29,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/cespare/xxhash"
 	parser "github.com/prometheus/prometheus/promql/parser"
 	"github.com/siglens/siglens/pkg/common/dtypeutils"
 	putils "github.com/siglens/siglens/pkg/integrations/prometheus/utils"
@@ -64,6 +65,8 @@ type MetricsResult struct {
 	MetricName string
 	// maps tsid to the raw read series (with downsampled timestamp)
 	AllSeries map[uint64]*Series
+	// maps tsid to its native histogram samples, only read for queries with a histogram function
+	AllHistograms map[uint64]*HistogramSeries
 
 	// maps groupid to all raw downsampled series. This downsampled series may have repeated timestamps from different tsids
 	DsResults map[string]*DownsampleSeries
@@ -77,6 +80,11 @@ type MetricsResult struct {
 
 	State bucketState
 
+	// interval of the downsampled buckets, which is the step of range queries
+	dsIntervalSec uint32
+	// set by sort and sort_desc to order the instant query response
+	sortFunction sutils.VectorFunctions
+
 	rwLock               *sync.RWMutex
 	ErrList              []error
 	TagValues            map[string]map[string]struct{}
@@ -92,6 +100,7 @@ func InitMetricResults(mQuery *structs.MetricsQuery, qid uint64) *MetricsResult
 	return &MetricsResult{
 		MetricName:           mQuery.MetricName,
 		AllSeries:            make(map[uint64]*Series),
+		AllHistograms:        make(map[uint64]*HistogramSeries),
 		rwLock:               &sync.RWMutex{},
 		ErrList:              make([]error, 0),
 		AllSeriesTagsOnlyMap: make(map[uint64]*tsidtracker.AllMatchedTSIDsInfo, 0),
@@ -130,6 +139,29 @@ func (r *MetricsResult) GetNumSeries() uint64 {
 	return uint64(len(r.Results))
 }
 
+/*
+Sets Results to the raw datapoints of every series, keyed by group id, and
+skips downsampling and aggregation. If several datapoints of a group share a
+timestamp, the last one read wins.
+*/
+func (r *MetricsResult) SetRawResults() {
+	r.Results = make(map[string]map[uint32]float64, len(r.AllSeries))
+	for _, series := range r.AllSeries {
+		series.sortEntries()
+		grp := series.grpID.String()
+		points, ok := r.Results[grp]
+		if !ok {
+			points = make(map[uint32]float64, series.idx)
+			r.Results[grp] = points
+		}
+		for _, entry := range series.entries[:series.idx] {
+			points[entry.downsampledTime] = entry.dpVal
+		}
+	}
+	r.AllSeries = nil
+	r.State = AGGREGATED
+}
+
 /*
 Downsample all series
 
@@ -182,6 +214,7 @@ func (r *MetricsResult) DownsampleResults(ds structs.Downsampler, parallelism in
 	r.DsResults = allDSSeries
 	r.State = DOWNSAMPLING
 	r.AllSeries = nil
+	r.dsIntervalSec = ds.GetIntervalTimeInSeconds()
 
 	if len(errors) > 0 {
 		return errors
@@ -492,6 +525,16 @@ func (r *MetricsResult) ApplyFunctionsToResults(parallelism int, function struct
 		return nil
 	}
 
+	if function.FunctionType == structs.VectorFunction {
+		err := r.ApplyVectorFunctionToResults(function, timeRange)
+		if err != nil {
+			errList = append(errList, err)
+			return errList
+		}
+
+		return nil
+	}
+
 	// Use a temporary map to record the results modified by goroutines, thus resolving concurrency issues caused by modifying a map during iteration.
 	results := make(map[string]map[uint32]float64, len(r.Results))
 
@@ -543,6 +586,10 @@ func (r *MetricsResult) ApplyHistogramToResults(parallelism int, agg *structs.Hi
 	switch agg.Function {
 	case sutils.HistogramQuantile:
 		return r.applyHistogramQunatile(seriesIds, agg)
+	case sutils.HistogramCount, sutils.HistogramSum, sutils.HistogramFraction:
+		// These only work on native histograms, which are evaluated before
+		// this point, so float series give no result.
+		r.Results = make(map[string]map[uint32]float64)
 	}
 
 	return nil
@@ -688,6 +735,9 @@ func (r *MetricsResult) Merge(localRes *MetricsResult) error {
 			r.AddError(err)
 		}
 	}
+	for tsid, hSeries := range localRes.AllHistograms {
+		r.addHistogramSeries(tsid, hSeries)
+	}
 	return nil
 }
 
@@ -753,12 +803,17 @@ func (r *MetricsResult) GetOTSDBResults(mQuery *structs.MetricsQuery) ([]*struct
 	return retVal, nil
 }
 
-func getPromQLSeriesFormat(seriesId string) map[string]string {
+// Returns the labels of the series, including __name__ unless the series has
+// no metric name, e.g. the result of vector() or absent().
+func GetPromQLSeriesFormat(seriesId string) map[string]string {
 	tagValues := strings.Split(RemoveTrailingComma(seriesId), tsidtracker.TAG_VALUE_DELIMITER_STR)
 
 	var keyValue []string
 	metric := make(map[string]string)
-	metric["__name__"] = ExtractMetricNameFromGroupID(seriesId)
+	metricName := ExtractMetricNameFromGroupID(seriesId)
+	if metricName != "" {
+		metric["__name__"] = metricName
+	}
 	for idx, val := range tagValues {
 		if idx == 0 {
 			keyValue = strings.SplitN(removeMetricNameFromGroupID(val), ":", 2)
@@ -786,12 +841,13 @@ func (r *MetricsResult) GetResultsPromQlInstantQuery(pqlQueryType parser.ValueTy
 		return nil, errors.New("GetResultsPromQlInstantQuery: ValueTypeString is not supported")
 	case parser.ValueTypeVector:
 		pqlData.ResultType = pqlQueryType
+		latestValues := make([]float64, 0, len(r.Results))
 		for seriesId, results := range r.Results {
 			if len(results) == 0 {
 				continue
 			}
 
-			metricSeries := getPromQLSeriesFormat(seriesId)
+			metricSeries := GetPromQLSeriesFormat(seriesId)
 
 			result := structs.InstantVectorResult{
 				Metric: metricSeries,
@@ -810,6 +866,15 @@ func (r *MetricsResult) GetResultsPromQlInstantQuery(pqlQueryType parser.ValueTy
 
 			result.Value = []interface{}{latestTime, fmt.Sprintf("%v", latestValue)}
 			pqlData.VectorResult = append(pqlData.VectorResult, result)
+			latestValues = append(latestValues, latestValue)
+		}
+
+		if r.sortFunction == sutils.Sort || r.sortFunction == sutils.Sort_Desc {
+			sort.Sort(&sortableVectorResult{
+				results: pqlData.VectorResult,
+				values:  latestValues,
+				desc:    r.sortFunction == sutils.Sort_Desc,
+			})
 		}
 	case parser.ValueTypeMatrix:
 		return nil, errors.New("ValueTypeMatrix is not supported for Instant Queries")
@@ -830,10 +895,11 @@ func (r *MetricsResult) GetResultsPromQl(mQuery *structs.MetricsQuery, pqlQueryt
 	var pqldata structs.PromQLRangeData
 
 	switch pqlQuerytype {
-	case parser.ValueTypeVector, parser.ValueTypeMatrix:
+	case parser.ValueTypeVector, parser.ValueTypeMatrix, parser.ValueTypeScalar:
+		// A scalar here is the result of scalar(), which can vary over time.
 		pqldata.ResultType = parser.ValueType("matrix")
 		for seriesId, results := range r.Results {
-			metricSeries := getPromQLSeriesFormat(seriesId)
+			metricSeries := GetPromQLSeriesFormat(seriesId)
 
 			result := &structs.RangeVectorResult{
 				Metric: metricSeries,
@@ -1104,6 +1170,10 @@ func (r *MetricsResult) aggregateFromAllTimeseries(aggregation structs.Aggregati
 		fallthrough
 	case sutils.Stddev:
 		r.computeAggStdvarOrStddev(aggregation, seriesEntriesMap)
+	case sutils.CountValues:
+		r.computeAggCountValues(aggregation, seriesEntriesMap)
+	case sutils.LimitK:
+		err = r.computeLimitK(aggregation.FuncConstant, seriesEntriesMap)
 	default:
 		return fmt.Errorf("aggregateFromAllTimeseries: Unsupported aggregation: %v", aggregation)
 	}
@@ -1292,3 +1362,75 @@ func (r *MetricsResult) computeAggStdvarOrStddev(aggregation structs.Aggregation
 
 	r.State = AGGREGATED
 }
+
+// Counts the series that have the same value, per group. Each value becomes a
+// series with the value in the aggregation.ValueLabel label.
+func (r *MetricsResult) computeAggCountValues(aggregation structs.Aggregation, seriesEntriesMap map[string]map[uint32][]RunningEntry) {
+	r.Results = make(map[string]map[uint32]float64)
+
+	for grpID, timeSeries := range seriesEntriesMap {
+		groupSeriesId := GetSeriesIdWithoutFields(getAggSeriesId(grpID, &aggregation), []string{aggregation.ValueLabel})
+		groupSeriesId = RemoveTrailingComma(groupSeriesId)
+
+		for timestamp, entries := range timeSeries {
+			for _, entry := range entries {
+				valueLabel := aggregation.ValueLabel + ":" + strconv.FormatFloat(entry.runningVal, 'f', -1, 64)
+				seriesId := groupSeriesId + valueLabel
+				if !strings.HasSuffix(groupSeriesId, "{") {
+					seriesId = groupSeriesId + "," + valueLabel
+				}
+
+				if _, exists := r.Results[seriesId]; !exists {
+					r.Results[seriesId] = make(map[uint32]float64)
+				}
+				r.Results[seriesId][timestamp]++
+			}
+		}
+	}
+
+	r.DsResults = nil
+	r.State = AGGREGATED
+}
+
+// Keeps at most k series at each timestamp. The series are picked by the hash
+// of their series id, so the same series are kept across timestamps and
+// across queries.
+func (r *MetricsResult) computeLimitK(funcConstant float64, seriesEntriesMap map[string]map[uint32][]RunningEntry) error {
+	limit := int(funcConstant)
+	if limit <= 0 {
+		return fmt.Errorf("computeLimitK: k must larger than 0")
+	}
+
+	seriesIds := make([]string, 0, len(seriesEntriesMap))
+	for seriesId := range seriesEntriesMap {
+		seriesIds = append(seriesIds, seriesId)
+	}
+	sort.Slice(seriesIds, func(i, j int) bool {
+		hashI, hashJ := xxhash.Sum64String(seriesIds[i]), xxhash.Sum64String(seriesIds[j])
+		if hashI != hashJ {
+			return hashI < hashJ
+		}
+		return seriesIds[i] < seriesIds[j]
+	})
+
+	r.Results = make(map[string]map[uint32]float64)
+	numSeriesAtTimestamp := make(map[uint32]int)
+	for _, seriesId := range seriesIds {
+		for timestamp, entries := range seriesEntriesMap[seriesId] {
+			if len(entries) == 0 || numSeriesAtTimestamp[timestamp] >= limit {
+				continue
+			}
+			numSeriesAtTimestamp[timestamp]++
+
+			if _, exists := r.Results[seriesId]; !exists {
+				r.Results[seriesId] = make(map[uint32]float64)
+			}
+			r.Results[seriesId][timestamp] = entries[0].runningVal
+		}
+	}
+
+	r.DsResults = nil
+	r.State = AGGREGATED
+
+	return nil
+}
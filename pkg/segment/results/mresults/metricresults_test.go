@@ -25,6 +25,7 @@ import (
 	"github.com/siglens/siglens/pkg/segment/structs"
 	sutils "github.com/siglens/siglens/pkg/segment/utils"
 	"github.com/stretchr/testify/assert"
+	"github.com/valyala/bytebufferpool"
 )
 
 func Test_getAggSeriesId_SeriesWithGroupBy(t *testing.T) {
@@ -481,3 +482,100 @@ func Test_getHistogramBins(t *testing.T) {
 	assert.Equal(t, 3.0, bins3[3][0].count)
 	assert.Equal(t, 0.3, bins3[3][0].upperBound)
 }
+
+func Test_ApplyAggregationToResults_CountValues(t *testing.T) {
+	mResult := &MetricsResult{
+		MetricName: "test",
+		State:      AGGREGATED,
+		Results: map[string]map[uint32]float64{
+			"test{job:a,instance:1,": {1: 1.5, 2: 2},
+			"test{job:a,instance:2,": {1: 1.5, 2: 3},
+			"test{job:b,instance:3,": {1: 1.5},
+		},
+	}
+
+	parallelism := int(config.GetParallelism()) * 2
+
+	aggregation := structs.Aggregation{
+		AggregatorFunction: sutils.CountValues,
+		GroupByFields:      []string{"job"},
+		ValueLabel:         "value",
+	}
+
+	errors := mResult.ApplyAggregationToResults(parallelism, aggregation)
+	assert.Equal(t, 0, len(errors))
+	assert.Equal(t, map[string]map[uint32]float64{
+		"test{job:a,value:1.5": {1: 2},
+		"test{job:a,value:2":   {2: 1},
+		"test{job:a,value:3":   {2: 1},
+		"test{job:b,value:1.5": {1: 1},
+	}, mResult.Results)
+}
+
+func Test_ApplyAggregationToResults_LimitK(t *testing.T) {
+	results := map[string]map[uint32]float64{
+		"test{instance:1,": {1: 1, 2: 1},
+		"test{instance:2,": {1: 2, 2: 2},
+		"test{instance:3,": {1: 3},
+		"test{instance:4,": {2: 4},
+	}
+
+	mResult := &MetricsResult{
+		MetricName: "test",
+		State:      AGGREGATED,
+		Results:    results,
+	}
+
+	parallelism := int(config.GetParallelism()) * 2
+
+	aggregation := structs.Aggregation{
+		AggregatorFunction: sutils.LimitK,
+		FuncConstant:       2,
+	}
+
+	errors := mResult.ApplyAggregationToResults(parallelism, aggregation)
+	assert.Equal(t, 0, len(errors))
+
+	numSeriesAtTimestamp := make(map[uint32]int)
+	for seriesId, timeSeries := range mResult.Results {
+		for ts, val := range timeSeries {
+			// Values are passed through unchanged.
+			assert.Equal(t, results[seriesId][ts], val)
+			numSeriesAtTimestamp[ts]++
+		}
+	}
+	assert.Equal(t, map[uint32]int{1: 2, 2: 2}, numSeriesAtTimestamp)
+
+	aggregation.FuncConstant = 0
+	errors = mResult.ApplyAggregationToResults(parallelism, aggregation)
+	assert.Equal(t, 1, len(errors))
+}
+
+func Test_SetRawResults(t *testing.T) {
+	mQuery := &structs.MetricsQuery{
+		MetricName: "test",
+		RawSamples: true,
+	}
+	mResult := InitMetricResults(mQuery, 0)
+
+	grpID := bytebufferpool.Get()
+	_, err := grpID.WriteString("test{host:a")
+	assert.NoError(t, err)
+
+	// Two series of the same group are merged into one.
+	first := InitSeriesHolder(mQuery, grpID)
+	first.AddEntry(10, 1)
+	first.AddEntry(11, 2)
+	second := InitSeriesHolder(mQuery, grpID)
+	second.AddEntry(12, 3)
+	second.AddEntry(13, 4)
+	mResult.AllSeries[1] = first
+	mResult.AllSeries[2] = second
+
+	mResult.SetRawResults()
+	assert.Equal(t, AGGREGATED, mResult.State)
+	assert.Nil(t, mResult.AllSeries)
+	assert.Equal(t, map[string]map[uint32]float64{
+		"test{host:a": {10: 1, 11: 2, 12: 3, 13: 4},
+	}, mResult.Results)
+}
@@ -0,0 +1,281 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mresults
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/siglens/siglens/pkg/common/dtypeutils"
+	"github.com/siglens/siglens/pkg/segment/structs"
+	sutils "github.com/siglens/siglens/pkg/segment/utils"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/histogram"
+	"github.com/valyala/bytebufferpool"
+)
+
+// The native histogram samples of a single tsid
+type HistogramSeries struct {
+	grpID   string
+	samples []histogram.Sample
+}
+
+/*
+Add the native histogram samples of a tsid
+
+This does not protect againt concurrency. The caller is responsible for coordination
+*/
+func (r *MetricsResult) AddHistogramSamples(tsid uint64, tsGroupId *bytebufferpool.ByteBuffer, samples []histogram.Sample) {
+	if len(samples) == 0 {
+		return
+	}
+	r.addHistogramSeries(tsid, &HistogramSeries{grpID: tsGroupId.String(), samples: samples})
+}
+
+func (r *MetricsResult) addHistogramSeries(tsid uint64, hSeries *HistogramSeries) {
+	if r.AllHistograms == nil {
+		r.AllHistograms = make(map[uint64]*HistogramSeries)
+	}
+	currSeries, ok := r.AllHistograms[tsid]
+	if !ok {
+		r.AllHistograms[tsid] = hSeries
+		return
+	}
+	currSeries.samples = append(currSeries.samples, hSeries.samples...)
+}
+
+func (r *MetricsResult) HasNativeHistograms() bool {
+	return len(r.AllHistograms) > 0
+}
+
+/*
+Evaluates the query up to and including its histogram function on the native
+histogram samples, and replaces the results with the output of the function.
+The applied part of the query is removed from mQuery.SubsequentAggs, so the rest
+of the chain is processed as usual.
+
+Before the histogram function, only rate, irate, increase and delta, and the sum
+and avg aggregations are supported. Series that only have classic histogram
+buckets are not part of the results once native histograms are found.
+*/
+func (r *MetricsResult) ApplyNativeHistogramChain(mQuery *structs.MetricsQuery, timeRange *dtypeutils.MetricsTimeRange) error {
+	var rangeFunction *structs.Function
+	aggregations := []structs.Aggregation{mQuery.FirstAggregator}
+	var histogramAgg *structs.HistogramAgg
+	var nextAgg *structs.MetricQueryAgg
+
+	for agg := mQuery.SubsequentAggs; agg != nil; agg = agg.Next {
+		if agg.AggBlockType == structs.AggregatorBlock {
+			aggregations = append(aggregations, *agg.AggregatorBlock)
+			continue
+		}
+
+		function := agg.FunctionBlock
+		if function.FunctionType == structs.HistogramFunction {
+			histogramAgg = function.HistogramFunction
+			nextAgg = agg.Next
+			break
+		}
+		if function.FunctionType != structs.RangeFunction || rangeFunction != nil || len(aggregations) > 1 {
+			return fmt.Errorf("ApplyNativeHistogramChain: function %+v is not supported on native histograms", *function)
+		}
+		switch function.RangeFunction {
+		case sutils.Rate, sutils.IRate, sutils.Increase, sutils.Delta:
+			rangeFunction = function
+		default:
+			return fmt.Errorf("ApplyNativeHistogramChain: range function %v is not supported on native histograms", function.RangeFunction)
+		}
+	}
+	if histogramAgg == nil {
+		return nil
+	}
+
+	for _, aggregation := range aggregations {
+		if aggregation.AggregatorFunction != sutils.Sum && aggregation.AggregatorFunction != sutils.Avg {
+			return fmt.Errorf("ApplyNativeHistogramChain: aggregation %v is not supported on native histograms", aggregation.AggregatorFunction)
+		}
+	}
+
+	steps := r.getStepTimestamps(timeRange)
+	allSeries := make([]*histogramStepSeries, 0, len(r.AllHistograms))
+	for _, hSeries := range r.AllHistograms {
+		sort.Slice(hSeries.samples, func(i, j int) bool {
+			return hSeries.samples[i].Ts < hSeries.samples[j].Ts
+		})
+
+		tsToHist := make(map[uint32]*histogram.Histogram)
+		for _, step := range steps {
+			var h *histogram.Histogram
+			if rangeFunction != nil {
+				h = evaluateHistogramRangeFunction(hSeries.samples, step, rangeFunction)
+			} else {
+				h = r.getLatestHistogram(hSeries.samples, step, timeRange)
+			}
+			if h != nil {
+				tsToHist[step] = h
+			}
+		}
+		if len(tsToHist) > 0 {
+			allSeries = append(allSeries, &histogramStepSeries{seriesId: hSeries.grpID, tsToHist: tsToHist})
+		}
+	}
+
+	for i := range aggregations {
+		allSeries = aggregateHistogramSeries(allSeries, &aggregations[i])
+	}
+
+	r.Results = make(map[string]map[uint32]float64, len(allSeries))
+	for _, hSeries := range allSeries {
+		tsToVal := make(map[uint32]float64, len(hSeries.tsToHist))
+		for ts, h := range hSeries.tsToHist {
+			tsToVal[ts] = getHistogramFunctionValue(h, histogramAgg)
+		}
+		r.Results[hSeries.seriesId] = tsToVal
+	}
+
+	r.AllHistograms = nil
+	r.DsResults = nil
+	r.State = AGGREGATED
+	mQuery.SubsequentAggs = nextAgg
+	return nil
+}
+
+// The histograms of a series at the evaluated timestamps
+type histogramStepSeries struct {
+	seriesId string
+	tsToHist map[uint32]*histogram.Histogram
+}
+
+// Returns the latest sample at or before the timestamp, within the bucket of
+// the step for range queries and within the time range for instant queries.
+func (r *MetricsResult) getLatestHistogram(sortedSamples []histogram.Sample, ts uint32, timeRange *dtypeutils.MetricsTimeRange) *histogram.Histogram {
+	lookback := r.dsIntervalSec
+	if r.IsInstantQuery || lookback == 0 {
+		lookback = timeRange.EndEpochSec - timeRange.StartEpochSec + 1
+	}
+
+	idx := sort.Search(len(sortedSamples), func(i int) bool {
+		return sortedSamples[i].Ts > ts
+	}) - 1
+	if idx < 0 || sortedSamples[idx].Ts+lookback <= ts {
+		return nil
+	}
+	return sortedSamples[idx].H
+}
+
+/*
+Applies a range function to the samples within (ts - window, ts].
+
+The increase of the counters is summed over consecutive samples, so a counter
+reset only loses the increase before the first sample after it. rate divides the
+increase by the time between the first and last sample, and increase
+extrapolates that rate to the whole window.
+*/
+func evaluateHistogramRangeFunction(sortedSamples []histogram.Sample, ts uint32, function *structs.Function) *histogram.Histogram {
+	windowStart := int64(ts) - int64(function.TimeWindow)
+	start := sort.Search(len(sortedSamples), func(i int) bool {
+		return int64(sortedSamples[i].Ts) > windowStart
+	})
+	end := sort.Search(len(sortedSamples), func(i int) bool {
+		return sortedSamples[i].Ts > ts
+	})
+	if end-start < 2 {
+		return nil
+	}
+	if function.RangeFunction == sutils.IRate {
+		start = end - 2
+	}
+
+	first, last := sortedSamples[start], sortedSamples[end-1]
+	if function.RangeFunction == sutils.Delta {
+		return last.H.Sub(first.H)
+	}
+
+	var increase *histogram.Histogram
+	for i := start + 1; i < end; i++ {
+		curr, prev := sortedSamples[i].H, sortedSamples[i-1].H
+		delta := curr
+		if !curr.IsCounterResetFrom(prev) {
+			delta = curr.Sub(prev)
+		}
+		if increase == nil {
+			increase = delta
+		} else {
+			increase = increase.Add(delta)
+		}
+	}
+
+	elapsed := float64(last.Ts - first.Ts)
+	if elapsed <= 0 {
+		return nil
+	}
+	rate := increase.Mul(1 / elapsed)
+	if function.RangeFunction == sutils.Increase {
+		return rate.Mul(function.TimeWindow)
+	}
+	return rate
+}
+
+// Sums the histograms of the series that have the same series id after the
+// aggregation, and divides them by the number of series for avg.
+func aggregateHistogramSeries(allSeries []*histogramStepSeries, aggregation *structs.Aggregation) []*histogramStepSeries {
+	grouped := make(map[string]*histogramStepSeries)
+	counts := make(map[string]map[uint32]float64)
+	for _, hSeries := range allSeries {
+		seriesId := getAggSeriesId(hSeries.seriesId, aggregation)
+		group, ok := grouped[seriesId]
+		if !ok {
+			group = &histogramStepSeries{seriesId: seriesId, tsToHist: make(map[uint32]*histogram.Histogram)}
+			grouped[seriesId] = group
+			counts[seriesId] = make(map[uint32]float64)
+		}
+		for ts, h := range hSeries.tsToHist {
+			if curr, ok := group.tsToHist[ts]; ok {
+				group.tsToHist[ts] = curr.Add(h)
+			} else {
+				group.tsToHist[ts] = h
+			}
+			counts[seriesId][ts]++
+		}
+	}
+
+	aggregated := make([]*histogramStepSeries, 0, len(grouped))
+	for seriesId, group := range grouped {
+		if aggregation.AggregatorFunction == sutils.Avg {
+			for ts, h := range group.tsToHist {
+				if counts[seriesId][ts] > 1 {
+					group.tsToHist[ts] = h.Mul(1 / counts[seriesId][ts])
+				}
+			}
+		}
+		aggregated = append(aggregated, group)
+	}
+	return aggregated
+}
+
+func getHistogramFunctionValue(h *histogram.Histogram, agg *structs.HistogramAgg) float64 {
+	switch agg.Function {
+	case sutils.HistogramCount:
+		return h.Count
+	case sutils.HistogramSum:
+		return h.Sum
+	case sutils.HistogramFraction:
+		return h.Fraction(agg.Lower, agg.Upper)
+	default:
+		return h.Quantile(agg.Quantile)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mresults
+
+import (
+	"testing"
+
+	"github.com/siglens/siglens/pkg/common/dtypeutils"
+	"github.com/siglens/siglens/pkg/segment/structs"
+	sutils "github.com/siglens/siglens/pkg/segment/utils"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/histogram"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/bytebufferpool"
+)
+
+// A schema 0 histogram with n observations in (0.5, 1] and 3n in (1, 2]
+func getNativeTestHistogram(n float64) *histogram.Histogram {
+	return &histogram.Histogram{
+		Count:           4 * n,
+		Sum:             5 * n,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+		PositiveBuckets: []float64{n, 3 * n},
+	}
+}
+
+func getNativeHistogramResult(t *testing.T) *MetricsResult {
+	res := InitMetricResults(&structs.MetricsQuery{}, 0)
+	res.dsIntervalSec = 60
+
+	for tsid, grpID := range map[uint64]string{1: "latency{job:a,instance:x", 2: "latency{job:a,instance:y", 3: "latency{job:b,instance:x"} {
+		tsGroupId := &bytebufferpool.ByteBuffer{}
+		_, err := tsGroupId.WriteString(grpID)
+		assert.Nil(t, err)
+
+		samples := make([]histogram.Sample, 0)
+		for i := uint32(0); i <= 4; i++ {
+			samples = append(samples, histogram.Sample{Ts: i * 30, H: getNativeTestHistogram(float64(tsid) * float64(i*30))})
+		}
+		res.AddHistogramSamples(tsid, tsGroupId, samples)
+	}
+	return res
+}
+
+func Test_ApplyNativeHistogramChain_RateAndSum(t *testing.T) {
+	res := getNativeHistogramResult(t)
+	assert.True(t, res.HasNativeHistograms())
+
+	// histogram_count(sum by (job) (rate(latency[60s])))
+	mQuery := &structs.MetricsQuery{
+		FirstAggregator: structs.Aggregation{AggregatorFunction: sutils.Avg, Without: true},
+		SubsequentAggs: &structs.MetricQueryAgg{
+			AggBlockType:  structs.FunctionBlock,
+			FunctionBlock: &structs.Function{FunctionType: structs.RangeFunction, RangeFunction: sutils.Rate, TimeWindow: 60},
+			Next: &structs.MetricQueryAgg{
+				AggBlockType:    structs.AggregatorBlock,
+				AggregatorBlock: &structs.Aggregation{AggregatorFunction: sutils.Sum, GroupByFields: []string{"job"}},
+				Next: &structs.MetricQueryAgg{
+					AggBlockType:  structs.FunctionBlock,
+					FunctionBlock: &structs.Function{FunctionType: structs.HistogramFunction, HistogramFunction: &structs.HistogramAgg{Function: sutils.HistogramCount}},
+				},
+			},
+		},
+	}
+
+	err := res.ApplyNativeHistogramChain(mQuery, &dtypeutils.MetricsTimeRange{StartEpochSec: 60, EndEpochSec: 120})
+	assert.Nil(t, err)
+	assert.Nil(t, mQuery.SubsequentAggs)
+	assert.False(t, res.HasNativeHistograms())
+
+	// every series grows by 4 * tsid observations per second
+	assert.Equal(t, map[string]map[uint32]float64{
+		"latency{job:a": {60: 12, 120: 12},
+		"latency{job:b": {60: 12, 120: 12},
+	}, res.Results)
+}
+
+func Test_ApplyNativeHistogramChain_Quantile(t *testing.T) {
+	res := getNativeHistogramResult(t)
+	res.IsInstantQuery = true
+
+	// abs(histogram_quantile(0.625, latency))
+	mQuery := &structs.MetricsQuery{
+		FirstAggregator: structs.Aggregation{AggregatorFunction: sutils.Avg, Without: true},
+		SubsequentAggs: &structs.MetricQueryAgg{
+			AggBlockType:  structs.FunctionBlock,
+			FunctionBlock: &structs.Function{FunctionType: structs.HistogramFunction, HistogramFunction: &structs.HistogramAgg{Function: sutils.HistogramQuantile, Quantile: 0.625}},
+			Next: &structs.MetricQueryAgg{
+				AggBlockType:  structs.FunctionBlock,
+				FunctionBlock: &structs.Function{MathFunction: sutils.Abs},
+			},
+		},
+	}
+
+	err := res.ApplyNativeHistogramChain(mQuery, &dtypeutils.MetricsTimeRange{StartEpochSec: 0, EndEpochSec: 100})
+	assert.Nil(t, err)
+	assert.Equal(t, sutils.Abs, mQuery.SubsequentAggs.FunctionBlock.MathFunction)
+
+	// the latest sample is at 90, and half of the (1, 2] bucket is below the rank
+	assert.Len(t, res.Results, 3)
+	for _, tsToVal := range res.Results {
+		assert.Equal(t, map[uint32]float64{100: 1.5}, tsToVal)
+	}
+}
+
+func Test_ApplyNativeHistogramChain_Unsupported(t *testing.T) {
+	res := getNativeHistogramResult(t)
+
+	mQuery := &structs.MetricsQuery{
+		FirstAggregator: structs.Aggregation{AggregatorFunction: sutils.Max},
+		SubsequentAggs: &structs.MetricQueryAgg{
+			AggBlockType:  structs.FunctionBlock,
+			FunctionBlock: &structs.Function{FunctionType: structs.HistogramFunction, HistogramFunction: &structs.HistogramAgg{Function: sutils.HistogramSum}},
+		},
+	}
+
+	err := res.ApplyNativeHistogramChain(mQuery, &dtypeutils.MetricsTimeRange{StartEpochSec: 0, EndEpochSec: 100})
+	assert.NotNil(t, err)
+	assert.NotNil(t, mQuery.SubsequentAggs)
+}
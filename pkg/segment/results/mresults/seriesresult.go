@@ -27,6 +27,7 @@ import (
 	"time"
 
 	"github.com/nethruster/go-fraction"
+	"github.com/prometheus/prometheus/model/value"
 	"github.com/siglens/siglens/pkg/common/dtypeutils"
 	"github.com/siglens/siglens/pkg/segment/structs"
 	sutils "github.com/siglens/siglens/pkg/segment/utils"
@@ -49,6 +50,10 @@ type Series struct {
 	// If the original Downsampler Aggregator is Avg, the convertedDownsampleAggFn is set to Sum; otherwise, it is set to the original Downsampler Aggregator.
 	convertedDownsampleAggFn sutils.AggregateFunctions
 	aggregationConstant      float64
+
+	// Set for instant queries without a range function, where a staleness
+	// marker as the latest datapoint means the series has no value.
+	dropIfStale bool
 }
 
 type DownsampleSeries struct {
@@ -71,6 +76,7 @@ type RunningEntry struct {
 
 type Entry struct {
 	downsampledTime uint32
+	count           uint32 // number of samples that dpVal summarizes, e.g. the sum of a rollup bucket
 	dpVal           float64
 }
 
@@ -92,17 +98,22 @@ func InitSeriesHolder(mQuery *structs.MetricsQuery, tsGroupId *bytebufferpool.By
 		convertedDownsampleAggFn = sutils.Sum
 	}
 	aggregationConstant := mQuery.FirstAggregator.FuncConstant
+	dsSeconds := uint32(1)
+	if !mQuery.RawSamples {
+		dsSeconds = ds.GetIntervalTimeInSeconds()
+	}
 
 	retVal := make([]Entry, initial_len, extend_capacity)
 	return &Series{
 		idx:                      0,
 		len:                      initial_len,
 		entries:                  retVal,
-		dsSeconds:                ds.GetIntervalTimeInSeconds(),
+		dsSeconds:                dsSeconds,
 		sorted:                   false,
 		convertedDownsampleAggFn: convertedDownsampleAggFn,
 		aggregationConstant:      aggregationConstant,
 		grpID:                    tsGroupId,
+		dropIfStale:              mQuery.IsInstantQuery && mQuery.LookBackToInclude == 0,
 	}
 }
 
@@ -117,7 +128,17 @@ func (s *Series) GetIdx() int {
 }
 
 func (s *Series) AddEntry(ts uint32, dp float64) {
+	s.AddSummaryEntry(ts, dp, 1)
+}
+
+/*
+Adds a value that summarizes count samples, like the sum of a rollup bucket
+when the downsample aggregation is Avg, so that the average is weighted by the
+number of samples rather than by the number of entries.
+*/
+func (s *Series) AddSummaryEntry(ts uint32, dp float64, count uint32) {
 	s.entries[s.idx].downsampledTime = (ts / s.dsSeconds) * s.dsSeconds
+	s.entries[s.idx].count = count
 	s.entries[s.idx].dpVal = dp
 	s.idx++
 	if s.idx >= s.len {
@@ -156,9 +177,36 @@ func (s *Series) Merge(toJoin *Series) error {
 	return nil
 }
 
+/*
+Removes the staleness markers, which end a series at their time but are not
+values. If dropIfStale is set and the latest datapoint is a marker, every
+datapoint is removed. The entries must be sorted.
+*/
+func (s *Series) removeStaleMarkers() {
+	if s.idx > 0 && s.dropIfStale && value.IsStaleNaN(s.entries[s.idx-1].dpVal) {
+		s.entries = s.entries[:0]
+		s.idx = 0
+		s.len = 0
+		return
+	}
+
+	kept := 0
+	for i := 0; i < s.idx; i++ {
+		if value.IsStaleNaN(s.entries[i].dpVal) {
+			continue
+		}
+		s.entries[kept] = s.entries[i]
+		kept++
+	}
+	s.entries = s.entries[:kept]
+	s.idx = kept
+	s.len = kept
+}
+
 func (s *Series) Downsample(downsampler structs.Downsampler) (*DownsampleSeries, error) {
 	// get downsampled series
 	s.sortEntries()
+	s.removeStaleMarkers()
 	ds := initDownsampleSeries(downsampler.Aggregator)
 	for i := 0; i < s.idx; i++ {
 		currDSTime := s.entries[i].downsampledTime
@@ -170,7 +218,11 @@ func (s *Series) Downsample(downsampler structs.Downsampler) (*DownsampleSeries,
 			log.Errorf("Downsample: failed to reduce entries: %v by using this operator: %v, err: %v", s.entries[i:maxJ], s.convertedDownsampleAggFn, err)
 			return nil, err
 		}
-		ds.Add(retVal, s.entries[i].downsampledTime, uint64(maxJ-i))
+		count := uint64(0)
+		for j := i; j < maxJ; j++ {
+			count += uint64(s.entries[j].count)
+		}
+		ds.Add(retVal, s.entries[i].downsampledTime, count)
 		i = maxJ - 1
 	}
 	ds.grpID = s.grpID
@@ -668,6 +720,40 @@ func ApplyRangeFunction(ts map[uint32]float64, function structs.Function, timeRa
 			ts[sortedTimeSeries[i].downsampledTime] = prefixSum[i] - prefixSum[preIndex]
 		}
 		return ts, nil
+	case sutils.Holt_Winters:
+		if len(function.ValueList) != 2 {
+			return ts, fmt.Errorf("ApplyRangeFunction: holt_winters has incorrect parameters: %v", function.ValueList)
+		}
+		smoothingFactor, err := strconv.ParseFloat(function.ValueList[0], 64)
+		if err != nil {
+			return ts, fmt.Errorf("ApplyRangeFunction: holt_winters has incorrect parameters: %v, err: %v", function.ValueList, err)
+		}
+		trendFactor, err := strconv.ParseFloat(function.ValueList[1], 64)
+		if err != nil {
+			return ts, fmt.Errorf("ApplyRangeFunction: holt_winters has incorrect parameters: %v, err: %v", function.ValueList, err)
+		}
+		if smoothingFactor <= 0 || smoothingFactor >= 1 {
+			return ts, fmt.Errorf("ApplyRangeFunction: holt_winters smoothing factor must be between 0 and 1, got: %v", smoothingFactor)
+		}
+		if trendFactor <= 0 || trendFactor >= 1 {
+			return ts, fmt.Errorf("ApplyRangeFunction: holt_winters trend factor must be between 0 and 1, got: %v", trendFactor)
+		}
+
+		for i := 1; i < len(sortedTimeSeries); i++ {
+			timeWindowStartTime := sortedTimeSeries[i].downsampledTime - timeWindow
+			preIndex := sort.Search(len(sortedTimeSeries), func(j int) bool {
+				return sortedTimeSeries[j].downsampledTime >= timeWindowStartTime
+			})
+
+			if i <= preIndex { // Need at least two points within the time window
+				delete(ts, sortedTimeSeries[i].downsampledTime)
+				continue
+			}
+
+			ts[sortedTimeSeries[i].downsampledTime] = evaluateHoltWinters(sortedTimeSeries[preIndex:i+1], smoothingFactor, trendFactor)
+		}
+		delete(ts, sortedTimeSeries[0].downsampledTime)
+		return ts, nil
 	case sutils.Avg_Over_Time, sutils.Min_Over_Time, sutils.Max_Over_Time, sutils.Sum_Over_Time, sutils.Count_Over_Time, sutils.Last_Over_Time:
 		return evaluateAggregationOverTime(sortedTimeSeries, ts, function, timeRange)
 	case sutils.Stdvar_Over_Time:
@@ -850,6 +936,25 @@ func evaluateMADOverTime(sortedTimeSeries []Entry, ts map[uint32]float64, timeWi
 	return ts
 }
 
+// Double exponential smoothing, which is what holt_winters computes in
+// Prometheus. Returns the smoothed value at the last entry. The entries must
+// be sorted and there must be at least two of them.
+func evaluateHoltWinters(entries []Entry, smoothingFactor, trendFactor float64) float64 {
+	var prevSmoothed float64
+	smoothed := entries[0].dpVal
+	trend := entries[1].dpVal - entries[0].dpVal
+
+	for i := 1; i < len(entries); i++ {
+		if i > 1 {
+			trend = trendFactor*(smoothed-prevSmoothed) + (1-trendFactor)*trend
+		}
+		prevSmoothed = smoothed
+		smoothed = smoothingFactor*entries[i].dpVal + (1-smoothingFactor)*(smoothed+trend)
+	}
+
+	return smoothed
+}
+
 // Median Calculation
 func computeMedian(values []float64) float64 {
 	sort.Float64s(values)
@@ -886,7 +991,9 @@ func reduceEntries(entries []Entry, fn sutils.AggregateFunctions, fnConstant flo
 				ret = entries[i].dpVal
 			}
 		}
-	case sutils.TopK:
+	case sutils.TopK, sutils.CountValues, sutils.LimitK:
+		// count_values and limitk need a single value per bucket; like topk,
+		// use the max of the bucket.
 		fallthrough
 	case sutils.Max:
 		for i := range entries {
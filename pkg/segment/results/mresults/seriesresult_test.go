@@ -23,6 +23,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/prometheus/model/value"
 	"github.com/siglens/siglens/pkg/common/dtypeutils"
 	"github.com/siglens/siglens/pkg/segment/structs"
 	sutils "github.com/siglens/siglens/pkg/segment/utils"
@@ -434,6 +435,34 @@ func Test_applyRangeFunctionChanges(t *testing.T) {
 	assert.Equal(t, float64(0), val)
 }
 
+func Test_applyRangeFunctionHoltWinters(t *testing.T) {
+	timeSeries := map[uint32]float64{
+		1000: 1.0,
+		1001: 3.0,
+		1002: 4.0,
+		1020: 10.0,
+	}
+
+	timeRange := &dtypeutils.MetricsTimeRange{
+		StartEpochSec: uint32(1000),
+		EndEpochSec:   uint32(1020),
+	}
+
+	function := structs.Function{RangeFunction: sutils.Holt_Winters, TimeWindow: 10, ValueList: []string{"0.5", "0.5"}}
+	res, err := ApplyRangeFunction(timeSeries, function, timeRange)
+	assert.Nil(t, err)
+
+	// The first point and the point without another point in its window are dropped.
+	assert.Len(t, res, 2)
+	assert.Equal(t, float64(3), res[1001])
+	assert.Equal(t, float64(4.5), res[1002])
+
+	timeSeries = map[uint32]float64{1000: 1.0, 1001: 3.0}
+	function.ValueList = []string{"1", "0.5"}
+	_, err = ApplyRangeFunction(timeSeries, function, timeRange)
+	assert.NotNil(t, err)
+}
+
 func Test_applyRangeFunctionResets(t *testing.T) {
 	timeSeries := map[uint32]float64{
 		1000: 5.0,
@@ -2026,3 +2055,39 @@ func Test_applyLabelReplace(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, expectedSeriesId, seriesId)
 }
+
+func Test_Downsample_StaleMarkers(t *testing.T) {
+	staleNaN := math.Float64frombits(value.StaleNaN)
+	mQuery := &structs.MetricsQuery{
+		Downsampler: structs.Downsampler{Interval: 1, Unit: "s", Aggregator: structs.Aggregation{AggregatorFunction: sutils.Avg}},
+	}
+
+	// A range query keeps the datapoints around the marker.
+	series := InitSeriesHolder(mQuery, nil)
+	series.AddEntry(10, 1)
+	series.AddEntry(20, staleNaN)
+	series.AddEntry(30, 3)
+	dsSeries, err := series.Downsample(mQuery.Downsampler)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, dsSeries.idx)
+	assert.Equal(t, float64(1), dsSeries.runningEntries[0].runningVal)
+	assert.Equal(t, float64(3), dsSeries.runningEntries[1].runningVal)
+
+	// An instant query has no value for a series whose latest datapoint is a marker.
+	mQuery.IsInstantQuery = true
+	series = InitSeriesHolder(mQuery, nil)
+	series.AddEntry(10, 1)
+	series.AddEntry(20, staleNaN)
+	dsSeries, err = series.Downsample(mQuery.Downsampler)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, dsSeries.idx)
+
+	// Unless it is read by a range function.
+	mQuery.LookBackToInclude = 300
+	series = InitSeriesHolder(mQuery, nil)
+	series.AddEntry(10, 1)
+	series.AddEntry(20, staleNaN)
+	dsSeries, err = series.Downsample(mQuery.Downsampler)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, dsSeries.idx)
+}
@@ -0,0 +1,280 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mresults
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/siglens/siglens/pkg/common/dtypeutils"
+	"github.com/siglens/siglens/pkg/segment/structs"
+	sutils "github.com/siglens/siglens/pkg/segment/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+func (r *MetricsResult) ApplyVectorFunctionToResults(function structs.Function, timeRange *dtypeutils.MetricsTimeRange) error {
+	if function.VectorFunction == nil {
+		log.Errorf("ApplyVectorFunctionToResults: VectorFunction is nil")
+		return fmt.Errorf("nil vector function")
+	}
+
+	switch function.VectorFunction.Function {
+	case sutils.Absent:
+		r.applyAbsent(function.VectorFunction.Labels, 0, timeRange)
+	case sutils.Absent_Over_Time:
+		r.applyAbsent(function.VectorFunction.Labels, uint32(function.TimeWindow), timeRange)
+	case sutils.Sort, sutils.Sort_Desc:
+		// The order only matters for the instant query response, which is
+		// built from the map of results; so just remember it.
+		r.sortFunction = function.VectorFunction.Function
+	case sutils.Scalar:
+		r.applyScalar(timeRange)
+	default:
+		return fmt.Errorf("ApplyVectorFunctionToResults: unsupported function %v", function.VectorFunction.Function)
+	}
+
+	r.DsResults = nil
+
+	return nil
+}
+
+// Returns the timestamps the query is evaluated at. Instant queries are only
+// evaluated at the end of the time range; range queries at every downsampled
+// bucket in the time range.
+func (r *MetricsResult) getStepTimestamps(timeRange *dtypeutils.MetricsTimeRange) []uint32 {
+	if r.IsInstantQuery || r.dsIntervalSec == 0 {
+		return []uint32{timeRange.EndEpochSec}
+	}
+
+	step := r.dsIntervalSec
+	timestamps := make([]uint32, 0, (timeRange.EndEpochSec-timeRange.StartEpochSec)/step+1)
+	for ts := (timeRange.StartEpochSec / step) * step; ts <= timeRange.EndEpochSec; ts += step {
+		timestamps = append(timestamps, ts)
+	}
+	return timestamps
+}
+
+// Replaces the results with a single series that is 1 at the timestamps where
+// no series has a point within (ts - timeWindow, ts]. A timeWindow of zero is
+// absent() rather than absent_over_time(): an instant query then checks the
+// whole lookback, and a range query checks the bucket of the timestamp.
+func (r *MetricsResult) applyAbsent(labels map[string]string, timeWindow uint32, timeRange *dtypeutils.MetricsTimeRange) {
+	uniqueTimestamps := make(map[uint32]struct{})
+	for _, timeSeries := range r.Results {
+		for ts := range timeSeries {
+			uniqueTimestamps[ts] = struct{}{}
+		}
+	}
+	presentTimestamps := make([]uint32, 0, len(uniqueTimestamps))
+	for ts := range uniqueTimestamps {
+		presentTimestamps = append(presentTimestamps, ts)
+	}
+	sort.Slice(presentTimestamps, func(i, j int) bool {
+		return presentTimestamps[i] < presentTimestamps[j]
+	})
+
+	if timeWindow == 0 {
+		if r.IsInstantQuery || r.dsIntervalSec == 0 {
+			timeWindow = timeRange.EndEpochSec - timeRange.StartEpochSec + 1
+		} else {
+			timeWindow = r.dsIntervalSec
+		}
+	}
+
+	absentValues := make(map[uint32]float64)
+	for _, ts := range r.getStepTimestamps(timeRange) {
+		windowStart := int64(ts) - int64(timeWindow)
+		idx := sort.Search(len(presentTimestamps), func(i int) bool {
+			return int64(presentTimestamps[i]) > windowStart
+		})
+		if idx < len(presentTimestamps) && presentTimestamps[idx] <= ts {
+			continue
+		}
+		absentValues[ts] = 1
+	}
+
+	r.Results = make(map[string]map[uint32]float64)
+	if len(absentValues) > 0 {
+		r.Results[getSeriesIdFromLabels(labels)] = absentValues
+	}
+	r.State = AGGREGATED
+}
+
+// Replaces the results with a single series without labels that has the value
+// of the only series at each timestamp, or NaN if there is not exactly one.
+func (r *MetricsResult) applyScalar(timeRange *dtypeutils.MetricsTimeRange) {
+	scalarValues := make(map[uint32]float64)
+
+	if r.IsInstantQuery || r.dsIntervalSec == 0 {
+		// The instant query uses the latest point of each series.
+		value := math.NaN()
+		numSeries := 0
+		for _, timeSeries := range r.Results {
+			latestValue, ok := getLatestValue(timeSeries)
+			if ok {
+				numSeries++
+				value = latestValue
+			}
+		}
+		if numSeries != 1 {
+			value = math.NaN()
+		}
+		scalarValues[timeRange.EndEpochSec] = value
+		r.ScalarValue = value
+	} else {
+		for _, ts := range r.getStepTimestamps(timeRange) {
+			value := math.NaN()
+			numSeries := 0
+			for _, timeSeries := range r.Results {
+				if val, ok := timeSeries[ts]; ok {
+					numSeries++
+					value = val
+				}
+			}
+			if numSeries != 1 {
+				value = math.NaN()
+			}
+			scalarValues[ts] = value
+		}
+	}
+
+	r.Results = map[string]map[uint32]float64{"{": scalarValues}
+	r.State = AGGREGATED
+}
+
+// Sets the results to a single series without labels that has the given value
+// at every step of the time range.
+func (r *MetricsResult) SetConstantVector(value float64, ds structs.Downsampler, timeRange *dtypeutils.MetricsTimeRange) {
+	r.dsIntervalSec = ds.GetIntervalTimeInSeconds()
+
+	values := make(map[uint32]float64)
+	for _, ts := range r.getStepTimestamps(timeRange) {
+		values[ts] = value
+	}
+
+	r.Results = map[string]map[uint32]float64{"{": values}
+	r.DsResults = nil
+	r.State = AGGREGATED
+}
+
+// Moves every point of the results by offset seconds. Points that would fall
+// outside the uint32 range are dropped.
+func (r *MetricsResult) ShiftTimestamps(offset int64) {
+	if offset == 0 {
+		return
+	}
+
+	for seriesId, timeSeries := range r.Results {
+		shifted := make(map[uint32]float64, len(timeSeries))
+		for ts, val := range timeSeries {
+			newTs := int64(ts) + offset
+			if newTs < 0 || newTs > math.MaxUint32 {
+				continue
+			}
+			shifted[uint32(newTs)] = val
+		}
+		r.Results[seriesId] = shifted
+	}
+}
+
+// Replaces the points of each series with its latest point, repeated at every
+// step of the time range. This is used for the @ modifier, where the query is
+// evaluated at a fixed time regardless of the step.
+func (r *MetricsResult) FillStepsWithLatestValue(timeRange *dtypeutils.MetricsTimeRange) {
+	timestamps := r.getStepTimestamps(timeRange)
+
+	for seriesId, timeSeries := range r.Results {
+		latestValue, ok := getLatestValue(timeSeries)
+		if !ok {
+			delete(r.Results, seriesId)
+			continue
+		}
+
+		filled := make(map[uint32]float64, len(timestamps))
+		for _, ts := range timestamps {
+			filled[ts] = latestValue
+		}
+		r.Results[seriesId] = filled
+	}
+}
+
+func getLatestValue(timeSeries map[uint32]float64) (float64, bool) {
+	latestTime := uint32(0)
+	latestValue := float64(0)
+	found := false
+	for ts, val := range timeSeries {
+		if !found || ts > latestTime {
+			latestTime = ts
+			latestValue = val
+			found = true
+		}
+	}
+	return latestValue, found
+}
+
+// Returns a series id without a metric name, in the "{key1:value1,key2:value2,"
+// format, with the labels sorted by name.
+func getSeriesIdFromLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString("{")
+	for _, key := range keys {
+		sb.WriteString(key)
+		sb.WriteString(":")
+		sb.WriteString(labels[key])
+		sb.WriteString(",")
+	}
+	return sb.String()
+}
+
+// Sorts the instant vector by value, like sort() and sort_desc(). NaN values
+// are always placed last.
+type sortableVectorResult struct {
+	results []structs.InstantVectorResult
+	values  []float64
+	desc    bool
+}
+
+func (s *sortableVectorResult) Len() int {
+	return len(s.results)
+}
+
+func (s *sortableVectorResult) Less(i, j int) bool {
+	if math.IsNaN(s.values[i]) {
+		return false
+	}
+	if math.IsNaN(s.values[j]) {
+		return true
+	}
+	if s.desc {
+		return s.values[i] > s.values[j]
+	}
+	return s.values[i] < s.values[j]
+}
+
+func (s *sortableVectorResult) Swap(i, j int) {
+	s.results[i], s.results[j] = s.results[j], s.results[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mresults
+
+import (
+	"math"
+	"testing"
+
+	parser "github.com/prometheus/prometheus/promql/parser"
+	dtu "github.com/siglens/siglens/pkg/common/dtypeutils"
+	"github.com/siglens/siglens/pkg/segment/structs"
+	sutils "github.com/siglens/siglens/pkg/segment/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ApplyVectorFunctionToResults_Absent_RangeQuery(t *testing.T) {
+	mResult := &MetricsResult{
+		State:         AGGREGATED,
+		dsIntervalSec: 10,
+		Results: map[string]map[uint32]float64{
+			"test{job:a,": {100: 1, 110: 1},
+			"test{job:b,": {110: 2, 130: 2},
+		},
+	}
+	timeRange := &dtu.MetricsTimeRange{StartEpochSec: 100, EndEpochSec: 140}
+
+	function := structs.Function{
+		FunctionType:   structs.VectorFunction,
+		VectorFunction: &structs.VectorFunctionExpr{Function: sutils.Absent, Labels: map[string]string{"job": "a"}},
+	}
+	err := mResult.ApplyVectorFunctionToResults(function, timeRange)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]map[uint32]float64{"{job:a,": {120: 1, 140: 1}}, mResult.Results)
+	assert.Equal(t, map[string]string{"job": "a"}, GetPromQLSeriesFormat("{job:a,"))
+}
+
+func Test_ApplyVectorFunctionToResults_Absent_InstantQuery(t *testing.T) {
+	timeRange := &dtu.MetricsTimeRange{StartEpochSec: 100, EndEpochSec: 400}
+	function := structs.Function{
+		FunctionType:   structs.VectorFunction,
+		VectorFunction: &structs.VectorFunctionExpr{Function: sutils.Absent},
+	}
+
+	mResult := &MetricsResult{
+		State:          AGGREGATED,
+		IsInstantQuery: true,
+		Results:        map[string]map[uint32]float64{"test{job:a,": {120: 1}},
+	}
+	err := mResult.ApplyVectorFunctionToResults(function, timeRange)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(mResult.Results))
+
+	mResult = &MetricsResult{
+		State:          AGGREGATED,
+		IsInstantQuery: true,
+		Results:        map[string]map[uint32]float64{},
+	}
+	err = mResult.ApplyVectorFunctionToResults(function, timeRange)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]map[uint32]float64{"{": {400: 1}}, mResult.Results)
+	assert.Equal(t, map[string]string{}, GetPromQLSeriesFormat("{"))
+}
+
+func Test_ApplyVectorFunctionToResults_AbsentOverTime(t *testing.T) {
+	mResult := &MetricsResult{
+		State:         AGGREGATED,
+		dsIntervalSec: 60,
+		Results: map[string]map[uint32]float64{
+			"test{job:a,": {60: 1},
+		},
+	}
+	timeRange := &dtu.MetricsTimeRange{StartEpochSec: 60, EndEpochSec: 300}
+
+	function := structs.Function{
+		FunctionType:   structs.VectorFunction,
+		TimeWindow:     120,
+		VectorFunction: &structs.VectorFunctionExpr{Function: sutils.Absent_Over_Time},
+	}
+	err := mResult.ApplyVectorFunctionToResults(function, timeRange)
+	assert.Nil(t, err)
+	// The point at 60 is in the window of 60 and 120, but not of 180.
+	assert.Equal(t, map[string]map[uint32]float64{"{": {180: 1, 240: 1, 300: 1}}, mResult.Results)
+}
+
+func Test_ApplyVectorFunctionToResults_Scalar(t *testing.T) {
+	mResult := &MetricsResult{
+		State:         AGGREGATED,
+		dsIntervalSec: 10,
+		Results: map[string]map[uint32]float64{
+			"test{job:a,": {10: 1, 20: 2},
+			"test{job:b,": {20: 3, 30: 4},
+		},
+	}
+	timeRange := &dtu.MetricsTimeRange{StartEpochSec: 10, EndEpochSec: 40}
+
+	function := structs.Function{
+		FunctionType:   structs.VectorFunction,
+		VectorFunction: &structs.VectorFunctionExpr{Function: sutils.Scalar},
+	}
+	err := mResult.ApplyVectorFunctionToResults(function, timeRange)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(mResult.Results))
+	values := mResult.Results["{"]
+	assert.Equal(t, 4, len(values))
+	assert.Equal(t, 1.0, values[10])
+	assert.True(t, math.IsNaN(values[20]))
+	assert.Equal(t, 4.0, values[30])
+	assert.True(t, math.IsNaN(values[40]))
+
+	mResult = &MetricsResult{
+		State:          AGGREGATED,
+		IsInstantQuery: true,
+		Results:        map[string]map[uint32]float64{"test{job:a,": {10: 1, 20: 2}},
+	}
+	err = mResult.ApplyVectorFunctionToResults(function, timeRange)
+	assert.Nil(t, err)
+	assert.Equal(t, 2.0, mResult.ScalarValue)
+	assert.Equal(t, map[string]map[uint32]float64{"{": {40: 2}}, mResult.Results)
+}
+
+func Test_ApplyVectorFunctionToResults_Sort(t *testing.T) {
+	for _, vectorFunction := range []sutils.VectorFunctions{sutils.Sort, sutils.Sort_Desc} {
+		mResult := &MetricsResult{
+			State: AGGREGATED,
+			Results: map[string]map[uint32]float64{
+				"test{job:a,": {10: 3},
+				"test{job:b,": {10: math.NaN()},
+				"test{job:c,": {10: 1},
+				"test{job:d,": {10: 2},
+			},
+		}
+
+		function := structs.Function{
+			FunctionType:   structs.VectorFunction,
+			VectorFunction: &structs.VectorFunctionExpr{Function: vectorFunction},
+		}
+		err := mResult.ApplyVectorFunctionToResults(function, &dtu.MetricsTimeRange{StartEpochSec: 0, EndEpochSec: 10})
+		assert.Nil(t, err)
+
+		response, err := mResult.GetResultsPromQlInstantQuery(parser.ValueTypeVector, 10)
+		assert.Nil(t, err)
+		jobs := make([]string, 0)
+		for _, result := range response.Data.VectorResult {
+			jobs = append(jobs, result.Metric["job"])
+		}
+
+		if vectorFunction == sutils.Sort {
+			assert.Equal(t, []string{"c", "d", "a", "b"}, jobs)
+		} else {
+			assert.Equal(t, []string{"a", "d", "c", "b"}, jobs)
+		}
+	}
+}
+
+func Test_SetConstantVector(t *testing.T) {
+	ds := structs.Downsampler{Interval: 30, Unit: "s"}
+	timeRange := &dtu.MetricsTimeRange{StartEpochSec: 100, EndEpochSec: 200}
+
+	mResult := &MetricsResult{}
+	mResult.SetConstantVector(5, ds, timeRange)
+	assert.Equal(t, AGGREGATED, mResult.State)
+	assert.Equal(t, map[string]map[uint32]float64{"{": {90: 5, 120: 5, 150: 5, 180: 5}}, mResult.Results)
+
+	mResult = &MetricsResult{IsInstantQuery: true}
+	mResult.SetConstantVector(5, ds, timeRange)
+	assert.Equal(t, map[string]map[uint32]float64{"{": {200: 5}}, mResult.Results)
+}
+
+func Test_ShiftTimestamps(t *testing.T) {
+	mResult := &MetricsResult{
+		Results: map[string]map[uint32]float64{
+			"test{job:a,": {100: 1, 200: 2},
+		},
+	}
+
+	mResult.ShiftTimestamps(604800)
+	assert.Equal(t, map[string]map[uint32]float64{"test{job:a,": {604900: 1, 605000: 2}}, mResult.Results)
+
+	mResult.ShiftTimestamps(-604850)
+	assert.Equal(t, map[string]map[uint32]float64{"test{job:a,": {50: 1, 150: 2}}, mResult.Results)
+
+	mResult.ShiftTimestamps(-100)
+	assert.Equal(t, map[string]map[uint32]float64{"test{job:a,": {50: 2}}, mResult.Results)
+}
+
+func Test_FillStepsWithLatestValue(t *testing.T) {
+	mResult := &MetricsResult{
+		dsIntervalSec: 60,
+		Results: map[string]map[uint32]float64{
+			"test{job:a,": {1000: 1, 1060: 2},
+			"test{job:b,": {},
+		},
+	}
+
+	mResult.FillStepsWithLatestValue(&dtu.MetricsTimeRange{StartEpochSec: 60, EndEpochSec: 180})
+	assert.Equal(t, map[string]map[uint32]float64{"test{job:a,": {60: 2, 120: 2, 180: 2}}, mResult.Results)
+}
@@ -20,10 +20,12 @@ package search
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"sync"
 	"time"
 
 	dtu "github.com/siglens/siglens/pkg/common/dtypeutils"
+	"github.com/siglens/siglens/pkg/instrumentation"
 	"github.com/siglens/siglens/pkg/segment/memory/limit"
 	"github.com/siglens/siglens/pkg/segment/query/summary"
 	"github.com/siglens/siglens/pkg/segment/reader/metrics/series"
@@ -32,6 +34,8 @@ import (
 	"github.com/siglens/siglens/pkg/segment/structs"
 	sutils "github.com/siglens/siglens/pkg/segment/utils"
 	"github.com/siglens/siglens/pkg/segment/writer/metrics"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/histogram"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/rollup"
 	"github.com/siglens/siglens/pkg/utils/semaphore"
 	log "github.com/sirupsen/logrus"
 )
@@ -97,19 +101,29 @@ func RawSearchMetricsSegment(mQuery *structs.MetricsQuery, tsidInfo *tsidtracker
 	var wg sync.WaitGroup
 	for i := 0; i < int(req.BlkWorkerParallelism); i++ {
 		wg.Add(1)
-		go blockWorker(i, sharedBlockIterators.TimeSeriesSegmentReadersList[i], blockNumChan, tsidInfo, mQuery, timeRange, res, qid, &wg, querySummary)
+		go blockWorker(i, req.MetricsKeyBaseDir, sharedBlockIterators.TimeSeriesSegmentReadersList[i], blockNumChan, tsidInfo, mQuery, timeRange, res, qid, &wg, querySummary)
 	}
 	wg.Wait()
 }
 
-func blockWorker(workerID int, sharedReader *series.TimeSeriesSegmentReader, blockNumChan <-chan int, tsidInfo *tsidtracker.AllMatchedTSIDs,
+func blockWorker(workerID int, mKey string, sharedReader *series.TimeSeriesSegmentReader, blockNumChan <-chan int, tsidInfo *tsidtracker.AllMatchedTSIDs,
 	mQuery *structs.MetricsQuery, timeRange *dtu.MetricsTimeRange, res *mresults.MetricsResult, qid uint64, wg *sync.WaitGroup, querySummary *summary.QuerySummary) {
 	defer wg.Done()
 	queryMetrics := &structs.MetricsQueryProcessingMetrics{
 		UpdateLock: &sync.Mutex{},
 	}
 	localRes := mresults.InitMetricResults(mQuery, qid)
+	readHistograms := mQuery.HasHistogramFunction()
 	for blockNum := range blockNumChan {
+		if readHistograms {
+			searchHistogramBlock(mKey, uint16(blockNum), tsidInfo, timeRange, localRes, res, qid)
+		}
+
+		if tier, ok := rollup.GetTierForBlock(mKey, uint16(blockNum), mQuery.RollupResolutionSec); ok {
+			searchRollupBlock(mKey, uint16(blockNum), tier, tsidInfo, mQuery, timeRange, localRes, res, queryMetrics, qid)
+			continue
+		}
+
 		tsbr, err := sharedReader.InitReaderForBlock(uint16(blockNum), queryMetrics)
 		if err != nil {
 			log.Errorf("qid=%d, RawSearchMetricsSegment.blockWorker: Error initialising a block reader. Error: %v", qid, err)
@@ -156,3 +170,96 @@ func blockWorker(workerID int, sharedReader *series.TimeSeriesSegmentReader, blo
 	queryMetrics.IncrementNumMetricsSegmentsSearched(1)
 	querySummary.UpdateMetricsSummary(queryMetrics)
 }
+
+/*
+Adds one point per rollup bucket of the block to the results. The value of each
+bucket is the summary that matches the downsample aggregation of the query.
+*/
+func searchRollupBlock(mKey string, blkNum uint16, tier rollup.Tier, tsidInfo *tsidtracker.AllMatchedTSIDs, mQuery *structs.MetricsQuery,
+	timeRange *dtu.MetricsTimeRange, localRes *mresults.MetricsResult, res *mresults.MetricsResult, queryMetrics *structs.MetricsQueryProcessingMetrics, qid uint64) {
+
+	brr, err := rollup.InitBlockRollupReader(rollup.GetRollupFileName(mKey, blkNum, tier))
+	if err != nil {
+		log.Errorf("qid=%d, searchRollupBlock: Error initialising the %v rollup reader of block %v of %v. Error: %v", qid, tier.Name, blkNum, mKey, err)
+		res.AddError(err)
+		return
+	}
+	instrumentation.IncrementInt64Counter(instrumentation.METRICS_ROLLUP_BLOCKS_QUERIED, 1)
+
+	downsampleAggFn := mQuery.Downsampler.Aggregator.AggregatorFunction
+	for tsid, tsGroupId := range tsidInfo.GetAllTSIDs() {
+		buckets, found, err := brr.GetBuckets(tsid)
+		queryMetrics.IncrementNumSeriesSearched(1)
+		if err != nil {
+			log.Errorf("qid=%d, searchRollupBlock: Error getting the rollup buckets. Error: %v", qid, err)
+			res.AddError(err)
+			continue
+		}
+		if !found {
+			continue
+		}
+		series := mresults.InitSeriesHolder(mQuery, tsGroupId)
+		addRollupBuckets(series, buckets, timeRange, downsampleAggFn)
+		if series.GetIdx() > 0 {
+			localRes.AddSeries(series, tsid, tsGroupId)
+		}
+	}
+}
+
+/*
+Adds the buckets in the time range to the series. For Avg each bucket adds its
+sum weighted by its count, so the downsampled average is the sum over the count
+of the raw samples, as when the raw datapoints are read.
+*/
+func addRollupBuckets(series *mresults.Series, buckets []rollup.Bucket, timeRange *dtu.MetricsTimeRange, downsampleAggFn sutils.AggregateFunctions) {
+	for i := range buckets {
+		if !timeRange.CheckInRange(buckets[i].Ts) {
+			continue
+		}
+		if downsampleAggFn == sutils.Avg {
+			series.AddSummaryEntry(buckets[i].Ts, buckets[i].Sum, buckets[i].Count)
+			continue
+		}
+		series.AddEntry(buckets[i].Ts, buckets[i].GetValue(downsampleAggFn))
+	}
+}
+
+/*
+Adds the native histogram samples of the block to the results. Blocks without
+native histograms have no histogram file.
+*/
+func searchHistogramBlock(mKey string, blkNum uint16, tsidInfo *tsidtracker.AllMatchedTSIDs, timeRange *dtu.MetricsTimeRange,
+	localRes *mresults.MetricsResult, res *mresults.MetricsResult, qid uint64) {
+
+	fileName := histogram.GetHistogramFileName(mKey, blkNum)
+	if _, err := os.Stat(fileName); err != nil {
+		return
+	}
+
+	bhr, err := histogram.InitBlockHistogramReader(fileName)
+	if err != nil {
+		log.Errorf("qid=%d, searchHistogramBlock: Error initialising the histogram reader of block %v of %v. Error: %v", qid, blkNum, mKey, err)
+		res.AddError(err)
+		return
+	}
+
+	for tsid, tsGroupId := range tsidInfo.GetAllTSIDs() {
+		samples, found, err := bhr.GetSamples(tsid)
+		if err != nil {
+			log.Errorf("qid=%d, searchHistogramBlock: Error getting the histogram samples. Error: %v", qid, err)
+			res.AddError(err)
+			continue
+		}
+		if !found {
+			continue
+		}
+
+		inRange := make([]histogram.Sample, 0, len(samples))
+		for _, sample := range samples {
+			if timeRange.CheckInRange(sample.Ts) {
+				inRange = append(inRange, sample)
+			}
+		}
+		localRes.AddHistogramSamples(tsid, tsGroupId, inRange)
+	}
+}
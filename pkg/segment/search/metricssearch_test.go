@@ -0,0 +1,72 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package search
+
+import (
+	"testing"
+
+	dtu "github.com/siglens/siglens/pkg/common/dtypeutils"
+	"github.com/siglens/siglens/pkg/segment/results/mresults"
+	"github.com/siglens/siglens/pkg/segment/structs"
+	sutils "github.com/siglens/siglens/pkg/segment/utils"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/rollup"
+	"github.com/stretchr/testify/assert"
+)
+
+func downsampleAvg(t *testing.T, mQuery *structs.MetricsQuery, series *mresults.Series) map[uint32]float64 {
+	t.Helper()
+	ds, err := series.Downsample(mQuery.Downsampler)
+	assert.Nil(t, err)
+	values, err := ds.AggregateFromSingleTimeseries()
+	assert.Nil(t, err)
+	return values
+}
+
+func Test_addRollupBuckets_AvgMatchesRawSamples(t *testing.T) {
+	mQuery := &structs.MetricsQuery{
+		Downsampler: structs.Downsampler{
+			Interval:   1,
+			Unit:       "h",
+			Aggregator: structs.Aggregation{AggregatorFunction: sutils.Avg},
+		},
+	}
+	timeRange := &dtu.MetricsTimeRange{StartEpochSec: 0, EndEpochSec: 7200}
+
+	// The 5m buckets have uneven sample counts, so a mean of the bucket means
+	// would differ from the mean of the samples.
+	timestamps := []uint32{0, 10, 20, 30, 40, 300, 3600, 3610, 3900, 3910, 3920}
+	values := []float64{1, 1, 1, 1, 1, 100, 2, 4, 10, 20, 30}
+
+	rawSeries := mresults.InitSeriesHolder(mQuery, nil)
+	for i := range timestamps {
+		rawSeries.AddEntry(timestamps[i], values[i])
+	}
+
+	rollupSeries := mresults.InitSeriesHolder(mQuery, nil)
+	addRollupBuckets(rollupSeries, rollup.ComputeBuckets(timestamps, values, 300), timeRange, sutils.Avg)
+
+	raw := downsampleAvg(t, mQuery, rawSeries)
+	rolledUp := downsampleAvg(t, mQuery, rollupSeries)
+
+	assert.Len(t, rolledUp, len(raw))
+	for ts, expected := range raw {
+		assert.InDelta(t, expected, rolledUp[ts], 1e-9, "ts %v", ts)
+	}
+	assert.InDelta(t, 105.0/6, rolledUp[0], 1e-9)
+	assert.InDelta(t, 66.0/5, rolledUp[3600], 1e-9)
+}
@@ -80,8 +80,35 @@ type MetricsQuery struct {
 	GroupByMetricName   bool // flag to group by metric name
 	AggWithoutGroupBy   bool // flag that indicates aggregation without group by anywhere in the query
 	IsInstantQuery      bool // flag that indicates if the query is an instant query
+	RawSamples          bool // flag to return the raw datapoints of each series, without downsampling or aggregation
+
+	// Set by the PromQL offset modifier, in seconds. The series are read
+	// Offset seconds before the requested time range and the results are
+	// shifted forward by the same amount. Negative offsets look forward.
+	Offset int64
+	// Set by the PromQL @ modifier. The query is evaluated at a single point
+	// in time, and that value is returned for every step of the time range.
+	AtModifier AtModifierType
+	AtEpochSec uint32 // only used when AtModifier is AtTimestamp
+
+	// Set by the PromQL vector(s) function. No series are read and the
+	// result is a single series without labels that has this value.
+	ConstantVector utils.Option[float64]
+
+	// Set by the query planner when rollups are enabled. Rotated blocks are
+	// read from the coarsest rollup tier that is not coarser than this. Zero
+	// means the raw datapoints are read.
+	RollupResolutionSec uint32
 }
 
+type AtModifierType uint8
+
+const (
+	AtTimestamp AtModifierType = iota + 1
+	AtStart
+	AtEnd
+)
+
 // This is used to aggregate multiple things into fewer things. Currently, two
 // use cases:
 // 1. Aggregate multiple series into fewer series (e.g., sum with an optional group by).
@@ -91,6 +118,7 @@ type Aggregation struct {
 	FuncConstant       float64
 	GroupByFields      []string // group by fields will be sorted
 	Without            bool     // if set exclude the above group by fields
+	ValueLabel         string   // for count_values, the label that holds the counted value
 }
 
 type MetricsFunctionType uint8
@@ -101,6 +129,7 @@ const (
 	TimeFunction
 	LabelFunction
 	HistogramFunction
+	VectorFunction
 )
 
 type LabelReplacementKeyType uint8
@@ -138,11 +167,23 @@ type Function struct {
 	TimeFunction      sutils.TimeFunctions
 	LabelFunction     *LabelFunctionExpr
 	HistogramFunction *HistogramAgg
+	VectorFunction    *VectorFunctionExpr
 }
 
 type HistogramAgg struct {
 	Function sutils.HistogramFunctions
 	Quantile float64
+	Lower    float64 // for histogram_fraction
+	Upper    float64 // for histogram_fraction
+}
+
+// Functions that work on all the series of the result at once, like absent
+// and sort, rather than on one series at a time.
+type VectorFunctionExpr struct {
+	Function sutils.VectorFunctions
+	// For absent and absent_over_time, the labels of the series returned when
+	// nothing matches. These come from the equality matchers of the selector.
+	Labels map[string]string
 }
 
 type Downsampler struct {
@@ -582,9 +623,21 @@ func (agg Aggregation) ShallowClone() *Aggregation {
 }
 
 func (agg Aggregation) IsAggregateFromAllTimeseries() bool {
-	return agg.AggregatorFunction == sutils.Count || agg.AggregatorFunction == sutils.Stdvar || agg.AggregatorFunction == sutils.Stddev || agg.AggregatorFunction == sutils.TopK || agg.AggregatorFunction == sutils.BottomK
+	return agg.AggregatorFunction == sutils.Count || agg.AggregatorFunction == sutils.Stdvar || agg.AggregatorFunction == sutils.Stddev || agg.AggregatorFunction == sutils.TopK || agg.AggregatorFunction == sutils.BottomK ||
+		agg.AggregatorFunction == sutils.CountValues || agg.AggregatorFunction == sutils.LimitK
 }
 
 func (mQuery *MetricsQuery) IsRegexOnMetricName() bool {
 	return mQuery.MetricOperator == sutils.Regex || mQuery.MetricOperator == sutils.NegRegex
 }
+
+// Returns whether the rest of the query applies a histogram function, in which
+// case the native histogram samples of the matched series are read too.
+func (mQuery *MetricsQuery) HasHistogramFunction() bool {
+	for agg := mQuery.SubsequentAggs; agg != nil; agg = agg.Next {
+		if agg.AggBlockType == FunctionBlock && agg.FunctionBlock != nil && agg.FunctionBlock.FunctionType == HistogramFunction {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,476 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package depgraph maintains the caller -> callee edges of the service
+// dependency graph incrementally from the ingested spans. Edges are kept in
+// fixed time buckets and written to the EDGES_INDEX_NAME index once a bucket
+// is complete, so the graph of any time range can be computed by merging the
+// buckets within it.
+package depgraph
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/es/writer"
+	segwriter "github.com/siglens/siglens/pkg/segment/writer"
+	"github.com/siglens/siglens/pkg/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const EDGES_INDEX_NAME = "service-dependency-edges"
+const BUCKET_SIZE_MS = 60_000
+
+// Sum the edge records of the edges index per edge, and the latency bin
+// records per edge and bin.
+const EDGE_COUNTS_QUERY = "call_count=* | stats sum(call_count) AS call_count, sum(error_count) AS error_count BY caller, callee"
+const EDGE_LATENCY_QUERY = "latency_bin=* | stats sum(bin_count) AS bin_count BY caller, callee, latency_bin"
+
+// Buckets this far behind the current time are considered complete and are
+// flushed; spans that arrive later for a flushed bucket go into a new record
+// for the same bucket, which is merged at query time.
+const flushDelayMs = 2 * BUCKET_SIZE_MS
+
+// Spans and children waiting for their parent are remembered for one to two
+// generations, so parents that arrive in a later request are still matched.
+const spanCacheGeneration = 5 * time.Minute
+
+type SpanInfo struct {
+	TraceId      string
+	SpanId       string
+	ParentSpanId string
+	Service      string
+	StartTimeNs  uint64
+	DurationNs   uint64
+	IsError      bool
+}
+
+type EdgeKey struct {
+	Caller string
+	Callee string
+}
+
+type EdgeStats struct {
+	CallCount  uint64
+	ErrorCount uint64
+	Latency    *LatencySketch
+}
+
+// Edge is the summary of an edge over a time range, as returned by the API.
+type Edge struct {
+	Caller     string  `json:"caller"`
+	Callee     string  `json:"callee"`
+	CallCount  uint64  `json:"call_count"`
+	ErrorCount uint64  `json:"error_count"`
+	P50Ms      float64 `json:"p50_ms"`
+	P90Ms      float64 `json:"p90_ms"`
+	P95Ms      float64 `json:"p95_ms"`
+	P99Ms      float64 `json:"p99_ms"`
+}
+
+type spanCacheGen struct {
+	spanToService map[string]string
+	// Children whose parent has not been seen yet, keyed by the parent.
+	pendingChildren map[string][]*SpanInfo
+}
+
+type orgGraph struct {
+	mu       sync.Mutex
+	curGen   *spanCacheGen
+	prevGen  *spanCacheGen
+	genStart time.Time
+	buckets  map[uint64]map[EdgeKey]*EdgeStats // bucket start in ms -> edges
+}
+
+var allGraphsLock sync.Mutex
+var allGraphs = make(map[int64]*orgGraph)
+
+func newSpanCacheGen() *spanCacheGen {
+	return &spanCacheGen{
+		spanToService:   make(map[string]string),
+		pendingChildren: make(map[string][]*SpanInfo),
+	}
+}
+
+func newEdgeStats() *EdgeStats {
+	return &EdgeStats{Latency: NewLatencySketch()}
+}
+
+func getOrgGraph(myid int64) *orgGraph {
+	allGraphsLock.Lock()
+	defer allGraphsLock.Unlock()
+
+	graph, ok := allGraphs[myid]
+	if !ok {
+		graph = &orgGraph{
+			curGen:   newSpanCacheGen(),
+			prevGen:  newSpanCacheGen(),
+			genStart: time.Now(),
+			buckets:  make(map[uint64]map[EdgeKey]*EdgeStats),
+		}
+		allGraphs[myid] = graph
+	}
+
+	return graph
+}
+
+func getSpanKey(traceId string, spanId string) string {
+	return traceId + ":" + spanId
+}
+
+// Adds the spans to the dependency graph of myid. A span whose parent belongs
+// to a different service adds one call from the parent's service to the span's
+// service, bucketed by the span's start time.
+func RecordSpans(myid int64, spans []*SpanInfo) {
+	if len(spans) == 0 {
+		return
+	}
+
+	graph := getOrgGraph(myid)
+	graph.mu.Lock()
+	defer graph.mu.Unlock()
+
+	graph.rotateGenerationsIfNeeded(time.Now())
+	for _, span := range spans {
+		graph.addSpan(span)
+	}
+}
+
+func (g *orgGraph) rotateGenerationsIfNeeded(now time.Time) {
+	if now.Sub(g.genStart) < spanCacheGeneration {
+		return
+	}
+	g.prevGen = g.curGen
+	g.curGen = newSpanCacheGen()
+	g.genStart = now
+}
+
+func (g *orgGraph) lookupService(spanKey string) (string, bool) {
+	if service, ok := g.curGen.spanToService[spanKey]; ok {
+		return service, true
+	}
+	service, ok := g.prevGen.spanToService[spanKey]
+	return service, ok
+}
+
+func (g *orgGraph) addSpan(span *SpanInfo) {
+	spanKey := getSpanKey(span.TraceId, span.SpanId)
+	g.curGen.spanToService[spanKey] = span.Service
+
+	for _, gen := range []*spanCacheGen{g.curGen, g.prevGen} {
+		children, ok := gen.pendingChildren[spanKey]
+		if !ok {
+			continue
+		}
+		for _, child := range children {
+			g.addCall(span.Service, child)
+		}
+		delete(gen.pendingChildren, spanKey)
+	}
+
+	if span.ParentSpanId == "" {
+		return
+	}
+
+	parentKey := getSpanKey(span.TraceId, span.ParentSpanId)
+	parentService, ok := g.lookupService(parentKey)
+	if !ok {
+		g.curGen.pendingChildren[parentKey] = append(g.curGen.pendingChildren[parentKey], span)
+		return
+	}
+	g.addCall(parentService, span)
+}
+
+func (g *orgGraph) addCall(callerService string, callee *SpanInfo) {
+	if callerService == callee.Service {
+		return
+	}
+
+	bucketStart := (callee.StartTimeNs / 1_000_000) / BUCKET_SIZE_MS * BUCKET_SIZE_MS
+	edges, ok := g.buckets[bucketStart]
+	if !ok {
+		edges = make(map[EdgeKey]*EdgeStats)
+		g.buckets[bucketStart] = edges
+	}
+
+	key := EdgeKey{Caller: callerService, Callee: callee.Service}
+	stats, ok := edges[key]
+	if !ok {
+		stats = newEdgeStats()
+		edges[key] = stats
+	}
+
+	stats.CallCount++
+	if callee.IsError {
+		stats.ErrorCount++
+	}
+	stats.Latency.Add(callee.DurationNs)
+}
+
+// Returns the edges that are still in memory and whose bucket starts within
+// [startMs, endMs].
+func GetUnflushedEdges(myid int64, startMs uint64, endMs uint64) map[EdgeKey]*EdgeStats {
+	graph := getOrgGraph(myid)
+	graph.mu.Lock()
+	defer graph.mu.Unlock()
+
+	result := make(map[EdgeKey]*EdgeStats)
+	for bucketStart, edges := range graph.buckets {
+		if bucketStart < startMs || bucketStart > endMs {
+			continue
+		}
+		for key, stats := range edges {
+			MergeEdgeStats(result, key, stats)
+		}
+	}
+
+	return result
+}
+
+func MergeEdgeStats(into map[EdgeKey]*EdgeStats, key EdgeKey, stats *EdgeStats) {
+	existing, ok := into[key]
+	if !ok {
+		existing = newEdgeStats()
+		into[key] = existing
+	}
+	existing.CallCount += stats.CallCount
+	existing.ErrorCount += stats.ErrorCount
+	existing.Latency.Merge(stats.Latency)
+}
+
+// Converts merged edge stats to API edges, sorted by caller and callee.
+func SummarizeEdges(edges map[EdgeKey]*EdgeStats) []*Edge {
+	result := make([]*Edge, 0, len(edges))
+	for key, stats := range edges {
+		result = append(result, &Edge{
+			Caller:     key.Caller,
+			Callee:     key.Callee,
+			CallCount:  stats.CallCount,
+			ErrorCount: stats.ErrorCount,
+			P50Ms:      stats.Latency.Quantile(0.50) / 1e6,
+			P90Ms:      stats.Latency.Quantile(0.90) / 1e6,
+			P95Ms:      stats.Latency.Quantile(0.95) / 1e6,
+			P99Ms:      stats.Latency.Quantile(0.99) / 1e6,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Caller != result[j].Caller {
+			return result[i].Caller < result[j].Caller
+		}
+		return result[i].Callee < result[j].Callee
+	})
+
+	return result
+}
+
+func RunFlushLoop() {
+	for {
+		time.Sleep(BUCKET_SIZE_MS * time.Millisecond)
+		FlushEdges(false)
+	}
+}
+
+// Writes the completed buckets of every org to the edges index. If force is
+// set, every bucket is written, including the current one.
+func FlushEdges(force bool) {
+	allGraphsLock.Lock()
+	myids := make([]int64, 0, len(allGraphs))
+	for myid := range allGraphs {
+		myids = append(myids, myid)
+	}
+	allGraphsLock.Unlock()
+
+	nowMs := utils.GetCurrentTimeInMs()
+	for _, myid := range myids {
+		graph := getOrgGraph(myid)
+		graph.mu.Lock()
+		toFlush := make(map[uint64]map[EdgeKey]*EdgeStats)
+		for bucketStart, edges := range graph.buckets {
+			if force || bucketStart+flushDelayMs <= nowMs {
+				toFlush[bucketStart] = edges
+				delete(graph.buckets, bucketStart)
+			}
+		}
+		graph.mu.Unlock()
+
+		if len(toFlush) > 0 {
+			writeEdgeRecords(myid, toFlush)
+		}
+	}
+}
+
+// Returns the record of the edge in the bucket, followed by one record per
+// non-empty latency bin. Keeping the bins in their own records lets a search
+// sum them per edge instead of reading back every record.
+func makeEdgeRecords(bucketStart uint64, key EdgeKey, stats *EdgeStats, tsKey string) ([][]byte, error) {
+	records := make([]map[string]interface{}, 0, 1+len(stats.Latency.Bins))
+	records = append(records, map[string]interface{}{
+		"caller":       key.Caller,
+		"callee":       key.Callee,
+		"bucket_start": bucketStart,
+		"call_count":   stats.CallCount,
+		"error_count":  stats.ErrorCount,
+		tsKey:          bucketStart,
+	})
+	for index, count := range stats.Latency.Bins {
+		records = append(records, map[string]interface{}{
+			"caller":       key.Caller,
+			"callee":       key.Callee,
+			"bucket_start": bucketStart,
+			"latency_bin":  index,
+			"bin_count":    count,
+			tsKey:          bucketStart,
+		})
+	}
+
+	recordJsons := make([][]byte, 0, len(records))
+	for _, record := range records {
+		recordJson, err := json.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("makeEdgeRecords: failed to marshal record %v, err=%v", record, err)
+		}
+		recordJsons = append(recordJsons, recordJson)
+	}
+
+	return recordJsons, nil
+}
+
+func writeEdgeRecords(myid int64, buckets map[uint64]map[EdgeKey]*EdgeStats) {
+	now := utils.GetCurrentTimeInMs()
+	shouldFlush := false
+	localIndexMap := make(map[string]string)
+	tsKey := config.GetTimeStampKey()
+
+	idxToStreamIdCache := make(map[string]string)
+	cnameCacheByteHashToStr := make(map[uint64]string)
+	var jsParsingStackbuf [utils.UnescapeStackBufSize]byte
+	pleArray := make([]*segwriter.ParsedLogEvent, 0)
+	defer segwriter.ReleasePLEs(pleArray)
+
+	for bucketStart, edges := range buckets {
+		for key, stats := range edges {
+			recordJsons, err := makeEdgeRecords(bucketStart, key, stats, tsKey)
+			if err != nil {
+				log.Errorf("writeEdgeRecords: %v", err)
+				continue
+			}
+
+			for _, recordJson := range recordJsons {
+				ple, err := segwriter.GetNewPLE(recordJson, now, EDGES_INDEX_NAME, &tsKey, jsParsingStackbuf[:])
+				if err != nil {
+					log.Errorf("writeEdgeRecords: failed to get new PLE, err=%v", err)
+					continue
+				}
+				pleArray = append(pleArray, ple)
+			}
+		}
+	}
+
+	err := writer.ProcessIndexRequestPle(now, EDGES_INDEX_NAME, shouldFlush, localIndexMap, myid, 0, idxToStreamIdCache,
+		cnameCacheByteHashToStr, jsParsingStackbuf[:], pleArray)
+	if err != nil {
+		log.Errorf("writeEdgeRecords: failed to ingest %v edge records for myid=%v, err=%v", len(pleArray), myid, err)
+	}
+}
+
+// Parses a row of EDGE_COUNTS_QUERY, with the group by and measure columns
+// keyed by name.
+func ParseEdgeCounts(row map[string]interface{}) (EdgeKey, *EdgeStats, error) {
+	key, err := parseEdgeKey(row)
+	if err != nil {
+		return EdgeKey{}, nil, fmt.Errorf("ParseEdgeCounts: %v", err)
+	}
+
+	stats := newEdgeStats()
+	stats.CallCount, err = toUint64(row["call_count"])
+	if err != nil {
+		return EdgeKey{}, nil, fmt.Errorf("ParseEdgeCounts: invalid call_count, err=%v", err)
+	}
+	stats.ErrorCount, err = toUint64(row["error_count"])
+	if err != nil {
+		return EdgeKey{}, nil, fmt.Errorf("ParseEdgeCounts: invalid error_count, err=%v", err)
+	}
+
+	return key, stats, nil
+}
+
+// Parses a row of EDGE_LATENCY_QUERY and adds its bin to the latency sketch
+// of the edge.
+func AddEdgeLatencyBin(edges map[EdgeKey]*EdgeStats, row map[string]interface{}) error {
+	key, err := parseEdgeKey(row)
+	if err != nil {
+		return fmt.Errorf("AddEdgeLatencyBin: %v", err)
+	}
+	index, err := toUint64(row["latency_bin"])
+	if err != nil {
+		return fmt.Errorf("AddEdgeLatencyBin: invalid latency_bin, err=%v", err)
+	}
+	count, err := toUint64(row["bin_count"])
+	if err != nil {
+		return fmt.Errorf("AddEdgeLatencyBin: invalid bin_count, err=%v", err)
+	}
+
+	stats, ok := edges[key]
+	if !ok {
+		stats = newEdgeStats()
+		edges[key] = stats
+	}
+	stats.Latency.Bins[int(index)] += count
+	stats.Latency.Count += count
+
+	return nil
+}
+
+func parseEdgeKey(row map[string]interface{}) (EdgeKey, error) {
+	caller, ok := row["caller"].(string)
+	if !ok {
+		return EdgeKey{}, fmt.Errorf("row has no caller")
+	}
+	callee, ok := row["callee"].(string)
+	if !ok {
+		return EdgeKey{}, fmt.Errorf("row has no callee")
+	}
+
+	return EdgeKey{Caller: caller, Callee: callee}, nil
+}
+
+func toUint64(value interface{}) (uint64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		if uintVal, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return uintVal, nil
+		}
+		floatVal, err := v.Float64()
+		return uint64(floatVal), err
+	case float64:
+		return uint64(v), nil
+	case uint64:
+		return v, nil
+	case int64:
+		return uint64(v), nil
+	case string:
+		return strconv.ParseUint(v, 10, 64)
+	default:
+		return 0, fmt.Errorf("unexpected type %T", value)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package depgraph
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const minuteNs = uint64(60_000_000_000)
+
+func Test_RecordSpans_ParentBeforeAndAfterChild(t *testing.T) {
+	myid := int64(101)
+
+	// The child arrives before its parent.
+	RecordSpans(myid, []*SpanInfo{
+		{TraceId: "t1", SpanId: "child", ParentSpanId: "root", Service: "cart", StartTimeNs: minuteNs + 5, DurationNs: 2_000_000, IsError: true},
+	})
+	assert.Empty(t, GetUnflushedEdges(myid, 0, 10*BUCKET_SIZE_MS))
+
+	RecordSpans(myid, []*SpanInfo{
+		{TraceId: "t1", SpanId: "root", Service: "frontend", StartTimeNs: minuteNs, DurationNs: 5_000_000},
+		{TraceId: "t1", SpanId: "db", ParentSpanId: "child", Service: "redis", StartTimeNs: 2*minuteNs + 1, DurationNs: 1_000_000},
+		{TraceId: "t1", SpanId: "internal", ParentSpanId: "child", Service: "cart", StartTimeNs: minuteNs + 10, DurationNs: 1_000_000},
+	})
+
+	edges := GetUnflushedEdges(myid, 0, 10*BUCKET_SIZE_MS)
+	assert.Len(t, edges, 2)
+	assert.Equal(t, uint64(1), edges[EdgeKey{Caller: "frontend", Callee: "cart"}].CallCount)
+	assert.Equal(t, uint64(1), edges[EdgeKey{Caller: "frontend", Callee: "cart"}].ErrorCount)
+	assert.Equal(t, uint64(1), edges[EdgeKey{Caller: "cart", Callee: "redis"}].CallCount)
+
+	// Only the bucket of the cart -> redis call is in the second minute.
+	edges = GetUnflushedEdges(myid, 2*BUCKET_SIZE_MS, 2*BUCKET_SIZE_MS)
+	assert.Len(t, edges, 1)
+	assert.Contains(t, edges, EdgeKey{Caller: "cart", Callee: "redis"})
+}
+
+func Test_LatencySketch(t *testing.T) {
+	sketch := NewLatencySketch()
+	for i := uint64(1); i <= 1000; i++ {
+		sketch.Add(i * 1_000_000)
+	}
+
+	assert.InEpsilon(t, 500_000_000, sketch.Quantile(0.5), 0.02)
+	assert.InEpsilon(t, 990_000_000, sketch.Quantile(0.99), 0.02)
+
+	other := NewLatencySketch()
+	other.Add(5_000_000_000)
+	sketch.Merge(other)
+	assert.Equal(t, uint64(1001), sketch.Count)
+	assert.InEpsilon(t, 5_000_000_000, sketch.Quantile(1), 0.02)
+}
+
+func Test_EdgeRecordRoundTrip(t *testing.T) {
+	stats := newEdgeStats()
+	stats.CallCount = 3
+	stats.ErrorCount = 1
+	stats.Latency.Add(1_000_000)
+	stats.Latency.Add(2_000_000)
+	stats.Latency.Add(3_000_000)
+
+	recordJsons, err := makeEdgeRecords(120_000, EdgeKey{Caller: "a", Callee: "b"}, stats, "timestamp")
+	assert.NoError(t, err)
+	assert.Len(t, recordJsons, 4)
+
+	// Feed the records back as rows of the stats queries would be.
+	edges := make(map[EdgeKey]*EdgeStats)
+	for _, recordJson := range recordJsons {
+		record := make(map[string]interface{})
+		assert.NoError(t, json.Unmarshal(recordJson, &record))
+		assert.Equal(t, float64(120_000), record["timestamp"])
+
+		if _, ok := record["latency_bin"]; ok {
+			record["latency_bin"] = fmt.Sprintf("%v", record["latency_bin"])
+			assert.NoError(t, AddEdgeLatencyBin(edges, record))
+			continue
+		}
+
+		key, parsed, err := ParseEdgeCounts(record)
+		assert.NoError(t, err)
+		assert.Equal(t, EdgeKey{Caller: "a", Callee: "b"}, key)
+		MergeEdgeStats(edges, key, parsed)
+	}
+
+	parsed := edges[EdgeKey{Caller: "a", Callee: "b"}]
+	assert.Equal(t, uint64(3), parsed.CallCount)
+	assert.Equal(t, uint64(1), parsed.ErrorCount)
+	assert.Equal(t, uint64(3), parsed.Latency.Count)
+
+	summary := SummarizeEdges(edges)
+	assert.Len(t, summary, 1)
+	assert.InEpsilon(t, 2.0, summary[0].P50Ms, 0.02)
+
+	_, _, err = ParseEdgeCounts(map[string]interface{}{"caller": "a"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package depgraph
+
+import (
+	"math"
+	"sort"
+)
+
+// Relative accuracy of the sketch is (gamma - 1) / (gamma + 1), about 1%.
+const sketchGamma = 1.02
+
+var sketchLogGamma = math.Log(sketchGamma)
+
+// LatencySketch is a log-bucketed histogram of durations. Unlike a plain list
+// of percentiles, sketches of different time buckets can be merged exactly,
+// which lets percentiles be computed for any time range.
+type LatencySketch struct {
+	Bins  map[int]uint64 `json:"bins"`
+	Count uint64         `json:"count"`
+}
+
+func NewLatencySketch() *LatencySketch {
+	return &LatencySketch{Bins: make(map[int]uint64)}
+}
+
+func getSketchIndex(value float64) int {
+	if value <= 1 {
+		return 0
+	}
+	return int(math.Ceil(math.Log(value) / sketchLogGamma))
+}
+
+func getSketchValue(index int) float64 {
+	if index <= 0 {
+		return 0
+	}
+	return 2 * math.Pow(sketchGamma, float64(index)) / (sketchGamma + 1)
+}
+
+func (s *LatencySketch) Add(value uint64) {
+	s.Bins[getSketchIndex(float64(value))]++
+	s.Count++
+}
+
+func (s *LatencySketch) Merge(other *LatencySketch) {
+	if other == nil {
+		return
+	}
+	for index, count := range other.Bins {
+		s.Bins[index] += count
+	}
+	s.Count += other.Count
+}
+
+// Returns the estimated value at quantile q, which must be in [0, 1].
+func (s *LatencySketch) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+
+	indices := make([]int, 0, len(s.Bins))
+	for index := range s.Bins {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+
+	rank := uint64(math.Ceil(q * float64(s.Count)))
+	if rank == 0 {
+		rank = 1
+	}
+	seen := uint64(0)
+	for _, index := range indices {
+		seen += s.Bins[index]
+		if seen >= rank {
+			return getSketchValue(index)
+		}
+	}
+
+	return getSketchValue(indices[len(indices)-1])
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/siglens/siglens/pkg/ast/pipesearch"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/segment/tracing/structs"
+	"github.com/siglens/siglens/pkg/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+const CORRELATION_PAGE_SIZE = 1000
+const MAX_CORRELATED_LOGS = 10_000
+
+// Keys under which a log record may carry the trace id, in order of preference.
+var traceIdKeys = []string{"trace_id", "traceId", "trace.id", "traceID"}
+var spanIdKeys = []string{"span_id", "spanId", "span.id", "spanID"}
+
+var validTraceIdRegex = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+// Returns all log records across the log indices that share the trace id in
+// the request, ordered by time and grouped by span.
+func ProcessTraceLogsRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	requestBody := &structs.TraceLogsRequestBody{}
+	if err := json.Unmarshal(ctx.PostBody(), requestBody); err != nil {
+		writeErrMsg(ctx, "ProcessTraceLogsRequest", "could not unmarshal json body", err)
+		return
+	}
+
+	if !validTraceIdRegex.MatchString(requestBody.TraceId) {
+		writeErrMsg(ctx, "ProcessTraceLogsRequest", fmt.Sprintf("invalid trace id %v", requestBody.TraceId), nil)
+		return
+	}
+
+	indexName := requestBody.IndexName
+	if indexName == "" {
+		// "*" expands to every index except the internal tracing ones.
+		indexName = "*"
+	}
+
+	searchRequestBody := &structs.SearchRequestBody{
+		IndexName:     indexName,
+		SearchText:    getTraceIdSearchText(requestBody.TraceId),
+		StartEpoch:    requestBody.StartEpoch,
+		EndEpoch:      requestBody.EndEpoch,
+		QueryLanguage: "Splunk QL",
+	}
+	records, err := fetchAllRecords(searchRequestBody, myid, MAX_CORRELATED_LOGS)
+	if err != nil {
+		writeErrMsg(ctx, "ProcessTraceLogsRequest", err.Error(), nil)
+		return
+	}
+
+	response := &structs.TraceLogsResponse{
+		TraceId:   requestBody.TraceId,
+		TotalLogs: len(records),
+		Spans:     groupLogsBySpan(records, config.GetTimeStampKey()),
+	}
+
+	utils.WriteJsonResponse(ctx, response)
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// Returns the Gantt chart of the trace that the log record in the request
+// belongs to.
+func ProcessLogTraceRequest(ctx *fasthttp.RequestCtx, myid int64) {
+	requestBody := &structs.LogTraceRequestBody{}
+	if err := json.Unmarshal(ctx.PostBody(), requestBody); err != nil {
+		writeErrMsg(ctx, "ProcessLogTraceRequest", "could not unmarshal json body", err)
+		return
+	}
+
+	traceId, ok := getStringField(requestBody.Record, traceIdKeys)
+	if !ok || !validTraceIdRegex.MatchString(traceId) {
+		writeErrMsg(ctx, "ProcessLogTraceRequest", "log record does not have a valid trace id", nil)
+		return
+	}
+
+	ganttRequestBody := &structs.SearchRequestBody{
+		IndexName:     "traces",
+		SearchText:    "trace_id=" + traceId,
+		StartEpoch:    requestBody.StartEpoch,
+		EndEpoch:      requestBody.EndEpoch,
+		QueryLanguage: "Splunk QL",
+	}
+	ganttRequestJSON, err := json.Marshal(ganttRequestBody)
+	if err != nil {
+		writeErrMsg(ctx, "ProcessLogTraceRequest", "could not marshal gantt chart request", err)
+		return
+	}
+
+	ctx.Request.SetBody(ganttRequestJSON)
+	ProcessGanttChartRequest(ctx, myid)
+}
+
+// Matches the trace id under any of the keys a log record may carry it in.
+func getTraceIdSearchText(traceId string) string {
+	clauses := make([]string, 0, len(traceIdKeys))
+	for _, key := range traceIdKeys {
+		clauses = append(clauses, key+"="+traceId)
+	}
+
+	return strings.Join(clauses, " OR ")
+}
+
+// Pages through the search results and returns at most maxRecords records.
+func fetchAllRecords(searchRequestBody *structs.SearchRequestBody, myid int64, maxRecords int) ([]map[string]interface{}, error) {
+	searchRequestBody.From = 0
+	searchRequestBody.Size = CORRELATION_PAGE_SIZE
+
+	var jsonc = jsoniter.ConfigCompatibleWithStandardLibrary
+	allRecords := make([]map[string]interface{}, 0)
+	for len(allRecords) < maxRecords {
+		modifiedData, err := json.Marshal(searchRequestBody)
+		if err != nil {
+			return nil, fmt.Errorf("fetchAllRecords: could not marshal to json body=%v, err=%v", *searchRequestBody, err)
+		}
+
+		rawCtx := &fasthttp.RequestCtx{}
+		rawCtx.Request.Header.SetMethod("POST")
+		rawCtx.Request.SetBody(modifiedData)
+		pipesearch.ProcessPipeSearchRequest(rawCtx, myid)
+
+		response := struct {
+			Hits struct {
+				Records []map[string]interface{} `json:"records"`
+			} `json:"hits"`
+		}{}
+		decoder := jsonc.NewDecoder(bytes.NewReader(rawCtx.Response.Body()))
+		decoder.UseNumber()
+		if err := decoder.Decode(&response); err != nil {
+			return nil, fmt.Errorf("fetchAllRecords: could not decode response body, err=%v", err)
+		}
+
+		allRecords = append(allRecords, response.Hits.Records...)
+		if len(response.Hits.Records) < searchRequestBody.Size {
+			break
+		}
+		searchRequestBody.From += searchRequestBody.Size
+	}
+
+	if len(allRecords) > maxRecords {
+		log.Warnf("fetchAllRecords: truncating %v records to %v for searchText=%v", len(allRecords), maxRecords, searchRequestBody.SearchText)
+		allRecords = allRecords[:maxRecords]
+	}
+
+	return allRecords, nil
+}
+
+// Sorts the records by time and groups them by span id. Spans are ordered by
+// the time of their earliest log; logs without a span id are grouped under an
+// empty span id.
+func groupLogsBySpan(records []map[string]interface{}, timestampKey string) []*structs.SpanLogs {
+	sort.SliceStable(records, func(i, j int) bool {
+		return getRecordTime(records[i], timestampKey) < getRecordTime(records[j], timestampKey)
+	})
+
+	spanIdToLogs := make(map[string]*structs.SpanLogs)
+	spans := make([]*structs.SpanLogs, 0)
+	for _, record := range records {
+		spanId, _ := getStringField(record, spanIdKeys)
+		spanLogs, ok := spanIdToLogs[spanId]
+		if !ok {
+			spanLogs = &structs.SpanLogs{SpanId: spanId, Logs: make([]map[string]interface{}, 0)}
+			spanIdToLogs[spanId] = spanLogs
+			spans = append(spans, spanLogs)
+		}
+		spanLogs.Logs = append(spanLogs.Logs, record)
+	}
+
+	return spans
+}
+
+// Returns the time of the record in milliseconds, preferring the indexed
+// timestamp and falling back to the OTLP time_unix_nano.
+func getRecordTime(record map[string]interface{}, timestampKey string) uint64 {
+	if value, ok := record[timestampKey]; ok {
+		if ts, err := convertTimeToUint64(value); err == nil {
+			return ts
+		}
+	}
+	if value, ok := record["time_unix_nano"]; ok {
+		if ts, err := convertTimeToUint64(value); err == nil {
+			return ts / 1_000_000
+		}
+	}
+
+	return 0
+}
+
+func getStringField(record map[string]interface{}, keys []string) (string, bool) {
+	for _, key := range keys {
+		value, ok := record[key]
+		if !ok {
+			continue
+		}
+		strValue, err := getString(value)
+		if err == nil && strValue != "" {
+			return strValue, true
+		}
+	}
+
+	return "", false
+}
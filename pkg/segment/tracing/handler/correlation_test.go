@@ -0,0 +1,79 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestGroupLogsBySpan(t *testing.T) {
+	records := []map[string]interface{}{
+		{"timestamp": json.Number("300"), "span_id": "b", "body": "b-2"},
+		{"timestamp": json.Number("100"), "span_id": "a", "body": "a-1"},
+		{"time_unix_nano": json.Number("200000000"), "spanId": "b", "body": "b-1"},
+		{"timestamp": json.Number("400"), "span_id": "a", "body": "a-2"},
+		{"timestamp": json.Number("50"), "body": "no-span"},
+	}
+
+	spans := groupLogsBySpan(records, "timestamp")
+	assert.Len(t, spans, 3)
+
+	assert.Equal(t, "", spans[0].SpanId)
+	assert.Equal(t, "no-span", spans[0].Logs[0]["body"])
+
+	assert.Equal(t, "a", spans[1].SpanId)
+	assert.Equal(t, "a-1", spans[1].Logs[0]["body"])
+	assert.Equal(t, "a-2", spans[1].Logs[1]["body"])
+
+	assert.Equal(t, "b", spans[2].SpanId)
+	assert.Equal(t, "b-1", spans[2].Logs[0]["body"])
+	assert.Equal(t, "b-2", spans[2].Logs[1]["body"])
+}
+
+func TestGetStringField(t *testing.T) {
+	value, ok := getStringField(map[string]interface{}{"traceId": "abc"}, traceIdKeys)
+	assert.True(t, ok)
+	assert.Equal(t, "abc", value)
+
+	value, ok = getStringField(map[string]interface{}{"trace_id": "", "trace.id": "def"}, traceIdKeys)
+	assert.True(t, ok)
+	assert.Equal(t, "def", value)
+
+	_, ok = getStringField(map[string]interface{}{"other": "abc"}, traceIdKeys)
+	assert.False(t, ok)
+}
+
+func TestGetTraceIdSearchText(t *testing.T) {
+	assert.Equal(t, "trace_id=abc OR traceId=abc OR trace.id=abc OR traceID=abc", getTraceIdSearchText("abc"))
+}
+
+func TestProcessTraceLogsRequest_InvalidTraceId(t *testing.T) {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetBody([]byte(`{"traceId": "abc | delete", "startEpoch": "now-1h", "endEpoch": "now"}`))
+	ProcessTraceLogsRequest(ctx, 0)
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.SetBody([]byte(`{"record": {"body": "no trace here"}}`))
+	ProcessLogTraceRequest(ctx, 0)
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+}
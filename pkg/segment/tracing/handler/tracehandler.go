@@ -33,6 +33,7 @@ import (
 	"github.com/siglens/siglens/pkg/es/writer"
 	"github.com/siglens/siglens/pkg/health"
 	segstructs "github.com/siglens/siglens/pkg/segment/structs"
+	"github.com/siglens/siglens/pkg/segment/tracing/depgraph"
 	"github.com/siglens/siglens/pkg/segment/tracing/structs"
 	tutils "github.com/siglens/siglens/pkg/segment/tracing/utils"
 	segwriter "github.com/siglens/siglens/pkg/segment/writer"
@@ -302,6 +303,12 @@ func convertTimeToUint64(val interface{}) (uint64, error) {
 		return uint64(v), nil
 	case uint64:
 		return v, nil
+	case json.Number:
+		floatVal, err := v.Float64()
+		if err != nil {
+			return 0, fmt.Errorf("error converting json number %v to float64", v)
+		}
+		return uint64(floatVal), nil
 	case string:
 		floatVal, err := strconv.ParseFloat(v, 64)
 		if err != nil {
@@ -807,6 +814,19 @@ func ProcessAggregatedDependencyGraphs(ctx *fasthttp.RequestCtx, myid int64) {
 		return
 	}
 
+	// Prefer the edges maintained at ingest, which cover the requested range
+	// exactly. Fall back to the hourly snapshots for data ingested before.
+	nowTs := utils.GetCurrentTimeInMs()
+	_, startEpoch, endEpoch, _, _, _, _, _ := pipesearch.ParseSearchBody(readJSON, nowTs)
+	detailed, _ := readJSON["detailed"].(bool)
+	edges, err := getIncrementalEdges(startEpoch, endEpoch, detailed, myid)
+	if err != nil {
+		log.Errorf("ProcessAggregatedDependencyGraphs: failed to get incremental edges, Error=%v", err)
+	} else if len(edges) > 0 {
+		writeIncrementalDependencyGraph(ctx, edges, detailed, nowTs)
+		return
+	}
+
 	dependencyResponseOuter, err := processSearchRequest(searchRequestBody, myid)
 	if err != nil {
 		log.Errorf("ProcessAggregatedDependencyGraphs: processSearchRequest: Error=%v", err)
@@ -870,6 +890,110 @@ func ProcessAggregatedDependencyGraphs(ctx *fasthttp.RequestCtx, myid int64) {
 	ctx.SetStatusCode(fasthttp.StatusOK)
 }
 
+// Merges the flushed edge buckets in [startEpoch, endEpoch] with the ones that
+// are still in memory. The flushed buckets are summed per edge by the search;
+// latency bins are only read back if detailed is set.
+func getIncrementalEdges(startEpoch uint64, endEpoch uint64, detailed bool, myid int64) (map[depgraph.EdgeKey]*depgraph.EdgeStats, error) {
+	edges := depgraph.GetUnflushedEdges(myid, startEpoch, endEpoch)
+
+	rows, err := searchEdgesIndex(depgraph.EDGE_COUNTS_QUERY, startEpoch, endEpoch, myid)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		key, stats, err := depgraph.ParseEdgeCounts(row)
+		if err != nil {
+			log.Errorf("getIncrementalEdges: skipping edge row, err=%v", err)
+			continue
+		}
+		depgraph.MergeEdgeStats(edges, key, stats)
+	}
+
+	if !detailed {
+		return edges, nil
+	}
+
+	rows, err = searchEdgesIndex(depgraph.EDGE_LATENCY_QUERY, startEpoch, endEpoch, myid)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if err := depgraph.AddEdgeLatencyBin(edges, row); err != nil {
+			log.Errorf("getIncrementalEdges: skipping latency row, err=%v", err)
+		}
+	}
+
+	return edges, nil
+}
+
+// Runs a stats query on the edges index and returns one row per group, with
+// the group by and measure columns keyed by name.
+func searchEdgesIndex(searchText string, startEpoch uint64, endEpoch uint64, myid int64) ([]map[string]interface{}, error) {
+	searchRequestBody := &structs.SearchRequestBody{
+		IndexName:     depgraph.EDGES_INDEX_NAME,
+		SearchText:    searchText,
+		StartEpoch:    strconv.FormatUint(startEpoch, 10),
+		EndEpoch:      strconv.FormatUint(endEpoch, 10),
+		QueryLanguage: "Splunk QL",
+	}
+	response, err := processSearchRequest(searchRequestBody, myid)
+	if err != nil {
+		return nil, err
+	}
+	if response.BucketCount > len(response.MeasureResults) {
+		log.Warnf("searchEdgesIndex: only %v of %v groups were returned for searchText=%v",
+			len(response.MeasureResults), response.BucketCount, searchText)
+	}
+
+	return getMeasureRows(response), nil
+}
+
+func getMeasureRows(response *segstructs.PipeSearchResponseOuter) []map[string]interface{} {
+	rows := make([]map[string]interface{}, 0, len(response.MeasureResults))
+	for _, bucket := range response.MeasureResults {
+		if len(bucket.GroupByValues) != len(response.GroupByCols) {
+			log.Errorf("getMeasureRows: expected %v group by values, got %v", len(response.GroupByCols), len(bucket.GroupByValues))
+			continue
+		}
+
+		row := make(map[string]interface{}, len(bucket.GroupByValues)+len(bucket.MeasureVal))
+		for i, col := range response.GroupByCols {
+			row[col] = bucket.GroupByValues[i]
+		}
+		for col, value := range bucket.MeasureVal {
+			row[col] = value
+		}
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// Writes the edges either in the caller -> callee -> count format of the
+// hourly snapshots, or as a list of edges with error counts and latencies.
+func writeIncrementalDependencyGraph(ctx *fasthttp.RequestCtx, edges map[depgraph.EdgeKey]*depgraph.EdgeStats, detailed bool, nowTs uint64) {
+	if detailed {
+		utils.WriteJsonResponse(ctx, map[string]interface{}{
+			"edges":     depgraph.SummarizeEdges(edges),
+			"timestamp": nowTs,
+		})
+		ctx.SetStatusCode(fasthttp.StatusOK)
+		return
+	}
+
+	processedData := make(map[string]interface{})
+	for key, stats := range edges {
+		if processedData[key.Caller] == nil {
+			processedData[key.Caller] = make(map[string]uint64)
+		}
+		processedData[key.Caller].(map[string]uint64)[key.Callee] += stats.CallCount
+	}
+	processedData["timestamp"] = nowTs
+
+	utils.WriteJsonResponse(ctx, processedData)
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
 func convertEpochToString(value interface{}) (string, string) {
 	valueType := fmt.Sprintf("%T", value)
 	switch v := value.(type) {
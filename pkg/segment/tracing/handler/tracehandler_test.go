@@ -175,3 +175,16 @@ func TestConvertTimeToUint64(t *testing.T) {
 	}
 
 }
+
+func TestGetMeasureRows(t *testing.T) {
+	response := &structs.PipeSearchResponseOuter{
+		GroupByCols: []string{"callee", "caller"},
+		MeasureResults: []*structs.BucketHolder{
+			{GroupByValues: []string{"b", "a"}, MeasureVal: map[string]interface{}{"call_count": float64(3)}},
+			{GroupByValues: []string{"c"}, MeasureVal: map[string]interface{}{"call_count": float64(1)}},
+		},
+	}
+
+	rows := getMeasureRows(response)
+	assert.Equal(t, []map[string]interface{}{{"caller": "a", "callee": "b", "call_count": float64(3)}}, rows)
+}
@@ -92,3 +92,29 @@ type GanttChartSpan struct {
 	Children        []*GanttChartSpan      `json:"children"`
 	Status          string                 `json:"status"`
 }
+
+// Request body of the trace to logs correlation API
+type TraceLogsRequestBody struct {
+	TraceId    string `json:"traceId"`
+	IndexName  string `json:"indexName"` // defaults to all log indices
+	StartEpoch string `json:"startEpoch"`
+	EndEpoch   string `json:"endEpoch"`
+}
+
+type SpanLogs struct {
+	SpanId string                   `json:"span_id"`
+	Logs   []map[string]interface{} `json:"logs"`
+}
+
+type TraceLogsResponse struct {
+	TraceId   string      `json:"trace_id"`
+	TotalLogs int         `json:"total_logs"`
+	Spans     []*SpanLogs `json:"spans"` // ordered by the time of their first log
+}
+
+// Request body of the log to trace correlation API
+type LogTraceRequestBody struct {
+	Record     map[string]interface{} `json:"record"`
+	StartEpoch string                 `json:"startEpoch"`
+	EndEpoch   string                 `json:"endEpoch"`
+}
@@ -378,6 +378,8 @@ const (
 	Latest
 	LatestTime
 	StatsRate
+	CountValues
+	LimitK
 	END_OF_AGGREGATE_FUNCS
 )
 
@@ -450,6 +452,7 @@ const (
 	Quantile_Over_Time
 	Changes
 	Resets
+	Holt_Winters
 )
 
 type LabelFunctions int
@@ -463,6 +466,19 @@ type HistogramFunctions int
 
 const (
 	HistogramQuantile HistogramFunctions = iota + 1
+	HistogramCount
+	HistogramSum
+	HistogramFraction
+)
+
+type VectorFunctions int
+
+const (
+	Absent VectorFunctions = iota + 1
+	Absent_Over_Time
+	Sort
+	Sort_Desc
+	Scalar
 )
 
 // For columns used by aggs with eval statements, we should keep their raw values because we need to evaluate them
@@ -544,6 +560,10 @@ func (e AggregateFunctions) String() string {
 		return "latest_time"
 	case StatsRate:
 		return "rate"
+	case CountValues:
+		return "count_values"
+	case LimitK:
+		return "limitk"
 	default:
 		return fmt.Sprintf("%d", int(e))
 	}
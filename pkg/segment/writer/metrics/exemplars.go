@@ -0,0 +1,461 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/wal"
+	log "github.com/sirupsen/logrus"
+)
+
+// How many exemplars are kept per org. The oldest ones are removed first.
+const MAX_EXEMPLARS_PER_ORG = 100_000
+
+const EXEMPLARS_WAL_DIR = "exemplars"
+const EXEMPLARS_WAL_FLUSH_INTERVAL = 1 * time.Second
+
+// The maximum number of characters in the label names and values of an
+// exemplar, from the OpenMetrics spec.
+const MAX_EXEMPLAR_LABELS_LENGTH = 128
+
+var ErrOutOfOrderExemplar = errors.New("out of order exemplar")
+var ErrExemplarLabelsTooLong = errors.New("exemplar labels exceed the maximum length")
+
+// Exemplar is a sample of a series that is linked to a trace, usually with a
+// trace_id label. The timestamp is in milliseconds.
+type Exemplar struct {
+	Labels    labels.Labels
+	Value     float64
+	Timestamp int64
+}
+
+// ExemplarSeries is a series and its exemplars within a time range.
+type ExemplarSeries struct {
+	SeriesLabels labels.Labels
+	Exemplars    []Exemplar
+}
+
+type exemplarSeries struct {
+	labels    labels.Labels // includes __name__
+	exemplars []Exemplar
+}
+
+/*
+The exemplars of an org are appended to a WAL file, which is replayed on
+startup. The file is rewritten with only the kept exemplars once it holds
+twice as many exemplars as are kept.
+*/
+type orgExemplars struct {
+	series map[uint64]*exemplarSeries
+	order  []uint64 // ring buffer of the tsid of every exemplar
+	oldest int      // index in order of the oldest exemplar, once order is full
+
+	wal      *wal.Wal
+	pending  []walExemplar // not yet in the WAL
+	numInWal int
+}
+
+// An exemplar in the WAL. The value is stored as its bits, since JSON has no NaN.
+type walExemplar struct {
+	Tsid         uint64        `json:"tsid"`
+	SeriesLabels labels.Labels `json:"seriesLabels"`
+	Labels       labels.Labels `json:"labels"`
+	ValueBits    uint64        `json:"valueBits"`
+	Timestamp    int64         `json:"timestamp"`
+}
+
+type exemplarEncoder struct{}
+
+func (e *exemplarEncoder) PrepareEncode(input any) ([]byte, error) {
+	exemplars, ok := input.([]walExemplar)
+	if !ok {
+		return nil, errors.New("invalid type for exemplarEncoder")
+	}
+	return json.Marshal(exemplars)
+}
+
+var exemplarsLock sync.RWMutex
+var allOrgExemplars = make(map[int64]*orgExemplars)
+var exemplarsWalDir string
+
+/*
+Adds an exemplar to a series. The relabel rules and the series limits of the
+org are applied to the series first, so that exemplars are found with the
+labels that the samples of the series were written with. Exemplars of series
+whose samples were rejected by the series limits are dropped.
+
+An exemplar that is the same as the last one of the series is ignored, since
+exporters keep exposing the same exemplar until a new one is recorded.
+*/
+func AddExemplar(mName []byte, tags *TagsHolder, exemplar Exemplar, orgid int64) error {
+	if exemplarLabelsLength(exemplar.Labels) > MAX_EXEMPLAR_LABELS_LENGTH {
+		return ErrExemplarLabelsTooLong
+	}
+
+	mName, tags, keep := relabelSeries(mName, tags, getMetricRelabelConfigs(orgid))
+	if !keep {
+		return nil
+	}
+	tsid, err := tags.GetTSID(mName)
+	if err != nil {
+		return err
+	}
+	if config.IsMetricsLimitsEnabled() {
+		var admitted bool
+		tags, tsid, admitted = getAdmittedSeries(mName, tags, tsid, orgid)
+		if !admitted {
+			return ErrSeriesLimitExceeded
+		}
+	}
+
+	exemplarsLock.Lock()
+	defer exemplarsLock.Unlock()
+	orgExs := getOrgExemplars(orgid)
+
+	series, ok := orgExs.series[tsid]
+	if !ok {
+		series = &exemplarSeries{labels: getSeriesLabels(mName, tags)}
+	}
+	if numExemplars := len(series.exemplars); numExemplars > 0 {
+		last := series.exemplars[numExemplars-1]
+		if last.Timestamp == exemplar.Timestamp && last.Value == exemplar.Value && labels.Equal(last.Labels, exemplar.Labels) {
+			return nil
+		}
+		if exemplar.Timestamp < last.Timestamp {
+			return ErrOutOfOrderExemplar
+		}
+	}
+
+	orgExs.add(tsid, series, exemplar)
+	if exemplarsWalDir != "" {
+		orgExs.pending = append(orgExs.pending, walExemplar{
+			Tsid:         tsid,
+			SeriesLabels: series.labels,
+			Labels:       exemplar.Labels,
+			ValueBits:    math.Float64bits(exemplar.Value),
+			Timestamp:    exemplar.Timestamp,
+		})
+	}
+	return nil
+}
+
+// The caller must hold exemplarsLock.
+func getOrgExemplars(orgid int64) *orgExemplars {
+	orgExs, ok := allOrgExemplars[orgid]
+	if !ok {
+		orgExs = &orgExemplars{series: make(map[uint64]*exemplarSeries)}
+		allOrgExemplars[orgid] = orgExs
+	}
+	return orgExs
+}
+
+// Adds the exemplar to the series, and removes the oldest exemplar of the org
+// when there are more than MAX_EXEMPLARS_PER_ORG.
+func (orgExs *orgExemplars) add(tsid uint64, series *exemplarSeries, exemplar Exemplar) {
+	orgExs.series[tsid] = series
+	series.exemplars = append(series.exemplars, exemplar)
+	if len(orgExs.order) < MAX_EXEMPLARS_PER_ORG {
+		orgExs.order = append(orgExs.order, tsid)
+		return
+	}
+
+	oldestTsid := orgExs.order[orgExs.oldest]
+	orgExs.order[orgExs.oldest] = tsid
+	orgExs.oldest = (orgExs.oldest + 1) % MAX_EXEMPLARS_PER_ORG
+
+	oldestSeries, ok := orgExs.series[oldestTsid]
+	if !ok {
+		return
+	}
+	oldestSeries.exemplars = oldestSeries.exemplars[1:]
+	if len(oldestSeries.exemplars) == 0 {
+		delete(orgExs.series, oldestTsid)
+	}
+}
+
+// Returns all the exemplars of the org, oldest first.
+func (orgExs *orgExemplars) getWalExemplars() []walExemplar {
+	exemplars := make([]walExemplar, 0, len(orgExs.order))
+	nextIdx := make(map[uint64]int, len(orgExs.series))
+	for i := range orgExs.order {
+		tsid := orgExs.order[(orgExs.oldest+i)%len(orgExs.order)]
+		series := orgExs.series[tsid]
+		exemplar := series.exemplars[nextIdx[tsid]]
+		nextIdx[tsid]++
+		exemplars = append(exemplars, walExemplar{
+			Tsid:         tsid,
+			SeriesLabels: series.labels,
+			Labels:       exemplar.Labels,
+			ValueBits:    math.Float64bits(exemplar.Value),
+			Timestamp:    exemplar.Timestamp,
+		})
+	}
+	return exemplars
+}
+
+/*
+Loads the exemplars of all orgs from their WAL files and starts writing the new
+exemplars to them periodically.
+*/
+func InitExemplars() error {
+	err := initExemplars(filepath.Join(getWALBaseDir(), EXEMPLARS_WAL_DIR))
+	if err != nil {
+		return err
+	}
+	go timeBasedExemplarsWalFlush()
+	return nil
+}
+
+func initExemplars(walDir string) error {
+	err := os.MkdirAll(walDir, 0764)
+	if err != nil {
+		return err
+	}
+	files, err := os.ReadDir(walDir)
+	if err != nil {
+		return err
+	}
+
+	exemplarsLock.Lock()
+	defer exemplarsLock.Unlock()
+	exemplarsWalDir = walDir
+	for _, file := range files {
+		orgid, ok := getExemplarsWalFileOrgId(file.Name())
+		if !ok {
+			continue
+		}
+		orgExs := getOrgExemplars(orgid)
+		orgExs.recoverWal(filepath.Join(walDir, file.Name()))
+
+		// start over with only the kept exemplars
+		err := orgExs.rewriteWal(filepath.Join(walDir, file.Name()))
+		if err != nil {
+			log.Errorf("initExemplars: failed to rewrite the exemplars WAL of orgid=%v, err=%v", orgid, err)
+		}
+	}
+	return nil
+}
+
+func getExemplarsWalFileName(orgid int64) string {
+	return "exemplars_" + strconv.FormatInt(orgid, 10) + ".wal"
+}
+
+func getExemplarsWalFileOrgId(fileName string) (int64, bool) {
+	if !strings.HasPrefix(fileName, "exemplars_") || !strings.HasSuffix(fileName, ".wal") {
+		return 0, false
+	}
+	orgid, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(fileName, "exemplars_"), ".wal"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return orgid, true
+}
+
+func (orgExs *orgExemplars) recoverWal(filePath string) {
+	it, err := wal.NewBlockReader(filePath)
+	if err != nil {
+		log.Errorf("orgExemplars.recoverWal: failed to open %v, err=%v", filePath, err)
+		return
+	}
+	defer it.Close()
+
+	for {
+		block, err := it.Next()
+		if err != nil {
+			log.Warnf("orgExemplars.recoverWal: failed to read block of %v, err=%v", filePath, err)
+			return
+		}
+		if block == nil {
+			return
+		}
+		var exemplars []walExemplar
+		err = json.Unmarshal(block, &exemplars)
+		if err != nil {
+			log.Warnf("orgExemplars.recoverWal: failed to decode block of %v, err=%v", filePath, err)
+			return
+		}
+		for _, we := range exemplars {
+			series, ok := orgExs.series[we.Tsid]
+			if !ok {
+				series = &exemplarSeries{labels: we.SeriesLabels}
+			}
+			orgExs.add(we.Tsid, series, Exemplar{
+				Labels:    we.Labels,
+				Value:     math.Float64frombits(we.ValueBits),
+				Timestamp: we.Timestamp,
+			})
+		}
+	}
+}
+
+// Replaces the WAL file with one that holds only the kept exemplars. The
+// caller must hold exemplarsLock.
+func (orgExs *orgExemplars) rewriteWal(filePath string) error {
+	if orgExs.wal != nil {
+		_ = orgExs.wal.Close()
+	}
+	var err error
+	orgExs.wal, err = wal.NewWAL(filePath, &exemplarEncoder{})
+	if err != nil {
+		return err
+	}
+	orgExs.pending = orgExs.pending[:0]
+	orgExs.numInWal = 0
+	if len(orgExs.order) == 0 {
+		return nil
+	}
+	err = orgExs.wal.Append(orgExs.getWalExemplars())
+	if err != nil {
+		return err
+	}
+	orgExs.numInWal = len(orgExs.order)
+	return nil
+}
+
+func timeBasedExemplarsWalFlush() {
+	for {
+		time.Sleep(EXEMPLARS_WAL_FLUSH_INTERVAL)
+		flushExemplarsWal()
+	}
+}
+
+// Writes the exemplars added since the last flush to the WAL of their org.
+func flushExemplarsWal() {
+	exemplarsLock.Lock()
+	defer exemplarsLock.Unlock()
+	if exemplarsWalDir == "" {
+		return
+	}
+
+	for orgid, orgExs := range allOrgExemplars {
+		if len(orgExs.pending) == 0 {
+			continue
+		}
+		filePath := filepath.Join(exemplarsWalDir, getExemplarsWalFileName(orgid))
+		if orgExs.wal == nil || orgExs.numInWal+len(orgExs.pending) > 2*MAX_EXEMPLARS_PER_ORG {
+			err := orgExs.rewriteWal(filePath)
+			if err != nil {
+				log.Errorf("flushExemplarsWal: failed to rewrite the exemplars WAL of orgid=%v, err=%v", orgid, err)
+			}
+			continue
+		}
+
+		err := orgExs.wal.Append(orgExs.pending)
+		if err != nil {
+			log.Errorf("flushExemplarsWal: failed to append to the exemplars WAL of orgid=%v, err=%v", orgid, err)
+			continue
+		}
+		orgExs.numInWal += len(orgExs.pending)
+		orgExs.pending = orgExs.pending[:0]
+	}
+}
+
+func exemplarLabelsLength(lbls labels.Labels) int {
+	length := 0
+	lbls.Range(func(l labels.Label) {
+		length += utf8.RuneCountInString(l.Name) + utf8.RuneCountInString(l.Value)
+	})
+	return length
+}
+
+func getSeriesLabels(mName []byte, tags *TagsHolder) labels.Labels {
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	for _, entry := range tags.GetEntries() {
+		lb.Set(entry.tagKey, string(entry.tagValue))
+	}
+	lb.Set(model.MetricNameLabel, string(mName))
+	return lb.Labels()
+}
+
+/*
+Returns the exemplars of the org between start and end, which are inclusive
+and in milliseconds, of the series that match any of the matcher sets. The
+series are sorted by their labels.
+*/
+func QueryExemplars(orgid int64, start int64, end int64, matcherSets [][]*labels.Matcher) []ExemplarSeries {
+	result := make([]ExemplarSeries, 0)
+
+	exemplarsLock.RLock()
+	defer exemplarsLock.RUnlock()
+	orgExs, ok := allOrgExemplars[orgid]
+	if !ok {
+		return result
+	}
+
+	for _, series := range orgExs.series {
+		if !matchesAnySet(series.labels, matcherSets) {
+			continue
+		}
+		var exemplars []Exemplar
+		for _, exemplar := range series.exemplars {
+			if exemplar.Timestamp >= start && exemplar.Timestamp <= end {
+				exemplars = append(exemplars, exemplar)
+			}
+		}
+		if len(exemplars) > 0 {
+			result = append(result, ExemplarSeries{SeriesLabels: series.labels, Exemplars: exemplars})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return labels.Compare(result[i].SeriesLabels, result[j].SeriesLabels) < 0
+	})
+	return result
+}
+
+func matchesAnySet(lbls labels.Labels, matcherSets [][]*labels.Matcher) bool {
+	for _, matchers := range matcherSets {
+		matched := true
+		for _, matcher := range matchers {
+			if !matcher.Matches(lbls.Get(matcher.Name)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func resetExemplars() {
+	exemplarsLock.Lock()
+	defer exemplarsLock.Unlock()
+	for _, orgExs := range allOrgExemplars {
+		if orgExs.wal != nil {
+			_ = orgExs.wal.Close()
+		}
+	}
+	allOrgExemplars = make(map[int64]*orgExemplars)
+	exemplarsWalDir = ""
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"testing"
+
+	jp "github.com/buger/jsonparser"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/config/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func addTestExemplar(t *testing.T, mName string, pod string, traceId string, ts int64, orgid int64) error {
+	tags := GetTagsHolder()
+	tags.Insert("pod", []byte(pod), jp.String)
+	return AddExemplar([]byte(mName), tags, Exemplar{
+		Labels:    labels.FromStrings("trace_id", traceId),
+		Value:     1.5,
+		Timestamp: ts,
+	}, orgid)
+}
+
+func Test_Exemplars(t *testing.T) {
+	ResetMetricsSegStore_TestOnly()
+	t.Cleanup(ResetMetricsSegStore_TestOnly)
+
+	assert.NoError(t, addTestExemplar(t, "latency", "a", "t1", 1000, 0))
+	assert.NoError(t, addTestExemplar(t, "latency", "a", "t1", 1000, 0)) // same exemplar again
+	assert.NoError(t, addTestExemplar(t, "latency", "a", "t2", 2000, 0))
+	assert.Equal(t, ErrOutOfOrderExemplar, addTestExemplar(t, "latency", "a", "t0", 500, 0))
+	assert.NoError(t, addTestExemplar(t, "latency", "b", "t3", 3000, 0))
+	assert.NoError(t, addTestExemplar(t, "requests", "a", "t4", 3000, 0))
+	assert.NoError(t, addTestExemplar(t, "latency", "a", "t5", 3000, 1))
+
+	matchers := [][]*labels.Matcher{{
+		labels.MustNewMatcher(labels.MatchEqual, "__name__", "latency"),
+	}}
+	result := QueryExemplars(0, 0, 5000, matchers)
+	assert.Len(t, result, 2)
+	assert.Equal(t, labels.FromStrings("__name__", "latency", "pod", "a"), result[0].SeriesLabels)
+	assert.Equal(t, []Exemplar{
+		{Labels: labels.FromStrings("trace_id", "t1"), Value: 1.5, Timestamp: 1000},
+		{Labels: labels.FromStrings("trace_id", "t2"), Value: 1.5, Timestamp: 2000},
+	}, result[0].Exemplars)
+	assert.Equal(t, labels.FromStrings("__name__", "latency", "pod", "b"), result[1].SeriesLabels)
+
+	// the time range is inclusive
+	result = QueryExemplars(0, 2000, 3000, matchers)
+	assert.Len(t, result, 2)
+	assert.Len(t, result[0].Exemplars, 1)
+
+	// any of the matcher sets can match
+	matchers = append(matchers, []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "__name__", "req.*")})
+	assert.Len(t, QueryExemplars(0, 0, 5000, matchers), 3)
+	assert.Len(t, QueryExemplars(1, 0, 5000, matchers), 1)
+	assert.Empty(t, QueryExemplars(2, 0, 5000, matchers))
+
+	tooLong := GetTagsHolder()
+	err := AddExemplar([]byte("latency"), tooLong, Exemplar{Labels: labels.FromStrings("trace_id", string(make([]byte, 200)))}, 0)
+	assert.Equal(t, ErrExemplarLabelsTooLong, err)
+}
+
+func Test_Exemplars_Eviction(t *testing.T) {
+	ResetMetricsSegStore_TestOnly()
+	t.Cleanup(ResetMetricsSegStore_TestOnly)
+
+	assert.NoError(t, addTestExemplar(t, "oldest", "a", "t0", 0, 0))
+	for i := 1; i <= MAX_EXEMPLARS_PER_ORG; i++ {
+		assert.NoError(t, addTestExemplar(t, "latency", "a", "t", int64(i), 0))
+	}
+
+	matchers := [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+")}}
+	result := QueryExemplars(0, 0, MAX_EXEMPLARS_PER_ORG, matchers)
+	assert.Len(t, result, 1)
+	assert.Equal(t, "latency", result[0].SeriesLabels.Get("__name__"))
+	assert.Len(t, result[0].Exemplars, MAX_EXEMPLARS_PER_ORG)
+}
+
+func Test_Exemplars_Relabel(t *testing.T) {
+	initMetricRelabelTest(t, nil)
+	assert.NoError(t, SetMetricRelabelRules(0, []common.MetricRelabelRule{
+		{SourceLabels: []string{"__name__"}, Regex: "debug_.*", Action: "drop"},
+		{Regex: "pod", Action: "labeldrop"},
+	}))
+
+	assert.NoError(t, addTestExemplar(t, "debug_latency", "a", "t1", 1000, 0))
+	assert.NoError(t, addTestExemplar(t, "latency", "a", "t2", 1000, 0))
+
+	result := QueryExemplars(0, 0, 5000, [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+")}})
+	assert.Len(t, result, 1)
+	assert.Equal(t, labels.FromStrings("__name__", "latency"), result[0].SeriesLabels)
+}
+
+func Test_Exemplars_Persisted(t *testing.T) {
+	ResetMetricsSegStore_TestOnly()
+	t.Cleanup(ResetMetricsSegStore_TestOnly)
+	dir := t.TempDir()
+	assert.NoError(t, initExemplars(dir))
+
+	assert.NoError(t, addTestExemplar(t, "latency", "a", "t1", 1000, 0))
+	flushExemplarsWal()
+	assert.NoError(t, addTestExemplar(t, "latency", "a", "t2", 2000, 0))
+	assert.NoError(t, addTestExemplar(t, "latency", "b", "t3", 3000, 5))
+	flushExemplarsWal()
+
+	matchers := [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+")}}
+	expected0 := QueryExemplars(0, 0, 5000, matchers)
+	expected5 := QueryExemplars(5, 0, 5000, matchers)
+	assert.Len(t, expected0, 1)
+	assert.Len(t, expected0[0].Exemplars, 2)
+
+	// a restart replays the WAL
+	resetExemplars()
+	assert.NoError(t, initExemplars(dir))
+	assert.Equal(t, expected0, QueryExemplars(0, 0, 5000, matchers))
+	assert.Equal(t, expected5, QueryExemplars(5, 0, 5000, matchers))
+
+	// and keeps appending to it
+	assert.NoError(t, addTestExemplar(t, "latency", "a", "t4", 4000, 0))
+	flushExemplarsWal()
+	resetExemplars()
+	assert.NoError(t, initExemplars(dir))
+	result := QueryExemplars(0, 0, 5000, matchers)
+	assert.Len(t, result, 1)
+	assert.Len(t, result[0].Exemplars, 3)
+}
+
+func Test_Exemplars_RingBuffer(t *testing.T) {
+	ResetMetricsSegStore_TestOnly()
+	t.Cleanup(ResetMetricsSegStore_TestOnly)
+
+	for i := 0; i < MAX_EXEMPLARS_PER_ORG+10; i++ {
+		pod := "a"
+		if i%2 == 1 {
+			pod = "b"
+		}
+		assert.NoError(t, addTestExemplar(t, "latency", pod, "t", int64(i), 0))
+	}
+
+	orgExs := allOrgExemplars[0]
+	assert.Len(t, orgExs.order, MAX_EXEMPLARS_PER_ORG)
+	assert.Equal(t, 10, orgExs.oldest)
+
+	walExemplars := orgExs.getWalExemplars()
+	assert.Len(t, walExemplars, MAX_EXEMPLARS_PER_ORG)
+	for i, we := range walExemplars {
+		assert.Equal(t, int64(i+10), we.Timestamp)
+	}
+}
+
+func Test_Exemplars_DropLabel(t *testing.T) {
+	initSeriesLimitsTest(t, common.MetricsLimitsConfig{Enabled: true, MaxValuesPerTagKey: 1, Action: config.METRICS_LIMITS_ACTION_DROP_LABEL})
+
+	assert.NoError(t, encodeTestDatapoint("latency", map[string]string{"pod": "a"}, 0))
+	assert.NoError(t, encodeTestDatapoint("latency", map[string]string{"pod": "b"}, 0))
+	assert.NoError(t, addTestExemplar(t, "latency", "a", "t1", 1000, 0))
+	assert.NoError(t, addTestExemplar(t, "latency", "b", "t2", 1000, 0))
+	// no sample of the series was written
+	assert.Equal(t, ErrSeriesLimitExceeded, addTestExemplar(t, "requests", "a", "t3", 1000, 0))
+
+	result := QueryExemplars(0, 0, 5000, [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+")}})
+	assert.Len(t, result, 2)
+	assert.Equal(t, labels.FromStrings("__name__", "latency"), result[0].SeriesLabels)
+	assert.Equal(t, labels.FromStrings("__name__", "latency", "pod", "a"), result[1].SeriesLabels)
+}
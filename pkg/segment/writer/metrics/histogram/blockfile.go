@@ -0,0 +1,183 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package histogram
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/siglens/siglens/pkg/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrBadHistogramFileVersion = fmt.Errorf("invalid histogram file version")
+var ErrCorruptHistogramFile = fmt.Errorf("corrupt histogram file")
+
+var VERSION_HSGFILE = []byte{1}
+
+type Sample struct {
+	Ts uint32
+	H  *Histogram
+}
+
+// Returns the name of the file that holds the histogram samples of a block,
+// next to its .tso and .tsg files.
+func GetHistogramFileName(mKey string, blkNum uint16) string {
+	return fmt.Sprintf("%s_%d.hsg", mKey, blkNum)
+}
+
+/*
+Writes the histogram samples of every series of a block.
+
+The file has a version byte and the number of series, followed by the sorted
+tsids with the offset of their samples, and then the samples of every series
+prefixed by their count. Every sample is its timestamp, the length of the
+encoded histogram and the encoded histogram. The file is written to a temporary
+file first, so that readers never see a partial file.
+*/
+func WriteBlockHistograms(fileName string, allSamples map[uint64][]Sample) error {
+	tsids := make([]uint64, 0, len(allSamples))
+	for tsid := range allSamples {
+		tsids = append(tsids, tsid)
+	}
+	sort.Slice(tsids, func(i, j int) bool {
+		return tsids[i] < tsids[j]
+	})
+
+	indexBuf := bytes.NewBuffer(nil)
+	indexBuf.Write(VERSION_HSGFILE)
+	indexBuf.Write(utils.Uint64ToBytesLittleEndian(uint64(len(tsids))))
+
+	dataBuf := bytes.NewBuffer(nil)
+	for _, tsid := range tsids {
+		indexBuf.Write(utils.Uint64ToBytesLittleEndian(tsid))
+		indexBuf.Write(utils.Uint32ToBytesLittleEndian(uint32(dataBuf.Len())))
+
+		samples := allSamples[tsid]
+		dataBuf.Write(utils.Uint32ToBytesLittleEndian(uint32(len(samples))))
+		for _, sample := range samples {
+			encoded := sample.H.Encode()
+			dataBuf.Write(utils.Uint32ToBytesLittleEndian(sample.Ts))
+			dataBuf.Write(utils.Uint32ToBytesLittleEndian(uint32(len(encoded))))
+			dataBuf.Write(encoded)
+		}
+	}
+
+	tmpFileName := fileName + ".tmp"
+	fd, err := os.OpenFile(tmpFileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Errorf("WriteBlockHistograms: failed to open file %v, err=%v", tmpFileName, err)
+		return err
+	}
+
+	_, err = fd.Write(indexBuf.Bytes())
+	if err == nil {
+		_, err = fd.Write(dataBuf.Bytes())
+	}
+	closeErr := fd.Close()
+	if err != nil || closeErr != nil {
+		log.Errorf("WriteBlockHistograms: failed to write file %v, err=%v, closeErr=%v", tmpFileName, err, closeErr)
+		_ = os.Remove(tmpFileName)
+		if err != nil {
+			return err
+		}
+		return closeErr
+	}
+
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		log.Errorf("WriteBlockHistograms: failed to rename %v to %v, err=%v", tmpFileName, fileName, err)
+		_ = os.Remove(tmpFileName)
+		return err
+	}
+	return nil
+}
+
+/*
+Reads the histogram samples of single series from the histogram file of a block
+*/
+type BlockHistogramReader struct {
+	raw      []byte
+	numTSIDs uint64
+	dataOff  uint64
+}
+
+func InitBlockHistogramReader(fileName string) (*BlockHistogramReader, error) {
+	raw, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 9 {
+		return nil, ErrCorruptHistogramFile
+	}
+	if raw[0] != VERSION_HSGFILE[0] {
+		return nil, ErrBadHistogramFileVersion
+	}
+
+	numTSIDs := utils.BytesToUint64LittleEndian(raw[1:9])
+	dataOff := 9 + numTSIDs*12
+	if uint64(len(raw)) < dataOff {
+		return nil, ErrCorruptHistogramFile
+	}
+
+	return &BlockHistogramReader{
+		raw:      raw,
+		numTSIDs: numTSIDs,
+		dataOff:  dataOff,
+	}, nil
+}
+
+// Returns the samples of the series and whether it is in the block.
+func (bhr *BlockHistogramReader) GetSamples(tsid uint64) ([]Sample, bool, error) {
+	index := bhr.raw[9:bhr.dataOff]
+	idx := sort.Search(int(bhr.numTSIDs), func(i int) bool {
+		return utils.BytesToUint64LittleEndian(index[i*12:i*12+8]) >= tsid
+	})
+	if idx >= int(bhr.numTSIDs) || utils.BytesToUint64LittleEndian(index[idx*12:idx*12+8]) != tsid {
+		return nil, false, nil
+	}
+
+	offset := bhr.dataOff + uint64(utils.BytesToUint32LittleEndian(index[idx*12+8:idx*12+12]))
+	if uint64(len(bhr.raw)) < offset+4 {
+		return nil, true, ErrCorruptHistogramFile
+	}
+	numSamples := utils.BytesToUint32LittleEndian(bhr.raw[offset : offset+4])
+	offset += 4
+
+	samples := make([]Sample, 0, numSamples)
+	for i := uint32(0); i < numSamples; i++ {
+		if uint64(len(bhr.raw)) < offset+8 {
+			return nil, true, ErrCorruptHistogramFile
+		}
+		ts := utils.BytesToUint32LittleEndian(bhr.raw[offset : offset+4])
+		length := uint64(utils.BytesToUint32LittleEndian(bhr.raw[offset+4 : offset+8]))
+		offset += 8
+		if uint64(len(bhr.raw)) < offset+length {
+			return nil, true, ErrCorruptHistogramFile
+		}
+		h, err := Decode(bhr.raw[offset : offset+length])
+		if err != nil {
+			return nil, true, err
+		}
+		samples = append(samples, Sample{Ts: ts, H: h})
+		offset += length
+	}
+	return samples, true, nil
+}
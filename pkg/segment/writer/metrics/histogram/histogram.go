@@ -0,0 +1,462 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package histogram
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/siglens/siglens/pkg/utils"
+)
+
+const MIN_SCHEMA = -4
+const MAX_SCHEMA = 8
+
+var ErrCorruptHistogram = fmt.Errorf("corrupt histogram")
+
+// A run of consecutive buckets. The offset of the first span is the index of
+// its first bucket; the offset of every other span is the gap to the end of
+// the previous span.
+type Span struct {
+	Offset int32
+	Length uint32
+}
+
+/*
+A native histogram with exponential buckets, as sent by Prometheus native
+histograms and OTLP exponential histograms.
+
+Positive bucket i covers (base^(i-1), base^i] with base = 2^(2^-Schema), and
+negative bucket i mirrors it below zero. Observations within
+[-ZeroThreshold, ZeroThreshold] are counted in the zero bucket. Only buckets
+that are described by the spans are stored, and their counts are absolute
+rather than delta encoded.
+*/
+type Histogram struct {
+	Schema          int32
+	ZeroThreshold   float64
+	ZeroCount       float64
+	Count           float64
+	Sum             float64
+	PositiveSpans   []Span
+	PositiveBuckets []float64
+	NegativeSpans   []Span
+	NegativeBuckets []float64
+}
+
+// A single bucket of a histogram, with its bounds and count.
+type Bucket struct {
+	Lower float64
+	Upper float64
+	Count float64
+}
+
+/*
+Sets the buckets of the histogram from their counts by index. Schemas above
+MAX_SCHEMA, which OTLP allows, are reduced to MAX_SCHEMA by merging buckets.
+*/
+func (h *Histogram) SetBuckets(schema int32, positive map[int32]float64, negative map[int32]float64) {
+	h.Schema = schema
+	if schema > MAX_SCHEMA {
+		h.Schema = MAX_SCHEMA
+		positive = reduceSchema(positive, schema, MAX_SCHEMA)
+		negative = reduceSchema(negative, schema, MAX_SCHEMA)
+	}
+	h.PositiveSpans, h.PositiveBuckets = getSpansAndCounts(positive)
+	h.NegativeSpans, h.NegativeBuckets = getSpansAndCounts(negative)
+}
+
+func (h *Histogram) Validate() error {
+	if h.Schema < MIN_SCHEMA || h.Schema > MAX_SCHEMA {
+		return fmt.Errorf("histogram schema %v is not within [%v, %v]", h.Schema, MIN_SCHEMA, MAX_SCHEMA)
+	}
+	if h.ZeroThreshold < 0 {
+		return fmt.Errorf("histogram zero threshold %v is negative", h.ZeroThreshold)
+	}
+	if getNumBuckets(h.PositiveSpans) != len(h.PositiveBuckets) {
+		return fmt.Errorf("histogram has %v positive buckets but its spans describe %v", len(h.PositiveBuckets), getNumBuckets(h.PositiveSpans))
+	}
+	if getNumBuckets(h.NegativeSpans) != len(h.NegativeBuckets) {
+		return fmt.Errorf("histogram has %v negative buckets but its spans describe %v", len(h.NegativeBuckets), getNumBuckets(h.NegativeSpans))
+	}
+	return nil
+}
+
+func (h *Histogram) Copy() *Histogram {
+	copied := *h
+	copied.PositiveSpans = append([]Span(nil), h.PositiveSpans...)
+	copied.PositiveBuckets = append([]float64(nil), h.PositiveBuckets...)
+	copied.NegativeSpans = append([]Span(nil), h.NegativeSpans...)
+	copied.NegativeBuckets = append([]float64(nil), h.NegativeBuckets...)
+	return &copied
+}
+
+// Returns the upper bound of the positive bucket at the index.
+func getBound(idx int32, schema int32) float64 {
+	return math.Exp2(float64(idx) * math.Exp2(-float64(schema)))
+}
+
+func getNumBuckets(spans []Span) int {
+	numBuckets := 0
+	for _, span := range spans {
+		numBuckets += int(span.Length)
+	}
+	return numBuckets
+}
+
+// Returns the counts of the buckets by index.
+func getBucketMap(spans []Span, counts []float64) map[int32]float64 {
+	bucketMap := make(map[int32]float64, len(counts))
+	idx := int32(0)
+	i := 0
+	for _, span := range spans {
+		idx += span.Offset
+		for j := uint32(0); j < span.Length && i < len(counts); j++ {
+			bucketMap[idx] += counts[i]
+			idx++
+			i++
+		}
+	}
+	return bucketMap
+}
+
+// Builds the spans and counts of the buckets by index. Empty buckets are dropped.
+func getSpansAndCounts(bucketMap map[int32]float64) ([]Span, []float64) {
+	indices := make([]int32, 0, len(bucketMap))
+	for idx, count := range bucketMap {
+		if count != 0 {
+			indices = append(indices, idx)
+		}
+	}
+	sort.Slice(indices, func(i, j int) bool {
+		return indices[i] < indices[j]
+	})
+
+	spans := make([]Span, 0)
+	counts := make([]float64, 0, len(indices))
+	nextIdx := int32(0)
+	for i, idx := range indices {
+		if i > 0 && idx == nextIdx {
+			spans[len(spans)-1].Length++
+		} else {
+			spans = append(spans, Span{Offset: idx - nextIdx, Length: 1})
+		}
+		counts = append(counts, bucketMap[idx])
+		nextIdx = idx + 1
+	}
+	return spans, counts
+}
+
+// Merges the buckets of a schema into the buckets of a smaller schema, where
+// every bucket is the union of 2^(fromSchema-toSchema) buckets.
+func reduceSchema(bucketMap map[int32]float64, fromSchema int32, toSchema int32) map[int32]float64 {
+	if fromSchema == toSchema {
+		return bucketMap
+	}
+	reduced := make(map[int32]float64, len(bucketMap))
+	for idx, count := range bucketMap {
+		reduced[((idx-1)>>(fromSchema-toSchema))+1] += count
+	}
+	return reduced
+}
+
+// Moves the buckets that are entirely within the zero threshold to the zero bucket.
+func widenZeroBucket(bucketMap map[int32]float64, schema int32, zeroThreshold float64) float64 {
+	zeroCount := 0.0
+	for idx, count := range bucketMap {
+		if getBound(idx, schema) <= zeroThreshold {
+			zeroCount += count
+			delete(bucketMap, idx)
+		}
+	}
+	return zeroCount
+}
+
+/*
+Returns h + factor * other.
+
+The result has the smaller schema and the larger zero threshold of the two
+histograms, so that both can be represented exactly.
+*/
+func (h *Histogram) addScaled(other *Histogram, factor float64) *Histogram {
+	schema := min(h.Schema, other.Schema)
+	zeroThreshold := math.Max(h.ZeroThreshold, other.ZeroThreshold)
+
+	positive := reduceSchema(getBucketMap(h.PositiveSpans, h.PositiveBuckets), h.Schema, schema)
+	negative := reduceSchema(getBucketMap(h.NegativeSpans, h.NegativeBuckets), h.Schema, schema)
+	otherPositive := reduceSchema(getBucketMap(other.PositiveSpans, other.PositiveBuckets), other.Schema, schema)
+	otherNegative := reduceSchema(getBucketMap(other.NegativeSpans, other.NegativeBuckets), other.Schema, schema)
+
+	zeroCount := h.ZeroCount + factor*other.ZeroCount
+	zeroCount += widenZeroBucket(positive, schema, zeroThreshold) + widenZeroBucket(negative, schema, zeroThreshold)
+	zeroCount += factor * (widenZeroBucket(otherPositive, schema, zeroThreshold) + widenZeroBucket(otherNegative, schema, zeroThreshold))
+
+	for idx, count := range otherPositive {
+		positive[idx] += factor * count
+	}
+	for idx, count := range otherNegative {
+		negative[idx] += factor * count
+	}
+
+	result := &Histogram{
+		Schema:        schema,
+		ZeroThreshold: zeroThreshold,
+		ZeroCount:     zeroCount,
+		Count:         h.Count + factor*other.Count,
+		Sum:           h.Sum + factor*other.Sum,
+	}
+	result.PositiveSpans, result.PositiveBuckets = getSpansAndCounts(positive)
+	result.NegativeSpans, result.NegativeBuckets = getSpansAndCounts(negative)
+	return result
+}
+
+func (h *Histogram) Add(other *Histogram) *Histogram {
+	return h.addScaled(other, 1)
+}
+
+func (h *Histogram) Sub(other *Histogram) *Histogram {
+	return h.addScaled(other, -1)
+}
+
+// Returns the histogram with every count and the sum multiplied by the factor.
+func (h *Histogram) Mul(factor float64) *Histogram {
+	result := h.Copy()
+	result.ZeroCount *= factor
+	result.Count *= factor
+	result.Sum *= factor
+	for i := range result.PositiveBuckets {
+		result.PositiveBuckets[i] *= factor
+	}
+	for i := range result.NegativeBuckets {
+		result.NegativeBuckets[i] *= factor
+	}
+	return result
+}
+
+// Returns whether the counter was reset between the other histogram and this
+// later one, in which case the difference of the two is meaningless.
+func (h *Histogram) IsCounterResetFrom(other *Histogram) bool {
+	return h.Count < other.Count || h.Schema > other.Schema || h.ZeroThreshold < other.ZeroThreshold
+}
+
+// Returns all the buckets of the histogram, from the lowest to the highest.
+func (h *Histogram) GetBuckets() []Bucket {
+	buckets := make([]Bucket, 0, len(h.NegativeBuckets)+len(h.PositiveBuckets)+1)
+
+	negative := getBucketMap(h.NegativeSpans, h.NegativeBuckets)
+	negativeIndices := make([]int32, 0, len(negative))
+	for idx := range negative {
+		negativeIndices = append(negativeIndices, idx)
+	}
+	sort.Slice(negativeIndices, func(i, j int) bool {
+		return negativeIndices[i] > negativeIndices[j]
+	})
+	for _, idx := range negativeIndices {
+		buckets = append(buckets, Bucket{
+			Lower: -getBound(idx, h.Schema),
+			Upper: -getBound(idx-1, h.Schema),
+			Count: negative[idx],
+		})
+	}
+
+	if h.ZeroCount > 0 || h.ZeroThreshold > 0 {
+		zeroBucket := Bucket{Lower: -h.ZeroThreshold, Upper: h.ZeroThreshold, Count: h.ZeroCount}
+		// like Prometheus, assume that there are no negative observations
+		// if there are no negative buckets
+		if len(negativeIndices) == 0 {
+			zeroBucket.Lower = 0
+		}
+		buckets = append(buckets, zeroBucket)
+	}
+
+	positive := getBucketMap(h.PositiveSpans, h.PositiveBuckets)
+	positiveIndices := make([]int32, 0, len(positive))
+	for idx := range positive {
+		positiveIndices = append(positiveIndices, idx)
+	}
+	sort.Slice(positiveIndices, func(i, j int) bool {
+		return positiveIndices[i] < positiveIndices[j]
+	})
+	for _, idx := range positiveIndices {
+		buckets = append(buckets, Bucket{
+			Lower: getBound(idx-1, h.Schema),
+			Upper: getBound(idx, h.Schema),
+			Count: positive[idx],
+		})
+	}
+	return buckets
+}
+
+/*
+Estimates the quantile of the observations, like PromQL's histogram_quantile on
+a native histogram. The observations are assumed to be spread linearly within
+the bucket that the quantile falls into.
+*/
+func (h *Histogram) Quantile(quantile float64) float64 {
+	if quantile < 0 {
+		return math.Inf(-1)
+	}
+	if quantile > 1 {
+		return math.Inf(1)
+	}
+	if math.IsNaN(quantile) || h.Count <= 0 {
+		return math.NaN()
+	}
+
+	buckets := h.GetBuckets()
+	if len(buckets) == 0 {
+		return math.NaN()
+	}
+
+	rank := quantile * h.Count
+	cumulative := 0.0
+	for i := range buckets {
+		if buckets[i].Count <= 0 {
+			continue
+		}
+		if cumulative+buckets[i].Count < rank && i < len(buckets)-1 {
+			cumulative += buckets[i].Count
+			continue
+		}
+
+		fraction := math.Min(1, (rank-cumulative)/buckets[i].Count)
+		return buckets[i].Lower + (buckets[i].Upper-buckets[i].Lower)*fraction
+	}
+	return buckets[len(buckets)-1].Upper
+}
+
+/*
+Estimates the fraction of the observations that are within [lower, upper], like
+PromQL's histogram_fraction. Buckets that are partially within the range are
+interpolated linearly.
+*/
+func (h *Histogram) Fraction(lower float64, upper float64) float64 {
+	if h.Count <= 0 || math.IsNaN(lower) || math.IsNaN(upper) {
+		return math.NaN()
+	}
+	if lower >= upper {
+		return 0
+	}
+
+	count := 0.0
+	for _, bucket := range h.GetBuckets() {
+		if bucket.Upper <= lower || bucket.Lower >= upper {
+			continue
+		}
+		if bucket.Lower >= lower && bucket.Upper <= upper {
+			count += bucket.Count
+			continue
+		}
+		if bucket.Upper == bucket.Lower {
+			continue
+		}
+		overlap := math.Min(upper, bucket.Upper) - math.Max(lower, bucket.Lower)
+		count += bucket.Count * overlap / (bucket.Upper - bucket.Lower)
+	}
+	return count / h.Count
+}
+
+/*
+Encodes the histogram as:
+[schema - 4 bytes][zero threshold - 8 bytes][zero count - 8 bytes][count - 8 bytes][sum - 8 bytes]
+followed by the positive and then the negative buckets, each as
+[number of spans - 4 bytes][offset - 4 bytes][length - 4 bytes]...[count - 8 bytes]...
+*/
+func (h *Histogram) Encode() []byte {
+	buf := make([]byte, 0, 44+8*len(h.PositiveSpans)+8*len(h.NegativeSpans)+8*len(h.PositiveBuckets)+8*len(h.NegativeBuckets))
+	buf = append(buf, utils.Int32ToBytesLittleEndian(h.Schema)...)
+	buf = append(buf, utils.Float64ToBytesLittleEndian(h.ZeroThreshold)...)
+	buf = append(buf, utils.Float64ToBytesLittleEndian(h.ZeroCount)...)
+	buf = append(buf, utils.Float64ToBytesLittleEndian(h.Count)...)
+	buf = append(buf, utils.Float64ToBytesLittleEndian(h.Sum)...)
+	buf = encodeBuckets(buf, h.PositiveSpans, h.PositiveBuckets)
+	buf = encodeBuckets(buf, h.NegativeSpans, h.NegativeBuckets)
+	return buf
+}
+
+func encodeBuckets(buf []byte, spans []Span, counts []float64) []byte {
+	buf = append(buf, utils.Uint32ToBytesLittleEndian(uint32(len(spans)))...)
+	for _, span := range spans {
+		buf = append(buf, utils.Int32ToBytesLittleEndian(span.Offset)...)
+		buf = append(buf, utils.Uint32ToBytesLittleEndian(span.Length)...)
+	}
+	for _, count := range counts {
+		buf = append(buf, utils.Float64ToBytesLittleEndian(count)...)
+	}
+	return buf
+}
+
+func Decode(raw []byte) (*Histogram, error) {
+	if len(raw) < 36 {
+		return nil, ErrCorruptHistogram
+	}
+	h := &Histogram{
+		Schema:        utils.BytesToInt32LittleEndian(raw[0:4]),
+		ZeroThreshold: utils.BytesToFloat64LittleEndian(raw[4:12]),
+		ZeroCount:     utils.BytesToFloat64LittleEndian(raw[12:20]),
+		Count:         utils.BytesToFloat64LittleEndian(raw[20:28]),
+		Sum:           utils.BytesToFloat64LittleEndian(raw[28:36]),
+	}
+
+	var err error
+	raw = raw[36:]
+	h.PositiveSpans, h.PositiveBuckets, raw, err = decodeBuckets(raw)
+	if err != nil {
+		return nil, err
+	}
+	h.NegativeSpans, h.NegativeBuckets, _, err = decodeBuckets(raw)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func decodeBuckets(raw []byte) ([]Span, []float64, []byte, error) {
+	if len(raw) < 4 {
+		return nil, nil, nil, ErrCorruptHistogram
+	}
+	numSpans := int(utils.BytesToUint32LittleEndian(raw[0:4]))
+	raw = raw[4:]
+	if numSpans == 0 {
+		return nil, nil, raw, nil
+	}
+	if len(raw) < numSpans*8 {
+		return nil, nil, nil, ErrCorruptHistogram
+	}
+
+	spans := make([]Span, numSpans)
+	for i := range spans {
+		spans[i] = Span{
+			Offset: utils.BytesToInt32LittleEndian(raw[0:4]),
+			Length: utils.BytesToUint32LittleEndian(raw[4:8]),
+		}
+		raw = raw[8:]
+	}
+
+	numBuckets := getNumBuckets(spans)
+	if len(raw) < numBuckets*8 {
+		return nil, nil, nil, ErrCorruptHistogram
+	}
+	counts := make([]float64, numBuckets)
+	for i := range counts {
+		counts[i] = utils.BytesToFloat64LittleEndian(raw[0:8])
+		raw = raw[8:]
+	}
+	return spans, counts, raw, nil
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package histogram
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Schema 0 has buckets (0.5, 1], (1, 2], (2, 4], (4, 8] for indices 0 to 3.
+func getTestHistogram() *Histogram {
+	return &Histogram{
+		Schema:          0,
+		ZeroThreshold:   0.001,
+		ZeroCount:       2,
+		Count:           12,
+		Sum:             30,
+		PositiveSpans:   []Span{{Offset: 0, Length: 2}, {Offset: 1, Length: 1}},
+		PositiveBuckets: []float64{2, 4, 2},
+		NegativeSpans:   []Span{{Offset: 1, Length: 1}},
+		NegativeBuckets: []float64{2},
+	}
+}
+
+func Test_GetBuckets(t *testing.T) {
+	h := getTestHistogram()
+	assert.Nil(t, h.Validate())
+
+	assert.Equal(t, []Bucket{
+		{Lower: -2, Upper: -1, Count: 2},
+		{Lower: -0.001, Upper: 0.001, Count: 2},
+		{Lower: 0.5, Upper: 1, Count: 2},
+		{Lower: 1, Upper: 2, Count: 4},
+		{Lower: 4, Upper: 8, Count: 2},
+	}, h.GetBuckets())
+
+	h.PositiveBuckets = h.PositiveBuckets[:2]
+	assert.NotNil(t, h.Validate())
+}
+
+func Test_QuantileAndFraction(t *testing.T) {
+	h := getTestHistogram()
+
+	assert.Equal(t, float64(-2), h.Quantile(0))
+	assert.Equal(t, float64(-1), h.Quantile(2.0/12))
+	assert.Equal(t, float64(1.5), h.Quantile(8.0/12))
+	assert.Equal(t, float64(6), h.Quantile(11.0/12))
+	assert.Equal(t, float64(8), h.Quantile(1))
+	assert.True(t, math.IsInf(h.Quantile(-1), -1))
+	assert.True(t, math.IsInf(h.Quantile(2), 1))
+	assert.True(t, math.IsNaN((&Histogram{}).Quantile(0.5)))
+
+	// half of the zero bucket is above zero
+	assert.Equal(t, float64(7)/12, h.Fraction(0, 2))
+	assert.Equal(t, float64(3)/12, h.Fraction(math.Inf(-1), 0))
+	assert.Equal(t, float64(3)/12, h.Fraction(1.5, 6))
+	assert.Equal(t, float64(0), h.Fraction(2, 1))
+}
+
+func Test_AddSubAndMul(t *testing.T) {
+	h := getTestHistogram()
+
+	doubled := h.Add(h)
+	assert.Equal(t, h.Mul(2), doubled)
+	assert.Equal(t, float64(24), doubled.Count)
+	assert.Equal(t, float64(60), doubled.Sum)
+
+	diff := doubled.Sub(h)
+	assert.Equal(t, h.Count, diff.Count)
+	assert.Equal(t, h.GetBuckets(), diff.GetBuckets())
+	assert.True(t, h.IsCounterResetFrom(doubled))
+	assert.False(t, doubled.IsCounterResetFrom(h))
+
+	// schema 1 buckets (1, 1.41] and (1.41, 2] merge into (1, 2] of schema 0
+	finer := &Histogram{
+		Schema:          1,
+		Count:           3,
+		Sum:             4,
+		PositiveSpans:   []Span{{Offset: 1, Length: 2}},
+		PositiveBuckets: []float64{1, 2},
+	}
+	sum := h.Add(finer)
+	assert.Equal(t, int32(0), sum.Schema)
+	assert.Equal(t, float64(15), sum.Count)
+	assert.Equal(t, []Bucket{
+		{Lower: -2, Upper: -1, Count: 2},
+		{Lower: -0.001, Upper: 0.001, Count: 2},
+		{Lower: 0.5, Upper: 1, Count: 2},
+		{Lower: 1, Upper: 2, Count: 7},
+		{Lower: 4, Upper: 8, Count: 2},
+	}, sum.GetBuckets())
+}
+
+func Test_SetBuckets(t *testing.T) {
+	h := &Histogram{}
+	h.SetBuckets(MAX_SCHEMA+1, map[int32]float64{1: 1, 2: 2, 3: 3, 5: 0}, map[int32]float64{})
+
+	assert.Equal(t, int32(MAX_SCHEMA), h.Schema)
+	assert.Equal(t, []Span{{Offset: 1, Length: 2}}, h.PositiveSpans)
+	assert.Equal(t, []float64{3, 3}, h.PositiveBuckets)
+	assert.Empty(t, h.NegativeSpans)
+	assert.Nil(t, h.Validate())
+}
+
+func Test_EncodeDecode(t *testing.T) {
+	h := getTestHistogram()
+
+	decoded, err := Decode(h.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, h, decoded)
+
+	_, err = Decode(h.Encode()[:40])
+	assert.Equal(t, ErrCorruptHistogram, err)
+}
+
+func Test_WriteAndReadBlockHistograms(t *testing.T) {
+	fileName := GetHistogramFileName(filepath.Join(t.TempDir(), "mock"), 0)
+	allSamples := map[uint64][]Sample{
+		42: {{Ts: 10, H: getTestHistogram()}},
+		7:  {{Ts: 20, H: getTestHistogram()}, {Ts: 30, H: getTestHistogram().Mul(2)}},
+	}
+
+	err := WriteBlockHistograms(fileName, allSamples)
+	assert.Nil(t, err)
+
+	reader, err := InitBlockHistogramReader(fileName)
+	assert.Nil(t, err)
+
+	for tsid, expected := range allSamples {
+		samples, found, err := reader.GetSamples(tsid)
+		assert.Nil(t, err)
+		assert.True(t, found)
+		assert.Equal(t, expected, samples)
+	}
+
+	_, found, err := reader.GetSamples(8)
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
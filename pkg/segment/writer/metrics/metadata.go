@@ -0,0 +1,240 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siglens/siglens/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// How many distinct metadata entries are kept for a metric. Newer entries
+// replace the oldest one.
+const MAX_METADATA_PER_METRIC = 10
+
+const METRIC_METADATA_FLUSH_INTERVAL = 60 * time.Second
+
+// MetricMetadata is the TYPE, HELP and UNIT of a metric family, in the format
+// of the Prometheus /api/v1/metadata API.
+type MetricMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+type orgMetricMetadata struct {
+	metrics map[string][]MetricMetadata
+	dirty   bool
+}
+
+var metricMetadataLock sync.RWMutex
+var metricMetadata = make(map[int64]*orgMetricMetadata)
+var metricMetadataBaseDir string
+
+// Loads the saved metadata of all orgs and starts saving the changes
+// periodically.
+func InitMetricMetadata() error {
+	metricMetadataBaseDir = config.GetCurrentNodeIngestDir() + "metricmetadata"
+	err := os.MkdirAll(metricMetadataBaseDir, 0764)
+	if err != nil {
+		return fmt.Errorf("InitMetricMetadata: failed to create dir=%v, err=%v", metricMetadataBaseDir, err)
+	}
+
+	files, err := os.ReadDir(metricMetadataBaseDir)
+	if err != nil {
+		return fmt.Errorf("InitMetricMetadata: failed to read dir=%v, err=%v", metricMetadataBaseDir, err)
+	}
+
+	metricMetadataLock.Lock()
+	for _, file := range files {
+		orgid, ok := getMetricMetadataFileOrgId(file.Name())
+		if !ok {
+			continue
+		}
+		fileName := filepath.Join(metricMetadataBaseDir, file.Name())
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			log.Errorf("InitMetricMetadata: failed to read file=%v, err=%v", fileName, err)
+			continue
+		}
+		orgMetadata := make(map[string][]MetricMetadata)
+		err = json.Unmarshal(data, &orgMetadata)
+		if err != nil {
+			log.Errorf("InitMetricMetadata: failed to parse file=%v, err=%v", fileName, err)
+			continue
+		}
+		metricMetadata[orgid] = &orgMetricMetadata{metrics: orgMetadata}
+	}
+	metricMetadataLock.Unlock()
+
+	go timeBasedMetricMetadataFlush()
+	return nil
+}
+
+func getMetricMetadataFileName(orgid int64) string {
+	if orgid != 0 {
+		return filepath.Join(metricMetadataBaseDir, "metadata-"+strconv.FormatInt(orgid, 10)+".json")
+	}
+	return filepath.Join(metricMetadataBaseDir, "metadata.json")
+}
+
+func getMetricMetadataFileOrgId(fileName string) (int64, bool) {
+	if fileName == "metadata.json" {
+		return 0, true
+	}
+	if !strings.HasPrefix(fileName, "metadata-") || !strings.HasSuffix(fileName, ".json") {
+		return 0, false
+	}
+	orgid, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(fileName, "metadata-"), ".json"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return orgid, true
+}
+
+func timeBasedMetricMetadataFlush() {
+	for {
+		time.Sleep(METRIC_METADATA_FLUSH_INTERVAL)
+		FlushMetricMetadata()
+	}
+}
+
+// Saves the metadata of the orgs that changed since the last flush.
+func FlushMetricMetadata() {
+	if metricMetadataBaseDir == "" {
+		return
+	}
+
+	toFlush := make(map[int64][]byte)
+	metricMetadataLock.Lock()
+	for orgid, orgMetadata := range metricMetadata {
+		if !orgMetadata.dirty {
+			continue
+		}
+		data, err := json.Marshal(orgMetadata.metrics)
+		if err != nil {
+			log.Errorf("FlushMetricMetadata: failed to marshal metadata of orgid=%v, err=%v", orgid, err)
+			continue
+		}
+		toFlush[orgid] = data
+		orgMetadata.dirty = false
+	}
+	metricMetadataLock.Unlock()
+
+	for orgid, data := range toFlush {
+		fileName := getMetricMetadataFileName(orgid)
+		err := os.WriteFile(fileName, data, 0644)
+		if err != nil {
+			log.Errorf("FlushMetricMetadata: failed to write file=%v, err=%v", fileName, err)
+		}
+	}
+}
+
+// Records the metadata of a metric family. Metadata that is already known for
+// the metric is ignored, so this is cheap to call for every request.
+func UpdateMetricMetadata(orgid int64, metricName string, metadata MetricMetadata) {
+	if metricName == "" {
+		return
+	}
+
+	metricMetadataLock.RLock()
+	orgMetadata, ok := metricMetadata[orgid]
+	known := ok && hasMetricMetadata(orgMetadata.metrics[metricName], metadata)
+	metricMetadataLock.RUnlock()
+	if known {
+		return
+	}
+
+	metricMetadataLock.Lock()
+	defer metricMetadataLock.Unlock()
+	orgMetadata, ok = metricMetadata[orgid]
+	if !ok {
+		orgMetadata = &orgMetricMetadata{metrics: make(map[string][]MetricMetadata)}
+		metricMetadata[orgid] = orgMetadata
+	}
+	entries := orgMetadata.metrics[metricName]
+	if hasMetricMetadata(entries, metadata) {
+		return
+	}
+	if len(entries) >= MAX_METADATA_PER_METRIC {
+		entries = entries[1:]
+	}
+	orgMetadata.metrics[metricName] = append(entries, metadata)
+	orgMetadata.dirty = true
+}
+
+func hasMetricMetadata(entries []MetricMetadata, metadata MetricMetadata) bool {
+	for _, entry := range entries {
+		if entry == metadata {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Returns the metadata of the metrics of the org, or only of metricName when it
+is set. At most limit metrics, sorted by name, and limitPerMetric entries per
+metric are returned; a limit of 0 or less is unlimited.
+*/
+func GetMetricMetadata(orgid int64, metricName string, limit int, limitPerMetric int) map[string][]MetricMetadata {
+	result := make(map[string][]MetricMetadata)
+
+	metricMetadataLock.RLock()
+	defer metricMetadataLock.RUnlock()
+	orgMetadata, ok := metricMetadata[orgid]
+	if !ok {
+		return result
+	}
+
+	names := make([]string, 0, len(orgMetadata.metrics))
+	for name := range orgMetadata.metrics {
+		if metricName == "" || name == metricName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if limit > 0 && len(names) > limit {
+		names = names[:limit]
+	}
+
+	for _, name := range names {
+		entries := orgMetadata.metrics[name]
+		if limitPerMetric > 0 && len(entries) > limitPerMetric {
+			entries = entries[:limitPerMetric]
+		}
+		result[name] = append([]MetricMetadata(nil), entries...)
+	}
+	return result
+}
+
+func resetMetricMetadata() {
+	metricMetadataLock.Lock()
+	defer metricMetadataLock.Unlock()
+	metricMetadata = make(map[int64]*orgMetricMetadata)
+	metricMetadataBaseDir = ""
+}
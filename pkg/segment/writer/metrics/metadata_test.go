@@ -0,0 +1,74 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MetricMetadata(t *testing.T) {
+	ResetMetricsSegStore_TestOnly()
+	t.Cleanup(ResetMetricsSegStore_TestOnly)
+
+	requests := MetricMetadata{Type: "counter", Help: "Number of requests."}
+	UpdateMetricMetadata(0, "http_requests", requests)
+	UpdateMetricMetadata(0, "http_requests", requests)
+	UpdateMetricMetadata(0, "http_requests", MetricMetadata{Type: "counter", Help: "Requests."})
+	UpdateMetricMetadata(0, "latency", MetricMetadata{Type: "histogram", Unit: "seconds"})
+	UpdateMetricMetadata(1, "memory", MetricMetadata{Type: "gauge"})
+	UpdateMetricMetadata(0, "", MetricMetadata{Type: "gauge"})
+
+	metadata := GetMetricMetadata(0, "", -1, -1)
+	assert.Len(t, metadata, 2)
+	assert.Equal(t, []MetricMetadata{requests, {Type: "counter", Help: "Requests."}}, metadata["http_requests"])
+	assert.Equal(t, []MetricMetadata{{Type: "histogram", Unit: "seconds"}}, metadata["latency"])
+
+	assert.Equal(t, map[string][]MetricMetadata{"http_requests": {requests}}, GetMetricMetadata(0, "", 1, 1))
+	assert.Equal(t, map[string][]MetricMetadata{"latency": {{Type: "histogram", Unit: "seconds"}}}, GetMetricMetadata(0, "latency", -1, -1))
+	assert.Equal(t, map[string][]MetricMetadata{"memory": {{Type: "gauge"}}}, GetMetricMetadata(1, "", -1, -1))
+	assert.Empty(t, GetMetricMetadata(2, "", -1, -1))
+
+	// only the newest entries of a metric are kept
+	for i := 0; i < MAX_METADATA_PER_METRIC; i++ {
+		UpdateMetricMetadata(0, "latency", MetricMetadata{Type: "histogram", Help: fmt.Sprintf("help %v", i)})
+	}
+	entries := GetMetricMetadata(0, "latency", -1, -1)["latency"]
+	assert.Len(t, entries, MAX_METADATA_PER_METRIC)
+	assert.Equal(t, "help 0", entries[0].Help)
+}
+
+func Test_MetricMetadata_Flush(t *testing.T) {
+	config.InitializeTestingConfig(t.TempDir())
+	ResetMetricsSegStore_TestOnly()
+	t.Cleanup(ResetMetricsSegStore_TestOnly)
+
+	assert.NoError(t, InitMetricMetadata())
+	UpdateMetricMetadata(0, "http_requests", MetricMetadata{Type: "counter"})
+	UpdateMetricMetadata(3, "memory", MetricMetadata{Type: "gauge", Unit: "bytes"})
+	FlushMetricMetadata()
+
+	resetMetricMetadata()
+	assert.Empty(t, GetMetricMetadata(0, "", -1, -1))
+	assert.NoError(t, InitMetricMetadata())
+	assert.Equal(t, map[string][]MetricMetadata{"http_requests": {{Type: "counter"}}}, GetMetricMetadata(0, "", -1, -1))
+	assert.Equal(t, map[string][]MetricMetadata{"memory": {{Type: "gauge", Unit: "bytes"}}}, GetMetricMetadata(3, "", -1, -1))
+}
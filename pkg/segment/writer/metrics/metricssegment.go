@@ -39,12 +39,14 @@ import (
 	"github.com/siglens/siglens/pkg/blob"
 	dtu "github.com/siglens/siglens/pkg/common/dtypeutils"
 	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/instrumentation"
 	"github.com/siglens/siglens/pkg/segment/memory"
 	"github.com/siglens/siglens/pkg/segment/query/summary"
 	"github.com/siglens/siglens/pkg/segment/reader/microreader"
 	"github.com/siglens/siglens/pkg/segment/structs"
 	sutils "github.com/siglens/siglens/pkg/segment/utils"
 	"github.com/siglens/siglens/pkg/segment/writer/metrics/compress"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/histogram"
 	"github.com/siglens/siglens/pkg/segment/writer/metrics/meta"
 	"github.com/siglens/siglens/pkg/segment/writer/suffix"
 	"github.com/siglens/siglens/pkg/usageStats"
@@ -78,6 +80,7 @@ const (
 	METRICS_NAME_WAL_FLUSH_SLEEP_DURATION       = 1  // 1 sec
 	METRICS_META_ENTRY_WAL_FLUSH_SLEEP_DURATION = 1  // 1 sec
 	METRICS_NAME_WAL_DIR                        = "mname"
+	HISTOGRAM_WAL_DIR                           = "hist"
 	META_ENTRY_WAL_DIR                          = "metaentry"
 	METRICS_META_ENTRY_WAL_FILE                 = "metricsMetaEntry.wal"
 )
@@ -166,6 +169,8 @@ A metrics buffer represent a 15 minute (or 1GB size) window of encoded series
 Every 5s, this metrics buffer should persist to disk and will create / update two file:
  1. Raw TS encoded file. Format [tsid][packed-len][raw-values]
  2. TSID offset file. Format [tsid][soff]
+
+If the block has native histogram samples, they are persisted to a third .hsg file.
 */
 type MetricsBlock struct {
 	tsidLookup     map[uint64]int
@@ -174,6 +179,16 @@ type MetricsBlock struct {
 	mBlockSummary  *structs.MBlockSummary
 	blkEncodedSize uint64 // total encoded size of the block
 	dpWalState     dpWalState
+	histSamples    map[uint64][]histogram.Sample // native histogram samples by tsid
+	histLock       sync.Mutex
+	histWalState   histWalState
+}
+
+// WAL of the native histogram samples of a block; there is one file per block.
+type histWalState struct {
+	currentWal      *wal.Wal
+	samplesInWalMem []wal.WalHistogram
+	lock            sync.Mutex
 }
 
 type dpWalState struct {
@@ -221,6 +236,18 @@ func InitMetricsSegStore() {
 	if err != nil {
 		log.Errorf("InitMetricsSegStore: failed to initialize metrics meta: %v", err)
 	}
+	err = InitMetricRelabelRules()
+	if err != nil {
+		log.Errorf("InitMetricsSegStore: failed to initialize metric relabel rules: %v", err)
+	}
+	err = InitMetricMetadata()
+	if err != nil {
+		log.Errorf("InitMetricsSegStore: failed to initialize metric metadata: %v", err)
+	}
+	err = InitExemplars()
+	if err != nil {
+		log.Errorf("InitMetricsSegStore: failed to initialize exemplars: %v", err)
+	}
 	go timeBasedMetricsFlush()
 	go timeBasedRotate()
 	go timeBasedTagsTreeFlush()
@@ -264,6 +291,12 @@ func initOrgMetrics(orgid int64) error {
 			return err
 		}
 
+		err = mSeg.mBlock.initNewHistWal()
+		if err != nil {
+			log.Errorf("initOrgMetrics : Failed to initialize new histogram WAL in mSeg.mBlock: %v", err)
+			return err
+		}
+
 		err = mSeg.initNewMNameWAL()
 		if err != nil {
 			log.Errorf("initOrgMetrics : Failed to initialize new Metrics Name WAL in mSeg: %v", err)
@@ -285,6 +318,10 @@ func initOrgMetrics(orgid int64) error {
 
 func ResetMetricsSegStore_TestOnly() {
 	OrgMetricsAndTags = make(map[int64]*MetricsAndTagsHolder)
+	resetSeriesLimiters()
+	resetMetricRelabelRules()
+	resetMetricMetadata()
+	resetExemplars()
 }
 
 /*
@@ -514,24 +551,75 @@ If it cannot find the series or no space exists in the metrics segment, it will
 Return number of bytes written and any error encountered
 */
 func EncodeDatapoint(mName []byte, tags *TagsHolder, dp float64, timestamp uint32, nBytes uint64, orgid int64) error {
+	_, err := encodeSeriesDatapoint(mName, tags, dp, timestamp, nBytes, orgid)
+	if err == errSeriesDroppedByRelabel {
+		return nil
+	}
+	return err
+}
+
+// WrittenSeries is the metric name and labels of the series that a datapoint
+// was written to, after the relabel rules and series limits of the org.
+type WrittenSeries struct {
+	MetricName string
+	Labels     map[string]string
+}
+
+// Encodes the datapoint like EncodeDatapoint, and returns the series it was
+// written to, or nil when the relabel rules dropped it.
+func EncodeDatapointGetSeries(mName []byte, tags *TagsHolder, dp float64, timestamp uint32, nBytes uint64, orgid int64) (*WrittenSeries, error) {
+	series, err := encodeSeriesDatapoint(mName, tags, dp, timestamp, nBytes, orgid)
+	if err == errSeriesDroppedByRelabel {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := series.tags.GetEntries()
+	written := &WrittenSeries{MetricName: string(series.mName), Labels: make(map[string]string, len(entries))}
+	for _, entry := range entries {
+		written.Labels[entry.tagKey] = string(entry.tagValue)
+	}
+	return written, nil
+}
+
+// The series that a datapoint was written to.
+type encodedSeries struct {
+	mSeg  *MetricsSegment
+	tsid  uint64
+	mName []byte
+	tags  *TagsHolder
+}
+
+// Encodes the datapoint and returns the series it was written to. This is not
+// the series of the given name and tags when the relabel rules of the org
+// changed them, or when the series limits dropped some of the tags.
+func encodeSeriesDatapoint(mName []byte, tags *TagsHolder, dp float64, timestamp uint32, nBytes uint64, orgid int64) (*encodedSeries, error) {
+	mName, tags, keep := relabelSeries(mName, tags, getMetricRelabelConfigs(orgid))
+	if !keep {
+		instrumentation.IncrementInt64Counter(instrumentation.METRICS_RELABEL_DROPPED_SAMPLES, 1)
+		return nil, errSeriesDroppedByRelabel
+	}
+
 	if len(mName) == 0 {
 		log.Errorf("EncodeDatapoint: metric name is empty, orgid=%v", orgid)
-		return fmt.Errorf("metric name is empty")
+		return nil, fmt.Errorf("metric name is empty")
 	}
 	tsid, err := tags.GetTSID(mName)
 	if err != nil {
 		log.Errorf("EncodeDatapoint: failed to get TSID for metric=%s, orgid=%v, err=%v", mName, orgid, err)
-		return err
+		return nil, err
 	}
 	mSeg, tth, err := getMetricsSegment(mName, orgid)
 	if err != nil {
 		log.Errorf("EncodeDatapoint: failed to get metrics segment for metric=%s, orgid=%v, err=%v", mName, orgid, err)
-		return err
+		return nil, err
 	}
 
 	if mSeg == nil {
 		log.Errorf("EncodeDatapoint: got nil metrics segment for metric=%s, orgid=%v", mName, orgid)
-		return fmt.Errorf("no segment remaining to be assigned to orgid=%v", orgid)
+		return nil, fmt.Errorf("no segment remaining to be assigned to orgid=%v", orgid)
 	}
 
 	mSeg.rwLock.Lock()
@@ -551,11 +639,29 @@ func EncodeDatapoint(mName []byte, tags *TagsHolder, dp float64, timestamp uint3
 	if err != nil {
 		mSeg.rwLock.RUnlock()
 		log.Errorf("EncodeDatapoint: failed to get time series for tsid=%v, metric=%s, orgid=%v, err=%v", tsid, mName, orgid, err)
-		return err
+		return nil, err
 	}
 	var bytesWritten uint64
 	mSeg.rwLock.RUnlock()
 
+	if !seriesExists && config.IsMetricsLimitsEnabled() {
+		var limitedTsid uint64
+		tags, limitedTsid, err = admitSeries(mName, tags, tsid, orgid)
+		if err != nil {
+			return nil, err
+		}
+		if limitedTsid != tsid {
+			tsid = limitedTsid
+			mSeg.rwLock.RLock()
+			ts, seriesExists, err = mSeg.mBlock.GetTimeSeries(tsid)
+			mSeg.rwLock.RUnlock()
+			if err != nil {
+				log.Errorf("EncodeDatapoint: failed to get time series for tsid=%v, metric=%s, orgid=%v, err=%v", tsid, mName, orgid, err)
+				return nil, err
+			}
+		}
+	}
+
 	// if the series does not exist, create it. but it may have been created by another goroutine during the same time
 	// as a result, we will check again while holding the write lock
 	// In addition, we need to always write at least one datapoint to the series to avoid panics on time based flushing
@@ -565,7 +671,7 @@ func EncodeDatapoint(mName []byte, tags *TagsHolder, dp float64, timestamp uint3
 		if err != nil {
 			log.Errorf("EncodeDatapoint: failed to create time series for tsid=%v, dp=%v, timestamp=%v, metric=%s, orgid=%v, err=%v",
 				tsid, dp, timestamp, mName, orgid, err)
-			return err
+			return nil, err
 		}
 		mSeg.rwLock.Lock()
 		exists, idx, err := mSeg.mBlock.InsertTimeSeries(tsid, ts)
@@ -573,7 +679,7 @@ func EncodeDatapoint(mName []byte, tags *TagsHolder, dp float64, timestamp uint3
 			mSeg.rwLock.Unlock()
 			log.Errorf("EncodeDatapoint: failed to insert time series for tsid=%v, dp=%v, timestamp=%v, metric=%s, orgid=%v, err=%v",
 				tsid, dp, timestamp, mName, orgid, err)
-			return err
+			return nil, err
 		}
 		if !exists { // if the new series was actually added, add the tsid to the block
 			mSeg.mBlock.addTsidToBlock(tsid)
@@ -584,25 +690,25 @@ func EncodeDatapoint(mName []byte, tags *TagsHolder, dp float64, timestamp uint3
 			if err != nil {
 				log.Errorf("EncodeDatapoint: failed to add single entry for tsid=%v, dp=%v, timestamp=%v, metric=%s, orgid=%v, err=%v",
 					tsid, dp, timestamp, mName, orgid, err)
-				return err
+				return nil, err
 			}
 		}
 		err = tth.AddTagsForTSID(mName, tags, tsid)
 		if err != nil {
 			log.Errorf("EncodeDatapoint: failed to add tags for tsid=%v, metric=%s, orgid=%v, err=%v", tsid, mName, orgid, err)
-			return err
+			return nil, err
 		}
 	} else {
 		bytesWritten, err = ts.AddSingleEntry(dp, timestamp)
 		if err != nil {
 			log.Errorf("EncodeDatapoint: failed to add single entry for tsid=%v, dp=%v, timestamp=%v, metric=%s, orgid=%v, err=%v",
 				tsid, dp, timestamp, mName, orgid, err)
-			return err
+			return nil, err
 		}
 	}
 	err = mSeg.mBlock.appendToWALBuffer(timestamp, dp, tsid)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	mSeg.updateTimeRange(timestamp)
@@ -612,9 +718,66 @@ func EncodeDatapoint(mName []byte, tags *TagsHolder, dp float64, timestamp uint3
 	atomic.AddUint64(&mSeg.bytesReceived, nBytes)
 	atomic.AddUint64(&mSeg.datapointCount, 1)
 
+	return &encodedSeries{mSeg: mSeg, tsid: tsid, mName: mName, tags: tags}, nil
+}
+
+/*
+Encodes a native histogram sample.
+
+The count of the histogram is encoded as a regular datapoint of the series, so
+every float query keeps working on it, and the full histogram is kept with the
+block and flushed to its .hsg file. Like the datapoints, histogram samples are
+written to a WAL of the block and replayed by RecoverWALData on startup.
+*/
+func EncodeHistogramDatapoint(mName []byte, tags *TagsHolder, h *histogram.Histogram, timestamp uint32, nBytes uint64, orgid int64) error {
+	err := h.Validate()
+	if err != nil {
+		log.Errorf("EncodeHistogramDatapoint: invalid histogram for metric=%s, orgid=%v, err=%v", mName, orgid, err)
+		return err
+	}
+
+	series, err := encodeSeriesDatapoint(mName, tags, h.Count, timestamp, nBytes, orgid)
+	if err == errSeriesDroppedByRelabel {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	mSeg, tsid := series.mSeg, series.tsid
+
+	mSeg.rwLock.RLock()
+	mSeg.mBlock.addHistogramSample(tsid, timestamp, h)
+	err = mSeg.mBlock.appendToHistWALBuffer(tsid, timestamp, h)
+	mSeg.rwLock.RUnlock()
+	if err != nil {
+		log.Errorf("EncodeHistogramDatapoint: failed to append histogram to WAL for metric=%s, orgid=%v, err=%v", mName, orgid, err)
+		return err
+	}
 	return nil
 }
 
+func (mb *MetricsBlock) addHistogramSample(tsid uint64, timestamp uint32, h *histogram.Histogram) {
+	mb.histLock.Lock()
+	defer mb.histLock.Unlock()
+	if mb.histSamples == nil {
+		mb.histSamples = make(map[uint64][]histogram.Sample)
+	}
+	mb.histSamples[tsid] = append(mb.histSamples[tsid], histogram.Sample{Ts: timestamp, H: h})
+}
+
+// Returns the histogram samples of the series in the block that are in the time range.
+func (mb *MetricsBlock) getHistogramSamples(tsid uint64, timeRange *dtu.MetricsTimeRange) []histogram.Sample {
+	mb.histLock.Lock()
+	defer mb.histLock.Unlock()
+	samples := make([]histogram.Sample, 0)
+	for _, sample := range mb.histSamples[tsid] {
+		if timeRange.CheckInRange(sample.Ts) {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
 type walFilesInfo struct {
 	mId      string
 	segID    uint64
@@ -705,7 +868,23 @@ func RecoverWALData() {
 		return
 	}
 
-	for _, fileData := range walFilesData {
+	histBaseDir := filepath.Join(baseDir, HISTOGRAM_WAL_DIR)
+	histFilesData, err := extractWALFileInfo(histBaseDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("RecoverWALData : Failed to read histogram WAL dir %s: %v", histBaseDir, err)
+	}
+	for key, histData := range histFilesData {
+		if _, ok := walFilesData[key]; !ok {
+			walFilesData[key] = &walFilesInfo{
+				mId:      histData.mId,
+				segID:    histData.segID,
+				blockNo:  histData.blockNo,
+				walFiles: []string{},
+			}
+		}
+	}
+
+	for key, fileData := range walFilesData {
 		mBlock := initMetricsBlock(fileData.mId, fileData.segID, fileData.blockNo)
 		isWalFileEmpty := true
 		for _, walFileName := range fileData.walFiles {
@@ -738,6 +917,11 @@ func RecoverWALData() {
 			}
 		}
 
+		if histData, ok := histFilesData[key]; ok {
+			hasHistograms := recoverHistogramWALFiles(mBlock, histBaseDir, histData.walFiles, !isWalFileEmpty)
+			isWalFileEmpty = isWalFileEmpty && !hasHistograms
+		}
+
 		if !isWalFileEmpty {
 			metricsKey, _ := getBaseMetricsKey(fileData.segID, fileData.mId)
 			err := mBlock.flushBlock(metricsKey, fileData.segID, uint16(fileData.blockNo))
@@ -750,6 +934,55 @@ func RecoverWALData() {
 	}
 }
 
+/*
+Replays the histogram WAL files of a block into mBlock and deletes them.
+
+The count of every histogram sample is also a datapoint of the block, which is
+normally recovered from the datapoint WAL. When that WAL had nothing for the
+block (hasDatapoints is false) the counts are encoded from the histograms.
+*/
+func recoverHistogramWALFiles(mBlock *MetricsBlock, baseDir string, walFiles []string, hasDatapoints bool) bool {
+	recovered := false
+	for _, walFileName := range walFiles {
+		filePath := filepath.Join(baseDir, walFileName)
+		walIterator, err := wal.NewHistWalReader(filePath)
+		if err != nil {
+			log.Warnf("recoverHistogramWALFiles : Failed to create WAL reader for file %s: %v", walFileName, err)
+			continue
+		}
+		for {
+			walSample, err := walIterator.Next()
+			if err != nil {
+				log.Warnf("recoverHistogramWALFiles : Error reading next WAL entry from file %s: %v", walFileName, err)
+				break
+			}
+			if walSample == nil {
+				break
+			}
+			h, err := histogram.Decode(walSample.Encoded)
+			if err != nil {
+				log.Warnf("recoverHistogramWALFiles : Failed to decode histogram from file %s: %v", walFileName, err)
+				continue
+			}
+			if !hasDatapoints {
+				err = mBlock.encodeDatapoint(walSample.Timestamp, h.Count, walSample.Tsid)
+				if err != nil {
+					log.Warnf("recoverHistogramWALFiles : Failed to encode histogram count from file %s: %v", walFileName, err)
+					break
+				}
+			}
+			mBlock.addHistogramSample(walSample.Tsid, walSample.Timestamp, h)
+			recovered = true
+		}
+		_ = walIterator.Close()
+		err = deleteWalFile(baseDir, walFileName)
+		if err != nil {
+			log.Warnf("recoverHistogramWALFiles : Failed to delete wal file %s: %v", walFileName, err)
+		}
+	}
+	return recovered
+}
+
 func (mb *MetricsBlock) encodeDatapoint(timestamp uint32, dpVal float64, tsid uint64) error {
 	var ts *TimeSeries
 	var seriesExists bool
@@ -1395,6 +1628,16 @@ func (mb *MetricsBlock) flushBlock(basePath string, suffix uint64, bufId uint16)
 		log.Errorf("MetricsBlock.flushBlock: Failed to flush TSO and TSG files at %s, err=%v", finalPath, err)
 		return err
 	}
+
+	mb.histLock.Lock()
+	defer mb.histLock.Unlock()
+	if len(mb.histSamples) > 0 {
+		err = histogram.WriteBlockHistograms(finalPath+".hsg", mb.histSamples)
+		if err != nil {
+			log.Errorf("MetricsBlock.flushBlock: Failed to flush histogram file at %s, err=%v", finalPath, err)
+			return err
+		}
+	}
 	return nil
 }
 
@@ -1420,6 +1663,9 @@ func (mb *MetricsBlock) rotateBlock(basePath string, suffix uint64, bufId uint16
 	mb.allSeries = newSeries
 	mb.blkEncodedSize = 0
 	mb.sortedTsids = make([]uint64, 0)
+	mb.histLock.Lock()
+	mb.histSamples = nil
+	mb.histLock.Unlock()
 	mb.mBlockSummary.Blknum++
 	mb.mBlockSummary.HighTs = 0
 	mb.mBlockSummary.LowTs = math.MaxInt32
@@ -1443,6 +1689,11 @@ func (mb *MetricsBlock) cleanAndInitNewDpWal() error {
 		log.Errorf("cleanAndInitNewDpWal : Failed to initialize new WAL: %v", err)
 		return err
 	}
+	err = mb.cleanAndInitNewHistWal()
+	if err != nil {
+		log.Errorf("cleanAndInitNewDpWal : Failed to initialize new histogram WAL: %v", err)
+		return err
+	}
 	return nil
 }
 
@@ -1644,6 +1895,7 @@ func ForceFlushMetricsBlock() {
 		}(ttholder)
 	}
 	wg.Wait()
+	FlushMetricMetadata()
 }
 
 func GetUnrotatedMetricsSegmentRequests(tRange *dtu.MetricsTimeRange, querySummary *summary.QuerySummary, orgid utils.Option[int64]) (map[string][]*structs.MetricsSearchRequest, error) {
@@ -2099,6 +2351,13 @@ func timeBasedWalDPSFlush() {
 				ms.mBlock.dpWalState.dpIdx = 0
 			}
 			ms.mBlock.dpWalState.lock.Unlock()
+
+			ms.mBlock.histWalState.lock.Lock()
+			err := ms.mBlock.flushHistWALBuffer()
+			if err != nil {
+				log.Warnf("timeBasedWalDPSFlush : Failed to append histograms to WAL: %v", err)
+			}
+			ms.mBlock.histWalState.lock.Unlock()
 		}
 	}
 }
@@ -2123,6 +2382,59 @@ func (mb *MetricsBlock) initNewDpWal() error {
 	return nil
 }
 
+func (mb *MetricsBlock) appendToHistWALBuffer(tsid uint64, timestamp uint32, h *histogram.Histogram) error {
+	mb.histWalState.lock.Lock()
+	defer mb.histWalState.lock.Unlock()
+
+	mb.histWalState.samplesInWalMem = append(mb.histWalState.samplesInWalMem, wal.WalHistogram{
+		Timestamp: timestamp,
+		Tsid:      tsid,
+		Encoded:   h.Encode(),
+	})
+	if len(mb.histWalState.samplesInWalMem) >= sutils.WAL_BLOCK_FLUSH_SIZE {
+		return mb.flushHistWALBuffer()
+	}
+	return nil
+}
+
+// The caller must hold histWalState.lock.
+func (mb *MetricsBlock) flushHistWALBuffer() error {
+	if len(mb.histWalState.samplesInWalMem) == 0 || mb.histWalState.currentWal == nil {
+		return nil
+	}
+	err := mb.histWalState.currentWal.Append(mb.histWalState.samplesInWalMem)
+	mb.histWalState.samplesInWalMem = mb.histWalState.samplesInWalMem[:0]
+	return err
+}
+
+func (mb *MetricsBlock) initNewHistWal() error {
+	basedir := filepath.Join(getWALBaseDir(), HISTOGRAM_WAL_DIR)
+	fileName := "shardID_" + mb.dpWalState.mId + "_segID_" + strconv.FormatUint(mb.dpWalState.segID, 10) + "_blockID_" + strconv.FormatUint(uint64(mb.mBlockSummary.Blknum), 10) + "_hist.wal"
+	filePath := filepath.Join(basedir, fileName)
+	var err error
+	mb.histWalState.currentWal, err = wal.NewWAL(filePath, wal.NewHistogramEncoder())
+	if err != nil {
+		log.Errorf("initNewHistWal : Failed to create new WAL file %s in %s: %v", fileName, basedir, err)
+		return err
+	}
+	return nil
+}
+
+// The samples of the previous block are in its .hsg file, so its histogram WAL is dropped.
+func (mb *MetricsBlock) cleanAndInitNewHistWal() error {
+	mb.histWalState.lock.Lock()
+	defer mb.histWalState.lock.Unlock()
+
+	mb.histWalState.samplesInWalMem = mb.histWalState.samplesInWalMem[:0]
+	if mb.histWalState.currentWal != nil {
+		err := mb.histWalState.currentWal.DeleteWAL()
+		if err != nil {
+			log.Errorf("cleanAndInitNewHistWal : Failed to delete WAL file: %v", err)
+		}
+	}
+	return mb.initNewHistWal()
+}
+
 func getWALBaseDir() string {
 	var sb strings.Builder
 	sb.WriteString(config.GetDataPath())
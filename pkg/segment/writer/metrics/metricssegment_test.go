@@ -21,16 +21,20 @@ import (
 	"bytes"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
 	fuzz "github.com/google/gofuzz"
+	dtu "github.com/siglens/siglens/pkg/common/dtypeutils"
 	"github.com/siglens/siglens/pkg/segment/reader/metrics/series"
 	"github.com/siglens/siglens/pkg/segment/reader/microreader"
 	"github.com/siglens/siglens/pkg/segment/structs"
 	sutils "github.com/siglens/siglens/pkg/segment/utils"
 	"github.com/siglens/siglens/pkg/segment/writer/metrics/compress"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/histogram"
+	"github.com/siglens/siglens/pkg/segment/writer/metrics/wal"
 	"github.com/siglens/siglens/pkg/utils"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -171,6 +175,7 @@ func Test_ReadWriteTsoTsgFiles(t *testing.T) {
 	}
 	tssr_block, err := tssr.InitReaderForBlock(uint16(0), queryMetrics)
 	assert.NoError(t, err)
+	assert.ElementsMatch(t, []uint64{tsid_1, tsid_2}, tssr_block.GetAllTSIDs())
 
 	// verify series 1
 	ts_itr, exists, err := tssr_block.GetTimeSeriesIterator(tsid_1)
@@ -202,6 +207,68 @@ func Test_ReadWriteTsoTsgFiles(t *testing.T) {
 	assert.Equal(t, count_2, 5000)
 }
 
+func Test_FlushHistogramSamples(t *testing.T) {
+	dir := "data/"
+	err := os.MkdirAll(dir, os.FileMode(0755))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mb := initMetricsBlock("mock", 0, 0)
+	h := &histogram.Histogram{Count: 3, Sum: 4, PositiveSpans: []histogram.Span{{Offset: 1, Length: 1}}, PositiveBuckets: []float64{3}}
+	mb.addHistogramSample(42, 100, h)
+	mb.addHistogramSample(42, 200, h.Mul(2))
+
+	samples := mb.getHistogramSamples(42, &dtu.MetricsTimeRange{StartEpochSec: 150, EndEpochSec: 250})
+	assert.Equal(t, []histogram.Sample{{Ts: 200, H: h.Mul(2)}}, samples)
+	assert.Empty(t, mb.getHistogramSamples(7, &dtu.MetricsTimeRange{StartEpochSec: 0, EndEpochSec: 250}))
+
+	err = mb.flushBlock("data/mock", 0, 0)
+	assert.NoError(t, err)
+
+	reader, err := histogram.InitBlockHistogramReader(histogram.GetHistogramFileName("data/mock0", 0))
+	assert.NoError(t, err)
+	samples, found, err := reader.GetSamples(42)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []histogram.Sample{{Ts: 100, H: h}, {Ts: 200, H: h.Mul(2)}}, samples)
+}
+
+func Test_RecoverHistogramWALFiles(t *testing.T) {
+	dir := t.TempDir()
+	h := &histogram.Histogram{Count: 3, Sum: 4, PositiveSpans: []histogram.Span{{Offset: 1, Length: 1}}, PositiveBuckets: []float64{3}}
+
+	histWal, err := wal.NewWAL(filepath.Join(dir, "shardID_mock_segID_0_blockID_0_hist.wal"), wal.NewHistogramEncoder())
+	assert.NoError(t, err)
+	err = histWal.Append([]wal.WalHistogram{
+		{Timestamp: 100, Tsid: 42, Encoded: h.Encode()},
+		{Timestamp: 200, Tsid: 42, Encoded: h.Mul(2).Encode()},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, histWal.Close())
+
+	filesInfo, err := extractWALFileInfo(dir)
+	assert.NoError(t, err)
+	fileData, ok := filesInfo["mock_0_0"]
+	assert.True(t, ok)
+
+	mb := initMetricsBlock("mock", 0, 0)
+	recovered := recoverHistogramWALFiles(mb, dir, fileData.walFiles, false)
+	assert.True(t, recovered)
+
+	samples := mb.getHistogramSamples(42, &dtu.MetricsTimeRange{StartEpochSec: 0, EndEpochSec: 250})
+	assert.Equal(t, []histogram.Sample{{Ts: 100, H: h}, {Ts: 200, H: h.Mul(2)}}, samples)
+
+	// without a datapoint WAL, the counts are recovered from the histograms
+	_, exists, err := mb.GetTimeSeries(42)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	_, err = os.Stat(filepath.Join(dir, fileData.walFiles[0]))
+	assert.True(t, os.IsNotExist(err))
+}
+
 func Test_ReadOldTso(t *testing.T) {
 	dir := "data/"
 	err := os.MkdirAll(dir, os.FileMode(0755))
@@ -0,0 +1,363 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	jp "github.com/buger/jsonparser"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/config/common"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+var errSeriesDroppedByRelabel = errors.New("series dropped by relabel rules")
+
+type metricRelabelFile struct {
+	Rules []common.MetricRelabelRule `yaml:"rules"`
+}
+
+var metricRelabelBaseDir string
+
+// Rules that were set with the API, and the compiled rules of every org, which
+// are the rules from the config followed by the ones from the API.
+var metricRelabelLock sync.RWMutex
+var apiMetricRelabelRules = make(map[int64][]common.MetricRelabelRule)
+var compiledMetricRelabelRules = make(map[int64][]*relabel.Config)
+var hasMetricRelabelRules atomic.Bool
+
+// Builders to relabel the series of the datapoints, so that relabeling does
+// not allocate one per datapoint.
+var labelsBuilderPool = sync.Pool{
+	New: func() interface{} {
+		return labels.NewBuilder(labels.EmptyLabels())
+	},
+}
+
+// Loads the relabel rules that were saved with the API and compiles them
+// along with the ones from the config.
+func InitMetricRelabelRules() error {
+	err := initMetricRelabelDir()
+	if err != nil {
+		return err
+	}
+
+	files, err := os.ReadDir(metricRelabelBaseDir)
+	if err != nil {
+		return fmt.Errorf("InitMetricRelabelRules: failed to read dir=%v, err=%v", metricRelabelBaseDir, err)
+	}
+
+	metricRelabelLock.Lock()
+	defer metricRelabelLock.Unlock()
+	for _, file := range files {
+		orgid, ok := getMetricRelabelFileOrgId(file.Name())
+		if !ok {
+			continue
+		}
+		rules, err := readMetricRelabelFile(orgid)
+		if err != nil {
+			log.Errorf("InitMetricRelabelRules: %v", err)
+			continue
+		}
+		apiMetricRelabelRules[orgid] = rules
+	}
+	reloadMetricRelabelRulesLocked()
+	return nil
+}
+
+func initMetricRelabelDir() error {
+	metricRelabelBaseDir = config.GetCurrentNodeIngestDir() + "metricrelabel"
+	err := os.MkdirAll(metricRelabelBaseDir, 0764)
+	if err != nil {
+		return fmt.Errorf("initMetricRelabelDir: failed to create dir=%v, err=%v", metricRelabelBaseDir, err)
+	}
+	return nil
+}
+
+func getMetricRelabelFileName(orgid int64) string {
+	if orgid != 0 {
+		return filepath.Join(metricRelabelBaseDir, "relabel-"+strconv.FormatInt(orgid, 10)+".yaml")
+	}
+	return filepath.Join(metricRelabelBaseDir, "relabel.yaml")
+}
+
+func getMetricRelabelFileOrgId(fileName string) (int64, bool) {
+	if fileName == "relabel.yaml" {
+		return 0, true
+	}
+	if !strings.HasPrefix(fileName, "relabel-") || !strings.HasSuffix(fileName, ".yaml") {
+		return 0, false
+	}
+	orgid, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(fileName, "relabel-"), ".yaml"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return orgid, true
+}
+
+func readMetricRelabelFile(orgid int64) ([]common.MetricRelabelRule, error) {
+	fileName := getMetricRelabelFileName(orgid)
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("readMetricRelabelFile: failed to read file=%v, err=%v", fileName, err)
+	}
+
+	relabelFile := &metricRelabelFile{}
+	err = yaml.Unmarshal(data, relabelFile)
+	if err != nil {
+		return nil, fmt.Errorf("readMetricRelabelFile: failed to parse file=%v, err=%v", fileName, err)
+	}
+	_, err = CompileMetricRelabelRules(relabelFile.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("readMetricRelabelFile: file=%v, err=%v", fileName, err)
+	}
+	return relabelFile.Rules, nil
+}
+
+func writeMetricRelabelFile(orgid int64, rules []common.MetricRelabelRule) error {
+	if metricRelabelBaseDir == "" {
+		err := initMetricRelabelDir()
+		if err != nil {
+			return err
+		}
+	}
+
+	fileName := getMetricRelabelFileName(orgid)
+	if len(rules) == 0 {
+		err := os.Remove(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("writeMetricRelabelFile: failed to remove file=%v, err=%v", fileName, err)
+		}
+		return nil
+	}
+
+	data, err := yaml.Marshal(&metricRelabelFile{Rules: rules})
+	if err != nil {
+		return fmt.Errorf("writeMetricRelabelFile: failed to marshal rules, err=%v", err)
+	}
+	err = os.WriteFile(fileName, data, 0644)
+	if err != nil {
+		return fmt.Errorf("writeMetricRelabelFile: failed to write file=%v, err=%v", fileName, err)
+	}
+	return nil
+}
+
+// Converts a rule to the Prometheus relabel config, so that empty fields get
+// the same defaults and the same validation as in metric_relabel_configs.
+func compileMetricRelabelRule(rule common.MetricRelabelRule) (*relabel.Config, error) {
+	data, err := yaml.Marshal(&rule)
+	if err != nil {
+		return nil, err
+	}
+	relabelConfig := &relabel.Config{}
+	err = yaml.Unmarshal(data, relabelConfig)
+	if err != nil {
+		return nil, err
+	}
+	return relabelConfig, nil
+}
+
+func CompileMetricRelabelRules(rules []common.MetricRelabelRule) ([]*relabel.Config, error) {
+	relabelConfigs := make([]*relabel.Config, 0, len(rules))
+	for i, rule := range rules {
+		relabelConfig, err := compileMetricRelabelRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %v: %v", i, err)
+		}
+		relabelConfigs = append(relabelConfigs, relabelConfig)
+	}
+	return relabelConfigs, nil
+}
+
+// Returns the relabel rules of the org from the config and the ones that were
+// set with the API. Samples go through the config rules first.
+func GetMetricRelabelRules(orgid int64) ([]common.MetricRelabelRule, []common.MetricRelabelRule) {
+	metricRelabelLock.RLock()
+	defer metricRelabelLock.RUnlock()
+	return config.GetMetricRelabelRules(orgid), apiMetricRelabelRules[orgid]
+}
+
+// Validates, saves and applies the API relabel rules of the org, replacing the
+// previous ones. Empty rules remove them.
+func SetMetricRelabelRules(orgid int64, rules []common.MetricRelabelRule) error {
+	_, err := CompileMetricRelabelRules(rules)
+	if err != nil {
+		return err
+	}
+
+	metricRelabelLock.Lock()
+	defer metricRelabelLock.Unlock()
+	err = writeMetricRelabelFile(orgid, rules)
+	if err != nil {
+		log.Errorf("SetMetricRelabelRules: orgid=%v, err=%v", orgid, err)
+		return err
+	}
+	if len(rules) == 0 {
+		delete(apiMetricRelabelRules, orgid)
+	} else {
+		apiMetricRelabelRules[orgid] = rules
+	}
+	reloadMetricRelabelRulesLocked()
+	return nil
+}
+
+// Compiles the rules of every org. An invalid rule from the config is logged
+// and skipped; the API rules were validated when they were set.
+func reloadMetricRelabelRulesLocked() {
+	orgids := make(map[int64]struct{})
+	for _, relabelConfig := range config.GetRunningConfig().MetricRelabelConfigs {
+		orgids[relabelConfig.OrgId] = struct{}{}
+	}
+	for orgid := range apiMetricRelabelRules {
+		orgids[orgid] = struct{}{}
+	}
+
+	compiled := make(map[int64][]*relabel.Config, len(orgids))
+	for orgid := range orgids {
+		var relabelConfigs []*relabel.Config
+		for i, rule := range config.GetMetricRelabelRules(orgid) {
+			relabelConfig, err := compileMetricRelabelRule(rule)
+			if err != nil {
+				log.Errorf("reloadMetricRelabelRulesLocked: skipping invalid config rule %v of orgid=%v, err=%v", i, orgid, err)
+				continue
+			}
+			relabelConfigs = append(relabelConfigs, relabelConfig)
+		}
+		for _, rule := range apiMetricRelabelRules[orgid] {
+			relabelConfig, err := compileMetricRelabelRule(rule)
+			if err != nil {
+				continue
+			}
+			relabelConfigs = append(relabelConfigs, relabelConfig)
+		}
+		if len(relabelConfigs) > 0 {
+			compiled[orgid] = relabelConfigs
+		}
+	}
+
+	compiledMetricRelabelRules = compiled
+	hasMetricRelabelRules.Store(len(compiled) > 0)
+}
+
+func getMetricRelabelConfigs(orgid int64) []*relabel.Config {
+	if !hasMetricRelabelRules.Load() {
+		return nil
+	}
+	metricRelabelLock.RLock()
+	defer metricRelabelLock.RUnlock()
+	return compiledMetricRelabelRules[orgid]
+}
+
+/*
+Applies the relabel configs to a series, with the metric name as __name__.
+
+Returns false when the series is dropped. Otherwise returns the metric name and
+the tags of the relabeled series. The tags are a new holder when any of them
+changed, since the given holder may be shared by other datapoints. Without
+relabel configs the series is returned as it is.
+*/
+func relabelSeries(mName []byte, tags *TagsHolder, relabelConfigs []*relabel.Config) ([]byte, *TagsHolder, bool) {
+	if len(relabelConfigs) == 0 {
+		return mName, tags, true
+	}
+
+	entries := tags.GetEntries()
+	lb := labelsBuilderPool.Get().(*labels.Builder)
+	defer labelsBuilderPool.Put(lb)
+	lb.Reset(labels.EmptyLabels())
+	for _, entry := range entries {
+		lb.Set(entry.tagKey, string(entry.tagValue))
+	}
+	lb.Set(model.MetricNameLabel, string(mName))
+
+	if !relabel.ProcessBuilder(lb, relabelConfigs...) {
+		return nil, nil, false
+	}
+
+	newName := lb.Get(model.MetricNameLabel)
+	lb.Del(model.MetricNameLabel)
+
+	// Tags with empty values are not labels, so they only go away when some
+	// other tag changed.
+	changed := false
+	numLabels := 0
+	lb.Range(func(l labels.Label) {
+		numLabels++
+		entry := findTagEntry(entries, l.Name)
+		if entry == nil || string(entry.tagValue) != l.Value {
+			changed = true
+		}
+	})
+	for _, entry := range entries {
+		if len(entry.tagValue) > 0 {
+			numLabels--
+		}
+	}
+	if !changed && numLabels == 0 {
+		return []byte(newName), tags, true
+	}
+
+	holder := GetTagsHolder()
+	lb.Range(func(l labels.Label) {
+		entry := findTagEntry(entries, l.Name)
+		if entry != nil && string(entry.tagValue) == l.Value {
+			holder.Insert(entry.tagKey, entry.tagValue, entry.tagValueType)
+		} else {
+			holder.Insert(l.Name, []byte(l.Value), jp.String)
+		}
+	})
+	return []byte(newName), holder, true
+}
+
+func findTagEntry(entries []tagEntry, key string) *tagEntry {
+	for i := range entries {
+		if entries[i].tagKey == key {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+// Applies the relabel configs to a set of labels, including __name__. Returns
+// false when the series is dropped.
+func ApplyMetricRelabelConfigs(lbls map[string]string, relabelConfigs []*relabel.Config) (map[string]string, bool) {
+	lb := labels.NewBuilder(labels.FromMap(lbls))
+	if !relabel.ProcessBuilder(lb, relabelConfigs...) {
+		return nil, false
+	}
+	return lb.Labels().Map(), true
+}
+
+func resetMetricRelabelRules() {
+	metricRelabelLock.Lock()
+	defer metricRelabelLock.Unlock()
+	apiMetricRelabelRules = make(map[int64][]common.MetricRelabelRule)
+	metricRelabelBaseDir = ""
+	reloadMetricRelabelRulesLocked()
+}
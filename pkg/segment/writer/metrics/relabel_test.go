@@ -0,0 +1,171 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"testing"
+
+	jp "github.com/buger/jsonparser"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/config/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func initMetricRelabelTest(t *testing.T, relabelConfigs []common.MetricRelabelConfig) {
+	config.InitializeTestingConfig(t.TempDir())
+	config.GetRunningConfig().MetricRelabelConfigs = relabelConfigs
+	ResetMetricsSegStore_TestOnly()
+	t.Cleanup(func() {
+		config.GetRunningConfig().MetricRelabelConfigs = nil
+		ResetMetricsSegStore_TestOnly()
+	})
+}
+
+func getTestMetricNames(orgid int64) map[string]bool {
+	names := make(map[string]bool)
+	for _, mSeg := range GetMetricSegments(orgid) {
+		mSeg.LoadMetricNamesIntoMap(names)
+	}
+	return names
+}
+
+func hasTestSeries(t *testing.T, mName string, tags map[string]string, orgid int64) bool {
+	tagHolder := GetTagsHolder()
+	for key, value := range tags {
+		tagHolder.Insert(key, []byte(value), jp.String)
+	}
+	tsid, err := tagHolder.GetTSID([]byte(mName))
+	assert.NoError(t, err)
+	mSeg, _, err := getMetricsSegment([]byte(mName), orgid)
+	assert.NoError(t, err)
+	_, exists, err := mSeg.mBlock.GetTimeSeries(tsid)
+	assert.NoError(t, err)
+	return exists
+}
+
+func Test_RelabelSeries(t *testing.T) {
+	relabelConfigs, err := CompileMetricRelabelRules([]common.MetricRelabelRule{
+		{SourceLabels: []string{"__name__"}, Regex: "debug_.*", Action: "drop"},
+		{Regex: "pod_uid", Action: "labeldrop"},
+		{SourceLabels: []string{"__name__"}, Regex: "old_(.*)", TargetLabel: "__name__", Replacement: strPtr("new_$1")},
+		{SourceLabels: []string{"instance"}, Modulus: 4, TargetLabel: "shard", Action: "hashmod"},
+	})
+	assert.NoError(t, err)
+
+	tags := GetTagsHolder()
+	tags.Insert("pod_uid", []byte("1234"), jp.String)
+	tags.Insert("code", []byte("200"), jp.Number)
+	tags.Insert("instance", []byte("host1:9100"), jp.String)
+	_, _, keep := relabelSeries([]byte("debug_requests"), tags, relabelConfigs)
+	assert.False(t, keep)
+
+	mName, newTags, keep := relabelSeries([]byte("old_requests"), tags, relabelConfigs)
+	assert.True(t, keep)
+	assert.Equal(t, "new_requests", string(mName))
+	assert.NotSame(t, tags, newTags)
+	values := make(map[string]string)
+	for _, entry := range newTags.GetEntries() {
+		values[entry.tagKey] = string(entry.tagValue)
+		if entry.tagKey == "code" {
+			assert.Equal(t, jp.Number, entry.tagValueType)
+		}
+	}
+	assert.Len(t, values, 3)
+	assert.Equal(t, "200", values["code"])
+	assert.Equal(t, "host1:9100", values["instance"])
+	assert.Contains(t, []string{"0", "1", "2", "3"}, values["shard"])
+
+	// the shared holder is not modified
+	assert.Len(t, tags.GetEntries(), 3)
+
+	// series that the rules do not change keep their tags
+	unchanged := GetTagsHolder()
+	unchanged.Insert("code", []byte("200"), jp.Number)
+	unchanged.Insert("empty", []byte(""), jp.String)
+	relabelConfigs, err = CompileMetricRelabelRules([]common.MetricRelabelRule{{Regex: "pod_uid", Action: "labeldrop"}})
+	assert.NoError(t, err)
+	mName, newTags, keep = relabelSeries([]byte("requests"), unchanged, relabelConfigs)
+	assert.True(t, keep)
+	assert.Equal(t, "requests", string(mName))
+	assert.Same(t, unchanged, newTags)
+
+	// without rules the series is not relabeled
+	mName, newTags, keep = relabelSeries([]byte("debug_requests"), tags, nil)
+	assert.True(t, keep)
+	assert.Equal(t, "debug_requests", string(mName))
+	assert.Same(t, tags, newTags)
+}
+
+func Test_CompileMetricRelabelRules_Invalid(t *testing.T) {
+	_, err := CompileMetricRelabelRules([]common.MetricRelabelRule{{Action: "explode"}})
+	assert.Error(t, err)
+	_, err = CompileMetricRelabelRules([]common.MetricRelabelRule{{Action: "hashmod", TargetLabel: "shard"}})
+	assert.Error(t, err)
+	_, err = CompileMetricRelabelRules([]common.MetricRelabelRule{{Regex: "(", Action: "drop"}})
+	assert.Error(t, err)
+}
+
+func Test_MetricRelabel_EncodeDatapoint(t *testing.T) {
+	initMetricRelabelTest(t, []common.MetricRelabelConfig{
+		{OrgId: 0, Rules: []common.MetricRelabelRule{
+			{SourceLabels: []string{"__name__"}, Regex: "go_gc_.*", Action: "drop"},
+		}},
+	})
+	metricRelabelLock.Lock()
+	reloadMetricRelabelRulesLocked()
+	metricRelabelLock.Unlock()
+
+	err := SetMetricRelabelRules(0, []common.MetricRelabelRule{
+		{Regex: "request_id", Action: "labeldrop"},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, encodeTestDatapoint("go_gc_duration", map[string]string{"job": "node"}, 0))
+	assert.NoError(t, encodeTestDatapoint("http_requests", map[string]string{"job": "api", "request_id": "r1"}, 0))
+	assert.NoError(t, encodeTestDatapoint("http_requests", map[string]string{"job": "api", "request_id": "r2"}, 0))
+
+	// other orgs are not relabeled
+	assert.NoError(t, encodeTestDatapoint("go_gc_duration", map[string]string{"job": "node"}, 1))
+
+	names := getTestMetricNames(0)
+	assert.False(t, names["go_gc_duration"])
+	assert.True(t, names["http_requests"])
+	assert.True(t, hasTestSeries(t, "http_requests", map[string]string{"job": "api"}, 0))
+	assert.False(t, hasTestSeries(t, "http_requests", map[string]string{"job": "api", "request_id": "r1"}, 0))
+	assert.True(t, getTestMetricNames(1)["go_gc_duration"])
+
+	configRules, apiRules := GetMetricRelabelRules(0)
+	assert.Len(t, configRules, 1)
+	assert.Len(t, apiRules, 1)
+
+	// the API rules are loaded again from their file
+	metricRelabelLock.Lock()
+	apiMetricRelabelRules = make(map[int64][]common.MetricRelabelRule)
+	metricRelabelLock.Unlock()
+	assert.NoError(t, InitMetricRelabelRules())
+	_, apiRules = GetMetricRelabelRules(0)
+	assert.Equal(t, []common.MetricRelabelRule{{Regex: "request_id", Action: "labeldrop"}}, apiRules)
+
+	assert.NoError(t, SetMetricRelabelRules(0, nil))
+	_, apiRules = GetMetricRelabelRules(0)
+	assert.Empty(t, apiRules)
+}
+
+func strPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rollup
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/config/common"
+	"github.com/siglens/siglens/pkg/instrumentation"
+	"github.com/siglens/siglens/pkg/segment/reader/metrics/series"
+	"github.com/siglens/siglens/pkg/segment/structs"
+	mmeta "github.com/siglens/siglens/pkg/segment/writer/metrics/meta"
+	log "github.com/sirupsen/logrus"
+)
+
+const COMPACTION_INTERVAL_MINS = 5
+
+func RunCompactionLoop() {
+	for {
+		time.Sleep(COMPACTION_INTERVAL_MINS * time.Minute)
+		CompactRotatedBlocks()
+	}
+}
+
+/*
+Rolls up every block of the rotated metrics segments that has not been rolled
+up yet. Segments that are older than the retention of every tier are skipped.
+*/
+func CompactRotatedBlocks() {
+	allMetricMetas, err := mmeta.GetLocalMetricsMetaEntries()
+	if err != nil {
+		log.Errorf("CompactRotatedBlocks: failed to get metrics meta entries, err=%v", err)
+		return
+	}
+
+	rollupConfig := config.GetMetricsRollupConfig()
+	maxTierRetentionHours := 0
+	for _, tier := range Tiers {
+		maxTierRetentionHours = max(maxTierRetentionHours, GetTierRetentionHours(tier, rollupConfig))
+	}
+	oldestEpochSec := time.Now().Add(-time.Duration(maxTierRetentionHours) * time.Hour).Unix()
+
+	for _, mMeta := range allMetricMetas {
+		if int64(mMeta.LatestEpochSec) < oldestEpochSec {
+			continue
+		}
+		for blkNum := uint16(0); blkNum < mMeta.NumBlocks; blkNum++ {
+			if IsBlockRolledUp(mMeta.MSegmentDir, blkNum) {
+				continue
+			}
+			err := CompactBlock(mMeta.MSegmentDir, blkNum)
+			if err != nil {
+				log.Errorf("CompactRotatedBlocks: failed to roll up block %v of %v, err=%v", blkNum, mMeta.MSegmentDir, err)
+				continue
+			}
+		}
+	}
+}
+
+// Returns whether the block has been rolled up. Tiers may have expired since,
+// so a block counts as rolled up if any of its tiers is still there.
+func IsBlockRolledUp(mKey string, blkNum uint16) bool {
+	for _, tier := range Tiers {
+		if _, err := os.Stat(GetRollupFileName(mKey, blkNum, tier)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the retention of the tier in hours.
+func GetTierRetentionHours(tier Tier, rollupConfig common.MetricsRollupConfig) int {
+	switch tier.ResolutionSec {
+	case 300:
+		return rollupConfig.FiveMinRetentionHours
+	case 3600:
+		return rollupConfig.OneHourRetentionHours
+	default:
+		return rollupConfig.RawRetentionHours
+	}
+}
+
+/*
+Writes the rollup files of every tier for a rotated block.
+
+The finest tier is computed from the raw datapoints and every coarser tier is
+merged from the previous one. Blocks whose raw datapoints no longer exist are
+skipped.
+*/
+func CompactBlock(mKey string, blkNum uint16) error {
+	if _, err := os.Stat(GetTsoFileName(mKey, blkNum)); err != nil {
+		return nil
+	}
+
+	tssr, err := series.InitTimeSeriesReader(mKey)
+	if err != nil {
+		return err
+	}
+	defer tssr.Close()
+
+	queryMetrics := &structs.MetricsQueryProcessingMetrics{
+		UpdateLock: &sync.Mutex{},
+	}
+	tsbr, err := tssr.InitReaderForBlock(blkNum, queryMetrics)
+	if err != nil {
+		return err
+	}
+
+	tierBuckets := make(map[uint64][]Bucket)
+	timestamps := make([]uint32, 0)
+	values := make([]float64, 0)
+	for _, tsid := range tsbr.GetAllTSIDs() {
+		tsitr, found, err := tsbr.GetTimeSeriesIterator(tsid)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+
+		timestamps = timestamps[:0]
+		values = values[:0]
+		for tsitr.Next() {
+			ts, dp := tsitr.At()
+			timestamps = append(timestamps, ts)
+			values = append(values, dp)
+		}
+		err = tsitr.Err()
+		if err != nil {
+			return err
+		}
+		if len(timestamps) == 0 {
+			continue
+		}
+
+		tierBuckets[tsid] = ComputeBuckets(timestamps, values, Tiers[0].ResolutionSec)
+	}
+
+	for i, tier := range Tiers {
+		if i > 0 {
+			for tsid, buckets := range tierBuckets {
+				tierBuckets[tsid] = MergeBuckets(buckets, tier.ResolutionSec)
+			}
+		}
+
+		err = WriteBlockRollup(GetRollupFileName(mKey, blkNum, tier), tierBuckets)
+		if err != nil {
+			return err
+		}
+	}
+
+	instrumentation.IncrementInt64Counter(instrumentation.METRICS_ROLLUP_BLOCKS_COMPACTED, 1)
+	return nil
+}
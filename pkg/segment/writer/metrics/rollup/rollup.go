@@ -0,0 +1,353 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rollup
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/segment/structs"
+	sutils "github.com/siglens/siglens/pkg/segment/utils"
+	"github.com/siglens/siglens/pkg/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrBadRollupVersion = fmt.Errorf("invalid rollup file version")
+var ErrCorruptRollupFile = fmt.Errorf("corrupt rollup file")
+
+var VERSION_ROLLUPFILE = []byte{1}
+
+// Each bucket takes 4 bytes for the timestamp, 4 for the count and 8 for
+// each of min, max, sum and last.
+const BUCKET_SIZE = 40
+
+type Tier struct {
+	Name          string
+	ResolutionSec uint32
+}
+
+// All rollup tiers, from the finest to the coarsest. Every resolution must be
+// a multiple of the previous one, as coarser tiers are built from finer ones.
+var Tiers = []Tier{
+	{Name: "5m", ResolutionSec: 300},
+	{Name: "1h", ResolutionSec: 3600},
+}
+
+/*
+Summary of the datapoints of a series within [Ts, Ts + resolution)
+*/
+type Bucket struct {
+	Ts    uint32
+	Count uint32
+	Min   float64
+	Max   float64
+	Sum   float64
+	Last  float64
+}
+
+func GetRollupFileName(mKey string, blkNum uint16, tier Tier) string {
+	return fmt.Sprintf("%s_%d_%s.mrup", mKey, blkNum, tier.Name)
+}
+
+func GetTsoFileName(mKey string, blkNum uint16) string {
+	return fmt.Sprintf("%s_%d.tso", mKey, blkNum)
+}
+
+func GetTsgFileName(mKey string, blkNum uint16) string {
+	return fmt.Sprintf("%s_%d.tsg", mKey, blkNum)
+}
+
+// Returns the value of the bucket that the given downsample aggregation
+// should use. Aggregations that have no matching summary use the last value.
+func (b *Bucket) GetValue(aggFn sutils.AggregateFunctions) float64 {
+	switch aggFn {
+	case sutils.Min:
+		return b.Min
+	case sutils.Max:
+		return b.Max
+	case sutils.Sum:
+		return b.Sum
+	case sutils.Count:
+		return float64(b.Count)
+	case sutils.Avg:
+		return b.Sum / float64(b.Count)
+	default:
+		return b.Last
+	}
+}
+
+func (b *Bucket) merge(other *Bucket) {
+	b.Count += other.Count
+	b.Min = math.Min(b.Min, other.Min)
+	b.Max = math.Max(b.Max, other.Max)
+	b.Sum += other.Sum
+	// buckets are merged in time order, so the other bucket is the later one
+	b.Last = other.Last
+}
+
+/*
+Buckets the datapoints of a series at the given resolution.
+
+The datapoints do not need to be sorted; points with the same timestamp keep
+the last one that was added as the last value. Staleness markers are skipped.
+Returns the buckets sorted by time.
+*/
+func ComputeBuckets(timestamps []uint32, values []float64, resolutionSec uint32) []Bucket {
+	order := make([]int, len(timestamps))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return timestamps[order[i]] < timestamps[order[j]]
+	})
+
+	buckets := make([]Bucket, 0)
+	for _, idx := range order {
+		val := values[idx]
+		if value.IsStaleNaN(val) {
+			continue
+		}
+		bucketTs := (timestamps[idx] / resolutionSec) * resolutionSec
+		if len(buckets) > 0 && buckets[len(buckets)-1].Ts == bucketTs {
+			buckets[len(buckets)-1].merge(&Bucket{Count: 1, Min: val, Max: val, Sum: val, Last: val})
+			continue
+		}
+		buckets = append(buckets, Bucket{Ts: bucketTs, Count: 1, Min: val, Max: val, Sum: val, Last: val})
+	}
+	return buckets
+}
+
+// Merges buckets sorted by time into buckets of a coarser resolution.
+func MergeBuckets(buckets []Bucket, resolutionSec uint32) []Bucket {
+	merged := make([]Bucket, 0)
+	for i := range buckets {
+		bucketTs := (buckets[i].Ts / resolutionSec) * resolutionSec
+		if len(merged) > 0 && merged[len(merged)-1].Ts == bucketTs {
+			merged[len(merged)-1].merge(&buckets[i])
+			continue
+		}
+		bucket := buckets[i]
+		bucket.Ts = bucketTs
+		merged = append(merged, bucket)
+	}
+	return merged
+}
+
+/*
+Writes the buckets of every series of a block to a rollup file.
+
+The file has a version byte and the number of series, followed by the sorted
+tsids with the offset of their buckets, and then the buckets of every series
+prefixed by their count. The file is written to a temporary file first, so
+that readers never see a partial file.
+*/
+func WriteBlockRollup(fileName string, allBuckets map[uint64][]Bucket) error {
+	tsids := make([]uint64, 0, len(allBuckets))
+	for tsid := range allBuckets {
+		tsids = append(tsids, tsid)
+	}
+	sort.Slice(tsids, func(i, j int) bool {
+		return tsids[i] < tsids[j]
+	})
+
+	indexBuf := bytes.NewBuffer(nil)
+	indexBuf.Write(VERSION_ROLLUPFILE)
+	indexBuf.Write(utils.Uint64ToBytesLittleEndian(uint64(len(tsids))))
+
+	dataBuf := bytes.NewBuffer(nil)
+	for _, tsid := range tsids {
+		indexBuf.Write(utils.Uint64ToBytesLittleEndian(tsid))
+		indexBuf.Write(utils.Uint32ToBytesLittleEndian(uint32(dataBuf.Len())))
+
+		buckets := allBuckets[tsid]
+		dataBuf.Write(utils.Uint32ToBytesLittleEndian(uint32(len(buckets))))
+		for i := range buckets {
+			dataBuf.Write(utils.Uint32ToBytesLittleEndian(buckets[i].Ts))
+			dataBuf.Write(utils.Uint32ToBytesLittleEndian(buckets[i].Count))
+			dataBuf.Write(utils.Float64ToBytesLittleEndian(buckets[i].Min))
+			dataBuf.Write(utils.Float64ToBytesLittleEndian(buckets[i].Max))
+			dataBuf.Write(utils.Float64ToBytesLittleEndian(buckets[i].Sum))
+			dataBuf.Write(utils.Float64ToBytesLittleEndian(buckets[i].Last))
+		}
+	}
+
+	tmpFileName := fileName + ".tmp"
+	fd, err := os.OpenFile(tmpFileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Errorf("WriteBlockRollup: failed to open file %v, err=%v", tmpFileName, err)
+		return err
+	}
+
+	_, err = fd.Write(indexBuf.Bytes())
+	if err == nil {
+		_, err = fd.Write(dataBuf.Bytes())
+	}
+	closeErr := fd.Close()
+	if err != nil || closeErr != nil {
+		log.Errorf("WriteBlockRollup: failed to write file %v, err=%v, closeErr=%v", tmpFileName, err, closeErr)
+		_ = os.Remove(tmpFileName)
+		if err != nil {
+			return err
+		}
+		return closeErr
+	}
+
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		log.Errorf("WriteBlockRollup: failed to rename %v to %v, err=%v", tmpFileName, fileName, err)
+		_ = os.Remove(tmpFileName)
+		return err
+	}
+	return nil
+}
+
+/*
+Reads the buckets of single series from a rollup file of a block
+*/
+type BlockRollupReader struct {
+	raw      []byte
+	numTSIDs uint64
+	dataOff  uint64
+}
+
+func InitBlockRollupReader(fileName string) (*BlockRollupReader, error) {
+	raw, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 9 {
+		return nil, ErrCorruptRollupFile
+	}
+	if raw[0] != VERSION_ROLLUPFILE[0] {
+		return nil, ErrBadRollupVersion
+	}
+
+	numTSIDs := utils.BytesToUint64LittleEndian(raw[1:9])
+	dataOff := 9 + numTSIDs*12
+	if uint64(len(raw)) < dataOff {
+		return nil, ErrCorruptRollupFile
+	}
+
+	return &BlockRollupReader{
+		raw:      raw,
+		numTSIDs: numTSIDs,
+		dataOff:  dataOff,
+	}, nil
+}
+
+// Returns the buckets of the series and whether it is in the block.
+func (brr *BlockRollupReader) GetBuckets(tsid uint64) ([]Bucket, bool, error) {
+	index := brr.raw[9:brr.dataOff]
+	idx := sort.Search(int(brr.numTSIDs), func(i int) bool {
+		return utils.BytesToUint64LittleEndian(index[i*12:i*12+8]) >= tsid
+	})
+	if idx >= int(brr.numTSIDs) || utils.BytesToUint64LittleEndian(index[idx*12:idx*12+8]) != tsid {
+		return nil, false, nil
+	}
+
+	offset := brr.dataOff + uint64(utils.BytesToUint32LittleEndian(index[idx*12+8:idx*12+12]))
+	if uint64(len(brr.raw)) < offset+4 {
+		return nil, true, ErrCorruptRollupFile
+	}
+	numBuckets := uint64(utils.BytesToUint32LittleEndian(brr.raw[offset : offset+4]))
+	offset += 4
+	if uint64(len(brr.raw)) < offset+numBuckets*BUCKET_SIZE {
+		return nil, true, ErrCorruptRollupFile
+	}
+
+	buckets := make([]Bucket, numBuckets)
+	for i := range buckets {
+		rawBucket := brr.raw[offset : offset+BUCKET_SIZE]
+		buckets[i] = Bucket{
+			Ts:    utils.BytesToUint32LittleEndian(rawBucket[0:4]),
+			Count: utils.BytesToUint32LittleEndian(rawBucket[4:8]),
+			Min:   utils.BytesToFloat64LittleEndian(rawBucket[8:16]),
+			Max:   utils.BytesToFloat64LittleEndian(rawBucket[16:24]),
+			Sum:   utils.BytesToFloat64LittleEndian(rawBucket[24:32]),
+			Last:  utils.BytesToFloat64LittleEndian(rawBucket[32:40]),
+		}
+		offset += BUCKET_SIZE
+	}
+	return buckets, true, nil
+}
+
+/*
+Sets the coarsest rollup resolution that the query can be answered from.
+
+A tier can be used if its resolution is not coarser than the step of the
+query, and if every range function still sees at least two points in its
+window. Instant queries always read raw datapoints.
+*/
+func SetQueryResolution(mQuery *structs.MetricsQuery) {
+	mQuery.RollupResolutionSec = 0
+	if !config.IsMetricsRollupEnabled() || mQuery.IsInstantQuery {
+		return
+	}
+
+	maxResolution := mQuery.Downsampler.GetIntervalTimeInSeconds()
+	for agg := mQuery.SubsequentAggs; agg != nil; agg = agg.Next {
+		if agg.AggBlockType != structs.FunctionBlock || agg.FunctionBlock == nil || agg.FunctionBlock.TimeWindow <= 0 {
+			continue
+		}
+		maxResolution = min(maxResolution, uint32(agg.FunctionBlock.TimeWindow/2))
+	}
+
+	for i := len(Tiers) - 1; i >= 0; i-- {
+		if Tiers[i].ResolutionSec <= maxResolution {
+			mQuery.RollupResolutionSec = Tiers[i].ResolutionSec
+			return
+		}
+	}
+}
+
+/*
+Returns the tier that a block should be read from, or false if the raw
+datapoints should be read.
+
+The coarsest tier that is not coarser than the resolution is used, if the
+block has been rolled up to it. If the raw datapoints of the block have expired,
+the finest remaining tier is used instead.
+*/
+func GetTierForBlock(mKey string, blkNum uint16, resolutionSec uint32) (Tier, bool) {
+	if resolutionSec > 0 {
+		for i := len(Tiers) - 1; i >= 0; i-- {
+			if Tiers[i].ResolutionSec > resolutionSec {
+				continue
+			}
+			if _, err := os.Stat(GetRollupFileName(mKey, blkNum, Tiers[i])); err == nil {
+				return Tiers[i], true
+			}
+		}
+	}
+
+	if _, err := os.Stat(GetTsoFileName(mKey, blkNum)); err == nil {
+		return Tier{}, false
+	}
+
+	for _, tier := range Tiers {
+		if _, err := os.Stat(GetRollupFileName(mKey, blkNum, tier)); err == nil {
+			return tier, true
+		}
+	}
+	return Tier{}, false
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rollup
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/segment/structs"
+	sutils "github.com/siglens/siglens/pkg/segment/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ComputeAndMergeBuckets(t *testing.T) {
+	// unsorted, with two points in the first 5m bucket of the second hour
+	timestamps := []uint32{3610, 10, 290, 3600, 400}
+	values := []float64{7, 1, 3, 5, -2}
+
+	buckets := ComputeBuckets(timestamps, values, 300)
+	assert.Equal(t, []Bucket{
+		{Ts: 0, Count: 2, Min: 1, Max: 3, Sum: 4, Last: 3},
+		{Ts: 300, Count: 1, Min: -2, Max: -2, Sum: -2, Last: -2},
+		{Ts: 3600, Count: 2, Min: 5, Max: 7, Sum: 12, Last: 7},
+	}, buckets)
+
+	merged := MergeBuckets(buckets, 3600)
+	assert.Equal(t, []Bucket{
+		{Ts: 0, Count: 3, Min: -2, Max: 3, Sum: 2, Last: -2},
+		{Ts: 3600, Count: 2, Min: 5, Max: 7, Sum: 12, Last: 7},
+	}, merged)
+
+	assert.Equal(t, float64(-2), merged[0].GetValue(sutils.Min))
+	assert.Equal(t, float64(3), merged[0].GetValue(sutils.Max))
+	assert.Equal(t, float64(2), merged[0].GetValue(sutils.Sum))
+	assert.Equal(t, float64(3), merged[0].GetValue(sutils.Count))
+	assert.InDelta(t, float64(2)/3, merged[0].GetValue(sutils.Avg), 1e-9)
+	assert.Equal(t, float64(-2), merged[0].GetValue(sutils.Quantile))
+
+	// Staleness markers are not values.
+	buckets = ComputeBuckets([]uint32{10, 20}, []float64{1, math.Float64frombits(value.StaleNaN)}, 300)
+	assert.Equal(t, []Bucket{{Ts: 0, Count: 1, Min: 1, Max: 1, Sum: 1, Last: 1}}, buckets)
+}
+
+func Test_WriteAndReadBlockRollup(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "mock_0_5m.mrup")
+	allBuckets := map[uint64][]Bucket{
+		42: {{Ts: 0, Count: 2, Min: 1, Max: 3, Sum: 4, Last: 3}},
+		7: {
+			{Ts: 300, Count: 1, Min: 5, Max: 5, Sum: 5, Last: 5},
+			{Ts: 600, Count: 3, Min: 1, Max: 9, Sum: 12, Last: 2},
+		},
+	}
+
+	err := WriteBlockRollup(fileName, allBuckets)
+	assert.Nil(t, err)
+
+	reader, err := InitBlockRollupReader(fileName)
+	assert.Nil(t, err)
+
+	for tsid, expected := range allBuckets {
+		buckets, found, err := reader.GetBuckets(tsid)
+		assert.Nil(t, err)
+		assert.True(t, found)
+		assert.Equal(t, expected, buckets)
+	}
+
+	_, found, err := reader.GetBuckets(8)
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
+
+func Test_GetTierForBlock(t *testing.T) {
+	mKey := filepath.Join(t.TempDir(), "mock")
+	createFile := func(fileName string) {
+		assert.Nil(t, os.WriteFile(fileName, []byte{}, 0644))
+	}
+
+	_, ok := GetTierForBlock(mKey, 0, 3600)
+	assert.False(t, ok)
+
+	createFile(GetTsoFileName(mKey, 0))
+	createFile(GetRollupFileName(mKey, 0, Tiers[0]))
+
+	tier, ok := GetTierForBlock(mKey, 0, 3600)
+	assert.True(t, ok)
+	assert.Equal(t, "5m", tier.Name)
+
+	// the step is finer than every tier
+	_, ok = GetTierForBlock(mKey, 0, 60)
+	assert.False(t, ok)
+
+	createFile(GetRollupFileName(mKey, 0, Tiers[1]))
+	tier, ok = GetTierForBlock(mKey, 0, 7200)
+	assert.True(t, ok)
+	assert.Equal(t, "1h", tier.Name)
+
+	// raw datapoints have expired, so the finest tier is read
+	assert.Nil(t, os.Remove(GetTsoFileName(mKey, 0)))
+	tier, ok = GetTierForBlock(mKey, 0, 0)
+	assert.True(t, ok)
+	assert.Equal(t, "5m", tier.Name)
+	assert.True(t, IsBlockRolledUp(mKey, 0))
+	assert.False(t, IsBlockRolledUp(mKey, 1))
+}
+
+func Test_SetQueryResolution(t *testing.T) {
+	runningConfig := config.GetTestConfig(t.TempDir())
+	runningConfig.MetricsRollup.Enabled = true
+	config.SetConfig(runningConfig)
+	defer config.SetConfig(config.GetTestConfig(t.TempDir()))
+
+	mQuery := &structs.MetricsQuery{
+		Downsampler: structs.Downsampler{Interval: 2, Unit: "h"},
+	}
+	SetQueryResolution(mQuery)
+	assert.Equal(t, uint32(3600), mQuery.RollupResolutionSec)
+
+	mQuery.Downsampler = structs.Downsampler{Interval: 30, Unit: "m"}
+	SetQueryResolution(mQuery)
+	assert.Equal(t, uint32(300), mQuery.RollupResolutionSec)
+
+	// rate over 5m needs more than one point per window
+	mQuery.SubsequentAggs = &structs.MetricQueryAgg{
+		AggBlockType:  structs.FunctionBlock,
+		FunctionBlock: &structs.Function{RangeFunction: sutils.Rate, TimeWindow: 300},
+	}
+	SetQueryResolution(mQuery)
+	assert.Equal(t, uint32(0), mQuery.RollupResolutionSec)
+
+	mQuery.SubsequentAggs = nil
+	mQuery.IsInstantQuery = true
+	SetQueryResolution(mQuery)
+	assert.Equal(t, uint32(0), mQuery.RollupResolutionSec)
+}
@@ -0,0 +1,382 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/instrumentation"
+)
+
+var ErrSeriesLimitExceeded = errors.New("series limit exceeded")
+
+const (
+	THROTTLE_REASON_SERIES_PER_ORG     = "series_per_org"
+	THROTTLE_REASON_SERIES_PER_METRIC  = "series_per_metric"
+	THROTTLE_REASON_VALUES_PER_TAG_KEY = "values_per_tag_key"
+)
+
+// How often series that are no longer active are removed from the limiters
+const SERIES_LIMITS_PURGE_INTERVAL_SECS = 60
+
+// ThrottledMetric is a metric that had samples rejected or tags dropped
+// because of a limit within the active series window.
+type ThrottledMetric struct {
+	MetricName          string `json:"metricName"`
+	Reason              string `json:"reason"`
+	TagKey              string `json:"tagKey,omitempty"`
+	Limit               uint64 `json:"limit"`
+	RejectedSamples     uint64 `json:"rejectedSamples"`
+	DroppedLabelSamples uint64 `json:"droppedLabelSamples"`
+	FirstThrottledEpoch int64  `json:"firstThrottledEpoch"`
+	LastThrottledEpoch  int64  `json:"lastThrottledEpoch"`
+}
+
+type limitedSeries struct {
+	mName    string
+	tags     []tagPair
+	lastSeen int64
+}
+
+type tagPair struct {
+	key   string
+	value string
+}
+
+// The active series of an org, along with the counts that the limits are
+// checked against.
+type orgSeriesLimiter struct {
+	series       map[uint64]*limitedSeries
+	metricSeries map[string]uint64
+	tagValues    map[string]map[string]map[string]uint64 // metric -> tag key -> tag value -> number of series
+	throttled    map[string]*ThrottledMetric
+	lastPurge    int64
+}
+
+var seriesLimitersLock sync.Mutex
+var seriesLimiters = make(map[int64]*orgSeriesLimiter)
+
+/*
+Checks a series that is not in the current block against the series limits of
+the org, and starts tracking it as an active series when it is admitted.
+
+Series that are already active are always admitted. With the drop_label
+action, the tag keys that are over their limit are removed, and the returned
+tags and tsid are those of the reduced series, which is checked against the
+other limits in turn. Returns ErrSeriesLimitExceeded when the sample has to be
+rejected.
+*/
+func admitSeries(mName []byte, tags *TagsHolder, tsid uint64, orgid int64) (*TagsHolder, uint64, error) {
+	limitsConfig := config.GetMetricsLimitsConfig()
+	now := time.Now().Unix()
+	windowSecs := int64(limitsConfig.ActiveSeriesWindowMins * 60)
+
+	seriesLimitersLock.Lock()
+	limiter, ok := seriesLimiters[orgid]
+	if !ok {
+		limiter = newOrgSeriesLimiter(now)
+		seriesLimiters[orgid] = limiter
+	}
+	if now-limiter.lastPurge >= SERIES_LIMITS_PURGE_INTERVAL_SECS {
+		// the blocks are checked without the lock, as that takes the lock of
+		// each segment and would block the ingestion of every org
+		candidates := limiter.getPurgeCandidates(now, windowSecs)
+		seriesLimitersLock.Unlock()
+		inCurrentBlock := getSeriesInCurrentBlock(candidates, orgid)
+		seriesLimitersLock.Lock()
+		limiter.purge(candidates, inCurrentBlock, now, windowSecs)
+	}
+	defer seriesLimitersLock.Unlock()
+
+	if series, ok := limiter.series[tsid]; ok {
+		series.lastSeen = now
+		return tags, tsid, nil
+	}
+	metricName := string(mName)
+
+	if limitsConfig.MaxValuesPerTagKey > 0 {
+		overKeys := limiter.getOverLimitTagKeys(metricName, tags, limitsConfig.MaxValuesPerTagKey)
+		if len(overKeys) > 0 {
+			dropLabels := limitsConfig.Action == config.METRICS_LIMITS_ACTION_DROP_LABEL
+			for tagKey := range overKeys {
+				throttled := limiter.getThrottledMetric(metricName, THROTTLE_REASON_VALUES_PER_TAG_KEY, tagKey, limitsConfig.MaxValuesPerTagKey, now)
+				if dropLabels {
+					throttled.DroppedLabelSamples++
+				} else {
+					throttled.RejectedSamples++
+				}
+			}
+			if !dropLabels {
+				instrumentation.IncrementInt64CounterWithLabel(instrumentation.METRICS_LIMITS_REJECTED_SAMPLES, 1, "reason", THROTTLE_REASON_VALUES_PER_TAG_KEY)
+				return nil, 0, ErrSeriesLimitExceeded
+			}
+			instrumentation.IncrementInt64Counter(instrumentation.METRICS_LIMITS_DROPPED_LABEL_SAMPLES, 1)
+
+			tags = tags.copyWithout(overKeys)
+			var err error
+			tsid, err = tags.GetTSID(mName)
+			if err != nil {
+				return nil, 0, err
+			}
+			if series, ok := limiter.series[tsid]; ok {
+				series.lastSeen = now
+				return tags, tsid, nil
+			}
+		}
+	}
+
+	if limitsConfig.MaxSeriesPerMetric > 0 && limiter.metricSeries[metricName] >= limitsConfig.MaxSeriesPerMetric {
+		limiter.getThrottledMetric(metricName, THROTTLE_REASON_SERIES_PER_METRIC, "", limitsConfig.MaxSeriesPerMetric, now).RejectedSamples++
+		instrumentation.IncrementInt64CounterWithLabel(instrumentation.METRICS_LIMITS_REJECTED_SAMPLES, 1, "reason", THROTTLE_REASON_SERIES_PER_METRIC)
+		return nil, 0, ErrSeriesLimitExceeded
+	}
+	if limitsConfig.MaxSeriesPerOrg > 0 && uint64(len(limiter.series)) >= limitsConfig.MaxSeriesPerOrg {
+		limiter.getThrottledMetric(metricName, THROTTLE_REASON_SERIES_PER_ORG, "", limitsConfig.MaxSeriesPerOrg, now).RejectedSamples++
+		instrumentation.IncrementInt64CounterWithLabel(instrumentation.METRICS_LIMITS_REJECTED_SAMPLES, 1, "reason", THROTTLE_REASON_SERIES_PER_ORG)
+		return nil, 0, ErrSeriesLimitExceeded
+	}
+
+	limiter.addSeries(tsid, metricName, tags, now)
+	return tags, tsid, nil
+}
+
+/*
+Returns the tags and tsid of the active series that the samples of the given
+series are written to, without admitting it. With the drop_label action this
+is the reduced series. Returns false when the series is not active, i.e. its
+samples were rejected.
+*/
+func getAdmittedSeries(mName []byte, tags *TagsHolder, tsid uint64, orgid int64) (*TagsHolder, uint64, bool) {
+	limitsConfig := config.GetMetricsLimitsConfig()
+
+	seriesLimitersLock.Lock()
+	defer seriesLimitersLock.Unlock()
+
+	limiter, ok := seriesLimiters[orgid]
+	if !ok {
+		return nil, 0, false
+	}
+	if _, ok := limiter.series[tsid]; ok {
+		return tags, tsid, true
+	}
+	if limitsConfig.MaxValuesPerTagKey == 0 || limitsConfig.Action != config.METRICS_LIMITS_ACTION_DROP_LABEL {
+		return nil, 0, false
+	}
+
+	overKeys := limiter.getOverLimitTagKeys(string(mName), tags, limitsConfig.MaxValuesPerTagKey)
+	if len(overKeys) == 0 {
+		return nil, 0, false
+	}
+	tags = tags.copyWithout(overKeys)
+	tsid, err := tags.GetTSID(mName)
+	if err != nil {
+		return nil, 0, false
+	}
+	if _, ok := limiter.series[tsid]; !ok {
+		return nil, 0, false
+	}
+	return tags, tsid, true
+}
+
+// Returns the tag keys of the series that have a new value while they are
+// already at the limit of values.
+func (osl *orgSeriesLimiter) getOverLimitTagKeys(metricName string, tags *TagsHolder, maxValues uint64) map[string]struct{} {
+	overKeys := make(map[string]struct{})
+	for _, entry := range tags.GetEntries() {
+		values := osl.tagValues[metricName][entry.tagKey]
+		if _, ok := values[string(entry.tagValue)]; !ok && uint64(len(values)) >= maxValues {
+			overKeys[entry.tagKey] = struct{}{}
+		}
+	}
+	return overKeys
+}
+
+func newOrgSeriesLimiter(now int64) *orgSeriesLimiter {
+	return &orgSeriesLimiter{
+		series:       make(map[uint64]*limitedSeries),
+		metricSeries: make(map[string]uint64),
+		tagValues:    make(map[string]map[string]map[string]uint64),
+		throttled:    make(map[string]*ThrottledMetric),
+		lastPurge:    now,
+	}
+}
+
+func (osl *orgSeriesLimiter) addSeries(tsid uint64, metricName string, tags *TagsHolder, now int64) {
+	entries := tags.GetEntries()
+	series := &limitedSeries{mName: metricName, tags: make([]tagPair, 0, len(entries)), lastSeen: now}
+
+	tagValues, ok := osl.tagValues[metricName]
+	if !ok {
+		tagValues = make(map[string]map[string]uint64)
+		osl.tagValues[metricName] = tagValues
+	}
+	for _, entry := range entries {
+		pair := tagPair{key: entry.tagKey, value: string(entry.tagValue)}
+		series.tags = append(series.tags, pair)
+		if _, ok := tagValues[pair.key]; !ok {
+			tagValues[pair.key] = make(map[string]uint64)
+		}
+		tagValues[pair.key][pair.value]++
+	}
+
+	osl.series[tsid] = series
+	osl.metricSeries[metricName]++
+}
+
+// Returns the metric names of the series that were not seen within the window,
+// and marks the limiter as purged.
+func (osl *orgSeriesLimiter) getPurgeCandidates(now int64, windowSecs int64) map[uint64]string {
+	osl.lastPurge = now
+	candidates := make(map[uint64]string)
+	for tsid, series := range osl.series {
+		if now-series.lastSeen >= windowSecs {
+			candidates[tsid] = series.mName
+		}
+	}
+	return candidates
+}
+
+func getSeriesInCurrentBlock(candidates map[uint64]string, orgid int64) map[uint64]struct{} {
+	inCurrentBlock := make(map[uint64]struct{})
+	for tsid, metricName := range candidates {
+		if isSeriesInCurrentBlock(metricName, tsid, orgid) {
+			inCurrentBlock[tsid] = struct{}{}
+		}
+	}
+	return inCurrentBlock
+}
+
+/*
+Removes the candidate series that are still not seen within the window, and
+the throttled metrics that were not throttled within it.
+
+A series is only seen by the limiter when it is added to a block, and blocks
+are rotated by size, so a series that is still in the current block of its
+segment is kept as active.
+*/
+func (osl *orgSeriesLimiter) purge(candidates map[uint64]string, inCurrentBlock map[uint64]struct{}, now int64, windowSecs int64) {
+	for tsid := range candidates {
+		series, ok := osl.series[tsid]
+		if !ok || now-series.lastSeen < windowSecs {
+			continue
+		}
+		if _, ok := inCurrentBlock[tsid]; ok {
+			series.lastSeen = now
+			continue
+		}
+		delete(osl.series, tsid)
+
+		osl.metricSeries[series.mName]--
+		if osl.metricSeries[series.mName] == 0 {
+			delete(osl.metricSeries, series.mName)
+		}
+		tagValues := osl.tagValues[series.mName]
+		for _, pair := range series.tags {
+			tagValues[pair.key][pair.value]--
+			if tagValues[pair.key][pair.value] == 0 {
+				delete(tagValues[pair.key], pair.value)
+			}
+			if len(tagValues[pair.key]) == 0 {
+				delete(tagValues, pair.key)
+			}
+		}
+		if len(tagValues) == 0 {
+			delete(osl.tagValues, series.mName)
+		}
+	}
+
+	for key, throttled := range osl.throttled {
+		if now-throttled.LastThrottledEpoch >= windowSecs {
+			delete(osl.throttled, key)
+		}
+	}
+}
+
+func isSeriesInCurrentBlock(metricName string, tsid uint64, orgid int64) bool {
+	mSeg, _, err := getMetricsSegment([]byte(metricName), orgid)
+	if err != nil || mSeg == nil {
+		return false
+	}
+	mSeg.rwLock.RLock()
+	defer mSeg.rwLock.RUnlock()
+	_, exists, err := mSeg.mBlock.GetTimeSeries(tsid)
+	return err == nil && exists
+}
+
+func (osl *orgSeriesLimiter) getThrottledMetric(metricName string, reason string, tagKey string, limit uint64, now int64) *ThrottledMetric {
+	key := metricName + "\x00" + reason + "\x00" + tagKey
+	throttled, ok := osl.throttled[key]
+	if !ok {
+		throttled = &ThrottledMetric{
+			MetricName:          metricName,
+			Reason:              reason,
+			TagKey:              tagKey,
+			FirstThrottledEpoch: now,
+		}
+		osl.throttled[key] = throttled
+	}
+	throttled.Limit = limit
+	throttled.LastThrottledEpoch = now
+	return throttled
+}
+
+// Returns the metrics of the org that were throttled within the active series
+// window, most recently throttled first.
+func GetThrottledMetrics(orgid int64) []ThrottledMetric {
+	windowSecs := int64(config.GetMetricsLimitsConfig().ActiveSeriesWindowMins * 60)
+	now := time.Now().Unix()
+
+	seriesLimitersLock.Lock()
+	throttledMetrics := make([]ThrottledMetric, 0)
+	if limiter, ok := seriesLimiters[orgid]; ok {
+		for _, throttled := range limiter.throttled {
+			if now-throttled.LastThrottledEpoch < windowSecs {
+				throttledMetrics = append(throttledMetrics, *throttled)
+			}
+		}
+	}
+	seriesLimitersLock.Unlock()
+
+	sort.Slice(throttledMetrics, func(i, j int) bool {
+		if throttledMetrics[i].LastThrottledEpoch != throttledMetrics[j].LastThrottledEpoch {
+			return throttledMetrics[i].LastThrottledEpoch > throttledMetrics[j].LastThrottledEpoch
+		}
+		return throttledMetrics[i].MetricName < throttledMetrics[j].MetricName
+	})
+	return throttledMetrics
+}
+
+// Returns the number of active series of the org that count towards its limit.
+func GetActiveSeriesCount(orgid int64) uint64 {
+	seriesLimitersLock.Lock()
+	defer seriesLimitersLock.Unlock()
+	if limiter, ok := seriesLimiters[orgid]; ok {
+		return uint64(len(limiter.series))
+	}
+	return 0
+}
+
+func resetSeriesLimiters() {
+	seriesLimitersLock.Lock()
+	defer seriesLimitersLock.Unlock()
+	seriesLimiters = make(map[int64]*orgSeriesLimiter)
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2021-2024 SigScalr, Inc.
+//
+// This file is part of SigLens Observability Solution
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"fmt"
+	"testing"
+
+	jp "github.com/buger/jsonparser"
+	"github.com/siglens/siglens/pkg/config"
+	"github.com/siglens/siglens/pkg/config/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func initSeriesLimitsTest(t *testing.T, limitsConfig common.MetricsLimitsConfig) {
+	config.InitializeTestingConfig(t.TempDir())
+	ResetMetricsSegStore_TestOnly()
+	config.GetRunningConfig().MetricsLimits = limitsConfig
+	t.Cleanup(func() {
+		config.GetRunningConfig().MetricsLimits = common.MetricsLimitsConfig{}
+		ResetMetricsSegStore_TestOnly()
+	})
+}
+
+func encodeTestDatapoint(mName string, tags map[string]string, orgid int64) error {
+	tagHolder := GetTagsHolder()
+	for key, value := range tags {
+		tagHolder.Insert(key, []byte(value), jp.String)
+	}
+	return EncodeDatapoint([]byte(mName), tagHolder, 1, 1700000000, 10, orgid)
+}
+
+func Test_SeriesLimits_Reject(t *testing.T) {
+	initSeriesLimitsTest(t, common.MetricsLimitsConfig{Enabled: true, MaxSeriesPerOrg: 3, MaxSeriesPerMetric: 2})
+
+	assert.NoError(t, encodeTestDatapoint("requests", map[string]string{"pod": "a"}, 0))
+	assert.NoError(t, encodeTestDatapoint("requests", map[string]string{"pod": "b"}, 0))
+	assert.Equal(t, ErrSeriesLimitExceeded, encodeTestDatapoint("requests", map[string]string{"pod": "c"}, 0))
+	assert.Equal(t, ErrSeriesLimitExceeded, encodeTestDatapoint("requests", map[string]string{"pod": "c"}, 0))
+
+	// existing series keep being written
+	assert.NoError(t, encodeTestDatapoint("requests", map[string]string{"pod": "a"}, 0))
+
+	assert.NoError(t, encodeTestDatapoint("errors", map[string]string{"pod": "a"}, 0))
+	assert.Equal(t, ErrSeriesLimitExceeded, encodeTestDatapoint("latency", nil, 0))
+
+	// the limits are per org
+	assert.NoError(t, encodeTestDatapoint("requests", map[string]string{"pod": "c"}, 1))
+
+	assert.Equal(t, uint64(3), GetActiveSeriesCount(0))
+	throttled := GetThrottledMetrics(0)
+	assert.Len(t, throttled, 2)
+	for _, metric := range throttled {
+		metric.FirstThrottledEpoch, metric.LastThrottledEpoch = 0, 0
+		switch metric.MetricName {
+		case "requests":
+			assert.Equal(t, ThrottledMetric{MetricName: "requests", Reason: THROTTLE_REASON_SERIES_PER_METRIC, Limit: 2, RejectedSamples: 2}, metric)
+		case "latency":
+			assert.Equal(t, ThrottledMetric{MetricName: "latency", Reason: THROTTLE_REASON_SERIES_PER_ORG, Limit: 3, RejectedSamples: 1}, metric)
+		default:
+			assert.Fail(t, fmt.Sprintf("unexpected throttled metric %+v", metric))
+		}
+	}
+	assert.Empty(t, GetThrottledMetrics(1))
+}
+
+func Test_SeriesLimits_DropLabel(t *testing.T) {
+	initSeriesLimitsTest(t, common.MetricsLimitsConfig{Enabled: true, MaxValuesPerTagKey: 2, Action: config.METRICS_LIMITS_ACTION_DROP_LABEL})
+
+	for _, user := range []string{"u1", "u2", "u3", "u4"} {
+		assert.NoError(t, encodeTestDatapoint("logins", map[string]string{"user": user, "region": "us"}, 0))
+	}
+	// u1 and u2 are separate series, while u3 and u4 share the series without the user tag
+	assert.Equal(t, uint64(3), GetActiveSeriesCount(0))
+
+	throttled := GetThrottledMetrics(0)
+	assert.Len(t, throttled, 1)
+	assert.Equal(t, "user", throttled[0].TagKey)
+	assert.Equal(t, uint64(2), throttled[0].DroppedLabelSamples)
+	assert.Equal(t, uint64(0), throttled[0].RejectedSamples)
+
+	mSeg, tth, err := getMetricsSegment([]byte("logins"), 0)
+	assert.NoError(t, err)
+	reduced := GetTagsHolder()
+	reduced.Insert("region", []byte("us"), jp.String)
+	tsid, err := reduced.GetTSID([]byte("logins"))
+	assert.NoError(t, err)
+	_, exists, err := mSeg.mBlock.GetTimeSeries(tsid)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.NotNil(t, tth)
+}
+
+func Test_SeriesLimits_Purge(t *testing.T) {
+	initSeriesLimitsTest(t, common.MetricsLimitsConfig{Enabled: true, MaxSeriesPerMetric: 1})
+
+	assert.NoError(t, encodeTestDatapoint("cpu", map[string]string{"host": "a"}, 0))
+	assert.Equal(t, ErrSeriesLimitExceeded, encodeTestDatapoint("cpu", map[string]string{"host": "b"}, 0))
+
+	// a stale series is kept while it is still in the current block
+	limiter := seriesLimiters[0]
+	for _, series := range limiter.series {
+		series.lastSeen = 0
+	}
+	candidates := limiter.getPurgeCandidates(7200, 3600)
+	limiter.purge(candidates, getSeriesInCurrentBlock(candidates, 0), 7200, 3600)
+	assert.Equal(t, uint64(1), GetActiveSeriesCount(0))
+
+	mSeg, _, err := getMetricsSegment([]byte("cpu"), 0)
+	assert.NoError(t, err)
+	// simulate a rotation of the block
+	mSeg.mBlock = initMetricsBlock("mock", 0, 1)
+	for _, series := range limiter.series {
+		series.lastSeen = 0
+	}
+	candidates = limiter.getPurgeCandidates(7200, 3600)
+	inCurrentBlock := getSeriesInCurrentBlock(candidates, 0)
+	assert.Empty(t, inCurrentBlock)
+
+	// a series that is seen while the blocks are checked is kept
+	for _, series := range limiter.series {
+		series.lastSeen = 7200
+	}
+	limiter.purge(candidates, inCurrentBlock, 7200, 3600)
+	assert.Equal(t, uint64(1), GetActiveSeriesCount(0))
+
+	for _, series := range limiter.series {
+		series.lastSeen = 0
+	}
+	candidates = limiter.getPurgeCandidates(7200, 3600)
+	limiter.purge(candidates, getSeriesInCurrentBlock(candidates, 0), 7200, 3600)
+	assert.Equal(t, uint64(0), GetActiveSeriesCount(0))
+	assert.Empty(t, limiter.metricSeries)
+	assert.Empty(t, limiter.tagValues)
+
+	tagHolder := GetTagsHolder()
+	tagHolder.Insert("host", []byte("b"), jp.String)
+	tsid, err := tagHolder.GetTSID([]byte("cpu"))
+	assert.NoError(t, err)
+	_, _, err = admitSeries([]byte("cpu"), tagHolder, tsid, 0)
+	assert.NoError(t, err)
+}
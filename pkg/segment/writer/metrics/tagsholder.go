@@ -160,3 +160,17 @@ func (te *tagEntry) GetTagValue() []byte {
 func (te *tagEntry) GetTagValueType() jp.ValueType {
 	return te.tagValueType
 }
+
+// Returns a copy of the tags without the given keys. The copy has its own
+// entries, so that dropping tags does not affect other datapoints that share
+// the holder.
+func (th *TagsHolder) copyWithout(keys map[string]struct{}) *TagsHolder {
+	holder := GetTagsHolder()
+	for _, entry := range th.GetEntries() {
+		if _, ok := keys[entry.tagKey]; ok {
+			continue
+		}
+		holder.Insert(entry.tagKey, entry.tagValue, entry.tagValueType)
+	}
+	return holder
+}
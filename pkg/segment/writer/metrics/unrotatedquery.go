@@ -63,8 +63,13 @@ func SearchUnrotatedMetricsBlock(mQuery *structs.MetricsQuery, segTsidInfo *tsid
 	}
 
 	localRes := mresults.InitMetricResults(mQuery, qid)
+	readHistograms := mQuery.HasHistogramFunction()
 
 	for tsid, tsGroupId := range segTsidInfo.GetAllTSIDs() {
+		if readHistograms {
+			localRes.AddHistogramSamples(tsid, tsGroupId, mSegment.mBlock.getHistogramSamples(tsid, timeRange))
+		}
+
 		found, tsitr, err := mSegment.mBlock.getUnrotatedBlockTimeSeriesIterator(tsid, bytesBuffer)
 		if err != nil {
 			log.Errorf("qid=%d, SearchUnrotatedMetricsBlock: failed to get time series iterator for tsid=%d, err=%v", qid, tsid, err)
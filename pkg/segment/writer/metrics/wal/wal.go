@@ -389,6 +389,198 @@ func (it *DPWalIterator) decodeWALBlock(blockBuf *bytes.Reader) error {
 	return nil
 }
 
+type WalHistogram struct {
+	Timestamp uint32
+	Tsid      uint64
+	Encoded   []byte // histogram.Histogram.Encode() output
+}
+
+type HistogramEncoder struct {
+	rawBlockBuf *bytes.Buffer
+	encodedBuf  []byte
+}
+
+func NewHistogramEncoder() *HistogramEncoder {
+	return &HistogramEncoder{
+		rawBlockBuf: new(bytes.Buffer),
+	}
+}
+
+/*
+Native Histogram WAL Format
+
+File Format:
+	Version:                1 Byte  // File format version
+
+	// Repeating Blocks Structure
+	[Block] {
+		BlockLen:               4 Bytes  // Size of this block (excluding this field)
+		Checksum:               4 Bytes  // CRC32 checksum for data integrity
+		ZstdEncoded Block:
+			NumOfSamples (N):   4 Bytes  // Number of histogram samples in this block
+			[Sample] {
+				Timestamp:      4 Bytes
+				Tsid:           8 Bytes
+				EncodedLen:     4 Bytes
+				EncodedHist:    Variable // Encoded histogram
+			}
+	}
+
+	Multiple such blocks are appended continuously.
+*/
+
+func (he *HistogramEncoder) PrepareEncode(input any) ([]byte, error) {
+	samples, ok := input.([]WalHistogram)
+	if !ok {
+		return nil, errors.New("invalid type for HistogramEncoder")
+	}
+	if len(samples) == 0 {
+		return nil, errors.New("empty histogram samples")
+	}
+
+	he.rawBlockBuf.Reset()
+	err := binary.Write(he.rawBlockBuf, binary.LittleEndian, uint32(len(samples)))
+	if err != nil {
+		log.Errorf("HistogramEncoder.PrepareEncode: failed to write sample count: %v", err)
+		return nil, err
+	}
+
+	for _, sample := range samples {
+		err = binary.Write(he.rawBlockBuf, binary.LittleEndian, sample.Timestamp)
+		if err == nil {
+			err = binary.Write(he.rawBlockBuf, binary.LittleEndian, sample.Tsid)
+		}
+		if err == nil {
+			err = binary.Write(he.rawBlockBuf, binary.LittleEndian, uint32(len(sample.Encoded)))
+		}
+		if err != nil {
+			log.Errorf("HistogramEncoder.PrepareEncode: failed to write sample of tsid %v: %v", sample.Tsid, err)
+			return nil, err
+		}
+		he.rawBlockBuf.Write(sample.Encoded)
+	}
+
+	encoderLock.Lock()
+	he.encodedBuf = encoder.EncodeAll(he.rawBlockBuf.Bytes(), he.encodedBuf[:0])
+	encoderLock.Unlock()
+	return he.encodedBuf, nil
+}
+
+type HistWalIterator struct {
+	fd           *os.File
+	readBuf      []byte
+	readSamples  []WalHistogram
+	currentIndex int
+}
+
+func NewHistWalReader(filePath string) (*HistWalIterator, error) {
+	fd, err := openAndValidateWALFile(filePath)
+	if err != nil {
+		log.Errorf("NewHistWalReader: validation failed for WAL file %s: %v", filePath, err)
+		return nil, err
+	}
+
+	return &HistWalIterator{
+		fd:          fd,
+		readBuf:     make([]byte, 0),
+		readSamples: make([]WalHistogram, 0),
+	}, nil
+}
+
+func (it *HistWalIterator) Close() error {
+	if it.fd != nil {
+		return it.fd.Close()
+	}
+	return errors.New("file descriptor is nil")
+}
+
+// Next returns the next histogram sample, or nil once the file is exhausted.
+// The returned sample owns its Encoded bytes.
+func (it *HistWalIterator) Next() (*WalHistogram, error) {
+	if it.currentIndex < len(it.readSamples) {
+		it.currentIndex++
+		return &it.readSamples[it.currentIndex-1], nil
+	}
+
+	var blockSize uint32
+	err := binary.Read(it.fd, binary.LittleEndian, &blockSize)
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	} else if err != nil {
+		log.Errorf("HistWalIterator.Next: failed to read block size from WAL file: %v", it.fd.Name())
+		return nil, err
+	}
+
+	if blockSize < Uint32Size { // Checking if block size is less than checksum size (4 bytes)
+		return nil, errors.New("invalid block size")
+	}
+
+	var checksum uint32
+	err = binary.Read(it.fd, binary.LittleEndian, &checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	it.readBuf = utils.ResizeSlice(it.readBuf, int(blockSize-Uint32Size))
+	_, err = io.ReadFull(it.fd, it.readBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(it.readBuf) != checksum {
+		log.Errorf("HistWalIterator.Next: checksum mismatch in file %s", it.fd.Name())
+		return nil, errors.New("checksum mismatch")
+	}
+
+	err = it.decodeHistBlock()
+	if err != nil {
+		log.Errorf("HistWalIterator.Next: failed to decode block: %v", err)
+		return nil, err
+	}
+	if len(it.readSamples) == 0 {
+		return nil, nil
+	}
+	it.currentIndex = 1
+	return &it.readSamples[0], nil
+}
+
+func (it *HistWalIterator) decodeHistBlock() error {
+	raw, err := decoder.DecodeAll(it.readBuf, nil)
+	if err != nil {
+		return err
+	}
+
+	rawReader := bytes.NewReader(raw)
+	var N uint32
+	err = binary.Read(rawReader, binary.LittleEndian, &N)
+	if err != nil {
+		return err
+	}
+
+	it.readSamples = utils.ResizeSlice(it.readSamples, int(N))
+	for i := range it.readSamples {
+		sample := &it.readSamples[i]
+		var encodedLen uint32
+		err = binary.Read(rawReader, binary.LittleEndian, &sample.Timestamp)
+		if err == nil {
+			err = binary.Read(rawReader, binary.LittleEndian, &sample.Tsid)
+		}
+		if err == nil {
+			err = binary.Read(rawReader, binary.LittleEndian, &encodedLen)
+		}
+		if err != nil {
+			return err
+		}
+		sample.Encoded = make([]byte, encodedLen)
+		_, err = io.ReadFull(rawReader, sample.Encoded)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 type MetricNameEncoder struct {
 	rawBlockBuf *bytes.Buffer
 	encodedBuf  []byte
@@ -661,6 +853,61 @@ func (it *MMetaEntryIterator) Next() (*structs.MetricsMeta, error) {
 	return it.entries[0], nil
 }
 
+// BlockIterator reads the raw blocks of a WAL file whose encoder does its own
+// serialization, like a JSON encoder, and leaves decoding to the caller.
+type BlockIterator struct {
+	fd      *os.File
+	readBuf []byte
+}
+
+func NewBlockReader(filePath string) (*BlockIterator, error) {
+	fd, err := openAndValidateWALFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockIterator{fd: fd}, nil
+}
+
+func (it *BlockIterator) Close() error {
+	if it.fd != nil {
+		return it.fd.Close()
+	}
+	return errors.New("file descriptor is nil")
+}
+
+// Next returns the data of the next block, or nil at the end of the file. The
+// data is only valid until the next call.
+func (it *BlockIterator) Next() ([]byte, error) {
+	var blockSize uint32
+	err := binary.Read(it.fd, binary.LittleEndian, &blockSize)
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if blockSize < Uint32Size {
+		return nil, errors.New("invalid block size")
+	}
+
+	var checksum uint32
+	err = binary.Read(it.fd, binary.LittleEndian, &checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	it.readBuf = utils.ResizeSlice(it.readBuf, int(blockSize-Uint32Size))
+	_, err = io.ReadFull(it.fd, it.readBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(it.readBuf) != checksum {
+		return nil, errors.New("checksum mismatch")
+	}
+	return it.readBuf, nil
+}
+
 func (w *Wal) Close() error {
 	if w.fd != nil {
 		return w.fd.Close()
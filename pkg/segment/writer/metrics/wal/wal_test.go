@@ -266,3 +266,36 @@ func TestMetaEntryWal(t *testing.T) {
 	assert.Equal(t, len(expected), i)
 
 }
+
+func TestHistogramWALAppendAndRead(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "hist.wal")
+	wal, err := NewWAL(filePath, NewHistogramEncoder())
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	first := []WalHistogram{
+		{Timestamp: 100, Tsid: 1, Encoded: []byte{1, 2, 3}},
+		{Timestamp: 101, Tsid: 2, Encoded: []byte{}},
+	}
+	second := []WalHistogram{
+		{Timestamp: 102, Tsid: 1, Encoded: []byte{4, 5}},
+	}
+	assert.NoError(t, wal.Append(first))
+	assert.NoError(t, wal.Append(second))
+
+	it, err := NewHistWalReader(filePath)
+	assert.NoError(t, err)
+	defer it.Close()
+
+	var read []WalHistogram
+	for {
+		sample, err := it.Next()
+		assert.NoError(t, err)
+		if sample == nil {
+			break
+		}
+		read = append(read, *sample)
+	}
+
+	assert.Equal(t, append(first, second...), read)
+}
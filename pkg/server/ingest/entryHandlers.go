@@ -28,6 +28,7 @@ import (
 	"github.com/siglens/siglens/pkg/health"
 	"github.com/siglens/siglens/pkg/hooks"
 	"github.com/siglens/siglens/pkg/instrumentation"
+	influxwriter "github.com/siglens/siglens/pkg/integrations/influx/writer"
 	"github.com/siglens/siglens/pkg/integrations/loki"
 	otsdbwriter "github.com/siglens/siglens/pkg/integrations/otsdb/writer"
 	prometheuswriter "github.com/siglens/siglens/pkg/integrations/prometheus/ingest"
@@ -127,6 +128,18 @@ func otsdbPutMetricsHandler() func(ctx *fasthttp.RequestCtx) {
 	}
 }
 
+func influxV1PutMetricsHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyId(influxwriter.PutMetricsV1, ctx)
+	}
+}
+
+func influxV2PutMetricsHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyId(influxwriter.PutMetricsV2, ctx)
+	}
+}
+
 func esGreetHandler() func(ctx *fasthttp.RequestCtx) {
 	return func(ctx *fasthttp.RequestCtx) {
 		esutils.ProcessGreetHandler(ctx)
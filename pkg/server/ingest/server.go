@@ -131,6 +131,10 @@ func (hs *ingestionServerCfg) Run() (err error) {
 	hs.router.PUT(server_utils.OTSDB_PREFIX+"/api/put", hs.Recovery(otsdbPutMetricsHandler()))
 	hs.router.POST(server_utils.OTSDB_PREFIX+"/api/put", hs.Recovery(otsdbPutMetricsHandler()))
 
+	// InfluxDB line protocol Handlers
+	hs.router.POST(server_utils.INFLUX_PREFIX+"/write", hs.Recovery(influxV1PutMetricsHandler()))
+	hs.router.POST(server_utils.INFLUX_PREFIX+"/api/v2/write", hs.Recovery(influxV2PutMetricsHandler()))
+
 	// Prometheus Handlers
 	hs.router.POST(server_utils.PROMQL_PREFIX+"/api/v1/write", hs.Recovery(prometheusPutMetricsHandler()))
 
@@ -34,8 +34,11 @@ import (
 	"github.com/siglens/siglens/pkg/health"
 	"github.com/siglens/siglens/pkg/hooks"
 	"github.com/siglens/siglens/pkg/instrumentation"
+	"github.com/siglens/siglens/pkg/integrations/graphite"
 	otsdbquery "github.com/siglens/siglens/pkg/integrations/otsdb/query"
 	prom "github.com/siglens/siglens/pkg/integrations/prometheus/promql"
+	"github.com/siglens/siglens/pkg/integrations/prometheus/rules"
+	"github.com/siglens/siglens/pkg/integrations/prometheus/scrape"
 	lookups "github.com/siglens/siglens/pkg/lookups"
 	"github.com/siglens/siglens/pkg/querytracker"
 	"github.com/siglens/siglens/pkg/sampledataset"
@@ -140,6 +143,96 @@ func promqlGetSeriesByLabelHandler() func(ctx *fasthttp.RequestCtx) {
 		serverutils.CallWithMyIdQuery(prom.ProcessGetSeriesByLabelRequest, ctx)
 	}
 }
+
+func promqlRemoteReadHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(prom.ProcessRemoteReadRequest, ctx)
+	}
+}
+
+func promqlGetRulesHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(rules.ProcessGetRulesStatusRequest, ctx)
+	}
+}
+
+func promqlGetAlertsHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessGetPrometheusAlertsRequest, ctx)
+	}
+}
+
+func promqlGetTargetsHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(scrape.ProcessGetTargetsRequest, ctx)
+	}
+}
+
+func promqlGetTargetsMetadataHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(scrape.ProcessGetTargetsMetadataRequest, ctx)
+	}
+}
+
+func promqlGetMetadataHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(prom.ProcessGetMetricMetadataRequest, ctx)
+	}
+}
+
+func promqlQueryExemplarsHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(prom.ProcessQueryExemplarsRequest, ctx)
+	}
+}
+
+func graphiteRenderHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(graphite.ProcessRenderRequest, ctx)
+	}
+}
+
+func graphiteFindHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(graphite.ProcessFindRequest, ctx)
+	}
+}
+
+func getRecordingRuleGroupsHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(rules.ProcessGetRuleGroupsRequest, ctx)
+	}
+}
+
+func getRecordingRuleGroupHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(rules.ProcessGetRuleGroupRequest, ctx)
+	}
+}
+
+func uploadRecordingRuleGroupsHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(rules.ProcessUploadRuleGroupsRequest, ctx)
+	}
+}
+
+func createRecordingRuleGroupHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(rules.ProcessCreateRuleGroupRequest, ctx)
+	}
+}
+
+func updateRecordingRuleGroupHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(rules.ProcessUpdateRuleGroupRequest, ctx)
+	}
+}
+
+func deleteRecordingRuleGroupHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(rules.ProcessDeleteRuleGroupRequest, ctx)
+	}
+}
 func uiMetricsSearchHandler() func(ctx *fasthttp.RequestCtx) {
 	return func(ctx *fasthttp.RequestCtx) {
 		serverutils.CallWithMyIdQuery(prom.ProcessUiMetricsSearchRequest, ctx)
@@ -182,6 +275,36 @@ func getTagKeysWithMostSeriesHandler() func(ctx *fasthttp.RequestCtx) {
 	}
 }
 
+func getThrottledMetricsHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(prom.ProcessGetThrottledMetricsRequest, ctx)
+	}
+}
+
+func getMetricRelabelRulesHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(prom.ProcessGetMetricRelabelRulesRequest, ctx)
+	}
+}
+
+func putMetricRelabelRulesHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(prom.ProcessPutMetricRelabelRulesRequest, ctx)
+	}
+}
+
+func deleteMetricRelabelRulesHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(prom.ProcessDeleteMetricRelabelRulesRequest, ctx)
+	}
+}
+
+func testMetricRelabelRulesHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(prom.ProcessTestMetricRelabelRulesRequest, ctx)
+	}
+}
+
 func getTagPairsWithMostSeriesHandler() func(ctx *fasthttp.RequestCtx) {
 	return func(ctx *fasthttp.RequestCtx) {
 		serverutils.CallWithMyIdQuery(prom.ProcessGetTagPairsWithMostSeriesRequest, ctx)
@@ -536,6 +659,138 @@ func unsilenceAlertHandler() fasthttp.RequestHandler {
 	}
 }
 
+func createSilenceHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessCreateSilenceRequest, ctx)
+	}
+}
+
+func getAllSilencesHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessGetAllSilencesRequest, ctx)
+	}
+}
+
+func updateSilenceHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		alertsHandler.ProcessUpdateSilenceRequest(ctx)
+	}
+}
+
+func deleteSilenceHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		alertsHandler.ProcessDeleteSilenceRequest(ctx)
+	}
+}
+
+func createMaintenanceWindowHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessCreateMaintenanceWindowRequest, ctx)
+	}
+}
+
+func getAllMaintenanceWindowsHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessGetAllMaintenanceWindowsRequest, ctx)
+	}
+}
+
+func updateMaintenanceWindowHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		alertsHandler.ProcessUpdateMaintenanceWindowRequest(ctx)
+	}
+}
+
+func deleteMaintenanceWindowHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		alertsHandler.ProcessDeleteMaintenanceWindowRequest(ctx)
+	}
+}
+
+func getNotificationRoutingHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessGetNotificationRoutingRequest, ctx)
+	}
+}
+
+func updateNotificationRoutingHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessUpdateNotificationRoutingRequest, ctx)
+	}
+}
+
+func deleteNotificationRoutingHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessDeleteNotificationRoutingRequest, ctx)
+	}
+}
+
+func importPrometheusRulesHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessImportPrometheusRulesRequest, ctx)
+	}
+}
+
+func previewNotificationTemplateHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessPreviewNotificationTemplateRequest, ctx)
+	}
+}
+
+func getAlertLeaderHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		alertsHandler.ProcessGetAlertLeaderRequest(ctx)
+	}
+}
+
+func exportAlertsHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessExportAlertsRequest, ctx)
+	}
+}
+
+func importAlertsHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessImportAlertsRequest, ctx)
+	}
+}
+
+func getDeliveryLogHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessGetDeliveryLogRequest, ctx)
+	}
+}
+
+func getDeadLettersHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessGetDeadLettersRequest, ctx)
+	}
+}
+
+func resendDeadLettersHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessResendDeadLettersRequest, ctx)
+	}
+}
+
+func deleteDeadLettersHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessDeleteDeadLettersRequest, ctx)
+	}
+}
+
+func postExternalAlertsHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessPostExternalAlertsRequest, ctx)
+	}
+}
+
+func getExternalAlertsHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(alertsHandler.ProcessGetExternalAlertsRequest, ctx)
+	}
+}
+
 func testContactPointHandler() func(ctx *fasthttp.RequestCtx) {
 	return func(ctx *fasthttp.RequestCtx) {
 		alertsHandler.ProcessTestContactPointRequest(ctx)
@@ -572,6 +827,12 @@ func alertHistoryHandler() func(ctx *fasthttp.RequestCtx) {
 	}
 }
 
+func alertInstancesHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		alertsHandler.ProcessGetAlertInstancesRequest(ctx)
+	}
+}
+
 func deleteAlertHandler() func(ctx *fasthttp.RequestCtx) {
 	return func(ctx *fasthttp.RequestCtx) {
 		alertsHandler.ProcessDeleteAlertRequest(ctx)
@@ -685,6 +946,18 @@ func generateDependencyGraphHandler() func(ctx *fasthttp.RequestCtx) {
 	}
 }
 
+func traceLogsHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(tracinghandler.ProcessTraceLogsRequest, ctx)
+	}
+}
+
+func logTraceHandler() func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		serverutils.CallWithMyIdQuery(tracinghandler.ProcessLogTraceRequest, ctx)
+	}
+}
+
 func ganttChartHandler() func(ctx *fasthttp.RequestCtx) {
 	return func(ctx *fasthttp.RequestCtx) {
 		serverutils.CallWithMyIdQuery(tracinghandler.ProcessGanttChartRequest, ctx)
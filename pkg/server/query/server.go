@@ -29,6 +29,7 @@ import (
 	"github.com/siglens/siglens/pkg/alerts/alertsHandler"
 	"github.com/siglens/siglens/pkg/config"
 	"github.com/siglens/siglens/pkg/hooks"
+	"github.com/siglens/siglens/pkg/integrations/prometheus/rules"
 	"github.com/siglens/siglens/pkg/segment/query"
 	"github.com/siglens/siglens/pkg/server"
 	server_utils "github.com/siglens/siglens/pkg/server/utils"
@@ -94,6 +95,8 @@ func (hs *queryserverCfg) Run(htmlTemplate *htmltemplate.Template, textTemplate
 
 	alertsHandler.InitAlertingService(server_utils.GetMyIds)
 	alertsHandler.InitMinionSearchService(server_utils.GetMyIds)
+	rules.InitRecordingRules(server_utils.GetMyIds)
+	rules.SetAlertingRuleGroupsProvider(alertsHandler.GetAlertingRuleGroupStatuses)
 
 	hs.Router.GET("/{filename}.html", func(ctx *fasthttp.RequestCtx) {
 		renderHtmlTemplate(ctx, htmlTemplate)
@@ -187,6 +190,28 @@ func (hs *queryserverCfg) Run(htmlTemplate *htmltemplate.Template, textTemplate
 	hs.Router.GET(server_utils.PROMQL_PREFIX+"/api/v1/label/{labelName}/values", hs.Recovery(promqlGetLabelValuesHandler()))
 	hs.Router.GET(server_utils.PROMQL_PREFIX+"/api/v1/series", hs.Recovery(promqlGetSeriesByLabelHandler()))
 	hs.Router.POST(server_utils.PROMQL_PREFIX+"/api/v1/series", hs.Recovery(promqlGetSeriesByLabelHandler()))
+	hs.Router.POST(server_utils.PROMQL_PREFIX+"/api/v1/read", hs.Recovery(promqlRemoteReadHandler()))
+	hs.Router.GET(server_utils.PROMQL_PREFIX+"/api/v1/rules", hs.Recovery(promqlGetRulesHandler()))
+	hs.Router.GET(server_utils.PROMQL_PREFIX+"/api/v1/alerts", hs.Recovery(promqlGetAlertsHandler()))
+	hs.Router.GET(server_utils.PROMQL_PREFIX+"/api/v1/targets", hs.Recovery(promqlGetTargetsHandler()))
+	hs.Router.GET(server_utils.PROMQL_PREFIX+"/api/v1/targets/metadata", hs.Recovery(promqlGetTargetsMetadataHandler()))
+	hs.Router.GET(server_utils.PROMQL_PREFIX+"/api/v1/metadata", hs.Recovery(promqlGetMetadataHandler()))
+	hs.Router.GET(server_utils.PROMQL_PREFIX+"/api/v1/query_exemplars", hs.Recovery(promqlQueryExemplarsHandler()))
+	hs.Router.POST(server_utils.PROMQL_PREFIX+"/api/v1/query_exemplars", hs.Recovery(promqlQueryExemplarsHandler()))
+
+	// graphite endpoints
+	hs.Router.GET(server_utils.GRAPHITE_PREFIX+"/render", hs.Recovery(graphiteRenderHandler()))
+	hs.Router.POST(server_utils.GRAPHITE_PREFIX+"/render", hs.Recovery(graphiteRenderHandler()))
+	hs.Router.GET(server_utils.GRAPHITE_PREFIX+"/metrics/find", hs.Recovery(graphiteFindHandler()))
+	hs.Router.POST(server_utils.GRAPHITE_PREFIX+"/metrics/find", hs.Recovery(graphiteFindHandler()))
+
+	// recording rules endpoints
+	hs.Router.GET(server_utils.API_PREFIX+"/recording-rules", hs.Recovery(getRecordingRuleGroupsHandler()))
+	hs.Router.POST(server_utils.API_PREFIX+"/recording-rules", hs.Recovery(createRecordingRuleGroupHandler()))
+	hs.Router.POST(server_utils.API_PREFIX+"/recording-rules/upload", hs.Recovery(uploadRecordingRuleGroupsHandler()))
+	hs.Router.GET(server_utils.API_PREFIX+"/recording-rules/{groupName}", hs.Recovery(getRecordingRuleGroupHandler()))
+	hs.Router.PUT(server_utils.API_PREFIX+"/recording-rules/{groupName}", hs.Recovery(updateRecordingRuleGroupHandler()))
+	hs.Router.DELETE(server_utils.API_PREFIX+"/recording-rules/{groupName}", hs.Recovery(deleteRecordingRuleGroupHandler()))
 
 	// metric explorer endpoint
 	hs.Router.POST(server_utils.METRIC_PREFIX+"/api/v1/metric_names", hs.Recovery(getAllMetricNamesHandler()))
@@ -195,6 +220,11 @@ func (hs *queryserverCfg) Run(htmlTemplate *htmltemplate.Template, textTemplate
 	hs.Router.GET(server_utils.METRIC_PREFIX+"/api/v1/functions", hs.Recovery(getMetricFunctionsHandler()))
 	hs.Router.POST(server_utils.METRIC_PREFIX+"/api/v1/series-cardinality", hs.Recovery(getMetricSeriesCardinalityHandler()))
 	hs.Router.POST(server_utils.METRIC_PREFIX+"/api/v1/tag-keys-with-most-series", hs.Recovery(getTagKeysWithMostSeriesHandler()))
+	hs.Router.GET(server_utils.METRIC_PREFIX+"/api/v1/throttled-metrics", hs.Recovery(getThrottledMetricsHandler()))
+	hs.Router.GET(server_utils.METRIC_PREFIX+"/api/v1/relabel-rules", hs.Recovery(getMetricRelabelRulesHandler()))
+	hs.Router.PUT(server_utils.METRIC_PREFIX+"/api/v1/relabel-rules", hs.Recovery(putMetricRelabelRulesHandler()))
+	hs.Router.DELETE(server_utils.METRIC_PREFIX+"/api/v1/relabel-rules", hs.Recovery(deleteMetricRelabelRulesHandler()))
+	hs.Router.POST(server_utils.METRIC_PREFIX+"/api/v1/relabel-rules/test", hs.Recovery(testMetricRelabelRulesHandler()))
 	hs.Router.POST(server_utils.METRIC_PREFIX+"/api/v1/tag-pairs-with-most-series", hs.Recovery(getTagPairsWithMostSeriesHandler()))
 	hs.Router.POST(server_utils.METRIC_PREFIX+"/api/v1/tag-keys-with-most-values", hs.Recovery(getTagKeysWithMostValuesHandler()))
 
@@ -237,12 +267,37 @@ func (hs *queryserverCfg) Run(htmlTemplate *htmltemplate.Template, textTemplate
 	hs.Router.POST(server_utils.API_PREFIX+"/alerts/update", hs.Recovery(updateAlertHandler()))
 	hs.Router.DELETE(server_utils.API_PREFIX+"/alerts/delete", hs.Recovery(deleteAlertHandler()))
 	hs.Router.GET(server_utils.API_PREFIX+"/alerts/{alertID}/history", hs.Recovery(alertHistoryHandler()))
+	hs.Router.GET(server_utils.API_PREFIX+"/alerts/{alertID}/instances", hs.Recovery(alertInstancesHandler()))
 	hs.Router.POST(server_utils.API_PREFIX+"/alerts/createContact", hs.Recovery(createContactHandler()))
 	hs.Router.GET(server_utils.API_PREFIX+"/alerts/allContacts", hs.Recovery(getAllContactsHandler()))
 	hs.Router.POST(server_utils.API_PREFIX+"/alerts/updateContact", hs.Recovery(updateContactHandler()))
 	hs.Router.DELETE(server_utils.API_PREFIX+"/alerts/deleteContact", hs.Recovery(deleteContactHandler()))
 	hs.Router.PUT(server_utils.API_PREFIX+"/alerts/silenceAlert", hs.Recovery(silenceAlertHandler()))
 	hs.Router.PUT(server_utils.API_PREFIX+"/alerts/unsilenceAlert", hs.Recovery(unsilenceAlertHandler()))
+	hs.Router.POST(server_utils.API_PREFIX+"/alerts/createSilence", hs.Recovery(createSilenceHandler()))
+	hs.Router.GET(server_utils.API_PREFIX+"/alerts/allSilences", hs.Recovery(getAllSilencesHandler()))
+	hs.Router.POST(server_utils.API_PREFIX+"/alerts/updateSilence", hs.Recovery(updateSilenceHandler()))
+	hs.Router.DELETE(server_utils.API_PREFIX+"/alerts/deleteSilence", hs.Recovery(deleteSilenceHandler()))
+	hs.Router.POST(server_utils.API_PREFIX+"/alerts/createMaintenanceWindow", hs.Recovery(createMaintenanceWindowHandler()))
+	hs.Router.GET(server_utils.API_PREFIX+"/alerts/allMaintenanceWindows", hs.Recovery(getAllMaintenanceWindowsHandler()))
+	hs.Router.POST(server_utils.API_PREFIX+"/alerts/updateMaintenanceWindow", hs.Recovery(updateMaintenanceWindowHandler()))
+	hs.Router.DELETE(server_utils.API_PREFIX+"/alerts/deleteMaintenanceWindow", hs.Recovery(deleteMaintenanceWindowHandler()))
+	hs.Router.GET(server_utils.API_PREFIX+"/alerts/notificationRouting", hs.Recovery(getNotificationRoutingHandler()))
+	hs.Router.POST(server_utils.API_PREFIX+"/alerts/updateNotificationRouting", hs.Recovery(updateNotificationRoutingHandler()))
+	hs.Router.DELETE(server_utils.API_PREFIX+"/alerts/deleteNotificationRouting", hs.Recovery(deleteNotificationRoutingHandler()))
+	hs.Router.POST(server_utils.API_PREFIX+"/alerts/importPrometheusRules", hs.Recovery(importPrometheusRulesHandler()))
+	hs.Router.POST(server_utils.API_PREFIX+"/alerts/previewTemplate", hs.Recovery(previewNotificationTemplateHandler()))
+	hs.Router.GET(server_utils.API_PREFIX+"/alerts/leader", hs.Recovery(getAlertLeaderHandler()))
+	hs.Router.GET(server_utils.API_PREFIX+"/alerts/export", hs.Recovery(exportAlertsHandler()))
+	hs.Router.POST(server_utils.API_PREFIX+"/alerts/import", hs.Recovery(importAlertsHandler()))
+	hs.Router.GET(server_utils.API_PREFIX+"/alerts/deliveryLog", hs.Recovery(getDeliveryLogHandler()))
+	hs.Router.GET(server_utils.API_PREFIX+"/alerts/deadLetters", hs.Recovery(getDeadLettersHandler()))
+	hs.Router.POST(server_utils.API_PREFIX+"/alerts/resendDeadLetters", hs.Recovery(resendDeadLettersHandler()))
+	hs.Router.DELETE(server_utils.API_PREFIX+"/alerts/deleteDeadLetters", hs.Recovery(deleteDeadLettersHandler()))
+
+	// Alertmanager API for alerts of external Prometheus servers
+	hs.Router.POST(server_utils.ALERTMANAGER_PREFIX+"/api/v2/alerts", hs.Recovery(postExternalAlertsHandler()))
+	hs.Router.GET(server_utils.ALERTMANAGER_PREFIX+"/api/v2/alerts", hs.Recovery(getExternalAlertsHandler()))
 
 	hs.Router.POST(server_utils.API_PREFIX+"/alerts/testContactPoint", hs.Recovery(testContactPointHandler()))
 	hs.Router.GET(server_utils.API_PREFIX+"/minionsearch/allMinionSearches", hs.Recovery(getAllMinionSearchesHandler()))
@@ -256,6 +311,8 @@ func (hs *queryserverCfg) Run(htmlTemplate *htmltemplate.Template, textTemplate
 	hs.Router.POST(server_utils.API_PREFIX+"/traces/ganttChart", tracing.TraceMiddleware(hs.Recovery(ganttChartHandler())))
 	hs.Router.POST(server_utils.API_PREFIX+"/traces/span/ganttChart", tracing.TraceMiddleware(hs.Recovery(spanGanttChartHandler())))
 	hs.Router.POST(server_utils.API_PREFIX+"/traces/count", tracing.TraceMiddleware(hs.Recovery((totalTracesHandler()))))
+	hs.Router.POST(server_utils.API_PREFIX+"/traces/logs", tracing.TraceMiddleware(hs.Recovery(traceLogsHandler())))
+	hs.Router.POST(server_utils.API_PREFIX+"/logs/trace", tracing.TraceMiddleware(hs.Recovery(logTraceHandler())))
 	// query server should still setup ES APIs for Kibana integration
 	hs.Router.POST(server_utils.ELASTIC_PREFIX+"/_bulk", hs.Recovery(esPostBulkHandler()))
 	hs.Router.PUT(server_utils.ELASTIC_PREFIX+"/{indexName}", hs.Recovery(esPutIndexHandler()))
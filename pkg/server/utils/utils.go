@@ -32,6 +32,8 @@ import (
 
 const ELASTIC_PREFIX string = "/elastic"
 const OTSDB_PREFIX string = "/otsdb"
+const INFLUX_PREFIX string = "/influx"
+const GRAPHITE_PREFIX string = "/graphite"
 const PROMQL_PREFIX string = "/promql"
 const OTLP_PREFIX string = "/otlp"
 const API_PREFIX string = "/api"
@@ -39,6 +41,7 @@ const LOKI_PREFIX string = "/loki"
 const HEROKU_ADDON_PREFIX string = "/heroku/resources"
 const METRIC_PREFIX string = "/metrics-explorer"
 const JAEGER_PREFIX string = "/jaeger"
+const ALERTMANAGER_PREFIX string = "/alertmanager"
 
 // This function reduces some boilerplate code by handling the logic for
 // injecting orgId if necessary, or using the default.
@@ -62,7 +62,7 @@ var aliasToIndexNames map[int64]map[string]map[string]bool = make(map[int64]map[
 // holds all the tables for orgid -> tname -> bool
 var allVirtualTables map[int64]map[string]bool
 
-var excludedInternalIndices = [...]string{"traces", "red-traces", "service-dependency"}
+var excludedInternalIndices = [...]string{"traces", "red-traces", "service-dependency", "service-dependency-edges"}
 
 func InitVTable(fnMyIds func() []int64) error {
 	allVirtualTables = make(map[int64]map[string]bool)
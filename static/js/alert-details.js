@@ -26,6 +26,11 @@ let mapIndexToConditionType = new Map([
     [1, 'Is below'],
     [2, 'Equal to'],
     [3, 'Not equal to'],
+    [5, 'Is above or equal to'],
+    [6, 'Is below or equal to'],
+    [7, 'Is anomalous'],
+    [8, 'Deviates from season'],
+    [9, 'Changes by percent'],
 ]);
 
 let mapIndexToAlertState = new Map([
@@ -35,6 +35,11 @@ let mapConditionTypeToIndex = new Map([
     ['Is below', 1],
     ['Equal to', 2],
     ['Not equal to', 3],
+    ['Is above or equal to', 5],
+    ['Is below or equal to', 6],
+    ['Is anomalous', 7],
+    ['Deviates from season', 8],
+    ['Changes by percent', 9],
 ]);
 
 let mapIndexToConditionType = new Map([
@@ -42,6 +47,11 @@ let mapIndexToConditionType = new Map([
     [1, 'Is below'],
     [2, 'Equal to'],
     [3, 'Not equal to'],
+    [5, 'Is above or equal to'],
+    [6, 'Is below or equal to'],
+    [7, 'Is anomalous'],
+    [8, 'Deviates from season'],
+    [9, 'Changes by percent'],
 ]);
 
 const alertForm = $('#alert-form');